@@ -0,0 +1,193 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"google.golang.org/api/iterator"
+)
+
+const benchBucketName = "bench"
+
+type benchConfig struct {
+	backend     string
+	fsRoot      string
+	concurrency int
+	objects     int
+	objectSize  int
+	listings    int
+}
+
+type benchResult struct {
+	operation string
+	errors    int
+	elapsed   time.Duration
+	latencies []time.Duration
+}
+
+func loadBenchConfig(args []string) (benchConfig, error) {
+	var cfg benchConfig
+	fs := flag.NewFlagSet("fake-gcs-server bench", flag.ContinueOnError)
+	fs.StringVar(&cfg.backend, "backend", "memory", "storage backend to benchmark (memory, filesystem or bolt)")
+	fs.StringVar(&cfg.fsRoot, "filesystem-root", "", "filesystem root for the filesystem and bolt backends. a temporary directory is used by default")
+	fs.IntVar(&cfg.concurrency, "concurrency", 8, "number of concurrent clients")
+	fs.IntVar(&cfg.objects, "objects", 1000, "number of objects to upload and download")
+	fs.IntVar(&cfg.objectSize, "object-size", 4096, "size of each object, in bytes")
+	fs.IntVar(&cfg.listings, "listings", 100, "number of full listings of the bucket")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if cfg.backend != "memory" && cfg.backend != "filesystem" && cfg.backend != "bolt" {
+		return cfg, fmt.Errorf(`invalid backend %q, must be either "memory", "filesystem" or "bolt"`, cfg.backend)
+	}
+	if cfg.concurrency < 1 || cfg.objects < 1 || cfg.objectSize < 0 || cfg.listings < 0 {
+		return cfg, errors.New("concurrency and objects must be positive, object-size and listings can't be negative")
+	}
+	return cfg, nil
+}
+
+// runBench drives uploads, downloads and listings against an in-process
+// server, and writes the throughput and latency percentiles of each
+// operation to w.
+func runBench(args []string, w io.Writer) error {
+	cfg, err := loadBenchConfig(args)
+	if err != nil {
+		return err
+	}
+	opts := fakestorage.Options{NoListener: true}
+	if cfg.backend != "memory" {
+		opts.BoltBackend = cfg.backend == "bolt"
+		opts.StorageRoot = cfg.fsRoot
+		if opts.StorageRoot == "" {
+			dir, err := os.MkdirTemp("", "fake-gcs-server-bench")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			opts.StorageRoot = dir
+		}
+	}
+	server, err := fakestorage.NewServerWithOptions(opts)
+	if err != nil {
+		return err
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: benchBucketName})
+	bucket := server.Client().Bucket(benchBucketName)
+	content := bytes.Repeat([]byte("a"), cfg.objectSize)
+
+	results := []benchResult{
+		runBenchOperation("upload", cfg.objects, cfg.concurrency, func(i int) error {
+			w := bucket.Object(benchObjectName(i)).NewWriter(context.Background())
+			if _, err := w.Write(content); err != nil {
+				w.Close()
+				return err
+			}
+			return w.Close()
+		}),
+		runBenchOperation("download", cfg.objects, cfg.concurrency, func(i int) error {
+			r, err := bucket.Object(benchObjectName(i)).NewReader(context.Background())
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = io.Copy(io.Discard, r)
+			return err
+		}),
+		runBenchOperation("list", cfg.listings, cfg.concurrency, func(int) error {
+			it := bucket.Objects(context.Background(), nil)
+			for {
+				_, err := it.Next()
+				if err == iterator.Done {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}),
+	}
+
+	fmt.Fprintf(w, "backend: %s, concurrency: %d, objects: %d, object size: %d bytes\n\n", cfg.backend, cfg.concurrency, cfg.objects, cfg.objectSize)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "operation\tcount\terrors\tops/s\tp50\tp90\tp99\tmax")
+	for _, result := range results {
+		if len(result.latencies) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\n",
+			result.operation,
+			len(result.latencies),
+			result.errors,
+			float64(len(result.latencies))/result.elapsed.Seconds(),
+			percentile(result.latencies, 50),
+			percentile(result.latencies, 90),
+			percentile(result.latencies, 99),
+			result.latencies[len(result.latencies)-1],
+		)
+	}
+	return tw.Flush()
+}
+
+func benchObjectName(i int) string {
+	return fmt.Sprintf("objects/%08d", i)
+}
+
+// runBenchOperation calls op n times across the given number of goroutines,
+// recording the latency of each call. The returned latencies are sorted.
+func runBenchOperation(operation string, n, concurrency int, op func(i int) error) benchResult {
+	result := benchResult{operation: operation, latencies: make([]time.Duration, n)}
+	indexes := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for g := 0; g < concurrency; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				opStart := time.Now()
+				err := op(i)
+				result.latencies[i] = time.Since(opStart)
+				if err != nil {
+					mu.Lock()
+					result.errors++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	sort.Slice(result.latencies, func(i, j int) bool {
+		return result.latencies[i] < result.latencies[j]
+	})
+	return result
+}
+
+// percentile returns the nearest-rank percentile p of the sorted latencies.
+func percentile(latencies []time.Duration, p int) time.Duration {
+	rank := (p*len(latencies) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return latencies[rank-1]
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunBench(t *testing.T) {
+	t.Parallel()
+	for _, backend := range []string{"memory", "filesystem", "bolt"} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			t.Parallel()
+			args := []string{"-backend", backend, "-concurrency", "4", "-objects", "20", "-object-size", "128", "-listings", "5"}
+			if backend != "memory" {
+				args = append(args, "-filesystem-root", t.TempDir())
+			}
+			var buf bytes.Buffer
+			if err := runBench(args, &buf); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			rows := map[string][]string{}
+			for _, line := range lines[2:] {
+				fields := strings.Fields(line)
+				rows[fields[0]] = fields
+			}
+			expectedCounts := map[string]string{"upload": "20", "download": "20", "list": "5"}
+			for operation, count := range expectedCounts {
+				row, ok := rows[operation]
+				if !ok {
+					t.Errorf("missing %s row in the report:\n%s", operation, buf.String())
+					continue
+				}
+				if row[1] != count {
+					t.Errorf("wrong %s count\nwant %s\ngot  %s", operation, count, row[1])
+				}
+				if row[2] != "0" {
+					t.Errorf("unexpected %s errors: %s", operation, row[2])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBenchConfigInvalid(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"invalid backend", []string{"-backend", "s3"}},
+		{"no concurrency", []string{"-concurrency", "0"}},
+		{"negative object size", []string{"-object-size", "-1"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := loadBenchConfig(test.args); err == nil {
+				t.Error("unexpected <nil> error")
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	t.Parallel()
+	var latencies []time.Duration
+	for i := 1; i <= 200; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		p        int
+		expected time.Duration
+	}{
+		{0, time.Millisecond},
+		{50, 100 * time.Millisecond},
+		{90, 180 * time.Millisecond},
+		{99, 198 * time.Millisecond},
+		{100, 200 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := percentile(latencies, test.p); got != test.expected {
+			t.Errorf("wrong p%d\nwant %s\ngot  %s", test.p, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// apiMethods maps the method and path template of the routes to the names of
+// the API methods they implement, such as "storage.objects.get". Paths of the
+// JSON API are relative to /storage/v1.
+var apiMethods = map[string]string{
+	"GET /b":                                                    "storage.buckets.list",
+	"POST /b":                                                   "storage.buckets.insert",
+	"GET /b/{bucketName}":                                       "storage.buckets.get",
+	"PATCH /b/{bucketName}":                                     "storage.buckets.patch",
+	"PUT /b/{bucketName}":                                       "storage.buckets.update",
+	"DELETE /b/{bucketName}":                                    "storage.buckets.delete",
+	"GET /b/{bucketName}/defaultObjectAcl":                      "storage.default_object_acl.list",
+	"POST /b/{bucketName}/defaultObjectAcl":                     "storage.default_object_acl.insert",
+	"GET /b/{bucketName}/iam":                                   "storage.buckets.getIamPolicy",
+	"PUT /b/{bucketName}/iam":                                   "storage.buckets.setIamPolicy",
+	"GET /b/{bucketName}/iam/testPermissions":                   "storage.buckets.testIamPermissions",
+	"POST /b/{bucketName}/lockRetentionPolicy":                  "storage.buckets.lockRetentionPolicy",
+	"GET /b/{bucketName}/notificationConfigs":                   "storage.notifications.list",
+	"POST /b/{bucketName}/notificationConfigs":                  "storage.notifications.insert",
+	"GET /b/{bucketName}/notificationConfigs/{notification}":    "storage.notifications.get",
+	"DELETE /b/{bucketName}/notificationConfigs/{notification}": "storage.notifications.delete",
+	"GET /b/{bucketName}/o":                                     "storage.objects.list",
+	"POST /b/{bucketName}/o":                                    "storage.objects.insert",
+	"GET /b/{bucketName}/o/{objectName:.+}/acl":                 "storage.object_acl.list",
+	"POST /b/{bucketName}/o/{objectName:.+}/acl":                "storage.object_acl.insert",
+	"GET /b/{bucketName}/o/{objectName:.+}/acl/{entity}":        "storage.object_acl.get",
+	"PUT /b/{bucketName}/o/{objectName:.+}/acl/{entity}":        "storage.object_acl.update",
+	"PATCH /b/{bucketName}/o/{objectName:.+}/acl/{entity}":      "storage.object_acl.patch",
+	"DELETE /b/{bucketName}/o/{objectName:.+}/acl/{entity}":     "storage.object_acl.delete",
+	"PATCH /b/{bucketName}/o/{objectName:.+}":                   "storage.objects.patch",
+	"GET /b/{bucketName}/o/{objectName:.+}":                     "storage.objects.get",
+	"HEAD /b/{bucketName}/o/{objectName:.+}":                    "storage.objects.get",
+	"DELETE /b/{bucketName}/o/{objectName:.+}":                  "storage.objects.delete",
+	"PUT /b/{bucketName}/o/{objectName:.+}":                     "storage.objects.update",
+	"POST /b/{bucketName}/o/{objectName:.+}/restore":            "storage.objects.restore",
+	"POST /b/{bucketName}/o/{destinationObject:.+}/compose":     "storage.objects.compose",
+	"POST /b/{sourceBucket}/o/{sourceObject:.+}/copyTo/b/{destinationBucket}/o/{destinationObject:.+}":    "storage.objects.copy",
+	"POST /b/{sourceBucket}/o/{sourceObject:.+}/rewriteTo/b/{destinationBucket}/o/{destinationObject:.+}": "storage.objects.rewrite",
+	"GET /projects/{projectId}/serviceAccount":                                                            "storage.serviceaccount.get",
+	"GET /projects/{projectId}/hmacKeys":                                                                  "storage.hmacKey.list",
+	"POST /projects/{projectId}/hmacKeys":                                                                 "storage.hmacKey.create",
+	"GET /projects/{projectId}/hmacKeys/{accessId}":                                                       "storage.hmacKey.get",
+	"PUT /projects/{projectId}/hmacKeys/{accessId}":                                                       "storage.hmacKey.update",
+	"DELETE /projects/{projectId}/hmacKeys/{accessId}":                                                    "storage.hmacKey.delete",
+
+	"GET /download/storage/v1/b/{bucketName}/o/{objectName:.+}": "storage.objects.get",
+	"POST /upload/storage/v1/b/{bucketName}/o":                  "storage.objects.insert",
+	"PUT /upload/resumable/{uploadId}":                          "storage.objects.insert",
+	"POST /upload/resumable/{uploadId}":                         "storage.objects.insert",
+	"GET /{bucketName}/{objectName:.+}":                         "storage.objects.get",
+	"HEAD /{bucketName}/{objectName:.+}":                        "storage.objects.get",
+	"PUT /{bucketName}/{objectName:.+}":                         "storage.objects.insert",
+	"POST /{bucketName}/{objectName:.+}":                        "storage.objects.insert",
+	"GET /{objectName:.+}":                                      "storage.objects.get",
+	"HEAD /{objectName:.+}":                                     "storage.objects.get",
+	"PUT /{objectName:.+}":                                      "storage.objects.insert",
+	"POST /{objectName:.+}":                                     "storage.objects.insert",
+}
+
+// apiMethod returns the name of the API method of the request, such as
+// "storage.objects.get", or an empty string for requests that aren't API
+// calls.
+func apiMethod(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return apiMethods[r.Method+" "+strings.TrimPrefix(template, "/storage/v1")]
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+// defaultAutoclassTerminalStorageClass is the terminal storage class of
+// buckets with Autoclass enabled without one.
+const defaultAutoclassTerminalStorageClass = "NEARLINE"
+
+type bucketAutoclass struct {
+	Enabled                        bool   `json:"enabled"`
+	ToggleTime                     string `json:"toggleTime,omitempty"`
+	TerminalStorageClass           string `json:"terminalStorageClass,omitempty"`
+	TerminalStorageClassUpdateTime string `json:"terminalStorageClassUpdateTime,omitempty"`
+}
+
+// SetBucketAutoclass enables or disables Autoclass on the bucket. The
+// terminal storage class is either NEARLINE, the default, or ARCHIVE.
+// Objects only transition to colder storage classes when the lifecycle of
+// the buckets runs, see RunLifecycle.
+func (s *Server) SetBucketAutoclass(bucketName string, enabled bool, terminalStorageClass string) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	autoclass := &bucketAutoclass{Enabled: enabled, TerminalStorageClass: terminalStorageClass}
+	if message := applyAutoclass(&attrs, autoclass, time.Now()); message != "" {
+		return backend.Error(message)
+	}
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// applyAutoclass updates the attributes of a bucket with the Autoclass
+// configuration sent in a request, returning an error message if the
+// configuration is invalid. A nil configuration disables Autoclass.
+func applyAutoclass(attrs *backend.BucketAttrs, autoclass *bucketAutoclass, now time.Time) string {
+	if autoclass == nil {
+		autoclass = &bucketAutoclass{}
+	}
+	current := attrs.Autoclass
+	if current == nil {
+		if !autoclass.Enabled {
+			return ""
+		}
+		current = &backend.Autoclass{}
+	}
+	updated := *current
+	if autoclass.Enabled != updated.Enabled {
+		updated.Enabled = autoclass.Enabled
+		updated.ToggleTime = now
+	}
+	terminalStorageClass := autoclass.TerminalStorageClass
+	if terminalStorageClass == "" {
+		terminalStorageClass = updated.TerminalStorageClass
+	}
+	if terminalStorageClass == "" {
+		terminalStorageClass = defaultAutoclassTerminalStorageClass
+	}
+	if terminalStorageClass != "NEARLINE" && terminalStorageClass != "ARCHIVE" {
+		return "Invalid Autoclass terminal storage class: " + terminalStorageClass + ". It must be either NEARLINE or ARCHIVE."
+	}
+	if terminalStorageClass != updated.TerminalStorageClass {
+		updated.TerminalStorageClass = terminalStorageClass
+		updated.TerminalStorageClassUpdateTime = now
+	}
+	attrs.Autoclass = &updated
+	return ""
+}
+
+func fromBackendAutoclass(autoclass *backend.Autoclass) *bucketAutoclass {
+	if autoclass == nil {
+		return nil
+	}
+	return &bucketAutoclass{
+		Enabled:                        autoclass.Enabled,
+		ToggleTime:                     autoclass.ToggleTime.Format(timestampFormat),
+		TerminalStorageClass:           autoclass.TerminalStorageClass,
+		TerminalStorageClassUpdateTime: autoclass.TerminalStorageClassUpdateTime.Format(timestampFormat),
+	}
+}
+
+// autoclassStorageClass returns the storage class Autoclass transitions the
+// object to, or an empty string when Autoclass is disabled on the bucket.
+//
+// Cloud Storage transitions objects that aren't accessed for 30 days to
+// NEARLINE and, when the terminal storage class is ARCHIVE, to COLDLINE after
+// 90 days and ARCHIVE after 365 days. The fake server doesn't track reads, so
+// the days are counted from the last update of the object, or from the time
+// Autoclass was enabled, whichever is later.
+func autoclassStorageClass(bucket backend.Bucket, obj ObjectAttrs, now time.Time) string {
+	autoclass := bucket.Autoclass
+	if autoclass == nil || !autoclass.Enabled {
+		return ""
+	}
+	since := obj.Updated
+	if autoclass.ToggleTime.After(since) {
+		since = autoclass.ToggleTime
+	}
+	days := int64(now.Sub(since) / (24 * time.Hour))
+	archive := autoclass.TerminalStorageClass == "ARCHIVE"
+	switch {
+	case archive && days >= 365:
+		return "ARCHIVE"
+	case archive && days >= 90:
+		return "COLDLINE"
+	case days >= 30:
+		return "NEARLINE"
+	}
+	return backend.DefaultStorageClass
+}
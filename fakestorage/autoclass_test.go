@@ -0,0 +1,133 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+func TestBucketAutoclass(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	do := func(method, path, body string) (int, bucketResponse) {
+		t.Helper()
+		req, err := http.NewRequest(method, "https://storage.googleapis.com/storage/v1/b"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var bucket bucketResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&bucket); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, bucket
+	}
+
+	status, _ := do(http.MethodPost, "", `{"name":"invalid-bucket","autoclass":{"enabled":true,"terminalStorageClass":"COLDLINE"}}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("wrong status creating a bucket with an invalid terminal storage class\nwant %d\ngot  %d", http.StatusBadRequest, status)
+	}
+
+	status, bucket := do(http.MethodPost, "", `{"name":"autoclass-bucket","autoclass":{"enabled":true}}`)
+	if status != http.StatusOK {
+		t.Fatalf("wrong status creating the bucket\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if bucket.Autoclass == nil || !bucket.Autoclass.Enabled || bucket.Autoclass.ToggleTime == "" {
+		t.Fatalf("autoclass not enabled: %+v", bucket.Autoclass)
+	}
+	if bucket.Autoclass.TerminalStorageClass != "NEARLINE" {
+		t.Errorf("wrong terminal storage class\nwant %q\ngot  %q", "NEARLINE", bucket.Autoclass.TerminalStorageClass)
+	}
+
+	status, bucket = do(http.MethodPatch, "/autoclass-bucket", `{"autoclass":{"enabled":true,"terminalStorageClass":"ARCHIVE"}}`)
+	if status != http.StatusOK {
+		t.Fatalf("wrong status patching the bucket\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if bucket.Autoclass == nil || bucket.Autoclass.TerminalStorageClass != "ARCHIVE" {
+		t.Errorf("wrong autoclass after patching the terminal storage class: %+v", bucket.Autoclass)
+	}
+
+	status, bucket = do(http.MethodPatch, "/autoclass-bucket", `{"autoclass":{"enabled":false}}`)
+	if status != http.StatusOK {
+		t.Fatalf("wrong status disabling autoclass\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if bucket.Autoclass == nil || bucket.Autoclass.Enabled {
+		t.Errorf("autoclass still enabled: %+v", bucket.Autoclass)
+	}
+}
+
+func TestAutoclassStorageClass(t *testing.T) {
+	now := time.Now()
+	daysAgo := func(days int) time.Time {
+		return now.Add(-time.Duration(days) * 24 * time.Hour)
+	}
+	tests := []struct {
+		name                 string
+		autoclass            *backend.Autoclass
+		updated              time.Time
+		expectedStorageClass string
+	}{
+		{
+			name:    "disabled",
+			updated: daysAgo(400),
+		},
+		{
+			name:                 "recently updated",
+			autoclass:            &backend.Autoclass{Enabled: true, ToggleTime: daysAgo(400), TerminalStorageClass: "ARCHIVE"},
+			updated:              daysAgo(10),
+			expectedStorageClass: "STANDARD",
+		},
+		{
+			name:                 "nearline terminal storage class",
+			autoclass:            &backend.Autoclass{Enabled: true, ToggleTime: daysAgo(400), TerminalStorageClass: "NEARLINE"},
+			updated:              daysAgo(400),
+			expectedStorageClass: "NEARLINE",
+		},
+		{
+			name:                 "coldline",
+			autoclass:            &backend.Autoclass{Enabled: true, ToggleTime: daysAgo(400), TerminalStorageClass: "ARCHIVE"},
+			updated:              daysAgo(100),
+			expectedStorageClass: "COLDLINE",
+		},
+		{
+			name:                 "archive",
+			autoclass:            &backend.Autoclass{Enabled: true, ToggleTime: daysAgo(400), TerminalStorageClass: "ARCHIVE"},
+			updated:              daysAgo(400),
+			expectedStorageClass: "ARCHIVE",
+		},
+		{
+			name:                 "recently enabled",
+			autoclass:            &backend.Autoclass{Enabled: true, ToggleTime: daysAgo(40), TerminalStorageClass: "ARCHIVE"},
+			updated:              daysAgo(400),
+			expectedStorageClass: "NEARLINE",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			bucket := backend.Bucket{Name: "some-bucket", Autoclass: test.autoclass}
+			storageClass := autoclassStorageClass(bucket, ObjectAttrs{Updated: test.updated}, now)
+			if storageClass != test.expectedStorageClass {
+				t.Errorf("wrong storage class\nwant %q\ngot  %q", test.expectedStorageClass, storageClass)
+			}
+		})
+	}
+}
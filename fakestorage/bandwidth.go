@@ -0,0 +1,161 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BandwidthLimits are the maximum rates, in bytes per second, of the content
+// of uploads and downloads. Zero values don't limit the rate.
+type BandwidthLimits struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+type bandwidthLimits struct {
+	mtx    sync.RWMutex
+	limits BandwidthLimits
+}
+
+func (b *bandwidthLimits) get() BandwidthLimits {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.limits
+}
+
+func (b *bandwidthLimits) set(limits BandwidthLimits) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.limits = limits
+}
+
+// SetBandwidthLimits changes the maximum rates of uploads and downloads. The
+// new limits apply to the requests received after the change.
+func (s *Server) SetBandwidthLimits(limits BandwidthLimits) {
+	s.bandwidth.set(limits)
+}
+
+// applyBandwidthLimits is the middleware that throttles the request body of
+// uploads and the response body of downloads.
+func (s *Server) applyBandwidthLimits(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := s.bandwidth.get()
+		switch operationClass(r) {
+		case OperationUpload:
+			if limits.Upload > 0 {
+				r.Body = &throttledReader{ReadCloser: r.Body, throttle: newThrottle(r.Context(), limits.Upload)}
+			}
+		case OperationDownload:
+			if limits.Download > 0 {
+				w = &throttledWriter{ResponseWriter: w, throttle: newThrottle(r.Context(), limits.Download)}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// throttle paces a stream to the given rate, in bytes per second, measured
+// since the beginning of the stream, so the time it takes only depends on
+// its size. The stream is transferred in chunks of a tenth of the rate,
+// which are what clients see as progress.
+type throttle struct {
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	total int64
+}
+
+func newThrottle(ctx context.Context, rate int64) *throttle {
+	return &throttle{ctx: ctx, rate: rate, start: time.Now()}
+}
+
+func (t *throttle) chunkSize() int {
+	if size := t.rate / 10; size > 0 {
+		return int(size)
+	}
+	return 1
+}
+
+// wait blocks until the stream is back within the rate after transferring n
+// more bytes. It returns an error if the request is canceled.
+func (t *throttle) wait(n int) error {
+	t.total += int64(n)
+	expected := time.Duration(t.total * int64(time.Second) / t.rate)
+	delay := expected - time.Since(t.start)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	throttle *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if size := r.throttle.chunkSize(); len(p) > size {
+		p = p[:size]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if waitErr := r.throttle.wait(n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	throttle *throttle
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if size := w.throttle.chunkSize(); len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if err := w.throttle.wait(n); err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *Server) getBandwidthLimits(r *http.Request) jsonResponse {
+	return jsonResponse{data: s.bandwidth.get()}
+}
+
+func (s *Server) setBandwidthLimits(r *http.Request) jsonResponse {
+	var limits BandwidthLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil || limits.Upload < 0 || limits.Download < 0 {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Bandwidth limits payload can not be parsed."}
+	}
+	s.SetBandwidthLimits(limits)
+	return jsonResponse{data: limits}
+}
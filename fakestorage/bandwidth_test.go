@@ -0,0 +1,152 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimits(t *testing.T) {
+	const bucketName = "some-bucket"
+	content := strings.Repeat("a", 4000)
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "file.txt"}, Content: []byte(content)},
+		},
+		BandwidthLimits: BandwidthLimits{Upload: 10000, Download: 10000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	ctx := context.Background()
+	bucket := server.Client().Bucket(bucketName)
+	download := func() time.Duration {
+		start := time.Now()
+		reader, err := bucket.Object("file.txt").NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("wrong content downloaded, got %d bytes", len(data))
+		}
+		return time.Since(start)
+	}
+	upload := func() time.Duration {
+		start := time.Now()
+		w := bucket.Object("uploaded.txt").NewWriter(ctx)
+		w.Write([]byte(content))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	const limited = 400 * time.Millisecond
+	if elapsed := download(); elapsed < limited {
+		t.Errorf("limited download took %s, expected at least %s", elapsed, limited)
+	}
+	if elapsed := upload(); elapsed < limited {
+		t.Errorf("limited upload took %s, expected at least %s", elapsed, limited)
+	}
+	obj, err := server.GetObject(bucketName, "uploaded.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != content {
+		t.Errorf("wrong content uploaded, got %d bytes", len(obj.Content))
+	}
+
+	server.SetBandwidthLimits(BandwidthLimits{})
+	if elapsed := download(); elapsed >= limited {
+		t.Errorf("unlimited download took %s, expected less than %s", elapsed, limited)
+	}
+	if elapsed := upload(); elapsed >= limited {
+		t.Errorf("unlimited upload took %s, expected less than %s", elapsed, limited)
+	}
+}
+
+func TestBandwidthLimitsEndpoint(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedLimits BandwidthLimits
+	}{
+		{
+			name:           "set limits",
+			body:           `{"upload":1024,"download":2048}`,
+			expectedStatus: http.StatusOK,
+			expectedLimits: BandwidthLimits{Upload: 1024, Download: 2048},
+		},
+		{
+			name:           "negative limit",
+			body:           `{"download":-1}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedLimits: BandwidthLimits{Upload: 1024, Download: 2048},
+		},
+		{
+			name:           "invalid payload",
+			body:           `{"upload":"fast"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedLimits: BandwidthLimits{Upload: 1024, Download: 2048},
+		},
+		{
+			name:           "remove limits",
+			body:           `{}`,
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/bandwidth", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+
+			resp, err = client.Get("https://storage.googleapis.com/_internal/bandwidth")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var limits BandwidthLimits
+			if err := json.NewDecoder(resp.Body).Decode(&limits); err != nil {
+				t.Fatal(err)
+			}
+			if limits != test.expectedLimits {
+				t.Errorf("wrong limits\nwant %+v\ngot  %+v", test.expectedLimits, limits)
+			}
+		})
+	}
+}
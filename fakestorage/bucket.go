@@ -7,8 +7,10 @@ package fakestorage
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/fsouza/fake-gcs-server/internal/backend"
 	"github.com/gorilla/mux"
@@ -16,6 +18,14 @@ import (
 
 var bucketRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*[a-zA-Z0-9]$`)
 
+var (
+	labelKeyRegexp   = regexp.MustCompile(`^[\p{Ll}\p{Lo}][\p{Ll}\p{Lo}\p{N}_-]{0,62}$`)
+	labelValueRegexp = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{N}_-]{0,63}$`)
+)
+
+// maxBucketLabels is the maximum number of labels of a bucket.
+const maxBucketLabels = 64
+
 // CreateBucket creates a bucket inside the server, so any API calls that
 // require the bucket name will recognize this bucket.
 //
@@ -23,7 +33,7 @@ var bucketRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*[a-zA-Z0-9]$`)
 //
 // Deprecated: use CreateBucketWithOpts.
 func (s *Server) CreateBucket(name string) {
-	err := s.backend.CreateBucket(name, false)
+	err := s.backend.CreateBucket(name, backend.BucketAttrs{})
 	if err != nil {
 		panic(err)
 	}
@@ -34,6 +44,41 @@ func (s *Server) CreateBucket(name string) {
 type CreateBucketOpts struct {
 	Name              string
 	VersioningEnabled bool
+	// DefaultStorageClass is inherited by objects uploaded to the bucket
+	// without a storage class. Defaults to STANDARD.
+	DefaultStorageClass string
+	// ProjectID is the project that owns the bucket. Buckets without a
+	// project are listed for every project.
+	ProjectID string
+	// CORS is the Cross-Origin Resource Sharing configuration of the
+	// bucket. See SetBucketCORS.
+	CORS []CORS
+	// Lifecycle are the object lifecycle management rules of the bucket.
+	// See SetBucketLifecycle.
+	Lifecycle []LifecycleRule
+	// RetentionPeriod is the retention period of the bucket's retention
+	// policy. See SetBucketRetentionPolicy.
+	RetentionPeriod time.Duration
+	// SoftDeleteRetention is how long deleted objects can be restored. See
+	// SetBucketSoftDeletePolicy.
+	SoftDeleteRetention time.Duration
+	// Labels are the key-value pairs attached to the bucket.
+	Labels map[string]string
+	// DefaultKMSKeyName is the Cloud KMS key of objects uploaded to the
+	// bucket without an encryption key. See SetBucketDefaultKMSKeyName.
+	DefaultKMSKeyName string
+	// UniformBucketLevelAccess disables the ACLs of the bucket. See
+	// SetBucketUniformBucketLevelAccess.
+	UniformBucketLevelAccess bool
+	// PublicAccessPrevention prevents the bucket and its objects from being
+	// made public. See SetBucketPublicAccessPrevention.
+	PublicAccessPrevention bool
+	// Autoclass enables Autoclass on the bucket, with NEARLINE as the
+	// terminal storage class. See SetBucketAutoclass.
+	Autoclass bool
+	// RequesterPays requires requests to the bucket's objects to name the
+	// project billed for them. See SetBucketRequesterPays.
+	RequesterPays bool
 }
 
 // CreateBucketWithOpts creates a bucket inside the server, so any API calls that
@@ -42,8 +87,44 @@ type CreateBucketOpts struct {
 //
 // If the underlying backend returns an error, this method panics.
 func (s *Server) CreateBucketWithOpts(opts CreateBucketOpts) {
-	err := s.backend.CreateBucket(opts.Name, opts.VersioningEnabled)
-	if err != nil {
+	retentionPolicy, message := newRetentionPolicy(nil, opts.RetentionPeriod)
+	if message != "" {
+		panic(message)
+	}
+	softDeletePolicy, message := newSoftDeletePolicy(opts.SoftDeleteRetention)
+	if message != "" {
+		panic(message)
+	}
+	if err := validateBucketLabels(opts.Labels); err != nil {
+		panic(err)
+	}
+	if opts.DefaultKMSKeyName != "" {
+		if err := validateKMSKeyName(opts.DefaultKMSKeyName); err != nil {
+			panic(err)
+		}
+	}
+	bucketAttrs := backend.BucketAttrs{
+		VersioningEnabled:   opts.VersioningEnabled,
+		DefaultStorageClass: opts.DefaultStorageClass,
+		ProjectID:           opts.ProjectID,
+		CORS:                toBackendCORS(opts.CORS),
+		Lifecycle:           toBackendLifecycle(opts.Lifecycle),
+		RetentionPolicy:     retentionPolicy,
+		SoftDeletePolicy:    softDeletePolicy,
+		Labels:              normalizeBucketLabels(opts.Labels),
+		DefaultKMSKeyName:   opts.DefaultKMSKeyName,
+		RequesterPays:       opts.RequesterPays,
+	}
+	if opts.UniformBucketLevelAccess {
+		bucketAttrs.UniformBucketLevelAccess = newUniformBucketLevelAccess()
+	}
+	if opts.PublicAccessPrevention {
+		bucketAttrs.PublicAccessPrevention = publicAccessPreventionEnforced
+	}
+	if opts.Autoclass {
+		applyAutoclass(&bucketAttrs, &bucketAutoclass{Enabled: true}, time.Now())
+	}
+	if err := s.backend.CreateBucket(opts.Name, bucketAttrs); err != nil {
 		panic(err)
 	}
 }
@@ -52,8 +133,18 @@ func (s *Server) createBucketByPost(r *http.Request) jsonResponse {
 	// Minimal version of Bucket from google.golang.org/api/storage/v1
 
 	var data struct {
-		Name       string            `json:"name,omitempty"`
-		Versioning *bucketVersioning `json:"versioning,omitempty"`
+		Name             string                  `json:"name,omitempty"`
+		Versioning       *bucketVersioning       `json:"versioning,omitempty"`
+		StorageClass     string                  `json:"storageClass,omitempty"`
+		CORS             []CORS                  `json:"cors,omitempty"`
+		Lifecycle        *bucketLifecycle        `json:"lifecycle,omitempty"`
+		RetentionPolicy  *bucketRetentionPolicy  `json:"retentionPolicy,omitempty"`
+		SoftDeletePolicy *bucketSoftDeletePolicy `json:"softDeletePolicy,omitempty"`
+		Labels           map[string]string       `json:"labels,omitempty"`
+		Encryption       *bucketEncryption       `json:"encryption,omitempty"`
+		IAMConfiguration *bucketIAMConfiguration `json:"iamConfiguration,omitempty"`
+		Autoclass        *bucketAutoclass        `json:"autoclass,omitempty"`
+		Billing          *bucketBilling          `json:"billing,omitempty"`
 	}
 
 	// Read the bucket props from the request body JSON
@@ -69,9 +160,60 @@ func (s *Server) createBucketByPost(r *http.Request) jsonResponse {
 	if err := validateBucketName(name); err != nil {
 		return jsonResponse{errorMessage: err.Error(), status: http.StatusBadRequest}
 	}
+	if err := validateBucketLabels(data.Labels); err != nil {
+		return jsonResponse{errorMessage: err.Error(), status: http.StatusBadRequest}
+	}
+	var defaultKMSKeyName string
+	if data.Encryption != nil && data.Encryption.DefaultKMSKeyName != "" {
+		defaultKMSKeyName = data.Encryption.DefaultKMSKeyName
+		if err := validateKMSKeyName(defaultKMSKeyName); err != nil {
+			return jsonResponse{errorMessage: err.Error(), status: http.StatusBadRequest}
+		}
+	}
+	var lifecycle []LifecycleRule
+	if data.Lifecycle != nil {
+		lifecycle = data.Lifecycle.Rule
+	}
+	if message := validateLifecycle(lifecycle); message != "" {
+		return jsonResponse{errorMessage: message, status: http.StatusBadRequest}
+	}
+	var retentionPolicy *backend.RetentionPolicy
+	if data.RetentionPolicy != nil {
+		var message string
+		retentionPolicy, message = newRetentionPolicy(nil, time.Duration(data.RetentionPolicy.RetentionPeriod)*time.Second)
+		if message != "" {
+			return jsonResponse{errorMessage: message, status: http.StatusBadRequest}
+		}
+	}
+	var softDeletePolicy *backend.SoftDeletePolicy
+	if data.SoftDeletePolicy != nil {
+		var message string
+		softDeletePolicy, message = newSoftDeletePolicy(time.Duration(data.SoftDeletePolicy.RetentionDurationSeconds) * time.Second)
+		if message != "" {
+			return jsonResponse{errorMessage: message, status: http.StatusBadRequest}
+		}
+	}
 
 	// Create the named bucket
-	if err := s.backend.CreateBucket(name, versioning); err != nil {
+	bucketAttrs := backend.BucketAttrs{
+		VersioningEnabled:   versioning,
+		DefaultStorageClass: data.StorageClass,
+		ProjectID:           r.URL.Query().Get("project"),
+		CORS:                toBackendCORS(data.CORS),
+		Lifecycle:           toBackendLifecycle(lifecycle),
+		RetentionPolicy:     retentionPolicy,
+		SoftDeletePolicy:    softDeletePolicy,
+		Labels:              normalizeBucketLabels(data.Labels),
+		DefaultKMSKeyName:   defaultKMSKeyName,
+		RequesterPays:       data.Billing != nil && data.Billing.RequesterPays,
+	}
+	if message := applyIAMConfiguration(&bucketAttrs, data.IAMConfiguration); message != "" {
+		return jsonResponse{errorMessage: message, status: http.StatusBadRequest}
+	}
+	if message := applyAutoclass(&bucketAttrs, data.Autoclass, time.Now()); message != "" {
+		return jsonResponse{errorMessage: message, status: http.StatusBadRequest}
+	}
+	if err := s.backend.CreateBucket(name, bucketAttrs); err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
 
@@ -88,9 +230,24 @@ func (s *Server) listBuckets(r *http.Request) jsonResponse {
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
+	if project := r.URL.Query().Get("project"); project != "" {
+		buckets = filterBucketsByProject(buckets, project)
+	}
 	return jsonResponse{data: newListBucketsResponse(buckets, s.options.BucketsLocation)}
 }
 
+// filterBucketsByProject returns the buckets owned by the given project, along
+// with the buckets that were created without a project.
+func filterBucketsByProject(buckets []backend.Bucket, project string) []backend.Bucket {
+	filtered := make([]backend.Bucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		if bucket.ProjectID == "" || bucket.ProjectID == project {
+			filtered = append(filtered, bucket)
+		}
+	}
+	return filtered
+}
+
 func (s *Server) getBucket(r *http.Request) jsonResponse {
 	bucketName := mux.Vars(r)["bucketName"]
 	bucket, err := s.backend.GetBucket(bucketName)
@@ -100,6 +257,193 @@ func (s *Server) getBucket(r *http.Request) jsonResponse {
 	return jsonResponse{data: newBucketResponse(bucket, s.options.BucketsLocation)}
 }
 
+// patchBucket updates the metadata of the bucket with the fields sent in the
+// request, leaving the other fields unchanged. Fields sent as null are
+// cleared. A null label value removes the label, and a null labels field
+// removes all of them.
+func (s *Server) patchBucket(r *http.Request) jsonResponse {
+	return s.changeBucketMetadata(r, false)
+}
+
+// updateBucket replaces the metadata of the bucket, clearing the fields in
+// bucketReplaceFields that aren't sent in the request. The storage class, the
+// IAM and the soft delete configuration keep their values when omitted.
+func (s *Server) updateBucket(r *http.Request) jsonResponse {
+	return s.changeBucketMetadata(r, true)
+}
+
+// bucketReplaceFields are the fields of a bucket cleared by buckets.update
+// when they aren't in the request.
+var bucketReplaceFields = []string{"versioning", "cors", "lifecycle", "retentionPolicy", "labels", "encryption", "autoclass", "billing"}
+
+func (s *Server) changeBucketMetadata(r *http.Request, replace bool) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	var data map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data == nil {
+		return jsonResponse{errorMessage: "Invalid bucket metadata", status: http.StatusBadRequest}
+	}
+	conds, errResp := parseObjectPreconditions(r, false)
+	if errResp != nil {
+		return *errResp
+	}
+	if errResp := conds.checkMetageneration(bucketMetageneration(bucket)); errResp != nil {
+		return *errResp
+	}
+	attrs := bucket.Attrs()
+	if replace {
+		attrs.Labels = nil
+		for _, field := range bucketReplaceFields {
+			if _, ok := data[field]; !ok {
+				data[field] = json.RawMessage("null")
+			}
+		}
+	}
+	if message := applyBucketMetadata(&attrs, data, time.Now()); message != "" {
+		return jsonResponse{errorMessage: message, status: http.StatusBadRequest}
+	}
+	attrs.Metageneration = bucketMetageneration(bucket) + 1
+	if err := s.backend.UpdateBucket(bucketName, attrs); err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	return s.getBucket(r)
+}
+
+// applyBucketMetadata updates the attributes of a bucket with the fields of
+// a buckets.patch or buckets.update request, returning an error message if
+// any of them is invalid.
+func applyBucketMetadata(attrs *backend.BucketAttrs, data map[string]json.RawMessage, now time.Time) string {
+	if rawVersioning, ok := data["versioning"]; ok {
+		var versioning *bucketVersioning
+		if err := json.Unmarshal(rawVersioning, &versioning); err != nil {
+			return err.Error()
+		}
+		attrs.VersioningEnabled = versioning != nil && versioning.Enabled
+	}
+	if rawStorageClass, ok := data["storageClass"]; ok {
+		var storageClass *string
+		if err := json.Unmarshal(rawStorageClass, &storageClass); err != nil {
+			return err.Error()
+		}
+		attrs.DefaultStorageClass = ""
+		if storageClass != nil {
+			attrs.DefaultStorageClass = *storageClass
+		}
+	}
+	if rawCORS, ok := data["cors"]; ok {
+		var cors []CORS
+		if err := json.Unmarshal(rawCORS, &cors); err != nil {
+			return err.Error()
+		}
+		attrs.CORS = toBackendCORS(cors)
+	}
+	if rawLifecycle, ok := data["lifecycle"]; ok {
+		var lifecycle *bucketLifecycle
+		if err := json.Unmarshal(rawLifecycle, &lifecycle); err != nil {
+			return err.Error()
+		}
+		var rules []LifecycleRule
+		if lifecycle != nil {
+			rules = lifecycle.Rule
+		}
+		if message := validateLifecycle(rules); message != "" {
+			return message
+		}
+		attrs.Lifecycle = toBackendLifecycle(rules)
+	}
+	if rawRetentionPolicy, ok := data["retentionPolicy"]; ok {
+		var retentionPolicy *bucketRetentionPolicy
+		if err := json.Unmarshal(rawRetentionPolicy, &retentionPolicy); err != nil {
+			return err.Error()
+		}
+		var retentionPeriod time.Duration
+		if retentionPolicy != nil {
+			retentionPeriod = time.Duration(retentionPolicy.RetentionPeriod) * time.Second
+		}
+		policy, message := newRetentionPolicy(attrs.RetentionPolicy, retentionPeriod)
+		if message != "" {
+			return message
+		}
+		attrs.RetentionPolicy = policy
+	}
+	if rawSoftDeletePolicy, ok := data["softDeletePolicy"]; ok {
+		var softDeletePolicy *bucketSoftDeletePolicy
+		if err := json.Unmarshal(rawSoftDeletePolicy, &softDeletePolicy); err != nil {
+			return err.Error()
+		}
+		var retentionDuration time.Duration
+		if softDeletePolicy != nil {
+			retentionDuration = time.Duration(softDeletePolicy.RetentionDurationSeconds) * time.Second
+		}
+		policy, message := newSoftDeletePolicy(retentionDuration)
+		if message != "" {
+			return message
+		}
+		attrs.SoftDeletePolicy = policy
+	}
+	if rawLabels, ok := data["labels"]; ok {
+		var labels map[string]*string
+		if err := json.Unmarshal(rawLabels, &labels); err != nil {
+			return err.Error()
+		}
+		attrs.Labels = patchBucketLabels(attrs.Labels, labels)
+		if err := validateBucketLabels(attrs.Labels); err != nil {
+			return err.Error()
+		}
+	}
+	if rawEncryption, ok := data["encryption"]; ok {
+		var encryption *bucketEncryption
+		if err := json.Unmarshal(rawEncryption, &encryption); err != nil {
+			return err.Error()
+		}
+		attrs.DefaultKMSKeyName = ""
+		if encryption != nil && encryption.DefaultKMSKeyName != "" {
+			if err := validateKMSKeyName(encryption.DefaultKMSKeyName); err != nil {
+				return err.Error()
+			}
+			attrs.DefaultKMSKeyName = encryption.DefaultKMSKeyName
+		}
+	}
+	if rawIAMConfiguration, ok := data["iamConfiguration"]; ok {
+		var config *bucketIAMConfiguration
+		if err := json.Unmarshal(rawIAMConfiguration, &config); err != nil {
+			return err.Error()
+		}
+		if message := applyIAMConfiguration(attrs, config); message != "" {
+			return message
+		}
+	}
+	if rawAutoclass, ok := data["autoclass"]; ok {
+		var autoclass *bucketAutoclass
+		if err := json.Unmarshal(rawAutoclass, &autoclass); err != nil {
+			return err.Error()
+		}
+		if message := applyAutoclass(attrs, autoclass, now); message != "" {
+			return message
+		}
+	}
+	if rawBilling, ok := data["billing"]; ok {
+		var billing *bucketBilling
+		if err := json.Unmarshal(rawBilling, &billing); err != nil {
+			return err.Error()
+		}
+		attrs.RequesterPays = billing != nil && billing.RequesterPays
+	}
+	return ""
+}
+
+// bucketMetageneration returns the metageneration of the bucket. Buckets
+// whose metadata was never changed are in their first metageneration.
+func bucketMetageneration(bucket backend.Bucket) int64 {
+	if bucket.Metageneration == 0 {
+		return 1
+	}
+	return bucket.Metageneration
+}
+
 func (s *Server) deleteBucket(r *http.Request) jsonResponse {
 	bucketName := mux.Vars(r)["bucketName"]
 	err := s.backend.DeleteBucket(bucketName)
@@ -112,6 +456,42 @@ func (s *Server) deleteBucket(r *http.Request) jsonResponse {
 	if err != nil {
 		return jsonResponse{status: http.StatusInternalServerError, errorMessage: err.Error()}
 	}
+	s.softDeleted.removeBucket(bucketName)
+	s.iamPolicies.remove(bucketName)
+	s.notifications.DeleteBucketConfigs(bucketName)
+	return jsonResponse{}
+}
+
+// ForceDeleteBucket deletes the bucket along with all of its objects. The
+// buckets.delete API rejects buckets that aren't empty, as Cloud Storage
+// does, so this is meant for cleaning up between tests.
+func (s *Server) ForceDeleteBucket(name string) error {
+	if _, err := s.backend.GetBucket(name); err != nil {
+		return backend.BucketNotFound
+	}
+	objs, err := s.backend.ListObjects(name, "", false)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		if err := s.backend.DeleteObject(name, obj.Name); err != nil {
+			return err
+		}
+	}
+	s.softDeleted.removeBucket(name)
+	s.iamPolicies.remove(name)
+	s.notifications.DeleteBucketConfigs(name)
+	return s.backend.DeleteBucket(name)
+}
+
+func (s *Server) forceDeleteBucket(r *http.Request) jsonResponse {
+	err := s.ForceDeleteBucket(mux.Vars(r)["bucketName"])
+	if err == backend.BucketNotFound {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
 	return jsonResponse{}
 }
 
@@ -121,3 +501,48 @@ func validateBucketName(bucketName string) error {
 	}
 	return nil
 }
+
+func validateBucketLabels(labels map[string]string) error {
+	if len(labels) > maxBucketLabels {
+		return fmt.Errorf("too many labels: the limit is %d", maxBucketLabels)
+	}
+	for key, value := range labels {
+		if !labelKeyRegexp.MatchString(key) {
+			return fmt.Errorf("invalid label key: %q", key)
+		}
+		if !labelValueRegexp.MatchString(value) {
+			return fmt.Errorf("invalid value for label %q: %q", key, value)
+		}
+	}
+	return nil
+}
+
+// patchBucketLabels applies the changes of a patch request to the labels of a
+// bucket. Labels with a nil value are removed, and nil changes remove all
+// labels.
+func patchBucketLabels(labels map[string]string, changes map[string]*string) map[string]string {
+	if changes == nil {
+		return nil
+	}
+	patched := make(map[string]string, len(labels)+len(changes))
+	for key, value := range labels {
+		patched[key] = value
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(patched, key)
+		} else {
+			patched[key] = *value
+		}
+	}
+	return normalizeBucketLabels(patched)
+}
+
+// normalizeBucketLabels returns nil for empty labels, so buckets without
+// labels compare equal regardless of how they were created.
+func normalizeBucketLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
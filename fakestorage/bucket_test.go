@@ -6,12 +6,19 @@ package fakestorage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -114,6 +121,46 @@ func TestServerClientDeleteBucket(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("it force deletes non-empty buckets", func(t *testing.T) {
+		const bucketName = "force-deleted-bucket"
+		objs := []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "static/js/app.js"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "static/css/app.css"}},
+		}
+		runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+			if err := server.ForceDeleteBucket(bucketName); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := server.Client().Bucket(bucketName).Attrs(context.Background()); err == nil {
+				t.Error("unexpected <nil> error getting a force deleted bucket")
+			}
+			if err := server.ForceDeleteBucket(bucketName); err == nil {
+				t.Error("unexpected <nil> error force deleting an unknown bucket")
+			}
+		})
+	})
+
+	t.Run("it force deletes buckets through the internal endpoint", func(t *testing.T) {
+		const bucketName = "force-deleted-bucket"
+		objs := []Object{{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "static/js/app.js"}}}
+		runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+			for _, expectedStatus := range []int{http.StatusOK, http.StatusNotFound} {
+				req, err := http.NewRequest(http.MethodDelete, server.URL()+"/_internal/buckets/"+bucketName, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := server.HTTPClient().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != expectedStatus {
+					t.Errorf("wrong status returned\nwant %d\ngot  %d", expectedStatus, resp.StatusCode)
+				}
+			}
+		})
+	})
 }
 
 func TestServerClientBucketAttrsAfterCreateBucketByPost(t *testing.T) {
@@ -172,6 +219,134 @@ func TestServerClientBucketCreateValidation(t *testing.T) {
 	}
 }
 
+func TestServerClientBucketLabels(t *testing.T) {
+	runServersTest(t, runServersOptions{enableFSBackend: true}, func(t *testing.T, server *Server) {
+		const bucketName = "labeled-bucket"
+		client := server.Client()
+		bucket := client.Bucket(bucketName)
+		labels := map[string]string{"env": "prod", "team": "storage"}
+		if err := bucket.Create(context.Background(), "whatever", &storage.BucketAttrs{Labels: labels}); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := bucket.Attrs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(attrs.Labels, labels) {
+			t.Errorf("wrong labels after creating the bucket\nwant %v\ngot  %v", labels, attrs.Labels)
+		}
+
+		var update storage.BucketAttrsToUpdate
+		update.SetLabel("team", "infra")
+		update.SetLabel("tier", "1")
+		update.DeleteLabel("env")
+		attrs, err = bucket.Update(context.Background(), update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedLabels := map[string]string{"team": "infra", "tier": "1"}
+		if !reflect.DeepEqual(attrs.Labels, expectedLabels) {
+			t.Errorf("wrong labels after updating the bucket\nwant %v\ngot  %v", expectedLabels, attrs.Labels)
+		}
+
+		update = storage.BucketAttrsToUpdate{}
+		update.DeleteLabel("team")
+		update.DeleteLabel("tier")
+		attrs, err = bucket.Update(context.Background(), update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attrs.Labels) != 0 {
+			t.Errorf("unexpected labels after deleting all of them: %v", attrs.Labels)
+		}
+
+		update = storage.BucketAttrsToUpdate{}
+		update.SetLabel("Invalid Key", "value")
+		if _, err := bucket.Update(context.Background(), update); err == nil {
+			t.Error("unexpected <nil> error setting an invalid label")
+		}
+		err = client.Bucket("other-bucket").Create(context.Background(), "whatever", &storage.BucketAttrs{Labels: map[string]string{"env": "Invalid Value"}})
+		if err == nil {
+			t.Error("unexpected <nil> error creating a bucket with an invalid label")
+		}
+	})
+}
+
+func TestServerClientBucketUpdate(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		const bucketName = "mutable-bucket"
+		ctx := context.Background()
+		bucket := server.Client().Bucket(bucketName)
+		if err := bucket.Create(ctx, "whatever", &storage.BucketAttrs{Labels: map[string]string{"env": "prod"}}); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := bucket.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.MetaGeneration != 1 {
+			t.Errorf("wrong metageneration after creating the bucket\nwant %d\ngot  %d", 1, attrs.MetaGeneration)
+		}
+
+		cors := []storage.CORS{{Origins: []string{"https://example.com"}, Methods: []string{"GET"}, MaxAge: time.Hour}}
+		attrs, err = bucket.If(storage.BucketConditions{MetagenerationMatch: 1}).Update(ctx, storage.BucketAttrsToUpdate{
+			VersioningEnabled: true,
+			CORS:              cors,
+			RetentionPolicy:   &storage.RetentionPolicy{RetentionPeriod: time.Hour},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.VersioningEnabled {
+			t.Error("versioning not enabled after patching the bucket")
+		}
+		if !reflect.DeepEqual(attrs.CORS, cors) {
+			t.Errorf("wrong cors after patching the bucket\nwant %+v\ngot  %+v", cors, attrs.CORS)
+		}
+		if attrs.RetentionPolicy == nil || attrs.RetentionPolicy.RetentionPeriod != time.Hour {
+			t.Errorf("wrong retention policy after patching the bucket: %+v", attrs.RetentionPolicy)
+		}
+		if !reflect.DeepEqual(attrs.Labels, map[string]string{"env": "prod"}) {
+			t.Errorf("labels changed by patching other fields: %v", attrs.Labels)
+		}
+		if attrs.MetaGeneration != 2 {
+			t.Errorf("wrong metageneration after patching the bucket\nwant %d\ngot  %d", 2, attrs.MetaGeneration)
+		}
+
+		_, err = bucket.If(storage.BucketConditions{MetagenerationMatch: 1}).Update(ctx, storage.BucketAttrsToUpdate{VersioningEnabled: false})
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusPreconditionFailed {
+			t.Errorf("wrong error patching with a stale metageneration: %v", err)
+		}
+
+		req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/storage/v1/b/"+bucketName+"?ifMetagenerationMatch=2", strings.NewReader(`{"labels":{"team":"storage"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status updating the bucket\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+		}
+		var updated bucketResponse
+		if err := json.NewDecoder(resp.Body).Decode(&updated); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(updated.Labels, map[string]string{"team": "storage"}) {
+			t.Errorf("wrong labels after updating the bucket: %v", updated.Labels)
+		}
+		if updated.Versioning != nil && updated.Versioning.Enabled || len(updated.CORS) > 0 || updated.RetentionPolicy != nil {
+			t.Errorf("fields omitted from the update weren't cleared: %+v", updated)
+		}
+		if updated.Metageneration != 3 {
+			t.Errorf("wrong metageneration after updating the bucket\nwant %d\ngot  %d", 3, updated.Metageneration)
+		}
+	})
+}
+
 func TestServerClientBucketAttrsNotFound(t *testing.T) {
 	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
 		client := server.Client()
@@ -230,6 +405,77 @@ func TestServerClientListBuckets(t *testing.T) {
 	})
 }
 
+func TestServerClientListBucketsByProject(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		client := server.Client()
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: "shared-bucket"})
+		for bucketName, project := range map[string]string{"bucket-a": "project-a", "bucket-b": "project-b"} {
+			if err := client.Bucket(bucketName).Create(context.Background(), project, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			project         string
+			expectedBuckets []string
+		}{
+			{"project-a", []string{"bucket-a", "shared-bucket"}},
+			{"project-b", []string{"bucket-b", "shared-bucket"}},
+			{"project-c", []string{"shared-bucket"}},
+		}
+		for _, test := range tests {
+			var bucketNames []string
+			it := client.Buckets(context.Background(), test.project)
+			b, err := it.Next()
+			for ; err == nil; b, err = it.Next() {
+				bucketNames = append(bucketNames, b.Name)
+			}
+			if err != iterator.Done {
+				t.Fatal(err)
+			}
+			sort.Strings(bucketNames)
+			if !reflect.DeepEqual(bucketNames, test.expectedBuckets) {
+				t.Errorf("wrong buckets listed for %s\nwant %v\ngot  %v", test.project, test.expectedBuckets, bucketNames)
+			}
+		}
+	})
+}
+
+func TestServerBucketOwner(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "shared-bucket"})
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "project-bucket", ProjectID: "some-project"})
+
+	tests := []struct {
+		bucketName    string
+		expectedOwner owner
+	}{
+		{"shared-bucket", owner{Entity: "user-" + ownerEntityID, EntityID: ownerEntityID}},
+		{"project-bucket", owner{Entity: "project-owners-some-project"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.bucketName, func(t *testing.T) {
+			resp, err := server.HTTPClient().Get("https://storage.googleapis.com/storage/v1/b/" + test.bucketName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var bucket bucketResponse
+			if err := json.NewDecoder(resp.Body).Decode(&bucket); err != nil {
+				t.Fatal(err)
+			}
+			if bucket.Owner == nil || *bucket.Owner != test.expectedOwner {
+				t.Errorf("wrong owner\nwant %+v\ngot  %+v", test.expectedOwner, bucket.Owner)
+			}
+		})
+	}
+}
+
 func TestServerClientListObjects(t *testing.T) {
 	objects := []Object{
 		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "img/hi-res/party-01.jpg"}},
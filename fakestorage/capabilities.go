@@ -0,0 +1,185 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+// capability describes a single API feature and whether the running server
+// supports it. Flags lists the command line flags that change the answer.
+type capability struct {
+	Name      string   `json:"name"`
+	Supported bool     `json:"supported"`
+	Flags     []string `json:"flags,omitempty"`
+	Notes     string   `json:"notes,omitempty"`
+}
+
+type capabilitiesResponse struct {
+	Kind           string          `json:"kind"`
+	Backend        string          `json:"backend"`
+	ProxiedBuckets []string        `json:"proxiedBuckets,omitempty"`
+	Transports     map[string]bool `json:"transports"`
+	Features       []capability    `json:"features"`
+}
+
+// backendName returns the name of the backend storing the data, checking
+// the options in the same order as newServer.
+func (s *Server) backendName() string {
+	if s.options.S3.Endpoint != "" {
+		return "s3"
+	}
+	if s.options.StorageRoot != "" {
+		if s.options.BoltBackend {
+			return "bolt"
+		}
+		return "filesystem"
+	}
+	return "memory"
+}
+
+// backendSupportsVersioning reports whether the backend keeps noncurrent
+// versions of objects.
+func (s *Server) backendSupportsVersioning() bool {
+	name := s.backendName()
+	return name == "memory" || name == "bolt"
+}
+
+func (s *Server) capabilities() []capability {
+	versioned := func(name string) capability {
+		c := capability{Name: name, Supported: s.backendSupportsVersioning(), Flags: []string{"backend"}}
+		if !c.Supported {
+			c.Notes = "not supported by the " + s.backendName() + " backend"
+		}
+		return c
+	}
+	supported := func(name string) capability {
+		return capability{Name: name, Supported: true}
+	}
+	_, refreshable := s.backend.(backend.Refresher)
+	refresh := capability{Name: "refresh", Supported: refreshable, Flags: []string{"backend"}}
+	if !refreshable {
+		refresh.Notes = "only supported by the filesystem backend"
+	}
+
+	return []capability{
+		supported("buckets.list"),
+		supported("buckets.insert"),
+		supported("buckets.get"),
+		supported("buckets.delete"),
+		supported("buckets.patch"),
+		supported("buckets.update"),
+		supported("buckets.forceDelete"),
+		supported("buckets.defaultStorageClass"),
+		supported("buckets.projects"),
+		supported("buckets.cors"),
+		supported("buckets.lifecycle"),
+		supported("buckets.retentionPolicy"),
+		supported("buckets.softDeletePolicy"),
+		supported("buckets.labels"),
+		supported("buckets.iam"),
+		supported("objects.list"),
+		supported("objects.list.matchGlob"),
+		supported("objects.list.includeTrailingDelimiter"),
+		supported("objects.list.includeFoldersAsPrefixes"),
+		supported("objects.get"),
+		supported("objects.delete"),
+		supported("objects.patch"),
+		supported("objects.update"),
+		supported("objects.copy"),
+		supported("objects.rewrite"),
+		supported("objects.compose"),
+		supported("objects.restore"),
+		supported("objects.insert.media"),
+		supported("objects.insert.multipart"),
+		supported("objects.insert.resumable"),
+		supported("objects.insert.checksumValidation"),
+		supported("objectAccessControls.list"),
+		supported("objectAccessControls.insert"),
+		supported("objectAccessControls.get"),
+		supported("objectAccessControls.update"),
+		supported("objectAccessControls.patch"),
+		supported("objectAccessControls.delete"),
+		supported("defaultObjectAccessControls"),
+		supported("hmacKeys"),
+		supported("projects.serviceAccount"),
+		supported("batch"),
+		supported("xml.download"),
+		supported("xml.virtualHostedStyle"),
+		supported("xml.formUpload"),
+		supported("xml.signedUrlUpload"),
+		supported("xml.signedUrlV2"),
+		supported("xml.multipartUpload"),
+		supported("preconditions"),
+		supported("partialResponses"),
+		supported("decompressiveTranscoding"),
+		supported("faults.checksumMismatch"),
+		supported("faults.error"),
+		supported("faults.uploadInterruption"),
+		supported("retryTests"),
+		supported("requestInstructions"),
+		supported("chaos"),
+		supported("latencyProfiles"),
+		supported("operationLatencies"),
+		supported("bandwidthLimits"),
+		supported("listingConsistencyDelay"),
+		supported("bucketQuotas"),
+		supported("writeRateLimits"),
+		supported("seed"),
+		refresh,
+		{
+			Name:      "proxy",
+			Supported: len(s.options.Proxy.Buckets) > 0,
+			Flags:     []string{"proxy-buckets"},
+		},
+		supported("stats"),
+		supported("objectVersions"),
+		{
+			Name:      "strictContentType",
+			Supported: s.options.StrictContentType,
+			Flags:     []string{"strict-content-type"},
+		},
+		{
+			Name:      "xml.formUpload.policyVerification",
+			Supported: s.options.VerifyPostPolicies,
+			Flags:     []string{"verify-post-policies"},
+		},
+		{
+			Name:      "objectAccessControls.enforcement",
+			Supported: s.options.EnforceObjectACL,
+			Flags:     []string{"enforce-object-acl"},
+		},
+		supported("customerSuppliedEncryptionKeys"),
+		supported("customerManagedEncryptionKeys"),
+		supported("uniformBucketLevelAccess"),
+		supported("publicAccessPrevention"),
+		supported("autoclass"),
+		supported("requesterPays"),
+		versioned("versioning"),
+		versioned("generations"),
+		supported("notificationConfigs"),
+		{
+			Name:      "notifications.pubsub",
+			Supported: s.options.EventOptions.ProjectID != "" && s.options.EventOptions.TopicName != "",
+			Flags:     []string{"event.pubsub-project-id", "event.pubsub-topic", "event.list", "event.object-prefix"},
+		},
+	}
+}
+
+func (s *Server) getCapabilities(r *http.Request) jsonResponse {
+	return jsonResponse{data: capabilitiesResponse{
+		Kind:           "fakestorage#capabilities",
+		Backend:        s.backendName(),
+		ProxiedBuckets: s.options.Proxy.Buckets,
+		Transports: map[string]bool{
+			"json": true,
+			"xml":  true,
+			"grpc": false,
+		},
+		Features: s.capabilities(),
+	}}
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultChaosMaxLatency is the maximum latency added to the requests
+// disrupted with latency when ChaosOptions.MaxLatency isn't set.
+const defaultChaosMaxLatency = time.Second
+
+// chaosStatuses are the statuses of the errors returned by the chaos mode.
+var chaosStatuses = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// ChaosOptions configures the chaos mode, in which the server disrupts a
+// share of the API requests at random, to shake out brittle retry logic.
+// Each disrupted request gets one of: a random latency, a 5xx error, a
+// dropped connection, or a response body truncated at a random point.
+type ChaosOptions struct {
+	// Probability is the chance of each request being disrupted, between
+	// 0 and 1. Zero disables the chaos mode.
+	Probability float64
+
+	// MaxLatency is the maximum latency added to requests, one second by
+	// default.
+	MaxLatency time.Duration
+
+	// Seed makes the disruptions reproducible. Zero seeds them with the
+	// current time.
+	Seed int64
+}
+
+type chaos struct {
+	mtx     sync.Mutex
+	options ChaosOptions
+	rand    *rand.Rand
+}
+
+func newChaos(options ChaosOptions) (*chaos, error) {
+	if options.Probability < 0 || options.Probability > 1 {
+		return nil, fmt.Errorf("invalid chaos probability %v, must be between 0 and 1", options.Probability)
+	}
+	if options.MaxLatency < 0 {
+		return nil, fmt.Errorf("invalid chaos max latency %s, must not be negative", options.MaxLatency)
+	}
+	if options.MaxLatency == 0 {
+		options.MaxLatency = defaultChaosMaxLatency
+	}
+	seed := options.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &chaos{options: options, rand: rand.New(rand.NewSource(seed))}, nil
+}
+
+type chaosDisruption int
+
+const (
+	chaosNone chaosDisruption = iota
+	chaosLatency
+	chaosError
+	chaosDroppedConnection
+	chaosTruncatedBody
+)
+
+// next decides the disruption of a request, along with its parameter: the
+// latency, the status of the error or the bytes sent before truncating the
+// body.
+func (c *chaos) next() (chaosDisruption, int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.options.Probability == 0 || c.rand.Float64() >= c.options.Probability {
+		return chaosNone, 0
+	}
+	switch disruption := chaosDisruption(1 + c.rand.Intn(4)); disruption {
+	case chaosLatency:
+		return disruption, c.rand.Int63n(int64(c.options.MaxLatency)) + 1
+	case chaosError:
+		return disruption, int64(chaosStatuses[c.rand.Intn(len(chaosStatuses))])
+	case chaosTruncatedBody:
+		return disruption, c.rand.Int63n(1024)
+	default:
+		return disruption, 0
+	}
+}
+
+// applyChaos is the middleware that disrupts the API requests in chaos mode.
+// Requests to the internal endpoints are never disrupted.
+func (s *Server) applyChaos(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiMethod(r) == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		disruption, value := s.chaos.next()
+		switch disruption {
+		case chaosLatency:
+			if !wait(r, time.Duration(value)) {
+				return
+			}
+		case chaosError:
+			writeAPIError(w, r, int(value), fmt.Sprintf("Chaos: Caused a %d", value))
+			return
+		case chaosDroppedConnection:
+			panic(http.ErrAbortHandler)
+		case chaosTruncatedBody:
+			w = &brokenStreamWriter{ResponseWriter: w, remaining: int(value)}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
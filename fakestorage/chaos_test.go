@@ -0,0 +1,83 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChaos(t *testing.T) {
+	content := strings.Repeat("a", 4096)
+	server, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		InitialObjects: []Object{{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte(content)}},
+		Chaos:          ChaosOptions{Probability: 1, MaxLatency: 10 * time.Millisecond, Seed: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	outcomes := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/file.txt?alt=media")
+		if err != nil {
+			outcomes["dropped connection"]++
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode >= 500:
+			outcomes["error"]++
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			outcomes["truncated body"]++
+		case err == nil && string(data) == content:
+			outcomes["latency"]++
+		default:
+			t.Errorf("unexpected response: status %d, %d bytes, error %v", resp.StatusCode, len(data), err)
+		}
+	}
+	for _, outcome := range []string{"dropped connection", "error", "truncated body", "latency"} {
+		if outcomes[outcome] == 0 {
+			t.Errorf("no requests disrupted with %s: %v", outcome, outcomes)
+		}
+	}
+
+	resp, err := server.HTTPClient().Get("https://storage.googleapis.com/_internal/capabilities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status of an internal endpoint in chaos mode\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestChaosOptionsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ChaosOptions
+	}{
+		{"negative probability", ChaosOptions{Probability: -0.1}},
+		{"probability over 1", ChaosOptions{Probability: 1.5}},
+		{"negative max latency", ChaosOptions{Probability: 0.1, MaxLatency: -time.Second}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{NoListener: true, Chaos: test.options})
+			if err == nil {
+				server.Stop()
+				t.Error("unexpected <nil> error")
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+)
+
+// uploadChecksums are the checksums of an upload sent by the client, base64
+// encoded. Empty values weren't sent.
+type uploadChecksums struct {
+	crc32c  string
+	md5Hash string
+}
+
+// hashHeaderChecksums reads the checksums of an upload from the X-Goog-Hash
+// headers, with comma-separated crc32c=... and md5=... values.
+func hashHeaderChecksums(header http.Header) uploadChecksums {
+	var checksums uploadChecksums
+	for _, value := range header.Values("X-Goog-Hash") {
+		for _, hash := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(hash), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch strings.ToLower(parts[0]) {
+			case "crc32c":
+				checksums.crc32c = parts[1]
+			case "md5":
+				checksums.md5Hash = parts[1]
+			}
+		}
+	}
+	return checksums
+}
+
+// mediaChecksums reads the checksums of an upload whose body is the whole
+// content, which can also have its MD5 hash in the Content-MD5 header.
+func mediaChecksums(header http.Header) uploadChecksums {
+	return hashHeaderChecksums(header).merge(uploadChecksums{md5Hash: header.Get("Content-MD5")})
+}
+
+// merge returns the checksums, with the ones that weren't sent taken from
+// other.
+func (c uploadChecksums) merge(other uploadChecksums) uploadChecksums {
+	if c.crc32c == "" {
+		c.crc32c = other.crc32c
+	}
+	if c.md5Hash == "" {
+		c.md5Hash = other.md5Hash
+	}
+	return c
+}
+
+// verify returns a checksumMismatchError if the content doesn't match the
+// checksums, as Cloud Storage rejects these uploads instead of storing
+// corrupted data.
+func (c uploadChecksums) verify(content []byte) error {
+	return c.verifyCalculated(checksum.EncodedCrc32cChecksum(content), checksum.EncodedMd5Hash(content))
+}
+
+// verifyCalculated is like verify, but takes the checksums calculated from
+// content that isn't in memory.
+func (c uploadChecksums) verifyCalculated(crc32c, md5Hash string) error {
+	if c.md5Hash != "" && md5Hash != c.md5Hash {
+		return &checksumMismatchError{name: "MD5 hash", provided: c.md5Hash, calculated: md5Hash}
+	}
+	if c.crc32c != "" && crc32c != c.crc32c {
+		return &checksumMismatchError{name: "CRC32C", provided: c.crc32c, calculated: crc32c}
+	}
+	return nil
+}
+
+// checksumMismatchError is returned when the content of an upload doesn't
+// match the checksum sent by the client.
+type checksumMismatchError struct {
+	name       string
+	provided   string
+	calculated string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("Provided %s %q doesn't match calculated %s %q.", e.name, e.provided, e.name, e.calculated)
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMediaChecksums(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected uploadChecksums
+	}{
+		{
+			name:   "no headers",
+			header: http.Header{},
+		},
+		{
+			name:     "single x-goog-hash header",
+			header:   http.Header{"X-Goog-Hash": []string{"crc32c=n03x6A==,md5=Ojk9c3dhfxgoKVVHYwFbHQ=="}},
+			expected: uploadChecksums{crc32c: "n03x6A==", md5Hash: "Ojk9c3dhfxgoKVVHYwFbHQ=="},
+		},
+		{
+			name:     "multiple x-goog-hash headers",
+			header:   http.Header{"X-Goog-Hash": []string{"crc32c=n03x6A==", "md5=Ojk9c3dhfxgoKVVHYwFbHQ=="}},
+			expected: uploadChecksums{crc32c: "n03x6A==", md5Hash: "Ojk9c3dhfxgoKVVHYwFbHQ=="},
+		},
+		{
+			name:     "content-md5",
+			header:   http.Header{"Content-Md5": []string{"Ojk9c3dhfxgoKVVHYwFbHQ=="}},
+			expected: uploadChecksums{md5Hash: "Ojk9c3dhfxgoKVVHYwFbHQ=="},
+		},
+		{
+			name: "x-goog-hash takes precedence over content-md5",
+			header: http.Header{
+				"X-Goog-Hash": []string{"md5=Ojk9c3dhfxgoKVVHYwFbHQ=="},
+				"Content-Md5": []string{"XrY7u+Ae7tCTyyK7j1rNww=="},
+			},
+			expected: uploadChecksums{md5Hash: "Ojk9c3dhfxgoKVVHYwFbHQ=="},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			checksums := mediaChecksums(test.header)
+			if checksums != test.expected {
+				t.Errorf("wrong checksums\nwant %+v\ngot  %+v", test.expected, checksums)
+			}
+		})
+	}
+}
+
+func TestUploadChecksumsVerify(t *testing.T) {
+	content := []byte("some nice content")
+	tests := []struct {
+		name      string
+		checksums uploadChecksums
+		expectErr bool
+	}{
+		{
+			name: "no checksums",
+		},
+		{
+			name:      "matching checksums",
+			checksums: uploadChecksums{crc32c: "0ttSew==", md5Hash: "3Tq0R0/q+yTKxYEuJF1HEw=="},
+		},
+		{
+			name:      "wrong crc32c",
+			checksums: uploadChecksums{crc32c: "n03x6A=="},
+			expectErr: true,
+		},
+		{
+			name:      "wrong md5",
+			checksums: uploadChecksums{md5Hash: "Ojk9c3dhfxgoKVVHYwFbHQ=="},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			err := test.checksums.verify(content)
+			if (err != nil) != test.expectErr {
+				t.Errorf("wrong error verifying the checksums\nwant error: %t\ngot  %v", test.expectErr, err)
+			}
+		})
+	}
+}
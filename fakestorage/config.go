@@ -3,12 +3,14 @@ package fakestorage
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 )
 
 func (s *Server) updateServerConfig(r *http.Request) jsonResponse {
 	var configOptions struct {
-		ExternalUrl string `json:"externalUrl,omitempty"`
-		PublicHost  string `json:"publicHost,omitempty"`
+		ExternalUrl             string `json:"externalUrl,omitempty"`
+		PublicHost              string `json:"publicHost,omitempty"`
+		ListingConsistencyDelay string `json:"listingConsistencyDelay,omitempty"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&configOptions)
 	if err != nil {
@@ -18,6 +20,19 @@ func (s *Server) updateServerConfig(r *http.Request) jsonResponse {
 		}
 	}
 
+	if configOptions.ListingConsistencyDelay != "" {
+		delay, err := time.ParseDuration(configOptions.ListingConsistencyDelay)
+		if err != nil || delay < 0 {
+			return jsonResponse{
+				status:       http.StatusBadRequest,
+				errorMessage: "Invalid listingConsistencyDelay: " + configOptions.ListingConsistencyDelay,
+			}
+		}
+		s.SetListingConsistencyDelay(delay)
+	}
+
+	s.configMtx.Lock()
+	defer s.configMtx.Unlock()
 	if configOptions.ExternalUrl != "" {
 		s.externalURL = configOptions.ExternalUrl
 	}
@@ -0,0 +1,96 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"sync"
+	"time"
+)
+
+// listingConsistency simulates listings that are eventually consistent:
+// objects created, overwritten or deleted are only listed as such once the
+// delay has passed since the last change, and until then the listings show
+// the object as it was before the changes.
+type listingConsistency struct {
+	mtx     sync.Mutex
+	delay   time.Duration
+	changes map[string]map[string]listingChange
+}
+
+type listingChange struct {
+	at time.Time
+	// previous is the object listed before the change, or nil if it
+	// didn't exist.
+	previous *ObjectAttrs
+}
+
+func (c *listingConsistency) setDelay(delay time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.delay = delay
+	if delay == 0 {
+		c.changes = nil
+	}
+}
+
+// record registers a change of the given object, which was listed as
+// previous before the change. Pending changes keep the object listed as it
+// was before the first of them.
+func (c *listingConsistency) record(bucketName, objectName string, previous *ObjectAttrs) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.delay == 0 {
+		return
+	}
+	if c.changes == nil {
+		c.changes = make(map[string]map[string]listingChange)
+	}
+	if c.changes[bucketName] == nil {
+		c.changes[bucketName] = make(map[string]listingChange)
+	}
+	now := time.Now()
+	if change, ok := c.changes[bucketName][objectName]; ok && now.Sub(change.at) < c.delay {
+		previous = change.previous
+	}
+	c.changes[bucketName][objectName] = listingChange{at: now, previous: previous}
+}
+
+// apply replaces the objects with pending changes in the listing of the
+// given bucket with the objects as they were before the changes.
+func (c *listingConsistency) apply(bucketName string, objects []ObjectAttrs) []ObjectAttrs {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	changes := c.changes[bucketName]
+	if len(changes) == 0 {
+		return objects
+	}
+	now := time.Now()
+	for name, change := range changes {
+		if now.Sub(change.at) >= c.delay {
+			delete(changes, name)
+		}
+	}
+	listed := make([]ObjectAttrs, 0, len(objects))
+	for _, obj := range objects {
+		if _, ok := changes[obj.Name]; !ok {
+			listed = append(listed, obj)
+		}
+	}
+	for _, change := range changes {
+		if change.previous != nil {
+			listed = append(listed, *change.previous)
+		}
+	}
+	return listed
+}
+
+// SetListingConsistencyDelay changes how long it takes for objects that are
+// created, overwritten or deleted to be listed as such, simulating eventually
+// consistent listings. Zero, the default, makes listings strongly
+// consistent, as they are in Cloud Storage. Listings of object versions and
+// of soft-deleted objects are always consistent.
+func (s *Server) SetListingConsistencyDelay(delay time.Duration) {
+	s.listingConsistency.setDelay(delay)
+}
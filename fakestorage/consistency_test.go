@@ -0,0 +1,152 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+func TestListingConsistencyDelay(t *testing.T) {
+	const (
+		bucketName = "some-bucket"
+		delay      = 300 * time.Millisecond
+	)
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "deleted.txt"}, Content: []byte("something")},
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "overwritten.txt"}, Content: []byte("something")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.SetListingConsistencyDelay(delay)
+
+	ctx := context.Background()
+	bucket := server.Client().Bucket(bucketName)
+	write := func(name, content string) {
+		w := bucket.Object(name).NewWriter(ctx)
+		w.Write([]byte(content))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func() map[string]int64 {
+		objs := make(map[string]int64)
+		it := bucket.Objects(ctx, nil)
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return objs
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs[attrs.Name] = attrs.Size
+		}
+	}
+
+	write("created.txt", "new content")
+	write("overwritten.txt", "new content")
+	if err := bucket.Object("deleted.txt").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int64{"deleted.txt": 9, "overwritten.txt": 9}
+	if objs := list(); !reflect.DeepEqual(objs, expected) {
+		t.Errorf("wrong objects listed before the delay\nwant %v\ngot  %v", expected, objs)
+	}
+	if _, err := bucket.Object("created.txt").Attrs(ctx); err != nil {
+		t.Errorf("unexpected error getting a created object: %v", err)
+	}
+	if _, err := bucket.Object("deleted.txt").Attrs(ctx); err != storage.ErrObjectNotExist {
+		t.Errorf("wrong error getting a deleted object\nwant %v\ngot  %v", storage.ErrObjectNotExist, err)
+	}
+
+	time.Sleep(delay)
+	expected = map[string]int64{"created.txt": 11, "overwritten.txt": 11}
+	if objs := list(); !reflect.DeepEqual(objs, expected) {
+		t.Errorf("wrong objects listed after the delay\nwant %v\ngot  %v", expected, objs)
+	}
+
+	server.SetListingConsistencyDelay(0)
+	write("immediate.txt", "content")
+	if _, ok := list()["immediate.txt"]; !ok {
+		t.Error("object created without a delay not listed")
+	}
+}
+
+func TestListingConsistencyDelayConfig(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedDelay  time.Duration
+	}{
+		{
+			"valid delay",
+			`{"listingConsistencyDelay":"5s"}`,
+			http.StatusOK,
+			5 * time.Second,
+		},
+		{
+			"invalid delay",
+			`{"listingConsistencyDelay":"soon"}`,
+			http.StatusBadRequest,
+			5 * time.Second,
+		},
+		{
+			"negative delay",
+			`{"listingConsistencyDelay":"-1s"}`,
+			http.StatusBadRequest,
+			5 * time.Second,
+		},
+		{
+			"disabled",
+			`{"listingConsistencyDelay":"0s"}`,
+			http.StatusOK,
+			0,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/config", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			server.listingConsistency.mtx.Lock()
+			delay := server.listingConsistency.delay
+			server.listingConsistency.mtx.Unlock()
+			if delay != test.expectedDelay {
+				t.Errorf("wrong delay\nwant %s\ngot  %s", test.expectedDelay, delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/gorilla/mux"
+)
+
+// CORS is a Cross-Origin Resource Sharing rule of a bucket, in the format
+// used by the JSON API.
+type CORS struct {
+	Origin         []string `json:"origin,omitempty"`
+	Method         []string `json:"method,omitempty"`
+	ResponseHeader []string `json:"responseHeader,omitempty"`
+	MaxAgeSeconds  int      `json:"maxAgeSeconds,omitempty"`
+}
+
+func toBackendCORS(rules []CORS) []backend.CORS {
+	if len(rules) == 0 {
+		return nil
+	}
+	backendRules := make([]backend.CORS, len(rules))
+	for i, rule := range rules {
+		backendRules[i] = backend.CORS(rule)
+	}
+	return backendRules
+}
+
+func fromBackendCORS(rules []backend.CORS) []CORS {
+	if len(rules) == 0 {
+		return nil
+	}
+	corsRules := make([]CORS, len(rules))
+	for i, rule := range rules {
+		corsRules[i] = CORS(rule)
+	}
+	return corsRules
+}
+
+// SetBucketCORS replaces the CORS configuration of the bucket. Once a bucket
+// has CORS rules, requests to it are only allowed from the origins and with
+// the methods and headers listed in the rules, as in Cloud Storage. Buckets
+// without CORS rules allow requests from any origin. An empty list of rules
+// removes the configuration.
+func (s *Server) SetBucketCORS(bucketName string, rules []CORS) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	attrs.CORS = toBackendCORS(rules)
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// bucketCORSHandler applies the CORS configuration of the bucket targeted by
+// cross-origin requests, answering preflight requests and setting the
+// Access-Control-* headers of the response. Requests to buckets without CORS
+// rules are served by defaultHandler.
+func (s *Server) bucketCORSHandler(h http.Handler, defaultHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			defaultHandler.ServeHTTP(w, r)
+			return
+		}
+		method := r.Method
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			method = r.Header.Get("Access-Control-Request-Method")
+		}
+		rules := s.bucketCORSRules(r, method)
+		if len(rules) == 0 {
+			defaultHandler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		rule, allowedOrigin, ok := matchCORSRule(rules, origin, method)
+		if preflight {
+			requestHeaders := splitHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+			if !ok || !corsListContains(rule.ResponseHeader, requestHeaders...) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(rule.Method, ", "))
+			if len(requestHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(requestHeaders, ", "))
+			}
+			if rule.MaxAgeSeconds > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAgeSeconds))
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if ok {
+			w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+			if len(rule.ResponseHeader) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(rule.ResponseHeader, ", "))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// bucketCORSRules returns the CORS rules of the bucket targeted by a request
+// with the given method to the URL of r. When the server doesn't support the
+// method on the URL, the bucket is identified as in a GET request.
+func (s *Server) bucketCORSRules(r *http.Request, method string) []backend.CORS {
+	req := r.Clone(r.Context())
+	var bucketName string
+	for _, m := range []string{method, http.MethodGet} {
+		req.Method = m
+		var match mux.RouteMatch
+		if s.mux.Match(req, &match) {
+			bucketName = match.Vars["bucketName"]
+			break
+		}
+	}
+	if bucketName == "" {
+		return nil
+	}
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return nil
+	}
+	return bucket.CORS
+}
+
+// matchCORSRule returns the first rule that allows the method from the given
+// origin, along with the value of the Access-Control-Allow-Origin header.
+func matchCORSRule(rules []backend.CORS, origin, method string) (backend.CORS, string, bool) {
+	for _, rule := range rules {
+		if !corsListContains(rule.Method, method) {
+			continue
+		}
+		for _, allowed := range rule.Origin {
+			if allowed == "*" {
+				return rule, "*", true
+			}
+			if strings.EqualFold(allowed, origin) {
+				return rule, origin, true
+			}
+		}
+	}
+	return backend.CORS{}, "", false
+}
+
+// corsListContains reports whether all values are in list, ignoring case. A
+// "*" in the list matches any value.
+func corsListContains(list []string, values ...string) bool {
+	for _, value := range values {
+		found := false
+		for _, item := range list {
+			if item == "*" || strings.EqualFold(item, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func splitHeaderList(value string) []string {
+	var headers []string
+	for _, header := range strings.Split(value, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
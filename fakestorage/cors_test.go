@@ -0,0 +1,221 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestBucketCORSConfiguration(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		client := server.Client()
+		cors := []storage.CORS{
+			{
+				Origins:         []string{"https://example.com"},
+				Methods:         []string{"GET", "PUT"},
+				ResponseHeaders: []string{"Content-Type", "X-Goog-Meta-Uploader"},
+				MaxAge:          time.Hour,
+			},
+		}
+		bucket := client.Bucket("cors-bucket")
+		if err := bucket.Create(context.TODO(), "", &storage.BucketAttrs{CORS: cors}); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := bucket.Attrs(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(attrs.CORS, cors) {
+			t.Errorf("wrong CORS configuration\nwant %+v\ngot  %+v", cors, attrs.CORS)
+		}
+
+		if err := server.SetBucketCORS("cors-bucket", nil); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err = bucket.Attrs(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attrs.CORS) != 0 {
+			t.Errorf("unexpected CORS configuration after removing it: %+v", attrs.CORS)
+		}
+		if err := server.SetBucketCORS("missing-bucket", []CORS{{Origin: []string{"*"}}}); err == nil {
+			t.Error("unexpected <nil> error setting the CORS configuration of a bucket that doesn't exist")
+		}
+	})
+}
+
+func TestBucketCORSRequests(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "cors-bucket", Name: "object.txt"}, Content: []byte("content")},
+			{ObjectAttrs: ObjectAttrs{BucketName: "other-bucket", Name: "object.txt"}, Content: []byte("content")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	err = server.SetBucketCORS("cors-bucket", []CORS{
+		{
+			Origin:         []string{"https://example.com"},
+			Method:         []string{"GET", "PUT"},
+			ResponseHeader: []string{"Content-Type"},
+			MaxAgeSeconds:  3600,
+		},
+		{
+			Origin: []string{"*"},
+			Method: []string{"HEAD"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name            string
+		method          string
+		url             string
+		origin          string
+		requestMethod   string
+		requestHeaders  string
+		expectedStatus  int
+		expectedHeaders map[string]string
+	}{
+		{
+			name:           "allowed preflight",
+			method:         http.MethodOptions,
+			url:            "https://storage.googleapis.com/cors-bucket/object.txt",
+			origin:         "https://example.com",
+			requestMethod:  http.MethodPut,
+			requestHeaders: "content-type",
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "https://example.com",
+				"Access-Control-Allow-Methods": "GET, PUT",
+				"Access-Control-Allow-Headers": "content-type",
+				"Access-Control-Max-Age":       "3600",
+			},
+		},
+		{
+			name:           "preflight from another origin",
+			method:         http.MethodOptions,
+			url:            "https://storage.googleapis.com/cors-bucket/object.txt",
+			origin:         "https://evil.example.com",
+			requestMethod:  http.MethodPut,
+			expectedStatus: http.StatusForbidden,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+		{
+			name:           "preflight with a disallowed method",
+			method:         http.MethodOptions,
+			url:            "https://storage.googleapis.com/cors-bucket/object.txt",
+			origin:         "https://example.com",
+			requestMethod:  http.MethodDelete,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "preflight with a disallowed header",
+			method:         http.MethodOptions,
+			url:            "https://storage.googleapis.com/cors-bucket/object.txt",
+			origin:         "https://example.com",
+			requestMethod:  http.MethodPut,
+			requestHeaders: "x-goog-meta-uploader",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "preflight to the JSON API",
+			method:         http.MethodOptions,
+			url:            "https://storage.googleapis.com/storage/v1/b/cors-bucket/o/object.txt",
+			origin:         "https://example.com",
+			requestMethod:  http.MethodGet,
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "https://example.com",
+			},
+		},
+		{
+			name:           "wildcard origin",
+			method:         http.MethodOptions,
+			url:            "https://storage.googleapis.com/cors-bucket/object.txt",
+			origin:         "https://other.example.com",
+			requestMethod:  http.MethodHead,
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+			},
+		},
+		{
+			name:           "allowed request",
+			method:         http.MethodGet,
+			url:            "https://storage.googleapis.com/cors-bucket/object.txt",
+			origin:         "https://example.com",
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":   "https://example.com",
+				"Access-Control-Expose-Headers": "Content-Type",
+			},
+		},
+		{
+			name:           "request from another origin",
+			method:         http.MethodGet,
+			url:            "https://storage.googleapis.com/cors-bucket/object.txt",
+			origin:         "https://evil.example.com",
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+		{
+			name:           "bucket without CORS configuration",
+			method:         http.MethodGet,
+			url:            "https://storage.googleapis.com/other-bucket/object.txt",
+			origin:         "https://evil.example.com",
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Origin", test.origin)
+			if test.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", test.requestMethod)
+			}
+			if test.requestHeaders != "" {
+				req.Header.Set("Access-Control-Request-Headers", test.requestHeaders)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			for name, value := range test.expectedHeaders {
+				if got := resp.Header.Get(name); got != value {
+					t.Errorf("wrong %s header\nwant %q\ngot  %q", name, value, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// SetBucketDefaultObjectACL replaces the default object ACL of the bucket,
+// which is applied to objects created in the bucket without an ACL. A nil ACL
+// removes the default.
+func (s *Server) SetBucketDefaultObjectACL(bucketName string, acl []storage.ACLRule) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	attrs.DefaultObjectACL = acl
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// defaultObjectACL returns a copy of the default object ACL of the bucket.
+func (s *Server) defaultObjectACL(bucketName string) []storage.ACLRule {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil || len(bucket.DefaultObjectACL) == 0 {
+		return nil
+	}
+	return append([]storage.ACLRule(nil), bucket.DefaultObjectACL...)
+}
+
+func newDefaultObjectACLResponse(bucketName string, rule storage.ACLRule) *objectAccessControl {
+	entity := string(rule.Entity)
+	item := &objectAccessControl{
+		Kind:   "storage#objectAccessControl",
+		ID:     bucketName + "/" + entity,
+		Bucket: bucketName,
+		Entity: entity,
+		Role:   string(rule.Role),
+		Domain: rule.Domain,
+		Email:  rule.Email,
+	}
+	if entity == "user-"+ownerEntityID {
+		item.EntityID = ownerEntityID
+	}
+	return item
+}
+
+func (s *Server) listDefaultObjectACL(r *http.Request) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	resp := aclListResponse{Items: make([]*objectAccessControl, len(bucket.DefaultObjectACL))}
+	for i, rule := range bucket.DefaultObjectACL {
+		resp.Items[i] = newDefaultObjectACLResponse(bucketName, rule)
+	}
+	return jsonResponse{data: resp}
+}
+
+func (s *Server) getDefaultObjectACL(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	bucket, err := s.backend.GetBucket(vars["bucketName"])
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	for _, rule := range bucket.DefaultObjectACL {
+		if string(rule.Entity) == vars["entity"] {
+			return jsonResponse{data: newDefaultObjectACLResponse(bucket.Name, rule)}
+		}
+	}
+	return jsonResponse{status: http.StatusNotFound}
+}
+
+// setDefaultObjectACL handles inserts, patches and updates of default object
+// ACL rules. Inserts and updates replace the rule for the entity, if there's
+// one, while patches require the rule to exist.
+func (s *Server) setDefaultObjectACL(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	bucket, err := s.backend.GetBucket(vars["bucketName"])
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+
+	var data struct {
+		Entity string
+		Role   string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	entity := storage.ACLEntity(vars["entity"])
+	if entity == "" {
+		entity = storage.ACLEntity(data.Entity)
+	}
+	role := storage.ACLRole(data.Role)
+	if entity == "" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Required field: entity"}
+	}
+	if !validObjectACLRole(role) {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid role: " + data.Role}
+	}
+	if err := s.checkPublicAccessPrevention(bucket.Name, []storage.ACLRule{{Entity: entity, Role: role}}); err != nil {
+		return errToJsonResponse(err)
+	}
+
+	attrs := bucket.Attrs()
+	acl, found := setACLRole(attrs.DefaultObjectACL, entity, role)
+	if !found && r.Method == http.MethodPatch {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	attrs.DefaultObjectACL = acl
+	if err := s.backend.UpdateBucket(bucket.Name, attrs); err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	return jsonResponse{data: newDefaultObjectACLResponse(bucket.Name, storage.ACLRule{Entity: entity, Role: role})}
+}
+
+func (s *Server) deleteDefaultObjectACL(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	bucket, err := s.backend.GetBucket(vars["bucketName"])
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	attrs := bucket.Attrs()
+	acl, found := removeACLRule(attrs.DefaultObjectACL, storage.ACLEntity(vars["entity"]))
+	if !found {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	attrs.DefaultObjectACL = acl
+	if err := s.backend.UpdateBucket(bucket.Name, attrs); err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	return jsonResponse{}
+}
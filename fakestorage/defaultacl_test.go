@@ -0,0 +1,209 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestBucketDefaultObjectACL(t *testing.T) {
+	runServersTest(t, runServersOptions{enableFSBackend: true}, func(t *testing.T, server *Server) {
+		const bucketName = "acl-bucket"
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName})
+		bucket := server.Client().Bucket(bucketName)
+		defaultACL := bucket.DefaultObjectACL()
+
+		rules, err := defaultACL.List(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rules) != 0 {
+			t.Errorf("unexpected default object ACL: %+v", rules)
+		}
+		if err := defaultACL.Set(context.TODO(), storage.AllUsers, storage.RoleReader); err != nil {
+			t.Fatal(err)
+		}
+		if err := defaultACL.Set(context.TODO(), "user-alice@example.com", storage.RoleOwner); err != nil {
+			t.Fatal(err)
+		}
+		if err := defaultACL.Set(context.TODO(), "user-alice@example.com", storage.RoleReader); err != nil {
+			t.Fatal(err)
+		}
+		expectedRules := []string{"allUsers:READER", "user-alice@example.com:READER"}
+		rules, err = defaultACL.List(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aclRoles(rules); !reflect.DeepEqual(got, expectedRules) {
+			t.Errorf("wrong default object ACL\nwant %v\ngot  %v", expectedRules, got)
+		}
+
+		w := bucket.Object("object.txt").NewWriter(context.TODO())
+		w.Write([]byte("content"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		rules, err = bucket.Object("object.txt").ACL().List(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aclRoles(rules); !reflect.DeepEqual(got, expectedRules) {
+			t.Errorf("wrong ACL of an object uploaded without one\nwant %v\ngot  %v", expectedRules, got)
+		}
+
+		w = bucket.Object("private.txt").NewWriter(context.TODO())
+		w.PredefinedACL = "projectPrivate"
+		w.Write([]byte("content"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := server.GetObject(bucketName, "private.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isACLPublic(obj.ACL) {
+			t.Errorf("object uploaded with a predefined ACL got the default object ACL: %+v", obj.ACL)
+		}
+
+		if err := defaultACL.Delete(context.TODO(), storage.AllUsers); err != nil {
+			t.Fatal(err)
+		}
+		rules, err = defaultACL.List(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aclRoles(rules); !reflect.DeepEqual(got, expectedRules[1:]) {
+			t.Errorf("wrong default object ACL after deleting a rule\nwant %v\ngot  %v", expectedRules[1:], got)
+		}
+		err = defaultACL.Delete(context.TODO(), storage.AllUsers)
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+			t.Errorf("wrong error deleting a rule that doesn't exist: %v", err)
+		}
+	})
+}
+
+func TestBucketDefaultObjectACLEndpoints(t *testing.T) {
+	const bucketURL = "https://storage.googleapis.com/storage/v1/b/acl-bucket"
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "acl-bucket"})
+	server.SetBucketDefaultObjectACL("acl-bucket", []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}})
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "get",
+			method:         http.MethodGet,
+			url:            bucketURL + "/defaultObjectAcl/allUsers",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "get missing entity",
+			method:         http.MethodGet,
+			url:            bucketURL + "/defaultObjectAcl/allAuthenticatedUsers",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "insert",
+			method:         http.MethodPost,
+			url:            bucketURL + "/defaultObjectAcl",
+			body:           `{"entity":"allAuthenticatedUsers","role":"READER"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "insert without entity",
+			method:         http.MethodPost,
+			url:            bucketURL + "/defaultObjectAcl",
+			body:           `{"role":"READER"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid role",
+			method:         http.MethodPost,
+			url:            bucketURL + "/defaultObjectAcl",
+			body:           `{"entity":"allUsers","role":"WRITER"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "patch",
+			method:         http.MethodPatch,
+			url:            bucketURL + "/defaultObjectAcl/allAuthenticatedUsers",
+			body:           `{"role":"OWNER"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "patch missing entity",
+			method:         http.MethodPatch,
+			url:            bucketURL + "/defaultObjectAcl/user-bob@example.com",
+			body:           `{"role":"OWNER"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "bucket not found",
+			method:         http.MethodGet,
+			url:            "https://storage.googleapis.com/storage/v1/b/missing-bucket/defaultObjectAcl",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "acl-bucket", Name: "object.txt"}})
+	obj, err := server.GetObject("acl-bucket", "object.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedACL := []storage.ACLRule{
+		{Entity: storage.AllUsers, Role: storage.RoleReader},
+		{Entity: storage.AllAuthenticatedUsers, Role: storage.RoleOwner},
+	}
+	if !reflect.DeepEqual(obj.ACL, expectedACL) {
+		t.Errorf("wrong ACL of an object created without one\nwant %+v\ngot  %+v", expectedACL, obj.ACL)
+	}
+}
+
+// aclRoles returns the rules in the entity:role format, ignoring the fields
+// filled by the client.
+func aclRoles(rules []storage.ACLRule) []string {
+	roles := make([]string, len(rules))
+	for i, rule := range rules {
+		roles[i] = string(rule.Entity) + ":" + string(rule.Role)
+	}
+	return roles
+}
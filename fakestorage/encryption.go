@@ -0,0 +1,163 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// customerEncryptionAlgorithm is the only algorithm supported for
+// customer-supplied encryption keys.
+const customerEncryptionAlgorithm = "AES256"
+
+const (
+	encryptionHeaderPrefix     = "X-Goog-Encryption-"
+	copySourceEncryptionPrefix = "X-Goog-Copy-Source-Encryption-"
+)
+
+// kmsKeyNameRegexp matches the resource names of Cloud KMS keys, optionally
+// followed by the key version.
+var kmsKeyNameRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+(/cryptoKeyVersions/[^/]+)?$`)
+
+type customerEncryption struct {
+	EncryptionAlgorithm string `json:"encryptionAlgorithm"`
+	KeySha256           string `json:"keySha256"`
+}
+
+func newCustomerEncryption(keySHA256 string) *customerEncryption {
+	if keySHA256 == "" {
+		return nil
+	}
+	return &customerEncryption{EncryptionAlgorithm: customerEncryptionAlgorithm, KeySha256: keySHA256}
+}
+
+// customerKeySHA256 validates the customer-supplied encryption key sent in
+// the headers with the given prefix and returns the base64-encoded SHA256 of
+// the key, or an empty string if the request has no key. The key itself is
+// never stored: objects only keep the hash, which is what is used to check
+// the key sent on later requests.
+func customerKeySHA256(r *http.Request, prefix string) (string, *jsonResponse) {
+	algorithm := r.Header.Get(prefix + "Algorithm")
+	key := r.Header.Get(prefix + "Key")
+	keySHA256 := r.Header.Get(prefix + "Key-Sha256")
+	if algorithm == "" && key == "" && keySHA256 == "" {
+		return "", nil
+	}
+	if algorithm != customerEncryptionAlgorithm {
+		return "", &jsonResponse{
+			status:       http.StatusBadRequest,
+			errorReason:  "customerEncryptionAlgorithmIsInvalid",
+			errorMessage: `Missing an encryption algorithm, or the provided algorithm is not "AE256."`,
+		}
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(rawKey) != 32 {
+		return "", &jsonResponse{
+			status:       http.StatusBadRequest,
+			errorReason:  "customerEncryptionKeyFormatIsInvalid",
+			errorMessage: "Missing an encryption key, or it is not base64 encoded, or it does not meet the required length of the encryption algorithm.",
+		}
+	}
+	sum := sha256.Sum256(rawKey)
+	expectedSHA256 := base64.StdEncoding.EncodeToString(sum[:])
+	if keySHA256 != expectedSHA256 {
+		return "", &jsonResponse{
+			status:       http.StatusBadRequest,
+			errorReason:  "customerEncryptionKeySha256IsInvalid",
+			errorMessage: "Missing a SHA256 hash of the encryption key, or it is not base64 encoded, or it does not match the encryption key.",
+		}
+	}
+	return expectedSHA256, nil
+}
+
+// checkCustomerKey verifies that the customer-supplied encryption key sent
+// in the headers with the given prefix is the key the object was encrypted
+// with.
+func checkCustomerKey(r *http.Request, prefix string, obj ObjectAttrs) *jsonResponse {
+	keySHA256, errResp := customerKeySHA256(r, prefix)
+	if errResp != nil {
+		return errResp
+	}
+	switch {
+	case obj.CustomerKeySHA256 == "" && keySHA256 != "":
+		return &jsonResponse{
+			status:       http.StatusBadRequest,
+			errorReason:  "resourceNotEncryptedWithCustomerEncryptionKey",
+			errorMessage: "The target object is not encrypted by a customer-supplied encryption key.",
+		}
+	case obj.CustomerKeySHA256 != "" && keySHA256 == "":
+		return &jsonResponse{
+			status:       http.StatusBadRequest,
+			errorReason:  "resourceIsEncryptedWithCustomerEncryptionKey",
+			errorMessage: "The target object is encrypted by a customer-supplied encryption key.",
+		}
+	case obj.CustomerKeySHA256 != keySHA256:
+		return &jsonResponse{
+			status:       http.StatusBadRequest,
+			errorReason:  "customerEncryptionKeyIsIncorrect",
+			errorMessage: "The provided encryption key is incorrect.",
+		}
+	}
+	return nil
+}
+
+func validateKMSKeyName(name string) error {
+	if !kmsKeyNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid Cloud KMS key name %q: the name must be in the format projects/PROJECT/locations/LOCATION/keyRings/KEY_RING/cryptoKeys/KEY", name)
+	}
+	return nil
+}
+
+// SetBucketDefaultKMSKeyName sets the Cloud KMS key of objects uploaded to
+// the bucket without an encryption key. An empty name removes the default
+// key.
+func (s *Server) SetBucketDefaultKMSKeyName(bucketName, kmsKeyName string) error {
+	if kmsKeyName != "" {
+		if err := validateKMSKeyName(kmsKeyName); err != nil {
+			return err
+		}
+	}
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	attrs.DefaultKMSKeyName = kmsKeyName
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// objectEncryption returns how an object written by the request to the
+// bucket is encrypted: with the customer-supplied key sent in the headers of
+// the request, whose SHA256 is returned, or with a Cloud KMS key. The KMS key
+// is the one requested, falling back to the default KMS key of the bucket
+// for requests without a customer-supplied key.
+func (s *Server) objectEncryption(r *http.Request, bucketName, kmsKeyName string) (string, string, *jsonResponse) {
+	keySHA256, errResp := customerKeySHA256(r, encryptionHeaderPrefix)
+	if errResp != nil {
+		return "", "", errResp
+	}
+	if kmsKeyName != "" {
+		if keySHA256 != "" {
+			return "", "", &jsonResponse{
+				status:       http.StatusBadRequest,
+				errorMessage: "A customer-supplied encryption key and a Cloud KMS key can't be used together.",
+			}
+		}
+		if err := validateKMSKeyName(kmsKeyName); err != nil {
+			return "", "", &jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+		}
+		return "", kmsKeyName, nil
+	}
+	if keySHA256 == "" {
+		if bucket, err := s.backend.GetBucket(bucketName); err == nil {
+			kmsKeyName = bucket.DefaultKMSKeyName
+		}
+	}
+	return keySHA256, kmsKeyName, nil
+}
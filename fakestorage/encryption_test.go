@@ -0,0 +1,285 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestServerClientCustomerSuppliedEncryptionKey(t *testing.T) {
+	const (
+		bucketName = "some-bucket"
+		objectName = "secret.txt"
+		content    = "something secret"
+	)
+	key := []byte(strings.Repeat("k", 32))
+	otherKey := []byte(strings.Repeat("o", 32))
+	sum := sha256.Sum256(key)
+	keySHA256 := base64.StdEncoding.EncodeToString(sum[:])
+
+	runServersTest(t, runServersOptions{
+		objs: []Object{{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "plain.txt"}, Content: []byte(content)}},
+	}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		bucket := server.Client().Bucket(bucketName)
+		obj := bucket.Object(objectName)
+
+		w := obj.Key(key).NewWriter(ctx)
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if w.Attrs().CustomerKeySHA256 != keySHA256 {
+			t.Errorf("wrong key SHA256 of the uploaded object\nwant %q\ngot  %q", keySHA256, w.Attrs().CustomerKeySHA256)
+		}
+
+		// metadata doesn't require the key.
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.CustomerKeySHA256 != keySHA256 {
+			t.Errorf("wrong key SHA256\nwant %q\ngot  %q", keySHA256, attrs.CustomerKeySHA256)
+		}
+
+		if _, err := obj.NewReader(ctx); err == nil {
+			t.Error("unexpected <nil> error reading the object without the key")
+		}
+		if _, err := obj.Key(otherKey).NewReader(ctx); err == nil {
+			t.Error("unexpected <nil> error reading the object with the wrong key")
+		}
+		if _, err := bucket.Object("plain.txt").Key(key).NewReader(ctx); err == nil {
+			t.Error("unexpected <nil> error reading an object without a key with a key")
+		}
+		r, err := obj.Key(key).NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("wrong content\nwant %q\ngot  %q", content, data)
+		}
+
+		// rewrites need the key of the source, and the copy is encrypted
+		// with the key of the destination, if any.
+		if _, err := bucket.Object("copy.txt").CopierFrom(obj).Run(ctx); err == nil {
+			t.Error("unexpected <nil> error rewriting the object without the key")
+		}
+		copied, err := bucket.Object("copy.txt").Key(otherKey).CopierFrom(obj.Key(key)).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherSum := sha256.Sum256(otherKey)
+		if expected := base64.StdEncoding.EncodeToString(otherSum[:]); copied.CustomerKeySHA256 != expected {
+			t.Errorf("wrong key SHA256 of the copy\nwant %q\ngot  %q", expected, copied.CustomerKeySHA256)
+		}
+		decrypted, err := bucket.Object("decrypted.txt").CopierFrom(obj.Key(key)).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted.CustomerKeySHA256 != "" {
+			t.Errorf("unexpected key SHA256 of the decrypted copy: %q", decrypted.CustomerKeySHA256)
+		}
+
+		// composed objects are encrypted with the key of the compose
+		// request, not with the key of the object they replace.
+		composed, err := bucket.Object("composed.txt").Key(key).ComposerFrom(obj, obj).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if composed.CustomerKeySHA256 != keySHA256 {
+			t.Errorf("wrong key SHA256 of the composed object\nwant %q\ngot  %q", keySHA256, composed.CustomerKeySHA256)
+		}
+		recomposed, err := bucket.Object("composed.txt").ComposerFrom(bucket.Object("plain.txt")).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recomposed.CustomerKeySHA256 != "" {
+			t.Errorf("unexpected key SHA256 of the recomposed object: %q", recomposed.CustomerKeySHA256)
+		}
+	})
+}
+
+func TestServerCustomerSuppliedEncryptionKeyErrors(t *testing.T) {
+	key := strings.Repeat("k", 32)
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	sum := sha256.Sum256([]byte(key))
+	keySHA256 := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name           string
+		algorithm      string
+		key            string
+		keySHA256      string
+		expectedStatus int
+	}{
+		{
+			name:           "valid key",
+			algorithm:      "AES256",
+			key:            encodedKey,
+			keySHA256:      keySHA256,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid algorithm",
+			algorithm:      "AES128",
+			key:            encodedKey,
+			keySHA256:      keySHA256,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "short key",
+			algorithm:      "AES256",
+			key:            base64.StdEncoding.EncodeToString([]byte("short")),
+			keySHA256:      keySHA256,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "missing key SHA256",
+			algorithm:      "AES256",
+			key:            encodedKey,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "wrong key SHA256",
+			algorithm:      "AES256",
+			key:            encodedKey,
+			keySHA256:      base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)),
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{NoListener: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+
+			req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name=secret.txt", strings.NewReader("something"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Goog-Encryption-Algorithm", test.algorithm)
+			req.Header.Set("X-Goog-Encryption-Key", test.key)
+			req.Header.Set("X-Goog-Encryption-Key-Sha256", test.keySHA256)
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestServerClientCustomerManagedEncryptionKey(t *testing.T) {
+	const (
+		bucketName = "some-bucket"
+		defaultKey = "projects/my-project/locations/us/keyRings/my-ring/cryptoKeys/default-key"
+		otherKey   = "projects/my-project/locations/us/keyRings/my-ring/cryptoKeys/other-key"
+	)
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		client := server.Client()
+		bucket := client.Bucket(bucketName)
+		if err := bucket.Create(ctx, "my-project", &storage.BucketAttrs{
+			Encryption: &storage.BucketEncryption{DefaultKMSKeyName: "not-a-key"},
+		}); err == nil {
+			t.Error("unexpected <nil> error creating a bucket with an invalid default KMS key")
+		}
+		if err := bucket.Create(ctx, "my-project", &storage.BucketAttrs{
+			Encryption: &storage.BucketEncryption{DefaultKMSKeyName: defaultKey},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		bucketAttrs, err := bucket.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucketAttrs.Encryption == nil || bucketAttrs.Encryption.DefaultKMSKeyName != defaultKey {
+			t.Errorf("wrong bucket encryption\nwant %q\ngot  %+v", defaultKey, bucketAttrs.Encryption)
+		}
+
+		upload := func(name string, configure func(*storage.Writer)) (*storage.ObjectAttrs, error) {
+			w := bucket.Object(name).NewWriter(ctx)
+			configure(w)
+			if _, err := io.WriteString(w, "something"); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return w.Attrs(), nil
+		}
+		attrs, err := upload("default.txt", func(*storage.Writer) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.KMSKeyName != defaultKey {
+			t.Errorf("wrong KMS key of the object uploaded without a key\nwant %q\ngot  %q", defaultKey, attrs.KMSKeyName)
+		}
+		attrs, err = upload("other.txt", func(w *storage.Writer) { w.KMSKeyName = otherKey })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.KMSKeyName != otherKey {
+			t.Errorf("wrong KMS key of the object uploaded with a key\nwant %q\ngot  %q", otherKey, attrs.KMSKeyName)
+		}
+		if _, err := upload("invalid.txt", func(w *storage.Writer) { w.KMSKeyName = "projects/my-project/cryptoKeys/key" }); err == nil {
+			t.Error("unexpected <nil> error uploading an object with an invalid KMS key")
+		}
+
+		copied, err := bucket.Object("copy.txt").CopierFrom(bucket.Object("default.txt")).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied.KMSKeyName != defaultKey {
+			t.Errorf("wrong KMS key of the copy\nwant %q\ngot  %q", defaultKey, copied.KMSKeyName)
+		}
+		copier := bucket.Object("copy.txt").CopierFrom(bucket.Object("default.txt"))
+		copier.DestinationKMSKeyName = otherKey
+		copied, err = copier.Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied.KMSKeyName != otherKey {
+			t.Errorf("wrong KMS key of the copy with a destination key\nwant %q\ngot  %q", otherKey, copied.KMSKeyName)
+		}
+
+		bucketAttrs, err = bucket.Update(ctx, storage.BucketAttrsToUpdate{Encryption: &storage.BucketEncryption{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucketAttrs.Encryption != nil {
+			t.Errorf("unexpected bucket encryption after removing the default key: %+v", bucketAttrs.Encryption)
+		}
+		attrs, err = upload("plain.txt", func(*storage.Writer) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.KMSKeyName != "" {
+			t.Errorf("unexpected KMS key of an object uploaded to a bucket without a default key: %q", attrs.KMSKeyName)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"time"
+)
+
+// minExpiryInterval and maxExpiryInterval bound the interval between the
+// runs of ExpireObjects when Options.ObjectTTL is set, so tiny TTLs don't
+// keep the server scanning all buckets.
+const (
+	minExpiryInterval = time.Second
+	maxExpiryInterval = time.Minute
+)
+
+// ExpireObjects deletes every object version, in all buckets, created longer
+// than ttl ago, regardless of the lifecycle rules of the buckets. Objects
+// under the retention policy of their bucket are kept. It returns the number
+// of deleted versions.
+//
+// As with lifecycle Delete actions, expiring the live version of an object in
+// a bucket with versioning enabled makes it noncurrent, and it's deleted by a
+// later run.
+func (s *Server) ExpireObjects(ttl time.Duration) (int, error) {
+	var deleted int
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		return deleted, err
+	}
+	expiration := time.Now().Add(-ttl)
+	for _, bucket := range buckets {
+		objs, err := s.lifecycleObjects(bucket.Name)
+		if err != nil {
+			return deleted, err
+		}
+		for _, obj := range objs {
+			if !obj.Created.Before(expiration) || s.checkRetention(obj.ObjectAttrs) != nil {
+				continue
+			}
+			if err := s.deleteObjectVersion(bucket, obj); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// expireObjectsPeriodically calls ExpireObjects until stop is closed, often
+// enough for objects to be deleted shortly after they expire.
+func (s *Server) expireObjectsPeriodically(ttl time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(expiryInterval(ttl))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.ExpireObjects(ttl)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// expiryInterval returns the interval between the runs of ExpireObjects for
+// the given TTL: a tenth of it, within minExpiryInterval and
+// maxExpiryInterval.
+func expiryInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 10
+	if interval < minExpiryInterval {
+		return minExpiryInterval
+	}
+	if interval > maxExpiryInterval {
+		return maxExpiryInterval
+	}
+	return interval
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireObjects(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "old.txt", Created: time.Now().Add(-2 * time.Hour)}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "new.txt"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "retained-bucket", Name: "old.txt", Created: time.Now().Add(-2 * time.Hour)}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.SetBucketRetentionPolicy("retained-bucket", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := server.ExpireObjects(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("wrong number of expired objects\nwant 1\ngot  %d", deleted)
+	}
+	if _, err := server.GetObject("some-bucket", "old.txt"); err == nil {
+		t.Error("expired object wasn't deleted")
+	}
+	kept := []struct{ bucketName, objectName string }{
+		{"some-bucket", "new.txt"},
+		{"retained-bucket", "old.txt"},
+	}
+	for _, obj := range kept {
+		if _, err := server.GetObject(obj.bucketName, obj.objectName); err != nil {
+			t.Errorf("unexpected error getting %s/%s: %v", obj.bucketName, obj.objectName, err)
+		}
+	}
+}
+
+func TestObjectTTL(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		ObjectTTL:  50 * time.Millisecond,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := server.GetObject("some-bucket", "file.txt"); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("file.txt wasn't deleted after its TTL")
+}
+
+func TestExpiryInterval(t *testing.T) {
+	tests := []struct {
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{time.Nanosecond, time.Second},
+		{5 * time.Second, time.Second},
+		{30 * time.Second, 3 * time.Second},
+		{24 * time.Hour, time.Minute},
+	}
+	for _, test := range tests {
+		if got := expiryInterval(test.ttl); got != test.expected {
+			t.Errorf("wrong interval for a TTL of %s\nwant %s\ngot  %s", test.ttl, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+	"github.com/gorilla/mux"
+)
+
+// FaultType identifies the kind of failure injected by a FaultRule.
+type FaultType string
+
+// FaultChecksumMismatch serves the object content unchanged, but with an
+// X-Goog-Hash header that doesn't match it, so client-side integrity checks
+// fail.
+const FaultChecksumMismatch FaultType = "checksumMismatch"
+
+// FaultError fails a share of the matching requests with an error status,
+// such as 503, so retry and backoff logic can be exercised.
+const FaultError FaultType = "error"
+
+// FaultUploadInterruption interrupts the resumable uploads of the matching
+// objects once, after receiving the given number of bytes. The bytes received
+// until then are kept in the upload session, so the client can query the
+// upload status and resume it.
+const FaultUploadInterruption FaultType = "uploadInterruption"
+
+// FaultRule describes a failure that the server should inject on requests
+// that match it.
+type FaultRule struct {
+	Type FaultType `json:"type"`
+
+	// BucketName and ObjectName restrict the rule to a given bucket and/or
+	// object. Empty values match everything.
+	BucketName string `json:"bucket,omitempty"`
+	ObjectName string `json:"object,omitempty"`
+
+	// ClientIP, UserAgent, Method and Headers restrict the rule to requests
+	// coming from the given IP address, with a User-Agent header containing
+	// the given value, using the given HTTP method, or with all the given
+	// headers set to the given values. Empty values match every request.
+	ClientIP  string            `json:"clientIp,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	Method    string            `json:"method,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+
+	// APIMethod restricts the rule to the requests to the given method of
+	// the JSON API, such as "storage.objects.get", including the
+	// equivalent requests of the XML API.
+	APIMethod string `json:"apiMethod,omitempty"`
+
+	// Status, Percentage and Count configure FaultError rules: the status
+	// returned, 503 by default, the percentage of the matching requests
+	// that fail, up to 100, and the number of requests that fail before
+	// the rule expires. Rules with a Count fail every matching request
+	// by default, while rules without one need a Percentage and never
+	// expire.
+	//
+	// FaultUploadInterruption rules return the Status, if set, after
+	// receiving AfterBytes bytes of the upload, or drop the connection
+	// otherwise.
+	Status     int     `json:"status,omitempty"`
+	Percentage float64 `json:"percentage,omitempty"`
+	Count      int     `json:"count,omitempty"`
+	AfterBytes int64   `json:"afterBytes,omitempty"`
+}
+
+func (f *FaultRule) matches(r *http.Request, bucketName, objectName string) bool {
+	if f.BucketName != "" && f.BucketName != bucketName {
+		return false
+	}
+	if f.ObjectName != "" && f.ObjectName != objectName {
+		return false
+	}
+	if f.ClientIP != "" && !net.ParseIP(f.ClientIP).Equal(clientIP(r)) {
+		return false
+	}
+	if f.UserAgent != "" && !strings.Contains(r.UserAgent(), f.UserAgent) {
+		return false
+	}
+	if f.Method != "" && !strings.EqualFold(f.Method, r.Method) {
+		return false
+	}
+	for name, value := range f.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	if f.APIMethod != "" && f.APIMethod != apiMethod(r) {
+		return false
+	}
+	return true
+}
+
+// clientIP returns the IP address the request came from, or nil if it's
+// unknown, as in requests handled by the in-process transport.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+type faultRules struct {
+	mtx   sync.RWMutex
+	rules []FaultRule
+}
+
+func (f *faultRules) add(rule FaultRule) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.rules = append(f.rules, rule)
+}
+
+func (f *faultRules) clear() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.rules = nil
+}
+
+func (f *faultRules) list() []FaultRule {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	return append([]FaultRule{}, f.rules...)
+}
+
+// find returns the first rule of the given type that matches the request for
+// the given bucket and object.
+func (f *faultRules) find(faultType FaultType, r *http.Request, bucketName, objectName string) (FaultRule, bool) {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	for _, rule := range f.rules {
+		if rule.Type == faultType && rule.matches(r, bucketName, objectName) {
+			return rule, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// fail returns the first FaultError rule that matches the request for the
+// given bucket and object, if the request should fail. Each failure counts
+// towards the Count of the rule, which is removed once it reaches zero.
+func (f *faultRules) fail(r *http.Request, bucketName, objectName string) (FaultRule, bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for i, rule := range f.rules {
+		if rule.Type != FaultError || !rule.matches(r, bucketName, objectName) {
+			continue
+		}
+		percentage := rule.Percentage
+		if percentage == 0 {
+			percentage = 100
+		}
+		if rand.Float64()*100 >= percentage {
+			return FaultRule{}, false
+		}
+		if rule.Count > 0 {
+			f.rules[i].Count--
+			if f.rules[i].Count == 0 {
+				f.rules = append(f.rules[:i:i], f.rules[i+1:]...)
+			}
+		}
+		return rule, true
+	}
+	return FaultRule{}, false
+}
+
+// AddFaultRule registers a fault to be injected on the requests matching the
+// rule. Rules remain active until ClearFaultRules is called, except for
+// FaultError rules with a Count, which expire once their failures are
+// consumed.
+func (s *Server) AddFaultRule(rule FaultRule) error {
+	if err := validateFaultRule(rule); err != nil {
+		return err
+	}
+	s.faults.add(rule)
+	return nil
+}
+
+// ClearFaultRules removes all registered fault rules.
+func (s *Server) ClearFaultRules() {
+	s.faults.clear()
+}
+
+func validateFaultRule(rule FaultRule) error {
+	switch rule.Type {
+	case FaultChecksumMismatch:
+	case FaultError:
+		if rule.Status != 0 && rule.Status != http.StatusTooManyRequests && (rule.Status < 500 || rule.Status > 599) {
+			return fmt.Errorf("invalid fault status %d, must be 429 or 5xx", rule.Status)
+		}
+		if rule.Count < 0 {
+			return fmt.Errorf("invalid fault count %d, must not be negative", rule.Count)
+		}
+		if rule.Percentage < 0 || rule.Percentage > 100 || (rule.Percentage == 0 && rule.Count == 0) {
+			return fmt.Errorf("invalid fault percentage %v, must be greater than 0 and up to 100", rule.Percentage)
+		}
+	case FaultUploadInterruption:
+		if rule.Status != 0 && rule.Status != http.StatusTooManyRequests && (rule.Status < 500 || rule.Status > 599) {
+			return fmt.Errorf("invalid fault status %d, must be 429 or 5xx", rule.Status)
+		}
+		if rule.AfterBytes < 0 {
+			return fmt.Errorf("invalid fault afterBytes %d, must not be negative", rule.AfterBytes)
+		}
+	default:
+		return fmt.Errorf("invalid fault type %q", rule.Type)
+	}
+	if rule.ClientIP != "" && net.ParseIP(rule.ClientIP) == nil {
+		return fmt.Errorf("invalid client IP %q", rule.ClientIP)
+	}
+	return nil
+}
+
+// applyFaultRules is the middleware that fails the API requests matching
+// FaultError rules, each with the probability given by the rule's
+// percentage, until their count is consumed. Requests to the internal endpoints are never failed.
+func (s *Server) applyFaultRules(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiMethod(r) == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		vars := mux.Vars(r)
+		objectName := vars["objectName"]
+		if objectName == "" {
+			objectName = r.URL.Query().Get("name")
+		}
+		rule, ok := s.faults.fail(r, vars["bucketName"], objectName)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		status := rule.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		writeAPIError(w, r, status, fmt.Sprintf("Injected fault: %s", http.StatusText(status)))
+	})
+}
+
+// corruptedChecksums returns CRC32C and MD5 values that don't match content.
+func corruptedChecksums(content []byte) (string, string) {
+	corrupted := append([]byte{0}, content...)
+	return checksum.EncodedCrc32cChecksum(corrupted), checksum.EncodedMd5Hash(corrupted)
+}
+
+type faultRulesResponse struct {
+	Kind  string      `json:"kind"`
+	Items []FaultRule `json:"items"`
+}
+
+func (s *Server) listFaultRules(r *http.Request) jsonResponse {
+	return jsonResponse{data: faultRulesResponse{Kind: "fakestorage#faultRules", Items: s.faults.list()}}
+}
+
+func (s *Server) addFaultRule(r *http.Request) jsonResponse {
+	var rule FaultRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Fault rule payload can not be parsed."}
+	}
+	if err := s.AddFaultRule(rule); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	return s.listFaultRules(r)
+}
+
+func (s *Server) clearFaultRules(r *http.Request) jsonResponse {
+	s.ClearFaultRules()
+	return jsonResponse{}
+}
@@ -0,0 +1,575 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+)
+
+func TestFaultChecksumMismatch(t *testing.T) {
+	const content = "some nice content"
+	objs := []Object{
+		{
+			ObjectAttrs: ObjectAttrs{
+				BucketName: "some-bucket",
+				Name:       "files/txt/text-01.txt",
+				Crc32c:     checksum.EncodedCrc32cChecksum([]byte(content)),
+				Md5Hash:    checksum.EncodedMd5Hash([]byte(content)),
+			},
+			Content: []byte(content),
+		},
+		{
+			ObjectAttrs: ObjectAttrs{
+				BucketName: "some-bucket",
+				Name:       "files/txt/text-02.txt",
+				Crc32c:     checksum.EncodedCrc32cChecksum([]byte(content)),
+				Md5Hash:    checksum.EncodedMd5Hash([]byte(content)),
+			},
+			Content: []byte(content),
+		},
+	}
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		err := server.AddFaultRule(FaultRule{
+			Type:       FaultChecksumMismatch,
+			BucketName: "some-bucket",
+			ObjectName: "files/txt/text-01.txt",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := server.Client()
+		read := func(name string) ([]byte, error) {
+			reader, err := client.Bucket("some-bucket").Object(name).NewReader(context.Background())
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return io.ReadAll(reader)
+		}
+
+		if _, err := read("files/txt/text-01.txt"); err == nil {
+			t.Error("unexpected <nil> error reading object with corrupted checksum")
+		}
+		if data, err := read("files/txt/text-02.txt"); err != nil {
+			t.Errorf("unexpected error reading object that doesn't match the rule: %v", err)
+		} else if string(data) != content {
+			t.Errorf("wrong content\nwant %q\ngot  %q", content, string(data))
+		}
+
+		server.ClearFaultRules()
+		if data, err := read("files/txt/text-01.txt"); err != nil {
+			t.Errorf("unexpected error after clearing rules: %v", err)
+		} else if string(data) != content {
+			t.Errorf("wrong content\nwant %q\ngot  %q", content, string(data))
+		}
+	})
+}
+
+func TestFaultRuleRequestMatchers(t *testing.T) {
+	newRequest := func(method, userAgent string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(method, "/storage/v1/b/some-bucket/o/file.txt", nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("User-Agent", userAgent)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+	tests := []struct {
+		name     string
+		rule     FaultRule
+		req      *http.Request
+		expected bool
+	}{
+		{
+			"no matchers",
+			FaultRule{},
+			newRequest(http.MethodGet, "some-client", nil),
+			true,
+		},
+		{
+			"matching client IP",
+			FaultRule{ClientIP: "192.0.2.10"},
+			newRequest(http.MethodGet, "some-client", nil),
+			true,
+		},
+		{
+			"different client IP",
+			FaultRule{ClientIP: "192.0.2.11"},
+			newRequest(http.MethodGet, "some-client", nil),
+			false,
+		},
+		{
+			"matching user agent",
+			FaultRule{UserAgent: "flaky-client"},
+			newRequest(http.MethodGet, "gcloud-golang/1.0 flaky-client/0.1", nil),
+			true,
+		},
+		{
+			"different user agent",
+			FaultRule{UserAgent: "flaky-client"},
+			newRequest(http.MethodGet, "gcloud-golang/1.0", nil),
+			false,
+		},
+		{
+			"matching method",
+			FaultRule{Method: "get"},
+			newRequest(http.MethodGet, "some-client", nil),
+			true,
+		},
+		{
+			"different method",
+			FaultRule{Method: http.MethodHead},
+			newRequest(http.MethodGet, "some-client", nil),
+			false,
+		},
+		{
+			"matching headers",
+			FaultRule{Headers: map[string]string{"X-Test-Client": "a", "X-Test-Run": "1"}},
+			newRequest(http.MethodGet, "some-client", map[string]string{"X-Test-Client": "a", "X-Test-Run": "1"}),
+			true,
+		},
+		{
+			"missing header",
+			FaultRule{Headers: map[string]string{"X-Test-Client": "a", "X-Test-Run": "1"}},
+			newRequest(http.MethodGet, "some-client", map[string]string{"X-Test-Client": "a"}),
+			false,
+		},
+		{
+			"all matchers",
+			FaultRule{BucketName: "some-bucket", ClientIP: "192.0.2.10", UserAgent: "some", Method: http.MethodGet, Headers: map[string]string{"X-Test-Client": "a"}},
+			newRequest(http.MethodGet, "some-client", map[string]string{"X-Test-Client": "a"}),
+			true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.rule.matches(test.req, "some-bucket", "file.txt"); got != test.expected {
+				t.Errorf("wrong match result\nwant %t\ngot  %t", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestFaultRulesEndpoint(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+		expectedRules  int
+	}{
+		{
+			"POST: valid rule",
+			http.MethodPost,
+			`{"type":"checksumMismatch","bucket":"some-bucket"}`,
+			http.StatusOK,
+			1,
+		},
+		{
+			"POST: invalid type",
+			http.MethodPost,
+			`{"type":"whatever"}`,
+			http.StatusBadRequest,
+			1,
+		},
+		{
+			"POST: invalid payload",
+			http.MethodPost,
+			`{`,
+			http.StatusBadRequest,
+			1,
+		},
+		{
+			"POST: valid error rule",
+			http.MethodPost,
+			`{"type":"error","apiMethod":"storage.objects.get","status":429,"percentage":10}`,
+			http.StatusOK,
+			2,
+		},
+		{
+			"POST: invalid error status",
+			http.MethodPost,
+			`{"type":"error","status":404,"percentage":10}`,
+			http.StatusBadRequest,
+			2,
+		},
+		{
+			"POST: missing error percentage",
+			http.MethodPost,
+			`{"type":"error","status":503}`,
+			http.StatusBadRequest,
+			2,
+		},
+		{
+			"POST: invalid upload interruption",
+			http.MethodPost,
+			`{"type":"uploadInterruption","afterBytes":-1}`,
+			http.StatusBadRequest,
+			2,
+		},
+		{
+			"POST: invalid client IP",
+			http.MethodPost,
+			`{"type":"checksumMismatch","clientIp":"localhost"}`,
+			http.StatusBadRequest,
+			2,
+		},
+		{
+			"DELETE: clear rules",
+			http.MethodDelete,
+			"",
+			http.StatusOK,
+			0,
+		},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "https://storage.googleapis.com/_internal/faults", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("%s: wrong status returned\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+		}
+
+		resp, err = client.Get("https://storage.googleapis.com/_internal/faults")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rules faultRulesResponse
+		err = json.NewDecoder(resp.Body).Decode(&rules)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rules.Items) != test.expectedRules {
+			t.Errorf("%s: wrong number of rules\nwant %d\ngot  %d", test.name, test.expectedRules, len(rules.Items))
+		}
+	}
+}
+
+func TestFaultErrors(t *testing.T) {
+	const bucketName = "some-bucket"
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "flaky.txt"}, Content: []byte("something")},
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "file.txt"}, Content: []byte("something")},
+		},
+		FaultRules: []FaultRule{
+			{Type: FaultError, APIMethod: "storage.objects.get", ObjectName: "flaky.txt", Percentage: 100},
+			{Type: FaultError, APIMethod: "storage.buckets.get", Status: http.StatusTooManyRequests, Percentage: 100},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedReason string
+	}{
+		{
+			"JSON API metadata",
+			"https://storage.googleapis.com/storage/v1/b/some-bucket/o/flaky.txt",
+			http.StatusServiceUnavailable,
+			"backendError",
+		},
+		{
+			"JSON API download",
+			"https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/flaky.txt?alt=media",
+			http.StatusServiceUnavailable,
+			"backendError",
+		},
+		{
+			"XML API download",
+			"https://storage.googleapis.com/some-bucket/flaky.txt",
+			http.StatusServiceUnavailable,
+			"",
+		},
+		{
+			"other object",
+			"https://storage.googleapis.com/storage/v1/b/some-bucket/o/file.txt",
+			http.StatusOK,
+			"",
+		},
+		{
+			"other method",
+			"https://storage.googleapis.com/storage/v1/b/some-bucket/o",
+			http.StatusOK,
+			"",
+		},
+		{
+			"custom status",
+			"https://storage.googleapis.com/storage/v1/b/some-bucket",
+			http.StatusTooManyRequests,
+			"rateLimitExceeded",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Get(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedReason == "" {
+				return
+			}
+			var body errorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Error.Errors) != 1 || body.Error.Errors[0].Reason != test.expectedReason {
+				t.Errorf("wrong error reason\nwant %q\ngot  %+v", test.expectedReason, body.Error.Errors)
+			}
+		})
+	}
+}
+
+func TestFaultErrorsPercentage(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		FaultRules: []FaultRule{{Type: FaultError, APIMethod: "storage.buckets.list", Percentage: 50}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	const requests = 200
+	var failures int
+	for i := 0; i < requests; i++ {
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/storage/v1/b?project=whatever")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			failures++
+		}
+	}
+	if failures < requests/5 || failures > requests*4/5 {
+		t.Errorf("%d out of %d requests failed with a 50%% fault rule", failures, requests)
+	}
+}
+
+func TestFaultUploadInterruption(t *testing.T) {
+	content := strings.Repeat("a", 2000)
+	tests := []struct {
+		name           string
+		status         int
+		expectedStatus int
+	}{
+		{"error status", http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"dropped connection", 0, 0},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{
+				NoListener: true,
+				FaultRules: []FaultRule{{Type: FaultUploadInterruption, ObjectName: "file.txt", Status: test.status, AfterBytes: 500}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+			client := server.HTTPClient()
+
+			resp, err := client.Post("https://storage.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=file.txt", "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			location := resp.Header.Get("Location")
+
+			sendChunk := func(contentRange, body string) (*http.Response, error) {
+				req, err := http.NewRequest(http.MethodPut, location, strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Content-Range", contentRange)
+				resp, err := client.Do(req)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return resp, err
+			}
+
+			resp, err = sendChunk("bytes 0-999/2000", content[:1000])
+			if test.expectedStatus == 0 {
+				if err == nil {
+					t.Fatalf("unexpected <nil> error with status %d sending the interrupted chunk", resp.StatusCode)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != test.expectedStatus {
+					t.Errorf("wrong status sending the interrupted chunk\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+				}
+			}
+
+			resp, err = sendChunk("bytes */2000", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusPermanentRedirect {
+				t.Errorf("wrong status querying the upload\nwant %d\ngot  %d", http.StatusPermanentRedirect, resp.StatusCode)
+			}
+			if got := resp.Header.Get("Range"); got != "bytes=0-499" {
+				t.Errorf("wrong range received before the interruption\nwant %q\ngot  %q", "bytes=0-499", got)
+			}
+
+			resp, err = sendChunk("bytes 500-1999/2000", content[500:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("wrong status resuming the upload\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+			}
+			obj, err := server.GetObject("some-bucket", "file.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(obj.Content) != content {
+				t.Errorf("wrong content uploaded, got %d bytes", len(obj.Content))
+			}
+		})
+	}
+}
+
+func TestFaultErrorsCount(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte("something")},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "other.txt"}, Content: []byte("something")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+	if err := server.AddFaultRule(FaultRule{Type: FaultError, Count: -1}); err == nil {
+		t.Error("unexpected <nil> error adding a rule with a negative count")
+	}
+	err = server.AddFaultRule(FaultRule{Type: FaultError, BucketName: "some-bucket", ObjectName: "file.txt", Method: http.MethodGet, Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post("https://storage.googleapis.com/_internal/faults", "application/json", strings.NewReader(`{"type":"error","bucket":"some-bucket","object":"other.txt","status":429,"count":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status adding a rule with a count\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	tests := []struct {
+		method         string
+		objectName     string
+		expectedStatus int
+		expectedRules  int
+	}{
+		{http.MethodGet, "file.txt", http.StatusServiceUnavailable, 2},
+		{http.MethodGet, "other.txt", http.StatusTooManyRequests, 1},
+		{http.MethodGet, "other.txt", http.StatusOK, 1},
+		{http.MethodDelete, "file.txt", http.StatusOK, 1},
+		{http.MethodGet, "file.txt", http.StatusServiceUnavailable, 0},
+		{http.MethodGet, "file.txt", http.StatusNotFound, 0},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, "https://storage.googleapis.com/storage/v1/b/some-bucket/o/"+test.objectName, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("%d: wrong status of the %s request\nwant %d\ngot  %d", i, test.method, test.expectedStatus, resp.StatusCode)
+		}
+		if rules := server.faults.list(); len(rules) != test.expectedRules {
+			t.Errorf("%d: wrong number of remaining rules\nwant %d\ngot  %d", i, test.expectedRules, len(rules))
+		}
+	}
+}
+
+func TestServerClientFaultUploadInterruption(t *testing.T) {
+	content := strings.Repeat("some nice content\n", 40000)
+	for _, status := range []int{http.StatusServiceUnavailable, 0} {
+		server, err := NewServerWithOptions(Options{
+			NoListener: true,
+			FaultRules: []FaultRule{{Type: FaultUploadInterruption, Status: status, AfterBytes: 300 * 1024}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+
+		w := server.Client().Bucket("some-bucket").Object("file.txt").NewWriter(context.Background())
+		w.ChunkSize = 256 * 1024
+		w.Write([]byte(content))
+		if err := w.Close(); err != nil {
+			t.Errorf("unexpected error resuming the upload interrupted with status %d: %v", status, err)
+		}
+		obj, err := server.GetObject("some-bucket", "file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != content {
+			t.Errorf("wrong content uploaded after an interruption with status %d, got %d bytes", status, len(obj.Content))
+		}
+		server.Stop()
+	}
+}
+
+func TestCorruptedChecksums(t *testing.T) {
+	content := []byte("some content")
+	crc32c, md5Hash := corruptedChecksums(content)
+	if crc32c == checksum.EncodedCrc32cChecksum(content) {
+		t.Errorf("corrupted crc32c matches the content: %s", crc32c)
+	}
+	if md5Hash == checksum.EncodedMd5Hash(content) {
+		t.Errorf("corrupted md5 matches the content: %s", md5Hash)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var errInvalidFieldSelection = errors.New("invalid field selection")
+
+// fieldMask is a parsed value of the fields parameter, which selects the
+// parts of a JSON response returned to the client. A nil sub-mask selects the
+// whole value of the field.
+type fieldMask map[string]fieldMask
+
+// parseFieldMask parses the fields parameter using the syntax of partial
+// responses in Google APIs: a comma-separated list of fields, where "a/b"
+// selects the field b of a, "a(b,c)" selects the fields b and c of a, and
+// "*" selects all fields. Selections in arrays apply to each element.
+func parseFieldMask(fields string) (fieldMask, error) {
+	mask, rest, err := parseFieldList(fields)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errInvalidFieldSelection
+	}
+	return mask, nil
+}
+
+func parseFieldList(fields string) (fieldMask, string, error) {
+	mask := fieldMask{}
+	for {
+		end := strings.IndexAny(fields, ",()")
+		if end < 0 {
+			end = len(fields)
+		}
+		path := strings.TrimSpace(fields[:end])
+		if path == "" {
+			return nil, "", errInvalidFieldSelection
+		}
+		fields = fields[end:]
+		var sub fieldMask
+		if strings.HasPrefix(fields, "(") {
+			var err error
+			sub, fields, err = parseFieldList(fields[1:])
+			if err != nil {
+				return nil, "", err
+			}
+			if !strings.HasPrefix(fields, ")") {
+				return nil, "", errInvalidFieldSelection
+			}
+			fields = fields[1:]
+		}
+		if err := mask.add(strings.Split(path, "/"), sub); err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(fields, ",") {
+			return mask, fields, nil
+		}
+		fields = fields[1:]
+	}
+}
+
+// add selects the field at the given path, restricted to sub.
+func (m fieldMask) add(path []string, sub fieldMask) error {
+	name := strings.TrimSpace(path[0])
+	if name == "" {
+		return errInvalidFieldSelection
+	}
+	if len(path) > 1 {
+		nested := fieldMask{}
+		if err := nested.add(path[1:], sub); err != nil {
+			return err
+		}
+		sub = nested
+	}
+	current, selected := m[name]
+	switch {
+	case !selected:
+		m[name] = sub
+	case current == nil || sub == nil:
+		m[name] = nil
+	default:
+		for field, fieldSub := range sub {
+			if err := current.add([]string{field}, fieldSub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// apply returns the parts of the JSON value selected by the mask.
+func (m fieldMask) apply(value interface{}) interface{} {
+	if m == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if sub, ok := m["*"]; ok {
+			result := make(map[string]interface{}, len(v))
+			for field, fieldValue := range v {
+				result[field] = sub.apply(fieldValue)
+			}
+			return result
+		}
+		result := make(map[string]interface{}, len(m))
+		for field, sub := range m {
+			if fieldValue, ok := v[field]; ok {
+				result[field] = sub.apply(fieldValue)
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = m.apply(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// selectFields returns the parts of data selected by the fields parameter.
+func selectFields(data interface{}, fields string) (interface{}, error) {
+	mask, err := parseFieldMask(fields)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	// numbers are decoded as json.Number to preserve int64 values.
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return mask.apply(value), nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+func TestSelectFields(t *testing.T) {
+	data := map[string]interface{}{
+		"kind":          "storage#objects",
+		"nextPageToken": "token",
+		"items": []interface{}{
+			map[string]interface{}{"name": "a.txt", "size": "1", "owner": map[string]interface{}{"entity": "user-a", "entityId": "a"}},
+			map[string]interface{}{"name": "b.txt", "size": "2", "owner": map[string]interface{}{"entity": "user-b", "entityId": "b"}},
+		},
+	}
+	tests := []struct {
+		fields   string
+		expected string
+	}{
+		{"kind", `{"kind":"storage#objects"}`},
+		{"nextPageToken,items(name)", `{"items":[{"name":"a.txt"},{"name":"b.txt"}],"nextPageToken":"token"}`},
+		{"items/name", `{"items":[{"name":"a.txt"},{"name":"b.txt"}]}`},
+		{"items/owner/entity", `{"items":[{"owner":{"entity":"user-a"}},{"owner":{"entity":"user-b"}}]}`},
+		{"items(name,owner(entityId))", `{"items":[{"name":"a.txt","owner":{"entityId":"a"}},{"name":"b.txt","owner":{"entityId":"b"}}]}`},
+		{"items/name,items", `{"items":[{"name":"a.txt","owner":{"entity":"user-a","entityId":"a"},"size":"1"},{"name":"b.txt","owner":{"entity":"user-b","entityId":"b"},"size":"2"}]}`},
+		{"items(*)", `{"items":[{"name":"a.txt","owner":{"entity":"user-a","entityId":"a"},"size":"1"},{"name":"b.txt","owner":{"entity":"user-b","entityId":"b"},"size":"2"}]}`},
+		{"missing", `{}`},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.fields, func(t *testing.T) {
+			selected, err := selectFields(data, test.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := json.Marshal(selected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(encoded) != test.expected {
+				t.Errorf("wrong selection\nwant %s\ngot  %s", test.expected, encoded)
+			}
+		})
+	}
+}
+
+func TestSelectFieldsInvalid(t *testing.T) {
+	for _, fields := range []string{",", "items(name", "items)", "items(name))", "a//b", "items()"} {
+		if _, err := selectFields(map[string]interface{}{}, fields); err == nil {
+			t.Errorf("unexpected <nil> error selecting %q", fields)
+		}
+	}
+}
+
+func TestServerPartialResponse(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt", Generation: 1648223681606667}, Content: []byte("something")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	get := func(path string) (int, map[string]interface{}) {
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/storage/v1/b/some-bucket" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var data map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, data
+	}
+
+	status, data := get("/o/file.txt?fields=name,generation")
+	if status != http.StatusOK {
+		t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	expected := map[string]interface{}{"name": "file.txt", "generation": "1648223681606667"}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("wrong partial object\nwant %v\ngot  %v", expected, data)
+	}
+
+	status, data = get("?fields=name")
+	if status != http.StatusOK || !reflect.DeepEqual(data, map[string]interface{}{"name": "some-bucket"}) {
+		t.Errorf("wrong partial bucket: %d %v", status, data)
+	}
+
+	status, _ = get("/o?fields=items(name")
+	if status != http.StatusBadRequest {
+		t.Errorf("wrong status with an invalid selection\nwant %d\ngot  %d", http.StatusBadRequest, status)
+	}
+
+	// errors aren't affected by the selection.
+	status, data = get("/o/missing.txt?fields=name")
+	if status != http.StatusNotFound || data["error"] == nil {
+		t.Errorf("wrong error response with a selection: %d %v", status, data)
+	}
+}
+
+func TestServerClientListObjectsPartialResponse(t *testing.T) {
+	const bucketName = "some-bucket"
+	objs := []Object{
+		{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "a.txt", ContentType: "text/plain"}},
+		{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "b.txt", ContentType: "text/plain"}},
+	}
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		// the go client selects the fields of the objects with the fields
+		// parameter.
+		query := &storage.Query{}
+		if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+			t.Fatal(err)
+		}
+		it := server.Client().Bucket(bucketName).Objects(context.Background(), query)
+		var names []string
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attrs.ContentType != "" {
+				t.Errorf("unexpected content type of %s in the partial response: %q", attrs.Name, attrs.ContentType)
+			}
+			names = append(names, attrs.Name)
+		}
+		if expected := []string{"a.txt", "b.txt"}; !reflect.DeepEqual(names, expected) {
+			t.Errorf("wrong names\nwant %v\ngot  %v", expected, names)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var errInvalidGlob = errors.New("invalid matchGlob pattern")
+
+// compileGlob converts the glob pattern of the matchGlob parameter of object
+// listings into a regular expression. As in Cloud Storage:
+//
+//   - "*" matches any sequence of characters other than "/"
+//   - "**" matches any sequence of characters, including "/", and "**/"
+//     matches zero or more directories
+//   - "?" matches a single character other than "/"
+//   - "[abc]" and "[a-z]" match a single character in the set or range, and
+//     "[!abc]" a single character outside of it
+//   - "{a,b}" matches any of the comma-separated alternatives
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	inAlternatives := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				expr.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, errInvalidGlob
+			}
+			set := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(set, "!") {
+				set = "^" + set[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(set, `\`, `\\`) + "]")
+			i += end + 1
+		case '{':
+			if inAlternatives {
+				return nil, errInvalidGlob
+			}
+			inAlternatives = true
+			expr.WriteString("(?:")
+		case '}':
+			if !inAlternatives {
+				return nil, errInvalidGlob
+			}
+			inAlternatives = false
+			expr.WriteString(")")
+		case ',':
+			if inAlternatives {
+				expr.WriteString("|")
+			} else {
+				expr.WriteString(",")
+			}
+		default:
+			r, size := utf8.DecodeRuneInString(pattern[i:])
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			i += size - 1
+		}
+	}
+	if inAlternatives {
+		return nil, errInvalidGlob
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, errInvalidGlob
+	}
+	return re, nil
+}
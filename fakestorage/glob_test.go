@@ -0,0 +1,53 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.txt", "file.txt", true},
+		{"*.txt", "dir/file.txt", false},
+		{"**/*.parquet", "data/2022/part-0.parquet", true},
+		{"**/*.parquet", "part-0.parquet", true},
+		{"**/*.parquet", "data/part-0.csv", false},
+		{"data/**", "data/a/b/c.txt", true},
+		{"data/**", "other/a.txt", false},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file10.txt", false},
+		{"file?.txt", "file/.txt", false},
+		{"file[0-9].txt", "file5.txt", true},
+		{"file[!0-9].txt", "file5.txt", false},
+		{"file[!0-9].txt", "filea.txt", true},
+		{"*.{jpg,png}", "image.png", true},
+		{"*.{jpg,png}", "image.gif", false},
+		{"a+b(c).txt", "a+b(c).txt", true},
+		{"café/*.txt", "café/menu.txt", true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.pattern+" "+test.name, func(t *testing.T) {
+			re, err := compileGlob(test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match := re.MatchString(test.name); match != test.match {
+				t.Errorf("wrong match for %q\nwant %t\ngot  %t", test.name, test.match, match)
+			}
+		})
+	}
+}
+
+func TestCompileGlobInvalid(t *testing.T) {
+	for _, pattern := range []string{"file[0-9.txt", "*.{jpg,png", "*.jpg}", "{a,{b,c}}"} {
+		if _, err := compileGlob(pattern); err == nil {
+			t.Errorf("unexpected <nil> error compiling %q", pattern)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	hmacKeyActive   = "ACTIVE"
+	hmacKeyInactive = "INACTIVE"
+	hmacKeyDeleted  = "DELETED"
+)
+
+// accessIDAlphabet is the set of characters of the generated access IDs,
+// which follow the format of the access IDs of service account keys in
+// Cloud Storage: GOOG1E followed by 55 uppercase alphanumeric characters.
+const accessIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+type hmacKeyMetadata struct {
+	Kind                string `json:"kind"`
+	ID                  string `json:"id"`
+	AccessID            string `json:"accessId"`
+	ProjectID           string `json:"projectId"`
+	ServiceAccountEmail string `json:"serviceAccountEmail"`
+	State               string `json:"state"`
+	TimeCreated         string `json:"timeCreated"`
+	Updated             string `json:"updated"`
+	Etag                string `json:"etag"`
+}
+
+type hmacKeyResponse struct {
+	Kind     string          `json:"kind"`
+	Secret   string          `json:"secret"`
+	Metadata hmacKeyMetadata `json:"metadata"`
+}
+
+type listHMACKeysResponse struct {
+	Kind          string            `json:"kind"`
+	Items         []hmacKeyMetadata `json:"items"`
+	NextPageToken string            `json:"nextPageToken,omitempty"`
+}
+
+type hmacKey struct {
+	accessID            string
+	secret              string
+	projectID           string
+	serviceAccountEmail string
+	state               string
+	created             time.Time
+	updated             time.Time
+	etag                string
+}
+
+func (k hmacKey) metadata() hmacKeyMetadata {
+	return hmacKeyMetadata{
+		Kind:                "storage#hmacKeyMetadata",
+		ID:                  k.projectID + "/" + k.accessID,
+		AccessID:            k.accessID,
+		ProjectID:           k.projectID,
+		ServiceAccountEmail: k.serviceAccountEmail,
+		State:               k.state,
+		TimeCreated:         k.created.Format(time.RFC3339),
+		Updated:             k.updated.Format(time.RFC3339),
+		Etag:                k.etag,
+	}
+}
+
+// projectHMACKeys stores the HMAC keys of all projects, in the order they
+// were created.
+type projectHMACKeys struct {
+	mtx  sync.Mutex
+	keys []*hmacKey
+}
+
+func (h *projectHMACKeys) add(key hmacKey) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.keys = append(h.keys, &key)
+}
+
+func (h *projectHMACKeys) get(projectID, accessID string) (hmacKey, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if key := h.find(projectID, accessID); key != nil {
+		return *key, true
+	}
+	return hmacKey{}, false
+}
+
+// update applies fn to the key, under the lock, and returns the updated key.
+func (h *projectHMACKeys) update(projectID, accessID string, fn func(*hmacKey) *jsonResponse) (hmacKey, *jsonResponse) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	key := h.find(projectID, accessID)
+	if key == nil {
+		return hmacKey{}, &jsonResponse{status: http.StatusNotFound}
+	}
+	updated := *key
+	if errResp := fn(&updated); errResp != nil {
+		return hmacKey{}, errResp
+	}
+	*key = updated
+	return updated, nil
+}
+
+func (h *projectHMACKeys) list(projectID, serviceAccountEmail string, showDeleted bool) []hmacKey {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var keys []hmacKey
+	for _, key := range h.keys {
+		if key.projectID != projectID {
+			continue
+		}
+		if serviceAccountEmail != "" && key.serviceAccountEmail != serviceAccountEmail {
+			continue
+		}
+		if key.state == hmacKeyDeleted && !showDeleted {
+			continue
+		}
+		keys = append(keys, *key)
+	}
+	return keys
+}
+
+func (h *projectHMACKeys) find(projectID, accessID string) *hmacKey {
+	for _, key := range h.keys {
+		if key.projectID == projectID && key.accessID == accessID {
+			return key
+		}
+	}
+	return nil
+}
+
+func randomString(alphabet string, length int) (string, error) {
+	raw := make([]byte, length)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	for i, b := range raw {
+		raw[i] = alphabet[int(b)%len(alphabet)]
+	}
+	return string(raw), nil
+}
+
+func randomBase64(length int) (string, error) {
+	raw := make([]byte, length)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func (s *Server) createHMACKey(r *http.Request) jsonResponse {
+	projectID := mux.Vars(r)["projectId"]
+	serviceAccountEmail := r.URL.Query().Get("serviceAccountEmail")
+	if serviceAccountEmail == "" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Required parameter: serviceAccountEmail"}
+	}
+	suffix, err := randomString(accessIDAlphabet, 55)
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	secret, err := randomBase64(30)
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	etag, err := randomBase64(9)
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	now := time.Now().UTC()
+	key := hmacKey{
+		accessID:            "GOOG1E" + suffix,
+		secret:              secret,
+		projectID:           projectID,
+		serviceAccountEmail: serviceAccountEmail,
+		state:               hmacKeyActive,
+		created:             now,
+		updated:             now,
+		etag:                etag,
+	}
+	s.hmacKeys.add(key)
+	// the secret is only ever returned in the response to the creation of
+	// the key.
+	return jsonResponse{data: hmacKeyResponse{
+		Kind:     "storage#hmacKey",
+		Secret:   key.secret,
+		Metadata: key.metadata(),
+	}}
+}
+
+func (s *Server) listHMACKeys(r *http.Request) jsonResponse {
+	query := r.URL.Query()
+	showDeleted := query.Get("showDeletedKeys") == "true"
+	keys := s.hmacKeys.list(mux.Vars(r)["projectId"], query.Get("serviceAccountEmail"), showDeleted)
+
+	start := 0
+	if token := query.Get("pageToken"); token != "" {
+		start = len(keys)
+		for i, key := range keys {
+			if key.accessID == token {
+				start = i
+				break
+			}
+		}
+	}
+	keys = keys[start:]
+	var nextPageToken string
+	if maxResults, err := strconv.Atoi(query.Get("maxResults")); err == nil && maxResults > 0 && maxResults < len(keys) {
+		nextPageToken = keys[maxResults].accessID
+		keys = keys[:maxResults]
+	}
+
+	resp := listHMACKeysResponse{
+		Kind:          "storage#hmacKeysMetadata",
+		Items:         make([]hmacKeyMetadata, len(keys)),
+		NextPageToken: nextPageToken,
+	}
+	for i, key := range keys {
+		resp.Items[i] = key.metadata()
+	}
+	return jsonResponse{data: resp}
+}
+
+func (s *Server) getHMACKey(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	key, ok := s.hmacKeys.get(vars["projectId"], vars["accessId"])
+	if !ok {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	return jsonResponse{data: key.metadata()}
+}
+
+// updateHMACKey changes the state of a key between ACTIVE and INACTIVE.
+// Deleted keys can't be updated.
+func (s *Server) updateHMACKey(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	var data struct {
+		State string `json:"state"`
+		Etag  string `json:"etag"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	if data.State != hmacKeyActive && data.State != hmacKeyInactive {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "The state must be either ACTIVE or INACTIVE."}
+	}
+	etag, err := randomBase64(9)
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	key, errResp := s.hmacKeys.update(vars["projectId"], vars["accessId"], func(key *hmacKey) *jsonResponse {
+		if data.Etag != "" && data.Etag != key.etag {
+			return &jsonResponse{status: http.StatusPreconditionFailed, errorMessage: "The etag doesn't match the etag of the key."}
+		}
+		if key.state == hmacKeyDeleted {
+			return &jsonResponse{status: http.StatusBadRequest, errorMessage: "Cannot update keys in DELETED state."}
+		}
+		if key.state != data.State {
+			key.state = data.State
+			key.updated = time.Now().UTC()
+			key.etag = etag
+		}
+		return nil
+	})
+	if errResp != nil {
+		return *errResp
+	}
+	return jsonResponse{data: key.metadata()}
+}
+
+// deleteHMACKey moves an inactive key to the DELETED state: active keys must
+// be deactivated before they're deleted.
+func (s *Server) deleteHMACKey(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	etag, err := randomBase64(9)
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	_, errResp := s.hmacKeys.update(vars["projectId"], vars["accessId"], func(key *hmacKey) *jsonResponse {
+		if key.state != hmacKeyInactive {
+			return &jsonResponse{status: http.StatusBadRequest, errorMessage: "Cannot delete keys in '" + key.state + "' state."}
+		}
+		key.state = hmacKeyDeleted
+		key.updated = time.Now().UTC()
+		key.etag = etag
+		return nil
+	})
+	if errResp != nil {
+		return *errResp
+	}
+	return jsonResponse{}
+}
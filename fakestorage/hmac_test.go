@@ -0,0 +1,106 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+func TestHMACKeys(t *testing.T) {
+	const (
+		projectID      = "my-project"
+		serviceAccount = "ci@my-project.iam.gserviceaccount.com"
+	)
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		client := server.Client()
+
+		key, err := client.CreateHMACKey(ctx, projectID, serviceAccount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Secret == "" || !strings.HasPrefix(key.AccessID, "GOOG1E") || key.State != storage.Active {
+			t.Errorf("wrong created key: %+v", key)
+		}
+		if _, err := client.CreateHMACKey(ctx, projectID, "other@my-project.iam.gserviceaccount.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		handle := client.HMACKeyHandle(projectID, key.AccessID)
+		got, err := handle.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Secret != "" {
+			t.Error("secret returned after the creation of the key")
+		}
+		if got.ServiceAccountEmail != serviceAccount || got.Etag != key.Etag {
+			t.Errorf("wrong key\nwant %+v\ngot  %+v", key, got)
+		}
+
+		if err := handle.Delete(ctx); err == nil {
+			t.Error("unexpected <nil> error deleting an active key")
+		}
+		if _, err := handle.Update(ctx, storage.HMACKeyAttrsToUpdate{State: storage.Inactive, Etag: "stale"}); err == nil {
+			t.Error("unexpected <nil> error updating a key with a stale etag")
+		}
+		updated, err := handle.Update(ctx, storage.HMACKeyAttrsToUpdate{State: storage.Inactive, Etag: got.Etag})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.State != storage.Inactive || updated.Etag == got.Etag {
+			t.Errorf("wrong updated key: %+v", updated)
+		}
+		if err := handle.Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		got, err = handle.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.State != storage.Deleted {
+			t.Errorf("wrong state after deleting the key\nwant %s\ngot  %s", storage.Deleted, got.State)
+		}
+		if _, err := handle.Update(ctx, storage.HMACKeyAttrsToUpdate{State: storage.Active}); err == nil {
+			t.Error("unexpected <nil> error updating a deleted key")
+		}
+
+		listKeys := func(opts ...storage.HMACKeyOption) []*storage.HMACKey {
+			t.Helper()
+			var keys []*storage.HMACKey
+			it := client.ListHMACKeys(ctx, projectID, opts...)
+			for {
+				key, err := it.Next()
+				if err == iterator.Done {
+					return keys
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+			}
+		}
+		if keys := listKeys(); len(keys) != 1 {
+			t.Errorf("wrong number of keys\nwant 1\ngot  %d", len(keys))
+		}
+		if keys := listKeys(storage.ShowDeletedHMACKeys()); len(keys) != 2 {
+			t.Errorf("wrong number of keys, including deleted keys\nwant 2\ngot  %d", len(keys))
+		}
+		if keys := listKeys(storage.ShowDeletedHMACKeys(), storage.ForHMACKeyServiceAccountEmail(serviceAccount)); len(keys) != 1 || keys[0].AccessID != key.AccessID {
+			t.Errorf("wrong keys of the service account: %+v", keys)
+		}
+		if _, err := client.ListHMACKeys(ctx, "other-project").Next(); err != iterator.Done {
+			t.Errorf("unexpected keys in another project: %v", err)
+		}
+		if _, err := client.HMACKeyHandle(projectID, "GOOG1EMISSING").Get(ctx); err == nil {
+			t.Error("unexpected <nil> error getting a key that doesn't exist")
+		}
+	})
+}
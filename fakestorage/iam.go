@@ -0,0 +1,300 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// IAMPolicy is the IAM policy of a bucket, in the format used by the JSON
+// API.
+type IAMPolicy struct {
+	Version  int          `json:"version,omitempty"`
+	Etag     string       `json:"etag,omitempty"`
+	Bindings []IAMBinding `json:"bindings"`
+}
+
+// IAMBinding grants a role to a list of members, optionally only when the
+// condition is met.
+type IAMBinding struct {
+	Role      string        `json:"role"`
+	Members   []string      `json:"members"`
+	Condition *IAMCondition `json:"condition,omitempty"`
+}
+
+// IAMCondition is a Common Expression Language expression restricting a
+// binding. The fake server stores conditions, but doesn't evaluate them.
+type IAMCondition struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Expression  string `json:"expression"`
+}
+
+type iamPolicyResponse struct {
+	Kind       string `json:"kind"`
+	ResourceID string `json:"resourceId"`
+	IAMPolicy
+}
+
+type testIAMPermissionsResponse struct {
+	Kind        string   `json:"kind"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+var iamMemberPrefixes = []string{
+	"user:",
+	"serviceAccount:",
+	"group:",
+	"domain:",
+	"projectOwner:",
+	"projectEditor:",
+	"projectViewer:",
+}
+
+// bucketIAMPolicies stores the IAM policies of the buckets, along with the
+// number of times each one changed, which is encoded in the etag.
+type bucketIAMPolicies struct {
+	mtx      sync.Mutex
+	policies map[string]IAMPolicy
+	versions map[string]uint64
+}
+
+func (p *bucketIAMPolicies) get(bucketName string) IAMPolicy {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	policy, ok := p.policies[bucketName]
+	if !ok {
+		policy = IAMPolicy{Version: 1, Bindings: []IAMBinding{}}
+	}
+	policy.Etag = iamPolicyEtag(p.versions[bucketName])
+	return policy
+}
+
+// set replaces the policy of the bucket, unless etag is set and doesn't
+// match the etag of the current policy.
+func (p *bucketIAMPolicies) set(bucketName string, policy IAMPolicy, etag string) (IAMPolicy, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if etag != "" && etag != iamPolicyEtag(p.versions[bucketName]) {
+		return IAMPolicy{}, false
+	}
+	if p.policies == nil {
+		p.policies = make(map[string]IAMPolicy)
+		p.versions = make(map[string]uint64)
+	}
+	p.policies[bucketName] = policy
+	p.versions[bucketName]++
+	policy.Etag = iamPolicyEtag(p.versions[bucketName])
+	return policy, true
+}
+
+func (p *bucketIAMPolicies) remove(bucketName string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.policies, bucketName)
+	delete(p.versions, bucketName)
+}
+
+// iamPolicyEtag encodes the version of the policy in the same format used by
+// Cloud Storage, so the etag of the initial policy is "CAA=".
+func iamPolicyEtag(version uint64) string {
+	buf := make([]byte, 1+binary.MaxVarintLen64)
+	buf[0] = 0x08
+	n := binary.PutUvarint(buf[1:], version)
+	return base64.StdEncoding.EncodeToString(buf[:n+1])
+}
+
+func validateIAMPolicy(policy IAMPolicy) error {
+	if policy.Version != 0 && policy.Version != 1 && policy.Version != 3 {
+		return fmt.Errorf("invalid policy version: %d", policy.Version)
+	}
+	for _, binding := range policy.Bindings {
+		if binding.Role == "" {
+			return errors.New("bindings require a role")
+		}
+		if len(binding.Members) == 0 {
+			return fmt.Errorf("the binding for role %s has no members", binding.Role)
+		}
+		for _, member := range binding.Members {
+			if !validIAMMember(member) {
+				return fmt.Errorf("invalid member: %s", member)
+			}
+		}
+		if binding.Condition != nil && policy.Version < 3 {
+			return errors.New("conditional bindings require policy version 3")
+		}
+	}
+	return nil
+}
+
+// normalizeIAMPolicy fills the defaults of a policy that is about to be
+// stored.
+func normalizeIAMPolicy(policy IAMPolicy) IAMPolicy {
+	if policy.Version == 0 {
+		policy.Version = 1
+	}
+	if policy.Bindings == nil {
+		policy.Bindings = []IAMBinding{}
+	}
+	return policy
+}
+
+func validIAMMember(member string) bool {
+	if member == "allUsers" || member == "allAuthenticatedUsers" {
+		return true
+	}
+	for _, prefix := range iamMemberPrefixes {
+		if strings.HasPrefix(member, prefix) && len(member) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasIAMConditions(policy IAMPolicy) bool {
+	for _, binding := range policy.Bindings {
+		if binding.Condition != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// SetBucketIAMPolicy replaces the IAM policy of the bucket. The policy is only
+// stored and returned by the IAM endpoints: the fake server doesn't enforce
+// it.
+func (s *Server) SetBucketIAMPolicy(bucketName string, policy IAMPolicy) error {
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return err
+	}
+	if err := validateIAMPolicy(policy); err != nil {
+		return err
+	}
+	if err := s.checkPublicIAMPolicy(bucketName, policy); err != nil {
+		return err
+	}
+	s.iamPolicies.set(bucketName, normalizeIAMPolicy(policy), "")
+	return nil
+}
+
+// checkPublicIAMPolicy returns an error if the policy grants access to the
+// public on a bucket that enforces public access prevention.
+func (s *Server) checkPublicIAMPolicy(bucketName string, policy IAMPolicy) error {
+	for _, binding := range policy.Bindings {
+		for _, member := range binding.Members {
+			if isPublicEntity(member) && s.publicAccessPrevented(bucketName) {
+				return &publicAccessPreventionError{bucketName}
+			}
+		}
+	}
+	return nil
+}
+
+// isPubliclyReadable reports whether anyone can read the object: through
+// its ACL or, on buckets with uniform bucket-level access, through the IAM
+// policy of the bucket. Objects in buckets that enforce public access
+// prevention are never public.
+func (s *Server) isPubliclyReadable(obj ObjectAttrs) bool {
+	bucket, err := s.backend.GetBucket(obj.BucketName)
+	if err != nil || bucket.PublicAccessPrevention == publicAccessPreventionEnforced {
+		return false
+	}
+	if bucket.UniformBucketLevelAccess == nil {
+		return isACLPublicRead(obj.ACL)
+	}
+	for _, binding := range s.iamPolicies.get(obj.BucketName).Bindings {
+		if binding.Role != "roles/storage.objectViewer" && binding.Role != "roles/storage.legacyObjectReader" {
+			continue
+		}
+		for _, member := range binding.Members {
+			if member == string(storage.AllUsers) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newIAMPolicyResponse(bucketName string, policy IAMPolicy) iamPolicyResponse {
+	return iamPolicyResponse{
+		Kind:       "storage#policy",
+		ResourceID: "projects/_/buckets/" + bucketName,
+		IAMPolicy:  policy,
+	}
+}
+
+func (s *Server) getBucketIAMPolicy(r *http.Request) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	policy := s.iamPolicies.get(bucketName)
+	requestedVersion := 1
+	if v := r.URL.Query().Get("optionsRequestedPolicyVersion"); v != "" {
+		var err error
+		if requestedVersion, err = strconv.Atoi(v); err != nil {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid optionsRequestedPolicyVersion."}
+		}
+	}
+	if requestedVersion < 3 && hasIAMConditions(policy) {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "The policy has conditional bindings, which require requesting policy version 3."}
+	}
+	return jsonResponse{data: newIAMPolicyResponse(bucketName, policy)}
+}
+
+func (s *Server) setBucketIAMPolicy(r *http.Request) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	var policy IAMPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	if err := validateIAMPolicy(policy); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	if err := s.checkPublicIAMPolicy(bucketName, policy); err != nil {
+		return errToJsonResponse(err)
+	}
+	policy, ok := s.iamPolicies.set(bucketName, normalizeIAMPolicy(policy), policy.Etag)
+	if !ok {
+		return jsonResponse{status: http.StatusPreconditionFailed, errorMessage: "The etag of the policy doesn't match the current policy."}
+	}
+	return jsonResponse{data: newIAMPolicyResponse(bucketName, policy)}
+}
+
+// testBucketIAMPermissions reports all of the requested permissions as
+// granted, since the fake server doesn't authenticate requests.
+func (s *Server) testBucketIAMPermissions(r *http.Request) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	permissions := r.URL.Query()["permissions"]
+	if len(permissions) == 0 {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Required parameter: permissions"}
+	}
+	for _, permission := range permissions {
+		if !strings.HasPrefix(permission, "storage.") {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: "Permission '" + permission + "' is not valid for the resource."}
+		}
+	}
+	return jsonResponse{data: testIAMPermissionsResponse{
+		Kind:        "storage#testIamPermissionsResponse",
+		Permissions: permissions,
+	}}
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBucketIAMPolicyClient(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		const bucketName = "iam-bucket"
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName})
+		handle := server.Client().Bucket(bucketName).IAM()
+
+		policy, err := handle.Policy(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roles := policy.Roles(); len(roles) != 0 {
+			t.Errorf("unexpected roles in the initial policy: %v", roles)
+		}
+		policy.Add("user:alice@example.com", "roles/storage.objectViewer")
+		policy.Add("serviceAccount:ci@project.iam.gserviceaccount.com", "roles/storage.objectAdmin")
+		if err := handle.SetPolicy(context.TODO(), policy); err != nil {
+			t.Fatal(err)
+		}
+
+		policy, err = handle.Policy(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !policy.HasRole("user:alice@example.com", "roles/storage.objectViewer") {
+			t.Errorf("missing binding for alice: %v", policy.Members("roles/storage.objectViewer"))
+		}
+		if !policy.HasRole("serviceAccount:ci@project.iam.gserviceaccount.com", "roles/storage.objectAdmin") {
+			t.Errorf("missing binding for the service account: %v", policy.Members("roles/storage.objectAdmin"))
+		}
+
+		permissions := []string{"storage.objects.get", "storage.buckets.delete"}
+		granted, err := handle.TestPermissions(context.TODO(), permissions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(granted, permissions) {
+			t.Errorf("wrong permissions\nwant %v\ngot  %v", permissions, granted)
+		}
+	})
+}
+
+func TestBucketIAMPolicyEndpoints(t *testing.T) {
+	const bucketURL = "https://storage.googleapis.com/storage/v1/b/iam-bucket"
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "iam-bucket"})
+	client := server.HTTPClient()
+
+	do := func(t *testing.T, method, url, body string) (int, iamPolicyResponse) {
+		t.Helper()
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var policy iamPolicyResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&policy); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, policy
+	}
+
+	status, initial := do(t, http.MethodGet, bucketURL+"/iam", "")
+	if status != http.StatusOK {
+		t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if initial.Kind != "storage#policy" || initial.ResourceID != "projects/_/buckets/iam-bucket" || initial.Etag != "CAA=" {
+		t.Errorf("wrong initial policy: %+v", initial)
+	}
+
+	conditional := `{"version":3,"etag":"CAA=","bindings":[{"role":"roles/storage.objectViewer","members":["allUsers"],"condition":{"title":"public","expression":"resource.name.startsWith(\"projects/_/buckets/iam-bucket/objects/public/\")"}}]}`
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "condition without version 3",
+			method:         http.MethodPut,
+			url:            bucketURL + "/iam",
+			body:           `{"bindings":[{"role":"roles/storage.objectViewer","members":["allUsers"],"condition":{"expression":"true"}}]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid member",
+			method:         http.MethodPut,
+			url:            bucketURL + "/iam",
+			body:           `{"bindings":[{"role":"roles/storage.objectViewer","members":["alice@example.com"]}]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "conditional policy",
+			method:         http.MethodPut,
+			url:            bucketURL + "/iam",
+			body:           conditional,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "stale etag",
+			method:         http.MethodPut,
+			url:            bucketURL + "/iam",
+			body:           conditional,
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "conditional policy requested with version 1",
+			method:         http.MethodGet,
+			url:            bucketURL + "/iam",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "conditional policy requested with version 3",
+			method:         http.MethodGet,
+			url:            bucketURL + "/iam?optionsRequestedPolicyVersion=3",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid permission",
+			method:         http.MethodGet,
+			url:            bucketURL + "/iam/testPermissions?permissions=compute.instances.list",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "bucket not found",
+			method:         http.MethodGet,
+			url:            "https://storage.googleapis.com/storage/v1/b/missing-bucket/iam",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			status, _ := do(t, test.method, test.url, test.body)
+			if status != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, status)
+			}
+		})
+	}
+
+	_, policy := do(t, http.MethodGet, bucketURL+"/iam?optionsRequestedPolicyVersion=3", "")
+	if policy.Version != 3 || policy.Etag != "CAE=" || len(policy.Bindings) != 1 {
+		t.Fatalf("wrong policy: %+v", policy)
+	}
+	if condition := policy.Bindings[0].Condition; condition == nil || condition.Title != "public" {
+		t.Errorf("wrong condition: %+v", condition)
+	}
+}
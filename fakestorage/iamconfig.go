@@ -0,0 +1,176 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/gorilla/mux"
+)
+
+const (
+	publicAccessPreventionInherited = "inherited"
+	publicAccessPreventionEnforced  = "enforced"
+)
+
+// uniformBucketLevelAccessLockPeriod is how long uniform bucket-level access
+// can be disabled after it's enabled on a bucket.
+const uniformBucketLevelAccessLockPeriod = 90 * 24 * time.Hour
+
+type bucketIAMConfiguration struct {
+	UniformBucketLevelAccess *uniformBucketLevelAccess `json:"uniformBucketLevelAccess,omitempty"`
+	// BucketPolicyOnly is the former name of uniform bucket-level access,
+	// still accepted and returned by Cloud Storage.
+	BucketPolicyOnly       *uniformBucketLevelAccess `json:"bucketPolicyOnly,omitempty"`
+	PublicAccessPrevention string                    `json:"publicAccessPrevention,omitempty"`
+}
+
+type uniformBucketLevelAccess struct {
+	Enabled    bool   `json:"enabled"`
+	LockedTime string `json:"lockedTime,omitempty"`
+}
+
+// publicAccessPreventionError is returned when an object would be made
+// public in a bucket that enforces public access prevention.
+type publicAccessPreventionError struct {
+	bucketName string
+}
+
+func (e *publicAccessPreventionError) Error() string {
+	return fmt.Sprintf("Request violates constraint 'constraints/storage.publicAccessPrevention': public access prevention is enforced on bucket %s", e.bucketName)
+}
+
+// SetBucketUniformBucketLevelAccess enables or disables uniform bucket-level
+// access on the bucket. Buckets with uniform bucket-level access reject
+// requests to the ACL endpoints. Unlike in the API, the access can be
+// disabled regardless of the locked time.
+func (s *Server) SetBucketUniformBucketLevelAccess(bucketName string, enabled bool) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	attrs.UniformBucketLevelAccess = nil
+	if enabled {
+		attrs.UniformBucketLevelAccess = newUniformBucketLevelAccess()
+	}
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// SetBucketPublicAccessPrevention enforces public access prevention on the
+// bucket, or makes it inherit the setting of its project, which the fake
+// server treats as not enforced. Buckets that enforce it reject ACLs and IAM
+// policies granting access to allUsers or allAuthenticatedUsers.
+func (s *Server) SetBucketPublicAccessPrevention(bucketName string, enforced bool) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	attrs.PublicAccessPrevention = ""
+	if enforced {
+		attrs.PublicAccessPrevention = publicAccessPreventionEnforced
+	}
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+func newUniformBucketLevelAccess() *backend.UniformBucketLevelAccess {
+	return &backend.UniformBucketLevelAccess{
+		LockedTime: time.Now().Add(uniformBucketLevelAccessLockPeriod).UTC(),
+	}
+}
+
+// applyIAMConfiguration updates the attributes of a bucket with the IAM
+// configuration sent in a request, returning an error message if the
+// configuration is invalid.
+func applyIAMConfiguration(attrs *backend.BucketAttrs, config *bucketIAMConfiguration) string {
+	if config == nil {
+		return ""
+	}
+	ubla := config.UniformBucketLevelAccess
+	if ubla == nil {
+		ubla = config.BucketPolicyOnly
+	}
+	if ubla != nil {
+		switch {
+		case ubla.Enabled && attrs.UniformBucketLevelAccess == nil:
+			attrs.UniformBucketLevelAccess = newUniformBucketLevelAccess()
+		case !ubla.Enabled && attrs.UniformBucketLevelAccess != nil:
+			if time.Now().After(attrs.UniformBucketLevelAccess.LockedTime) {
+				return "Uniform bucket-level access can't be disabled after its locked time."
+			}
+			attrs.UniformBucketLevelAccess = nil
+		}
+	}
+	switch config.PublicAccessPrevention {
+	case "":
+	case publicAccessPreventionInherited, "unspecified":
+		attrs.PublicAccessPrevention = ""
+	case publicAccessPreventionEnforced:
+		attrs.PublicAccessPrevention = publicAccessPreventionEnforced
+	default:
+		return "Invalid value for publicAccessPrevention: " + config.PublicAccessPrevention
+	}
+	return ""
+}
+
+func fromBackendIAMConfiguration(bucket backend.Bucket) *bucketIAMConfiguration {
+	ubla := &uniformBucketLevelAccess{}
+	if bucket.UniformBucketLevelAccess != nil {
+		ubla.Enabled = true
+		ubla.LockedTime = bucket.UniformBucketLevelAccess.LockedTime.Format(timestampFormat)
+	}
+	publicAccessPrevention := bucket.PublicAccessPrevention
+	if publicAccessPrevention == "" {
+		publicAccessPrevention = publicAccessPreventionInherited
+	}
+	return &bucketIAMConfiguration{
+		UniformBucketLevelAccess: ubla,
+		BucketPolicyOnly:         ubla,
+		PublicAccessPrevention:   publicAccessPrevention,
+	}
+}
+
+const legacyACLsDisabledMessage = "Cannot use legacy ACLs when uniform bucket-level access is enabled. Read more at https://cloud.google.com/storage/docs/uniform-bucket-level-access"
+
+// requireLegacyACLs wraps the handlers of the ACL endpoints, which are
+// rejected on buckets with uniform bucket-level access.
+func (s *Server) requireLegacyACLs(h jsonHandler) jsonHandler {
+	return func(r *http.Request) jsonResponse {
+		bucket, err := s.backend.GetBucket(mux.Vars(r)["bucketName"])
+		if err == nil && bucket.UniformBucketLevelAccess != nil {
+			return jsonResponse{
+				status:       http.StatusBadRequest,
+				errorReason:  "invalid",
+				errorMessage: legacyACLsDisabledMessage,
+			}
+		}
+		return h(r)
+	}
+}
+
+func (s *Server) publicAccessPrevented(bucketName string) bool {
+	bucket, err := s.backend.GetBucket(bucketName)
+	return err == nil && bucket.PublicAccessPrevention == publicAccessPreventionEnforced
+}
+
+// checkPublicAccessPrevention returns an error if the ACL grants access to
+// the public on a bucket that enforces public access prevention.
+func (s *Server) checkPublicAccessPrevention(bucketName string, acl []storage.ACLRule) error {
+	for _, rule := range acl {
+		if isPublicEntity(string(rule.Entity)) && s.publicAccessPrevented(bucketName) {
+			return &publicAccessPreventionError{bucketName}
+		}
+	}
+	return nil
+}
+
+func isPublicEntity(entity string) bool {
+	return entity == string(storage.AllUsers) || entity == string(storage.AllAuthenticatedUsers)
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerClientUniformBucketLevelAccess(t *testing.T) {
+	const bucketName = "some-bucket"
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		bucket := server.Client().Bucket(bucketName)
+		if err := bucket.Create(ctx, "my-project", &storage.BucketAttrs{
+			UniformBucketLevelAccess: storage.UniformBucketLevelAccess{Enabled: true},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := bucket.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.UniformBucketLevelAccess.Enabled || !attrs.BucketPolicyOnly.Enabled {
+			t.Errorf("uniform bucket-level access not enabled: %+v", attrs.UniformBucketLevelAccess)
+		}
+		if lockedTime := attrs.UniformBucketLevelAccess.LockedTime; lockedTime.Before(time.Now().Add(89 * 24 * time.Hour)) {
+			t.Errorf("wrong locked time: %s", lockedTime)
+		}
+
+		server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "file.txt"}})
+		var apiErr *googleapi.Error
+		if _, err := bucket.Object("file.txt").ACL().List(ctx); !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+			t.Errorf("wrong error listing the ACL of an object\nwant status %d\ngot  %v", http.StatusBadRequest, err)
+		}
+		if err := bucket.DefaultObjectACL().Set(ctx, storage.AllUsers, storage.RoleReader); !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+			t.Errorf("wrong error setting the default object ACL\nwant status %d\ngot  %v", http.StatusBadRequest, err)
+		}
+
+		attrs, err = bucket.Update(ctx, storage.BucketAttrsToUpdate{
+			UniformBucketLevelAccess: &storage.UniformBucketLevelAccess{Enabled: false},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.UniformBucketLevelAccess.Enabled {
+			t.Error("uniform bucket-level access still enabled after disabling it")
+		}
+		if _, err := bucket.Object("file.txt").ACL().List(ctx); err != nil {
+			t.Errorf("unexpected error listing the ACL after disabling uniform bucket-level access: %v", err)
+		}
+	})
+}
+
+func TestServerClientPublicAccessPrevention(t *testing.T) {
+	const bucketName = "some-bucket"
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		bucket := server.Client().Bucket(bucketName)
+		if err := bucket.Create(ctx, "my-project", &storage.BucketAttrs{
+			PublicAccessPrevention: storage.PublicAccessPreventionEnforced,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := bucket.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.PublicAccessPrevention != storage.PublicAccessPreventionEnforced {
+			t.Errorf("wrong public access prevention\nwant %s\ngot  %s", storage.PublicAccessPreventionEnforced, attrs.PublicAccessPrevention)
+		}
+
+		server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "file.txt"}})
+		var apiErr *googleapi.Error
+		if err := bucket.Object("file.txt").ACL().Set(ctx, storage.AllUsers, storage.RoleReader); !errors.As(err, &apiErr) || apiErr.Code != http.StatusPreconditionFailed {
+			t.Errorf("wrong error making the object public\nwant status %d\ngot  %v", http.StatusPreconditionFailed, err)
+		}
+		if err := bucket.Object("file.txt").ACL().Set(ctx, "user-someone@example.com", storage.RoleReader); err != nil {
+			t.Errorf("unexpected error granting access to a user: %v", err)
+		}
+		if err := bucket.DefaultObjectACL().Set(ctx, storage.AllAuthenticatedUsers, storage.RoleReader); !errors.As(err, &apiErr) || apiErr.Code != http.StatusPreconditionFailed {
+			t.Errorf("wrong error making the default object ACL public\nwant status %d\ngot  %v", http.StatusPreconditionFailed, err)
+		}
+		w := bucket.Object("public.txt").NewWriter(ctx)
+		w.PredefinedACL = "publicRead"
+		w.Write([]byte("something"))
+		if err := w.Close(); !errors.As(err, &apiErr) || apiErr.Code != http.StatusPreconditionFailed {
+			t.Errorf("wrong error uploading a public object\nwant status %d\ngot  %v", http.StatusPreconditionFailed, err)
+		}
+
+		handle := bucket.IAM()
+		policy, err := handle.Policy(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy.Add(iam.AllUsers, "roles/storage.objectViewer")
+		if err := handle.SetPolicy(ctx, policy); !errors.As(err, &apiErr) || apiErr.Code != http.StatusPreconditionFailed {
+			t.Errorf("wrong error making the bucket public\nwant status %d\ngot  %v", http.StatusPreconditionFailed, err)
+		}
+
+		if _, err := bucket.Update(ctx, storage.BucketAttrsToUpdate{
+			PublicAccessPrevention: storage.PublicAccessPreventionInherited,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := handle.SetPolicy(ctx, policy); err != nil {
+			t.Errorf("unexpected error making the bucket public after disabling public access prevention: %v", err)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instructionsHeader is the header with the failures that the server should
+// cause on a single request, as a comma separated list of instructions:
+//
+//	status=503     fail the request with the given status
+//	delay=2s       wait for the given duration before handling the request
+//	truncate=1024  break the connection after sending the given number of
+//	               bytes of the response body
+//
+// The delay applies before the other instructions, so "delay=1s,status=503"
+// fails the request after a second.
+const instructionsHeader = "X-Fake-Gcs-Instructions"
+
+type requestInstructions struct {
+	status   int
+	delay    time.Duration
+	truncate int
+}
+
+func parseRequestInstructions(value string) (requestInstructions, error) {
+	instructions := requestInstructions{truncate: -1}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return requestInstructions{}, fmt.Errorf("invalid instruction %q, must be in the format name=value", item)
+		}
+		var err error
+		switch parts[0] {
+		case "status":
+			instructions.status, err = strconv.Atoi(parts[1])
+			if err == nil && (instructions.status < 400 || instructions.status > 599) {
+				err = fmt.Errorf("the status must be 4xx or 5xx")
+			}
+		case "delay":
+			instructions.delay, err = time.ParseDuration(parts[1])
+			if err == nil && instructions.delay < 0 {
+				err = fmt.Errorf("the delay must not be negative")
+			}
+		case "truncate":
+			instructions.truncate, err = strconv.Atoi(parts[1])
+			if err == nil && instructions.truncate < 0 {
+				err = fmt.Errorf("the number of bytes must not be negative")
+			}
+		default:
+			return requestInstructions{}, fmt.Errorf("unknown instruction %q", parts[0])
+		}
+		if err != nil {
+			return requestInstructions{}, fmt.Errorf("invalid instruction %q: %w", item, err)
+		}
+	}
+	return instructions, nil
+}
+
+// applyRequestInstructions is the middleware that causes the failures set in
+// the x-fake-gcs-instructions header of the requests.
+func (s *Server) applyRequestInstructions(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(instructionsHeader)
+		if value == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		instructions, err := parseRequestInstructions(value)
+		if err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !wait(r, instructions.delay) {
+			return
+		}
+		if instructions.status != 0 {
+			writeAPIError(w, r, instructions.status, fmt.Sprintf("Caused a %d by the %s header", instructions.status, instructionsHeader))
+			return
+		}
+		if instructions.truncate >= 0 {
+			w = &brokenStreamWriter{ResponseWriter: w, remaining: instructions.truncate}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestInstructions(t *testing.T) {
+	content := strings.Repeat("a", 4096)
+	server, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		InitialObjects: []Object{{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte(content)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name           string
+		url            string
+		instructions   string
+		expectedStatus int
+		expectedBytes  int
+		expectedErr    error
+		minDuration    time.Duration
+	}{
+		{
+			name:           "no instructions",
+			url:            "https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/file.txt?alt=media",
+			expectedStatus: http.StatusOK,
+			expectedBytes:  len(content),
+		},
+		{
+			name:           "JSON API status",
+			url:            "https://storage.googleapis.com/storage/v1/b/some-bucket/o/file.txt",
+			instructions:   "status=503",
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:           "XML API status",
+			url:            "https://storage.googleapis.com/some-bucket/file.txt",
+			instructions:   "status=429",
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:           "delay",
+			url:            "https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/file.txt?alt=media",
+			instructions:   "delay=100ms",
+			expectedStatus: http.StatusOK,
+			expectedBytes:  len(content),
+			minDuration:    100 * time.Millisecond,
+		},
+		{
+			name:           "delay and status",
+			url:            "https://storage.googleapis.com/storage/v1/b/some-bucket/o/file.txt",
+			instructions:   "delay=100ms, status=500",
+			expectedStatus: http.StatusInternalServerError,
+			minDuration:    100 * time.Millisecond,
+		},
+		{
+			name:           "truncated response",
+			url:            "https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/file.txt?alt=media",
+			instructions:   "truncate=1000",
+			expectedStatus: http.StatusOK,
+			expectedBytes:  1000,
+			expectedErr:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:           "invalid instruction",
+			url:            "https://storage.googleapis.com/storage/v1/b/some-bucket/o/file.txt",
+			instructions:   "explode=true",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid status",
+			url:            "https://storage.googleapis.com/storage/v1/b/some-bucket/o/file.txt",
+			instructions:   "status=200",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.instructions != "" {
+				req.Header.Set("X-Fake-Gcs-Instructions", test.instructions)
+			}
+			start := time.Now()
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			if elapsed := time.Since(start); elapsed < test.minDuration {
+				t.Errorf("request took %s, expected at least %s", elapsed, test.minDuration)
+			}
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if !errors.Is(err, test.expectedErr) {
+				t.Errorf("wrong error reading the body\nwant %v\ngot  %v", test.expectedErr, err)
+			}
+			if test.expectedBytes > 0 && len(data) != test.expectedBytes {
+				t.Errorf("wrong number of bytes read\nwant %d\ngot  %d", test.expectedBytes, len(data))
+			}
+		})
+	}
+}
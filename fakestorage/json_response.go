@@ -3,9 +3,13 @@ package fakestorage
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"mime"
 	"net/http"
 	"os"
 	"syscall"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
 )
 
 type jsonResponse struct {
@@ -13,6 +17,21 @@ type jsonResponse struct {
 	header       http.Header
 	data         interface{}
 	errorMessage string
+
+	// errorReason is the reason reported in the list of errors of the
+	// response, such as "quotaExceeded". When empty, the usual reason for
+	// the status is reported.
+	errorReason string
+
+	// errorLocationType and errorLocation identify the part of the
+	// request that caused the error, such as the "header" If-Match.
+	errorLocationType string
+	errorLocation     string
+
+	// xmlErrorCode is the code of the error reported when the handler is
+	// served on the XML API, such as "NoSuchBucket", when the reason doesn't
+	// identify it.
+	xmlErrorCode string
 }
 
 type jsonHandler = func(r *http.Request) jsonResponse
@@ -28,9 +47,22 @@ func jsonToHTTPHandler(h jsonHandler) http.HandlerFunc {
 		}
 
 		status := resp.getStatus()
+		if fields := r.URL.Query().Get("fields"); fields != "" && status < 300 && resp.data != nil {
+			selected, err := selectFields(resp.data, fields)
+			if err != nil {
+				resp = jsonResponse{
+					status:       http.StatusBadRequest,
+					errorReason:  "invalidParameter",
+					errorMessage: "Invalid field selection " + fields,
+				}
+				status = resp.status
+			} else {
+				resp.data = selected
+			}
+		}
 		var data interface{}
 		if status > 399 {
-			data = newErrorResponse(status, resp.getErrorMessage(status), nil)
+			data = resp.errorResponse(status)
 		} else {
 			data = resp.data
 		}
@@ -40,6 +72,12 @@ func jsonToHTTPHandler(h jsonHandler) http.HandlerFunc {
 	}
 }
 
+// writeJSONError writes the error response of a JSON API request handled
+// outside of jsonToHTTPHandler, such as media downloads.
+func writeJSONError(w http.ResponseWriter, r *http.Request, resp jsonResponse) {
+	jsonToHTTPHandler(func(*http.Request) jsonResponse { return resp })(w, r)
+}
+
 func (r *jsonResponse) getStatus() int {
 	if r.status > 0 {
 		return r.status
@@ -57,11 +95,79 @@ func (r *jsonResponse) getErrorMessage(status int) string {
 	return http.StatusText(status)
 }
 
+// errorResponse returns the error body of the response, in the envelope
+// used by the Google APIs, with a single error.
+func (r *jsonResponse) errorResponse(status int) errorResponse {
+	reason := r.errorReason
+	if reason == "" {
+		reason = defaultErrorReason(status)
+	}
+	message := r.getErrorMessage(status)
+	return newErrorResponse(status, message, []apiError{{
+		Domain:       "global",
+		Reason:       reason,
+		Message:      message,
+		LocationType: r.errorLocationType,
+		Location:     r.errorLocation,
+	}})
+}
+
 func errToJsonResponse(err error) jsonResponse {
 	status := 0
 	var pathError *os.PathError
 	if errors.As(err, &pathError) && pathError.Err == syscall.ENAMETOOLONG {
 		status = http.StatusBadRequest
 	}
+	var quotaErr *quotaExceededError
+	if errors.As(err, &quotaErr) || errors.Is(err, backend.CapacityExceeded) {
+		return jsonResponse{errorMessage: err.Error(), status: http.StatusForbidden, errorReason: "quotaExceeded"}
+	}
+	var rateErr *rateLimitError
+	if errors.As(err, &rateErr) {
+		return jsonResponse{errorMessage: err.Error(), status: rateErr.status, errorReason: "rateLimitExceeded"}
+	}
+	var retentionErr *retentionPolicyError
+	if errors.As(err, &retentionErr) {
+		return jsonResponse{errorMessage: err.Error(), status: http.StatusForbidden, errorReason: "retentionPolicyNotMet"}
+	}
+	var checksumErr *checksumMismatchError
+	if errors.As(err, &checksumErr) {
+		return jsonResponse{errorMessage: err.Error(), status: http.StatusBadRequest, errorReason: "invalid"}
+	}
+	var conditionErr *backend.ConditionError
+	if errors.As(err, &conditionErr) {
+		// the precondition was met when the request was checked, but not
+		// anymore when the object was written.
+		return *preconditionFailed(conditionHeader(conditionErr.Condition))
+	}
+	if errors.Is(err, backend.PreconditionFailed) {
+		return *preconditionFailed("If-Match")
+	}
+	var publicAccessErr *publicAccessPreventionError
+	if errors.As(err, &publicAccessErr) {
+		return jsonResponse{errorMessage: err.Error(), status: http.StatusPreconditionFailed, errorReason: "conditionNotMet"}
+	}
 	return jsonResponse{errorMessage: err.Error(), status: status}
 }
+
+// requireJSONBody wraps handlers of JSON API metadata requests, rejecting
+// requests with a body that isn't sent as application/json when the server
+// runs with Options.StrictContentType. Requests without a body are always
+// accepted.
+func (s *Server) requireJSONBody(h jsonHandler) jsonHandler {
+	return func(r *http.Request) jsonResponse {
+		if !s.options.StrictContentType || r.ContentLength == 0 {
+			return h(r)
+		}
+		contentType := r.Header.Get(contentTypeHeader)
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil && mediaType == "application/json" {
+			return h(r)
+		}
+		message := fmt.Sprintf("Unsupported content with type: %s", contentType)
+		if mediaType == "application/x-www-form-urlencoded" {
+			message = "This API does not support parsing form-encoded input."
+		}
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: message, errorReason: "parseError"}
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLatencyProfiles are the latency profiles available in every server,
+// in addition to the ones provided in Options.LatencyProfiles.
+var defaultLatencyProfiles = map[string]time.Duration{
+	"standard":      0,
+	"nearline-slow": 50 * time.Millisecond,
+	"coldline-slow": 200 * time.Millisecond,
+	"archive-slow":  time.Second,
+}
+
+type bucketLatencies struct {
+	mtx      sync.RWMutex
+	profiles map[string]time.Duration
+	buckets  map[string]string
+}
+
+func newBucketLatencies(profiles map[string]time.Duration) *bucketLatencies {
+	l := bucketLatencies{
+		profiles: make(map[string]time.Duration, len(defaultLatencyProfiles)+len(profiles)),
+		buckets:  make(map[string]string),
+	}
+	for name, latency := range defaultLatencyProfiles {
+		l.profiles[name] = latency
+	}
+	for name, latency := range profiles {
+		l.profiles[name] = latency
+	}
+	return &l
+}
+
+func (l *bucketLatencies) set(bucketName, profile string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if profile == "" {
+		delete(l.buckets, bucketName)
+		return nil
+	}
+	if _, ok := l.profiles[profile]; !ok {
+		return fmt.Errorf("unknown latency profile %q", profile)
+	}
+	l.buckets[bucketName] = profile
+	return nil
+}
+
+func (l *bucketLatencies) readLatency(bucketName string) time.Duration {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.profiles[l.buckets[bucketName]]
+}
+
+// SetBucketLatencyProfile tags the bucket with the given latency profile, so
+// reads of its objects are delayed accordingly. An empty profile removes the
+// tag.
+//
+// Available profiles are "standard", "nearline-slow", "coldline-slow" and
+// "archive-slow", along with any profile defined in Options.LatencyProfiles.
+func (s *Server) SetBucketLatencyProfile(bucketName, profile string) error {
+	return s.latencies.set(bucketName, profile)
+}
+
+// waitReadLatency blocks for the read latency of the given bucket. It returns
+// false if the request is canceled before that.
+func (s *Server) waitReadLatency(r *http.Request, bucketName string) bool {
+	return wait(r, s.latencies.readLatency(bucketName))
+}
+
+// Operation classes of OperationLatency.
+const (
+	OperationUpload   = "upload"
+	OperationDownload = "download"
+	OperationList     = "list"
+	OperationMetadata = "metadata"
+)
+
+// OperationLatency is the latency added to the requests of a class of
+// operations: a random duration between Min and Max, or Min when Max isn't
+// greater than it.
+type OperationLatency struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (l OperationLatency) duration() time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + time.Duration(rand.Int63n(int64(l.Max-l.Min)))
+}
+
+func validOperation(operation string) bool {
+	switch operation {
+	case OperationUpload, OperationDownload, OperationList, OperationMetadata:
+		return true
+	}
+	return false
+}
+
+type operationLatencies struct {
+	mtx        sync.RWMutex
+	operations map[string]OperationLatency
+}
+
+func newOperationLatencies(latencies map[string]OperationLatency) (*operationLatencies, error) {
+	l := operationLatencies{operations: make(map[string]OperationLatency, len(latencies))}
+	for operation, latency := range latencies {
+		if err := l.set(operation, latency); err != nil {
+			return nil, err
+		}
+	}
+	return &l, nil
+}
+
+func (l *operationLatencies) set(operation string, latency OperationLatency) error {
+	if !validOperation(operation) {
+		return fmt.Errorf("unknown operation %q", operation)
+	}
+	if latency.Min < 0 || latency.Max < 0 {
+		return fmt.Errorf("invalid negative latency for %s", operation)
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if latency == (OperationLatency{}) {
+		delete(l.operations, operation)
+		return nil
+	}
+	l.operations[operation] = latency
+	return nil
+}
+
+func (l *operationLatencies) get(operation string) OperationLatency {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.operations[operation]
+}
+
+// SetOperationLatency sets the latency added to the requests of the given
+// class of operations: OperationUpload, OperationDownload, OperationList or
+// OperationMetadata. A zero latency removes it.
+func (s *Server) SetOperationLatency(operation string, latency OperationLatency) error {
+	return s.operationLatencies.set(operation, latency)
+}
+
+// operationClass returns the class of operations of the request, or an empty
+// string for requests that aren't API calls, such as the ones to the
+// internal API.
+func operationClass(r *http.Request) string {
+	method := apiMethod(r)
+	switch {
+	case method == "":
+		return ""
+	case method == "storage.objects.insert":
+		return OperationUpload
+	case method == "storage.objects.get" && (isXMLAPIRequest(r) || r.URL.Query().Get("alt") == "media"):
+		return OperationDownload
+	case strings.HasSuffix(method, ".list"):
+		return OperationList
+	default:
+		return OperationMetadata
+	}
+}
+
+// applyOperationLatency is the middleware that delays requests by the latency
+// of their class of operations. Requests canceled while waiting aren't
+// served.
+func (s *Server) applyOperationLatency(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if operation := operationClass(r); operation != "" {
+			if !wait(r, s.operationLatencies.get(operation).duration()) {
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wait blocks for the given duration. It returns false if the request is
+// canceled before that.
+func wait(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+type latencyProfilesResponse struct {
+	Kind       string                    `json:"kind"`
+	Profiles   map[string]string         `json:"profiles"`
+	Buckets    map[string]string         `json:"buckets"`
+	Operations map[string]latencyPayload `json:"operations"`
+}
+
+type latencyPayload struct {
+	Min string `json:"min"`
+	Max string `json:"max,omitempty"`
+}
+
+func (s *Server) listLatencyProfiles(r *http.Request) jsonResponse {
+	s.latencies.mtx.RLock()
+	defer s.latencies.mtx.RUnlock()
+	resp := latencyProfilesResponse{
+		Kind:     "fakestorage#latencyProfiles",
+		Profiles: make(map[string]string, len(s.latencies.profiles)),
+		Buckets:  make(map[string]string, len(s.latencies.buckets)),
+	}
+	for name, latency := range s.latencies.profiles {
+		resp.Profiles[name] = latency.String()
+	}
+	for bucketName, profile := range s.latencies.buckets {
+		resp.Buckets[bucketName] = profile
+	}
+	s.operationLatencies.mtx.RLock()
+	defer s.operationLatencies.mtx.RUnlock()
+	resp.Operations = make(map[string]latencyPayload, len(s.operationLatencies.operations))
+	for operation, latency := range s.operationLatencies.operations {
+		payload := latencyPayload{Min: latency.Min.String()}
+		if latency.Max > latency.Min {
+			payload.Max = latency.Max.String()
+		}
+		resp.Operations[operation] = payload
+	}
+	return jsonResponse{data: resp}
+}
+
+func (s *Server) setBucketLatencyProfile(r *http.Request) jsonResponse {
+	var data struct {
+		Bucket  string `json:"bucket"`
+		Profile string `json:"profile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Bucket == "" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Latency profile payload can not be parsed."}
+	}
+	if err := s.SetBucketLatencyProfile(data.Bucket, data.Profile); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	return s.listLatencyProfiles(r)
+}
+
+func (s *Server) setOperationLatency(r *http.Request) jsonResponse {
+	var data struct {
+		Operation string `json:"operation"`
+		Min       string `json:"min"`
+		Max       string `json:"max"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Operation == "" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Operation latency payload can not be parsed."}
+	}
+	var latency OperationLatency
+	for _, field := range []struct {
+		value    string
+		duration *time.Duration
+	}{{data.Min, &latency.Min}, {data.Max, &latency.Max}} {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: fmt.Sprintf("Invalid latency %q.", field.value)}
+		}
+		*field.duration = d
+	}
+	if err := s.SetOperationLatency(data.Operation, latency); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	return s.listLatencyProfiles(r)
+}
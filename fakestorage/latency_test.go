@@ -0,0 +1,218 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketLatencyProfile(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "slow-bucket", Name: "file.txt"}, Content: []byte("something")},
+			{ObjectAttrs: ObjectAttrs{BucketName: "fast-bucket", Name: "file.txt"}, Content: []byte("something")},
+		},
+		LatencyProfiles: map[string]time.Duration{"test-slow": latency},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	if err := server.SetBucketLatencyProfile("slow-bucket", "unknown"); err == nil {
+		t.Error("unexpected <nil> error setting an unknown latency profile")
+	}
+	if err := server.SetBucketLatencyProfile("slow-bucket", "test-slow"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := server.Client()
+	read := func(bucketName string) time.Duration {
+		start := time.Now()
+		reader, err := client.Bucket(bucketName).Object("file.txt").NewReader(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		if _, err := io.ReadAll(reader); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	if elapsed := read("slow-bucket"); elapsed < latency {
+		t.Errorf("read from slow bucket took %s, expected at least %s", elapsed, latency)
+	}
+	if elapsed := read("fast-bucket"); elapsed >= latency {
+		t.Errorf("read from fast bucket took %s, expected less than %s", elapsed, latency)
+	}
+
+	if err := server.SetBucketLatencyProfile("slow-bucket", ""); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := read("slow-bucket"); elapsed >= latency {
+		t.Errorf("read from untagged bucket took %s, expected less than %s", elapsed, latency)
+	}
+}
+
+func TestBucketLatencyProfileEndpoint(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name            string
+		body            string
+		expectedStatus  int
+		expectedProfile string
+	}{
+		{
+			"valid profile",
+			`{"bucket":"some-bucket","profile":"coldline-slow"}`,
+			http.StatusOK,
+			"coldline-slow",
+		},
+		{
+			"unknown profile",
+			`{"bucket":"some-bucket","profile":"whatever"}`,
+			http.StatusBadRequest,
+			"coldline-slow",
+		},
+		{
+			"missing bucket",
+			`{"profile":"archive-slow"}`,
+			http.StatusBadRequest,
+			"coldline-slow",
+		},
+		{
+			"remove profile",
+			`{"bucket":"some-bucket"}`,
+			http.StatusOK,
+			"",
+		},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/latency", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("%s: wrong status returned\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+		}
+
+		resp, err = client.Get("https://storage.googleapis.com/_internal/latency")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var profiles latencyProfilesResponse
+		err = json.NewDecoder(resp.Body).Decode(&profiles)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profiles.Buckets["some-bucket"] != test.expectedProfile {
+			t.Errorf("%s: wrong profile\nwant %q\ngot  %q", test.name, test.expectedProfile, profiles.Buckets["some-bucket"])
+		}
+		if profiles.Profiles["coldline-slow"] != "200ms" {
+			t.Errorf("%s: wrong latency for coldline-slow: %q", test.name, profiles.Profiles["coldline-slow"])
+		}
+	}
+}
+
+func TestOperationLatency(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte("something")},
+		},
+		OperationLatencies: map[string]OperationLatency{
+			OperationList: {Min: latency, Max: 2 * latency},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.SetOperationLatency(OperationDownload, OperationLatency{Min: latency}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetOperationLatency("delete", OperationLatency{Min: latency}); err == nil {
+		t.Error("unexpected <nil> error setting the latency of an unknown operation")
+	}
+
+	client := server.HTTPClient()
+	timeRequest := func(url string) time.Duration {
+		start := time.Now()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status for %s\nwant %d\ngot  %d", url, http.StatusOK, resp.StatusCode)
+		}
+		return time.Since(start)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		min     time.Duration
+		slowest time.Duration
+	}{
+		{"list", "https://storage.googleapis.com/storage/v1/b/some-bucket/o", latency, 0},
+		{"download", "https://storage.googleapis.com/some-bucket/file.txt", latency, 0},
+		{"JSON API download", "https://storage.googleapis.com/storage/v1/b/some-bucket/o/file.txt?alt=media", latency, 0},
+		{"metadata", "https://storage.googleapis.com/storage/v1/b/some-bucket/o/file.txt", 0, latency},
+	}
+	for _, test := range tests {
+		elapsed := timeRequest(test.url)
+		if elapsed < test.min {
+			t.Errorf("%s took %s, expected at least %s", test.name, elapsed, test.min)
+		}
+		if test.slowest > 0 && elapsed >= test.slowest {
+			t.Errorf("%s took %s, expected less than %s", test.name, elapsed, test.slowest)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/latency/operations", strings.NewReader(`{"operation":"metadata","min":"100ms","max":"150ms"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var profiles latencyProfilesResponse
+	err = json.NewDecoder(resp.Body).Decode(&profiles)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := latencyPayload{Min: "100ms", Max: "150ms"}
+	if profiles.Operations[OperationMetadata] != expected {
+		t.Errorf("wrong metadata latency\nwant %+v\ngot  %+v", expected, profiles.Operations[OperationMetadata])
+	}
+	if elapsed := timeRequest("https://storage.googleapis.com/storage/v1/b/some-bucket/o/file.txt"); elapsed < latency {
+		t.Errorf("metadata took %s after setting its latency, expected at least %s", elapsed, latency)
+	}
+}
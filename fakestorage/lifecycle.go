@@ -0,0 +1,364 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/fsouza/fake-gcs-server/internal/notification"
+)
+
+const (
+	lifecycleActionDelete          = "Delete"
+	lifecycleActionSetStorageClass = "SetStorageClass"
+
+	lifecycleDateFormat = "2006-01-02"
+)
+
+// LifecycleRule is an object lifecycle management rule of a bucket, in the
+// format used by the JSON API. See SetBucketLifecycle.
+type LifecycleRule struct {
+	Action    LifecycleAction    `json:"action"`
+	Condition LifecycleCondition `json:"condition"`
+}
+
+// LifecycleAction is the action applied to the objects that meet the
+// conditions of a lifecycle rule.
+type LifecycleAction struct {
+	// Type is either "Delete" or "SetStorageClass".
+	Type         string `json:"type"`
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// LifecycleCondition are the conditions of a lifecycle rule. Objects must
+// meet all of the conditions set in the rule. Dates are in the YYYY-MM-DD
+// format.
+type LifecycleCondition struct {
+	Age                     *int64   `json:"age,omitempty"`
+	CreatedBefore           string   `json:"createdBefore,omitempty"`
+	CustomTimeBefore        string   `json:"customTimeBefore,omitempty"`
+	DaysSinceCustomTime     int64    `json:"daysSinceCustomTime,omitempty"`
+	DaysSinceNoncurrentTime int64    `json:"daysSinceNoncurrentTime,omitempty"`
+	IsLive                  *bool    `json:"isLive,omitempty"`
+	MatchesPrefix           []string `json:"matchesPrefix,omitempty"`
+	MatchesSuffix           []string `json:"matchesSuffix,omitempty"`
+	MatchesStorageClass     []string `json:"matchesStorageClass,omitempty"`
+	NoncurrentTimeBefore    string   `json:"noncurrentTimeBefore,omitempty"`
+	NumNewerVersions        int64    `json:"numNewerVersions,omitempty"`
+}
+
+// LifecycleResult summarizes the changes made by a run of the lifecycle
+// rules.
+type LifecycleResult struct {
+	Deleted               int `json:"deleted"`
+	StorageClassesChanged int `json:"storageClassesChanged"`
+}
+
+type bucketLifecycle struct {
+	Rule []LifecycleRule `json:"rule,omitempty"`
+}
+
+func toBackendLifecycle(rules []LifecycleRule) []backend.LifecycleRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	backendRules := make([]backend.LifecycleRule, len(rules))
+	for i, rule := range rules {
+		backendRules[i] = backend.LifecycleRule{
+			Action:    backend.LifecycleAction(rule.Action),
+			Condition: backend.LifecycleCondition(rule.Condition),
+		}
+	}
+	return backendRules
+}
+
+func fromBackendLifecycle(rules []backend.LifecycleRule) *bucketLifecycle {
+	if len(rules) == 0 {
+		return nil
+	}
+	lifecycle := bucketLifecycle{Rule: make([]LifecycleRule, len(rules))}
+	for i, rule := range rules {
+		lifecycle.Rule[i] = LifecycleRule{
+			Action:    LifecycleAction(rule.Action),
+			Condition: LifecycleCondition(rule.Condition),
+		}
+	}
+	return &lifecycle
+}
+
+// validateLifecycle returns an error message describing the first invalid
+// rule, or an empty string if all rules are valid.
+func validateLifecycle(rules []LifecycleRule) string {
+	for _, rule := range rules {
+		switch rule.Action.Type {
+		case lifecycleActionDelete:
+		case lifecycleActionSetStorageClass:
+			if rule.Action.StorageClass == "" {
+				return "A SetStorageClass action requires a storageClass."
+			}
+		default:
+			return "Invalid lifecycle action type: " + rule.Action.Type
+		}
+		for _, date := range []string{rule.Condition.CreatedBefore, rule.Condition.CustomTimeBefore, rule.Condition.NoncurrentTimeBefore} {
+			if _, err := time.Parse(lifecycleDateFormat, date); date != "" && err != nil {
+				return "Invalid lifecycle condition date: " + date
+			}
+		}
+	}
+	return ""
+}
+
+// SetBucketLifecycle replaces the lifecycle rules of the bucket. The rules
+// are applied by RunLifecycle, which the server also calls periodically when
+// Options.LifecycleInterval is set. An empty list of rules removes the
+// configuration.
+func (s *Server) SetBucketLifecycle(bucketName string, rules []LifecycleRule) error {
+	if message := validateLifecycle(rules); message != "" {
+		return backend.Error(message)
+	}
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	attrs.Lifecycle = toBackendLifecycle(rules)
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// lifecycleObject is an object version along with the properties used to
+// evaluate the lifecycle conditions.
+type lifecycleObject struct {
+	ObjectAttrs
+	live             bool
+	numNewerVersions int64
+}
+
+// RunLifecycle applies the lifecycle rules of all buckets to their objects,
+// along with the storage class transitions of buckets with Autoclass enabled.
+// As in Cloud Storage, a Delete action takes precedence over SetStorageClass
+// actions, and when multiple SetStorageClass actions apply to an object, the
+// one that transitions it to the coldest storage class wins.
+func (s *Server) RunLifecycle() (LifecycleResult, error) {
+	var result LifecycleResult
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		return result, err
+	}
+	now := time.Now()
+	for _, bucket := range buckets {
+		if len(bucket.Lifecycle) == 0 && (bucket.Autoclass == nil || !bucket.Autoclass.Enabled) {
+			continue
+		}
+		objs, err := s.lifecycleObjects(bucket.Name)
+		if err != nil {
+			return result, err
+		}
+		for _, obj := range objs {
+			deleted, storageClassChanged, err := s.applyLifecycle(bucket, obj, now)
+			if err != nil {
+				return result, err
+			}
+			if deleted {
+				result.Deleted++
+			}
+			if storageClassChanged {
+				result.StorageClassesChanged++
+			}
+		}
+	}
+	return result, nil
+}
+
+// lifecycleObjects returns all versions of the objects in the bucket.
+func (s *Server) lifecycleObjects(bucketName string) ([]lifecycleObject, error) {
+	liveObjs, err := s.backend.ListObjects(bucketName, "", false)
+	if err != nil {
+		return nil, err
+	}
+	liveGenerations := make(map[string]int64, len(liveObjs))
+	for _, obj := range liveObjs {
+		liveGenerations[obj.Name] = obj.Generation
+	}
+	allObjs, err := s.backend.ListObjects(bucketName, "", true)
+	if err != nil {
+		return nil, err
+	}
+	versions := fromBackendObjectsAttrs(allObjs)
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].Name == versions[j].Name {
+			return versions[i].Generation > versions[j].Generation
+		}
+		return versions[i].Name < versions[j].Name
+	})
+	objs := make([]lifecycleObject, len(versions))
+	for i, version := range versions {
+		objs[i] = lifecycleObject{ObjectAttrs: version}
+		if generation, ok := liveGenerations[version.Name]; ok && generation == version.Generation {
+			objs[i].live = true
+		}
+		if i > 0 && versions[i-1].Name == version.Name {
+			objs[i].numNewerVersions = objs[i-1].numNewerVersions + 1
+		}
+	}
+	return objs, nil
+}
+
+func (s *Server) applyLifecycle(bucket backend.Bucket, obj lifecycleObject, now time.Time) (deleted, storageClassChanged bool, err error) {
+	var storageClass string
+	for _, rule := range bucket.Lifecycle {
+		if !obj.matches(rule.Condition, now) {
+			continue
+		}
+		switch rule.Action.Type {
+		case lifecycleActionDelete:
+			// objects under the retention policy of the bucket can't be
+			// deleted, but their storage class can still change.
+			if s.checkRetention(obj.ObjectAttrs) != nil {
+				continue
+			}
+			return true, false, s.deleteObjectVersion(bucket, obj)
+		case lifecycleActionSetStorageClass:
+			if storageClassRank(rule.Action.StorageClass) > storageClassRank(storageClass) {
+				storageClass = rule.Action.StorageClass
+			}
+		}
+	}
+	// Autoclass only transitions objects to colder storage classes.
+	autoclass := autoclassStorageClass(bucket, obj.ObjectAttrs, now)
+	if storageClassRank(autoclass) > storageClassRank(obj.StorageClass) && storageClassRank(autoclass) > storageClassRank(storageClass) {
+		storageClass = autoclass
+	}
+	if storageClass == "" || storageClass == obj.StorageClass {
+		return false, false, nil
+	}
+	if err := s.backend.SetObjectStorageClass(obj.BucketName, obj.Name, obj.Generation, storageClass); err != nil {
+		return false, false, err
+	}
+	obj.StorageClass = storageClass
+	backendObj := toBackendObjects([]Object{{ObjectAttrs: obj.ObjectAttrs}})[0]
+	s.eventManager.Trigger(&backendObj, notification.EventMetadata, nil)
+	return false, true, nil
+}
+
+func (s *Server) deleteObjectVersion(bucket backend.Bucket, obj lifecycleObject) error {
+	deletedObj, err := s.GetObjectWithGeneration(obj.BucketName, obj.Name, obj.Generation)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.DeleteObjectGeneration(obj.BucketName, obj.Name, obj.Generation); err != nil {
+		return err
+	}
+	backendObj := toBackendObjects([]Object{deletedObj})[0]
+	if obj.live && bucket.VersioningEnabled {
+		s.eventManager.Trigger(&backendObj, notification.EventArchive, nil)
+	} else {
+		s.softDelete(deletedObj)
+		s.eventManager.Trigger(&backendObj, notification.EventDelete, nil)
+	}
+	return nil
+}
+
+// storageClassRank orders the storage classes from the warmest to the
+// coldest.
+func storageClassRank(storageClass string) int {
+	switch storageClass {
+	case "":
+		return 0
+	case "NEARLINE":
+		return 2
+	case "COLDLINE":
+		return 3
+	case "ARCHIVE":
+		return 4
+	default:
+		return 1
+	}
+}
+
+func (obj lifecycleObject) matches(cond backend.LifecycleCondition, now time.Time) bool {
+	days := func(since time.Time) int64 {
+		return int64(now.Sub(since) / (24 * time.Hour))
+	}
+	before := func(t time.Time, date string) bool {
+		d, err := time.Parse(lifecycleDateFormat, date)
+		return err == nil && t.Before(d)
+	}
+	// noncurrent versions of objects became noncurrent when they were
+	// deleted or replaced.
+	noncurrentTime := obj.Deleted
+
+	if cond.Age != nil && days(obj.Created) < *cond.Age {
+		return false
+	}
+	if cond.CreatedBefore != "" && !before(obj.Created, cond.CreatedBefore) {
+		return false
+	}
+	// the conditions based on the custom time are never met by objects
+	// without one.
+	if cond.CustomTimeBefore != "" && (obj.CustomTime.IsZero() || !before(obj.CustomTime, cond.CustomTimeBefore)) {
+		return false
+	}
+	if cond.DaysSinceCustomTime > 0 && (obj.CustomTime.IsZero() || days(obj.CustomTime) < cond.DaysSinceCustomTime) {
+		return false
+	}
+	if cond.IsLive != nil && *cond.IsLive != obj.live {
+		return false
+	}
+	if cond.DaysSinceNoncurrentTime > 0 && (obj.live || days(noncurrentTime) < cond.DaysSinceNoncurrentTime) {
+		return false
+	}
+	if cond.NoncurrentTimeBefore != "" && (obj.live || !before(noncurrentTime, cond.NoncurrentTimeBefore)) {
+		return false
+	}
+	if cond.NumNewerVersions > 0 && obj.numNewerVersions < cond.NumNewerVersions {
+		return false
+	}
+	if len(cond.MatchesPrefix) > 0 && !matchesAny(obj.Name, cond.MatchesPrefix, strings.HasPrefix) {
+		return false
+	}
+	if len(cond.MatchesSuffix) > 0 && !matchesAny(obj.Name, cond.MatchesSuffix, strings.HasSuffix) {
+		return false
+	}
+	if len(cond.MatchesStorageClass) > 0 && !matchesAny(obj.StorageClass, cond.MatchesStorageClass, func(a, b string) bool { return a == b }) {
+		return false
+	}
+	return true
+}
+
+func matchesAny(value string, patterns []string, match func(string, string) bool) bool {
+	for _, pattern := range patterns {
+		if match(value, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// runLifecyclePeriodically calls RunLifecycle every interval until stop is
+// closed.
+func (s *Server) runLifecyclePeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.RunLifecycle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Server) runLifecycle(r *http.Request) jsonResponse {
+	result, err := s.RunLifecycle()
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	return jsonResponse{data: result}
+}
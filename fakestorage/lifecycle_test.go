@@ -0,0 +1,326 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestBucketLifecycleConfiguration(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		client := server.Client()
+		lifecycle := storage.Lifecycle{
+			Rules: []storage.LifecycleRule{
+				{
+					Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+					Condition: storage.LifecycleCondition{AgeInDays: 30, Liveness: storage.Live},
+				},
+				{
+					Action: storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "COLDLINE"},
+					Condition: storage.LifecycleCondition{
+						CreatedBefore:         time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+						MatchesStorageClasses: []string{"STANDARD"},
+					},
+				},
+			},
+		}
+		bucket := client.Bucket("lifecycle-bucket")
+		if err := bucket.Create(context.TODO(), "", &storage.BucketAttrs{Lifecycle: lifecycle}); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := bucket.Attrs(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(attrs.Lifecycle, lifecycle) {
+			t.Errorf("wrong lifecycle configuration\nwant %+v\ngot  %+v", lifecycle, attrs.Lifecycle)
+		}
+
+		if err := server.SetBucketLifecycle("lifecycle-bucket", nil); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err = bucket.Attrs(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attrs.Lifecycle.Rules) != 0 {
+			t.Errorf("unexpected lifecycle rules after removing them: %+v", attrs.Lifecycle.Rules)
+		}
+		if err := server.SetBucketLifecycle("lifecycle-bucket", []LifecycleRule{{Action: LifecycleAction{Type: "Archive"}}}); err == nil {
+			t.Error("unexpected <nil> error setting a lifecycle rule with an invalid action")
+		}
+		if err := server.SetBucketLifecycle("missing-bucket", []LifecycleRule{{Action: LifecycleAction{Type: "Delete"}}}); err == nil {
+			t.Error("unexpected <nil> error setting the lifecycle rules of a bucket that doesn't exist")
+		}
+	})
+}
+
+func TestCreateBucketInvalidLifecycle(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	body := `{"name":"lifecycle-bucket","lifecycle":{"rule":[{"action":{"type":"SetStorageClass"},"condition":{"age":1}}]}}`
+	req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/storage/v1/b", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if _, err := server.backend.GetBucket("lifecycle-bucket"); err == nil {
+		t.Error("bucket created despite the invalid lifecycle configuration")
+	}
+}
+
+func TestRunLifecycle(t *testing.T) {
+	const bucketName = "lifecycle-bucket"
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName, VersioningEnabled: true})
+
+	daysAgo := func(days int) time.Time {
+		return time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	}
+	for _, obj := range []ObjectAttrs{
+		{Name: "logs/old.txt", Created: daysAgo(40)},
+		{Name: "logs/new.txt", Created: daysAgo(1)},
+		{Name: "data/warm.txt", Created: daysAgo(15)},
+		{Name: "data/cold.txt", Created: daysAgo(25)},
+		{Name: "versioned.txt"},
+		{Name: "versioned.txt"},
+		{Name: "versioned.txt"},
+	} {
+		obj.BucketName = bucketName
+		server.CreateObject(Object{ObjectAttrs: obj, Content: []byte("content")})
+	}
+	age := func(days int64) *int64 {
+		return &days
+	}
+	err = server.SetBucketLifecycle(bucketName, []LifecycleRule{
+		{
+			Action:    LifecycleAction{Type: "Delete"},
+			Condition: LifecycleCondition{Age: age(30), MatchesPrefix: []string{"logs/"}},
+		},
+		{
+			Action:    LifecycleAction{Type: "SetStorageClass", StorageClass: "NEARLINE"},
+			Condition: LifecycleCondition{Age: age(10), MatchesPrefix: []string{"data/"}},
+		},
+		{
+			Action:    LifecycleAction{Type: "SetStorageClass", StorageClass: "COLDLINE"},
+			Condition: LifecycleCondition{Age: age(20), MatchesPrefix: []string{"data/"}},
+		},
+		{
+			Action:    LifecycleAction{Type: "Delete"},
+			Condition: LifecycleCondition{NumNewerVersions: 2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := server.RunLifecycle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResult := LifecycleResult{Deleted: 2, StorageClassesChanged: 2}
+	if result != expectedResult {
+		t.Errorf("wrong result\nwant %+v\ngot  %+v", expectedResult, result)
+	}
+
+	if _, err := server.GetObject(bucketName, "logs/old.txt"); err == nil {
+		t.Error("logs/old.txt wasn't deleted")
+	}
+	if _, err := server.GetObject(bucketName, "logs/new.txt"); err != nil {
+		t.Errorf("logs/new.txt was unexpectedly deleted: %v", err)
+	}
+	for name, expectedStorageClass := range map[string]string{
+		"data/warm.txt": "NEARLINE",
+		"data/cold.txt": "COLDLINE",
+	} {
+		obj, err := server.GetObject(bucketName, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.StorageClass != expectedStorageClass {
+			t.Errorf("wrong storage class for %s\nwant %q\ngot  %q", name, expectedStorageClass, obj.StorageClass)
+		}
+	}
+	versions, err := server.ObjectVersions(bucketName, "versioned.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("wrong number of versions of versioned.txt\nwant 2\ngot  %d", len(versions))
+	}
+
+	// the live version of the old object was archived as a noncurrent
+	// version, which the following rule deletes.
+	err = server.SetBucketLifecycle(bucketName, []LifecycleRule{
+		{Action: LifecycleAction{Type: "Delete"}, Condition: LifecycleCondition{IsLive: new(bool)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = server.RunLifecycle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResult = LifecycleResult{Deleted: 2}
+	if result != expectedResult {
+		t.Errorf("wrong result\nwant %+v\ngot  %+v", expectedResult, result)
+	}
+	versions, err = server.ObjectVersions(bucketName, "versioned.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("wrong number of versions of versioned.txt\nwant 1\ngot  %d", len(versions))
+	}
+}
+
+func TestRunLifecycleCustomTime(t *testing.T) {
+	const bucketName = "some-bucket"
+	daysAgo := func(days int) time.Time {
+		return time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	}
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "expired.txt", CustomTime: daysAgo(10)}},
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "recent.txt", CustomTime: daysAgo(1)}},
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "old-without-custom-time.txt", Created: daysAgo(10)}},
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "archived.bin", CustomTime: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	err = server.SetBucketLifecycle(bucketName, []LifecycleRule{
+		{Action: LifecycleAction{Type: "Delete"}, Condition: LifecycleCondition{DaysSinceCustomTime: 7, MatchesSuffix: []string{".txt"}}},
+		{Action: LifecycleAction{Type: "SetStorageClass", StorageClass: "ARCHIVE"}, Condition: LifecycleCondition{CustomTimeBefore: "2021-01-01"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := server.RunLifecycle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedResult := LifecycleResult{Deleted: 1, StorageClassesChanged: 1}
+	if result != expectedResult {
+		t.Errorf("wrong result\nwant %+v\ngot  %+v", expectedResult, result)
+	}
+	if _, err := server.GetObject(bucketName, "expired.txt"); err == nil {
+		t.Error("expired.txt wasn't deleted")
+	}
+	obj, err := server.GetObject(bucketName, "archived.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.StorageClass != "ARCHIVE" {
+		t.Errorf("wrong storage class for archived.bin\nwant %q\ngot  %q", "ARCHIVE", obj.StorageClass)
+	}
+	for _, name := range []string{"recent.txt", "old-without-custom-time.txt"} {
+		if _, err := server.GetObject(bucketName, name); err != nil {
+			t.Errorf("%s was unexpectedly deleted: %v", name, err)
+		}
+	}
+}
+
+func TestRunLifecycleEndpoint(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "old.txt", Created: time.Now().Add(-48 * time.Hour)}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "new.txt"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	age := int64(1)
+	err = server.SetBucketLifecycle("some-bucket", []LifecycleRule{
+		{Action: LifecycleAction{Type: "Delete"}, Condition: LifecycleCondition{Age: &age}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/_internal/lifecycle", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	var result LifecycleResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	expectedResult := LifecycleResult{Deleted: 1}
+	if result != expectedResult {
+		t.Errorf("wrong result\nwant %+v\ngot  %+v", expectedResult, result)
+	}
+	if _, err := server.GetObject("some-bucket", "new.txt"); err != nil {
+		t.Errorf("new.txt was unexpectedly deleted: %v", err)
+	}
+}
+
+func TestLifecycleInterval(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:        true,
+		LifecycleInterval: 10 * time.Millisecond,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "old.txt", Created: time.Now().Add(-48 * time.Hour)}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	age := int64(1)
+	err = server.SetBucketLifecycle("some-bucket", []LifecycleRule{
+		{Action: LifecycleAction{Type: "Delete"}, Condition: LifecycleCondition{Age: &age}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := server.GetObject("some-bucket", "old.txt"); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("old.txt wasn't deleted by the periodic lifecycle run")
+}
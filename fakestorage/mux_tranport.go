@@ -5,16 +5,42 @@
 package fakestorage
 
 import (
+	"bytes"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"syscall"
 )
 
 type muxTransport struct {
 	handler http.Handler
 }
 
-func (t *muxTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+func (t *muxTransport) RoundTrip(r *http.Request) (resp *http.Response, err error) {
 	w := httptest.NewRecorder()
+	defer func() {
+		// handlers abort to break the connection, which is reported as a
+		// reset when nothing was sent yet, or as a truncated body.
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				panic(v)
+			}
+			if !w.Flushed {
+				resp, err = nil, syscall.ECONNRESET
+				return
+			}
+			resp = w.Result()
+			resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(w.Body.Bytes()), errReader{io.ErrUnexpectedEOF}))
+		}
+	}()
 	t.handler.ServeHTTP(w, r)
 	return w.Result(), nil
 }
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
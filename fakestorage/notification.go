@@ -0,0 +1,145 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/fsouza/fake-gcs-server/internal/notification"
+	"github.com/gorilla/mux"
+)
+
+// topicRegexp matches the full resource name of Pub/Sub topics, as used in
+// notification configurations.
+var topicRegexp = regexp.MustCompile(`^//pubsub\.googleapis\.com/projects/([^/]+)/topics/([^/]+)$`)
+
+type notificationConfigResponse struct {
+	Kind             string            `json:"kind"`
+	ID               string            `json:"id"`
+	SelfLink         string            `json:"selfLink"`
+	Topic            string            `json:"topic"`
+	EventTypes       []string          `json:"event_types,omitempty"`
+	CustomAttributes map[string]string `json:"custom_attributes,omitempty"`
+	PayloadFormat    string            `json:"payload_format"`
+	ObjectNamePrefix string            `json:"object_name_prefix,omitempty"`
+	Etag             string            `json:"etag"`
+}
+
+type listNotificationConfigsResponse struct {
+	Kind  string                       `json:"kind"`
+	Items []notificationConfigResponse `json:"items"`
+}
+
+func (s *Server) newNotificationConfigResponse(config notification.Config) notificationConfigResponse {
+	eventTypes := make([]string, len(config.EventTypes))
+	for i, t := range config.EventTypes {
+		eventTypes[i] = string(t)
+	}
+	return notificationConfigResponse{
+		Kind:             "storage#notification",
+		ID:               config.ID,
+		SelfLink:         fmt.Sprintf("%s/storage/v1/b/%s/notificationConfigs/%s", s.URL(), config.BucketName, config.ID),
+		Topic:            fmt.Sprintf("//pubsub.googleapis.com/projects/%s/topics/%s", config.TopicProjectID, config.TopicName),
+		EventTypes:       eventTypes,
+		CustomAttributes: config.CustomAttributes,
+		PayloadFormat:    config.PayloadFormat,
+		ObjectNamePrefix: config.ObjectNamePrefix,
+		Etag:             config.ID,
+	}
+}
+
+// eventPayload returns the payload of the events of the object: the object
+// resource returned by the JSON API, along with its links, as Cloud Storage
+// sends it.
+func (s *Server) eventPayload(o *backend.Object) interface{} {
+	obj := fromBackendObjects([]backend.Object{*o})[0].ObjectAttrs
+	// objects written or read as a stream don't carry their content, only
+	// their size.
+	if o.Content == nil {
+		obj.Size = o.Size
+	}
+	resource := newObjectResponse(obj)
+	path := "/b/" + url.PathEscape(obj.BucketName) + "/o/" + url.PathEscape(obj.Name)
+	resource.SelfLink = s.URL() + "/storage/v1" + path
+	resource.MediaLink = fmt.Sprintf("%s/download/storage/v1%s?generation=%d&alt=media", s.URL(), path, obj.Generation)
+	return resource
+}
+
+func (s *Server) insertNotificationConfig(r *http.Request) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	var data notificationConfigResponse
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	topic := topicRegexp.FindStringSubmatch(data.Topic)
+	if topic == nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid topic name: " + data.Topic}
+	}
+	payloadFormat := data.PayloadFormat
+	if payloadFormat == "" {
+		payloadFormat = notification.PayloadFormatJSON
+	}
+	if payloadFormat != notification.PayloadFormatJSON && payloadFormat != notification.PayloadFormatNone {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid payload format: " + payloadFormat}
+	}
+	config := notification.Config{
+		BucketName:       bucketName,
+		TopicProjectID:   topic[1],
+		TopicName:        topic[2],
+		CustomAttributes: data.CustomAttributes,
+		PayloadFormat:    payloadFormat,
+		ObjectNamePrefix: data.ObjectNamePrefix,
+	}
+	for _, t := range data.EventTypes {
+		eventType := notification.EventType(t)
+		if !notification.ValidEventType(eventType) {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid event type: " + t}
+		}
+		config.EventTypes = append(config.EventTypes, eventType)
+	}
+	config = s.notifications.AddConfig(config)
+	return jsonResponse{data: s.newNotificationConfigResponse(config)}
+}
+
+func (s *Server) listNotificationConfigs(r *http.Request) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	configs := s.notifications.ListConfigs(bucketName)
+	resp := listNotificationConfigsResponse{
+		Kind:  "storage#notifications",
+		Items: make([]notificationConfigResponse, len(configs)),
+	}
+	for i, config := range configs {
+		resp.Items[i] = s.newNotificationConfigResponse(config)
+	}
+	return jsonResponse{data: resp}
+}
+
+func (s *Server) getNotificationConfig(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	config, ok := s.notifications.GetConfig(vars["bucketName"], vars["notification"])
+	if !ok {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	return jsonResponse{data: s.newNotificationConfigResponse(config)}
+}
+
+func (s *Server) deleteNotificationConfig(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	if !s.notifications.DeleteConfig(vars["bucketName"], vars["notification"]) {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	return jsonResponse{}
+}
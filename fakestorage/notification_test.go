@@ -0,0 +1,150 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+func TestNotificationConfigs(t *testing.T) {
+	const bucketName = "some-bucket"
+	runServersTest(t, runServersOptions{
+		objs: []Object{{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "file.txt"}}},
+	}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		bucket := server.Client().Bucket(bucketName)
+
+		created, err := bucket.AddNotification(ctx, &storage.Notification{
+			TopicProjectID:   "my-project",
+			TopicID:          "uploads",
+			EventTypes:       []string{storage.ObjectFinalizeEvent, storage.ObjectDeleteEvent},
+			CustomAttributes: map[string]string{"team": "storage"},
+			ObjectNamePrefix: "files/",
+			PayloadFormat:    storage.NoPayload,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.ID == "" {
+			t.Error("no ID assigned to the notification configuration")
+		}
+		if created.TopicProjectID != "my-project" || created.TopicID != "uploads" {
+			t.Errorf("wrong topic\nwant my-project/uploads\ngot  %s/%s", created.TopicProjectID, created.TopicID)
+		}
+		if created.PayloadFormat != storage.NoPayload {
+			t.Errorf("wrong payload format\nwant %q\ngot  %q", storage.NoPayload, created.PayloadFormat)
+		}
+
+		notifications, err := bucket.Notifications(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := notifications[created.ID]; !ok || !reflect.DeepEqual(got, created) {
+			t.Errorf("wrong notifications\nwant %+v\ngot  %+v", created, notifications)
+		}
+
+		if err := bucket.DeleteNotification(ctx, created.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := bucket.DeleteNotification(ctx, created.ID); err == nil {
+			t.Error("unexpected <nil> error deleting a notification configuration twice")
+		}
+		notifications, err = bucket.Notifications(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notifications) != 0 {
+			t.Errorf("unexpected notifications after the deletion: %+v", notifications)
+		}
+
+		if _, err := bucket.AddNotification(ctx, &storage.Notification{
+			TopicProjectID: "my-project",
+			TopicID:        "uploads",
+			EventTypes:     []string{"OBJECT_EXPLODED"},
+		}); err == nil {
+			t.Error("unexpected <nil> error adding a notification with an invalid event type")
+		}
+		if _, err := server.Client().Bucket("missing-bucket").Notifications(ctx); err == nil {
+			t.Error("unexpected <nil> error listing the notifications of a bucket that doesn't exist")
+		}
+	})
+}
+
+func TestEventPayload(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true, ExternalURL: "https://gcs.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	obj := backend.Object{
+		ObjectAttrs: backend.ObjectAttrs{
+			BucketName:         "some-bucket",
+			Name:               "files/text 01.txt",
+			ContentType:        "text/plain",
+			ContentEncoding:    "gzip",
+			CacheControl:       "no-cache",
+			ContentDisposition: "attachment",
+			ContentLanguage:    "en",
+			Crc32c:             "crc32c",
+			Md5Hash:            "md5",
+			Etag:               `"md5"`,
+			ACL:                []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}},
+			Metadata:           map[string]string{"key": "value"},
+			Created:            "2022-05-20T10:00:00Z",
+			Updated:            "2022-05-20T10:00:01Z",
+			CustomTime:         "2022-05-21T10:00:00Z",
+			Generation:         1653040800000000,
+			Metageneration:     1,
+			StorageClass:       "NEARLINE",
+			KMSKeyName:         "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		},
+		Content: []byte("something"),
+	}
+	data, err := json.Marshal(server.eventPayload(&obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"selfLink":           "https://gcs.example.com/storage/v1/b/some-bucket/o/files%2Ftext%2001.txt",
+		"mediaLink":          "https://gcs.example.com/download/storage/v1/b/some-bucket/o/files%2Ftext%2001.txt?generation=1653040800000000&alt=media",
+		"size":               "9",
+		"cacheControl":       "no-cache",
+		"contentDisposition": "attachment",
+		"contentLanguage":    "en",
+		"customTime":         "2022-05-21T10:00:00Z",
+		"kmsKeyName":         "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		"timeCreated":        "2022-05-20T10:00:00Z",
+	}
+	for key, value := range expected {
+		if !reflect.DeepEqual(payload[key], value) {
+			t.Errorf("wrong %s\nwant %#v\ngot  %#v", key, value, payload[key])
+		}
+	}
+	for _, key := range []string{"acl", "owner"} {
+		if payload[key] == nil {
+			t.Errorf("missing %s in the payload", key)
+		}
+	}
+	if _, ok := payload["timeStorageClassUpdated"]; ok {
+		t.Errorf("unexpected timeStorageClassUpdated in the payload: %v", payload["timeStorageClassUpdated"])
+	}
+
+	// streamed objects have no content, only their size.
+	obj.Content = nil
+	obj.Size = 42
+	if resource := server.eventPayload(&obj).(objectResponse); resource.Size != 42 {
+		t.Errorf("wrong size of a streamed object\nwant 42\ngot  %d", resource.Size)
+	}
+}
@@ -5,12 +5,14 @@
 package fakestorage
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -22,7 +24,10 @@ import (
 	"github.com/gorilla/mux"
 )
 
-var errInvalidGeneration = errors.New("invalid generation ID")
+var (
+	errInvalidGeneration = errors.New("invalid generation ID")
+	errInvalidPageToken  = errors.New("invalid page token")
+)
 
 // ObjectAttrs returns only the meta-data about an object without its contents.
 type ObjectAttrs struct {
@@ -31,6 +36,12 @@ type ObjectAttrs struct {
 	Size            int64
 	ContentType     string
 	ContentEncoding string
+	// CacheControl, ContentDisposition and ContentLanguage are served as
+	// the Cache-Control, Content-Disposition and Content-Language headers
+	// of downloads.
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
 	// Crc32c checksum of Content. calculated by server when it's upload methods are used.
 	Crc32c  string
 	Md5Hash string
@@ -42,7 +53,31 @@ type ObjectAttrs struct {
 	Updated    time.Time
 	Deleted    time.Time
 	Generation int64
-	Metadata   map[string]string
+	// Metageneration is the version of the object's metadata within its
+	// generation. It's set to 1 when left empty.
+	Metageneration int64
+	Metadata       map[string]string
+	// StorageClass is inherited from the bucket's default storage class
+	// when left empty.
+	StorageClass string
+	// ComponentCount is the number of non-composite objects that make up a
+	// composite object, zero for other objects.
+	ComponentCount int
+	// SoftDeleteTime and HardDeleteTime are only set on soft-deleted
+	// objects. See SetBucketSoftDeletePolicy.
+	SoftDeleteTime time.Time
+	HardDeleteTime time.Time
+	// CustomerKeySHA256 is the base64-encoded SHA256 of the customer-supplied
+	// encryption key of the object. Objects with a key can only be read by
+	// requests that send the same key.
+	CustomerKeySHA256 string
+	// KMSKeyName is the Cloud KMS key the object is encrypted with. Objects
+	// uploaded without a key inherit the default KMS key of the bucket.
+	KMSKeyName string
+	// CustomTime is a user-specified timestamp for the object, used by the
+	// daysSinceCustomTime and customTimeBefore lifecycle conditions. Once
+	// set, it can only move forward.
+	CustomTime time.Time
 }
 
 func (o *ObjectAttrs) id() string {
@@ -58,36 +93,54 @@ type Object struct {
 // MarshalJSON for Object to use ACLRule instead of storage.ACLRule
 func (o Object) MarshalJSON() ([]byte, error) {
 	temp := struct {
-		BucketName      string            `json:"bucket"`
-		Name            string            `json:"name"`
-		Size            int64             `json:"size,string"`
-		ContentType     string            `json:"contentType"`
-		ContentEncoding string            `json:"contentEncoding"`
-		Content         []byte            `json:"-"`
-		Crc32c          string            `json:"crc32c,omitempty"`
-		Md5Hash         string            `json:"md5Hash,omitempty"`
-		Etag            string            `json:"etag,omitempty"`
-		ACL             []aclRule         `json:"acl,omitempty"`
-		Created         time.Time         `json:"created,omitempty"`
-		Updated         time.Time         `json:"updated,omitempty"`
-		Deleted         time.Time         `json:"deleted,omitempty"`
-		Generation      int64             `json:"generation,omitempty,string"`
-		Metadata        map[string]string `json:"metadata,omitempty"`
+		BucketName         string              `json:"bucket"`
+		Name               string              `json:"name"`
+		Size               int64               `json:"size,string"`
+		ContentType        string              `json:"contentType"`
+		ContentEncoding    string              `json:"contentEncoding"`
+		CacheControl       string              `json:"cacheControl,omitempty"`
+		ContentDisposition string              `json:"contentDisposition,omitempty"`
+		ContentLanguage    string              `json:"contentLanguage,omitempty"`
+		Content            []byte              `json:"-"`
+		Crc32c             string              `json:"crc32c,omitempty"`
+		Md5Hash            string              `json:"md5Hash,omitempty"`
+		Etag               string              `json:"etag,omitempty"`
+		ACL                []aclRule           `json:"acl,omitempty"`
+		Created            time.Time           `json:"created,omitempty"`
+		Updated            time.Time           `json:"updated,omitempty"`
+		Deleted            time.Time           `json:"deleted,omitempty"`
+		Generation         int64               `json:"generation,omitempty,string"`
+		Metageneration     int64               `json:"metageneration,omitempty,string"`
+		Metadata           map[string]string   `json:"metadata,omitempty"`
+		StorageClass       string              `json:"storageClass,omitempty"`
+		ComponentCount     int                 `json:"componentCount,omitempty"`
+		CustomerEncryption *customerEncryption `json:"customerEncryption,omitempty"`
+		KMSKeyName         string              `json:"kmsKeyName,omitempty"`
+		CustomTime         time.Time           `json:"customTime,omitempty"`
 	}{
-		BucketName:      o.BucketName,
-		Name:            o.Name,
-		ContentType:     o.ContentType,
-		ContentEncoding: o.ContentEncoding,
-		Size:            o.Size,
-		Content:         o.Content,
-		Crc32c:          o.Crc32c,
-		Md5Hash:         o.Md5Hash,
-		Etag:            o.Etag,
-		Created:         o.Created,
-		Updated:         o.Updated,
-		Deleted:         o.Deleted,
-		Generation:      o.Generation,
-		Metadata:        o.Metadata,
+		BucketName:         o.BucketName,
+		Name:               o.Name,
+		ContentType:        o.ContentType,
+		ContentEncoding:    o.ContentEncoding,
+		CacheControl:       o.CacheControl,
+		ContentDisposition: o.ContentDisposition,
+		ContentLanguage:    o.ContentLanguage,
+		Size:               o.Size,
+		Content:            o.Content,
+		Crc32c:             o.Crc32c,
+		Md5Hash:            o.Md5Hash,
+		Etag:               o.Etag,
+		Created:            o.Created,
+		Updated:            o.Updated,
+		Deleted:            o.Deleted,
+		Generation:         o.Generation,
+		Metageneration:     o.Metageneration,
+		Metadata:           o.Metadata,
+		StorageClass:       o.StorageClass,
+		ComponentCount:     o.ComponentCount,
+		CustomerEncryption: newCustomerEncryption(o.CustomerKeySHA256),
+		KMSKeyName:         o.KMSKeyName,
+		CustomTime:         o.CustomTime,
 	}
 	temp.ACL = make([]aclRule, len(o.ACL))
 	for i, ACL := range o.ACL {
@@ -99,21 +152,30 @@ func (o Object) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON for Object to use ACLRule instead of storage.ACLRule
 func (o *Object) UnmarshalJSON(data []byte) error {
 	temp := struct {
-		BucketName      string            `json:"bucket"`
-		Name            string            `json:"name"`
-		Size            int64             `json:"size,string"`
-		ContentType     string            `json:"contentType"`
-		ContentEncoding string            `json:"contentEncoding"`
-		Content         []byte            `json:"-"`
-		Crc32c          string            `json:"crc32c,omitempty"`
-		Md5Hash         string            `json:"md5Hash,omitempty"`
-		Etag            string            `json:"etag,omitempty"`
-		ACL             []aclRule         `json:"acl,omitempty"`
-		Created         time.Time         `json:"created,omitempty"`
-		Updated         time.Time         `json:"updated,omitempty"`
-		Deleted         time.Time         `json:"deleted,omitempty"`
-		Generation      int64             `json:"generation,omitempty,string"`
-		Metadata        map[string]string `json:"metadata,omitempty"`
+		BucketName         string              `json:"bucket"`
+		Name               string              `json:"name"`
+		Size               int64               `json:"size,string"`
+		ContentType        string              `json:"contentType"`
+		ContentEncoding    string              `json:"contentEncoding"`
+		CacheControl       string              `json:"cacheControl,omitempty"`
+		ContentDisposition string              `json:"contentDisposition,omitempty"`
+		ContentLanguage    string              `json:"contentLanguage,omitempty"`
+		Content            []byte              `json:"-"`
+		Crc32c             string              `json:"crc32c,omitempty"`
+		Md5Hash            string              `json:"md5Hash,omitempty"`
+		Etag               string              `json:"etag,omitempty"`
+		ACL                []aclRule           `json:"acl,omitempty"`
+		Created            time.Time           `json:"created,omitempty"`
+		Updated            time.Time           `json:"updated,omitempty"`
+		Deleted            time.Time           `json:"deleted,omitempty"`
+		Generation         int64               `json:"generation,omitempty,string"`
+		Metageneration     int64               `json:"metageneration,omitempty,string"`
+		Metadata           map[string]string   `json:"metadata,omitempty"`
+		StorageClass       string              `json:"storageClass,omitempty"`
+		ComponentCount     int                 `json:"componentCount,omitempty"`
+		CustomerEncryption *customerEncryption `json:"customerEncryption,omitempty"`
+		KMSKeyName         string              `json:"kmsKeyName,omitempty"`
+		CustomTime         time.Time           `json:"customTime,omitempty"`
 	}{}
 	if err := json.Unmarshal(data, &temp); err != nil {
 		return err
@@ -122,6 +184,9 @@ func (o *Object) UnmarshalJSON(data []byte) error {
 	o.Name = temp.Name
 	o.ContentType = temp.ContentType
 	o.ContentEncoding = temp.ContentEncoding
+	o.CacheControl = temp.CacheControl
+	o.ContentDisposition = temp.ContentDisposition
+	o.ContentLanguage = temp.ContentLanguage
 	o.Size = temp.Size
 	o.Content = temp.Content
 	o.Crc32c = temp.Crc32c
@@ -131,7 +196,15 @@ func (o *Object) UnmarshalJSON(data []byte) error {
 	o.Updated = temp.Updated
 	o.Deleted = temp.Deleted
 	o.Generation = temp.Generation
+	o.Metageneration = temp.Metageneration
 	o.Metadata = temp.Metadata
+	o.StorageClass = temp.StorageClass
+	o.ComponentCount = temp.ComponentCount
+	if temp.CustomerEncryption != nil {
+		o.CustomerKeySHA256 = temp.CustomerEncryption.KeySha256
+	}
+	o.KMSKeyName = temp.KMSKeyName
+	o.CustomTime = temp.CustomTime
 	o.ACL = make([]storage.ACLRule, len(temp.ACL))
 	for i, ACL := range temp.ACL {
 		o.ACL[i] = storage.ACLRule(ACL)
@@ -221,6 +294,9 @@ func (o objectAttrsList) Len() int {
 }
 
 func (o objectAttrsList) Less(i int, j int) bool {
+	if o[i].Name == o[j].Name {
+		return o[i].Generation < o[j].Generation
+	}
 	return o[i].Name < o[j].Name
 }
 
@@ -232,25 +308,102 @@ func (o *objectAttrsList) Swap(i int, j int) {
 // CreateObject stores the given object internally.
 //
 // If the bucket within the object doesn't exist, it also creates it. If the
-// object already exists, it overrides the object.
+// object already exists, it overrides the object. Objects without an ACL get
+// the default object ACL of the bucket.
 func (s *Server) CreateObject(obj Object) {
-	_, err := s.createObject(obj)
+	if len(obj.ACL) == 0 {
+		obj.ACL = s.defaultObjectACL(obj.BucketName)
+	}
+	_, err := s.storeObject(obj)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// createObject stores an object written through the API, which is subject to
+// the write rate limits of the bucket.
 func (s *Server) createObject(obj Object) (Object, error) {
-	oldBackendObj, err := s.backend.GetObject(obj.BucketName, obj.Name)
-	prevVersionExisted := err == nil
+	return s.createObjectIf(obj, nil, objectPreconditions{})
+}
+
+// createObjectStream is like createObject, with the content read from the
+// given reader.
+func (s *Server) createObjectStream(obj Object, content io.Reader) (Object, error) {
+	return s.createObjectIf(obj, content, objectPreconditions{})
+}
+
+// createObjectIf is like createObjectStream, with the preconditions of the
+// request enforced by the backend when the object is stored. When content is
+// nil, obj.Content is stored instead.
+func (s *Server) createObjectIf(obj Object, content io.Reader, conds objectPreconditions) (Object, error) {
+	if err := s.writeRates.take(obj.BucketName, obj.Name); err != nil {
+		return Object{}, err
+	}
+	if content == nil {
+		obj.Size = int64(len(obj.Content))
+	}
+	return s.storeObjectStream(obj, content, conds.toBackend())
+}
+
+func (s *Server) storeObject(obj Object) (Object, error) {
+	obj.Size = int64(len(obj.Content))
+	return s.storeObjectStream(obj, nil, backend.Conditions{})
+}
 
-	newBackendObj, err := s.backend.CreateObject(toBackendObjects([]Object{obj})[0])
+// storeObjectStream stores the object with the content read from the given
+// reader, so the content doesn't need to be in memory. obj.Size must be set
+// to the size of the content. When content is nil, obj.Content is stored
+// instead. The object is only stored if its live version meets the
+// conditions.
+func (s *Server) storeObjectStream(obj Object, content io.Reader, conds backend.Conditions) (Object, error) {
+	if err := s.checkPublicAccessPrevention(obj.BucketName, obj.ACL); err != nil {
+		return Object{}, err
+	}
+	if quota, ok := s.quotas.get(obj.BucketName); ok {
+		s.quotas.writeMtx.Lock()
+		defer s.quotas.writeMtx.Unlock()
+		if err := s.checkQuota(obj, quota); err != nil {
+			return Object{}, err
+		}
+	}
+
+	bucket, _ := s.backend.GetBucket(obj.BucketName)
+	oldBackendObj, prevVersionExisted, err := s.previousObject(bucket, obj.BucketName, obj.Name)
 	if err != nil {
 		return Object{}, err
 	}
+	var oldObj *ObjectAttrs
+	if prevVersionExisted {
+		oldObj = &fromBackendObjectsAttrs([]backend.ObjectAttrs{oldBackendObj.ObjectAttrs})[0]
+		if err := s.checkRetention(*oldObj); err != nil {
+			return Object{}, err
+		}
+	}
+
+	var newBackendObj backend.Object
+	if !conds.IsZero() {
+		reader := content
+		if reader == nil {
+			reader = bytes.NewReader(obj.Content)
+			newBackendObj.Content = obj.Content
+		}
+		newBackendObj.ObjectAttrs, err = s.backend.CreateObjectIf(toBackendObjects([]Object{obj})[0].ObjectAttrs, reader, conds)
+	} else if content == nil {
+		newBackendObj, err = s.backend.CreateObject(toBackendObjects([]Object{obj})[0])
+	} else {
+		newBackendObj.ObjectAttrs, err = s.backend.CreateObjectStream(toBackendObjects([]Object{obj})[0].ObjectAttrs, content)
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	s.listingConsistency.record(obj.BucketName, obj.Name, oldObj)
 
 	var newObjEventAttr map[string]string
 	if prevVersionExisted {
+		if !bucket.VersioningEnabled {
+			s.softDelete(fromBackendObjects([]backend.Object{oldBackendObj})[0])
+		}
+
 		newObjEventAttr = map[string]string{
 			"overwroteGeneration": strconv.FormatInt(oldBackendObj.Generation, 10),
 		}
@@ -259,7 +412,6 @@ func (s *Server) createObject(obj Object) (Object, error) {
 			"overwrittenByGeneration": strconv.FormatInt(newBackendObj.Generation, 10),
 		}
 
-		bucket, _ := s.backend.GetBucket(obj.BucketName)
 		if bucket.VersioningEnabled {
 			s.eventManager.Trigger(&oldBackendObj, notification.EventArchive, oldObjEventAttr)
 		} else {
@@ -267,11 +419,32 @@ func (s *Server) createObject(obj Object) (Object, error) {
 		}
 	}
 
-	newObj := fromBackendObjects([]backend.Object{newBackendObj})[0]
+	newObj := Object{
+		ObjectAttrs: fromBackendObjectsAttrs([]backend.ObjectAttrs{newBackendObj.ObjectAttrs})[0],
+		Content:     newBackendObj.Content,
+	}
 	s.eventManager.Trigger(&newBackendObj, notification.EventFinalize, newObjEventAttr)
 	return newObj, nil
 }
 
+// previousObject retrieves the live version of an object that's about to be
+// overwritten, reporting whether there's one. The content of large objects
+// is only loaded when the object is going to be soft deleted.
+func (s *Server) previousObject(bucket backend.Bucket, bucketName, objectName string) (backend.Object, bool, error) {
+	streamingObj, err := s.backend.GetObjectStream(bucketName, objectName, 0)
+	if err != nil {
+		return backend.Object{}, false, nil
+	}
+	defer streamingObj.Content.Close()
+	obj := backend.Object{ObjectAttrs: streamingObj.ObjectAttrs}
+	if obj.Size <= maxInMemoryContentSize || (!bucket.VersioningEnabled && bucket.SoftDeletePolicy != nil) {
+		if obj.Content, err = io.ReadAll(streamingObj.Content); err != nil {
+			return backend.Object{}, false, err
+		}
+	}
+	return obj, true, nil
+}
+
 type ListOptions struct {
 	Prefix                   string
 	Delimiter                string
@@ -279,6 +452,12 @@ type ListOptions struct {
 	StartOffset              string
 	EndOffset                string
 	IncludeTrailingDelimiter bool
+	// MatchGlob filters the objects by a glob pattern, such as
+	// "**/*.parquet". See compileGlob for the syntax.
+	MatchGlob string
+	// SoftDeleted lists the soft-deleted objects instead of the live ones.
+	// See SetBucketSoftDeletePolicy.
+	SoftDeleted bool
 }
 
 // ListObjects returns a sorted list of objects that match the given criteria,
@@ -298,7 +477,21 @@ func (s *Server) ListObjectsWithOptions(bucketName string, options ListOptions)
 	if err != nil {
 		return nil, nil, err
 	}
+	var glob *regexp.Regexp
+	if options.MatchGlob != "" {
+		if glob, err = compileGlob(options.MatchGlob); err != nil {
+			return nil, nil, err
+		}
+	}
 	objects := fromBackendObjectsAttrs(backendObjects)
+	if options.SoftDeleted {
+		objects = nil
+		for _, obj := range s.softDeleted.list(bucketName) {
+			objects = append(objects, obj.ObjectAttrs)
+		}
+	} else if !options.Versions {
+		objects = s.listingConsistency.apply(bucketName, objects)
+	}
 	olist := objectAttrsList(objects)
 	sort.Sort(&olist)
 	var respObjects []ObjectAttrs
@@ -307,13 +500,23 @@ func (s *Server) ListObjectsWithOptions(bucketName string, options ListOptions)
 		if !strings.HasPrefix(obj.Name, options.Prefix) {
 			continue
 		}
-		objName := strings.Replace(obj.Name, options.Prefix, "", 1)
+		if glob != nil && !glob.MatchString(obj.Name) {
+			continue
+		}
+		// objects with the delimiter after the prefix are collapsed into
+		// the prefix that ends at the first occurrence of the delimiter,
+		// which may be longer than one character.
+		objName := strings.TrimPrefix(obj.Name, options.Prefix)
 		delimPos := strings.Index(objName, options.Delimiter)
 		if options.Delimiter != "" && delimPos > -1 {
-			prefix := obj.Name[:len(options.Prefix)+delimPos+1]
-			if isInOffset(prefix, options.StartOffset, options.EndOffset) {
-				prefixes[prefix] = true
+			prefix := obj.Name[:len(options.Prefix)+delimPos+len(options.Delimiter)]
+			if !isInOffset(prefix, options.StartOffset, options.EndOffset) {
+				continue
 			}
+			prefixes[prefix] = true
+			// objects that end at the delimiter, the placeholders of
+			// "folders" created by the Cloud Console, are listed along
+			// with their prefix.
 			if options.IncludeTrailingDelimiter && obj.Name == prefix {
 				respObjects = append(respObjects, obj)
 			}
@@ -355,20 +558,29 @@ func toBackendObjects(objects []Object) []backend.Object {
 	for _, o := range objects {
 		backendObjects = append(backendObjects, backend.Object{
 			ObjectAttrs: backend.ObjectAttrs{
-				BucketName:      o.BucketName,
-				Name:            o.Name,
-				Size:            int64(len(o.Content)),
-				ContentType:     o.ContentType,
-				ContentEncoding: o.ContentEncoding,
-				Crc32c:          o.Crc32c,
-				Md5Hash:         o.Md5Hash,
-				Etag:            o.Etag,
-				ACL:             o.ACL,
-				Created:         getCurrentIfZero(o.Created).Format(timestampFormat),
-				Deleted:         o.Deleted.Format(timestampFormat),
-				Updated:         getCurrentIfZero(o.Updated).Format(timestampFormat),
-				Generation:      o.Generation,
-				Metadata:        o.Metadata,
+				BucketName:         o.BucketName,
+				Name:               o.Name,
+				Size:               int64(len(o.Content)),
+				ContentType:        o.ContentType,
+				ContentEncoding:    o.ContentEncoding,
+				CacheControl:       o.CacheControl,
+				ContentDisposition: o.ContentDisposition,
+				ContentLanguage:    o.ContentLanguage,
+				Crc32c:             o.Crc32c,
+				Md5Hash:            o.Md5Hash,
+				Etag:               o.Etag,
+				ACL:                o.ACL,
+				Created:            getCurrentIfZero(o.Created).Format(timestampFormat),
+				Deleted:            o.Deleted.Format(timestampFormat),
+				Updated:            getCurrentIfZero(o.Updated).Format(timestampFormat),
+				Generation:         o.Generation,
+				Metageneration:     o.Metageneration,
+				Metadata:           o.Metadata,
+				StorageClass:       o.StorageClass,
+				ComponentCount:     o.ComponentCount,
+				CustomerKeySHA256:  o.CustomerKeySHA256,
+				KMSKeyName:         o.KMSKeyName,
+				CustomTime:         o.CustomTime.Format(timestampFormat),
 			},
 			Content: o.Content,
 		})
@@ -381,20 +593,29 @@ func fromBackendObjects(objects []backend.Object) []Object {
 	for _, o := range objects {
 		backendObjects = append(backendObjects, Object{
 			ObjectAttrs: ObjectAttrs{
-				BucketName:      o.BucketName,
-				Name:            o.Name,
-				Size:            int64(len(o.Content)),
-				ContentType:     o.ContentType,
-				ContentEncoding: o.ContentEncoding,
-				Crc32c:          o.Crc32c,
-				Md5Hash:         o.Md5Hash,
-				Etag:            o.Etag,
-				ACL:             o.ACL,
-				Created:         convertTimeWithoutError(o.Created),
-				Deleted:         convertTimeWithoutError(o.Deleted),
-				Updated:         convertTimeWithoutError(o.Updated),
-				Generation:      o.Generation,
-				Metadata:        o.Metadata,
+				BucketName:         o.BucketName,
+				Name:               o.Name,
+				Size:               int64(len(o.Content)),
+				ContentType:        o.ContentType,
+				ContentEncoding:    o.ContentEncoding,
+				CacheControl:       o.CacheControl,
+				ContentDisposition: o.ContentDisposition,
+				ContentLanguage:    o.ContentLanguage,
+				Crc32c:             o.Crc32c,
+				Md5Hash:            o.Md5Hash,
+				Etag:               o.Etag,
+				ACL:                o.ACL,
+				Created:            convertTimeWithoutError(o.Created),
+				Deleted:            convertTimeWithoutError(o.Deleted),
+				Updated:            convertTimeWithoutError(o.Updated),
+				Generation:         o.Generation,
+				Metageneration:     o.Metageneration,
+				Metadata:           o.Metadata,
+				StorageClass:       o.StorageClass,
+				ComponentCount:     o.ComponentCount,
+				CustomerKeySHA256:  o.CustomerKeySHA256,
+				KMSKeyName:         o.KMSKeyName,
+				CustomTime:         convertTimeWithoutError(o.CustomTime),
 			},
 			Content: o.Content,
 		})
@@ -406,20 +627,29 @@ func fromBackendObjectsAttrs(objectAttrs []backend.ObjectAttrs) []ObjectAttrs {
 	oattrs := make([]ObjectAttrs, 0, len(objectAttrs))
 	for _, o := range objectAttrs {
 		oattrs = append(oattrs, ObjectAttrs{
-			BucketName:      o.BucketName,
-			Name:            o.Name,
-			Size:            o.Size,
-			ContentType:     o.ContentType,
-			ContentEncoding: o.ContentEncoding,
-			Crc32c:          o.Crc32c,
-			Md5Hash:         o.Md5Hash,
-			Etag:            o.Etag,
-			ACL:             o.ACL,
-			Created:         convertTimeWithoutError(o.Created),
-			Deleted:         convertTimeWithoutError(o.Deleted),
-			Updated:         convertTimeWithoutError(o.Updated),
-			Generation:      o.Generation,
-			Metadata:        o.Metadata,
+			BucketName:         o.BucketName,
+			Name:               o.Name,
+			Size:               o.Size,
+			ContentType:        o.ContentType,
+			ContentEncoding:    o.ContentEncoding,
+			CacheControl:       o.CacheControl,
+			ContentDisposition: o.ContentDisposition,
+			ContentLanguage:    o.ContentLanguage,
+			Crc32c:             o.Crc32c,
+			Md5Hash:            o.Md5Hash,
+			Etag:               o.Etag,
+			ACL:                o.ACL,
+			Created:            convertTimeWithoutError(o.Created),
+			Deleted:            convertTimeWithoutError(o.Deleted),
+			Updated:            convertTimeWithoutError(o.Updated),
+			Generation:         o.Generation,
+			Metageneration:     o.Metageneration,
+			Metadata:           o.Metadata,
+			StorageClass:       o.StorageClass,
+			ComponentCount:     o.ComponentCount,
+			CustomerKeySHA256:  o.CustomerKeySHA256,
+			KMSKeyName:         o.KMSKeyName,
+			CustomTime:         convertTimeWithoutError(o.CustomTime),
 		})
 	}
 	return oattrs
@@ -454,6 +684,41 @@ func (s *Server) GetObjectWithGeneration(bucketName, objectName string, generati
 	return obj, nil
 }
 
+// ObjectVersions returns all the generations of the given object, sorted from
+// the oldest to the newest, or an error if the bucket doesn't exist.
+//
+// Noncurrent generations, kept when versioning is enabled, have the Deleted
+// field set.
+func (s *Server) ObjectVersions(bucketName, objectName string) ([]ObjectAttrs, error) {
+	backendObjects, err := s.backend.ListObjects(bucketName, objectName, true)
+	if err != nil {
+		return nil, err
+	}
+	var versions []ObjectAttrs
+	for _, obj := range fromBackendObjectsAttrs(backendObjects) {
+		if obj.Name == objectName {
+			versions = append(versions, obj)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Generation < versions[j].Generation
+	})
+	return versions, nil
+}
+
+// objectStreamWithGenerationOnValidGeneration is like
+// objectWithGenerationOnValidGeneration, but it doesn't load the content of
+// the object.
+func (s *Server) objectStreamWithGenerationOnValidGeneration(bucketName, objectName, generationStr string) (backend.StreamingObject, error) {
+	generation, err := strconv.ParseInt(generationStr, 10, 64)
+	if err != nil && generationStr != "" {
+		return backend.StreamingObject{}, errInvalidGeneration
+	} else if generation < 0 {
+		generation = 0
+	}
+	return s.backend.GetObjectStream(bucketName, objectName, generation)
+}
+
 func (s *Server) objectWithGenerationOnValidGeneration(bucketName, objectName, generationStr string) (Object, error) {
 	generation, err := strconv.ParseInt(generationStr, 10, 64)
 	if err != nil && generationStr != "" {
@@ -466,6 +731,15 @@ func (s *Server) objectWithGenerationOnValidGeneration(bucketName, objectName, g
 
 func (s *Server) listObjects(r *http.Request) jsonResponse {
 	bucketName := mux.Vars(r)["bucketName"]
+	softDeleted := r.URL.Query().Get("softDeleted") == "true"
+	if softDeleted && r.URL.Query().Get("versions") == "true" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "The versions and softDeleted parameters can't be combined."}
+	}
+	// the fake server has no folder resources, so the prefixes of the
+	// objects are the only folders listed with includeFoldersAsPrefixes.
+	if r.URL.Query().Get("includeFoldersAsPrefixes") == "true" && r.URL.Query().Get("delimiter") != "/" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "includeFoldersAsPrefixes is only supported with the delimiter '/'."}
+	}
 	objs, prefixes, err := s.ListObjectsWithOptions(bucketName, ListOptions{
 		Prefix:                   r.URL.Query().Get("prefix"),
 		Delimiter:                r.URL.Query().Get("delimiter"),
@@ -473,14 +747,133 @@ func (s *Server) listObjects(r *http.Request) jsonResponse {
 		StartOffset:              r.URL.Query().Get("startOffset"),
 		EndOffset:                r.URL.Query().Get("endOffset"),
 		IncludeTrailingDelimiter: r.URL.Query().Get("includeTrailingDelimiter") == "true",
+		MatchGlob:                r.URL.Query().Get("matchGlob"),
+		SoftDeleted:              softDeleted,
 	})
+	if errors.Is(err, errInvalidGlob) {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid matchGlob: " + r.URL.Query().Get("matchGlob")}
+	}
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	maxResults := defaultMaxListResults
+	if value := r.URL.Query().Get("maxResults"); value != "" {
+		maxResults, err = strconv.Atoi(value)
+		if err != nil || maxResults < 0 {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid value for maxResults: " + value}
+		}
+		if maxResults == 0 || maxResults > defaultMaxListResults {
+			maxResults = defaultMaxListResults
+		}
+	}
+	objs, prefixes, nextPageToken, err := paginateObjects(objs, prefixes, r.URL.Query().Get("pageToken"), maxResults)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	resp := newListObjectsResponse(objs, prefixes)
+	resp.NextPageToken = nextPageToken
+	return jsonResponse{data: resp}
+}
+
+// defaultMaxListResults is the maximum number of items and prefixes in a page
+// of the object listing, used when the request doesn't set maxResults.
+const defaultMaxListResults = 1000
+
+// listEntry is an object or a prefix in a page of the object listing. Prefixes
+// have no generation, so they come before the objects with the same name.
+type listEntry struct {
+	name       string
+	generation int64
+	obj        *ObjectAttrs
+}
+
+func (e listEntry) less(other listEntry) bool {
+	if e.name == other.name {
+		return e.generation < other.generation
+	}
+	return e.name < other.name
+}
+
+// paginateObjects returns the page of the object listing that starts after
+// the entry encoded in pageToken, along with the token of the next page, if
+// any. As in Cloud Storage, objects and prefixes are listed in lexicographic
+// order and both count towards maxResults. The page token encodes the last
+// entry of the page, so pages stay stable when objects are created or
+// deleted between requests.
+func paginateObjects(objs []ObjectAttrs, prefixes []string, pageToken string, maxResults int) ([]ObjectAttrs, []string, string, error) {
+	entries := make([]listEntry, 0, len(objs)+len(prefixes))
+	for i := range objs {
+		entries = append(entries, listEntry{name: objs[i].Name, generation: objs[i].Generation, obj: &objs[i]})
+	}
+	for _, prefix := range prefixes {
+		entries = append(entries, listEntry{name: prefix})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].less(entries[j])
+	})
+
+	if pageToken != "" {
+		last, err := decodePageToken(pageToken)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		start := sort.Search(len(entries), func(i int) bool {
+			return last.less(entries[i])
+		})
+		entries = entries[start:]
+	}
+	var nextPageToken string
+	if len(entries) > maxResults {
+		entries = entries[:maxResults]
+		nextPageToken = encodePageToken(entries[maxResults-1])
+	}
+
+	pageObjs := []ObjectAttrs{}
+	pagePrefixes := []string{}
+	for _, entry := range entries {
+		if entry.obj != nil {
+			pageObjs = append(pageObjs, *entry.obj)
+		} else {
+			pagePrefixes = append(pagePrefixes, entry.name)
+		}
+	}
+	return pageObjs, pagePrefixes, nextPageToken, nil
+}
+
+func encodePageToken(entry listEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(entry.generation, 10) + ":" + entry.name))
+}
+
+func decodePageToken(pageToken string) (listEntry, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return listEntry{}, errInvalidPageToken
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return listEntry{}, errInvalidPageToken
+	}
+	generation, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
+		return listEntry{}, errInvalidPageToken
+	}
+	return listEntry{name: parts[1], generation: generation}, nil
+}
+
+func (s *Server) listObjectVersions(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	versions, err := s.ObjectVersions(vars["bucketName"], vars["objectName"])
+	if err != nil || len(versions) == 0 {
 		return jsonResponse{status: http.StatusNotFound}
 	}
-	return jsonResponse{data: newListObjectsResponse(objs, prefixes)}
+	return jsonResponse{data: newListObjectsResponse(versions, nil)}
 }
 
 func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("softDeleted") == "true" {
+		jsonToHTTPHandler(s.getSoftDeletedObject)(w, r)
+		return
+	}
 	if alt := r.URL.Query().Get("alt"); alt == "media" || r.Method == http.MethodHead {
 		s.downloadObject(w, r)
 		return
@@ -502,6 +895,13 @@ func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
 				errorMessage: errMessage,
 			}
 		}
+		conds, errResp := parseObjectPreconditions(r, false)
+		if errResp != nil {
+			return *errResp
+		}
+		if errResp := conds.check(&obj.ObjectAttrs, true); errResp != nil {
+			return *errResp
+		}
 		header := make(http.Header)
 		header.Set("Accept-Ranges", "bytes")
 		return jsonResponse{
@@ -515,8 +915,27 @@ func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) deleteObject(r *http.Request) jsonResponse {
 	vars := mux.Vars(r)
-	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
-	if err == nil {
+	generation := r.FormValue("generation")
+	obj, err := s.objectWithGenerationOnValidGeneration(vars["bucketName"], vars["objectName"], generation)
+	if errors.Is(err, errInvalidGeneration) {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	conds, errResp := parseObjectPreconditions(r, false)
+	if errResp != nil {
+		return *errResp
+	}
+	if errResp := conds.check(&obj.ObjectAttrs, false); errResp != nil {
+		return *errResp
+	}
+	if err := s.checkRetention(obj.ObjectAttrs); err != nil {
+		return errToJsonResponse(err)
+	}
+	if generation != "" {
+		err = s.backend.DeleteObjectGeneration(vars["bucketName"], vars["objectName"], obj.Generation)
+	} else {
 		err = s.backend.DeleteObject(vars["bucketName"], vars["objectName"])
 	}
 	if err != nil {
@@ -524,9 +943,15 @@ func (s *Server) deleteObject(r *http.Request) jsonResponse {
 	}
 	bucket, _ := s.backend.GetBucket(obj.BucketName)
 	backendObj := toBackendObjects([]Object{obj})[0]
-	if bucket.VersioningEnabled {
+	// deleting the live version archives it when versioning is enabled,
+	// while noncurrent versions are deleted permanently.
+	if obj.Deleted.IsZero() {
+		s.listingConsistency.record(obj.BucketName, obj.Name, &obj.ObjectAttrs)
+	}
+	if bucket.VersioningEnabled && obj.Deleted.IsZero() {
 		s.eventManager.Trigger(&backendObj, notification.EventArchive, nil)
 	} else {
+		s.softDelete(obj)
 		s.eventManager.Trigger(&backendObj, notification.EventDelete, nil)
 	}
 	return jsonResponse{}
@@ -543,6 +968,23 @@ func (s *Server) listObjectACL(r *http.Request) jsonResponse {
 	return jsonResponse{data: newACLListResponse(obj.ObjectAttrs)}
 }
 
+func (s *Server) getObjectACLRule(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+
+	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	item := findAccessControl(obj.ObjectAttrs, storage.ACLEntity(vars["entity"]))
+	if item == nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	return jsonResponse{data: item}
+}
+
+// setObjectACL handles inserts, patches and updates of object ACL rules.
+// Inserts and updates replace the rule for the entity, if there's one, while
+// patches require the rule to exist.
 func (s *Server) setObjectACL(r *http.Request) jsonResponse {
 	vars := mux.Vars(r)
 
@@ -564,22 +1006,178 @@ func (s *Server) setObjectACL(r *http.Request) jsonResponse {
 		}
 	}
 
-	entity := storage.ACLEntity(data.Entity)
+	entity := storage.ACLEntity(vars["entity"])
+	if entity == "" {
+		entity = storage.ACLEntity(data.Entity)
+	}
 	role := storage.ACLRole(data.Role)
-	obj.ACL = []storage.ACLRule{{
-		Entity: entity,
-		Role:   role,
-	}}
+	if entity == "" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Required field: entity"}
+	}
+	if !validObjectACLRole(role) {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid role: " + data.Role}
+	}
+	acl, found := setACLRole(obj.ACL, entity, role)
+	if !found && r.Method == http.MethodPatch {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	obj.ACL = acl
 
-	_, err = s.createObject(obj)
+	obj, err = s.updateObjectMetadata(obj)
 	if err != nil {
 		return errToJsonResponse(err)
 	}
 
-	return jsonResponse{data: newACLListResponse(obj.ObjectAttrs)}
+	return jsonResponse{data: findAccessControl(obj.ObjectAttrs, entity)}
+}
+
+func (s *Server) deleteObjectACLRule(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+
+	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	acl, found := removeACLRule(obj.ACL, storage.ACLEntity(vars["entity"]))
+	if !found {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	obj.ACL = acl
+	if _, err := s.updateObjectMetadata(obj); err != nil {
+		return errToJsonResponse(err)
+	}
+	return jsonResponse{}
 }
 
+func validObjectACLRole(role storage.ACLRole) bool {
+	return role == storage.RoleOwner || role == storage.RoleReader
+}
+
+// setACLRole returns a copy of the ACL granting the role to the entity, and
+// whether the ACL already had a rule for the entity.
+func setACLRole(acl []storage.ACLRule, entity storage.ACLEntity, role storage.ACLRole) ([]storage.ACLRule, bool) {
+	updated := make([]storage.ACLRule, 0, len(acl)+1)
+	found := false
+	for _, rule := range acl {
+		if rule.Entity == entity {
+			rule.Role = role
+			found = true
+		}
+		updated = append(updated, rule)
+	}
+	if !found {
+		updated = append(updated, storage.ACLRule{Entity: entity, Role: role})
+	}
+	return updated, found
+}
+
+// removeACLRule returns a copy of the ACL without the rule for the entity,
+// and whether the ACL had a rule for the entity.
+func removeACLRule(acl []storage.ACLRule, entity storage.ACLEntity) ([]storage.ACLRule, bool) {
+	var updated []storage.ACLRule
+	for _, rule := range acl {
+		if rule.Entity != entity {
+			updated = append(updated, rule)
+		}
+	}
+	return updated, len(updated) != len(acl)
+}
+
+func (s *Server) copyObject(r *http.Request) jsonResponse {
+	obj, errResp := s.prepareCopy(r)
+	if errResp != nil {
+		return *errResp
+	}
+	conds, _ := parseObjectPreconditions(r, false)
+	obj, err := s.createObjectIf(obj, nil, conds)
+	if err != nil {
+		return errToJsonResponse(err)
+	}
+	return jsonResponse{data: newObjectResponse(obj.ObjectAttrs)}
+}
+
+// rewriteState tracks a rewrite that takes multiple calls to complete.
+type rewriteState struct {
+	vars      map[string]string
+	obj       Object
+	rewritten int64
+}
+
+// rewriteObject copies the source object to the destination. When a chunk size
+// is set, through Options.RewriteChunkSize or the maxBytesRewrittenPerCall
+// parameter, larger objects are rewritten in multiple calls: each call returns
+// a rewrite token to be sent in the next one, and the object is created once
+// all of its bytes are rewritten.
 func (s *Server) rewriteObject(r *http.Request) jsonResponse {
+	chunkSize := s.options.RewriteChunkSize
+	if value := r.URL.Query().Get("maxBytesRewrittenPerCall"); value != "" {
+		var err error
+		chunkSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || chunkSize <= 0 {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid maxBytesRewrittenPerCall."}
+		}
+	}
+
+	vars := mux.Vars(r)
+	var state rewriteState
+	token := r.URL.Query().Get("rewriteToken")
+	if token != "" {
+		rawState, ok := s.rewrites.Load(token)
+		if !ok {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid rewrite token."}
+		}
+		state = rawState.(rewriteState)
+		for _, key := range []string{"sourceBucket", "sourceObject", "destinationBucket", "destinationObject"} {
+			if state.vars[key] != vars[key] {
+				return jsonResponse{status: http.StatusBadRequest, errorMessage: "The rewrite token doesn't match the request."}
+			}
+		}
+	} else {
+		obj, errResp := s.prepareCopy(r)
+		if errResp != nil {
+			return *errResp
+		}
+		state = rewriteState{vars: vars, obj: obj}
+	}
+
+	size := int64(len(state.obj.Content))
+	state.rewritten += chunkSize
+	if chunkSize <= 0 || state.rewritten > size {
+		state.rewritten = size
+	}
+	if state.rewritten < size {
+		if token == "" {
+			var err error
+			token, err = generateUploadID()
+			if err != nil {
+				return jsonResponse{errorMessage: err.Error()}
+			}
+		}
+		s.rewrites.Store(token, state)
+		return jsonResponse{data: rewriteResponse{
+			Kind:                "storage#rewriteResponse",
+			TotalBytesRewritten: state.rewritten,
+			ObjectSize:          size,
+			RewriteToken:        token,
+		}}
+	}
+	if token != "" {
+		s.rewrites.Delete(token)
+	}
+
+	conds, _ := parseObjectPreconditions(r, false)
+	obj, err := s.createObjectIf(state.obj, nil, conds)
+	if err != nil {
+		return errToJsonResponse(err)
+	}
+	return jsonResponse{data: newObjectRewriteResponse(obj.ObjectAttrs)}
+}
+
+// prepareCopy returns the object to be created by a copy or rewrite request.
+//
+// The metadata of the new object is taken from the request body, falling back
+// to the metadata of the source object for the fields that aren't supplied.
+func (s *Server) prepareCopy(r *http.Request) (Object, *jsonResponse) {
 	vars := mux.Vars(r)
 	obj, err := s.objectWithGenerationOnValidGeneration(vars["sourceBucket"], vars["sourceObject"], r.FormValue("sourceGeneration"))
 	if err != nil {
@@ -589,13 +1187,23 @@ func (s *Server) rewriteObject(r *http.Request) jsonResponse {
 			statusCode = http.StatusBadRequest
 			errMessage = err.Error()
 		}
-		return jsonResponse{errorMessage: errMessage, status: statusCode}
+		return Object{}, &jsonResponse{errorMessage: errMessage, status: statusCode}
+	}
+	sourceConds, errResp := parseObjectPreconditions(r, true)
+	if errResp != nil {
+		return Object{}, errResp
+	}
+	if errResp := sourceConds.check(&obj.ObjectAttrs, false); errResp != nil {
+		return Object{}, errResp
+	}
+	if errResp := checkCustomerKey(r, copySourceEncryptionPrefix, obj.ObjectAttrs); errResp != nil {
+		return Object{}, errResp
 	}
 
 	var metadata multipartMetadata
 	err = json.NewDecoder(r.Body).Decode(&metadata)
 	if err != nil && err != io.EOF { // The body is optional
-		return jsonResponse{errorMessage: "Invalid metadata", status: http.StatusBadRequest}
+		return Object{}, &jsonResponse{errorMessage: "Invalid metadata", status: http.StatusBadRequest}
 	}
 
 	// Only supplied metadata overwrites the new object's metdata
@@ -608,34 +1216,73 @@ func (s *Server) rewriteObject(r *http.Request) jsonResponse {
 	if metadata.ContentEncoding == "" {
 		metadata.ContentEncoding = obj.ContentEncoding
 	}
+	if metadata.CacheControl == "" {
+		metadata.CacheControl = obj.CacheControl
+	}
+	if metadata.ContentDisposition == "" {
+		metadata.ContentDisposition = obj.ContentDisposition
+	}
+	if metadata.ContentLanguage == "" {
+		metadata.ContentLanguage = obj.ContentLanguage
+	}
+	if metadata.CustomTime.IsZero() {
+		metadata.CustomTime = obj.CustomTime
+	}
 
 	dstBucket := vars["destinationBucket"]
+	if _, err := s.backend.GetBucket(dstBucket); err != nil {
+		return Object{}, &jsonResponse{status: http.StatusNotFound, errorMessage: "Destination bucket not found."}
+	}
+	if _, errResp := s.checkObjectPreconditions(r, dstBucket, vars["destinationObject"]); errResp != nil {
+		return Object{}, errResp
+	}
+	keySHA256, kmsKeyName, errResp := s.objectEncryption(r, dstBucket, r.URL.Query().Get("destinationKmsKeyName"))
+	if errResp != nil {
+		return Object{}, errResp
+	}
 	newObject := Object{
 		ObjectAttrs: ObjectAttrs{
-			BucketName:      dstBucket,
-			Name:            vars["destinationObject"],
-			Size:            int64(len(obj.Content)),
-			Crc32c:          obj.Crc32c,
-			Md5Hash:         obj.Md5Hash,
-			ACL:             obj.ACL,
-			ContentType:     metadata.ContentType,
-			ContentEncoding: metadata.ContentEncoding,
-			Metadata:        metadata.Metadata,
+			BucketName:         dstBucket,
+			Name:               vars["destinationObject"],
+			Size:               int64(len(obj.Content)),
+			Crc32c:             obj.Crc32c,
+			Md5Hash:            obj.Md5Hash,
+			Etag:               obj.Etag,
+			ACL:                obj.ACL,
+			ContentType:        metadata.ContentType,
+			ContentEncoding:    metadata.ContentEncoding,
+			CacheControl:       metadata.CacheControl,
+			ContentDisposition: metadata.ContentDisposition,
+			ContentLanguage:    metadata.ContentLanguage,
+			Metadata:           metadata.Metadata,
+			StorageClass:       metadata.StorageClass,
+			ComponentCount:     obj.ComponentCount,
+			CustomerKeySHA256:  keySHA256,
+			KMSKeyName:         kmsKeyName,
+			CustomTime:         metadata.CustomTime,
 		},
 		Content: append([]byte(nil), obj.Content...),
 	}
 
-	_, err = s.createObject(newObject)
-	if err != nil {
-		return errToJsonResponse(err)
-	}
+	return newObject, nil
+}
 
-	return jsonResponse{data: newObjectRewriteResponse(newObject.ObjectAttrs)}
+// setGenerationHeaders sets the headers with which the XML API reports the
+// generation and metageneration of an object.
+func setGenerationHeaders(header http.Header, obj ObjectAttrs) {
+	header.Set("X-Goog-Generation", strconv.FormatInt(obj.Generation, 10))
+	header.Set("X-Goog-Metageneration", strconv.FormatInt(obj.Metageneration, 10))
 }
 
 func (s *Server) downloadObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	obj, err := s.objectWithGenerationOnValidGeneration(vars["bucketName"], vars["objectName"], r.FormValue("generation"))
+	if isXMLAPIRequest(r) && isV2SignedURL(r) {
+		if errResp := s.verifyV2SignedURL(r); errResp != nil {
+			writeXMLErrorWithCode(w, errResp.status, errResp.errorReason, errResp.errorMessage)
+			return
+		}
+	}
+	streamingObj, err := s.objectStreamWithGenerationOnValidGeneration(vars["bucketName"], vars["objectName"], r.FormValue("generation"))
 	if err != nil {
 		statusCode := http.StatusNotFound
 		message := http.StatusText(statusCode)
@@ -643,109 +1290,368 @@ func (s *Server) downloadObject(w http.ResponseWriter, r *http.Request) {
 			statusCode = http.StatusBadRequest
 			message = err.Error()
 		}
-		http.Error(w, message, statusCode)
+		if isXMLAPIRequest(r) {
+			if statusCode != http.StatusNotFound {
+				writeXMLError(w, statusCode, message)
+			} else if _, err := s.backend.GetBucket(vars["bucketName"]); err != nil {
+				writeXMLErrorWithCode(w, statusCode, "NoSuchBucket", fmt.Sprintf("No such bucket: %s", vars["bucketName"]))
+			} else {
+				writeXMLError(w, statusCode, fmt.Sprintf("No such object: %s/%s", vars["bucketName"], vars["objectName"]))
+			}
+			return
+		}
+		writeJSONError(w, r, jsonResponse{status: statusCode, errorMessage: message})
+		return
+	}
+	defer streamingObj.Content.Close()
+	obj := Object{ObjectAttrs: fromBackendObjectsAttrs([]backend.ObjectAttrs{streamingObj.ObjectAttrs})[0]}
+
+	if s.options.EnforceObjectACL && isAnonymousRequest(r) && !s.isPubliclyReadable(obj.ObjectAttrs) {
+		message := "Anonymous caller does not have storage.objects.get access to the Google Cloud Storage object."
+		if isXMLAPIRequest(r) {
+			writeXMLErrorWithCode(w, http.StatusForbidden, "AccessDenied", message)
+			return
+		}
+		writeJSONError(w, r, jsonResponse{status: http.StatusForbidden, errorMessage: message})
+		return
+	}
+
+	if errResp := checkCustomerKey(r, encryptionHeaderPrefix, obj.ObjectAttrs); errResp != nil {
+		if isXMLAPIRequest(r) {
+			writeXMLError(w, errResp.status, errResp.errorMessage)
+			return
+		}
+		writeJSONError(w, r, *errResp)
+		return
+	}
+
+	etag := objectETag(obj)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", obj.Updated.UTC().Format(http.TimeFormat))
+	conds, errResp := parseObjectPreconditions(r, false)
+	if errResp == nil {
+		errResp = conds.check(&obj.ObjectAttrs, true)
+	}
+	if errResp == nil {
+		errResp = checkConditionalHeaders(r, etag, obj.Updated)
+	}
+	if errResp != nil {
+		if errResp.status == http.StatusNotModified {
+			w.WriteHeader(errResp.status)
+		} else if isXMLAPIRequest(r) {
+			writeXMLError(w, errResp.status, errResp.errorMessage)
+		} else {
+			writeJSONError(w, r, *errResp)
+		}
+		return
+	}
+
+	if !s.waitReadLatency(r, obj.BucketName) {
+		return
+	}
+
+	// the content is streamed from the backend, unless it has to be
+	// transcoded, split into multiple ranges or checksummed.
+	_, corruptChecksums := s.faults.find(FaultChecksumMismatch, r, obj.BucketName, obj.Name)
+	var reader io.ReadSeeker = streamingObj.Content
+	if obj.ContentEncoding == "gzip" || corruptChecksums || strings.Contains(r.Header.Get("Range"), ",") {
+		if obj.Content, err = io.ReadAll(streamingObj.Content); err != nil {
+			writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		reader = bytes.NewReader(obj.Content)
+	}
+
+	var body io.Reader = reader
+	contentLength := obj.Size
+	contentEncoding := obj.ContentEncoding
+	var ranges []byteRange
+	if decompressed, ok := decompressiveTranscoding(obj, r); ok {
+		// as in Cloud Storage, the Range header is ignored when the
+		// content is transcoded.
+		body = bytes.NewReader(decompressed)
+		contentLength = int64(len(decompressed))
+		contentEncoding = ""
+	} else if ranges, err = parseRange(r.Header.Get("Range"), obj.Size); err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", obj.Size))
+		if isXMLAPIRequest(r) {
+			writeXMLError(w, http.StatusRequestedRangeNotSatisfiable, "The requested range cannot be satisfied.")
+			return
+		}
+		writeJSONError(w, r, jsonResponse{status: http.StatusRequestedRangeNotSatisfiable, errorMessage: "The requested range cannot be satisfied."})
 		return
 	}
 
 	status := http.StatusOK
-	ranged, start, lastByte, content := s.handleRange(obj, r)
-	if ranged {
+	contentType := obj.ContentType
+	switch len(ranges) {
+	case 0:
+	case 1:
 		status = http.StatusPartialContent
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, lastByte, len(obj.Content)))
+		w.Header().Set("Content-Range", ranges[0].contentRange(int(obj.Size)))
+		if _, err := reader.Seek(ranges[0].start, io.SeekStart); err != nil {
+			writeAPIError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		contentLength = ranges[0].end - ranges[0].start + 1
+		body = io.LimitReader(reader, contentLength)
+	default:
+		status = http.StatusPartialContent
+		var content []byte
+		content, contentType = multipartByteRanges(obj, ranges)
+		body = bytes.NewReader(content)
+		contentLength = int64(len(content))
 	}
-	if obj.ContentType != "" {
-		w.Header().Set(contentTypeHeader, obj.ContentType)
+	if contentType != "" {
+		w.Header().Set(contentTypeHeader, contentType)
 	}
 	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
-	w.Header().Set("X-Goog-Generation", strconv.FormatInt(obj.Generation, 10))
-	w.Header().Set("X-Goog-Hash", fmt.Sprintf("crc32c=%s,md5=%s", obj.Crc32c, obj.Md5Hash))
-	w.Header().Set("Last-Modified", obj.Updated.Format(http.TimeFormat))
-	if obj.ContentEncoding != "" {
-		w.Header().Set("Content-Encoding", obj.ContentEncoding)
+	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	setGenerationHeaders(w.Header(), obj.ObjectAttrs)
+	if obj.StorageClass != "" {
+		w.Header().Set("X-Goog-Storage-Class", obj.StorageClass)
+	}
+	crc32c, md5Hash := obj.Crc32c, obj.Md5Hash
+	if corruptChecksums {
+		crc32c, md5Hash = corruptedChecksums(obj.Content)
+	}
+	w.Header().Add("X-Goog-Hash", "crc32c="+crc32c)
+	w.Header().Add("X-Goog-Hash", "md5="+md5Hash)
+	if obj.ContentEncoding == "gzip" {
+		w.Header().Set("X-Goog-Stored-Content-Encoding", obj.ContentEncoding)
+		w.Header().Set("X-Goog-Stored-Content-Length", strconv.FormatInt(obj.Size, 10))
+		if contentEncoding != "" && !acceptsGzip(r) {
+			w.Header().Set("Warning", "214 UploadServer gzipped")
+		}
+	}
+	if contentEncoding != "" {
+		w.Header().Set("Content-Encoding", contentEncoding)
+	}
+	for header, value := range map[string]string{
+		"Cache-Control":       obj.CacheControl,
+		"Content-Disposition": obj.ContentDisposition,
+		"Content-Language":    obj.ContentLanguage,
+	} {
+		if value != "" {
+			w.Header().Set(header, value)
+		}
 	}
 	w.WriteHeader(status)
 	if r.Method == http.MethodGet {
-		w.Write(content)
-	}
-}
-
-func (s *Server) handleRange(obj Object, r *http.Request) (ranged bool, start int64, lastByte int64, content []byte) {
-	if reqRange := r.Header.Get("Range"); reqRange != "" {
-		parts := strings.SplitN(reqRange, "=", 2)
-		if len(parts) == 2 && parts[0] == "bytes" {
-			rangeParts := strings.SplitN(parts[1], "-", 2)
-			if len(rangeParts) == 2 {
-				start, _ = strconv.ParseInt(rangeParts[0], 10, 64)
-				var err error
-				var end int64
-				if end, err = strconv.ParseInt(rangeParts[1], 10, 64); err != nil {
-					end = int64(len(obj.Content))
-				} else if end != math.MaxInt64 {
-					end++
-				}
-				if end > int64(len(obj.Content)) {
-					end = int64(len(obj.Content))
-				}
-				return true, start, end - 1, obj.Content[start:end]
-			}
+		io.Copy(w, body)
+	}
+}
+
+// isAnonymousRequest reports whether the request was sent without
+// credentials: without an Authorization header and not through a signed URL.
+func isAnonymousRequest(r *http.Request) bool {
+	query := r.URL.Query()
+	return r.Header.Get("Authorization") == "" && query.Get("Signature") == "" && query.Get("X-Goog-Signature") == ""
+}
+
+// isACLPublicRead reports whether the ACL allows anyone to read the object.
+func isACLPublicRead(acl []storage.ACLRule) bool {
+	for _, rule := range acl {
+		if rule.Entity == storage.AllUsers && validObjectACLRole(rule.Role) {
+			return true
 		}
 	}
-	return false, 0, 0, obj.Content
+	return false
 }
 
+// isXMLAPIRequest reports whether r was routed through the XML API, as
+// opposed to the JSON API download endpoints that also serve object content.
+func isXMLAPIRequest(r *http.Request) bool {
+	return !strings.HasPrefix(r.URL.Path, "/download/storage/v1/") && !strings.HasPrefix(r.URL.Path, "/storage/v1/")
+}
+
+// writeAPIError writes an error in the format of the API the request was sent
+// to.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if isXMLAPIRequest(r) && !strings.HasPrefix(r.URL.Path, "/upload/") {
+		writeXMLError(w, status, message)
+		return
+	}
+	writeJSONError(w, r, jsonResponse{status: status, errorMessage: message})
+}
+
+// patchObject updates the metadata of an object with the fields sent in the
+// request, leaving the other fields unchanged. Fields sent as null are
+// cleared, as are keys of the custom metadata with null values.
 func (s *Server) patchObject(r *http.Request) jsonResponse {
+	return s.changeObjectMetadata(r, false)
+}
+
+// updateObject replaces the metadata of an object, clearing the fields that
+// aren't sent in the request.
+func (s *Server) updateObject(r *http.Request) jsonResponse {
+	return s.changeObjectMetadata(r, true)
+}
+
+func (s *Server) changeObjectMetadata(r *http.Request, replace bool) jsonResponse {
 	vars := mux.Vars(r)
-	bucketName := vars["bucketName"]
-	objectName := vars["objectName"]
-	var metadata struct {
-		Metadata map[string]string `json:"metadata"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&metadata)
-	if err != nil {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
 		return jsonResponse{
 			status:       http.StatusBadRequest,
 			errorMessage: "Metadata in the request couldn't decode",
 		}
 	}
-	backendObj, err := s.backend.PatchObject(bucketName, objectName, metadata.Metadata)
+	obj, err := s.objectWithGenerationOnValidGeneration(vars["bucketName"], vars["objectName"], r.URL.Query().Get("generation"))
 	if err != nil {
-		return jsonResponse{
-			status:       http.StatusNotFound,
-			errorMessage: "Object not found to be PATCHed",
+		if errors.Is(err, errInvalidGeneration) {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
 		}
+		return jsonResponse{status: http.StatusNotFound, errorMessage: "Object not found"}
+	}
+	conds, errResp := parseObjectPreconditions(r, false)
+	if errResp != nil {
+		return *errResp
+	}
+	if errResp := conds.check(&obj.ObjectAttrs, false); errResp != nil {
+		return *errResp
+	}
+	if errResp := s.applyObjectMetadata(&obj.ObjectAttrs, fields, replace); errResp != nil {
+		return *errResp
+	}
+	obj, err = s.updateObjectMetadataIf(obj, conds)
+	if err != nil {
+		return errToJsonResponse(err)
+	}
+	return jsonResponse{data: newObjectResponse(obj.ObjectAttrs)}
+}
+
+// updateObjectMetadata stores the changed metadata of the object, keeping
+// its generation and incrementing its metageneration.
+func (s *Server) updateObjectMetadata(obj Object) (Object, error) {
+	return s.updateObjectMetadataIf(obj, objectPreconditions{})
+}
+
+// updateObjectMetadataIf is like updateObjectMetadata, with the
+// preconditions of the request enforced by the backend against the version
+// being updated.
+func (s *Server) updateObjectMetadataIf(obj Object, conds objectPreconditions) (Object, error) {
+	if err := s.checkPublicAccessPrevention(obj.BucketName, obj.ACL); err != nil {
+		return Object{}, err
 	}
+	if err := s.writeRates.take(obj.BucketName, obj.Name); err != nil {
+		return Object{}, err
+	}
+	if obj.Metageneration == 0 {
+		obj.Metageneration = 1
+	}
+	obj.Metageneration++
+	obj.Updated = time.Now()
 
+	backendObj := toBackendObjects([]Object{obj})[0]
+	if err := s.backend.UpdateObjectAttrsIf(obj.BucketName, obj.Name, obj.Generation, backendObj.ObjectAttrs, conds.toBackend()); err != nil {
+		return Object{}, err
+	}
 	s.eventManager.Trigger(&backendObj, notification.EventMetadata, nil)
-	return jsonResponse{data: fromBackendObjects([]backend.Object{backendObj})[0]}
+	return obj, nil
 }
 
-func (s *Server) updateObject(r *http.Request) jsonResponse {
-	vars := mux.Vars(r)
-	bucketName := vars["bucketName"]
-	objectName := vars["objectName"]
-	var metadata struct {
-		Metadata map[string]string `json:"metadata"`
+// applyObjectMetadata changes the writable fields of the object with the
+// fields of an objects.patch or objects.update request. When replace is
+// true, the fields that aren't in the request are cleared. The custom time
+// can't be removed or moved backwards.
+func (s *Server) applyObjectMetadata(obj *ObjectAttrs, fields map[string]json.RawMessage, replace bool) *jsonResponse {
+	invalid := func(field string) *jsonResponse {
+		return &jsonResponse{status: http.StatusBadRequest, errorReason: "invalid", errorMessage: "Invalid value for " + field}
 	}
-	err := json.NewDecoder(r.Body).Decode(&metadata)
-	if err != nil {
-		return jsonResponse{
-			status:       http.StatusBadRequest,
-			errorMessage: "Metadata in the request couldn't decode",
+	isNull := func(raw json.RawMessage) bool {
+		return string(raw) == "null"
+	}
+
+	for name, value := range map[string]*string{
+		"contentType":        &obj.ContentType,
+		"contentEncoding":    &obj.ContentEncoding,
+		"cacheControl":       &obj.CacheControl,
+		"contentDisposition": &obj.ContentDisposition,
+		"contentLanguage":    &obj.ContentLanguage,
+	} {
+		raw, ok := fields[name]
+		if !ok || isNull(raw) {
+			if ok || replace {
+				*value = ""
+			}
+			continue
+		}
+		if err := json.Unmarshal(raw, value); err != nil {
+			return invalid(name)
 		}
 	}
-	backendObj, err := s.backend.UpdateObject(bucketName, objectName, metadata.Metadata)
-	if err != nil {
-		return jsonResponse{
-			status:       http.StatusNotFound,
-			errorMessage: "Object not found to be updated",
+
+	if raw, ok := fields["metadata"]; ok || replace {
+		var metadata map[string]*string
+		if ok {
+			if err := json.Unmarshal(raw, &metadata); err != nil {
+				return invalid("metadata")
+			}
+		}
+		merged := map[string]string{}
+		if !replace && metadata != nil {
+			for k, v := range obj.Metadata {
+				merged[k] = v
+			}
+		}
+		for k, v := range metadata {
+			if v == nil {
+				delete(merged, k)
+			} else {
+				merged[k] = *v
+			}
+		}
+		obj.Metadata = nil
+		if len(merged) > 0 {
+			obj.Metadata = merged
 		}
 	}
 
-	s.eventManager.Trigger(&backendObj, notification.EventMetadata, nil)
-	return jsonResponse{data: fromBackendObjects([]backend.Object{backendObj})[0]}
+	if raw, ok := fields["customTime"]; ok {
+		var customTime time.Time
+		if isNull(raw) {
+			if !obj.CustomTime.IsZero() {
+				return &jsonResponse{status: http.StatusBadRequest, errorReason: "invalid", errorMessage: "The customTime of an object can't be removed."}
+			}
+		} else if err := json.Unmarshal(raw, &customTime); err != nil {
+			return invalid("customTime")
+		} else if customTime.Before(obj.CustomTime) {
+			return &jsonResponse{
+				status:       http.StatusBadRequest,
+				errorReason:  "invalid",
+				errorMessage: "The customTime of an object can't be set to an earlier time than its current value.",
+			}
+		} else {
+			obj.CustomTime = customTime
+		}
+	}
+
+	if raw, ok := fields["acl"]; ok && !isNull(raw) {
+		if bucket, err := s.backend.GetBucket(obj.BucketName); err == nil && bucket.UniformBucketLevelAccess != nil {
+			return &jsonResponse{status: http.StatusBadRequest, errorReason: "invalid", errorMessage: legacyACLsDisabledMessage}
+		}
+		var rules []objectAccessControl
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			return invalid("acl")
+		}
+		acl := make([]storage.ACLRule, 0, len(rules))
+		for _, rule := range rules {
+			role := storage.ACLRole(rule.Role)
+			if rule.Entity == "" || !validObjectACLRole(role) {
+				return invalid("acl")
+			}
+			acl = append(acl, storage.ACLRule{Entity: storage.ACLEntity(rule.Entity), Role: role})
+		}
+		obj.ACL = acl
+	}
+	return nil
 }
 
+// maxComposeSources is the maximum number of source objects in a compose
+// request.
+const maxComposeSources = 32
+
 func (s *Server) composeObject(r *http.Request) jsonResponse {
 	vars := mux.Vars(r)
 	bucketName := vars["bucketName"]
@@ -771,12 +1677,73 @@ func (s *Server) composeObject(r *http.Request) jsonResponse {
 		}
 	}
 
+	if len(composeRequest.SourceObjects) == 0 || len(composeRequest.SourceObjects) > maxComposeSources {
+		return jsonResponse{
+			status:       http.StatusBadRequest,
+			errorMessage: fmt.Sprintf("The number of source objects must be between 1 and %d.", maxComposeSources),
+		}
+	}
+
 	sourceNames := make([]string, 0, len(composeRequest.SourceObjects))
+	var size int64
 	for _, n := range composeRequest.SourceObjects {
+		source, err := s.backend.GetObject(bucketName, n.Name)
+		if err != nil {
+			return jsonResponse{
+				status:       http.StatusNotFound,
+				errorMessage: fmt.Sprintf("Source object %s not found.", n.Name),
+			}
+		}
+		// the content of sources encrypted with customer-supplied keys
+		// can only be composed by requests that send their key.
+		if errResp := checkCustomerKey(r, encryptionHeaderPrefix, fromBackendObjectsAttrs([]backend.ObjectAttrs{source.ObjectAttrs})[0]); errResp != nil {
+			return *errResp
+		}
 		sourceNames = append(sourceNames, n.Name)
+		size += int64(len(source.Content))
 	}
 
-	backendObj, err := s.backend.ComposeObject(bucketName, sourceNames, destinationObject, composeRequest.Destination.Metadata, composeRequest.Destination.ContentType)
+	conds, resp := s.checkObjectPreconditions(r, bucketName, destinationObject)
+	if resp != nil {
+		return *resp
+	}
+	keySHA256, kmsKeyName, errResp := s.objectEncryption(r, bucketName, r.URL.Query().Get("kmsKeyName"))
+	if errResp != nil {
+		return *errResp
+	}
+
+	if err := s.writeRates.take(bucketName, destinationObject); err != nil {
+		return errToJsonResponse(err)
+	}
+	var previous *ObjectAttrs
+	oldBackendObj, err := s.backend.GetObject(bucketName, destinationObject)
+	if err == nil {
+		previous = &fromBackendObjectsAttrs([]backend.ObjectAttrs{oldBackendObj.ObjectAttrs})[0]
+		if err := s.checkRetention(*previous); err != nil {
+			return errToJsonResponse(err)
+		}
+	}
+	if quota, ok := s.quotas.get(bucketName); ok {
+		s.quotas.writeMtx.Lock()
+		defer s.quotas.writeMtx.Unlock()
+		dest := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: destinationObject, Size: size}}
+		if err := s.checkQuota(dest, quota); err != nil {
+			return errToJsonResponse(err)
+		}
+	}
+	predefinedACL := r.URL.Query().Get("destinationPredefinedAcl")
+	dest := backend.ObjectAttrs{
+		Name:              destinationObject,
+		ContentType:       composeRequest.Destination.ContentType,
+		Metadata:          composeRequest.Destination.Metadata,
+		ACL:               s.newObjectACL(bucketName, predefinedACL),
+		CustomerKeySHA256: keySHA256,
+		KMSKeyName:        kmsKeyName,
+	}
+	backendObj, err := s.backend.ComposeObject(bucketName, sourceNames, dest, conds.toBackend())
+	if errors.Is(err, backend.PreconditionFailed) {
+		return errToJsonResponse(err)
+	}
 	if err != nil {
 		return jsonResponse{
 			status:       http.StatusInternalServerError,
@@ -784,9 +1751,15 @@ func (s *Server) composeObject(r *http.Request) jsonResponse {
 		}
 	}
 
-	obj := fromBackendObjects([]backend.Object{backendObj})[0]
+	obj := fromBackendObjectsAttrs([]backend.ObjectAttrs{backendObj.ObjectAttrs})[0]
+	s.listingConsistency.record(bucketName, destinationObject, previous)
+	if previous != nil {
+		if bucket, err := s.backend.GetBucket(bucketName); err == nil && !bucket.VersioningEnabled {
+			s.softDelete(fromBackendObjects([]backend.Object{oldBackendObj})[0])
+		}
+	}
 
 	s.eventManager.Trigger(&backendObj, notification.EventFinalize, nil)
 
-	return jsonResponse{data: newObjectResponse(obj.ObjectAttrs)}
+	return jsonResponse{data: newObjectResponse(obj)}
 }
@@ -8,17 +8,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/fsouza/fake-gcs-server/internal/checksum"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -379,7 +384,7 @@ func TestServerClientObjectRangeReader(t *testing.T) {
 		},
 	}
 
-	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+	runServersTest(t, runServersOptions{objs: objs, enableFSBackend: true}, func(t *testing.T, server *Server) {
 		tests := []struct {
 			testCase string
 			offset   int64
@@ -526,6 +531,73 @@ func TestServerClientObjectReaderAgainstSpecificGenerations(t *testing.T) {
 	})
 }
 
+func TestServerObjectVersions(t *testing.T) {
+	const (
+		bucketName = "versioned-bucket"
+		objectName = "items/data.txt"
+	)
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName, VersioningEnabled: true})
+	for _, generation := range []int64{2222, 1111, 3333} {
+		server.CreateObject(Object{
+			ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName, Generation: generation},
+			Content:     []byte(strconv.FormatInt(generation, 10)),
+		})
+	}
+	server.CreateObject(Object{
+		ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName + ".bak", Generation: 4444},
+	})
+
+	versions, err := server.ObjectVersions(bucketName, objectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generations []int64
+	for _, version := range versions {
+		generations = append(generations, version.Generation)
+	}
+	if expected := []int64{1111, 2222, 3333}; !reflect.DeepEqual(generations, expected) {
+		t.Errorf("wrong generations\nwant %v\ngot  %v", expected, generations)
+	}
+	if len(versions) == 3 {
+		if versions[0].Deleted.IsZero() || versions[1].Deleted.IsZero() {
+			t.Error("noncurrent generations should have the deleted time set")
+		}
+		if !versions[2].Deleted.IsZero() {
+			t.Errorf("unexpected deleted time in the live generation: %v", versions[2].Deleted)
+		}
+	}
+
+	client := server.HTTPClient()
+	resp, err := client.Get("https://storage.googleapis.com/_internal/versions/" + bucketName + "/" + objectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Items []objectResponse `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 3 {
+		t.Errorf("wrong number of versions returned by the endpoint\nwant 3\ngot  %d", len(list.Items))
+	}
+
+	resp, err = client.Get("https://storage.googleapis.com/_internal/versions/" + bucketName + "/missing.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status for missing object\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
 func TestServerClientObjectReaderError(t *testing.T) {
 	objs := []Object{
 		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "img/hi-res/party-01.jpg"}},
@@ -732,6 +804,20 @@ func getTestCasesForListTests(versioningEnabled, withOverwrites bool) []listTest
 			[]string{"img/brand.jpg"},
 			[]string{"img/hi-res/"},
 		},
+		{
+			fmt.Sprintf("filtering prefix and multi-character delimiter, versioning %t and overwrites %t", versioningEnabled, withOverwrites),
+			"some-bucket",
+			&storage.Query{Prefix: "img/", Delimiter: "-res/"},
+			[]string{"img/brand.jpg"},
+			[]string{"img/hi-res/", "img/low-res/"},
+		},
+		{
+			fmt.Sprintf("multi-character delimiter, versioning %t and overwrites %t", versioningEnabled, withOverwrites),
+			"some-bucket",
+			&storage.Query{Delimiter: "party-"},
+			[]string{"img/brand.jpg", "video/hi-res/some_video_1080p.mp4"},
+			[]string{"img/hi-res/party-", "img/low-res/party-"},
+		},
 		{
 			"delimiter without IncludeTrailingDelimiter",
 			"trailing-delimiter-bucket",
@@ -1257,6 +1343,205 @@ func TestServiceClientRewriteObjectWithGenerations(t *testing.T) {
 	}
 }
 
+func TestServerCopyObject(t *testing.T) {
+	objs := []Object{
+		{
+			ObjectAttrs: ObjectAttrs{
+				BucketName:  "first-bucket",
+				Name:        "files/some-file.txt",
+				ContentType: "text/plain",
+				Metadata:    map[string]string{"foo": "bar"},
+			},
+			Content: []byte("some content"),
+		},
+	}
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: "other-bucket"})
+		source, err := server.GetObject("first-bucket", "files/some-file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name             string
+			url              string
+			body             string
+			expectedStatus   int
+			expectedMetadata map[string]string
+		}{
+			{
+				"preserve metadata",
+				"/b/first-bucket/o/files%2Fsome-file.txt/copyTo/b/other-bucket/o/copy.txt",
+				"",
+				http.StatusOK,
+				map[string]string{"foo": "bar"},
+			},
+			{
+				"replace metadata",
+				"/b/first-bucket/o/files%2Fsome-file.txt/copyTo/b/other-bucket/o/copy.txt",
+				`{"metadata":{"baz":"qux"}}`,
+				http.StatusOK,
+				map[string]string{"baz": "qux"},
+			},
+			{
+				"missing source",
+				"/b/first-bucket/o/missing.txt/copyTo/b/other-bucket/o/copy.txt",
+				"",
+				http.StatusNotFound,
+				nil,
+			},
+			{
+				"missing destination bucket",
+				"/b/first-bucket/o/files%2Fsome-file.txt/copyTo/b/missing-bucket/o/copy.txt",
+				"",
+				http.StatusNotFound,
+				nil,
+			},
+		}
+		client := server.HTTPClient()
+		for _, test := range tests {
+			resp, err := client.Post("https://storage.googleapis.com/storage/v1"+test.url, "application/json", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var copied objectResponse
+			err = json.NewDecoder(resp.Body).Decode(&copied)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s: wrong status\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+				continue
+			}
+			if test.expectedStatus != http.StatusOK {
+				continue
+			}
+			if copied.Kind != "storage#object" {
+				t.Errorf("%s: wrong kind\nwant %q\ngot  %q", test.name, "storage#object", copied.Kind)
+			}
+			if copied.Generation == 0 || copied.Generation == source.Generation {
+				t.Errorf("%s: copy didn't get a new generation: %d", test.name, copied.Generation)
+			}
+			if copied.ContentType != "text/plain" {
+				t.Errorf("%s: wrong content type\nwant %q\ngot  %q", test.name, "text/plain", copied.ContentType)
+			}
+			if !reflect.DeepEqual(copied.Metadata, test.expectedMetadata) {
+				t.Errorf("%s: wrong metadata\nwant %+v\ngot  %+v", test.name, test.expectedMetadata, copied.Metadata)
+			}
+			obj, err := server.GetObject("other-bucket", "copy.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(obj.Content) != "some content" {
+				t.Errorf("%s: wrong content\nwant %q\ngot  %q", test.name, "some content", string(obj.Content))
+			}
+		}
+	})
+}
+
+func TestServerClientRewriteObjectInChunks(t *testing.T) {
+	const content = "some content to rewrite"
+	server, err := NewServerWithOptions(Options{
+		NoListener:       true,
+		RewriteChunkSize: 10,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "source.txt"}, Content: []byte(content)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := server.Client()
+	copier := client.Bucket("some-bucket").Object("destination.txt").CopierFrom(client.Bucket("some-bucket").Object("source.txt"))
+	var progress []int64
+	copier.ProgressFunc = func(copiedBytes, totalBytes uint64) {
+		if totalBytes != uint64(len(content)) {
+			t.Errorf("wrong total bytes\nwant %d\ngot  %d", len(content), totalBytes)
+		}
+		progress = append(progress, int64(copiedBytes))
+	}
+	attrs, err := copier.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != int64(len(content)) {
+		t.Errorf("wrong size\nwant %d\ngot  %d", len(content), attrs.Size)
+	}
+	if expected := []int64{10, 20, 23}; !reflect.DeepEqual(progress, expected) {
+		t.Errorf("wrong progress\nwant %v\ngot  %v", expected, progress)
+	}
+	obj, err := server.GetObject("some-bucket", "destination.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != content {
+		t.Errorf("wrong content\nwant %q\ngot  %q", content, string(obj.Content))
+	}
+}
+
+func TestServerRewriteObjectTokens(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "source.txt"}, Content: []byte("some content")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+	rewrite := func(path, query string) (rewriteResponse, int) {
+		url := "https://storage.googleapis.com/storage/v1/b/some-bucket/o/source.txt/rewriteTo/b/some-bucket/o/" + path + "?" + query
+		resp, err := client.Post(url, "application/json", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var data rewriteResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return data, resp.StatusCode
+	}
+
+	first, status := rewrite("dst.txt", "maxBytesRewrittenPerCall=5")
+	if status != http.StatusOK {
+		t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if first.Done || first.RewriteToken == "" || first.TotalBytesRewritten != 5 || first.Resource != nil {
+		t.Errorf("unexpected response to the first call: %+v", first)
+	}
+	if _, status := rewrite("other.txt", "maxBytesRewrittenPerCall=5&rewriteToken="+first.RewriteToken); status != http.StatusBadRequest {
+		t.Errorf("wrong status for a token of a different rewrite\nwant %d\ngot  %d", http.StatusBadRequest, status)
+	}
+	if _, status := rewrite("dst.txt", "rewriteToken=invalid"); status != http.StatusBadRequest {
+		t.Errorf("wrong status for an invalid token\nwant %d\ngot  %d", http.StatusBadRequest, status)
+	}
+	if _, status := rewrite("dst.txt", "maxBytesRewrittenPerCall=none"); status != http.StatusBadRequest {
+		t.Errorf("wrong status for an invalid maxBytesRewrittenPerCall\nwant %d\ngot  %d", http.StatusBadRequest, status)
+	}
+	if _, err := server.GetObject("some-bucket", "dst.txt"); err == nil {
+		t.Error("unexpected <nil> error getting the object before the rewrite is done")
+	}
+
+	last, status := rewrite("dst.txt", "rewriteToken="+first.RewriteToken)
+	if status != http.StatusOK {
+		t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if !last.Done || last.TotalBytesRewritten != 12 || last.Resource == nil || last.Resource.Name != "dst.txt" {
+		t.Errorf("unexpected response to the last call: %+v", last)
+	}
+	if _, status := rewrite("dst.txt", "rewriteToken="+first.RewriteToken); status != http.StatusBadRequest {
+		t.Errorf("wrong status reusing the token of a finished rewrite\nwant %d\ngot  %d", http.StatusBadRequest, status)
+	}
+}
+
 func TestServerClientObjectDelete(t *testing.T) {
 	const (
 		bucketName = "some-bucket"
@@ -1308,6 +1593,99 @@ func TestServerClientObjectDeleteWithVersioning(t *testing.T) {
 	})
 }
 
+func TestServerClientObjectDeleteGeneration(t *testing.T) {
+	const (
+		bucketName = "versioned-bucket"
+		objectName = "items/data.txt"
+	)
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName, VersioningEnabled: true})
+		for _, generation := range []int64{1111, 2222, 3333} {
+			server.CreateObject(Object{
+				ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName, Generation: generation},
+				Content:     []byte(strconv.FormatInt(generation, 10)),
+			})
+		}
+		client := server.Client()
+		objHandle := client.Bucket(bucketName).Object(objectName)
+
+		if err := objHandle.Generation(1111).Delete(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		if err := objHandle.Generation(3333).Delete(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		if err := objHandle.Generation(9999).Delete(context.TODO()); err != storage.ErrObjectNotExist {
+			t.Errorf("wrong error deleting a generation that doesn't exist\nwant %v\ngot  %v", storage.ErrObjectNotExist, err)
+		}
+		if _, err := server.GetObject(bucketName, objectName); err == nil {
+			t.Error("the live version wasn't deleted")
+		}
+
+		it := client.Bucket(bucketName).Objects(context.TODO(), &storage.Query{Versions: true})
+		var generations []int64
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			generations = append(generations, attrs.Generation)
+			if attrs.Deleted.IsZero() {
+				t.Errorf("noncurrent generation %d without the deleted time", attrs.Generation)
+			}
+		}
+		if expected := []int64{2222, 3333}; !reflect.DeepEqual(generations, expected) {
+			t.Errorf("wrong generations\nwant %v\ngot  %v", expected, generations)
+		}
+
+		reader, err := objHandle.Generation(3333).NewReader(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "3333" {
+			t.Errorf("wrong content of the archived generation\nwant %q\ngot  %q", "3333", data)
+		}
+	})
+}
+
+func TestServerObjectResponseTimeDeleted(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "versioned-bucket", VersioningEnabled: true})
+	for _, generation := range []int64{1111, 2222} {
+		server.CreateObject(Object{
+			ObjectAttrs: ObjectAttrs{BucketName: "versioned-bucket", Name: "object.txt", Generation: generation},
+		})
+	}
+
+	for generation, expectTimeDeleted := range map[string]bool{"1111": true, "2222": false} {
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/storage/v1/b/versioned-bucket/o/object.txt?generation=" + generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := data["timeDeleted"]; ok != expectTimeDeleted {
+			t.Errorf("wrong timeDeleted for generation %s\nwant present=%t\ngot  %v", generation, expectTimeDeleted, data["timeDeleted"])
+		}
+	}
+}
+
 func TestServerClientObjectDeleteErrors(t *testing.T) {
 	objs := []Object{
 		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "img/hi-res/party-01.jpg"}},
@@ -1382,71 +1760,487 @@ func TestServerClientObjectSetAclPrivate(t *testing.T) {
 	})
 }
 
-func TestServerClientObjectPatchMetadata(t *testing.T) {
-	const (
-		bucketName  = "some-bucket"
-		objectName  = "items/data.txt"
-		content     = "some nice content"
-		contentType = "text/plain; charset=utf-8"
-	)
-	objs := []Object{
-		{
-			ObjectAttrs: ObjectAttrs{
-				BucketName:  bucketName,
-				Name:        objectName,
-				ContentType: contentType,
+func TestServerObjectOwnerAndACLIDs(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{
+				ObjectAttrs: ObjectAttrs{
+					BucketName: "some-bucket",
+					Name:       "img/owned.jpg",
+					Generation: 1234,
+					ACL: []storage.ACLRule{
+						{Entity: "user-" + ownerEntityID, Role: storage.RoleOwner},
+						{Entity: storage.AllUsers, Role: storage.RoleReader},
+					},
+				},
 			},
-			Content: []byte(content),
 		},
-	}
-	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
-		client := server.Client()
-		objHandle := client.Bucket(bucketName).Object(objectName)
-
-		metadata := map[string]string{
-			"1-key": "1-value",
-			"2-key": "2-value",
-		}
-		testPatch(metadata, metadata, objHandle, t)
-
-		metadata = map[string]string{
-			"1-key": "1.1-value",
-			"3-key": "3-value",
-		}
-		testPatch(metadata, map[string]string{
-			"1-key": "1.1-value",
-			"2-key": "2-value",
-			"3-key": "3-value",
-		}, objHandle, t)
 	})
-}
-
-func testPatch(newMetadata, finalMetadata map[string]string, objHandle *storage.ObjectHandle, t *testing.T) {
-	ctx := context.TODO()
-	_, err := objHandle.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: newMetadata})
 	if err != nil {
 		t.Fatal(err)
 	}
-	attrs, err := objHandle.Attrs(ctx)
+	defer server.Stop()
+
+	attrs, err := server.Client().Bucket("some-bucket").Object("img/owned.jpg").Attrs(context.TODO())
 	if err != nil {
 		t.Fatal(err)
 	}
-	checkObjectMetadata(attrs.Metadata, finalMetadata, t)
-}
+	if expected := "user-" + ownerEntityID; attrs.Owner != expected {
+		t.Errorf("wrong owner\nwant %q\ngot  %q", expected, attrs.Owner)
+	}
 
-func checkObjectMetadata(actual, expected map[string]string, t *testing.T) {
-	if actual == nil {
-		t.Fatalf("unexpected nil metadata")
-	} else if len(actual) != len(expected) {
-		t.Fatalf("Number of metadata mismatched: #actual = %d, #expected = %d", len(actual), len(expected))
+	resp, err := server.HTTPClient().Get("https://storage.googleapis.com/storage/v1/b/some-bucket/o/img%2Fowned.jpg/acl")
+	if err != nil {
+		t.Fatal(err)
 	}
-	for k, v := range expected {
-		if actual[k] != v {
-			t.Errorf("Metadata for key %s: actual = %s, expected = %s", k, actual[k], v)
-		}
+	defer resp.Body.Close()
+	var acl aclListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&acl); err != nil {
+		t.Fatal(err)
 	}
-}
-
+	expectedACL := []objectAccessControl{
+		{
+			Kind:       "storage#objectAccessControl",
+			ID:         "some-bucket/img/owned.jpg/1234/user-" + ownerEntityID,
+			Bucket:     "some-bucket",
+			Object:     "img/owned.jpg",
+			Generation: 1234,
+			Entity:     "user-" + ownerEntityID,
+			EntityID:   ownerEntityID,
+			Role:       "OWNER",
+		},
+		{
+			Kind:       "storage#objectAccessControl",
+			ID:         "some-bucket/img/owned.jpg/1234/allUsers",
+			Bucket:     "some-bucket",
+			Object:     "img/owned.jpg",
+			Generation: 1234,
+			Entity:     "allUsers",
+			Role:       "READER",
+		},
+	}
+	if len(acl.Items) != len(expectedACL) {
+		t.Fatalf("wrong number of acl rules\nwant %d\ngot  %d", len(expectedACL), len(acl.Items))
+	}
+	for i, expected := range expectedACL {
+		if !reflect.DeepEqual(*acl.Items[i], expected) {
+			t.Errorf("wrong acl rule %d\nwant %+v\ngot  %+v", i, expected, *acl.Items[i])
+		}
+	}
+}
+
+func TestServerClientObjectACLRules(t *testing.T) {
+	objs := []Object{
+		{ObjectAttrs: ObjectAttrs{
+			BucketName: "some-bucket",
+			Name:       "img/photo.jpg",
+			ACL:        []storage.ACLRule{{Entity: "user-" + ownerEntityID, Role: storage.RoleOwner}},
+		}},
+	}
+
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		acl := server.Client().Bucket("some-bucket").Object("img/photo.jpg").ACL()
+		if err := acl.Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
+			t.Fatal(err)
+		}
+		if err := acl.Set(ctx, "user-alice@example.com", storage.RoleReader); err != nil {
+			t.Fatal(err)
+		}
+		if err := acl.Set(ctx, "user-alice@example.com", storage.RoleOwner); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := acl.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedRules := []string{"user-" + ownerEntityID + ":OWNER", "allUsers:READER", "user-alice@example.com:OWNER"}
+		if got := aclRoles(rules); !reflect.DeepEqual(got, expectedRules) {
+			t.Errorf("wrong acl\nwant %v\ngot  %v", expectedRules, got)
+		}
+
+		if err := acl.Delete(ctx, storage.AllUsers); err != nil {
+			t.Fatal(err)
+		}
+		rules, err = acl.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedRules = []string{"user-" + ownerEntityID + ":OWNER", "user-alice@example.com:OWNER"}
+		if got := aclRoles(rules); !reflect.DeepEqual(got, expectedRules) {
+			t.Errorf("wrong acl after deleting a rule\nwant %v\ngot  %v", expectedRules, got)
+		}
+		if err := acl.Delete(ctx, storage.AllUsers); err == nil {
+			t.Error("unexpected <nil> error deleting a rule that doesn't exist")
+		}
+	})
+}
+
+func TestServerObjectACLRuleEndpoints(t *testing.T) {
+	const objectURL = "https://storage.googleapis.com/storage/v1/b/some-bucket/o/img%2Fphoto.jpg"
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{
+				BucketName: "some-bucket",
+				Name:       "img/photo.jpg",
+				Generation: 1234,
+				ACL:        []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "get",
+			method:         http.MethodGet,
+			url:            objectURL + "/acl/allUsers",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "get missing entity",
+			method:         http.MethodGet,
+			url:            objectURL + "/acl/allAuthenticatedUsers",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "insert",
+			method:         http.MethodPost,
+			url:            objectURL + "/acl",
+			body:           `{"entity":"allAuthenticatedUsers","role":"READER"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid role",
+			method:         http.MethodPost,
+			url:            objectURL + "/acl",
+			body:           `{"entity":"allUsers","role":"WRITER"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "patch",
+			method:         http.MethodPatch,
+			url:            objectURL + "/acl/allAuthenticatedUsers",
+			body:           `{"role":"OWNER"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "patch missing entity",
+			method:         http.MethodPatch,
+			url:            objectURL + "/acl/user-bob@example.com",
+			body:           `{"role":"OWNER"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "delete",
+			method:         http.MethodDelete,
+			url:            objectURL + "/acl/allUsers",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "delete missing entity",
+			method:         http.MethodDelete,
+			url:            objectURL + "/acl/allUsers",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "object not found",
+			method:         http.MethodGet,
+			url:            "https://storage.googleapis.com/storage/v1/b/some-bucket/o/missing.jpg/acl/allUsers",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+
+	obj, err := server.GetObject("some-bucket", "img/photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedACL := []storage.ACLRule{{Entity: storage.AllAuthenticatedUsers, Role: storage.RoleOwner}}
+	if !reflect.DeepEqual(obj.ACL, expectedACL) {
+		t.Errorf("wrong acl\nwant %+v\ngot  %+v", expectedACL, obj.ACL)
+	}
+}
+
+func TestServerEnforceObjectACL(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:       true,
+		EnforceObjectACL: true,
+		InitialObjects: []Object{
+			{
+				ObjectAttrs: ObjectAttrs{
+					BucketName: "some-bucket",
+					Name:       "public.txt",
+					ACL:        []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}},
+				},
+				Content: []byte("public content"),
+			},
+			{
+				ObjectAttrs: ObjectAttrs{
+					BucketName: "some-bucket",
+					Name:       "private.txt",
+					ACL:        []storage.ACLRule{{Entity: storage.AllAuthenticatedUsers, Role: storage.RoleReader}},
+				},
+				Content: []byte("private content"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name           string
+		url            string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "public object",
+			url:            "https://storage.googleapis.com/some-bucket/public.txt",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "private object",
+			url:            "https://storage.googleapis.com/some-bucket/private.txt",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "private object through the JSON API",
+			url:            "https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/private.txt?alt=media",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "private object with credentials",
+			url:            "https://storage.googleapis.com/some-bucket/private.txt",
+			authorization:  "Bearer some-token",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+
+	err = server.Client().Bucket("some-bucket").Object("private.txt").ACL().Set(context.Background(), storage.AllUsers, storage.RoleReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("https://storage.googleapis.com/some-bucket/private.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status after sharing the object\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestServerClientObjectPatchMetadata(t *testing.T) {
+	const (
+		bucketName  = "some-bucket"
+		objectName  = "items/data.txt"
+		content     = "some nice content"
+		contentType = "text/plain; charset=utf-8"
+	)
+	objs := []Object{
+		{
+			ObjectAttrs: ObjectAttrs{
+				BucketName:  bucketName,
+				Name:        objectName,
+				ContentType: contentType,
+			},
+			Content: []byte(content),
+		},
+	}
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		client := server.Client()
+		objHandle := client.Bucket(bucketName).Object(objectName)
+
+		metadata := map[string]string{
+			"1-key": "1-value",
+			"2-key": "2-value",
+		}
+		testPatch(metadata, metadata, objHandle, t)
+
+		metadata = map[string]string{
+			"1-key": "1.1-value",
+			"3-key": "3-value",
+		}
+		testPatch(metadata, map[string]string{
+			"1-key": "1.1-value",
+			"2-key": "2-value",
+			"3-key": "3-value",
+		}, objHandle, t)
+	})
+}
+
+func TestServerObjectPatchAndUpdateSemantics(t *testing.T) {
+	const (
+		bucketName = "some-bucket"
+		objectName = "items/data.txt"
+	)
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{
+				ObjectAttrs: ObjectAttrs{
+					BucketName:   bucketName,
+					Name:         objectName,
+					ContentType:  "text/plain",
+					CacheControl: "no-cache",
+					Metadata:     map[string]string{"1-key": "1-value", "2-key": "2-value"},
+				},
+				Content: []byte("some nice content"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	do := func(method, query, body string) (int, objectResponse) {
+		t.Helper()
+		objURL := "https://storage.googleapis.com/storage/v1/b/" + bucketName + "/o/" + url.PathEscape(objectName) + query
+		req, err := http.NewRequest(method, objURL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var obj objectResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, obj
+	}
+
+	status, obj := do(http.MethodPatch, "", `{"contentLanguage":"en","cacheControl":null,"metadata":{"1-key":null,"3-key":"3-value"}}`)
+	if status != http.StatusOK {
+		t.Fatalf("wrong status patching the object\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if obj.ContentType != "text/plain" || obj.ContentLanguage != "en" || obj.CacheControl != "" {
+		t.Errorf("wrong fields after patch: %+v", obj)
+	}
+	expectedMetadata := map[string]string{"2-key": "2-value", "3-key": "3-value"}
+	if !reflect.DeepEqual(obj.Metadata, expectedMetadata) {
+		t.Errorf("wrong metadata after patch\nwant %v\ngot  %v", expectedMetadata, obj.Metadata)
+	}
+	if obj.Metageneration != 2 {
+		t.Errorf("wrong metageneration after patch\nwant %d\ngot  %d", 2, obj.Metageneration)
+	}
+
+	status, _ = do(http.MethodPut, "?ifMetagenerationMatch=1", `{"contentType":"application/json"}`)
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("wrong status updating with a stale metageneration\nwant %d\ngot  %d", http.StatusPreconditionFailed, status)
+	}
+
+	status, obj = do(http.MethodPut, "?ifMetagenerationMatch=2", `{"contentType":"application/json","metadata":{"4-key":"4-value"}}`)
+	if status != http.StatusOK {
+		t.Fatalf("wrong status updating the object\nwant %d\ngot  %d", http.StatusOK, status)
+	}
+	if obj.ContentType != "application/json" || obj.ContentLanguage != "" {
+		t.Errorf("wrong fields after update: %+v", obj)
+	}
+	expectedMetadata = map[string]string{"4-key": "4-value"}
+	if !reflect.DeepEqual(obj.Metadata, expectedMetadata) {
+		t.Errorf("wrong metadata after update\nwant %v\ngot  %v", expectedMetadata, obj.Metadata)
+	}
+	if obj.Metageneration != 3 {
+		t.Errorf("wrong metageneration after update\nwant %d\ngot  %d", 3, obj.Metageneration)
+	}
+
+	stored, err := server.GetObject(bucketName, objectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored.Content) != "some nice content" {
+		t.Errorf("wrong content after update\nwant %q\ngot  %q", "some nice content", stored.Content)
+	}
+	if stored.Metageneration != 3 {
+		t.Errorf("wrong stored metageneration\nwant %d\ngot  %d", 3, stored.Metageneration)
+	}
+}
+
+func testPatch(newMetadata, finalMetadata map[string]string, objHandle *storage.ObjectHandle, t *testing.T) {
+	ctx := context.TODO()
+	_, err := objHandle.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: newMetadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := objHandle.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkObjectMetadata(attrs.Metadata, finalMetadata, t)
+}
+
+func checkObjectMetadata(actual, expected map[string]string, t *testing.T) {
+	if actual == nil {
+		t.Fatalf("unexpected nil metadata")
+	} else if len(actual) != len(expected) {
+		t.Fatalf("Number of metadata mismatched: #actual = %d, #expected = %d", len(actual), len(expected))
+	}
+	for k, v := range expected {
+		if actual[k] != v {
+			t.Errorf("Metadata for key %s: actual = %s, expected = %s", k, actual[k], v)
+		}
+	}
+}
+
 func TestParseRangeRequest(t *testing.T) {
 	ctx := context.TODO()
 
@@ -1657,3 +2451,563 @@ func TestServiceClientComposeObject(t *testing.T) {
 		}
 	})
 }
+
+func TestServiceClientComposeObjectWithPredefinedACL(t *testing.T) {
+	objs := []Object{
+		{
+			ObjectAttrs: ObjectAttrs{
+				BucketName:  "some-bucket",
+				Name:        "files/source1.txt",
+				ContentType: "text/html",
+			},
+			Content: []byte("some content"),
+		},
+		{
+			ObjectAttrs: ObjectAttrs{
+				BucketName: "some-bucket",
+				Name:       "files/destination.txt",
+			},
+			Content: []byte("test"),
+		},
+	}
+
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		tests := []struct {
+			testCase       string
+			destObjectName string
+		}{
+			{"destination file doesn't exist", "files/some-file.txt"},
+			{"destination file already exists", "files/destination.txt"},
+		}
+		for _, test := range tests {
+			test := test
+			t.Run(test.testCase, func(t *testing.T) {
+				const contentType = "text/plain; charset=utf-8"
+				client := server.Client()
+				bucket := client.Bucket("some-bucket")
+				composer := bucket.Object(test.destObjectName).ComposerFrom(bucket.Object("files/source1.txt"))
+				composer.ContentType = contentType
+				composer.Metadata = map[string]string{"baz": "qux"}
+				composer.PredefinedACL = "publicRead"
+				if _, err := composer.Run(context.TODO()); err != nil {
+					t.Fatal(err)
+				}
+
+				obj, err := server.GetObject("some-bucket", test.destObjectName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !isACLPublic(obj.ACL) {
+					t.Errorf("wrong acl\ngot %+v", obj.ACL)
+				}
+				if obj.ContentType != contentType {
+					t.Errorf("wrong content type\nwant %q\ngot  %q", contentType, obj.ContentType)
+				}
+				if !reflect.DeepEqual(obj.Metadata, composer.Metadata) {
+					t.Errorf("wrong meta data\nwant %+v\ngot  %+v", composer.Metadata, obj.Metadata)
+				}
+			})
+		}
+	})
+}
+
+func TestServiceClientComposeObjectComponentCount(t *testing.T) {
+	objs := []Object{
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "part1.txt"}, Content: []byte("first ")},
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "part2.txt"}, Content: []byte("second ")},
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "part3.txt"}, Content: []byte("third")},
+	}
+
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		bucket := server.Client().Bucket("some-bucket")
+		compose := func(dst *storage.ObjectHandle, names ...string) (*storage.ObjectAttrs, error) {
+			var sources []*storage.ObjectHandle
+			for _, name := range names {
+				sources = append(sources, bucket.Object(name))
+			}
+			return dst.ComposerFrom(sources...).Run(context.TODO())
+		}
+
+		attrs, err := compose(bucket.Object("composite.txt"), "part1.txt", "part2.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj, err := server.GetObject("some-bucket", "composite.txt"); err != nil {
+			t.Fatal(err)
+		} else if obj.ComponentCount != 2 {
+			t.Errorf("wrong component count\nwant %d\ngot  %d", 2, obj.ComponentCount)
+		}
+
+		// composing a composite object counts each of its components.
+		attrs, err = compose(bucket.Object("nested.txt"), "composite.txt", "part3.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj, err := server.GetObject("some-bucket", "nested.txt"); err != nil {
+			t.Fatal(err)
+		} else if obj.ComponentCount != 3 {
+			t.Errorf("wrong component count\nwant %d\ngot  %d", 3, obj.ComponentCount)
+		}
+		const expectedContent = "first second third"
+		if attrs.CRC32C != uint32Checksum([]byte(expectedContent)) {
+			t.Errorf("wrong checksum\nwant %d\ngot  %d", uint32Checksum([]byte(expectedContent)), attrs.CRC32C)
+		}
+
+		_, err = compose(bucket.Object("nested.txt").If(storage.Conditions{DoesNotExist: true}), "part1.txt")
+		if err == nil || err.Error() != "googleapi: Error 412: Precondition failed, conditionNotMet" {
+			t.Errorf("expected HTTP 412 precondition failed error composing into an existing object, but got %v", err)
+		}
+		_, err = compose(bucket.Object("nested.txt").If(storage.Conditions{GenerationMatch: attrs.Generation}), "part1.txt")
+		if err != nil {
+			t.Errorf("unexpected error composing with a matching generation: %v", err)
+		}
+		if _, err := compose(bucket.Object("other.txt"), "part1.txt", "missing.txt"); err == nil {
+			t.Error("unexpected <nil> error composing a missing source object")
+		}
+	})
+}
+
+func TestServerComposeObjectTooManySources(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "part.txt"}, Content: []byte("part")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	sources := make([]string, maxComposeSources+1)
+	for i := range sources {
+		sources[i] = `{"name":"part.txt"}`
+	}
+	body := `{"sourceObjects":[` + strings.Join(sources, ",") + `]}`
+	resp, err := server.HTTPClient().Post("https://storage.googleapis.com/storage/v1/b/some-bucket/o/composite.txt/compose", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status returned\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestServerClientObjectCustomTime(t *testing.T) {
+	const bucketName = "some-bucket"
+	customTime := time.Date(2022, time.May, 1, 10, 0, 0, 0, time.UTC)
+	runServersTest(t, runServersOptions{
+		objs: []Object{{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "placeholder.txt"}}},
+	}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		obj := server.Client().Bucket(bucketName).Object("custom.txt")
+		w := obj.NewWriter(ctx)
+		w.CustomTime = customTime
+		w.Write([]byte("something"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.CustomTime.Equal(customTime) {
+			t.Errorf("wrong custom time after upload\nwant %s\ngot  %s", customTime, attrs.CustomTime)
+		}
+
+		later := customTime.Add(24 * time.Hour)
+		attrs, err = obj.Update(ctx, storage.ObjectAttrsToUpdate{CustomTime: later})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.CustomTime.Equal(later) {
+			t.Errorf("wrong custom time after update\nwant %s\ngot  %s", later, attrs.CustomTime)
+		}
+
+		_, err = obj.Update(ctx, storage.ObjectAttrsToUpdate{CustomTime: customTime})
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+			t.Errorf("wrong error moving the custom time backwards\nwant status %d\ngot  %v", http.StatusBadRequest, err)
+		}
+		attrs, err = obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.CustomTime.Equal(later) {
+			t.Errorf("custom time changed by the rejected update\nwant %s\ngot  %s", later, attrs.CustomTime)
+		}
+	})
+}
+
+func TestServerClientObjectDownloadHeaders(t *testing.T) {
+	const (
+		bucketName         = "some-bucket"
+		objectName         = "report.pdf"
+		cacheControl       = "public, max-age=3600"
+		contentDisposition = `attachment; filename="report.pdf"`
+		contentLanguage    = "en"
+	)
+	runServersTest(t, runServersOptions{
+		objs: []Object{{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "placeholder.txt"}}},
+	}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		client := server.Client()
+		w := client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
+		w.CacheControl = cacheControl
+		w.ContentDisposition = contentDisposition
+		w.ContentLanguage = contentLanguage
+		w.Write([]byte("something"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		attrs, err := client.Bucket(bucketName).Object(objectName).Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.CacheControl != cacheControl || attrs.ContentDisposition != contentDisposition || attrs.ContentLanguage != contentLanguage {
+			t.Errorf("wrong attributes\nwant %q, %q, %q\ngot  %q, %q, %q", cacheControl, contentDisposition, contentLanguage, attrs.CacheControl, attrs.ContentDisposition, attrs.ContentLanguage)
+		}
+
+		copied, err := client.Bucket(bucketName).Object("copy.pdf").CopierFrom(client.Bucket(bucketName).Object(objectName)).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied.CacheControl != cacheControl || copied.ContentDisposition != contentDisposition || copied.ContentLanguage != contentLanguage {
+			t.Errorf("wrong attributes of the copy\nwant %q, %q, %q\ngot  %q, %q, %q", cacheControl, contentDisposition, contentLanguage, copied.CacheControl, copied.ContentDisposition, copied.ContentLanguage)
+		}
+
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/" + bucketName + "/" + objectName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for header, expected := range map[string]string{
+			"Cache-Control":       cacheControl,
+			"Content-Disposition": contentDisposition,
+			"Content-Language":    contentLanguage,
+		} {
+			if value := resp.Header.Get(header); value != expected {
+				t.Errorf("wrong %s header\nwant %q\ngot  %q", header, expected, value)
+			}
+		}
+	})
+}
+
+func TestServerClientObjectGenerationLifecycle(t *testing.T) {
+	const (
+		bucketName = "some-bucket"
+		objectName = "object.txt"
+	)
+	runServersTest(t, runServersOptions{
+		objs: []Object{{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "placeholder.txt"}}},
+	}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		obj := server.Client().Bucket(bucketName).Object(objectName)
+		checkVersion := func(t *testing.T, attrs *storage.ObjectAttrs, generation, metageneration int64) {
+			t.Helper()
+			if attrs.Generation != generation || attrs.Metageneration != metageneration {
+				t.Errorf("wrong generation and metageneration\nwant %d, %d\ngot  %d, %d", generation, metageneration, attrs.Generation, attrs.Metageneration)
+			}
+		}
+
+		var generation int64
+		for i := 0; i < 5; i++ {
+			w := obj.NewWriter(ctx)
+			w.Write([]byte("content " + strconv.Itoa(i)))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if w.Attrs().Generation <= generation {
+				t.Fatalf("generation didn't increase on overwrite\nprevious %d\ngot      %d", generation, w.Attrs().Generation)
+			}
+			generation = w.Attrs().Generation
+			checkVersion(t, w.Attrs(), generation, 1)
+
+			attrs, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{ContentType: "text/plain"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkVersion(t, attrs, generation, 2)
+		}
+
+		if err := obj.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkVersion(t, attrs, generation, 3)
+
+		composed, err := obj.ComposerFrom(obj).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if composed.Generation <= generation || composed.Metageneration != 1 {
+			t.Errorf("wrong generation and metageneration of the composed object\nwant >%d, 1\ngot  %d, %d", generation, composed.Generation, composed.Metageneration)
+		}
+
+		resp, err := server.HTTPClient().Get("https://storage.googleapis.com/" + bucketName + "/" + objectName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for header, expected := range map[string]int64{
+			"X-Goog-Generation":     composed.Generation,
+			"X-Goog-Metageneration": composed.Metageneration,
+		} {
+			if value := resp.Header.Get(header); value != strconv.FormatInt(expected, 10) {
+				t.Errorf("wrong %s header\nwant %d\ngot  %q", header, expected, value)
+			}
+		}
+	})
+}
+
+func TestServerClientListObjectsPagination(t *testing.T) {
+	const bucketName = "some-bucket"
+	var objs []Object
+	var expectedNames []string
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("object-%02d.txt", i)
+		objs = append(objs, Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: name}})
+		expectedNames = append(expectedNames, name)
+	}
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		it := server.Client().Bucket(bucketName).Objects(context.Background(), nil)
+		pager := iterator.NewPager(it, 10, "")
+		var names []string
+		var pages int
+		for {
+			var page []*storage.ObjectAttrs
+			nextPageToken, err := pager.NextPage(&page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages++
+			if len(page) > 10 {
+				t.Errorf("page %d has %d objects, more than the page size", pages, len(page))
+			}
+			for _, attrs := range page {
+				names = append(names, attrs.Name)
+			}
+			if nextPageToken == "" {
+				break
+			}
+		}
+		if pages != 3 {
+			t.Errorf("wrong number of pages\nwant 3\ngot  %d", pages)
+		}
+		if !reflect.DeepEqual(names, expectedNames) {
+			t.Errorf("wrong object names\nwant %v\ngot  %v", expectedNames, names)
+		}
+	})
+}
+
+func TestPaginateObjects(t *testing.T) {
+	objs := []ObjectAttrs{
+		{Name: "a.txt", Generation: 1},
+		{Name: "b.txt", Generation: 1},
+		{Name: "b.txt", Generation: 2},
+		{Name: "d.txt", Generation: 1},
+	}
+	prefixes := []string{"c/", "e/"}
+
+	pageObjs, pagePrefixes, token, err := paginateObjects(objs, prefixes, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pageObjs) != 3 || len(pagePrefixes) != 0 || token == "" {
+		t.Fatalf("wrong first page: %v, %v, %q", pageObjs, pagePrefixes, token)
+	}
+
+	// removing an object that was already listed doesn't affect the next
+	// page.
+	pageObjs, pagePrefixes, token, err = paginateObjects(objs[1:], prefixes, token, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pageObjs) != 1 || pageObjs[0].Name != "d.txt" {
+		t.Errorf("wrong objects in the second page: %v", pageObjs)
+	}
+	if !reflect.DeepEqual(pagePrefixes, prefixes) {
+		t.Errorf("wrong prefixes in the second page\nwant %v\ngot  %v", prefixes, pagePrefixes)
+	}
+	if token != "" {
+		t.Errorf("unexpected token after the last page: %q", token)
+	}
+
+	if _, _, _, err := paginateObjects(objs, prefixes, "not a token", 3); err == nil {
+		t.Error("unexpected <nil> error with an invalid page token")
+	}
+}
+
+func TestServerListObjectsMatchGlob(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "data/2022/01/part-0.parquet"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "data/2022/02/part-0.parquet"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "data/2022/02/_SUCCESS"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "root.parquet"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedNames  []string
+	}{
+		{
+			"all parquet files",
+			"matchGlob=**/*.parquet",
+			http.StatusOK,
+			[]string{"data/2022/01/part-0.parquet", "data/2022/02/part-0.parquet", "root.parquet"},
+		},
+		{
+			"glob with prefix and offsets",
+			"matchGlob=data/**&prefix=data/&startOffset=data/2022/02&endOffset=data/2022/03",
+			http.StatusOK,
+			[]string{"data/2022/02/_SUCCESS", "data/2022/02/part-0.parquet"},
+		},
+		{
+			"invalid glob",
+			"matchGlob=data/[0-9",
+			http.StatusBadRequest,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := server.HTTPClient().Get("https://storage.googleapis.com/storage/v1/b/some-bucket/o?" + test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Fatalf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedStatus != http.StatusOK {
+				return
+			}
+			var list struct {
+				Items []struct {
+					Name string `json:"name"`
+				} `json:"items"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, len(list.Items))
+			for i, item := range list.Items {
+				names[i] = item.Name
+			}
+			if !reflect.DeepEqual(names, test.expectedNames) {
+				t.Errorf("wrong names\nwant %v\ngot  %v", test.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestServerListObjectsFolders(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "docs/"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "docs/drafts/"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "docs/drafts/notes.txt"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "docs/reports/2022.pdf"}},
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "docs/readme.txt"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name             string
+		query            string
+		expectedStatus   int
+		expectedNames    []string
+		expectedPrefixes []string
+	}{
+		{
+			"browsing a folder",
+			"prefix=docs/&delimiter=/",
+			http.StatusOK,
+			[]string{"docs/", "docs/readme.txt"},
+			[]string{"docs/drafts/", "docs/reports/"},
+		},
+		{
+			"browsing a folder with includeTrailingDelimiter",
+			"prefix=docs/&delimiter=/&includeTrailingDelimiter=true",
+			http.StatusOK,
+			[]string{"docs/", "docs/drafts/", "docs/readme.txt"},
+			[]string{"docs/drafts/", "docs/reports/"},
+		},
+		{
+			"includeTrailingDelimiter and offsets",
+			"prefix=docs/&delimiter=/&includeTrailingDelimiter=true&startOffset=docs/e",
+			http.StatusOK,
+			[]string{"docs/readme.txt"},
+			[]string{"docs/reports/"},
+		},
+		{
+			"includeFoldersAsPrefixes",
+			"prefix=docs/&delimiter=/&includeFoldersAsPrefixes=true",
+			http.StatusOK,
+			[]string{"docs/", "docs/readme.txt"},
+			[]string{"docs/drafts/", "docs/reports/"},
+		},
+		{
+			"includeFoldersAsPrefixes with the wrong delimiter",
+			"prefix=docs/&delimiter=-&includeFoldersAsPrefixes=true",
+			http.StatusBadRequest,
+			nil,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := server.HTTPClient().Get("https://storage.googleapis.com/storage/v1/b/some-bucket/o?" + test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Fatalf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedStatus != http.StatusOK {
+				return
+			}
+			var list struct {
+				Items []struct {
+					Name string `json:"name"`
+				} `json:"items"`
+				Prefixes []string `json:"prefixes"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, len(list.Items))
+			for i, item := range list.Items {
+				names[i] = item.Name
+			}
+			if !reflect.DeepEqual(names, test.expectedNames) {
+				t.Errorf("wrong names\nwant %v\ngot  %v", test.expectedNames, names)
+			}
+			if !reflect.DeepEqual(list.Prefixes, test.expectedPrefixes) {
+				t.Errorf("wrong prefixes\nwant %v\ngot  %v", test.expectedPrefixes, list.Prefixes)
+			}
+		})
+	}
+}
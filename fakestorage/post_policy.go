@@ -0,0 +1,195 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type postPolicy struct {
+	Expiration string            `json:"expiration"`
+	Conditions []json.RawMessage `json:"conditions"`
+}
+
+type postObjectResponse struct {
+	XMLName  xml.Name `xml:"PostResponse"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// formValue returns the first value of the given field of a form POST upload.
+// As in Cloud Storage, field names are case-insensitive.
+func formValue(r *http.Request, name string) string {
+	for key, values := range r.MultipartForm.Value {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// verifyPostPolicy validates the policy document of a form POST upload: the
+// policy must not have expired, and the form fields and the size of the
+// uploaded file must meet its conditions. When Options.SignedURLKeys has a key
+// for the signer of the policy, its signature is verified as well. Uploads
+// without a policy document are accepted.
+func (s *Server) verifyPostPolicy(r *http.Request, bucketName string, size int) *xmlResponse {
+	encodedPolicy := formValue(r, "policy")
+	if encodedPolicy == "" {
+		return nil
+	}
+	invalidPolicy := func(details string) *xmlResponse {
+		return &xmlResponse{status: http.StatusBadRequest, errorCode: "InvalidPolicyDocument", errorMessage: details}
+	}
+	rawPolicy, err := base64.StdEncoding.DecodeString(encodedPolicy)
+	if err != nil {
+		return invalidPolicy("Invalid Policy: Invalid Base64 encoding.")
+	}
+	var policy postPolicy
+	if err := json.Unmarshal(rawPolicy, &policy); err != nil {
+		return invalidPolicy("Invalid Policy: Invalid JSON.")
+	}
+	expiration, err := time.Parse(time.RFC3339, policy.Expiration)
+	if err != nil {
+		return invalidPolicy("Invalid Policy: Invalid expiration.")
+	}
+	if time.Now().After(expiration) {
+		return invalidPolicy("Invalid according to Policy: Policy expired.")
+	}
+
+	if resp := s.verifyPostPolicySignature(r, encodedPolicy); resp != nil {
+		return resp
+	}
+
+	fieldValue := func(name string) string {
+		name = strings.TrimPrefix(name, "$")
+		if strings.EqualFold(name, "bucket") {
+			return bucketName
+		}
+		return formValue(r, name)
+	}
+	for _, rawCondition := range policy.Conditions {
+		conditionFailed := invalidPolicy(fmt.Sprintf("Invalid according to Policy: Policy Condition failed: %s", rawCondition))
+
+		var exactMatch map[string]string
+		if err := json.Unmarshal(rawCondition, &exactMatch); err == nil {
+			for name, value := range exactMatch {
+				if fieldValue(name) != value {
+					return conditionFailed
+				}
+			}
+			continue
+		}
+
+		var condition []interface{}
+		if err := json.Unmarshal(rawCondition, &condition); err != nil || len(condition) != 3 {
+			return invalidPolicy(fmt.Sprintf("Invalid Policy: Invalid condition: %s", rawCondition))
+		}
+		operator, _ := condition[0].(string)
+		operator = strings.ToLower(operator)
+		switch operator {
+		case "eq", "starts-with":
+			name, nameOK := condition[1].(string)
+			value, valueOK := condition[2].(string)
+			if !nameOK || !valueOK {
+				return invalidPolicy(fmt.Sprintf("Invalid Policy: Invalid condition: %s", rawCondition))
+			}
+			actual := fieldValue(name)
+			if (operator == "eq" && actual != value) || !strings.HasPrefix(actual, value) {
+				return conditionFailed
+			}
+		case "content-length-range":
+			min, minOK := condition[1].(float64)
+			max, maxOK := condition[2].(float64)
+			if !minOK || !maxOK {
+				return invalidPolicy(fmt.Sprintf("Invalid Policy: Invalid condition: %s", rawCondition))
+			}
+			if float64(size) < min {
+				return &xmlResponse{status: http.StatusBadRequest, errorCode: "EntityTooSmall"}
+			}
+			if float64(size) > max {
+				return &xmlResponse{status: http.StatusBadRequest, errorCode: "EntityTooLarge"}
+			}
+		default:
+			return invalidPolicy(fmt.Sprintf("Invalid Policy: Invalid condition: %s", rawCondition))
+		}
+	}
+	return nil
+}
+
+// verifyPostPolicySignature verifies the signature of the policy document,
+// which is signed either with the V4 scheme (x-goog-credential and
+// x-goog-signature fields) or the legacy V2 scheme (GoogleAccessId and
+// signature fields). The signature can only be verified when
+// Options.SignedURLKeys has the key of the signer.
+func (s *Server) verifyPostPolicySignature(r *http.Request, encodedPolicy string) *xmlResponse {
+	var signer string
+	var signature []byte
+	var err error
+	if credential := formValue(r, "x-goog-credential"); credential != "" {
+		signer = strings.SplitN(credential, "/", 2)[0]
+		signature, err = hex.DecodeString(formValue(r, "x-goog-signature"))
+	} else {
+		signer = formValue(r, "GoogleAccessId")
+		signature, err = base64.StdEncoding.DecodeString(formValue(r, "signature"))
+	}
+	key, ok := s.options.SignedURLKeys[signer]
+	if !ok {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(encodedPolicy))
+	if err != nil || rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+		return &xmlResponse{status: http.StatusForbidden, errorCode: "SignatureDoesNotMatch"}
+	}
+	return nil
+}
+
+// postObjectSuccessResponse builds the response to a successful form POST
+// upload, based on the success_action_redirect and success_action_status
+// fields of the form.
+func (s *Server) postObjectSuccessResponse(r *http.Request, obj Object) xmlResponse {
+	if redirect := formValue(r, "success_action_redirect"); redirect != "" {
+		if redirectURL, err := url.Parse(redirect); err == nil {
+			query := redirectURL.Query()
+			query.Set("bucket", obj.BucketName)
+			query.Set("key", obj.Name)
+			query.Set("etag", obj.Etag)
+			redirectURL.RawQuery = query.Encode()
+			return xmlResponse{
+				status: http.StatusSeeOther,
+				header: http.Header{"Location": []string{redirectURL.String()}},
+			}
+		}
+	}
+	switch formValue(r, "success_action_status") {
+	case "200":
+		return xmlResponse{status: http.StatusOK}
+	case "201":
+		return xmlResponse{
+			status: http.StatusCreated,
+			data: postObjectResponse{
+				Location: s.baseURL(r) + (&url.URL{Path: "/" + obj.BucketName + "/" + obj.Name}).String(),
+				Bucket:   obj.BucketName,
+				Key:      obj.Name,
+				ETag:     obj.Etag,
+			},
+		}
+	default:
+		return xmlResponse{status: http.StatusNoContent}
+	}
+}
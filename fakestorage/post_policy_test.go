@@ -0,0 +1,266 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func newPostPolicyRequest(t *testing.T, url string, fields map[string]string, content string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileWriter, err := writer.CreateFormFile("file", "object.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileWriter.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestFormDataUploadPostPolicy(t *testing.T) {
+	const (
+		accessID   = "signer@project.iam.gserviceaccount.com"
+		bucketName = "some-bucket"
+	)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	server, err := NewServerWithOptions(Options{
+		NoListener:         true,
+		SignedURLKeys:      map[string]*rsa.PublicKey{accessID: &key.PublicKey},
+		VerifyPostPolicies: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName})
+	client := server.HTTPClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	generatePolicy := func(t *testing.T, objectName string, fields *storage.PolicyV4Fields) *storage.PostPolicyV4 {
+		policy, err := storage.GenerateSignedPostPolicyV4(bucketName, objectName, &storage.PostPolicyV4Options{
+			GoogleAccessID: accessID,
+			PrivateKey:     privateKey,
+			Expires:        time.Now().Add(time.Hour),
+			Fields:         fields,
+			Conditions: []storage.PostPolicyV4Condition{
+				storage.ConditionStartsWith("$key", "uploads/"),
+				storage.ConditionContentLengthRange(1, 20),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return policy
+	}
+	expiredPolicy := base64.StdEncoding.EncodeToString([]byte(`{"expiration":"2020-01-01T00:00:00Z","conditions":[]}`))
+
+	tests := []struct {
+		name           string
+		policy         *storage.PostPolicyV4
+		modifyFields   func(map[string]string)
+		content        string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:           "valid policy",
+			policy:         generatePolicy(t, "uploads/valid.txt", &storage.PolicyV4Fields{ContentType: "text/plain"}),
+			content:        "some content",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "field not matching the policy",
+			policy:         generatePolicy(t, "uploads/key.txt", &storage.PolicyV4Fields{ContentType: "text/plain"}),
+			modifyFields:   func(fields map[string]string) { fields["content-type"] = "text/html" },
+			content:        "some content",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "InvalidPolicyDocument",
+		},
+		{
+			name:           "key not starting with the prefix",
+			policy:         generatePolicy(t, "other/key.txt", nil),
+			content:        "some content",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "InvalidPolicyDocument",
+		},
+		{
+			name:           "file too large",
+			policy:         generatePolicy(t, "uploads/large.txt", nil),
+			content:        "some content that is too large",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "EntityTooLarge",
+		},
+		{
+			name:           "empty file",
+			policy:         generatePolicy(t, "uploads/empty.txt", nil),
+			content:        "",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "EntityTooSmall",
+		},
+		{
+			name:           "invalid signature",
+			policy:         generatePolicy(t, "uploads/signature.txt", nil),
+			modifyFields:   func(fields map[string]string) { fields["x-goog-signature"] = "abcd" },
+			content:        "some content",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   "SignatureDoesNotMatch",
+		},
+		{
+			name: "expired policy",
+			policy: &storage.PostPolicyV4{
+				URL:    "https://storage.googleapis.com/" + bucketName + "/",
+				Fields: map[string]string{"key": "uploads/expired.txt", "policy": expiredPolicy},
+			},
+			content:        "some content",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "InvalidPolicyDocument",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			fields := map[string]string{}
+			for name, value := range test.policy.Fields {
+				fields[name] = value
+			}
+			if test.modifyFields != nil {
+				test.modifyFields(fields)
+			}
+			resp, err := client.Do(newPostPolicyRequest(t, test.policy.URL, fields, test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			_, err = server.GetObject(bucketName, fields["key"])
+			if test.expectedCode == "" {
+				if err != nil {
+					t.Errorf("object not created: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Error("object created despite the policy failure")
+			}
+			var xmlErr xmlErrorResponse
+			if err := xml.NewDecoder(resp.Body).Decode(&xmlErr); err != nil {
+				t.Fatal(err)
+			}
+			if xmlErr.Code != test.expectedCode {
+				t.Errorf("wrong error code\nwant %q\ngot  %q", test.expectedCode, xmlErr.Code)
+			}
+		})
+	}
+
+	t.Run("success action status", func(t *testing.T) {
+		policy := generatePolicy(t, "uploads/created.txt", &storage.PolicyV4Fields{StatusCodeOnSuccess: http.StatusCreated})
+		resp, err := client.Do(newPostPolicyRequest(t, policy.URL, policy.Fields, "some content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusCreated, resp.StatusCode)
+		}
+		var postResp postObjectResponse
+		if err := xml.NewDecoder(resp.Body).Decode(&postResp); err != nil {
+			t.Fatal(err)
+		}
+		if postResp.Bucket != bucketName || postResp.Key != "uploads/created.txt" {
+			t.Errorf("wrong bucket or key in the response: %+v", postResp)
+		}
+		if !strings.HasSuffix(postResp.Location, "/some-bucket/uploads/created.txt") {
+			t.Errorf("wrong location: %q", postResp.Location)
+		}
+	})
+
+	t.Run("success action redirect", func(t *testing.T) {
+		const redirectURL = "https://example.com/done?upload=1"
+		policy := generatePolicy(t, "uploads/redirect.txt", &storage.PolicyV4Fields{RedirectToURLOnSuccess: redirectURL})
+		resp, err := client.Do(newPostPolicyRequest(t, policy.URL, policy.Fields, "some content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusSeeOther, resp.StatusCode)
+		}
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := location.Query()
+		if location.Host != "example.com" || query.Get("upload") != "1" || query.Get("bucket") != bucketName || query.Get("key") != "uploads/redirect.txt" || query.Get("etag") == "" {
+			t.Errorf("wrong redirect location: %s", location)
+		}
+	})
+}
+
+func TestFormDataUploadPostPolicyNotVerified(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+
+	fields := map[string]string{
+		"key":    "object.txt",
+		"policy": base64.StdEncoding.EncodeToString([]byte(`{"expiration":"2020-01-01T00:00:00Z","conditions":[]}`)),
+	}
+	resp, err := server.HTTPClient().Do(newPostPolicyRequest(t, "https://storage.googleapis.com/some-bucket", fields, "some content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusNoContent, resp.StatusCode)
+	}
+	obj, err := server.GetObject("some-bucket", "object.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "some content" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "some content", string(obj.Content))
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+)
+
+// objectPreconditions are the generation and metageneration preconditions of
+// a request. Nil values mean the precondition wasn't set.
+type objectPreconditions struct {
+	ifGenerationMatch        *int64
+	ifGenerationNotMatch     *int64
+	ifMetagenerationMatch    *int64
+	ifMetagenerationNotMatch *int64
+}
+
+// parseObjectPreconditions reads the preconditions from the query string,
+// falling back to the equivalent x-goog-if-* headers of the XML API. When
+// source is true, the preconditions on the source object of a copy or
+// rewrite are read instead (ifSourceGenerationMatch and friends).
+func parseObjectPreconditions(r *http.Request, source bool) (objectPreconditions, *jsonResponse) {
+	var prefix string
+	if source {
+		prefix = "Source"
+	}
+	var conds objectPreconditions
+	params := []struct {
+		name   string
+		header string
+		value  **int64
+	}{
+		{"if" + prefix + "GenerationMatch", "X-Goog-If-Generation-Match", &conds.ifGenerationMatch},
+		{"if" + prefix + "GenerationNotMatch", "X-Goog-If-Generation-Not-Match", &conds.ifGenerationNotMatch},
+		{"if" + prefix + "MetagenerationMatch", "X-Goog-If-Metageneration-Match", &conds.ifMetagenerationMatch},
+		{"if" + prefix + "MetagenerationNotMatch", "X-Goog-If-Metageneration-Not-Match", &conds.ifMetagenerationNotMatch},
+	}
+	for _, param := range params {
+		value := r.URL.Query().Get(param.name)
+		if value == "" && !source {
+			value = r.Header.Get(param.header)
+		}
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return objectPreconditions{}, &jsonResponse{
+				status:       http.StatusBadRequest,
+				errorMessage: "Invalid argument for " + param.name,
+			}
+		}
+		*param.value = &n
+	}
+	return conds, nil
+}
+
+// check verifies the preconditions against obj, which is nil if the object
+// doesn't exist. As in Cloud Storage, ifGenerationMatch=0 requires the object
+// to not exist, and ifGenerationNotMatch=0 requires it to exist. When read is
+// true, failing one of the "not match" preconditions results in 304 Not
+// Modified instead of 412 Precondition Failed.
+func (c objectPreconditions) check(obj *ObjectAttrs, read bool) *jsonResponse {
+	failed := preconditionFailed("If-Match")
+	metagenerationFailed := preconditionFailed("If-Metageneration-Match")
+	notModified, metagenerationNotModified := failed, metagenerationFailed
+	if read {
+		notModified = &jsonResponse{status: http.StatusNotModified}
+		metagenerationNotModified = notModified
+	}
+
+	var generation, metageneration int64
+	if obj != nil {
+		generation = obj.Generation
+		metageneration = obj.Metageneration
+	}
+	if c.ifGenerationMatch != nil {
+		if *c.ifGenerationMatch == 0 {
+			if obj != nil {
+				return failed
+			}
+		} else if obj == nil || generation != *c.ifGenerationMatch {
+			return failed
+		}
+	}
+	if c.ifMetagenerationMatch != nil && (obj == nil || metageneration != *c.ifMetagenerationMatch) {
+		return metagenerationFailed
+	}
+	if c.ifGenerationNotMatch != nil {
+		if *c.ifGenerationNotMatch == 0 {
+			if obj == nil {
+				return notModified
+			}
+		} else if obj != nil && generation == *c.ifGenerationNotMatch {
+			return notModified
+		}
+	}
+	if c.ifMetagenerationNotMatch != nil && obj != nil && metageneration == *c.ifMetagenerationNotMatch {
+		return metagenerationNotModified
+	}
+	return nil
+}
+
+// toBackend returns the preconditions as the conditions of a backend write,
+// so they're enforced atomically with the write instead of only being
+// checked beforehand.
+func (c objectPreconditions) toBackend() backend.Conditions {
+	return backend.Conditions{
+		GenerationMatch:        c.ifGenerationMatch,
+		GenerationNotMatch:     c.ifGenerationNotMatch,
+		MetagenerationMatch:    c.ifMetagenerationMatch,
+		MetagenerationNotMatch: c.ifMetagenerationNotMatch,
+	}
+}
+
+// checkMetageneration verifies the metageneration preconditions against the
+// metageneration of a bucket, which has no generation.
+func (c objectPreconditions) checkMetageneration(metageneration int64) *jsonResponse {
+	if c.ifMetagenerationMatch != nil && metageneration != *c.ifMetagenerationMatch ||
+		c.ifMetagenerationNotMatch != nil && metageneration == *c.ifMetagenerationNotMatch {
+		return preconditionFailed("If-Metageneration-Match")
+	}
+	return nil
+}
+
+// preconditionFailed returns the error for a failed precondition, which
+// Cloud Storage reports as a failed header even when it's sent as a query
+// parameter.
+func preconditionFailed(header string) *jsonResponse {
+	return &jsonResponse{
+		status:            http.StatusPreconditionFailed,
+		errorMessage:      "Precondition failed",
+		errorReason:       "conditionNotMet",
+		errorLocationType: "header",
+		errorLocation:     header,
+	}
+}
+
+// conditionHeader returns the header reported for a failed backend
+// condition, the same check reports for the matching precondition.
+func conditionHeader(condition string) string {
+	if strings.HasPrefix(condition, "Metageneration") {
+		return "If-Metageneration-Match"
+	}
+	return "If-Match"
+}
+
+// checkObjectPreconditions verifies the preconditions in the request against
+// the live version of the given object, returning them so they can also be
+// enforced when the object is written.
+func (s *Server) checkObjectPreconditions(r *http.Request, bucketName, objectName string) (objectPreconditions, *jsonResponse) {
+	conds, errResp := parseObjectPreconditions(r, false)
+	if errResp != nil {
+		return conds, errResp
+	}
+	var attrs *ObjectAttrs
+	if obj, err := s.GetObject(bucketName, objectName); err == nil {
+		attrs = &obj.ObjectAttrs
+	}
+	return conds, conds.check(attrs, false)
+}
+
+// objectETag returns the strong entity tag of the object served on
+// downloads, its quoted MD5 hash.
+func objectETag(obj Object) string {
+	if obj.Etag != "" {
+		if strings.HasPrefix(obj.Etag, `"`) {
+			return obj.Etag
+		}
+		return strconv.Quote(obj.Etag)
+	}
+	md5Hash := obj.Md5Hash
+	if md5Hash == "" {
+		md5Hash = checksum.EncodedMd5Hash(obj.Content)
+	}
+	return strconv.Quote(md5Hash)
+}
+
+// checkConditionalHeaders evaluates the HTTP conditional request headers
+// (If-Match, If-Unmodified-Since, If-None-Match and If-Modified-Since)
+// against the entity tag and update time of an object, in the order defined
+// by RFC 7232. If-None-Match and If-Modified-Since result in 304 Not Modified
+// on reads, while the other headers result in 412 Precondition Failed.
+func checkConditionalHeaders(r *http.Request, etag string, updated time.Time) *jsonResponse {
+	failed := &jsonResponse{
+		status:       http.StatusPreconditionFailed,
+		errorMessage: "Precondition failed",
+	}
+	notModified := &jsonResponse{status: http.StatusNotModified}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		notModified = failed
+	}
+	// HTTP dates don't include fractions of seconds.
+	updated = updated.Truncate(time.Second)
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !matchesETag(ifMatch, etag, false) {
+			return failed
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && updated.After(t) {
+		return failed
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchesETag(ifNoneMatch, etag, true) {
+			return notModified
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updated.After(t) {
+		return notModified
+	}
+	return nil
+}
+
+// matchesETag reports whether the list of entity tags in the value of an
+// If-Match or If-None-Match header includes etag. Weak entity tags only
+// match when weak is true.
+func matchesETag(header, etag string, weak bool) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" {
+			return true
+		}
+		if strings.HasPrefix(value, "W/") {
+			if !weak {
+				continue
+			}
+			value = strings.TrimPrefix(value, "W/")
+		}
+		if value == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,432 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"google.golang.org/api/googleapi"
+)
+
+func TestObjectPreconditionsCheck(t *testing.T) {
+	value := func(n int64) *int64 { return &n }
+	obj := &ObjectAttrs{Generation: 10, Metageneration: 2}
+	tests := []struct {
+		name           string
+		conds          objectPreconditions
+		obj            *ObjectAttrs
+		read           bool
+		expectedStatus int
+	}{
+		{"no preconditions", objectPreconditions{}, obj, false, 0},
+		{"generation match", objectPreconditions{ifGenerationMatch: value(10)}, obj, false, 0},
+		{"generation mismatch", objectPreconditions{ifGenerationMatch: value(9)}, obj, false, http.StatusPreconditionFailed},
+		{"generation match on missing object", objectPreconditions{ifGenerationMatch: value(10)}, nil, false, http.StatusPreconditionFailed},
+		{"does not exist", objectPreconditions{ifGenerationMatch: value(0)}, nil, false, 0},
+		{"does not exist on existing object", objectPreconditions{ifGenerationMatch: value(0)}, obj, false, http.StatusPreconditionFailed},
+		{"generation not match", objectPreconditions{ifGenerationNotMatch: value(9)}, obj, false, 0},
+		{"generation not match failure", objectPreconditions{ifGenerationNotMatch: value(10)}, obj, false, http.StatusPreconditionFailed},
+		{"generation not match failure on read", objectPreconditions{ifGenerationNotMatch: value(10)}, obj, true, http.StatusNotModified},
+		{"exists on missing object", objectPreconditions{ifGenerationNotMatch: value(0)}, nil, false, http.StatusPreconditionFailed},
+		{"metageneration match", objectPreconditions{ifMetagenerationMatch: value(2)}, obj, false, 0},
+		{"metageneration mismatch", objectPreconditions{ifMetagenerationMatch: value(1)}, obj, false, http.StatusPreconditionFailed},
+		{"metageneration match on missing object", objectPreconditions{ifMetagenerationMatch: value(1)}, nil, false, http.StatusPreconditionFailed},
+		{"metageneration not match", objectPreconditions{ifMetagenerationNotMatch: value(1)}, obj, false, 0},
+		{"metageneration not match failure", objectPreconditions{ifMetagenerationNotMatch: value(2)}, obj, false, http.StatusPreconditionFailed},
+		{"metageneration not match on missing object", objectPreconditions{ifMetagenerationNotMatch: value(2)}, nil, false, 0},
+		{
+			"match takes precedence over not match",
+			objectPreconditions{ifGenerationMatch: value(9), ifMetagenerationNotMatch: value(2)},
+			obj,
+			true,
+			http.StatusPreconditionFailed,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp := test.conds.check(test.obj, test.read)
+			var status int
+			if resp != nil {
+				status = resp.status
+			}
+			if status != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, status)
+			}
+		})
+	}
+}
+
+func TestBackendConditionErrorHeader(t *testing.T) {
+	tests := []struct {
+		err            error
+		expectedHeader string
+	}{
+		{&backend.ConditionError{Condition: "GenerationMatch"}, "If-Match"},
+		{&backend.ConditionError{Condition: "GenerationNotMatch"}, "If-Match"},
+		{&backend.ConditionError{Condition: "MetagenerationMatch"}, "If-Metageneration-Match"},
+		{&backend.ConditionError{Condition: "MetagenerationNotMatch"}, "If-Metageneration-Match"},
+		{fmt.Errorf("failed to write: %w", &backend.ConditionError{Condition: "MetagenerationMatch"}), "If-Metageneration-Match"},
+		{backend.PreconditionFailed, "If-Match"},
+	}
+	for _, test := range tests {
+		resp := errToJsonResponse(test.err)
+		if resp.status != http.StatusPreconditionFailed || resp.errorLocation != test.expectedHeader {
+			t.Errorf("wrong response for %v\nwant %d with header %s\ngot  %d with header %s", test.err, http.StatusPreconditionFailed, test.expectedHeader, resp.status, resp.errorLocation)
+		}
+	}
+}
+
+func TestServerClientObjectPreconditions(t *testing.T) {
+	const (
+		bucketName = "some-bucket"
+		objectName = "some/object.txt"
+		content    = "some content"
+	)
+	objs := []Object{
+		{
+			ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName, Generation: 1234},
+			Content:     []byte(content),
+		},
+	}
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		client := server.Client()
+		objHandle := client.Bucket(bucketName).Object(objectName)
+		attrs, err := objHandle.Attrs(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Metageneration != 1 {
+			t.Errorf("wrong metageneration\nwant %d\ngot  %d", 1, attrs.Metageneration)
+		}
+		isPreconditionFailure := func(err error) bool {
+			var apiErr *googleapi.Error
+			return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+		}
+		wrongGeneration := attrs.Generation + 1
+
+		reader, err := objHandle.If(storage.Conditions{GenerationMatch: attrs.Generation}).NewReader(context.TODO())
+		if err != nil {
+			t.Fatalf("unexpected error reading with a matching generation: %v", err)
+		}
+		io.Copy(io.Discard, reader)
+		reader.Close()
+		if _, err := objHandle.If(storage.Conditions{MetagenerationMatch: 2}).NewReader(context.TODO()); err == nil {
+			t.Error("unexpected <nil> error reading with a mismatched metageneration")
+		}
+
+		_, err = objHandle.If(storage.Conditions{MetagenerationMatch: 2}).Update(context.TODO(), storage.ObjectAttrsToUpdate{
+			Metadata: map[string]string{"key": "value"},
+		})
+		if !isPreconditionFailure(err) {
+			t.Errorf("expected precondition failure updating with a mismatched metageneration, got %v", err)
+		}
+
+		dst := client.Bucket(bucketName).Object("copy.txt")
+		_, err = dst.CopierFrom(objHandle.If(storage.Conditions{GenerationMatch: wrongGeneration})).Run(context.TODO())
+		if !isPreconditionFailure(err) {
+			t.Errorf("expected precondition failure copying with a mismatched source generation, got %v", err)
+		}
+		if _, err := dst.If(storage.Conditions{DoesNotExist: true}).CopierFrom(objHandle).Run(context.TODO()); err != nil {
+			t.Fatalf("unexpected error copying to a new object: %v", err)
+		}
+		_, err = dst.If(storage.Conditions{DoesNotExist: true}).CopierFrom(objHandle).Run(context.TODO())
+		if !isPreconditionFailure(err) {
+			t.Errorf("expected precondition failure copying over an existing object, got %v", err)
+		}
+
+		err = objHandle.If(storage.Conditions{GenerationMatch: wrongGeneration}).Delete(context.TODO())
+		if !isPreconditionFailure(err) {
+			t.Errorf("expected precondition failure deleting with a mismatched generation, got %v", err)
+		}
+		if _, err := server.GetObject(bucketName, objectName); err != nil {
+			t.Fatalf("object deleted despite failed precondition: %v", err)
+		}
+		if err := objHandle.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(context.TODO()); err != nil {
+			t.Errorf("unexpected error deleting with a matching generation: %v", err)
+		}
+	})
+}
+
+func TestServerFSConditionalWrites(t *testing.T) {
+	dir, err := os.MkdirTemp(tempDir(), "fakestorage-conditions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := NewServerWithOptions(Options{NoListener: true, StorageRoot: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "object.txt"}, Content: []byte("content")})
+	isPreconditionFailure := func(err error) bool {
+		var apiErr *googleapi.Error
+		return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+	}
+	ctx := context.TODO()
+	objHandle := server.Client().Bucket("some-bucket").Object("object.txt")
+	write := func(conds storage.Conditions) (*storage.ObjectAttrs, error) {
+		w := objHandle.If(conds).NewWriter(ctx)
+		w.Write([]byte("new content"))
+		err := w.Close()
+		return w.Attrs(), err
+	}
+
+	attrs, err := objHandle.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := write(storage.Conditions{GenerationMatch: attrs.Generation})
+	if err != nil {
+		t.Fatalf("unexpected error writing with the generation read: %v", err)
+	}
+	if updated.Generation <= attrs.Generation {
+		t.Errorf("generation didn't increase\nwant more than %d\ngot  %d", attrs.Generation, updated.Generation)
+	}
+	if _, err := write(storage.Conditions{GenerationMatch: attrs.Generation}); !isPreconditionFailure(err) {
+		t.Errorf("expected precondition failure writing with a replaced generation, got %v", err)
+	}
+	_, err = objHandle.If(storage.Conditions{GenerationMatch: attrs.Generation}).ComposerFrom(objHandle).Run(ctx)
+	if !isPreconditionFailure(err) {
+		t.Errorf("expected precondition failure composing over a replaced generation, got %v", err)
+	}
+	if _, err := objHandle.If(storage.Conditions{GenerationMatch: updated.Generation}).ComposerFrom(objHandle).Run(ctx); err != nil {
+		t.Errorf("unexpected error composing with the current generation: %v", err)
+	}
+}
+
+func TestServerConcurrentConditionalUploads(t *testing.T) {
+	runServersTest(t, runServersOptions{objs: []Object{{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "other.txt"}}}}, func(t *testing.T, server *Server) {
+		const uploads = 10
+		url := server.URL() + "/upload/storage/v1/b/some-bucket/o?uploadType=media&name=lock.txt&ifGenerationMatch=0"
+		var wg sync.WaitGroup
+		statuses := make(chan int, uploads)
+		for i := 0; i < uploads; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// large uploads keep the requests busy between the
+				// precondition check and the write.
+				resp, err := server.HTTPClient().Post(url, "text/plain", bytes.NewReader(bytes.Repeat([]byte(strconv.Itoa(i)), 1<<20)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}(i)
+		}
+		wg.Wait()
+		close(statuses)
+		var created int
+		for status := range statuses {
+			switch status {
+			case http.StatusOK:
+				created++
+			case http.StatusPreconditionFailed:
+			default:
+				t.Errorf("unexpected status %d", status)
+			}
+		}
+		if created != 1 {
+			t.Errorf("wrong number of uploads creating the object\nwant 1\ngot  %d", created)
+		}
+	})
+}
+
+func TestServerObjectPreconditionsNotModified(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{
+				ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "object.txt", Generation: 1234},
+				Content:     []byte("content"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+	}{
+		{
+			"metadata with matching generation",
+			"https://storage.googleapis.com/storage/v1/b/some-bucket/o/object.txt?ifGenerationNotMatch=1234",
+			http.StatusNotModified,
+		},
+		{
+			"media with matching metageneration",
+			"https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/object.txt?alt=media&ifMetagenerationNotMatch=1",
+			http.StatusNotModified,
+		},
+		{
+			"media with other generation",
+			"https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/object.txt?alt=media&ifGenerationNotMatch=1",
+			http.StatusOK,
+		},
+		{
+			"invalid precondition",
+			"https://storage.googleapis.com/storage/v1/b/some-bucket/o/object.txt?ifGenerationMatch=abc",
+			http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Get(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCheckConditionalHeaders(t *testing.T) {
+	const etag = `"abc"`
+	updated := time.Date(2022, time.May, 1, 10, 0, 0, 500, time.UTC)
+	before := updated.Add(-time.Hour).Format(http.TimeFormat)
+	after := updated.Add(time.Hour).Format(http.TimeFormat)
+	tests := []struct {
+		name           string
+		method         string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{"no headers", http.MethodGet, nil, 0},
+		{"if-match", http.MethodGet, map[string]string{"If-Match": `"xyz", "abc"`}, 0},
+		{"if-match any", http.MethodGet, map[string]string{"If-Match": "*"}, 0},
+		{"if-match failure", http.MethodGet, map[string]string{"If-Match": `"xyz"`}, http.StatusPreconditionFailed},
+		{"if-match weak", http.MethodGet, map[string]string{"If-Match": `W/"abc"`}, http.StatusPreconditionFailed},
+		{"if-none-match", http.MethodGet, map[string]string{"If-None-Match": `"xyz"`}, 0},
+		{"if-none-match failure", http.MethodGet, map[string]string{"If-None-Match": `"abc"`}, http.StatusNotModified},
+		{"if-none-match weak failure", http.MethodHead, map[string]string{"If-None-Match": `W/"abc"`}, http.StatusNotModified},
+		{"if-none-match failure on write", http.MethodPut, map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed},
+		{"if-modified-since", http.MethodGet, map[string]string{"If-Modified-Since": before}, 0},
+		{"if-modified-since failure", http.MethodGet, map[string]string{"If-Modified-Since": updated.Format(http.TimeFormat)}, http.StatusNotModified},
+		{"if-unmodified-since", http.MethodGet, map[string]string{"If-Unmodified-Since": after}, 0},
+		{"if-unmodified-since failure", http.MethodGet, map[string]string{"If-Unmodified-Since": before}, http.StatusPreconditionFailed},
+		{
+			"if-none-match takes precedence over if-modified-since",
+			http.MethodGet,
+			map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": after},
+			0,
+		},
+		{
+			"if-match takes precedence over if-unmodified-since",
+			http.MethodGet,
+			map[string]string{"If-Match": etag, "If-Unmodified-Since": before},
+			0,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, "https://storage.googleapis.com/some-bucket/object.txt", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for header, value := range test.headers {
+				req.Header.Set(header, value)
+			}
+			resp := checkConditionalHeaders(req, etag, updated)
+			var status int
+			if resp != nil {
+				status = resp.status
+			}
+			if status != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, status)
+			}
+		})
+	}
+}
+
+func TestServerConditionalDownload(t *testing.T) {
+	const content = "some content"
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "object.txt"}, Content: []byte(content)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	const url = "https://storage.googleapis.com/some-bucket/object.txt"
+	resp, err := server.HTTPClient().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("missing ETag or Last-Modified headers: %q, %q", etag, lastModified)
+	}
+
+	tests := []struct {
+		name           string
+		header         string
+		value          string
+		expectedStatus int
+	}{
+		{"if-none-match", "If-None-Match", etag, http.StatusNotModified},
+		{"if-match", "If-Match", etag, http.StatusOK},
+		{"if-match failure", "If-Match", `"some-other-etag"`, http.StatusPreconditionFailed},
+		{"if-modified-since", "If-Modified-Since", lastModified, http.StatusNotModified},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(test.header, test.value)
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if value := resp.Header.Get("ETag"); value != etag {
+				t.Errorf("wrong ETag header\nwant %q\ngot  %q", etag, value)
+			}
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expectedStatus == http.StatusOK && string(data) != content {
+				t.Errorf("wrong content\nwant %q\ngot  %q", content, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type serviceAccountResponse struct {
+	Kind         string `json:"kind"`
+	EmailAddress string `json:"email_address"`
+}
+
+// projectNumber returns a fake, but stable, 12-digit project number for the
+// project.
+func projectNumber(projectID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(projectID))
+	return 100000000000 + h.Sum64()%900000000000
+}
+
+// serviceAgentEmail returns the email of the Cloud Storage service agent of
+// the project, which is the identity that publishes Pub/Sub notifications.
+func serviceAgentEmail(projectID string) string {
+	return fmt.Sprintf("service-%d@gs-project-accounts.iam.gserviceaccount.com", projectNumber(projectID))
+}
+
+func (s *Server) getServiceAccount(r *http.Request) jsonResponse {
+	return jsonResponse{data: serviceAccountResponse{
+		Kind:         "storage#serviceAccount",
+		EmailAddress: serviceAgentEmail(mux.Vars(r)["projectId"]),
+	}}
+}
@@ -0,0 +1,38 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"regexp"
+	"testing"
+)
+
+func TestServiceAccount(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		client := server.Client()
+		email, err := client.ServiceAccount(context.Background(), "my-project")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(`^service-\d{12}@gs-project-accounts\.iam\.gserviceaccount\.com$`).MatchString(email) {
+			t.Errorf("wrong service account email: %q", email)
+		}
+		again, err := client.ServiceAccount(context.Background(), "my-project")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != email {
+			t.Errorf("service account email isn't stable\nwant %q\ngot  %q", email, again)
+		}
+		other, err := client.ServiceAccount(context.Background(), "other-project")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other == email {
+			t.Errorf("same service account email for different projects: %q", email)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// BucketQuota limits the objects stored in a bucket. Zero values mean no
+// limit.
+type BucketQuota struct {
+	MaxObjects int   `json:"maxObjects,omitempty"`
+	MaxBytes   int64 `json:"maxBytes,omitempty"`
+}
+
+// quotaExceededError is returned when creating an object would exceed the
+// quota of its bucket.
+type quotaExceededError struct {
+	bucketName string
+	limit      string
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded for bucket %s: %s", e.bucketName, e.limit)
+}
+
+type bucketQuotas struct {
+	mtx    sync.RWMutex
+	quotas map[string]BucketQuota
+
+	// writeMtx serializes the creation of objects in buckets with a quota,
+	// so the usage can't change between checking it and creating the
+	// object.
+	writeMtx sync.Mutex
+}
+
+func (q *bucketQuotas) set(bucketName string, quota BucketQuota) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if quota == (BucketQuota{}) {
+		delete(q.quotas, bucketName)
+		return
+	}
+	if q.quotas == nil {
+		q.quotas = make(map[string]BucketQuota)
+	}
+	q.quotas[bucketName] = quota
+}
+
+func (q *bucketQuotas) get(bucketName string) (BucketQuota, bool) {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+	quota, ok := q.quotas[bucketName]
+	return quota, ok
+}
+
+// SetBucketQuota limits the number of objects and/or bytes stored in the
+// bucket. Uploads that would exceed the quota fail with a 403 error with the
+// "quotaExceeded" reason. Only the live version of the objects counts
+// towards the quota, and replacing an object only counts the difference in
+// size. A zero quota removes the limits.
+func (s *Server) SetBucketQuota(bucketName string, quota BucketQuota) error {
+	if quota.MaxObjects < 0 || quota.MaxBytes < 0 {
+		return fmt.Errorf("invalid quota for bucket %s: limits can't be negative", bucketName)
+	}
+	s.quotas.set(bucketName, quota)
+	return nil
+}
+
+// checkQuota returns a quotaExceededError if storing obj would exceed the
+// quota of its bucket.
+func (s *Server) checkQuota(obj Object, quota BucketQuota) error {
+	objs, err := s.backend.ListObjects(obj.BucketName, "", false)
+	if err != nil {
+		// the bucket doesn't exist yet, so it's empty.
+		objs = nil
+	}
+	count := len(objs) + 1
+	size := obj.Size
+	for _, existing := range objs {
+		if existing.Name == obj.Name {
+			count--
+			continue
+		}
+		size += existing.Size
+	}
+	if quota.MaxObjects > 0 && count > quota.MaxObjects {
+		return &quotaExceededError{obj.BucketName, fmt.Sprintf("the limit is %d objects", quota.MaxObjects)}
+	}
+	if quota.MaxBytes > 0 && size > quota.MaxBytes {
+		return &quotaExceededError{obj.BucketName, fmt.Sprintf("the limit is %d bytes", quota.MaxBytes)}
+	}
+	return nil
+}
+
+type bucketQuotasResponse struct {
+	Kind    string                 `json:"kind"`
+	Buckets map[string]BucketQuota `json:"buckets"`
+}
+
+func (s *Server) listBucketQuotas(r *http.Request) jsonResponse {
+	s.quotas.mtx.RLock()
+	defer s.quotas.mtx.RUnlock()
+	resp := bucketQuotasResponse{
+		Kind:    "fakestorage#bucketQuotas",
+		Buckets: make(map[string]BucketQuota, len(s.quotas.quotas)),
+	}
+	for bucketName, quota := range s.quotas.quotas {
+		resp.Buckets[bucketName] = quota
+	}
+	return jsonResponse{data: resp}
+}
+
+func (s *Server) setBucketQuota(r *http.Request) jsonResponse {
+	var data struct {
+		Bucket string `json:"bucket"`
+		BucketQuota
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Bucket == "" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Bucket quota payload can not be parsed."}
+	}
+	if err := s.SetBucketQuota(data.Bucket, data.BucketQuota); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	return s.listBucketQuotas(r)
+}
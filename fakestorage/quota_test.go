@@ -0,0 +1,199 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestBucketQuota(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: "limited-bucket"})
+		if err := server.SetBucketQuota("limited-bucket", BucketQuota{MaxObjects: -1}); err == nil {
+			t.Error("unexpected <nil> error setting a negative quota")
+		}
+		if err := server.SetBucketQuota("limited-bucket", BucketQuota{MaxObjects: 2, MaxBytes: 20}); err != nil {
+			t.Fatal(err)
+		}
+
+		client := server.Client()
+		write := func(name, content string) error {
+			w := client.Bucket("limited-bucket").Object(name).NewWriter(context.Background())
+			if _, err := w.Write([]byte(content)); err != nil {
+				return err
+			}
+			return w.Close()
+		}
+
+		tests := []struct {
+			name          string
+			objectName    string
+			content       string
+			expectSuccess bool
+		}{
+			{"first object", "obj1", "0123456789", true},
+			{"second object", "obj2", "01234", true},
+			{"too many objects", "obj3", "0", false},
+			{"replace within the byte limit", "obj1", "012345678901234", true},
+			{"replace over the byte limit", "obj1", "0123456789012345", false},
+		}
+		for _, test := range tests {
+			err := write(test.objectName, test.content)
+			if test.expectSuccess {
+				if err != nil {
+					t.Errorf("%s: unexpected error: %v", test.name, err)
+				}
+				continue
+			}
+			var apiErr *googleapi.Error
+			if !errors.As(err, &apiErr) {
+				t.Errorf("%s: expected a googleapi error, got %v", test.name, err)
+				continue
+			}
+			if apiErr.Code != http.StatusForbidden {
+				t.Errorf("%s: wrong status\nwant %d\ngot  %d", test.name, http.StatusForbidden, apiErr.Code)
+			}
+			if len(apiErr.Errors) != 1 || apiErr.Errors[0].Reason != "quotaExceeded" {
+				t.Errorf("%s: wrong error reason: %+v", test.name, apiErr.Errors)
+			}
+		}
+
+		compose := func(name string, sources ...string) error {
+			var handles []*storage.ObjectHandle
+			for _, source := range sources {
+				handles = append(handles, client.Bucket("limited-bucket").Object(source))
+			}
+			_, err := client.Bucket("limited-bucket").Object(name).ComposerFrom(handles...).Run(context.Background())
+			return err
+		}
+		if err := compose("obj3", "obj2"); !isQuotaExceeded(err) {
+			t.Errorf("expected a quota error composing too many objects, got %v", err)
+		}
+		if err := compose("obj2", "obj1", "obj2"); !isQuotaExceeded(err) {
+			t.Errorf("expected a quota error composing over the byte limit, got %v", err)
+		}
+		if err := compose("obj2", "obj2"); err != nil {
+			t.Errorf("unexpected error composing within the limits: %v", err)
+		}
+
+		if err := server.SetBucketQuota("limited-bucket", BucketQuota{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := write("obj3", "0"); err != nil {
+			t.Errorf("unexpected error after removing the quota: %v", err)
+		}
+	})
+}
+
+func isQuotaExceeded(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden && len(apiErr.Errors) == 1 && apiErr.Errors[0].Reason == "quotaExceeded"
+}
+
+func TestBucketQuotaEndpoint(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedQuota  BucketQuota
+	}{
+		{
+			"valid quota",
+			`{"bucket":"some-bucket","maxObjects":10,"maxBytes":1024}`,
+			http.StatusOK,
+			BucketQuota{MaxObjects: 10, MaxBytes: 1024},
+		},
+		{
+			"negative quota",
+			`{"bucket":"some-bucket","maxBytes":-1}`,
+			http.StatusBadRequest,
+			BucketQuota{MaxObjects: 10, MaxBytes: 1024},
+		},
+		{
+			"missing bucket",
+			`{"maxObjects":1}`,
+			http.StatusBadRequest,
+			BucketQuota{MaxObjects: 10, MaxBytes: 1024},
+		},
+		{
+			"remove quota",
+			`{"bucket":"some-bucket"}`,
+			http.StatusOK,
+			BucketQuota{},
+		},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/quotas", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("%s: wrong status returned\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+		}
+
+		resp, err = client.Get("https://storage.googleapis.com/_internal/quotas")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var quotas bucketQuotasResponse
+		err = json.NewDecoder(resp.Body).Decode(&quotas)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quotas.Buckets["some-bucket"] != test.expectedQuota {
+			t.Errorf("%s: wrong quota\nwant %+v\ngot  %+v", test.name, test.expectedQuota, quotas.Buckets["some-bucket"])
+		}
+	}
+}
+
+func TestMemoryLimits(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true, MemoryLimits: MemoryLimits{MaxObjects: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+	client := server.Client()
+	write := func(name string) error {
+		w := client.Bucket("some-bucket").Object(name).NewWriter(context.Background())
+		w.Write([]byte("some content"))
+		return w.Close()
+	}
+	if err := write("obj1"); err != nil {
+		t.Fatal(err)
+	}
+	err = write("obj2")
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected a googleapi error, got %v", err)
+	}
+	if apiErr.Code != http.StatusForbidden {
+		t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusForbidden, apiErr.Code)
+	}
+	if len(apiErr.Errors) != 1 || apiErr.Errors[0].Reason != "quotaExceeded" {
+		t.Errorf("wrong error reason: %+v", apiErr.Errors)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// byteRange is a range of the content of an object. Both ends are inclusive.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (r byteRange) contentRange(size int) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseRange parses the value of the Range header for content of the given
+// size, supporting multiple ranges and suffix ranges such as "bytes=-500".
+//
+// It returns no ranges when the header is missing or malformed, in which
+// case the whole content should be served, and errUnsatisfiableRange when
+// none of the ranges overlap the content. Ranges extending past the end of
+// the content are truncated.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, nil
+	}
+	var ranges []byteRange
+	for _, spec := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		parts := strings.SplitN(spec, "-", 2)
+		if len(parts) != 2 {
+			return nil, nil
+		}
+		first, last := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var r byteRange
+		if first == "" {
+			// suffix range, with the number of bytes at the end of the
+			// content.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, end: size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+			}
+			if start >= size {
+				continue
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r = byteRange{start: start, end: end}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// multipartByteRanges builds the multipart/byteranges body used to serve
+// multiple ranges of the object, returning it along with its content type.
+func multipartByteRanges(obj Object, ranges []byteRange) ([]byte, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, r := range ranges {
+		header := make(textproto.MIMEHeader)
+		if obj.ContentType != "" {
+			header.Set(contentTypeHeader, obj.ContentType)
+		}
+		header.Set("Content-Range", r.contentRange(len(obj.Content)))
+		part, _ := mw.CreatePart(header)
+		part.Write(obj.Content[r.start : r.end+1])
+	}
+	mw.Close()
+	return buf.Bytes(), "multipart/byteranges; boundary=" + mw.Boundary()
+}
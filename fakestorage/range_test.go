@@ -0,0 +1,132 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header         string
+		size           int64
+		expectedRanges []byteRange
+		expectedErr    error
+	}{
+		{"", 10, nil, nil},
+		{"bytes=0-4", 10, []byteRange{{0, 4}}, nil},
+		{"bytes=5-", 10, []byteRange{{5, 9}}, nil},
+		{"bytes=5-100", 10, []byteRange{{5, 9}}, nil},
+		{"bytes=-3", 10, []byteRange{{7, 9}}, nil},
+		{"bytes=-30", 10, []byteRange{{0, 9}}, nil},
+		{"bytes=0-1, 4-5,-2", 10, []byteRange{{0, 1}, {4, 5}, {8, 9}}, nil},
+		{"bytes=0-1,10-12", 10, []byteRange{{0, 1}}, nil},
+		{"bytes=10-", 10, nil, errUnsatisfiableRange},
+		{"bytes=10-12,-0", 10, nil, errUnsatisfiableRange},
+		{"bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"bytes=4-2", 10, nil, nil},
+		{"bytes=a-b", 10, nil, nil},
+		{"bytes=5", 10, nil, nil},
+		{"items=0-4", 10, nil, nil},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.header, func(t *testing.T) {
+			ranges, err := parseRange(test.header, test.size)
+			if err != test.expectedErr {
+				t.Errorf("wrong error\nwant %v\ngot  %v", test.expectedErr, err)
+			}
+			if !reflect.DeepEqual(ranges, test.expectedRanges) {
+				t.Errorf("wrong ranges\nwant %+v\ngot  %+v", test.expectedRanges, ranges)
+			}
+		})
+	}
+}
+
+func TestDownloadObjectMultipleRanges(t *testing.T) {
+	objs := []Object{
+		{
+			ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "files/txt/text-01.txt", ContentType: "text/plain"},
+			Content:     []byte("something"),
+		},
+	}
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		client := server.HTTPClient()
+		url := "https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/files%2Ftxt%2Ftext-01.txt?alt=media"
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", "bytes=0-3,-5")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("wrong status returned\nwant %d\ngot  %d", http.StatusPartialContent, resp.StatusCode)
+		}
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mediaType != "multipart/byteranges" {
+			t.Fatalf("wrong content type\nwant %q\ngot  %q", "multipart/byteranges", mediaType)
+		}
+		expectedParts := []struct {
+			contentRange string
+			content      string
+		}{
+			{"bytes 0-3/9", "some"},
+			{"bytes 4-8/9", "thing"},
+		}
+		reader := multipart.NewReader(resp.Body, params["boundary"])
+		for _, expected := range expectedParts {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentRange := part.Header.Get("Content-Range"); contentRange != expected.contentRange {
+				t.Errorf("wrong part Content-Range\nwant %q\ngot  %q", expected.contentRange, contentRange)
+			}
+			if contentType := part.Header.Get("Content-Type"); contentType != "text/plain" {
+				t.Errorf("wrong part Content-Type\nwant %q\ngot  %q", "text/plain", contentType)
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != expected.content {
+				t.Errorf("wrong part content\nwant %q\ngot  %q", expected.content, string(data))
+			}
+		}
+		if _, err := reader.NextPart(); err != io.EOF {
+			t.Errorf("expected no more parts, got %v", err)
+		}
+
+		req, err = http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", "bytes=9-")
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("wrong status returned\nwant %d\ngot  %d", http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+		}
+		if contentRange := resp.Header.Get("Content-Range"); contentRange != "bytes */9" {
+			t.Errorf("wrong Content-Range returned\nwant %q\ngot  %q", "bytes */9", contentRange)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WriteRateLimit limits the rate of the writes to the objects of a bucket,
+// such as uploads, metadata updates and composes, in writes per second. Zero
+// values mean no limit. Cloud Storage only sustains about one write per
+// second to the same object.
+type WriteRateLimit struct {
+	PerObject float64 `json:"perObject,omitempty"`
+	PerBucket float64 `json:"perBucket,omitempty"`
+
+	// Status is the status of the errors returned to the writes over the
+	// limit, either 429, the default, or 503.
+	Status int `json:"status,omitempty"`
+}
+
+// rateLimitError is returned when a write exceeds the write rate limit of
+// its bucket.
+type rateLimitError struct {
+	status  int
+	message string
+}
+
+func (e *rateLimitError) Error() string {
+	return e.message
+}
+
+// tokenBucket allows a burst of up to the rate, or one write, and then
+// writes at the rate.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	capacity := math.Max(1, rate)
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+type writeRateLimits struct {
+	mtx     sync.Mutex
+	limits  map[string]WriteRateLimit
+	buckets map[string]*tokenBucket
+	objects map[string]map[string]*tokenBucket
+}
+
+func (l *writeRateLimits) set(bucketName string, limit WriteRateLimit) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	delete(l.buckets, bucketName)
+	delete(l.objects, bucketName)
+	if limit.PerObject == 0 && limit.PerBucket == 0 {
+		delete(l.limits, bucketName)
+		return
+	}
+	if l.limits == nil {
+		l.limits = make(map[string]WriteRateLimit)
+	}
+	l.limits[bucketName] = limit
+}
+
+func (l *writeRateLimits) list() map[string]WriteRateLimit {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	limits := make(map[string]WriteRateLimit, len(l.limits))
+	for bucketName, limit := range l.limits {
+		limits[bucketName] = limit
+	}
+	return limits
+}
+
+// take records a write to the given object, returning a rateLimitError
+// instead if the write exceeds the limits of the bucket. Rejected writes
+// don't count towards the limits.
+func (l *writeRateLimits) take(bucketName, objectName string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	limit, ok := l.limits[bucketName]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	status := limit.Status
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+
+	var objectBucket, bucketBucket *tokenBucket
+	if limit.PerObject > 0 {
+		if l.objects == nil {
+			l.objects = make(map[string]map[string]*tokenBucket)
+		}
+		if l.objects[bucketName] == nil {
+			l.objects[bucketName] = make(map[string]*tokenBucket)
+		}
+		if objectBucket = l.objects[bucketName][objectName]; objectBucket == nil {
+			objectBucket = &tokenBucket{}
+			l.objects[bucketName][objectName] = objectBucket
+		}
+		objectBucket.refill(limit.PerObject, now)
+		if objectBucket.tokens < 1 {
+			return &rateLimitError{status, "The object exceeded the rate limit for object mutation operations (create, update, and delete). Please reduce your request rate."}
+		}
+	}
+	if limit.PerBucket > 0 {
+		if l.buckets == nil {
+			l.buckets = make(map[string]*tokenBucket)
+		}
+		if bucketBucket = l.buckets[bucketName]; bucketBucket == nil {
+			bucketBucket = &tokenBucket{}
+			l.buckets[bucketName] = bucketBucket
+		}
+		bucketBucket.refill(limit.PerBucket, now)
+		if bucketBucket.tokens < 1 {
+			return &rateLimitError{status, "The bucket exceeded the rate limit for object mutation operations (create, update, and delete). Please reduce your request rate."}
+		}
+	}
+	if objectBucket != nil {
+		objectBucket.tokens--
+	}
+	if bucketBucket != nil {
+		bucketBucket.tokens--
+	}
+	return nil
+}
+
+// SetBucketWriteRateLimit limits the rate of the writes to the objects of the
+// bucket through the API. Writes over the limit fail with a 429 or 503 error
+// with the "rateLimitExceeded" reason. Objects created with CreateObject
+// aren't limited. A zero limit removes the limits.
+func (s *Server) SetBucketWriteRateLimit(bucketName string, limit WriteRateLimit) error {
+	if limit.PerObject < 0 || limit.PerBucket < 0 {
+		return fmt.Errorf("invalid write rate limit for bucket %s: limits can't be negative", bucketName)
+	}
+	if limit.Status != 0 && limit.Status != http.StatusTooManyRequests && limit.Status != http.StatusServiceUnavailable {
+		return fmt.Errorf("invalid write rate limit status %d, must be 429 or 503", limit.Status)
+	}
+	s.writeRates.set(bucketName, limit)
+	return nil
+}
+
+type writeRateLimitsResponse struct {
+	Kind    string                    `json:"kind"`
+	Buckets map[string]WriteRateLimit `json:"buckets"`
+}
+
+func (s *Server) listWriteRateLimits(r *http.Request) jsonResponse {
+	return jsonResponse{data: writeRateLimitsResponse{Kind: "fakestorage#writeRateLimits", Buckets: s.writeRates.list()}}
+}
+
+func (s *Server) setWriteRateLimit(r *http.Request) jsonResponse {
+	var data struct {
+		Bucket string `json:"bucket"`
+		WriteRateLimit
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Bucket == "" {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Write rate limit payload can not be parsed."}
+	}
+	if err := s.SetBucketWriteRateLimit(data.Bucket, data.WriteRateLimit); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	return s.listWriteRateLimits(r)
+}
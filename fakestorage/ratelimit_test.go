@@ -0,0 +1,160 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestBucketWriteRateLimit(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: "object-limited"})
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: "bucket-limited"})
+		if err := server.SetBucketWriteRateLimit("object-limited", WriteRateLimit{PerObject: -1}); err == nil {
+			t.Error("unexpected <nil> error setting a negative write rate limit")
+		}
+		if err := server.SetBucketWriteRateLimit("object-limited", WriteRateLimit{PerObject: 1, Status: http.StatusNotFound}); err == nil {
+			t.Error("unexpected <nil> error setting an invalid status")
+		}
+		if err := server.SetBucketWriteRateLimit("object-limited", WriteRateLimit{PerObject: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.SetBucketWriteRateLimit("bucket-limited", WriteRateLimit{PerBucket: 2, Status: http.StatusServiceUnavailable}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		client := server.Client()
+		write := func(bucketName, name string) error {
+			w := client.Bucket(bucketName).Object(name).NewWriter(ctx)
+			w.Write([]byte("something"))
+			return w.Close()
+		}
+		updateMetadata := func(bucketName, name string) error {
+			_, err := client.Bucket(bucketName).Object(name).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{"key": "value"}})
+			return err
+		}
+
+		tests := []struct {
+			name           string
+			write          func() error
+			expectedStatus int
+		}{
+			{"first write to an object", func() error { return write("object-limited", "obj1") }, 0},
+			{"second write to the object", func() error { return write("object-limited", "obj1") }, http.StatusTooManyRequests},
+			{"first write to another object", func() error { return write("object-limited", "obj2") }, 0},
+			{"metadata update of the object", func() error { return updateMetadata("object-limited", "obj2") }, http.StatusTooManyRequests},
+			{"first write to the bucket", func() error { return write("bucket-limited", "obj1") }, 0},
+			{"second write to the bucket", func() error { return write("bucket-limited", "obj2") }, 0},
+			{"third write to the bucket", func() error { return write("bucket-limited", "obj3") }, http.StatusServiceUnavailable},
+		}
+		for _, test := range tests {
+			err := test.write()
+			if test.expectedStatus == 0 {
+				if err != nil {
+					t.Errorf("%s: unexpected error: %v", test.name, err)
+				}
+				continue
+			}
+			var apiErr *googleapi.Error
+			if !errors.As(err, &apiErr) {
+				t.Errorf("%s: expected a googleapi error, got %v", test.name, err)
+				continue
+			}
+			if apiErr.Code != test.expectedStatus {
+				t.Errorf("%s: wrong status\nwant %d\ngot  %d", test.name, test.expectedStatus, apiErr.Code)
+			}
+			if len(apiErr.Errors) != 1 || apiErr.Errors[0].Reason != "rateLimitExceeded" {
+				t.Errorf("%s: wrong error reason\nwant %q\ngot  %+v", test.name, "rateLimitExceeded", apiErr.Errors)
+			}
+		}
+
+		server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "object-limited", Name: "obj1"}, Content: []byte("server side")})
+
+		time.Sleep(time.Second)
+		if err := write("object-limited", "obj1"); err != nil {
+			t.Errorf("unexpected error writing to the object after a second: %v", err)
+		}
+	})
+}
+
+func TestWriteRateLimitEndpoint(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedLimits map[string]WriteRateLimit
+	}{
+		{
+			"set limit",
+			`{"bucket":"some-bucket","perObject":1,"perBucket":100}`,
+			http.StatusOK,
+			map[string]WriteRateLimit{"some-bucket": {PerObject: 1, PerBucket: 100}},
+		},
+		{
+			"missing bucket",
+			`{"perObject":1}`,
+			http.StatusBadRequest,
+			map[string]WriteRateLimit{"some-bucket": {PerObject: 1, PerBucket: 100}},
+		},
+		{
+			"invalid status",
+			`{"bucket":"other-bucket","perObject":1,"status":500}`,
+			http.StatusBadRequest,
+			map[string]WriteRateLimit{"some-bucket": {PerObject: 1, PerBucket: 100}},
+		},
+		{
+			"remove limit",
+			`{"bucket":"some-bucket"}`,
+			http.StatusOK,
+			map[string]WriteRateLimit{},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/ratelimits", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if got := server.writeRates.list(); !reflect.DeepEqual(got, test.expectedLimits) {
+				t.Errorf("wrong limits\nwant %+v\ngot  %+v", test.expectedLimits, got)
+			}
+			if resp.StatusCode == http.StatusOK {
+				var body writeRateLimitsResponse
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(body.Buckets, test.expectedLimits) {
+					t.Errorf("wrong limits in the response\nwant %+v\ngot  %+v", test.expectedLimits, body.Buckets)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+var errRefreshNotSupported = errors.New("the backend can't be refreshed, only the filesystem backend can")
+
+// RefreshResult is the result of a refresh of the storage.
+type RefreshResult struct {
+	Imported int `json:"imported"`
+}
+
+// Refresh imports the files copied into the bucket folders of StorageRoot by
+// other tools as objects, so they become visible without restarting the
+// server. Folders copied into StorageRoot are buckets already. It's only
+// supported by the filesystem backend.
+func (s *Server) Refresh() (RefreshResult, error) {
+	refresher, ok := s.backend.(backend.Refresher)
+	if !ok {
+		return RefreshResult{}, errRefreshNotSupported
+	}
+	imported, err := refresher.Refresh()
+	return RefreshResult{Imported: imported}, err
+}
+
+func (s *Server) refresh(r *http.Request) jsonResponse {
+	result, err := s.Refresh()
+	if errors.Is(err, errRefreshNotSupported) {
+		return jsonResponse{status: http.StatusNotImplemented, errorMessage: err.Error()}
+	}
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	return jsonResponse{data: result}
+}
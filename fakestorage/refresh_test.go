@@ -0,0 +1,173 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerRefresh(t *testing.T) {
+	dir, err := os.MkdirTemp(tempDir(), "fakestorage-refresh-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := NewServerWithOptions(Options{
+		NoListener:  true,
+		StorageRoot: dir,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "existing.txt"}, Content: []byte("existing")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	files := map[string]string{
+		"dropped.json":        `{"some": "content"}`,
+		"nested/dir/file.txt": "nested content",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, "some-bucket", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objs, _, err := server.ListObjectsWithOptions("some-bucket", ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Errorf("wrong number of objects before refreshing\nwant 1\ngot  %d", len(objs))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/_internal/refresh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	var result RefreshResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != len(files) {
+		t.Errorf("wrong number of imported objects\nwant %d\ngot  %d", len(files), result.Imported)
+	}
+
+	for name, content := range files {
+		obj, err := server.GetObject("some-bucket", name)
+		if err != nil {
+			t.Errorf("unexpected error getting %s: %v", name, err)
+			continue
+		}
+		if string(obj.Content) != content {
+			t.Errorf("wrong content of %s\nwant %q\ngot  %q", name, content, string(obj.Content))
+		}
+		if obj.Crc32c == "" || obj.Md5Hash == "" {
+			t.Errorf("checksums of %s weren't computed", name)
+		}
+	}
+	obj, err := server.GetObject("some-bucket", "dropped.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.ContentType != "application/json" {
+		t.Errorf("wrong content type\nwant %q\ngot  %q", "application/json", obj.ContentType)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "some-bucket", "nested")); !os.IsNotExist(err) {
+		t.Errorf("imported folder wasn't removed, stat returned %v", err)
+	}
+
+	result, err = server.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 0 {
+		t.Errorf("objects imported again\nwant 0\ngot  %d", result.Imported)
+	}
+}
+
+func TestServerRefreshThroughProxy(t *testing.T) {
+	dir, err := os.MkdirTemp(tempDir(), "fakestorage-refresh-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remote := NewServer(nil)
+	defer remote.Stop()
+	server, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		StorageRoot:    dir,
+		InitialObjects: []Object{{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "existing.txt"}}},
+		Proxy:          ProxyOptions{Buckets: []string{"prod-fixtures"}, Client: remote.Client()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := os.WriteFile(filepath.Join(dir, "some-bucket", "dropped.txt"), []byte("dropped"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 1 {
+		t.Errorf("wrong number of imported objects\nwant 1\ngot  %d", result.Imported)
+	}
+
+	resp, err := server.HTTPClient().Get("https://storage.googleapis.com/_internal/capabilities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var caps capabilitiesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+		t.Fatal(err)
+	}
+	if len(caps.ProxiedBuckets) != 1 || caps.ProxiedBuckets[0] != "prod-fixtures" {
+		t.Errorf("wrong proxied buckets\nwant %q\ngot  %q", []string{"prod-fixtures"}, caps.ProxiedBuckets)
+	}
+	for _, feature := range caps.Features {
+		if (feature.Name == "proxy" || feature.Name == "refresh") && !feature.Supported {
+			t.Errorf("feature %s reported as unsupported", feature.Name)
+		}
+	}
+}
+
+func TestServerRefreshNotSupported(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/_internal/refresh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusNotImplemented, resp.StatusCode)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const requesterPaysMessage = "Bucket is a requester pays bucket but no user project provided."
+
+type bucketBilling struct {
+	RequesterPays bool `json:"requesterPays,omitempty"`
+}
+
+func fromBackendRequesterPays(requesterPays bool) *bucketBilling {
+	if !requesterPays {
+		return nil
+	}
+	return &bucketBilling{RequesterPays: true}
+}
+
+// SetBucketRequesterPays enables or disables Requester Pays on the bucket.
+// Requests to the objects of requester pays buckets must name the project
+// billed for them, with the userProject parameter, or the
+// x-goog-user-project header in the XML API.
+func (s *Server) SetBucketRequesterPays(bucketName string, enabled bool) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	attrs.RequesterPays = enabled
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// requireUserProject is the middleware that rejects requests to requester
+// pays buckets that don't name a user project. Requests to the bucket
+// resource itself, such as the one that disables Requester Pays, and to the
+// internal API are always accepted.
+func (s *Server) requireUserProject(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("userProject") != "" || r.Header.Get("X-Goog-User-Project") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ := route.GetPathTemplate()
+			if strings.HasPrefix(template, "/_internal/") || strings.HasSuffix(template, "/b/{bucketName}") {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		vars := mux.Vars(r)
+		for _, name := range []string{"bucketName", "sourceBucket", "destinationBucket"} {
+			if bucketName, ok := vars[name]; ok && s.requesterPays(bucketName) {
+				if isXMLAPIRequest(r) && !strings.HasPrefix(r.URL.Path, "/upload/") {
+					writeXMLErrorWithCode(w, http.StatusBadRequest, "UserProjectMissing", requesterPaysMessage)
+					return
+				}
+				writeJSONError(w, r, jsonResponse{status: http.StatusBadRequest, errorReason: "required", errorMessage: requesterPaysMessage})
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) requesterPays(bucketName string) bool {
+	bucket, err := s.backend.GetBucket(bucketName)
+	return err == nil && bucket.RequesterPays
+}
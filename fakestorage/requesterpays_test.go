@@ -0,0 +1,120 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestServerClientRequesterPays(t *testing.T) {
+	const bucketName = "billed-bucket"
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		client := server.Client()
+		if err := client.Bucket(bucketName).Create(ctx, "whatever", &storage.BucketAttrs{RequesterPays: true}); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := client.Bucket(bucketName).Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.RequesterPays {
+			t.Error("requester pays not enabled on the bucket")
+		}
+
+		write := func(bucket *storage.BucketHandle) error {
+			w := bucket.Object("object.txt").NewWriter(ctx)
+			w.Write([]byte("some nice content"))
+			return w.Close()
+		}
+		err = write(client.Bucket(bucketName))
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest || apiErr.Message != requesterPaysMessage {
+			t.Errorf("wrong error uploading without a user project: %v", err)
+		}
+
+		billed := client.Bucket(bucketName).UserProject("my-project")
+		if err := write(billed); err != nil {
+			t.Fatalf("unexpected error uploading with a user project: %v", err)
+		}
+		obj, err := billed.Object("object.txt").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Size != int64(len("some nice content")) {
+			t.Errorf("wrong object size\nwant %d\ngot  %d", len("some nice content"), obj.Size)
+		}
+		if _, err := client.Bucket(bucketName).Object("object.txt").Attrs(ctx); !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+			t.Errorf("wrong error getting an object without a user project: %v", err)
+		}
+
+		attrs, err = client.Bucket(bucketName).Update(ctx, storage.BucketAttrsToUpdate{RequesterPays: false})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.RequesterPays {
+			t.Error("requester pays still enabled after disabling it")
+		}
+		if _, err := client.Bucket(bucketName).Object("object.txt").Attrs(ctx); err != nil {
+			t.Errorf("unexpected error getting an object after disabling requester pays: %v", err)
+		}
+	})
+}
+
+func TestServerRequesterPaysXMLDownload(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		InitialObjects: []Object{{ObjectAttrs: ObjectAttrs{BucketName: "billed-bucket", Name: "object.txt"}, Content: []byte("something")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.SetBucketRequesterPays("billed-bucket", true); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := server.HTTPClient().Get("https://storage.googleapis.com/billed-bucket/object.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status downloading without a user project\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	var xmlErr xmlErrorResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&xmlErr); err != nil {
+		t.Fatal(err)
+	}
+	if xmlErr.Code != "UserProjectMissing" {
+		t.Errorf("wrong error code\nwant %q\ngot  %q", "UserProjectMissing", xmlErr.Code)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/billed-bucket/object.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Goog-User-Project", "my-project")
+	resp, err = server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(data) != "something" {
+		t.Errorf("wrong response downloading with a user project\nwant %d %q\ngot  %d %q", http.StatusOK, "something", resp.StatusCode, data)
+	}
+}
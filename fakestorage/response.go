@@ -4,14 +4,35 @@
 
 package fakestorage
 
-import "github.com/fsouza/fake-gcs-server/internal/backend"
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
 
 const timestampFormat = "2006-01-02T15:04:05.999999Z07:00"
 
+// ownerEntityID is the ID of the user reported as the owner of the objects,
+// and of the buckets that don't belong to a project.
+const ownerEntityID = "fake-gcs-server"
+
+type owner struct {
+	Entity   string `json:"entity"`
+	EntityID string `json:"entityId,omitempty"`
+}
+
+func newUserOwner() *owner {
+	return &owner{Entity: "user-" + ownerEntityID, EntityID: ownerEntityID}
+}
+
 type listResponse struct {
-	Kind     string        `json:"kind"`
-	Items    []interface{} `json:"items"`
-	Prefixes []string      `json:"prefixes,omitempty"`
+	Kind          string        `json:"kind"`
+	Items         []interface{} `json:"items"`
+	Prefixes      []string      `json:"prefixes,omitempty"`
+	NextPageToken string        `json:"nextPageToken,omitempty"`
 }
 
 func newListBucketsResponse(buckets []backend.Bucket, location string) listResponse {
@@ -26,26 +47,69 @@ func newListBucketsResponse(buckets []backend.Bucket, location string) listRespo
 }
 
 type bucketResponse struct {
-	Kind        string            `json:"kind"`
-	ID          string            `json:"id"`
-	Name        string            `json:"name"`
-	Versioning  *bucketVersioning `json:"versioning,omitempty"`
-	TimeCreated string            `json:"timeCreated,omitempty"`
-	Location    string            `json:"location,omitempty"`
+	Kind             string                  `json:"kind"`
+	ID               string                  `json:"id"`
+	Name             string                  `json:"name"`
+	Versioning       *bucketVersioning       `json:"versioning,omitempty"`
+	TimeCreated      string                  `json:"timeCreated,omitempty"`
+	Location         string                  `json:"location,omitempty"`
+	StorageClass     string                  `json:"storageClass,omitempty"`
+	Owner            *owner                  `json:"owner,omitempty"`
+	CORS             []CORS                  `json:"cors,omitempty"`
+	Lifecycle        *bucketLifecycle        `json:"lifecycle,omitempty"`
+	RetentionPolicy  *bucketRetentionPolicy  `json:"retentionPolicy,omitempty"`
+	SoftDeletePolicy *bucketSoftDeletePolicy `json:"softDeletePolicy,omitempty"`
+	Labels           map[string]string       `json:"labels,omitempty"`
+	Encryption       *bucketEncryption       `json:"encryption,omitempty"`
+	IAMConfiguration *bucketIAMConfiguration `json:"iamConfiguration,omitempty"`
+	Autoclass        *bucketAutoclass        `json:"autoclass,omitempty"`
+	Billing          *bucketBilling          `json:"billing,omitempty"`
+	Metageneration   int64                   `json:"metageneration,string"`
 }
 
 type bucketVersioning struct {
 	Enabled bool `json:"enabled,omitempty"`
 }
 
+type bucketEncryption struct {
+	DefaultKMSKeyName string `json:"defaultKmsKeyName,omitempty"`
+}
+
+func fromBackendEncryption(defaultKMSKeyName string) *bucketEncryption {
+	if defaultKMSKeyName == "" {
+		return nil
+	}
+	return &bucketEncryption{DefaultKMSKeyName: defaultKMSKeyName}
+}
+
 func newBucketResponse(bucket backend.Bucket, location string) bucketResponse {
+	storageClass := bucket.DefaultStorageClass
+	if storageClass == "" {
+		storageClass = backend.DefaultStorageClass
+	}
+	bucketOwner := newUserOwner()
+	if bucket.ProjectID != "" {
+		bucketOwner = &owner{Entity: "project-owners-" + bucket.ProjectID}
+	}
 	return bucketResponse{
-		Kind:        "storage#bucket",
-		ID:          bucket.Name,
-		Name:        bucket.Name,
-		Versioning:  &bucketVersioning{bucket.VersioningEnabled},
-		TimeCreated: bucket.TimeCreated.Format(timestampFormat),
-		Location:    location,
+		Kind:             "storage#bucket",
+		ID:               bucket.Name,
+		Name:             bucket.Name,
+		Versioning:       &bucketVersioning{bucket.VersioningEnabled},
+		TimeCreated:      bucket.TimeCreated.Format(timestampFormat),
+		Location:         location,
+		StorageClass:     storageClass,
+		Owner:            bucketOwner,
+		CORS:             fromBackendCORS(bucket.CORS),
+		Lifecycle:        fromBackendLifecycle(bucket.Lifecycle),
+		RetentionPolicy:  fromBackendRetentionPolicy(bucket.RetentionPolicy),
+		SoftDeletePolicy: fromBackendSoftDeletePolicy(bucket.SoftDeletePolicy),
+		Labels:           bucket.Labels,
+		Encryption:       fromBackendEncryption(bucket.DefaultKMSKeyName),
+		IAMConfiguration: fromBackendIAMConfiguration(bucket),
+		Autoclass:        fromBackendAutoclass(bucket.Autoclass),
+		Billing:          fromBackendRequesterPays(bucket.RequesterPays),
+		Metageneration:   bucketMetageneration(bucket),
 	}
 }
 
@@ -83,44 +147,79 @@ type objectAccessControl struct {
 }
 
 type objectResponse struct {
-	Kind            string                 `json:"kind"`
-	Name            string                 `json:"name"`
-	ID              string                 `json:"id"`
-	Bucket          string                 `json:"bucket"`
-	Size            int64                  `json:"size,string"`
-	ContentType     string                 `json:"contentType,omitempty"`
-	ContentEncoding string                 `json:"contentEncoding,omitempty"`
-	Crc32c          string                 `json:"crc32c,omitempty"`
-	ACL             []*objectAccessControl `json:"acl,omitempty"`
-	Md5Hash         string                 `json:"md5Hash,omitempty"`
-	Etag            string                 `json:"etag,omitempty"`
-	TimeCreated     string                 `json:"timeCreated,omitempty"`
-	TimeDeleted     string                 `json:"timeDeleted,omitempty"`
-	Updated         string                 `json:"updated,omitempty"`
-	Generation      int64                  `json:"generation,string"`
-	Metadata        map[string]string      `json:"metadata,omitempty"`
+	Kind               string                 `json:"kind"`
+	Name               string                 `json:"name"`
+	ID                 string                 `json:"id"`
+	Bucket             string                 `json:"bucket"`
+	SelfLink           string                 `json:"selfLink,omitempty"`
+	MediaLink          string                 `json:"mediaLink,omitempty"`
+	Size               int64                  `json:"size,string"`
+	ContentType        string                 `json:"contentType,omitempty"`
+	ContentEncoding    string                 `json:"contentEncoding,omitempty"`
+	CacheControl       string                 `json:"cacheControl,omitempty"`
+	ContentDisposition string                 `json:"contentDisposition,omitempty"`
+	ContentLanguage    string                 `json:"contentLanguage,omitempty"`
+	Crc32c             string                 `json:"crc32c,omitempty"`
+	ACL                []*objectAccessControl `json:"acl,omitempty"`
+	Md5Hash            string                 `json:"md5Hash,omitempty"`
+	Etag               string                 `json:"etag,omitempty"`
+	TimeCreated        string                 `json:"timeCreated,omitempty"`
+	TimeDeleted        string                 `json:"timeDeleted,omitempty"`
+	Updated            string                 `json:"updated,omitempty"`
+	Generation         int64                  `json:"generation,string"`
+	Metageneration     int64                  `json:"metageneration,string,omitempty"`
+	Metadata           map[string]string      `json:"metadata,omitempty"`
+	StorageClass       string                 `json:"storageClass,omitempty"`
+	ComponentCount     int                    `json:"componentCount,omitempty"`
+	Owner              *owner                 `json:"owner,omitempty"`
+	SoftDeleteTime     string                 `json:"softDeleteTime,omitempty"`
+	HardDeleteTime     string                 `json:"hardDeleteTime,omitempty"`
+	CustomerEncryption *customerEncryption    `json:"customerEncryption,omitempty"`
+	KMSKeyName         string                 `json:"kmsKeyName,omitempty"`
+	CustomTime         string                 `json:"customTime,omitempty"`
 }
 
 func newObjectResponse(obj ObjectAttrs) objectResponse {
 	acl := getAccessControlsListFromObject(obj)
+	// only noncurrent versions have a deletion time, only soft-deleted
+	// objects have soft and hard delete times, and the custom time is
+	// optional.
+	formatIfSet := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(timestampFormat)
+	}
 
 	return objectResponse{
-		Kind:            "storage#object",
-		ID:              obj.id(),
-		Bucket:          obj.BucketName,
-		Name:            obj.Name,
-		Size:            obj.Size,
-		ContentType:     obj.ContentType,
-		ContentEncoding: obj.ContentEncoding,
-		Crc32c:          obj.Crc32c,
-		Md5Hash:         obj.Md5Hash,
-		Etag:            obj.Etag,
-		ACL:             acl,
-		Metadata:        obj.Metadata,
-		TimeCreated:     obj.Created.Format(timestampFormat),
-		TimeDeleted:     obj.Deleted.Format(timestampFormat),
-		Updated:         obj.Updated.Format(timestampFormat),
-		Generation:      obj.Generation,
+		Kind:               "storage#object",
+		ID:                 obj.id(),
+		Bucket:             obj.BucketName,
+		Name:               obj.Name,
+		Size:               obj.Size,
+		ContentType:        obj.ContentType,
+		ContentEncoding:    obj.ContentEncoding,
+		CacheControl:       obj.CacheControl,
+		ContentDisposition: obj.ContentDisposition,
+		ContentLanguage:    obj.ContentLanguage,
+		Crc32c:             obj.Crc32c,
+		Md5Hash:            obj.Md5Hash,
+		Etag:               obj.Etag,
+		ACL:                acl,
+		Metadata:           obj.Metadata,
+		TimeCreated:        obj.Created.Format(timestampFormat),
+		TimeDeleted:        formatIfSet(obj.Deleted),
+		Updated:            obj.Updated.Format(timestampFormat),
+		Generation:         obj.Generation,
+		Metageneration:     obj.Metageneration,
+		StorageClass:       obj.StorageClass,
+		ComponentCount:     obj.ComponentCount,
+		Owner:              newUserOwner(),
+		SoftDeleteTime:     formatIfSet(obj.SoftDeleteTime),
+		HardDeleteTime:     formatIfSet(obj.HardDeleteTime),
+		CustomerEncryption: newCustomerEncryption(obj.CustomerKeySHA256),
+		KMSKeyName:         obj.KMSKeyName,
+		CustomTime:         formatIfSet(obj.CustomTime),
 	}
 }
 
@@ -135,36 +234,57 @@ func newACLListResponse(obj ObjectAttrs) aclListResponse {
 	return aclListResponse{Items: getAccessControlsListFromObject(obj)}
 }
 
+// getAccessControlsListFromObject returns the ACL of the object, with IDs in
+// the format used by Cloud Storage: bucket/object/generation/entity.
 func getAccessControlsListFromObject(obj ObjectAttrs) []*objectAccessControl {
 	aclItems := make([]*objectAccessControl, len(obj.ACL))
 	for idx, aclRule := range obj.ACL {
+		entity := string(aclRule.Entity)
 		aclItems[idx] = &objectAccessControl{
-			Bucket: obj.BucketName,
-			Entity: string(aclRule.Entity),
-			Object: obj.Name,
-			Role:   string(aclRule.Role),
+			Kind:       "storage#objectAccessControl",
+			ID:         fmt.Sprintf("%s/%s/%d/%s", obj.BucketName, obj.Name, obj.Generation, entity),
+			Bucket:     obj.BucketName,
+			Entity:     entity,
+			Object:     obj.Name,
+			Generation: obj.Generation,
+			Role:       string(aclRule.Role),
+		}
+		if entity == "user-"+ownerEntityID {
+			aclItems[idx].EntityID = ownerEntityID
 		}
 	}
 	return aclItems
 }
 
+// findAccessControl returns the rule of the object's ACL for the entity, or
+// nil if there's no such rule.
+func findAccessControl(obj ObjectAttrs, entity storage.ACLEntity) *objectAccessControl {
+	for _, item := range getAccessControlsListFromObject(obj) {
+		if item.Entity == string(entity) {
+			return item
+		}
+	}
+	return nil
+}
+
 type rewriteResponse struct {
-	Kind                string         `json:"kind"`
-	TotalBytesRewritten int64          `json:"totalBytesRewritten,string"`
-	ObjectSize          int64          `json:"objectSize,string"`
-	Done                bool           `json:"done"`
-	RewriteToken        string         `json:"rewriteToken"`
-	Resource            objectResponse `json:"resource"`
+	Kind                string          `json:"kind"`
+	TotalBytesRewritten int64           `json:"totalBytesRewritten,string"`
+	ObjectSize          int64           `json:"objectSize,string"`
+	Done                bool            `json:"done"`
+	RewriteToken        string          `json:"rewriteToken"`
+	Resource            *objectResponse `json:"resource,omitempty"`
 }
 
 func newObjectRewriteResponse(obj ObjectAttrs) rewriteResponse {
+	resource := newObjectResponse(obj)
 	return rewriteResponse{
 		Kind:                "storage#rewriteResponse",
 		TotalBytesRewritten: obj.Size,
 		ObjectSize:          obj.Size,
 		Done:                true,
 		RewriteToken:        "",
-		Resource:            newObjectResponse(obj),
+		Resource:            &resource,
 	}
 }
 
@@ -179,9 +299,11 @@ type httpError struct {
 }
 
 type apiError struct {
-	Domain  string `json:"domain"`
-	Reason  string `json:"reason"`
-	Message string `json:"message"`
+	Domain       string `json:"domain"`
+	Reason       string `json:"reason"`
+	Message      string `json:"message"`
+	LocationType string `json:"locationType,omitempty"`
+	Location     string `json:"location,omitempty"`
 }
 
 func newErrorResponse(code int, message string, errs []apiError) errorResponse {
@@ -193,3 +315,30 @@ func newErrorResponse(code int, message string, errs []apiError) errorResponse {
 		},
 	}
 }
+
+// defaultErrorReasons are the reasons Cloud Storage reports for errors with
+// the given status when there isn't a more specific one.
+var defaultErrorReasons = map[int]string{
+	http.StatusBadRequest:                   "invalid",
+	http.StatusUnauthorized:                 "required",
+	http.StatusForbidden:                    "forbidden",
+	http.StatusNotFound:                     "notFound",
+	http.StatusMethodNotAllowed:             "methodNotAllowed",
+	http.StatusConflict:                     "conflict",
+	http.StatusLengthRequired:               "required",
+	http.StatusPreconditionFailed:           "conditionNotMet",
+	http.StatusRequestEntityTooLarge:        "uploadTooLarge",
+	http.StatusRequestedRangeNotSatisfiable: "requestedRangeNotSatisfiable",
+	http.StatusTooManyRequests:              "rateLimitExceeded",
+	http.StatusNotImplemented:               "notImplemented",
+}
+
+func defaultErrorReason(status int) string {
+	if reason, ok := defaultErrorReasons[status]; ok {
+		return reason
+	}
+	if status >= http.StatusInternalServerError {
+		return "backendError"
+	}
+	return "invalid"
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/gorilla/mux"
+)
+
+// maxRetentionPeriod is the longest retention period accepted by Cloud
+// Storage: 100 years.
+const maxRetentionPeriod = 100 * 365 * 24 * time.Hour
+
+type bucketRetentionPolicy struct {
+	RetentionPeriod int64  `json:"retentionPeriod,string"`
+	EffectiveTime   string `json:"effectiveTime,omitempty"`
+	IsLocked        bool   `json:"isLocked,omitempty"`
+}
+
+func fromBackendRetentionPolicy(policy *backend.RetentionPolicy) *bucketRetentionPolicy {
+	if policy == nil {
+		return nil
+	}
+	return &bucketRetentionPolicy{
+		RetentionPeriod: int64(policy.RetentionPeriod / time.Second),
+		EffectiveTime:   policy.EffectiveTime.Format(time.RFC3339),
+		IsLocked:        policy.IsLocked,
+	}
+}
+
+// retentionPolicyError is returned when deleting or overwriting an object
+// that is younger than the retention period of its bucket.
+type retentionPolicyError struct {
+	bucketName string
+	objectName string
+	expiration time.Time
+}
+
+func (e *retentionPolicyError) Error() string {
+	return fmt.Sprintf("Object '%s/%s' is subject to bucket's retention policy and cannot be deleted, overwritten or archived until %s", e.bucketName, e.objectName, e.expiration.Format(time.RFC3339))
+}
+
+// newRetentionPolicy returns the retention policy of the bucket after
+// changing its retention period, or an error message when the change isn't
+// allowed. A zero period removes the policy.
+func newRetentionPolicy(current *backend.RetentionPolicy, retentionPeriod time.Duration) (*backend.RetentionPolicy, string) {
+	if retentionPeriod < 0 || retentionPeriod > maxRetentionPeriod {
+		return nil, "The retention period must be greater than zero and less than 100 years."
+	}
+	if current != nil && current.IsLocked {
+		if retentionPeriod < current.RetentionPeriod {
+			return nil, "Cannot reduce retention duration of a locked Retention Policy."
+		}
+		if retentionPeriod == current.RetentionPeriod {
+			return current, ""
+		}
+	}
+	if retentionPeriod == 0 {
+		return nil, ""
+	}
+	policy := backend.RetentionPolicy{
+		RetentionPeriod: retentionPeriod,
+		EffectiveTime:   time.Now().UTC().Truncate(time.Second),
+	}
+	if current != nil {
+		policy.IsLocked = current.IsLocked
+	}
+	return &policy, ""
+}
+
+// SetBucketRetentionPolicy sets the retention period of the bucket: objects
+// can't be deleted or overwritten until they're older than the period, and
+// attempts to do so fail with a 403 error with the "retentionPolicyNotMet"
+// reason. A zero period removes the policy. Locked policies can't be removed
+// or shortened, only extended.
+func (s *Server) SetBucketRetentionPolicy(bucketName string, retentionPeriod time.Duration) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	policy, message := newRetentionPolicy(bucket.RetentionPolicy, retentionPeriod)
+	if message != "" {
+		return backend.Error(message)
+	}
+	attrs := bucket.Attrs()
+	attrs.RetentionPolicy = policy
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// LockBucketRetentionPolicy locks the retention policy of the bucket, so it
+// can no longer be removed or shortened.
+func (s *Server) LockBucketRetentionPolicy(bucketName string) error {
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	if bucket.RetentionPolicy == nil {
+		return backend.Error("The bucket does not have a retention policy to lock.")
+	}
+	attrs := bucket.Attrs()
+	policy := *bucket.RetentionPolicy
+	policy.IsLocked = true
+	attrs.RetentionPolicy = &policy
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// checkRetention returns a retentionPolicyError if the bucket has a retention
+// policy that prevents deleting or overwriting the given object version.
+func (s *Server) checkRetention(obj ObjectAttrs) error {
+	bucket, err := s.backend.GetBucket(obj.BucketName)
+	if err != nil || bucket.RetentionPolicy == nil {
+		return nil
+	}
+	expiration := obj.Created.Add(bucket.RetentionPolicy.RetentionPeriod)
+	if time.Now().Before(expiration) {
+		return &retentionPolicyError{obj.BucketName, obj.Name, expiration}
+	}
+	return nil
+}
+
+func (s *Server) lockRetentionPolicy(r *http.Request) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	// buckets don't have a metageneration, so the required
+	// ifMetagenerationMatch parameter is ignored.
+	if err := s.LockBucketRetentionPolicy(bucketName); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	return s.getBucket(r)
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestBucketRetentionPolicy(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		const bucketName = "retention-bucket"
+		client := server.Client()
+		bucket := client.Bucket(bucketName)
+		err := bucket.Create(context.TODO(), "", &storage.BucketAttrs{
+			RetentionPolicy: &storage.RetentionPolicy{RetentionPeriod: time.Hour},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := bucket.Attrs(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.RetentionPolicy == nil {
+			t.Fatal("unexpected <nil> retention policy")
+		}
+		if attrs.RetentionPolicy.RetentionPeriod != time.Hour {
+			t.Errorf("wrong retention period\nwant %s\ngot  %s", time.Hour, attrs.RetentionPolicy.RetentionPeriod)
+		}
+		if attrs.RetentionPolicy.EffectiveTime.IsZero() || attrs.RetentionPolicy.IsLocked {
+			t.Errorf("wrong retention policy: %+v", attrs.RetentionPolicy)
+		}
+
+		err = bucket.If(storage.BucketConditions{MetagenerationMatch: 1}).LockRetentionPolicy(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs, err = bucket.Attrs(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !attrs.RetentionPolicy.IsLocked {
+			t.Error("retention policy wasn't locked")
+		}
+		if err := server.SetBucketRetentionPolicy(bucketName, 0); err == nil {
+			t.Error("unexpected <nil> error removing a locked retention policy")
+		}
+		if err := server.SetBucketRetentionPolicy(bucketName, time.Minute); err == nil {
+			t.Error("unexpected <nil> error reducing a locked retention policy")
+		}
+		if err := server.SetBucketRetentionPolicy(bucketName, 2*time.Hour); err != nil {
+			t.Errorf("unexpected error extending a locked retention policy: %v", err)
+		}
+		if err := server.SetBucketRetentionPolicy("missing-bucket", time.Hour); err == nil {
+			t.Error("unexpected <nil> error setting the retention policy of a bucket that doesn't exist")
+		}
+	})
+}
+
+func TestBucketRetentionPolicyEnforcement(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		const bucketName = "retention-bucket"
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName, RetentionPeriod: time.Hour})
+		server.CreateObject(Object{
+			ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "new.txt"},
+			Content:     []byte("content"),
+		})
+		server.CreateObject(Object{
+			ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "old.txt", Created: time.Now().Add(-2 * time.Hour)},
+			Content:     []byte("content"),
+		})
+		client := server.Client()
+		obj := client.Bucket(bucketName).Object("new.txt")
+
+		assertRetentionError := func(t *testing.T, err error) {
+			t.Helper()
+			var apiErr *googleapi.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if apiErr.Code != http.StatusForbidden {
+				t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusForbidden, apiErr.Code)
+			}
+			if len(apiErr.Errors) == 0 || apiErr.Errors[0].Reason != "retentionPolicyNotMet" {
+				t.Errorf("wrong errors: %+v", apiErr.Errors)
+			}
+		}
+
+		t.Run("delete", func(t *testing.T) {
+			assertRetentionError(t, obj.Delete(context.TODO()))
+		})
+
+		t.Run("overwrite", func(t *testing.T) {
+			w := obj.NewWriter(context.TODO())
+			w.Write([]byte("new content"))
+			assertRetentionError(t, w.Close())
+			got, err := server.GetObject(bucketName, "new.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Content) != "content" {
+				t.Errorf("object overwritten despite the retention policy: %q", got.Content)
+			}
+		})
+
+		t.Run("compose", func(t *testing.T) {
+			_, err := obj.ComposerFrom(client.Bucket(bucketName).Object("old.txt")).Run(context.TODO())
+			assertRetentionError(t, err)
+			got, err := server.GetObject(bucketName, "new.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Content) != "content" {
+				t.Errorf("object composed over despite the retention policy: %q", got.Content)
+			}
+		})
+
+		t.Run("lifecycle", func(t *testing.T) {
+			age := int64(0)
+			err := server.SetBucketLifecycle(bucketName, []LifecycleRule{
+				{Action: LifecycleAction{Type: "Delete"}, Condition: LifecycleCondition{Age: &age}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := server.RunLifecycle()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Deleted != 1 {
+				t.Errorf("wrong number of deleted objects\nwant 1\ngot  %d", result.Deleted)
+			}
+			if _, err := server.GetObject(bucketName, "new.txt"); err != nil {
+				t.Errorf("object deleted despite the retention policy: %v", err)
+			}
+			if _, err := server.GetObject(bucketName, "old.txt"); err == nil {
+				t.Error("object older than the retention period wasn't deleted")
+			}
+		})
+
+		t.Run("removed policy", func(t *testing.T) {
+			if err := server.SetBucketRetentionPolicy(bucketName, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := obj.Delete(context.TODO()); err != nil {
+				t.Errorf("unexpected error deleting the object after removing the policy: %v", err)
+			}
+		})
+	})
+}
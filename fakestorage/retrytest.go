@@ -0,0 +1,274 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// retryTestHeader is the header that identifies the retry test whose
+// instructions apply to a request.
+const retryTestHeader = "X-Retry-Test-Id"
+
+var (
+	returnStatusInstruction      = regexp.MustCompile(`^return-([0-9]{3})$`)
+	returnStatusAfterInstruction = regexp.MustCompile(`^return-([0-9]{3})-after-([0-9]+)K$`)
+	brokenStreamAfterInstruction = regexp.MustCompile(`^return-broken-stream-after-([0-9]+)K$`)
+)
+
+// retryTest is a test of the Retry Test API of the storage testbench, which
+// has lists of instructions, such as "return-503", for the requests to each
+// method, such as "storage.objects.get". Instructions are applied to the
+// requests sent with the test's id in the x-retry-test-id header, in order,
+// until none are left.
+type retryTest struct {
+	ID           string              `json:"id"`
+	Instructions map[string][]string `json:"instructions"`
+	Transport    string              `json:"transport,omitempty"`
+	Completed    bool                `json:"completed"`
+}
+
+// clone returns a copy of the test that doesn't share its instructions.
+func (t retryTest) clone() retryTest {
+	instructions := make(map[string][]string, len(t.Instructions))
+	for method, list := range t.Instructions {
+		instructions[method] = append([]string{}, list...)
+	}
+	t.Instructions = instructions
+	return t
+}
+
+type retryTests struct {
+	mtx   sync.Mutex
+	tests map[string]*retryTest
+}
+
+func (t *retryTests) create(test retryTest) (retryTest, error) {
+	id, err := generateUploadID()
+	if err != nil {
+		return retryTest{}, err
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.tests == nil {
+		t.tests = make(map[string]*retryTest)
+	}
+	test = test.clone()
+	test.ID = id
+	test.Completed = retryTestCompleted(test.Instructions)
+	t.tests[test.ID] = &test
+	return test.clone(), nil
+}
+
+func (t *retryTests) get(id string) (retryTest, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	test, ok := t.tests[id]
+	if !ok {
+		return retryTest{}, false
+	}
+	return test.clone(), true
+}
+
+func (t *retryTests) list() []retryTest {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	tests := make([]retryTest, 0, len(t.tests))
+	for _, test := range t.tests {
+		tests = append(tests, test.clone())
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].ID < tests[j].ID })
+	return tests
+}
+
+func (t *retryTests) delete(id string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	_, ok := t.tests[id]
+	delete(t.tests, id)
+	return ok
+}
+
+// next removes and returns the next instruction of the test for the given
+// method, if any. It returns false if the test doesn't exist.
+func (t *retryTests) next(id, method string) (string, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	test, ok := t.tests[id]
+	if !ok {
+		return "", false
+	}
+	instructions := test.Instructions[method]
+	if len(instructions) == 0 {
+		return "", true
+	}
+	test.Instructions[method] = instructions[1:]
+	test.Completed = retryTestCompleted(test.Instructions)
+	return instructions[0], true
+}
+
+// restore puts back an instruction removed by next that didn't apply to the
+// request, so it applies to the next one.
+func (t *retryTests) restore(id, method, instruction string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if test, ok := t.tests[id]; ok {
+		test.Instructions[method] = append([]string{instruction}, test.Instructions[method]...)
+		test.Completed = false
+	}
+}
+
+func retryTestCompleted(instructions map[string][]string) bool {
+	for _, list := range instructions {
+		if len(list) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func validRetryTestInstruction(instruction string) bool {
+	switch instruction {
+	case "return-reset-connection", "return-broken-stream":
+		return true
+	}
+	return returnStatusInstruction.MatchString(instruction) ||
+		returnStatusAfterInstruction.MatchString(instruction) ||
+		brokenStreamAfterInstruction.MatchString(instruction)
+}
+
+// applyRetryTests is the middleware that applies the instructions of the
+// retry test identified in the x-retry-test-id header to the requests.
+func (s *Server) applyRetryTests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(retryTestHeader)
+		method := apiMethod(r)
+		if id == "" || method == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		instruction, ok := s.retryTests.next(id, method)
+		if !ok {
+			writeJSONError(w, r, jsonResponse{status: http.StatusNotFound, errorMessage: "Retry Test not found: " + id})
+			return
+		}
+
+		if instruction == "return-reset-connection" {
+			panic(http.ErrAbortHandler)
+		}
+		if instruction == "return-broken-stream" {
+			h.ServeHTTP(&brokenStreamWriter{ResponseWriter: w}, r)
+			return
+		}
+		if match := brokenStreamAfterInstruction.FindStringSubmatch(instruction); match != nil {
+			kib, _ := strconv.Atoi(match[1])
+			h.ServeHTTP(&brokenStreamWriter{ResponseWriter: w, remaining: kib * 1024}, r)
+			return
+		}
+		if match := returnStatusInstruction.FindStringSubmatch(instruction); match != nil {
+			status, _ := strconv.Atoi(match[1])
+			writeRetryTestError(w, r, status)
+			return
+		}
+		if match := returnStatusAfterInstruction.FindStringSubmatch(instruction); match != nil {
+			// as in the testbench, the error is only returned once more
+			// than the given amount of the object is uploaded, taking the
+			// previous chunks of resumable uploads into account. Earlier
+			// requests keep the instruction for the following ones.
+			kib, _ := strconv.Atoi(match[2])
+			limit := kib * 1024
+			if contentRange, err := parseContentRange(r.Header.Get("Content-Range")); err == nil && contentRange.Start > 0 {
+				limit -= contentRange.Start
+			}
+			if limit < 0 {
+				limit = 0
+			}
+			received, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+			if err == nil && len(received) > limit {
+				status, _ := strconv.Atoi(match[1])
+				writeRetryTestError(w, r, status)
+				return
+			}
+			s.retryTests.restore(id, method, instruction)
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(received), r.Body))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeRetryTestError(w http.ResponseWriter, r *http.Request, status int) {
+	writeAPIError(w, r, status, fmt.Sprintf("Retry Test: Caused a %d", status))
+}
+
+// brokenStreamWriter is the response writer that breaks the connection after
+// sending the given number of bytes of the body.
+type brokenStreamWriter struct {
+	http.ResponseWriter
+	remaining int
+}
+
+func (w *brokenStreamWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.remaining {
+		w.remaining -= len(p)
+		return w.ResponseWriter.Write(p)
+	}
+	w.ResponseWriter.Write(p[:w.remaining])
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+type retryTestsResponse struct {
+	RetryTests []retryTest `json:"retry_test"`
+}
+
+func (s *Server) createRetryTest(r *http.Request) jsonResponse {
+	var test retryTest
+	if err := json.NewDecoder(r.Body).Decode(&test); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Retry test payload can not be parsed."}
+	}
+	for method, instructions := range test.Instructions {
+		for _, instruction := range instructions {
+			if !validRetryTestInstruction(instruction) {
+				return jsonResponse{status: http.StatusBadRequest, errorMessage: fmt.Sprintf("Invalid instruction %q for %s.", instruction, method)}
+			}
+		}
+	}
+	test, err := s.retryTests.create(test)
+	if err != nil {
+		return errToJsonResponse(err)
+	}
+	return jsonResponse{data: test}
+}
+
+func (s *Server) getRetryTest(r *http.Request) jsonResponse {
+	test, ok := s.retryTests.get(mux.Vars(r)["id"])
+	if !ok {
+		return jsonResponse{status: http.StatusNotFound, errorMessage: "Retry Test not found: " + mux.Vars(r)["id"]}
+	}
+	return jsonResponse{data: test}
+}
+
+func (s *Server) listRetryTests(r *http.Request) jsonResponse {
+	return jsonResponse{data: retryTestsResponse{RetryTests: s.retryTests.list()}}
+}
+
+func (s *Server) deleteRetryTest(r *http.Request) jsonResponse {
+	if !s.retryTests.delete(mux.Vars(r)["id"]) {
+		return jsonResponse{status: http.StatusNotFound, errorMessage: "Retry Test not found: " + mux.Vars(r)["id"]}
+	}
+	return jsonResponse{}
+}
@@ -0,0 +1,223 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+type retryTestTransport struct {
+	id        string
+	transport http.RoundTripper
+}
+
+func (t *retryTestTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Retry-Test-Id", t.id)
+	return t.transport.RoundTrip(r)
+}
+
+func createRetryTest(t *testing.T, server *Server, instructions map[string][]string) retryTest {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{"instructions": instructions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.HTTPClient().Post(server.URL()+"/retry_test", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status creating the retry test\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	var test retryTest
+	if err := json.NewDecoder(resp.Body).Decode(&test); err != nil {
+		t.Fatal(err)
+	}
+	return test
+}
+
+func getRetryTest(t *testing.T, server *Server, id string) retryTest {
+	t.Helper()
+	resp, err := server.HTTPClient().Get(server.URL() + "/retry_test/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var test retryTest
+	if err := json.NewDecoder(resp.Body).Decode(&test); err != nil {
+		t.Fatal(err)
+	}
+	return test
+}
+
+func retryTestClient(t *testing.T, server *Server, id string) *storage.Client {
+	t.Helper()
+	httpClient := &http.Client{Transport: &retryTestTransport{id: id, transport: server.HTTPClient().Transport}}
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(httpClient), option.WithCredentials(&google.Credentials{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestServerClientRetryTests(t *testing.T) {
+	const bucketName = "some-bucket"
+	content := strings.Repeat("some nice content\n", 40000)
+	objs := []Object{{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "object.txt"}, Content: []byte(content)}}
+
+	runServersTest(t, runServersOptions{objs: objs}, func(t *testing.T, server *Server) {
+		ctx := context.Background()
+		test := createRetryTest(t, server, map[string][]string{
+			"storage.objects.get":    {"return-503", "return-reset-connection"},
+			"storage.objects.list":   {"return-429"},
+			"storage.objects.insert": {"return-503-after-256K"},
+		})
+		if test.ID == "" || test.Completed {
+			t.Fatalf("invalid retry test created: %+v", test)
+		}
+		bucket := retryTestClient(t, server, test.ID).Bucket(bucketName)
+
+		reader, err := bucket.Object("object.txt").NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("wrong content downloaded, got %d bytes", len(data))
+		}
+
+		if _, err := bucket.Objects(ctx, nil).Next(); err != nil {
+			t.Fatal(err)
+		}
+
+		w := bucket.Object("uploaded.txt").NewWriter(ctx)
+		w.ChunkSize = 256 * 1024
+		w.Write([]byte(content))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := server.GetObject(bucketName, "uploaded.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != content {
+			t.Errorf("wrong content uploaded, got %d bytes", len(obj.Content))
+		}
+
+		test = getRetryTest(t, server, test.ID)
+		if !test.Completed {
+			t.Errorf("retry test not completed, remaining instructions: %v", test.Instructions)
+		}
+	})
+}
+
+func TestServerRetryTestBrokenStream(t *testing.T) {
+	const bucketName = "some-bucket"
+	content := strings.Repeat("a", 4096)
+	runServersTest(t, runServersOptions{
+		objs: []Object{{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "object.txt"}, Content: []byte(content)}},
+	}, func(t *testing.T, server *Server) {
+		test := createRetryTest(t, server, map[string][]string{"storage.objects.get": {"return-broken-stream-after-1K"}})
+		client := &http.Client{Transport: &retryTestTransport{id: test.ID, transport: server.HTTPClient().Transport}}
+
+		resp, err := client.Get(server.URL() + "/download/storage/v1/b/some-bucket/o/object.txt?alt=media")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("wrong error reading the broken stream\nwant %v\ngot  %v", io.ErrUnexpectedEOF, err)
+		}
+		if len(data) != 1024 {
+			t.Errorf("wrong number of bytes before the stream broke\nwant %d\ngot  %d", 1024, len(data))
+		}
+
+		resp, err = client.Get(server.URL() + "/download/storage/v1/b/some-bucket/o/object.txt?alt=media")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if data, err := io.ReadAll(resp.Body); err != nil || string(data) != content {
+			t.Errorf("unexpected response after the instructions were consumed: %d bytes, %v", len(data), err)
+		}
+	})
+}
+
+func TestServerRetryTestAPI(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	resp, err := server.HTTPClient().Post("https://storage.googleapis.com/retry_test", "application/json", strings.NewReader(`{"instructions":{"storage.objects.get":["return-something"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status creating a retry test with an invalid instruction\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	test := createRetryTest(t, server, map[string][]string{"storage.buckets.list": {"return-500"}})
+	resp, err = server.HTTPClient().Get("https://storage.googleapis.com/retry_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list retryTestsResponse
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.RetryTests) != 1 || list.RetryTests[0].ID != test.ID {
+		t.Errorf("wrong list of retry tests: %+v", list.RetryTests)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, "https://storage.googleapis.com/retry_test/"+test.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status deleting the retry test\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, "https://storage.googleapis.com/storage/v1/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Retry-Test-Id", test.ID)
+	resp, err = server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status using a deleted retry test\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+	"gopkg.in/yaml.v3"
+)
+
+// seedObject is an entry in the manifest accepted by the seeding endpoint.
+// The content is either inlined as base64 or read from a file in the server's
+// filesystem.
+type seedObject struct {
+	Bucket          string            `json:"bucket"`
+	Name            string            `json:"name"`
+	Content         string            `json:"content,omitempty"`
+	Path            string            `json:"path,omitempty"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	StorageClass    string            `json:"storageClass,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	ACL             []seedACLRule     `json:"acl,omitempty"`
+	Generation      int64             `json:"generation,omitempty"`
+}
+
+type seedACLRule struct {
+	Entity string `json:"entity"`
+	Role   string `json:"role"`
+}
+
+// seedBucket is a bucket in the manifest, created before the objects.
+// Buckets of objects that aren't in the manifest are created with the
+// default attributes.
+type seedBucket struct {
+	Name              string            `json:"name"`
+	VersioningEnabled bool              `json:"versioning,omitempty"`
+	StorageClass      string            `json:"storageClass,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+type seedManifest struct {
+	Buckets []seedBucket `json:"buckets,omitempty"`
+	Objects []seedObject `json:"objects"`
+}
+
+// parseSeedManifest parses a manifest in JSON or YAML. YAML manifests use the
+// same field names as JSON ones.
+func parseSeedManifest(data []byte) (seedManifest, error) {
+	var manifest seedManifest
+	if err := json.Unmarshal(data, &manifest); err == nil {
+		return manifest, nil
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return manifest, err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+func (b seedBucket) toBucket() (backend.Bucket, error) {
+	if err := validateBucketName(b.Name); err != nil {
+		return backend.Bucket{}, fmt.Errorf("%s: %w", b.Name, err)
+	}
+	if err := validateBucketLabels(b.Labels); err != nil {
+		return backend.Bucket{}, fmt.Errorf("%s: %w", b.Name, err)
+	}
+	return backend.Bucket{
+		Name:                b.Name,
+		VersioningEnabled:   b.VersioningEnabled,
+		DefaultStorageClass: b.StorageClass,
+		Labels:              b.Labels,
+	}, nil
+}
+
+func (o seedObject) toObject() (Object, error) {
+	if err := validateBucketName(o.Bucket); err != nil {
+		return Object{}, fmt.Errorf("%s: %w", o.Bucket, err)
+	}
+	if o.Name == "" {
+		return Object{}, fmt.Errorf("missing object name in bucket %s", o.Bucket)
+	}
+	if o.Content != "" && o.Path != "" {
+		return Object{}, fmt.Errorf("%s/%s: content and path are mutually exclusive", o.Bucket, o.Name)
+	}
+	var content []byte
+	var err error
+	if o.Path != "" {
+		content, err = os.ReadFile(o.Path)
+	} else {
+		content, err = base64.StdEncoding.DecodeString(o.Content)
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("%s/%s: invalid content: %w", o.Bucket, o.Name, err)
+	}
+	var acl []storage.ACLRule
+	for _, rule := range o.ACL {
+		if rule.Entity == "" || rule.Role == "" {
+			return Object{}, fmt.Errorf("%s/%s: ACL rules require an entity and a role", o.Bucket, o.Name)
+		}
+		acl = append(acl, storage.ACLRule{Entity: storage.ACLEntity(rule.Entity), Role: storage.ACLRole(rule.Role)})
+	}
+	md5Hash := checksum.EncodedMd5Hash(content)
+	return Object{
+		ObjectAttrs: ObjectAttrs{
+			BucketName:      o.Bucket,
+			Name:            o.Name,
+			ContentType:     o.ContentType,
+			ContentEncoding: o.ContentEncoding,
+			Crc32c:          checksum.EncodedCrc32cChecksum(content),
+			Md5Hash:         md5Hash,
+			Etag:            fmt.Sprintf("%q", md5Hash),
+			StorageClass:    o.StorageClass,
+			Metadata:        o.Metadata,
+			ACL:             acl,
+			Generation:      o.Generation,
+		},
+		Content: content,
+	}, nil
+}
+
+// seedObjects creates all the given objects, or none of them: if creating one
+// of the objects fails, the generations created so far are deleted, and the
+// objects they replaced are restored as the live versions, so buckets with
+// versioning enabled don't keep them as noncurrent versions.
+func (s *Server) seedObjects(objs []Object) ([]Object, error) {
+	s.seedMtx.Lock()
+	defer s.seedMtx.Unlock()
+
+	type createdObject struct {
+		generation  int64
+		previous    backend.Object
+		hadPrevious bool
+		newBucket   bool
+	}
+	var created []createdObject
+	rollback := func() {
+		for i := len(created) - 1; i >= 0; i-- {
+			c := created[i]
+			obj := objs[i]
+			s.purgeObjectGeneration(obj.BucketName, obj.Name, c.generation)
+			if c.hadPrevious {
+				s.purgeObjectGeneration(obj.BucketName, obj.Name, c.previous.Generation)
+				s.backend.CreateObject(c.previous)
+				continue
+			}
+			if c.newBucket {
+				s.backend.DeleteBucket(obj.BucketName)
+			}
+		}
+	}
+
+	result := make([]Object, 0, len(objs))
+	for _, obj := range objs {
+		var c createdObject
+		_, err := s.backend.GetBucket(obj.BucketName)
+		c.newBucket = err != nil
+		c.previous, err = s.backend.GetObject(obj.BucketName, obj.Name)
+		c.hadPrevious = err == nil
+
+		newObj, err := s.storeObject(obj)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("failed to create %s: %w", obj.id(), err)
+		}
+		c.generation = newObj.Generation
+		created = append(created, c)
+		result = append(result, newObj)
+	}
+	return result, nil
+}
+
+// purgeObjectGeneration permanently deletes the given generation of the
+// object. Deleting the live version of an object in a bucket with versioning
+// enabled only makes it noncurrent, so it's deleted again in that case.
+func (s *Server) purgeObjectGeneration(bucketName, objectName string, generation int64) {
+	if err := s.backend.DeleteObjectGeneration(bucketName, objectName, generation); err != nil {
+		return
+	}
+	if _, err := s.backend.GetObjectWithGeneration(bucketName, objectName, generation); err == nil {
+		s.backend.DeleteObjectGeneration(bucketName, objectName, generation)
+	}
+}
+
+// parse validates the manifest, returning its buckets and objects.
+func (m seedManifest) parse() ([]backend.Bucket, []Object, error) {
+	buckets := make([]backend.Bucket, 0, len(m.Buckets))
+	for _, entry := range m.Buckets {
+		bucket, err := entry.toBucket()
+		if err != nil {
+			return nil, nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	objs := make([]Object, 0, len(m.Objects))
+	for _, entry := range m.Objects {
+		obj, err := entry.toObject()
+		if err != nil {
+			return nil, nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return buckets, objs, nil
+}
+
+// seed creates the buckets and then the objects of a manifest. Buckets that
+// already exist keep their attributes.
+func (s *Server) seed(buckets []backend.Bucket, objs []Object) ([]Object, error) {
+	for _, bucket := range buckets {
+		if _, err := s.backend.GetBucket(bucket.Name); err == nil {
+			continue
+		}
+		if err := s.backend.CreateBucket(bucket.Name, bucket.Attrs()); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %w", bucket.Name, err)
+		}
+	}
+	return s.seedObjects(objs)
+}
+
+// seedFromFile seeds the server with the manifest in the given file, in JSON
+// or YAML. Relative paths of content files are relative to the directory of
+// the manifest.
+func (s *Server) seedFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	manifest, err := parseSeedManifest(data)
+	if err != nil {
+		return fmt.Errorf("invalid seed manifest %s: %w", path, err)
+	}
+	for i, obj := range manifest.Objects {
+		if obj.Path != "" && !filepath.IsAbs(obj.Path) {
+			manifest.Objects[i].Path = filepath.Join(filepath.Dir(path), obj.Path)
+		}
+	}
+	buckets, objs, err := manifest.parse()
+	if err != nil {
+		return fmt.Errorf("invalid seed manifest %s: %w", path, err)
+	}
+	if _, err := s.seed(buckets, objs); err != nil {
+		return fmt.Errorf("failed to seed from %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *Server) seedFromManifest(r *http.Request) jsonResponse {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Seed manifest can not be read."}
+	}
+	manifest, err := parseSeedManifest(data)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Seed manifest can not be parsed."}
+	}
+	if len(manifest.Buckets) == 0 && len(manifest.Objects) == 0 {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "Seed manifest has no buckets or objects."}
+	}
+
+	buckets, objs, err := manifest.parse()
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+
+	created, err := s.seed(buckets, objs)
+	if err != nil {
+		return errToJsonResponse(err)
+	}
+
+	attrs := make([]ObjectAttrs, len(created))
+	for i, obj := range created {
+		attrs[i] = obj.ObjectAttrs
+	}
+	return jsonResponse{data: newListObjectsResponse(attrs, nil)}
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+)
+
+// ObjectsFromDir returns an object in the given bucket for each file in the
+// directory tree, named after the path of the file relative to dir, with
+// forward slashes.
+//
+// The content type of the objects is detected from the extension of the
+// files, or sniffed from their content when the extension is unknown. The
+// objects get the given Cache-Control, if any.
+func ObjectsFromDir(dir, bucketName, cacheControl string) ([]Object, error) {
+	var objects []Object
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		// Rel() should never return error since path always descend from dir
+		relPath, _ := filepath.Rel(dir, path)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read file %q: %w", path, err)
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = http.DetectContentType(content)
+		}
+		objects = append(objects, Object{
+			ObjectAttrs: ObjectAttrs{
+				BucketName:   bucketName,
+				Name:         filepath.ToSlash(relPath),
+				ContentType:  contentType,
+				CacheControl: cacheControl,
+				Crc32c:       checksum.EncodedCrc32cChecksum(content),
+				Md5Hash:      checksum.EncodedMd5Hash(content),
+			},
+			Content: content,
+		})
+		return nil
+	})
+	return objects, err
+}
+
+// objectsFromSeedDir returns the objects of each top-level folder of dir,
+// using the folders as buckets, along with the buckets of the empty folders.
+// Files in dir itself are ignored, and so is a missing dir, so a default
+// seed directory, such as the one of the Docker image, can be left unmounted.
+// A dir that can't be read, and folders that can't be read or aren't valid
+// bucket names, are skipped with a warning written to w, if any.
+func objectsFromSeedDir(dir, cacheControl string, w io.Writer) ([]Object, []string) {
+	warn := func(format string, args ...interface{}) {
+		if w != nil {
+			fmt.Fprintf(w, format, args...)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			warn("couldn't read the seed directory %q, skipping: %v\n", dir, err)
+		}
+		return nil, nil
+	}
+	var objects []Object
+	var emptyBuckets []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		bucketName := entry.Name()
+		if err := validateBucketName(bucketName); err != nil {
+			warn("invalid bucket folder %q in the seed directory, skipping: %v\n", bucketName, err)
+			continue
+		}
+		bucketPath := filepath.Join(dir, bucketName)
+		bucketObjects, err := ObjectsFromDir(bucketPath, bucketName, cacheControl)
+		if err != nil {
+			warn("couldn't read files from %q, skipping: %v\n", bucketPath, err)
+			continue
+		}
+		if len(bucketObjects) == 0 {
+			emptyBuckets = append(emptyBuckets, bucketName)
+		}
+		objects = append(objects, bucketObjects...)
+	}
+	return objects, emptyBuckets
+}
@@ -0,0 +1,357 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+func TestSeedFromManifest(t *testing.T) {
+	dir, err := os.MkdirTemp(tempDir(), "fakestorage-seed-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "app.js")
+	if err := os.WriteFile(filePath, []byte("console.log(1);"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	manifest := fmt.Sprintf(`{"objects":[
+		{"bucket":"some-bucket","name":"files/txt/text-01.txt","content":%q,"contentType":"text/plain","metadata":{"key":"value"}},
+		{"bucket":"other-bucket","name":"static/js/app.js","path":%q}
+	]}`, base64.StdEncoding.EncodeToString([]byte("something")), filePath)
+	resp, err := server.HTTPClient().Post("https://storage.googleapis.com/_internal/seed", "application/json", strings.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status returned\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	obj, err := server.GetObject("some-bucket", "files/txt/text-01.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "something" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "something", string(obj.Content))
+	}
+	if obj.ContentType != "text/plain" {
+		t.Errorf("wrong content type\nwant %q\ngot  %q", "text/plain", obj.ContentType)
+	}
+	if obj.Metadata["key"] != "value" {
+		t.Errorf("wrong metadata: %v", obj.Metadata)
+	}
+	checkChecksum(t, []byte("something"), obj)
+
+	obj, err = server.GetObject("other-bucket", "static/js/app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "console.log(1);" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "console.log(1);", string(obj.Content))
+	}
+}
+
+func TestSeedFromManifestInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+	}{
+		{"invalid payload", `{`},
+		{"no objects", `{"objects":[]}`},
+		{"invalid bucket name", `{"objects":[{"bucket":"-","name":"file.txt"}]}`},
+		{"missing object name", `{"objects":[{"bucket":"some-bucket"}]}`},
+		{"invalid base64", `{"objects":[{"bucket":"some-bucket","name":"file.txt","content":"!!"}]}`},
+		{"missing file", `{"objects":[{"bucket":"some-bucket","name":"file.txt","path":"/does/not/exist"}]}`},
+		{"content and path", `{"objects":[{"bucket":"some-bucket","name":"file.txt","content":"YQ==","path":"/etc/hosts"}]}`},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{NoListener: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			resp, err := server.HTTPClient().Post("https://storage.googleapis.com/_internal/seed", "application/json", strings.NewReader(test.manifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("wrong status returned\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+			}
+			if buckets, _ := server.backend.ListBuckets(); len(buckets) != 0 {
+				t.Errorf("unexpected buckets created: %v", buckets)
+			}
+		})
+	}
+}
+
+func TestSeedObjectsRollback(t *testing.T) {
+	dir, err := os.MkdirTemp(tempDir(), "fakestorage-seed-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := NewServerWithOptions(Options{
+		NoListener:  true,
+		StorageRoot: dir,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "existing.txt"}, Content: []byte("original")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	_, err = server.seedObjects([]Object{
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "existing.txt"}, Content: []byte("replaced")},
+		{ObjectAttrs: ObjectAttrs{BucketName: "new-bucket", Name: "new.txt"}, Content: []byte("new")},
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: strings.Repeat("a", 1024)}, Content: []byte("too long")},
+	})
+	if err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+
+	obj, err := server.GetObject("some-bucket", "existing.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "original" {
+		t.Errorf("object wasn't restored\nwant %q\ngot  %q", "original", string(obj.Content))
+	}
+	if _, err := server.backend.GetBucket("new-bucket"); err == nil {
+		t.Error("bucket created by the failed seed wasn't removed")
+	}
+}
+
+func TestSeedObjectsRollbackVersionedBucket(t *testing.T) {
+	// the fourth generation exceeds the limit.
+	server, err := NewServerWithOptions(Options{NoListener: true, MemoryLimits: MemoryLimits{MaxObjects: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true})
+	original, err := server.backend.CreateObject(backend.Object{ObjectAttrs: backend.ObjectAttrs{BucketName: "some-bucket", Name: "existing.txt"}, Content: []byte("original")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.seedObjects([]Object{
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "existing.txt"}, Content: []byte("replaced")},
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "existing.txt"}, Content: []byte("replaced again")},
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "new.txt"}, Content: []byte("new")},
+	})
+	if err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+
+	objs, err := server.backend.ListObjects("some-bucket", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("wrong number of generations left\nwant 1\ngot  %d: %+v", len(objs), objs)
+	}
+	obj, err := server.GetObject("some-bucket", "existing.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "original" || obj.Generation != original.Generation {
+		t.Errorf("wrong live version\nwant %q with generation %d\ngot  %q with generation %d", "original", original.Generation, obj.Content, obj.Generation)
+	}
+}
+
+func TestSeedDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"some-bucket/static/app.js": "console.log(1);",
+		"some-bucket/page":          "<html><body>hi</body></html>",
+		"readme.md":                 "not an object",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "empty-bucket"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServerWithOptions(Options{NoListener: true, SeedDir: dir, SeedCacheControl: "public, max-age=60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		{"static/app.js", mime.TypeByExtension(".js")},
+		{"page", "text/html; charset=utf-8"},
+	}
+	for _, test := range tests {
+		obj, err := server.GetObject("some-bucket", test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != files["some-bucket/"+test.name] {
+			t.Errorf("wrong content of %s\nwant %q\ngot  %q", test.name, files["some-bucket/"+test.name], obj.Content)
+		}
+		if obj.ContentType != test.contentType {
+			t.Errorf("wrong content type of %s\nwant %q\ngot  %q", test.name, test.contentType, obj.ContentType)
+		}
+		if obj.CacheControl != "public, max-age=60" {
+			t.Errorf("wrong cache control of %s\nwant %q\ngot  %q", test.name, "public, max-age=60", obj.CacheControl)
+		}
+	}
+	if _, err := server.backend.GetBucket("empty-bucket"); err != nil {
+		t.Errorf("empty bucket not created: %v", err)
+	}
+	buckets, err := server.backend.ListBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 {
+		t.Errorf("wrong number of buckets\nwant 2\ngot  %d", len(buckets))
+	}
+}
+
+func TestSeedDirSkipsInvalidBuckets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"-invalid-bucket", ".git", "some-bucket"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var logs bytes.Buffer
+	server, err := NewServerWithOptions(Options{NoListener: true, SeedDir: dir, Writer: &logs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	buckets, err := server.backend.ListBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 || buckets[0].Name != "some-bucket" {
+		t.Errorf("wrong buckets created: %+v", buckets)
+	}
+	for _, name := range []string{"-invalid-bucket", ".git"} {
+		if !strings.Contains(logs.String(), name) {
+			t.Errorf("missing warning about %q in the logs: %q", name, logs.String())
+		}
+	}
+}
+
+func TestObjectsFromDirMissingDir(t *testing.T) {
+	if _, err := ObjectsFromDir(filepath.Join(t.TempDir(), "missing"), "some-bucket", ""); err == nil {
+		t.Error("unexpected <nil> error")
+	}
+}
+
+func TestSeedManifestFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"a":1}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	manifest := fmt.Sprintf(`
+buckets:
+  - name: versioned-bucket
+    versioning: true
+    storageClass: NEARLINE
+    labels:
+      env: test
+objects:
+  - bucket: versioned-bucket
+    name: data/data.json
+    path: data.json
+    contentType: application/json
+    metadata:
+      key: value
+    generation: 1234
+    acl:
+      - entity: allUsers
+        role: READER
+  - bucket: other-bucket
+    name: inline.txt
+    content: %s
+`, base64.StdEncoding.EncodeToString([]byte("inline content")))
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	if err := os.WriteFile(manifestPath, []byte(manifest), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServerWithOptions(Options{NoListener: true, SeedManifest: manifestPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	bucket, err := server.backend.GetBucket("versioned-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bucket.VersioningEnabled || bucket.DefaultStorageClass != "NEARLINE" || bucket.Labels["env"] != "test" {
+		t.Errorf("wrong bucket attributes: %+v", bucket)
+	}
+	obj, err := server.GetObjectWithGeneration("versioned-bucket", "data/data.json", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != `{"a":1}` || obj.ContentType != "application/json" || obj.Metadata["key"] != "value" {
+		t.Errorf("wrong object seeded: %+v", obj)
+	}
+	if len(obj.ACL) != 1 || obj.ACL[0].Entity != "allUsers" || obj.ACL[0].Role != "READER" {
+		t.Errorf("wrong ACL: %+v", obj.ACL)
+	}
+	if obj.StorageClass != "NEARLINE" {
+		t.Errorf("wrong storage class\nwant %q\ngot  %q", "NEARLINE", obj.StorageClass)
+	}
+	obj, err = server.GetObject("other-bucket", "inline.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "inline content" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "inline content", obj.Content)
+	}
+}
+
+func TestSeedManifestFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	if err := os.WriteFile(manifestPath, []byte("objects:\n  - bucket: some-bucket\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServerWithOptions(Options{NoListener: true, SeedManifest: manifestPath}); err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -21,6 +22,7 @@ import (
 	"net/textproto"
 	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/fsouza/fake-gcs-server/internal/backend"
@@ -37,16 +39,41 @@ const defaultPublicHost = "storage.googleapis.com"
 // Server is the fake server.
 //
 // It provides a fake implementation of the Google Cloud Storage API.
+//
+// A Server is safe for concurrent use by multiple goroutines, so a single
+// instance can be shared by tests running in parallel.
 type Server struct {
-	backend      backend.Storage
-	uploads      sync.Map
-	transport    http.RoundTripper
-	ts           *httptest.Server
-	mux          *mux.Router
-	options      Options
-	externalURL  string
-	publicHost   string
-	eventManager notification.EventManager
+	backend            backend.Storage
+	uploads            sync.Map
+	multipartUploads   sync.Map
+	rewrites           sync.Map
+	transport          http.RoundTripper
+	ts                 *httptest.Server
+	mux                *mux.Router
+	options            Options
+	eventManager       notification.EventManager
+	faults             faultRules
+	retryTests         retryTests
+	latencies          *bucketLatencies
+	operationLatencies *operationLatencies
+	bandwidth          bandwidthLimits
+	listingConsistency listingConsistency
+	chaos              *chaos
+	quotas             bucketQuotas
+	writeRates         writeRateLimits
+	softDeleted        softDeletedObjects
+	iamPolicies        bucketIAMPolicies
+	hmacKeys           projectHMACKeys
+	notifications      *notification.ConfigEventManager
+	seedMtx            sync.Mutex
+	stopBackground     chan struct{}
+	stopOnce           sync.Once
+
+	// configMtx protects the settings that can be changed at runtime
+	// through the /_internal/config endpoint.
+	configMtx   sync.RWMutex
+	externalURL string
+	publicHost  string
 }
 
 // NewServer creates a new instance of the server, pre-loaded with the given
@@ -69,6 +96,44 @@ func NewServerWithHostPort(objects []Object, host string, port uint16) (*Server,
 	})
 }
 
+// S3Options configures the S3-compatible store used as the backend of the
+// server. The S3 bucket must already exist, and it can be shared by multiple
+// servers.
+type S3Options struct {
+	// Endpoint is the URL of the store, such as http://localhost:9000.
+	Endpoint string
+	// Bucket is the S3 bucket that holds all the buckets and objects.
+	Bucket string
+	// Region is used to sign the requests, us-east-1 by default.
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// MemoryLimits limits the objects stored by the memory backend, counting all
+// their versions, so tests can't exhaust the memory of the server. Zero values
+// mean no limit.
+type MemoryLimits struct {
+	MaxBytes   int64
+	MaxObjects int
+	// EvictOldest makes room for new objects by permanently deleting the
+	// oldest objects, noncurrent versions first. Without it, uploads that
+	// would exceed the limits fail with a 403 error with the "quotaExceeded"
+	// reason.
+	EvictOldest bool
+}
+
+// ProxyOptions configures the buckets whose reads are forwarded to Cloud
+// Storage.
+type ProxyOptions struct {
+	// Buckets are the buckets read from Cloud Storage when they, or their
+	// objects, are missing from the server.
+	Buckets []string
+	// Client is used to read from Cloud Storage. When nil, a client is
+	// created with the application default credentials.
+	Client *storage.Client
+}
+
 // Options are used to configure the server on creation.
 type Options struct {
 	InitialObjects []Object
@@ -81,10 +146,81 @@ type Options struct {
 	// client requests will get processed by an internal mocked transport.
 	NoListener bool
 
+	// BoltBackend keeps the metadata of buckets and objects in a Bolt
+	// database in StorageRoot, with the content of the objects in files next
+	// to it, instead of using the filesystem backend. The database survives
+	// restarts without rescanning the files, and supports object
+	// versioning.
+	BoltBackend bool
+
+	// DeduplicateContent makes the Bolt backend store the content of
+	// objects with the same content only once, with a reference count, so
+	// test suites that upload the same fixtures over and over don't
+	// multiply the disk usage. It's ignored by the other backends.
+	DeduplicateContent bool
+
+	// StorageEncryptionKey is an AES-128, AES-192 or AES-256 key used to
+	// encrypt the content of the objects stored by the filesystem backend,
+	// with AES-GCM. The attributes of the objects aren't encrypted. The
+	// same key must be used every time the server is started with the same
+	// StorageRoot. It's ignored by the other backends.
+	StorageEncryptionKey []byte
+
+	// StorageSync makes the filesystem backend flush new objects and
+	// attributes to the disk before the writes return, so they survive a
+	// crash of the machine running the server, at the cost of slower
+	// writes. It's ignored by the other backends.
+	StorageSync bool
+
+	// S3 stores the buckets and objects in a bucket of an S3-compatible
+	// store, such as MinIO, when its Endpoint is set. It takes precedence
+	// over StorageRoot.
+	S3 S3Options
+
+	// MemoryLimits limits the objects stored when the memory backend is
+	// used, that is, without StorageRoot or S3.
+	MemoryLimits MemoryLimits
+
+	// Proxy forwards the reads of missing buckets and objects to Cloud
+	// Storage, storing a copy of what was read in the backend of the server.
+	// Writes and deletions are never forwarded. With StorageRoot set, the
+	// copies are kept across runs, and replayed without reaching Cloud
+	// Storage.
+	Proxy ProxyOptions
+
+	// SeedDir is a directory with the initial buckets and objects of the
+	// server: each top-level folder is a bucket, and each file in it an
+	// object, named after its path in the folder. The content type of the
+	// objects is detected from the names of the files, or their content.
+	// Nothing is seeded when the directory doesn't exist, and folders that
+	// can't be read or aren't valid bucket names are skipped.
+	SeedDir string
+	// SeedCacheControl is the Cache-Control of the objects seeded from
+	// SeedDir.
+	SeedCacheControl string
+	// SeedManifest is a JSON or YAML file describing buckets and objects
+	// created on startup, in the format accepted by the /_internal/seed
+	// endpoint, along with a list of buckets. Relative paths of content files
+	// are relative to the directory of the manifest:
+	//
+	//	buckets:
+	//	  - name: some-bucket
+	//	    versioning: true
+	//	objects:
+	//	  - bucket: some-bucket
+	//	    name: data/file.json
+	//	    path: fixtures/file.json
+	//	    contentType: application/json
+	//	    acl:
+	//	      - entity: allUsers
+	//	        role: READER
+	SeedManifest string
+
 	// Optional external URL, such as https://gcs.127.0.0.1.nip.io:4443
 	// Returned in the Location header for resumable uploads
 	// The "real" value is https://www.googleapis.com, the JSON API
-	// The default is whatever the server is bound to, such as https://0.0.0.0:4443
+	// The default is the scheme and host the request was sent to, taking
+	// the X-Forwarded-Proto and X-Forwarded-Host headers into account
 	ExternalURL string
 
 	// Optional URL for public access
@@ -114,6 +250,87 @@ type Options struct {
 	CertificateLocation string
 
 	PrivateKeyLocation string
+
+	// LatencyProfiles defines additional latency profiles that buckets can
+	// be tagged with through SetBucketLatencyProfile, mapping the profile
+	// name to the latency added to reads.
+	LatencyProfiles map[string]time.Duration
+
+	// OperationLatencies maps the classes of operations, such as
+	// OperationUpload, to the latency added to their requests. See
+	// SetOperationLatency.
+	OperationLatencies map[string]OperationLatency
+
+	// BandwidthLimits are the maximum rates of the content of uploads and
+	// downloads, for simulating slow networks. See SetBandwidthLimits.
+	BandwidthLimits BandwidthLimits
+
+	// ListingConsistencyDelay makes object listings eventually consistent.
+	// See SetListingConsistencyDelay.
+	ListingConsistencyDelay time.Duration
+
+	// Chaos enables the chaos mode, disrupting a share of the requests at
+	// random. See ChaosOptions.
+	Chaos ChaosOptions
+
+	// FaultRules are the fault rules registered when the server starts, as
+	// if they were added with AddFaultRule.
+	FaultRules []FaultRule
+
+	// UploadSessionExpiry is how long resumable upload sessions and XML API
+	// multipart uploads remain valid after being initiated. Expired
+	// uploads are discarded along with their parts. The default is one
+	// week, as in Cloud Storage.
+	UploadSessionExpiry time.Duration
+
+	// SignedURLKeys maps the GoogleAccessId of legacy V2 signed URLs to the
+	// public key used to verify their signature. Signed URLs from access IDs
+	// that aren't in the map are accepted without verification, as long as
+	// they haven't expired.
+	SignedURLKeys map[string]*rsa.PublicKey
+
+	// VerifyPostPolicies enables the validation of the policy documents of
+	// form POST uploads: uploads are rejected when the policy has expired or
+	// the form doesn't meet its conditions. The signature of the policy is
+	// verified when SignedURLKeys has the key of the signer.
+	VerifyPostPolicies bool
+
+	// EnforceObjectACL makes the server reject downloads sent without
+	// credentials (neither an Authorization header nor a signed URL) unless
+	// the ACL of the object grants access to allUsers, as Cloud Storage does
+	// for anonymous requests. Requests with credentials aren't checked.
+	EnforceObjectACL bool
+
+	// LifecycleInterval is how often the lifecycle rules of the buckets are
+	// applied to their objects in the background. When zero, the rules are
+	// only applied when triggered through RunLifecycle or the
+	// /_internal/lifecycle endpoint.
+	LifecycleInterval time.Duration
+
+	// ObjectTTL makes the server delete objects, including all their
+	// versions, once they're older than the given duration, independently of
+	// the lifecycle rules of their buckets. It's useful for keeping shared,
+	// long-lived servers from growing unbounded. See ExpireObjects.
+	ObjectTTL time.Duration
+
+	// Optional path prefix, such as "/gcs", for running the server behind a
+	// reverse proxy that serves it under that path. Requests are accepted
+	// with or without the prefix, and the URLs generated by the server, such
+	// as resumable upload session URIs, include it.
+	BasePath string
+
+	// RewriteChunkSize is the maximum number of bytes copied by each call to
+	// objects.rewrite. When it's set, rewriting larger objects takes
+	// multiple calls, each one returning the rewrite token for the next, as
+	// Cloud Storage does for large objects. Requests can also set it through
+	// the maxBytesRewrittenPerCall parameter.
+	RewriteChunkSize int64
+
+	// StrictContentType makes the server reject JSON API metadata requests,
+	// such as objects.patch, whose body isn't sent as application/json,
+	// with the error returned by Cloud Storage. By default the body is
+	// parsed as JSON regardless of the Content-Type header.
+	StrictContentType bool
 }
 
 // NewServerWithOptions creates a new server configured according to the
@@ -141,20 +358,22 @@ func NewServerWithOptions(options Options) (*Server, error) {
 		handlers.AllowCredentials(),
 	)
 
-	handler := cors(s.mux)
+	handler := s.bucketCORSHandler(s.mux, cors(s.mux))
 	if options.Writer != nil {
 		handler = handlers.LoggingHandler(options.Writer, handler)
 	}
 	handler = requestCompressHandler(handler)
+	handler = s.basePathHandler(handler)
 	s.transport = &muxTransport{handler: handler}
 	if options.NoListener {
 		return s, nil
 	}
 
-	s.eventManager, err = notification.NewPubsubEventManager(options.EventOptions, options.Writer)
+	pubsubEventManager, err := notification.NewPubsubEventManager(options.EventOptions, s.eventPayload, options.Writer)
 	if err != nil {
 		return nil, err
 	}
+	s.eventManager = notification.EventManagers{pubsubEventManager, s.notifications}
 
 	s.ts = httptest.NewUnstartedServer(handler)
 	startFunc := s.ts.StartTLS
@@ -183,37 +402,132 @@ func NewServerWithOptions(options Options) (*Server, error) {
 }
 
 func newServer(options Options) (*Server, error) {
-	backendObjects := toBackendObjects(options.InitialObjects)
+	initialObjects := options.InitialObjects
+	var emptyBuckets []string
+	if options.SeedDir != "" {
+		seedObjects, seedBuckets := objectsFromSeedDir(options.SeedDir, options.SeedCacheControl, options.Writer)
+		initialObjects = append(append([]Object{}, initialObjects...), seedObjects...)
+		emptyBuckets = seedBuckets
+	}
+	backendObjects := toBackendObjects(initialObjects)
 	var backendStorage backend.Storage
 	var err error
-	if options.StorageRoot != "" {
-		backendStorage, err = backend.NewStorageFS(backendObjects, options.StorageRoot)
+	if options.S3.Endpoint != "" {
+		backendStorage, err = backend.NewStorageS3(backendObjects, backend.S3Config{
+			Endpoint:        options.S3.Endpoint,
+			Bucket:          options.S3.Bucket,
+			Region:          options.S3.Region,
+			AccessKeyID:     options.S3.AccessKeyID,
+			SecretAccessKey: options.S3.SecretAccessKey,
+		})
+	} else if options.StorageRoot != "" && options.BoltBackend {
+		backendStorage, err = backend.NewStorageBoltWithOptions(backendObjects, options.StorageRoot, backend.BoltOptions{
+			DeduplicateContent: options.DeduplicateContent,
+		})
+	} else if options.StorageRoot != "" {
+		backendStorage, err = backend.NewStorageFSWithOptions(backendObjects, options.StorageRoot, backend.FSOptions{
+			EncryptionKey: options.StorageEncryptionKey,
+			Sync:          options.StorageSync,
+		})
 	} else {
-		backendStorage = backend.NewStorageMemory(backendObjects)
+		backendStorage = backend.NewStorageMemoryWithLimits(backendObjects, backend.MemoryLimits{
+			MaxBytes:    options.MemoryLimits.MaxBytes,
+			MaxObjects:  options.MemoryLimits.MaxObjects,
+			EvictOldest: options.MemoryLimits.EvictOldest,
+		})
 	}
 	if err != nil {
 		return nil, err
 	}
+	for _, bucketName := range emptyBuckets {
+		if _, err := backendStorage.GetBucket(bucketName); err == nil {
+			continue
+		}
+		if err := backendStorage.CreateBucket(bucketName, backend.BucketAttrs{}); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.Proxy.Buckets) > 0 {
+		client := options.Proxy.Client
+		if client == nil {
+			client, err = storage.NewClient(context.Background())
+			if err != nil {
+				return nil, fmt.Errorf("failed to create the Cloud Storage client of the proxy: %w", err)
+			}
+		}
+		backendStorage, err = backend.NewStorageProxy(backendStorage, backend.ProxyConfig{
+			Client:  client,
+			Buckets: options.Proxy.Buckets,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 	publicHost := options.PublicHost
 	if publicHost == "" {
 		publicHost = defaultPublicHost
 	}
+	options.BasePath = strings.TrimRight(options.BasePath, "/")
+	if options.BasePath != "" && !strings.HasPrefix(options.BasePath, "/") {
+		options.BasePath = "/" + options.BasePath
+	}
+
+	operationLatencies, err := newOperationLatencies(options.OperationLatencies)
+	if err != nil {
+		return nil, err
+	}
+	chaos, err := newChaos(options.Chaos)
+	if err != nil {
+		return nil, err
+	}
 
 	s := Server{
-		backend:      backendStorage,
-		uploads:      sync.Map{},
-		externalURL:  options.ExternalURL,
-		publicHost:   publicHost,
-		options:      options,
-		eventManager: &notification.PubsubEventManager{},
+		backend:            backendStorage,
+		uploads:            sync.Map{},
+		externalURL:        options.ExternalURL,
+		publicHost:         publicHost,
+		options:            options,
+		latencies:          newBucketLatencies(options.LatencyProfiles),
+		operationLatencies: operationLatencies,
+		chaos:              chaos,
+	}
+	s.notifications = notification.NewConfigEventManager(options.EventOptions.PubsubEmulatorHost, s.eventPayload, options.Writer)
+	s.eventManager = s.notifications
+	s.bandwidth.set(options.BandwidthLimits)
+	s.listingConsistency.setDelay(options.ListingConsistencyDelay)
+	for _, rule := range options.FaultRules {
+		if err := s.AddFaultRule(rule); err != nil {
+			return nil, err
+		}
 	}
 	s.buildMuxer()
+	if options.SeedManifest != "" {
+		if err := s.seedFromFile(options.SeedManifest); err != nil {
+			return nil, err
+		}
+	}
+	if options.LifecycleInterval > 0 || options.ObjectTTL > 0 {
+		s.stopBackground = make(chan struct{})
+	}
+	if options.LifecycleInterval > 0 {
+		go s.runLifecyclePeriodically(options.LifecycleInterval, s.stopBackground)
+	}
+	if options.ObjectTTL > 0 {
+		go s.expireObjectsPeriodically(options.ObjectTTL, s.stopBackground)
+	}
 	return &s, nil
 }
 
 func (s *Server) buildMuxer() {
 	const apiPrefix = "/storage/v1"
 	s.mux = mux.NewRouter()
+	s.mux.Use(s.applyOperationLatency)
+	s.mux.Use(s.applyBandwidthLimits)
+	s.mux.Use(s.applyRetryTests)
+	s.mux.Use(s.applyRequestInstructions)
+	s.mux.Use(s.applyChaos)
+	s.mux.Use(s.applyFaultRules)
+	s.mux.Use(s.requireUserProject)
 
 	routers := []*mux.Router{
 		s.mux.PathPrefix(apiPrefix).Subrouter(),
@@ -222,74 +536,180 @@ func (s *Server) buildMuxer() {
 
 	for _, r := range routers {
 		r.Path("/b").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listBuckets))
-		r.Path("/b").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.createBucketByPost))
+		r.Path("/b").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.createBucketByPost)))
 		r.Path("/b/{bucketName}").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getBucket))
+		r.Path("/b/{bucketName}").Methods(http.MethodPatch).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.patchBucket)))
+		r.Path("/b/{bucketName}").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.updateBucket)))
 		r.Path("/b/{bucketName}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.deleteBucket))
+		r.Path("/b/{bucketName}/defaultObjectAcl").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.listDefaultObjectACL)))
+		r.Path("/b/{bucketName}/defaultObjectAcl").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.requireJSONBody(s.setDefaultObjectACL))))
+		r.Path("/b/{bucketName}/defaultObjectAcl/{entity}").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.getDefaultObjectACL)))
+		r.Path("/b/{bucketName}/defaultObjectAcl/{entity}").Methods(http.MethodPut, http.MethodPatch).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.requireJSONBody(s.setDefaultObjectACL))))
+		r.Path("/b/{bucketName}/defaultObjectAcl/{entity}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.deleteDefaultObjectACL)))
+		r.Path("/b/{bucketName}/iam").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getBucketIAMPolicy))
+		r.Path("/b/{bucketName}/iam").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.setBucketIAMPolicy)))
+		r.Path("/b/{bucketName}/iam/testPermissions").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.testBucketIAMPermissions))
+		r.Path("/b/{bucketName}/lockRetentionPolicy").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.lockRetentionPolicy))
+		r.Path("/b/{bucketName}/notificationConfigs").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listNotificationConfigs))
+		r.Path("/b/{bucketName}/notificationConfigs").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.insertNotificationConfig)))
+		r.Path("/b/{bucketName}/notificationConfigs/{notification}").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getNotificationConfig))
+		r.Path("/b/{bucketName}/notificationConfigs/{notification}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.deleteNotificationConfig))
 		r.Path("/b/{bucketName}/o").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listObjects))
 		r.Path("/b/{bucketName}/o").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.insertObject))
-		r.Path("/b/{bucketName}/o/{objectName:.+}").Methods(http.MethodPatch).HandlerFunc(jsonToHTTPHandler(s.patchObject))
-		r.Path("/b/{bucketName}/o/{objectName:.+}/acl").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listObjectACL))
-		r.Path("/b/{bucketName}/o/{objectName:.+}/acl").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.setObjectACL))
-		r.Path("/b/{bucketName}/o/{objectName:.+}/acl/{entity}").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.setObjectACL))
+		r.Path("/b/{bucketName}/o/{objectName:.+}/acl").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.listObjectACL)))
+		r.Path("/b/{bucketName}/o/{objectName:.+}/acl").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.requireJSONBody(s.setObjectACL))))
+		r.Path("/b/{bucketName}/o/{objectName:.+}/acl/{entity}").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.getObjectACLRule)))
+		r.Path("/b/{bucketName}/o/{objectName:.+}/acl/{entity}").Methods(http.MethodPut, http.MethodPatch).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.requireJSONBody(s.setObjectACL))))
+		r.Path("/b/{bucketName}/o/{objectName:.+}/acl/{entity}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.requireLegacyACLs(s.deleteObjectACLRule)))
+		r.Path("/b/{bucketName}/o/{objectName:.+}").Methods(http.MethodPatch).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.patchObject)))
 		r.Path("/b/{bucketName}/o/{objectName:.+}").Methods(http.MethodGet, http.MethodHead).HandlerFunc(s.getObject)
 		r.Path("/b/{bucketName}/o/{objectName:.+}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.deleteObject))
-		r.Path("/b/{sourceBucket}/o/{sourceObject:.+}/copyTo/b/{destinationBucket}/o/{destinationObject:.+}").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.rewriteObject))
-		r.Path("/b/{sourceBucket}/o/{sourceObject:.+}/rewriteTo/b/{destinationBucket}/o/{destinationObject:.+}").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.rewriteObject))
-		r.Path("/b/{bucketName}/o/{destinationObject:.+}/compose").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.composeObject))
-		r.Path("/b/{bucketName}/o/{objectName:.+}").Methods(http.MethodPut, http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.updateObject))
+		r.Path("/b/{sourceBucket}/o/{sourceObject:.+}/copyTo/b/{destinationBucket}/o/{destinationObject:.+}").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.copyObject)))
+		r.Path("/b/{sourceBucket}/o/{sourceObject:.+}/rewriteTo/b/{destinationBucket}/o/{destinationObject:.+}").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.rewriteObject)))
+		r.Path("/b/{bucketName}/o/{destinationObject:.+}/compose").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.composeObject)))
+		r.Path("/b/{bucketName}/o/{objectName:.+}/restore").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.restoreObject))
+		r.Path("/b/{bucketName}/o/{objectName:.+}").Methods(http.MethodPut, http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.updateObject)))
+		r.Path("/projects/{projectId}/serviceAccount").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getServiceAccount))
+		r.Path("/projects/{projectId}/hmacKeys").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listHMACKeys))
+		r.Path("/projects/{projectId}/hmacKeys").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.createHMACKey))
+		r.Path("/projects/{projectId}/hmacKeys/{accessId}").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getHMACKey))
+		r.Path("/projects/{projectId}/hmacKeys/{accessId}").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.requireJSONBody(s.updateHMACKey)))
+		r.Path("/projects/{projectId}/hmacKeys/{accessId}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.deleteHMACKey))
 	}
 
 	// Internal / update server configuration
 	s.mux.Path("/_internal/config").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.updateServerConfig))
 	s.mux.MatcherFunc(s.publicHostMatcher).Path("/_internal/config").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.updateServerConfig))
+	s.mux.Path("/_internal/capabilities").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getCapabilities))
+	s.mux.MatcherFunc(s.publicHostMatcher).Path("/_internal/capabilities").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getCapabilities))
+	s.mux.Path("/_internal/buckets/{bucketName}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.forceDeleteBucket))
+	s.mux.Path("/_internal/faults").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listFaultRules))
+	s.mux.Path("/_internal/faults").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.addFaultRule))
+	s.mux.Path("/_internal/faults").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.clearFaultRules))
+	s.mux.Path("/_internal/lifecycle").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.runLifecycle))
+	s.mux.Path("/_internal/latency").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listLatencyProfiles))
+	s.mux.Path("/_internal/latency").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.setBucketLatencyProfile))
+	s.mux.Path("/_internal/latency/operations").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.setOperationLatency))
+	s.mux.Path("/_internal/bandwidth").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getBandwidthLimits))
+	s.mux.Path("/_internal/bandwidth").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.setBandwidthLimits))
+	s.mux.Path("/_internal/quotas").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listBucketQuotas))
+	s.mux.Path("/_internal/quotas").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.setBucketQuota))
+	s.mux.Path("/_internal/ratelimits").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listWriteRateLimits))
+	s.mux.Path("/_internal/ratelimits").Methods(http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.setWriteRateLimit))
+	s.mux.Path("/_internal/refresh").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.refresh))
+	s.mux.Path("/_internal/seed").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.seedFromManifest))
+	s.mux.Path("/_internal/stats").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getStats))
+	s.mux.Path("/_internal/stats/{bucketName}").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getBucketStats))
+	s.mux.Path("/_internal/versions/{bucketName}/{objectName:.+}").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listObjectVersions))
 	// Internal - end
 
-	bucketHost := fmt.Sprintf("{bucketName}.%s", s.publicHost)
-	s.mux.Host(bucketHost).Path("/{objectName:.+}").Methods(http.MethodGet, http.MethodHead).HandlerFunc(s.downloadObject)
+	// Retry Test API of the storage testbench
+	s.mux.Path("/retry_test").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.createRetryTest))
+	s.mux.Path("/retry_test/{id}").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.getRetryTest))
+	s.mux.Path("/retry_test/{id}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.deleteRetryTest))
+	s.mux.Path("/retry_tests").Methods(http.MethodGet).HandlerFunc(jsonToHTTPHandler(s.listRetryTests))
+
+	s.mux.MatcherFunc(s.bucketHostMatcher).Path("/{objectName:.+}").Methods(http.MethodGet, http.MethodHead).HandlerFunc(s.downloadObject)
 	s.mux.Path("/download/storage/v1/b/{bucketName}/o/{objectName:.+}").Methods(http.MethodGet).HandlerFunc(s.downloadObject)
 	s.mux.Path("/upload/storage/v1/b/{bucketName}/o").Methods(http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.insertObject))
 	s.mux.Path("/upload/resumable/{uploadId}").Methods(http.MethodPut, http.MethodPost).HandlerFunc(jsonToHTTPHandler(s.uploadFileContent))
+	s.mux.Path("/upload/resumable/{uploadId}").Methods(http.MethodDelete).HandlerFunc(jsonToHTTPHandler(s.cancelUpload))
 
 	// Batch endpoint
 	s.mux.MatcherFunc(s.publicHostMatcher).Path("/batch/storage/v1").Methods(http.MethodPost).HandlerFunc(s.handleBatchCall)
 	s.mux.Path("/batch/storage/v1").Methods(http.MethodPost).HandlerFunc(s.handleBatchCall)
 
+	// XML API multipart uploads
+	xmlObjectRoutes := []func() *mux.Route{
+		func() *mux.Route { return s.mux.MatcherFunc(s.publicHostMatcher).Path("/{bucketName}/{objectName:.+}") },
+		func() *mux.Route { return s.mux.MatcherFunc(s.bucketHostMatcher).Path("/{objectName:.+}") },
+		func() *mux.Route { return s.mux.Host("{bucketName:.+}").Path("/{objectName:.+}") },
+	}
+	for _, route := range xmlObjectRoutes {
+		route().Methods(http.MethodPost).Queries("uploads", "").HandlerFunc(xmlToHTTPHandler(s.initiateMultipartUpload))
+		route().Methods(http.MethodPut).Queries("uploadId", "{uploadId}", "partNumber", "{partNumber}").HandlerFunc(xmlToHTTPHandler(s.uploadPart))
+		route().Methods(http.MethodPost).Queries("uploadId", "{uploadId}").HandlerFunc(xmlToHTTPHandler(s.completeMultipartUpload))
+		route().Methods(http.MethodDelete).Queries("uploadId", "{uploadId}").HandlerFunc(xmlToHTTPHandler(s.abortMultipartUpload))
+		route().Methods(http.MethodGet).Queries("uploadId", "{uploadId}").HandlerFunc(xmlToHTTPHandler(s.listParts))
+	}
+	s.mux.MatcherFunc(s.publicHostMatcher).Path("/{bucketName}").Methods(http.MethodGet).Queries("uploads", "").HandlerFunc(xmlToHTTPHandler(s.listMultipartUploads))
+	s.mux.MatcherFunc(s.bucketHostMatcher).Path("/").Methods(http.MethodGet).Queries("uploads", "").HandlerFunc(xmlToHTTPHandler(s.listMultipartUploads))
+	s.mux.Host("{bucketName:.+}").Path("/").Methods(http.MethodGet).Queries("uploads", "").HandlerFunc(xmlToHTTPHandler(s.listMultipartUploads))
+
 	s.mux.MatcherFunc(s.publicHostMatcher).Path("/{bucketName}/{objectName:.+}").Methods(http.MethodGet, http.MethodHead).HandlerFunc(s.downloadObject)
 	s.mux.Host("{bucketName:.+}").Path("/{objectName:.+}").Methods(http.MethodGet, http.MethodHead).HandlerFunc(s.downloadObject)
 
 	// Form Uploads
-	s.mux.Host(s.publicHost).Path("/{bucketName}").MatcherFunc(matchFormData).Methods(http.MethodPost, http.MethodPut).HandlerFunc(xmlToHTTPHandler(s.insertFormObject))
-	s.mux.Host(bucketHost).MatcherFunc(matchFormData).Methods(http.MethodPost, http.MethodPut).HandlerFunc(xmlToHTTPHandler(s.insertFormObject))
+	s.mux.MatcherFunc(s.publicHostMatcher).Path("/{bucketName}").MatcherFunc(matchFormData).Methods(http.MethodPost, http.MethodPut).HandlerFunc(xmlToHTTPHandler(s.insertFormObject))
+	s.mux.MatcherFunc(s.publicHostMatcher).Path("/{bucketName}/").MatcherFunc(matchFormData).Methods(http.MethodPost, http.MethodPut).HandlerFunc(xmlToHTTPHandler(s.insertFormObject))
+	s.mux.MatcherFunc(s.bucketHostMatcher).MatcherFunc(matchFormData).Methods(http.MethodPost, http.MethodPut).HandlerFunc(xmlToHTTPHandler(s.insertFormObject))
 
 	// Signed URL Uploads
-	s.mux.Host(s.publicHost).Path("/{bucketName}/{objectName:.+}").Methods(http.MethodPost, http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.insertObject))
-	s.mux.Host(bucketHost).Path("/{objectName:.+}").Methods(http.MethodPost, http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.insertObject))
-	s.mux.Host("{bucketName:.+}").Path("/{objectName:.+}").Methods(http.MethodPost, http.MethodPut).HandlerFunc(jsonToHTTPHandler(s.insertObject))
+	s.mux.MatcherFunc(s.publicHostMatcher).Path("/{bucketName}/{objectName:.+}").Methods(http.MethodPost, http.MethodPut).HandlerFunc(jsonToXMLAPIHandler(s.insertObject))
+	s.mux.MatcherFunc(s.bucketHostMatcher).Path("/{objectName:.+}").Methods(http.MethodPost, http.MethodPut).HandlerFunc(jsonToXMLAPIHandler(s.insertObject))
+	s.mux.Host("{bucketName:.+}").Path("/{objectName:.+}").Methods(http.MethodPost, http.MethodPut).HandlerFunc(jsonToXMLAPIHandler(s.insertObject))
 }
 
 // publicHostMatcher matches incoming requests against the currently specified server publicHost.
 func (s *Server) publicHostMatcher(r *http.Request, rm *mux.RouteMatch) bool {
-	if strings.Contains(s.publicHost, ":") || !strings.Contains(r.Host, ":") {
-		return r.Host == s.publicHost
+	publicHost := s.getPublicHost()
+	if strings.Contains(publicHost, ":") || !strings.Contains(r.Host, ":") {
+		return r.Host == publicHost
 	}
 	idx := strings.IndexByte(r.Host, ':')
-	return r.Host[:idx] == s.publicHost
+	return r.Host[:idx] == publicHost
+}
+
+// bucketHostMatcher matches virtual-hosted style requests, addressed to
+// <bucket>.<publicHost>, setting the bucketName variable to the bucket in the
+// host. As in publicHostMatcher, the port of the request is ignored when the
+// public host doesn't have one. Bucket names may contain dots.
+func (s *Server) bucketHostMatcher(r *http.Request, rm *mux.RouteMatch) bool {
+	publicHost := s.getPublicHost()
+	host := r.Host
+	if idx := strings.IndexByte(host, ':'); idx >= 0 && !strings.Contains(publicHost, ":") {
+		host = host[:idx]
+	}
+	bucketName := strings.TrimSuffix(host, "."+publicHost)
+	if bucketName == host || bucketName == "" {
+		return false
+	}
+	if rm.Vars == nil {
+		rm.Vars = make(map[string]string)
+	}
+	rm.Vars["bucketName"] = bucketName
+	return true
+}
+
+func (s *Server) getPublicHost() string {
+	s.configMtx.RLock()
+	defer s.configMtx.RUnlock()
+	return s.publicHost
 }
 
 // Stop stops the server, closing all connections.
 func (s *Server) Stop() {
+	if s.stopBackground != nil {
+		s.stopOnce.Do(func() { close(s.stopBackground) })
+	}
 	if s.ts != nil {
 		if transport, ok := s.transport.(*http.Transport); ok {
 			transport.CloseIdleConnections()
 		}
 		s.ts.Close()
 	}
+	if closer, ok := s.backend.(io.Closer); ok {
+		closer.Close()
+	}
 }
 
 // URL returns the server URL.
 func (s *Server) URL() string {
-	if s.externalURL != "" {
-		return s.externalURL
+	s.configMtx.RLock()
+	externalURL := s.externalURL
+	s.configMtx.RUnlock()
+	if externalURL != "" {
+		return externalURL
 	}
 	if s.ts != nil {
 		return s.ts.URL
@@ -299,7 +719,44 @@ func (s *Server) URL() string {
 
 // PublicURL returns the server's public download URL.
 func (s *Server) PublicURL() string {
-	return fmt.Sprintf("%s://%s", s.scheme(), s.publicHost)
+	return fmt.Sprintf("%s://%s%s", s.scheme(), s.getPublicHost(), s.options.BasePath)
+}
+
+// baseURL returns the URL used as the base for the URLs generated by the
+// server in response to the given request, followed by the configured base
+// path.
+//
+// The URL is ExternalURL when it's configured. Otherwise it's derived from the
+// request, honoring the X-Forwarded-Host and X-Forwarded-Proto headers, so
+// the generated URLs are reachable by the client even when the server is
+// accessed through port forwarding or a container network.
+func (s *Server) baseURL(r *http.Request) string {
+	s.configMtx.RLock()
+	externalURL := s.externalURL
+	s.configMtx.RUnlock()
+	if externalURL != "" {
+		return strings.TrimRight(externalURL, "/") + s.options.BasePath
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	if host == "" {
+		return s.URL() + s.options.BasePath
+	}
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		// Requests handled by the in-process transport keep the scheme
+		// in the URL.
+		scheme = r.URL.Scheme
+	}
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, s.options.BasePath)
 }
 
 func (s *Server) scheme() string {
@@ -323,6 +780,12 @@ func (s *Server) Client() *storage.Client {
 	return client
 }
 
+// maxBatchCalls is the maximum number of calls in a single batch request.
+const maxBatchCalls = 100
+
+// handleBatchCall serves a batch request: each part of the multipart/mixed
+// body is an HTTP request that the server handles, and the response contains
+// a part with the response to each of them, in the same order.
 func (s *Server) handleBatchCall(w http.ResponseWriter, r *http.Request) {
 	reader, err := r.MultipartReader()
 	if err != nil {
@@ -330,51 +793,66 @@ func (s *Server) handleBatchCall(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	type batchPart struct {
+		header  textproto.MIMEHeader
+		content []byte
+		err     error
+	}
+	var parts []batchPart
+	part, err := reader.NextPart()
+	for ; err == nil; part, err = reader.NextPart() {
+		content, err := io.ReadAll(part)
+		part.Close()
+		parts = append(parts, batchPart{header: part.Header, content: content, err: err})
+	}
+	if err != io.EOF {
+		http.Error(w, "invalid multipart batch request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(parts) > maxBatchCalls {
+		http.Error(w, fmt.Sprintf("too many calls in batch request, the limit is %d", maxBatchCalls), http.StatusBadRequest)
+		return
+	}
+
 	var b bytes.Buffer
 	mw := multipart.NewWriter(&b)
 	defer mw.Close()
 	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
 
 	w.WriteHeader(http.StatusOK)
-	part, err := reader.NextPart()
-	for ; err == nil; part, err = reader.NextPart() {
-		contentID := part.Header.Get("Content-ID")
-		if contentID == "" {
-			// missing content ID, skip
-			continue
-		}
-
+	for _, part := range parts {
+		contentID := part.header.Get("Content-ID")
 		partHeaders := textproto.MIMEHeader{}
 		partHeaders.Set("Content-Type", "application/http")
-		partHeaders.Set("Content-ID", strings.Replace(contentID, "<", "<response-", 1))
+		if contentID != "" {
+			partHeaders.Set("Content-ID", strings.Replace(contentID, "<", "<response-", 1))
+		}
 		partWriter, err := mw.CreatePart(partHeaders)
 		if err != nil {
 			continue
 		}
 
 		partResponseWriter := httptest.NewRecorder()
-		if part.Header.Get("Content-Type") != "application/http" {
+		if mediaType, _, _ := mime.ParseMediaType(part.header.Get("Content-Type")); mediaType != "application/http" {
 			http.Error(partResponseWriter, "invalid Content-Type header", http.StatusBadRequest)
 			writeMultipartResponse(partResponseWriter.Result(), partWriter, contentID)
 			continue
 		}
 
-		content, err := io.ReadAll(part)
-		part.Close()
-		if err != nil {
+		if part.err != nil {
 			http.Error(partResponseWriter, "unable to process request", http.StatusBadRequest)
 			writeMultipartResponse(partResponseWriter.Result(), partWriter, contentID)
 			continue
 		}
 
-		partRequest, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(content)))
+		partRequest, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(part.content)))
 		if err != nil {
 			http.Error(partResponseWriter, "unable to process request", http.StatusBadRequest)
 			writeMultipartResponse(partResponseWriter.Result(), partWriter, contentID)
 			continue
 		}
 
-		s.mux.ServeHTTP(partResponseWriter, partRequest)
+		s.mux.ServeHTTP(partResponseWriter, s.trimBasePath(partRequest))
 		writeMultipartResponse(partResponseWriter.Result(), partWriter, contentID)
 	}
 	mw.Close()
@@ -387,6 +865,12 @@ func (s *Server) handleBatchCall(w http.ResponseWriter, r *http.Request) {
 }
 
 func writeMultipartResponse(r *http.Response, w io.Writer, contentId string) {
+	// Set the length of the body, so each response can be parsed on its own.
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
 	dump, err := httputil.DumpResponse(r, true)
 	if err != nil {
 		fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\nContent-ID: %s\r\nContent-Length: 0\r\n\r\nHTTP/1.1 500 Internal Server Error", contentId)
@@ -395,6 +879,41 @@ func writeMultipartResponse(r *http.Response, w io.Writer, contentId string) {
 	w.Write(dump)
 }
 
+// basePathHandler removes the base path from the requests it serves.
+func (s *Server) basePathHandler(h http.Handler) http.Handler {
+	if s.options.BasePath == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, s.trimBasePath(r))
+	})
+}
+
+// trimBasePath returns a request for the path of r without the base path.
+// Requests that don't start with the base path are returned unchanged.
+func (s *Server) trimBasePath(r *http.Request) *http.Request {
+	basePath := s.options.BasePath
+	if basePath == "" {
+		return r
+	}
+	path := strings.TrimPrefix(r.URL.Path, basePath)
+	if path == r.URL.Path || (path != "" && path[0] != '/') {
+		return r
+	}
+	if path == "" {
+		path = "/"
+	}
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	if rawPath := strings.TrimPrefix(r.URL.RawPath, basePath); rawPath != r.URL.RawPath {
+		u.RawPath = rawPath
+	}
+	r = r.Clone(r.Context())
+	r.URL = &u
+	return r
+}
+
 func requestCompressHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("content-encoding") == "gzip" {
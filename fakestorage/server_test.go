@@ -5,13 +5,21 @@
 package fakestorage
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -261,6 +269,95 @@ func TestDownloadPartialHostValidationShouldntValidatePortPartially(t *testing.T
 	}
 }
 
+func TestVirtualHostedStyleRequests(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		PublicHost: "storage.example.test",
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "files/text-01.txt"}, Content: []byte("something")},
+			{ObjectAttrs: ObjectAttrs{BucketName: "dotted.bucket.name", Name: "text-02.txt"}, Content: []byte("something else")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	get := func(url string) (int, string) {
+		t.Helper()
+		resp, err := server.HTTPClient().Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(data)
+	}
+
+	tests := []struct {
+		name         string
+		url          string
+		expectedBody string
+	}{
+		{
+			name:         "bucket in host",
+			url:          "https://some-bucket.storage.example.test/files/text-01.txt",
+			expectedBody: "something",
+		},
+		{
+			name:         "bucket in host with port",
+			url:          "https://some-bucket.storage.example.test:4443/files/text-01.txt",
+			expectedBody: "something",
+		},
+		{
+			name:         "bucket with dots in host",
+			url:          "https://dotted.bucket.name.storage.example.test/text-02.txt",
+			expectedBody: "something else",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			status, body := get(test.url)
+			if status != http.StatusOK {
+				t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, status)
+			}
+			if body != test.expectedBody {
+				t.Errorf("wrong body\nwant %q\ngot  %q", test.expectedBody, body)
+			}
+		})
+	}
+
+	t.Run("initiate multipart upload", func(t *testing.T) {
+		resp, err := server.HTTPClient().Post("https://some-bucket.storage.example.test/files/multipart.txt?uploads", "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			Bucket string `xml:"Bucket"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Bucket != "some-bucket" {
+			t.Errorf("wrong bucket\nwant %q\ngot  %q", "some-bucket", result.Bucket)
+		}
+	})
+
+	t.Run("after public host change", func(t *testing.T) {
+		server.configMtx.Lock()
+		server.publicHost = "gcs.example.test"
+		server.configMtx.Unlock()
+		if status, _ := get("https://some-bucket.gcs.example.test/files/text-01.txt"); status != http.StatusOK {
+			t.Errorf("wrong status\nwant %d\ngot  %d", http.StatusOK, status)
+		}
+	})
+}
+
 func testDownloadObject(t *testing.T, server *Server) {
 	tests := []struct {
 		name            string
@@ -273,7 +370,7 @@ func testDownloadObject(t *testing.T, server *Server) {
 			"GET: bucket in the path",
 			http.MethodGet,
 			"://storage.googleapis.com/some-bucket/files/txt/text-01.txt",
-			map[string]string{"accept-ranges": "bytes", "content-length": "9"},
+			map[string]string{"accept-ranges": "bytes", "content-length": "9", "x-goog-storage-class": "STANDARD"},
 			"something",
 		},
 		{
@@ -358,6 +455,10 @@ func testDownloadObjectRange(t *testing.T, server *Server) {
 		{"Partial range specified", map[string]string{"Range": "bytes=1-4"}, http.StatusPartialContent, "bytes 1-4/9", "omet"},
 		{"Exact range specified", map[string]string{"Range": "bytes=0-8"}, http.StatusPartialContent, "bytes 0-8/9", "something"},
 		{"Too-long range specified", map[string]string{"Range": "bytes=0-100"}, http.StatusPartialContent, "bytes 0-8/9", "something"},
+		{"Open-ended range specified", map[string]string{"Range": "bytes=4-"}, http.StatusPartialContent, "bytes 4-8/9", "thing"},
+		{"Suffix range specified", map[string]string{"Range": "bytes=-5"}, http.StatusPartialContent, "bytes 4-8/9", "thing"},
+		{"Too-long suffix range specified", map[string]string{"Range": "bytes=-100"}, http.StatusPartialContent, "bytes 0-8/9", "something"},
+		{"Malformed range specified", map[string]string{"Range": "bytes=4-1"}, http.StatusOK, "", "something"},
 	}
 	for _, test := range tests {
 		test := test
@@ -455,6 +556,472 @@ func TestUpdateServerConfig(t *testing.T) {
 	}
 }
 
+// TestServerConcurrentUse shares a single server between parallel tests. Run
+// it with -race to detect unsynchronized access to the server state.
+func TestServerBasePath(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener:  true,
+		ExternalURL: "https://proxy.example.com",
+		BasePath:    "gcs/",
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte("something")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	if publicURL := server.PublicURL(); publicURL != "https://storage.googleapis.com/gcs" {
+		t.Errorf("wrong public URL\nwant %q\ngot  %q", "https://storage.googleapis.com/gcs", publicURL)
+	}
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+	}{
+		{"/gcs/storage/v1/b/some-bucket/o/file.txt", http.StatusOK},
+		{"/storage/v1/b/some-bucket/o/file.txt", http.StatusOK},
+		{"/gcs/some-bucket/file.txt", http.StatusOK},
+		{"/gcsother/storage/v1/b/some-bucket/o/file.txt", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp, err := client.Get("https://storage.googleapis.com" + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("%s: wrong status returned\nwant %d\ngot  %d", test.path, test.expectedStatus, resp.StatusCode)
+		}
+	}
+
+	resp, err := client.Post("https://proxy.example.com/gcs/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=uploaded.txt", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "https://proxy.example.com/gcs/upload/resumable/") {
+		t.Fatalf("resumable session URI doesn't include the base path: %q", location)
+	}
+	req, err := http.NewRequest(http.MethodPut, location, strings.NewReader("uploaded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status uploading to the session URI\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	if _, err := server.GetObject("some-bucket", "uploaded.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerStrictContentType(t *testing.T) {
+	tests := []struct {
+		name           string
+		strict         bool
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{"json", true, "application/json; charset=UTF-8", `{"metadata":{"key":"value"}}`, http.StatusOK},
+		{"missing content type", true, "", `{"metadata":{"key":"value"}}`, http.StatusBadRequest},
+		{"form encoded", true, "application/x-www-form-urlencoded", `{"metadata":{"key":"value"}}`, http.StatusBadRequest},
+		{"text", true, "text/plain", `{"metadata":{"key":"value"}}`, http.StatusBadRequest},
+		{"not strict", false, "text/plain", `{"metadata":{"key":"value"}}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{
+				NoListener:        true,
+				StrictContentType: test.strict,
+				InitialObjects: []Object{
+					{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "object.txt"}, Content: []byte("content")},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+
+			req, err := http.NewRequest(http.MethodPatch, "https://storage.googleapis.com/storage/v1/b/some-bucket/o/object.txt", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Fatalf("wrong status returned\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedStatus != http.StatusBadRequest {
+				return
+			}
+			var errResp errorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+				t.Fatal(err)
+			}
+			if len(errResp.Error.Errors) != 1 || errResp.Error.Errors[0].Reason != "parseError" {
+				t.Errorf("wrong errors returned: %+v", errResp.Error.Errors)
+			}
+		})
+	}
+}
+
+func TestServerJSONErrorResponses(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "object.txt"}, Content: []byte("content")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name     string
+		url      string
+		expected httpError
+	}{
+		{
+			name: "missing object",
+			url:  "https://storage.googleapis.com/storage/v1/b/some-bucket/o/missing.txt",
+			expected: httpError{
+				Code:    http.StatusNotFound,
+				Message: "Not Found",
+				Errors:  []apiError{{Domain: "global", Reason: "notFound", Message: "Not Found"}},
+			},
+		},
+		{
+			name: "missing object download",
+			url:  "https://storage.googleapis.com/download/storage/v1/b/some-bucket/o/missing.txt?alt=media",
+			expected: httpError{
+				Code:    http.StatusNotFound,
+				Message: "Not Found",
+				Errors:  []apiError{{Domain: "global", Reason: "notFound", Message: "Not Found"}},
+			},
+		},
+		{
+			name: "failed generation precondition",
+			url:  "https://storage.googleapis.com/storage/v1/b/some-bucket/o/object.txt?ifGenerationMatch=1",
+			expected: httpError{
+				Code:    http.StatusPreconditionFailed,
+				Message: "Precondition failed",
+				Errors: []apiError{{
+					Domain:       "global",
+					Reason:       "conditionNotMet",
+					Message:      "Precondition failed",
+					LocationType: "header",
+					Location:     "If-Match",
+				}},
+			},
+		},
+		{
+			name: "failed metageneration precondition",
+			url:  "https://storage.googleapis.com/storage/v1/b/some-bucket/o/object.txt?ifMetagenerationMatch=2",
+			expected: httpError{
+				Code:    http.StatusPreconditionFailed,
+				Message: "Precondition failed",
+				Errors: []apiError{{
+					Domain:       "global",
+					Reason:       "conditionNotMet",
+					Message:      "Precondition failed",
+					LocationType: "header",
+					Location:     "If-Metageneration-Match",
+				}},
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := server.HTTPClient().Get(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expected.Code {
+				t.Errorf("wrong status returned\nwant %d\ngot  %d", test.expected.Code, resp.StatusCode)
+			}
+			if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("wrong content type\nwant %q\ngot  %q", "application/json", contentType)
+			}
+			var errResp errorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(errResp.Error, test.expected) {
+				t.Errorf("wrong error returned\nwant %+v\ngot  %+v", test.expected, errResp.Error)
+			}
+		})
+	}
+}
+
+func TestServerConcurrentUse(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < 8; i++ {
+			bucketName := fmt.Sprintf("bucket-%d", i%2)
+			objectName := fmt.Sprintf("object-%d", i%3)
+			t.Run(strconv.Itoa(i), func(t *testing.T) {
+				t.Parallel()
+				server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName})
+				client := server.Client()
+				for j := 0; j < 10; j++ {
+					server.CreateObject(Object{
+						ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName, Metadata: map[string]string{"iteration": strconv.Itoa(j)}},
+						Content:     []byte("some content"),
+					})
+					obj := client.Bucket(bucketName).Object(objectName)
+					w := obj.NewWriter(context.Background())
+					w.Write([]byte("other content"))
+					if err := w.Close(); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := obj.Update(context.Background(), storage.ObjectAttrsToUpdate{Metadata: map[string]string{"key": "value"}}); err != nil {
+						t.Fatal(err)
+					}
+					if reader, err := obj.NewReader(context.Background()); err == nil {
+						io.ReadAll(reader)
+						reader.Close()
+					}
+					if _, _, err := server.ListObjectsWithOptions(bucketName, ListOptions{}); err != nil {
+						t.Fatal(err)
+					}
+					server.GetObject(bucketName, objectName)
+					server.URL()
+					server.PublicURL()
+
+					req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/config", strings.NewReader(`{"publicHost":"storage.googleapis.com"}`))
+					if err != nil {
+						t.Fatal(err)
+					}
+					resp, err := server.HTTPClient().Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					resp.Body.Close()
+				}
+			})
+		}
+	})
+}
+
+func TestServerCapabilities(t *testing.T) {
+	dir, err := os.MkdirTemp(tempDir(), "fakestorage-test-root-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name               string
+		options            Options
+		expectedBackend    string
+		expectedVersioning bool
+	}{
+		{
+			"memory backend",
+			Options{NoListener: true},
+			"memory",
+			true,
+		},
+		{
+			"filesystem backend",
+			Options{NoListener: true, StorageRoot: dir},
+			"filesystem",
+			false,
+		},
+		{
+			"bolt backend",
+			Options{NoListener: true, StorageRoot: dir, BoltBackend: true},
+			"bolt",
+			true,
+		},
+		{
+			"s3 backend",
+			Options{NoListener: true, StorageRoot: dir, S3: S3Options{Endpoint: "http://127.0.0.1:1", Bucket: "some-s3-bucket"}},
+			"s3",
+			false,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/_internal/capabilities", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("wrong status returned\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+			}
+			var caps capabilitiesResponse
+			if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+				t.Fatal(err)
+			}
+			if caps.Backend != test.expectedBackend {
+				t.Errorf("wrong backend\nwant %q\ngot  %q", test.expectedBackend, caps.Backend)
+			}
+			if caps.Transports["grpc"] {
+				t.Error("unexpected grpc transport reported as supported")
+			}
+			var found bool
+			for _, feature := range caps.Features {
+				if feature.Name == "versioning" {
+					found = true
+					if feature.Supported != test.expectedVersioning {
+						t.Errorf("wrong versioning support\nwant %t\ngot  %t", test.expectedVersioning, feature.Supported)
+					}
+				}
+			}
+			if !found {
+				t.Error("versioning feature not reported")
+			}
+		})
+	}
+}
+
+func TestDownloadObjectXMLError(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+
+	tests := []struct {
+		name            string
+		url             string
+		expectedStatus  int
+		expectedCode    string
+		expectedDetails string
+	}{
+		{
+			"missing object",
+			"https://storage.googleapis.com/some-bucket/files/txt/text-01.txt",
+			http.StatusNotFound,
+			"NoSuchKey",
+			"No such object: some-bucket/files/txt/text-01.txt",
+		},
+		{
+			"missing object in bucket host",
+			"https://some-bucket.storage.googleapis.com/files/txt/text-01.txt",
+			http.StatusNotFound,
+			"NoSuchKey",
+			"No such object: some-bucket/files/txt/text-01.txt",
+		},
+		{
+			"invalid generation",
+			"https://storage.googleapis.com/some-bucket/files/txt/text-01.txt?generation=abc",
+			http.StatusBadRequest,
+			"InvalidArgument",
+			"invalid generation ID",
+		},
+	}
+	client := server.HTTPClient()
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Get(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status returned\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/xml") {
+				t.Errorf("wrong content type returned: %q", contentType)
+			}
+			var xmlErr xmlErrorResponse
+			if err := xml.NewDecoder(resp.Body).Decode(&xmlErr); err != nil {
+				t.Fatal(err)
+			}
+			if xmlErr.Code != test.expectedCode {
+				t.Errorf("wrong error code\nwant %q\ngot  %q", test.expectedCode, xmlErr.Code)
+			}
+			if xmlErr.Details != test.expectedDetails {
+				t.Errorf("wrong error details\nwant %q\ngot  %q", test.expectedDetails, xmlErr.Details)
+			}
+		})
+	}
+}
+
+func TestXMLBucketNotFound(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+	}{
+		{"download", http.MethodGet, "https://storage.googleapis.com/missing-bucket/file.txt"},
+		{"download from bucket host", http.MethodGet, "https://missing-bucket.storage.googleapis.com/file.txt"},
+		{"upload", http.MethodPut, "https://storage.googleapis.com/missing-bucket/file.txt"},
+		{"initiate multipart upload", http.MethodPost, "https://storage.googleapis.com/missing-bucket/file.txt?uploads"},
+		{"list multipart uploads", http.MethodGet, "https://storage.googleapis.com/missing-bucket?uploads"},
+	}
+	client := server.HTTPClient()
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, strings.NewReader("something"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("wrong status returned\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+			}
+			var xmlErr xmlErrorResponse
+			if err := xml.NewDecoder(resp.Body).Decode(&xmlErr); err != nil {
+				t.Fatal(err)
+			}
+			if xmlErr.Code != "NoSuchBucket" {
+				t.Errorf("wrong error code\nwant %q\ngot  %q", "NoSuchBucket", xmlErr.Code)
+			}
+		})
+	}
+}
+
 func TestDownloadObjectAlternatePublicHost(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -786,7 +1353,7 @@ func TestServerEventNotification(t *testing.T) {
 			}
 			eventManager := &fakeEventManager{}
 			server.eventManager = eventManager
-			err = server.backend.CreateBucket(obj.BucketName, test.versioningEnabled)
+			err = server.backend.CreateBucket(obj.BucketName, backend.BucketAttrs{VersioningEnabled: test.versioningEnabled})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -825,7 +1392,7 @@ func TestServerBatchRequest(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = server.backend.CreateBucket("some-bucket", true)
+	err = server.backend.CreateBucket("some-bucket", backend.BucketAttrs{VersioningEnabled: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -892,18 +1459,166 @@ func TestServerBatchRequest(t *testing.T) {
 	}
 }
 
+func batchRequestPart(contentID, method, path, body string) string {
+	return "--batch-boundary\r\n" +
+		"Content-Type: application/http\r\n" +
+		"Content-ID: <" + contentID + ">\r\n" +
+		"\r\n" +
+		method + " " + path + " HTTP/1.1\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" +
+		body + "\r\n"
+}
+
+func TestServerBatchRequestResponses(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte("something")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	body := batchRequestPart("batch+1", http.MethodPatch, "/storage/v1/b/some-bucket/o/file.txt", `{"metadata":{"key":"value"}}`) +
+		batchRequestPart("batch+2", http.MethodPost, "/storage/v1/b/some-bucket/o/file.txt/acl", `{"entity":"allUsers","role":"READER"}`) +
+		batchRequestPart("batch+3", http.MethodDelete, "/storage/v1/b/some-bucket/o/missing.txt", "") +
+		"--batch-boundary--\r\n"
+	req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/batch/storage/v1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary=batch-boundary")
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status returned\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		contentID string
+		status    int
+	}{
+		{"<response-batch+1>", http.StatusOK},
+		{"<response-batch+2>", http.StatusOK},
+		{"<response-batch+3>", http.StatusNotFound},
+	}
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	for _, e := range expected {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentID := part.Header.Get("Content-ID"); contentID != e.contentID {
+			t.Errorf("wrong Content-ID\nwant %s\ngot  %s", e.contentID, contentID)
+		}
+		partResp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partResp.Body.Close()
+		if partResp.StatusCode != e.status {
+			t.Errorf("%s: wrong status\nwant %d\ngot  %d", e.contentID, e.status, partResp.StatusCode)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("expected the end of the batch response, got %v", err)
+	}
+
+	obj, err := server.GetObject("some-bucket", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Metadata["key"] != "value" {
+		t.Errorf("metadata wasn't updated by batch call: %v", obj.Metadata)
+	}
+	if !isACLPublic(obj.ACL) {
+		t.Errorf("ACL wasn't updated by batch call: %v", obj.ACL)
+	}
+}
+
+func TestServerBatchRequestTooManyCalls(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	var body strings.Builder
+	for i := 0; i <= maxBatchCalls; i++ {
+		body.WriteString(batchRequestPart("batch+"+strconv.Itoa(i), http.MethodGet, "/storage/v1/b", ""))
+	}
+	body.WriteString("--batch-boundary--\r\n")
+	req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/batch/storage/v1", strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary=batch-boundary")
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status returned\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestServerBatchRequestMalformedBody(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// the closing boundary is missing, so the body ends in the middle of the
+	// second call.
+	body := batchRequestPart("batch+0", http.MethodGet, "/storage/v1/b", "") +
+		batchRequestPart("batch+1", http.MethodGet, "/storage/v1/b", "")
+	req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/batch/storage/v1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary=batch-boundary")
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status returned\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
 type fakeEventFields struct {
 	BucketName string
 	Name       string
-	Content    []byte
+	Size       int64
 	Metadata   map[string]string
 }
 
+// fakeEventFieldsFromObject takes the size of the object from its content,
+// when it has one, as objects uploaded with their content streamed to the
+// backend have only their size.
 func fakeEventFieldsFromObject(obj Object) fakeEventFields {
+	size := obj.Size
+	if obj.Content != nil {
+		size = int64(len(obj.Content))
+	}
 	return fakeEventFields{
 		BucketName: obj.BucketName,
 		Name:       obj.Name,
-		Content:    obj.Content,
+		Size:       size,
 		Metadata:   obj.Metadata,
 	}
 }
@@ -924,8 +1639,12 @@ type fakeEventManager struct {
 }
 
 func (m *fakeEventManager) Trigger(o *backend.Object, eventType notification.EventType, extraEventAttr map[string]string) {
+	obj := fromBackendObjects([]backend.Object{*o})[0]
+	if o.Content == nil {
+		obj.Size = o.Size
+	}
 	m.events = append(m.events, fakeEvent{
-		obj:       fakeEventFieldsFromObject(fromBackendObjects([]backend.Object{*o})[0]),
+		obj:       fakeEventFieldsFromObject(obj),
 		eventType: eventType,
 	})
 }
@@ -997,3 +1716,160 @@ func runServersTest(t *testing.T, runOpts runServersOptions, fn func(*testing.T,
 		})
 	}
 }
+
+func TestBoltBackendSurvivesRestarts(t *testing.T) {
+	dir := t.TempDir()
+	server, err := NewServerWithOptions(Options{NoListener: true, StorageRoot: dir, BoltBackend: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte("first")})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte("second")})
+	server.Stop()
+
+	server, err = NewServerWithOptions(Options{NoListener: true, StorageRoot: dir, BoltBackend: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	obj, err := server.GetObject("some-bucket", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "second" {
+		t.Errorf("wrong content after restarting\nwant %q\ngot  %q", "second", obj.Content)
+	}
+	versions, err := server.ObjectVersions("some-bucket", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("wrong number of versions after restarting\nwant 2\ngot  %d", len(versions))
+	}
+}
+
+func TestProxyBackendKeepsWritesLocal(t *testing.T) {
+	remote, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "prod-fixtures", Name: "a.txt", ContentType: "text/plain"}, Content: []byte("remote a")},
+			{ObjectAttrs: ObjectAttrs{BucketName: "prod-fixtures", Name: "b.txt"}, Content: []byte("remote b")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Stop()
+	dir := t.TempDir()
+	server, err := NewServerWithOptions(Options{
+		NoListener:  true,
+		StorageRoot: dir,
+		BoltBackend: true,
+		Proxy:       ProxyOptions{Buckets: []string{"prod-fixtures"}, Client: remote.Client()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.Client()
+	ctx := context.Background()
+
+	objs, _, err := server.ListObjects("prod-fixtures", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 {
+		t.Errorf("wrong number of objects listed\nwant 2\ngot  %d", len(objs))
+	}
+	reader, err := client.Bucket("prod-fixtures").Object("a.txt").NewReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "remote a" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "remote a", content)
+	}
+	if reader.Attrs.ContentType != "text/plain" {
+		t.Errorf("wrong content type\nwant %q\ngot  %q", "text/plain", reader.Attrs.ContentType)
+	}
+
+	writer := client.Bucket("prod-fixtures").Object("a.txt").NewWriter(ctx)
+	writer.Write([]byte("local a"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Bucket("prod-fixtures").Object("b.txt").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Bucket("prod-fixtures").Object("b.txt").Attrs(ctx); err != storage.ErrObjectNotExist {
+		t.Errorf("wrong error reading a deleted object\nwant %v\ngot  %v", storage.ErrObjectNotExist, err)
+	}
+	remoteObj, err := remote.GetObject("prod-fixtures", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(remoteObj.Content) != "remote a" {
+		t.Errorf("write forwarded to the remote server: %q", remoteObj.Content)
+	}
+	if _, err := remote.GetObject("prod-fixtures", "b.txt"); err != nil {
+		t.Errorf("deletion forwarded to the remote server: %v", err)
+	}
+	server.Stop()
+
+	// the recorded copies are replayed without the remote objects.
+	empty := NewServer(nil)
+	defer empty.Stop()
+	empty.CreateBucketWithOpts(CreateBucketOpts{Name: "prod-fixtures"})
+	server, err = NewServerWithOptions(Options{
+		NoListener:  true,
+		StorageRoot: dir,
+		BoltBackend: true,
+		Proxy:       ProxyOptions{Buckets: []string{"prod-fixtures"}, Client: empty.Client()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	obj, err := server.GetObject("prod-fixtures", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "local a" {
+		t.Errorf("wrong content after restarting\nwant %q\ngot  %q", "local a", obj.Content)
+	}
+	server.Stop()
+
+	// the local deletions are kept across runs, so the deleted objects
+	// aren't read from the remote server again.
+	server, err = NewServerWithOptions(Options{
+		NoListener:  true,
+		StorageRoot: dir,
+		BoltBackend: true,
+		Proxy:       ProxyOptions{Buckets: []string{"prod-fixtures"}, Client: remote.Client()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if _, err := server.GetObject("prod-fixtures", "b.txt"); err == nil {
+		t.Error("deleted object read from the remote server after restarting")
+	}
+	objs, _, err = server.ListObjects("prod-fixtures", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].Name != "a.txt" {
+		t.Errorf("wrong number of objects listed after restarting\nwant 1\ngot  %d", len(objs))
+	}
+	buckets, err := server.backend.ListBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 || buckets[0].Name != "prod-fixtures" {
+		t.Errorf("wrong number of buckets listed after restarting\nwant 1\ngot  %d", len(buckets))
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// isV2SignedURL reports whether the request was sent to a legacy V2 signed
+// URL, which carries the signature in the GoogleAccessId, Expires and
+// Signature parameters.
+func isV2SignedURL(r *http.Request) bool {
+	query := r.URL.Query()
+	return query.Get("GoogleAccessId") != "" && query.Get("Signature") != ""
+}
+
+// verifyV2SignedURL rejects requests to V2 signed URLs that have expired. When
+// Options.SignedURLKeys has a key for the GoogleAccessId of the URL, the
+// signature is verified as well.
+func (s *Server) verifyV2SignedURL(r *http.Request) *jsonResponse {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("Expires"), 10, 64)
+	if err != nil {
+		return &jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid Expires parameter."}
+	}
+	if time.Now().Unix() > expires {
+		return &jsonResponse{
+			status:       http.StatusBadRequest,
+			errorReason:  "ExpiredToken",
+			errorMessage: fmt.Sprintf("Request signature expired at: %s", time.Unix(expires, 0).UTC().Format(time.RFC3339)),
+		}
+	}
+
+	key, ok := s.options.SignedURLKeys[query.Get("GoogleAccessId")]
+	if !ok {
+		return nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	hash := sha256.Sum256(v2StringToSign(r, expires))
+	if err != nil || rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+		return &jsonResponse{status: http.StatusForbidden, errorReason: "SignatureDoesNotMatch"}
+	}
+	return nil
+}
+
+// v2StringToSign builds the string signed by the client to generate a V2
+// signed URL for the request.
+func v2StringToSign(r *http.Request, expires int64) []byte {
+	var extensionHeaders []string
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "x-goog-") || strings.HasPrefix(name, "x-goog-encryption-key") {
+			continue
+		}
+		extensionHeaders = append(extensionHeaders, name+":"+strings.TrimSpace(r.Header.Get(name)))
+	}
+	sort.Strings(extensionHeaders)
+
+	vars := mux.Vars(r)
+	resource := url.URL{Path: fmt.Sprintf("/%s/%s", vars["bucketName"], vars["objectName"])}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n", r.Method)
+	fmt.Fprintf(&buf, "%s\n", r.Header.Get("Content-MD5"))
+	fmt.Fprintf(&buf, "%s\n", r.Header.Get(contentTypeHeader))
+	fmt.Fprintf(&buf, "%d\n", expires)
+	for _, header := range extensionHeaders {
+		fmt.Fprintf(&buf, "%s\n", header)
+	}
+	buf.WriteString(resource.String())
+	return buf.Bytes()
+}
@@ -0,0 +1,164 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestServerV2SignedURL(t *testing.T) {
+	const (
+		accessID   = "signer@project.iam.gserviceaccount.com"
+		bucketName = "some-bucket"
+		objectName = "files/object.txt"
+		content    = "some content"
+	)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName}, Content: []byte(content)},
+		},
+		SignedURLKeys: map[string]*rsa.PublicKey{accessID: &key.PublicKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	signURL := func(t *testing.T, googleAccessID, method, contentType string, expires time.Time) string {
+		url, err := storage.SignedURL(bucketName, objectName, &storage.SignedURLOptions{
+			Scheme:         storage.SigningSchemeV2,
+			GoogleAccessID: googleAccessID,
+			PrivateKey:     privateKey,
+			Method:         method,
+			ContentType:    contentType,
+			Expires:        expires,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url
+	}
+
+	tests := []struct {
+		name           string
+		url            func(t *testing.T) string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			"valid signature",
+			func(t *testing.T) string {
+				return signURL(t, accessID, http.MethodGet, "", time.Now().Add(time.Hour))
+			},
+			http.StatusOK,
+			"",
+		},
+		{
+			"expired",
+			func(t *testing.T) string {
+				return signURL(t, accessID, http.MethodGet, "", time.Now().Add(-time.Minute))
+			},
+			http.StatusBadRequest,
+			"ExpiredToken",
+		},
+		{
+			"signed for another method",
+			func(t *testing.T) string {
+				return signURL(t, accessID, http.MethodPut, "", time.Now().Add(time.Hour))
+			},
+			http.StatusForbidden,
+			"SignatureDoesNotMatch",
+		},
+		{
+			"tampered signature",
+			func(t *testing.T) string {
+				url := signURL(t, accessID, http.MethodGet, "", time.Now().Add(time.Hour))
+				return strings.Replace(url, "Signature=", "Signature=AAAA", 1)
+			},
+			http.StatusForbidden,
+			"SignatureDoesNotMatch",
+		},
+		{
+			"unknown access id",
+			func(t *testing.T) string {
+				return signURL(t, "other@project.iam.gserviceaccount.com", http.MethodGet, "", time.Now().Add(time.Hour))
+			},
+			http.StatusOK,
+			"",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := client.Get(test.url(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expectedCode == "" {
+				if string(data) != content {
+					t.Errorf("wrong content\nwant %q\ngot  %q", content, string(data))
+				}
+			} else if !strings.Contains(string(data), "<Code>"+test.expectedCode+"</Code>") {
+				t.Errorf("wrong error body, expected code %q: %s", test.expectedCode, data)
+			}
+		})
+	}
+
+	t.Run("upload", func(t *testing.T) {
+		const newContent = "some other content"
+		url := signURL(t, accessID, http.MethodPut, "text/plain", time.Now().Add(time.Hour))
+		for _, contentType := range []string{"application/json", "text/plain"} {
+			req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(newContent))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", contentType)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			expectedStatus := http.StatusOK
+			if contentType != "text/plain" {
+				expectedStatus = http.StatusForbidden
+			}
+			if resp.StatusCode != expectedStatus {
+				t.Errorf("wrong status uploading with %s\nwant %d\ngot  %d", contentType, expectedStatus, resp.StatusCode)
+			}
+		}
+		obj, err := server.GetObject(bucketName, objectName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != newContent {
+			t.Errorf("wrong content\nwant %q\ngot  %q", newContent, string(obj.Content))
+		}
+	})
+}
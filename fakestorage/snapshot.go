@@ -0,0 +1,321 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+const (
+	snapshotVersion      = 1
+	snapshotManifestName = "snapshot.json"
+)
+
+// snapshotManifest is the first entry of a snapshot, followed by an entry
+// with the attributes of each bucket, and then two entries for each version
+// of each of its objects: its attributes and its content.
+type snapshotManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type snapshotBucket struct {
+	backend.Bucket
+	// NoncurrentVersions is set for buckets with noncurrent versions of
+	// objects, which are only restored with versioning enabled.
+	NoncurrentVersions bool `json:"noncurrentVersions,omitempty"`
+}
+
+type snapshotObject struct {
+	Bucket string              `json:"bucket"`
+	Name   string              `json:"name"`
+	Attrs  backend.ObjectAttrs `json:"attrs"`
+}
+
+// Snapshot writes a tarball with all the buckets of the server, with their
+// attributes, and all the versions of their objects, with their content and
+// metadata. The snapshot can be loaded with Restore, in this or another
+// server, as long as its backend supports versioning when the snapshot has
+// noncurrent versions of objects.
+//
+// The server state that isn't stored in the backend, such as soft-deleted
+// objects, notification configurations or IAM policies, isn't included.
+func (s *Server) Snapshot(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := writeSnapshotJSON(tw, snapshotManifestName, snapshotManifest{Version: snapshotVersion, Created: time.Now().UTC()}); err != nil {
+		return err
+	}
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		return err
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	count := 0
+	for _, bucket := range buckets {
+		objs, err := s.backend.ListObjects(bucket.Name, "", true)
+		if err != nil {
+			return err
+		}
+		sort.Slice(objs, func(i, j int) bool {
+			if objs[i].Name != objs[j].Name {
+				return objs[i].Name < objs[j].Name
+			}
+			return objs[i].Generation < objs[j].Generation
+		})
+		entry := snapshotBucket{Bucket: bucket}
+		for _, attrs := range objs {
+			entry.NoncurrentVersions = entry.NoncurrentVersions || isNoncurrent(attrs)
+		}
+		if err := writeSnapshotJSON(tw, "buckets/"+bucket.Name+".json", entry); err != nil {
+			return err
+		}
+		for _, attrs := range objs {
+			name := "objects/" + strconv.Itoa(count)
+			count++
+			if err := writeSnapshotJSON(tw, name+".json", snapshotObject{Bucket: bucket.Name, Name: attrs.Name, Attrs: attrs}); err != nil {
+				return err
+			}
+			if err := s.writeSnapshotContent(tw, name, attrs); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func writeSnapshotJSON(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func (s *Server) writeSnapshotContent(tw *tar.Writer, name string, attrs backend.ObjectAttrs) error {
+	obj, err := s.backend.GetObjectStream(attrs.BucketName, attrs.Name, attrs.Generation)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", attrs.ID(), err)
+	}
+	defer obj.Content.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: obj.Size}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, obj.Content)
+	return err
+}
+
+// Restore replaces all the buckets and objects of the server with the ones
+// in a snapshot written by Snapshot.
+//
+// Object generations are only kept in buckets restored with versioning, where
+// they identify the versions of objects, and objects in other buckets get new
+// generations, so snapshots can be restored with any backend. Noncurrent
+// versions are restored as such, but their deletion time is the time of the
+// restore.
+//
+// The whole snapshot is read and validated before the server state is
+// replaced, so an invalid snapshot, or one with versioned buckets restored
+// with a backend that doesn't support versioning, leaves the server as it
+// was.
+func (s *Server) Restore(r io.Reader) error {
+	snapshot, err := spoolContent(r)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	defer snapshot.Close()
+	if err := s.validateSnapshot(snapshot.reader()); err != nil {
+		return err
+	}
+	if err := s.deleteAllBuckets(); err != nil {
+		return err
+	}
+	return s.restoreSnapshot(snapshot.reader())
+}
+
+func readSnapshotManifest(tr *tar.Reader) error {
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	var manifest snapshotManifest
+	if hdr.Name != snapshotManifestName || json.NewDecoder(tr).Decode(&manifest) != nil {
+		return errors.New("invalid snapshot: missing manifest")
+	}
+	if manifest.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", manifest.Version)
+	}
+	return nil
+}
+
+// validateSnapshot reads all the entries of the snapshot, checking that
+// they can be restored.
+func (s *Server) validateSnapshot(r io.Reader) error {
+	tr := tar.NewReader(r)
+	if err := readSnapshotManifest(tr); err != nil {
+		return err
+	}
+	buckets := make(map[string]bool)
+	var last *snapshotObject
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		switch {
+		case strings.HasPrefix(hdr.Name, "buckets/"):
+			var bucket snapshotBucket
+			if err := json.NewDecoder(tr).Decode(&bucket); err != nil {
+				return fmt.Errorf("invalid snapshot entry %s: %w", hdr.Name, err)
+			}
+			if (bucket.VersioningEnabled || bucket.NoncurrentVersions) && !s.backendSupportsVersioning() {
+				return fmt.Errorf("can't restore bucket %s: versioning is not supported by the %s backend", bucket.Name, s.backendName())
+			}
+			buckets[bucket.Name] = true
+		case strings.HasSuffix(hdr.Name, ".json"):
+			var obj snapshotObject
+			if err := json.NewDecoder(tr).Decode(&obj); err != nil {
+				return fmt.Errorf("invalid snapshot entry %s: %w", hdr.Name, err)
+			}
+			if !buckets[obj.Bucket] {
+				return fmt.Errorf("invalid snapshot entry %s: unknown bucket %s", hdr.Name, obj.Bucket)
+			}
+			last = &obj
+		default:
+			if last == nil {
+				return fmt.Errorf("invalid snapshot: content %s without attributes", hdr.Name)
+			}
+			if _, err := io.Copy(io.Discard, tr); err != nil {
+				return fmt.Errorf("invalid snapshot entry %s: %w", hdr.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) restoreSnapshot(r io.Reader) error {
+	tr := tar.NewReader(r)
+	if err := readSnapshotManifest(tr); err != nil {
+		return err
+	}
+	buckets := make(map[string]backend.BucketAttrs)
+	versioned := make(map[string]bool)
+	var last *snapshotObject
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		switch {
+		case strings.HasPrefix(hdr.Name, "buckets/"):
+			var bucket snapshotBucket
+			if err := json.NewDecoder(tr).Decode(&bucket); err != nil {
+				return fmt.Errorf("invalid snapshot entry %s: %w", hdr.Name, err)
+			}
+			attrs := bucket.Attrs()
+			buckets[bucket.Name] = attrs
+			// versioning is enabled until all versions are restored.
+			attrs.VersioningEnabled = attrs.VersioningEnabled || bucket.NoncurrentVersions
+			versioned[bucket.Name] = attrs.VersioningEnabled
+			if err := s.backend.CreateBucket(bucket.Name, attrs); err != nil {
+				return fmt.Errorf("failed to restore bucket %s: %w", bucket.Name, err)
+			}
+		case strings.HasSuffix(hdr.Name, ".json"):
+			var obj snapshotObject
+			if err := json.NewDecoder(tr).Decode(&obj); err != nil {
+				return fmt.Errorf("invalid snapshot entry %s: %w", hdr.Name, err)
+			}
+			if last != nil && (last.Bucket != obj.Bucket || last.Name != obj.Name) {
+				if err := s.finishRestoredObject(*last); err != nil {
+					return err
+				}
+			}
+			last = &obj
+		default:
+			if last == nil {
+				return fmt.Errorf("invalid snapshot: content %s without attributes", hdr.Name)
+			}
+			attrs := last.Attrs
+			attrs.BucketName = last.Bucket
+			attrs.Name = last.Name
+			if isNoncurrent(attrs) {
+				attrs.Deleted = ""
+			}
+			if !versioned[attrs.BucketName] {
+				attrs.Generation = 0
+			}
+			if _, err := s.backend.CreateObjectStream(attrs, tr); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", attrs.ID(), err)
+			}
+		}
+	}
+	if last != nil {
+		if err := s.finishRestoredObject(*last); err != nil {
+			return err
+		}
+	}
+	for name, attrs := range buckets {
+		if err := s.backend.UpdateBucket(name, attrs); err != nil {
+			return fmt.Errorf("failed to restore bucket %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func isNoncurrent(attrs backend.ObjectAttrs) bool {
+	return !convertTimeWithoutError(attrs.Deleted).IsZero()
+}
+
+// finishRestoredObject deletes the live version of an object whose versions
+// were all noncurrent in the snapshot, once its last version was restored.
+func (s *Server) finishRestoredObject(obj snapshotObject) error {
+	if !isNoncurrent(obj.Attrs) {
+		return nil
+	}
+	return s.backend.DeleteObject(obj.Bucket, obj.Name)
+}
+
+// deleteAllBuckets deletes all the versions of all the objects of the server,
+// and then its buckets.
+func (s *Server) deleteAllBuckets() error {
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		objs, err := s.backend.ListObjects(bucket.Name, "", true)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			if err := s.backend.DeleteObjectGeneration(bucket.Name, obj.Name, obj.Generation); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", obj.ID(), err)
+			}
+		}
+		if err := s.backend.DeleteBucket(bucket.Name); err != nil {
+			return fmt.Errorf("failed to delete bucket %s: %w", bucket.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "versioned-bucket", VersioningEnabled: true})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "versioned-bucket", Name: "file.txt"}, Content: []byte("first")})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "versioned-bucket", Name: "file.txt"}, Content: []byte("second")})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "versioned-bucket", Name: "deleted.txt"}, Content: []byte("gone")})
+	if err := server.backend.DeleteObject("versioned-bucket", "deleted.txt"); err != nil {
+		t.Fatal(err)
+	}
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+	server.CreateObject(Object{
+		ObjectAttrs: ObjectAttrs{
+			BucketName:  "some-bucket",
+			Name:        "dir/data.json",
+			ContentType: "application/json",
+			Metadata:    map[string]string{"key": "value"},
+		},
+		Content: []byte(`{"a":1}`),
+	})
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "empty-bucket"})
+	versions, err := server.ObjectVersions("versioned-bucket", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := server.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewServerWithOptions(Options{
+		NoListener:     true,
+		InitialObjects: []Object{{ObjectAttrs: ObjectAttrs{BucketName: "replaced-bucket", Name: "file.txt"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Stop()
+	if err := restored.Restore(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, err := restored.backend.ListBuckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 {
+		t.Errorf("wrong number of buckets restored\nwant 3\ngot  %d", len(buckets))
+	}
+	bucket, err := restored.backend.GetBucket("versioned-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bucket.VersioningEnabled {
+		t.Error("versioning not restored")
+	}
+	obj, err := restored.GetObject("some-bucket", "dir/data.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != `{"a":1}` || obj.ContentType != "application/json" || obj.Metadata["key"] != "value" {
+		t.Errorf("wrong object restored: %+v", obj)
+	}
+	restoredVersions, err := restored.ObjectVersions("versioned-bucket", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restoredVersions) != len(versions) {
+		t.Fatalf("wrong number of versions restored\nwant %d\ngot  %d", len(versions), len(restoredVersions))
+	}
+	for _, version := range versions {
+		obj, err := restored.GetObjectWithGeneration("versioned-bucket", "file.txt", version.Generation)
+		if err != nil {
+			t.Errorf("generation %d not restored: %v", version.Generation, err)
+			continue
+		}
+		expected, err := server.GetObjectWithGeneration("versioned-bucket", "file.txt", version.Generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(obj.Content, expected.Content) {
+			t.Errorf("wrong content of generation %d\nwant %q\ngot  %q", version.Generation, expected.Content, obj.Content)
+		}
+	}
+	if _, err := restored.GetObject("versioned-bucket", "deleted.txt"); err == nil {
+		t.Error("deleted object restored as live")
+	}
+	deletedVersions, err := restored.ObjectVersions("versioned-bucket", "deleted.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deletedVersions) != 1 {
+		t.Errorf("wrong number of noncurrent versions restored\nwant 1\ngot  %d", len(deletedVersions))
+	}
+}
+
+func TestRestoreInvalidSnapshot(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true, InitialObjects: []Object{
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.Restore(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Fatal("unexpected <nil> error")
+	}
+	if _, err := server.GetObject("some-bucket", "file.txt"); err != nil {
+		t.Errorf("objects deleted restoring an invalid snapshot: %v", err)
+	}
+}
+
+func TestSnapshotRestoreFilesystem(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true, InitialObjects: []Object{
+		{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "a/b.txt", ContentType: "text/plain"}, Content: []byte("some content")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	var snapshot bytes.Buffer
+	if err := server.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewServerWithOptions(Options{NoListener: true, StorageRoot: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Stop()
+	if err := restored.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := restored.GetObject("some-bucket", "a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "some content" || obj.ContentType != "text/plain" {
+		t.Errorf("wrong object restored: %+v", obj)
+	}
+}
+
+func TestRestoreSnapshotKeepsStateOnFailure(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "data.txt"}, Content: bytes.Repeat([]byte("a"), 4096)})
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "versioned-bucket", VersioningEnabled: true})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "versioned-bucket", Name: "file.txt"}, Content: []byte("first")})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "versioned-bucket", Name: "file.txt"}, Content: []byte("second")})
+	var snapshot bytes.Buffer
+	if err := server.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	// cut the snapshot in the middle of an entry.
+	truncated := snapshot.Bytes()[:snapshot.Len()/1024*512+100]
+
+	tests := []struct {
+		name     string
+		options  Options
+		snapshot []byte
+	}{
+		{
+			"truncated snapshot",
+			Options{NoListener: true},
+			truncated,
+		},
+		{
+			"versioned buckets with the filesystem backend",
+			Options{NoListener: true, StorageRoot: t.TempDir()},
+			snapshot.Bytes(),
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.options.InitialObjects = []Object{{ObjectAttrs: ObjectAttrs{BucketName: "kept-bucket", Name: "file.txt"}, Content: []byte("kept")}}
+			restored, err := NewServerWithOptions(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer restored.Stop()
+			if err := restored.Restore(bytes.NewReader(test.snapshot)); err == nil {
+				t.Fatal("unexpected <nil> error")
+			}
+			if _, err := restored.GetObject("kept-bucket", "file.txt"); err != nil {
+				t.Errorf("objects deleted by a failed restore: %v", err)
+			}
+			if _, err := restored.backend.GetBucket("some-bucket"); err == nil {
+				t.Error("bucket restored by a failed restore")
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"github.com/gorilla/mux"
+)
+
+// maxSoftDeleteRetention is the longest soft delete retention duration
+// accepted by Cloud Storage: 90 days.
+const maxSoftDeleteRetention = 90 * 24 * time.Hour
+
+var errSoftDeletedObjectNotFound = errors.New("soft-deleted object not found")
+
+type bucketSoftDeletePolicy struct {
+	RetentionDurationSeconds int64  `json:"retentionDurationSeconds,string"`
+	EffectiveTime            string `json:"effectiveTime,omitempty"`
+}
+
+func fromBackendSoftDeletePolicy(policy *backend.SoftDeletePolicy) *bucketSoftDeletePolicy {
+	if policy == nil {
+		return nil
+	}
+	return &bucketSoftDeletePolicy{
+		RetentionDurationSeconds: int64(policy.RetentionDuration / time.Second),
+		EffectiveTime:            policy.EffectiveTime.Format(time.RFC3339),
+	}
+}
+
+// newSoftDeletePolicy returns the soft delete policy with the given retention
+// duration, or an error message when the duration is invalid. A zero
+// duration disables soft delete.
+func newSoftDeletePolicy(retentionDuration time.Duration) (*backend.SoftDeletePolicy, string) {
+	if retentionDuration < 0 || retentionDuration > maxSoftDeleteRetention {
+		return nil, "The soft delete retention duration must not be negative nor longer than 90 days."
+	}
+	if retentionDuration == 0 {
+		return nil, ""
+	}
+	return &backend.SoftDeletePolicy{
+		RetentionDuration: retentionDuration,
+		EffectiveTime:     time.Now().UTC().Truncate(time.Second),
+	}, ""
+}
+
+// softDeletedObjects keeps the objects deleted from buckets with a soft
+// delete policy until their hard delete time.
+type softDeletedObjects struct {
+	mtx     sync.Mutex
+	objects map[string][]Object
+}
+
+func (d *softDeletedObjects) add(obj Object) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.objects == nil {
+		d.objects = make(map[string][]Object)
+	}
+	d.objects[obj.BucketName] = append(d.objects[obj.BucketName], obj)
+}
+
+// list returns the soft-deleted objects of the bucket, discarding the ones
+// past their hard delete time.
+func (d *softDeletedObjects) list(bucketName string) []Object {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	now := time.Now()
+	var objs []Object
+	for _, obj := range d.objects[bucketName] {
+		if now.Before(obj.HardDeleteTime) {
+			objs = append(objs, obj)
+		}
+	}
+	if len(objs) == 0 {
+		delete(d.objects, bucketName)
+	} else {
+		d.objects[bucketName] = objs
+	}
+	return objs
+}
+
+func (d *softDeletedObjects) get(bucketName, objectName string, generation int64) (Object, bool) {
+	for _, obj := range d.list(bucketName) {
+		if obj.Name == objectName && obj.Generation == generation {
+			return obj, true
+		}
+	}
+	return Object{}, false
+}
+
+func (d *softDeletedObjects) remove(bucketName, objectName string, generation int64) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	objs := d.objects[bucketName]
+	for i, obj := range objs {
+		if obj.Name == objectName && obj.Generation == generation {
+			d.objects[bucketName] = append(objs[:i:i], objs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *softDeletedObjects) removeBucket(bucketName string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.objects, bucketName)
+}
+
+// SetBucketSoftDeletePolicy sets how long objects deleted from the bucket are
+// kept before they're permanently deleted. Until then, soft-deleted objects
+// can be listed with ListOptions.SoftDeleted and restored with
+// RestoreObject. Unlike Cloud Storage, durations shorter than 7 days are
+// accepted, so tests don't have to wait for objects to expire. A zero
+// duration disables soft delete.
+func (s *Server) SetBucketSoftDeletePolicy(bucketName string, retentionDuration time.Duration) error {
+	policy, message := newSoftDeletePolicy(retentionDuration)
+	if message != "" {
+		return backend.Error(message)
+	}
+	bucket, err := s.backend.GetBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	attrs := bucket.Attrs()
+	attrs.SoftDeletePolicy = policy
+	return s.backend.UpdateBucket(bucketName, attrs)
+}
+
+// softDelete keeps an object version that was permanently removed from the
+// backend, if its bucket has a soft delete policy.
+func (s *Server) softDelete(obj Object) {
+	bucket, err := s.backend.GetBucket(obj.BucketName)
+	if err != nil || bucket.SoftDeletePolicy == nil {
+		return
+	}
+	obj.SoftDeleteTime = time.Now()
+	obj.HardDeleteTime = obj.SoftDeleteTime.Add(bucket.SoftDeletePolicy.RetentionDuration)
+	s.softDeleted.add(obj)
+}
+
+// GetSoftDeletedObject returns the given generation of a soft-deleted object,
+// or an error if there's no such object or its hard delete time has passed.
+func (s *Server) GetSoftDeletedObject(bucketName, objectName string, generation int64) (Object, error) {
+	obj, ok := s.softDeleted.get(bucketName, objectName, generation)
+	if !ok {
+		return Object{}, errSoftDeletedObjectNotFound
+	}
+	return obj, nil
+}
+
+// RestoreObject restores the given generation of a soft-deleted object as the
+// live version of the object, with a new generation.
+func (s *Server) RestoreObject(bucketName, objectName string, generation int64) (Object, error) {
+	obj, err := s.GetSoftDeletedObject(bucketName, objectName, generation)
+	if err != nil {
+		return Object{}, err
+	}
+	obj.Generation = 0
+	obj.Metageneration = 0
+	obj.Created = time.Time{}
+	obj.Updated = time.Time{}
+	obj.Deleted = time.Time{}
+	obj.SoftDeleteTime = time.Time{}
+	obj.HardDeleteTime = time.Time{}
+	restored, err := s.createObject(obj)
+	if err != nil {
+		return Object{}, err
+	}
+	s.softDeleted.remove(bucketName, objectName, generation)
+	return restored, nil
+}
+
+func (s *Server) restoreObject(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	generation, err := strconv.ParseInt(r.FormValue("generation"), 10, 64)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "A valid generation is required to restore an object."}
+	}
+	obj, err := s.RestoreObject(vars["bucketName"], vars["objectName"], generation)
+	if err == errSoftDeletedObjectNotFound {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	if err != nil {
+		return errToJsonResponse(err)
+	}
+	return jsonResponse{data: newObjectResponse(obj.ObjectAttrs)}
+}
+
+func (s *Server) getSoftDeletedObject(r *http.Request) jsonResponse {
+	vars := mux.Vars(r)
+	generation, err := strconv.ParseInt(r.FormValue("generation"), 10, 64)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "A valid generation is required to get a soft-deleted object."}
+	}
+	obj, err := s.GetSoftDeletedObject(vars["bucketName"], vars["objectName"], generation)
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	return jsonResponse{data: newObjectResponse(obj.ObjectAttrs)}
+}
@@ -0,0 +1,240 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketSoftDeletePolicy(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := server.HTTPClient()
+
+	createBucket := func(t *testing.T, body string) *http.Response {
+		t.Helper()
+		resp, err := client.Post("https://storage.googleapis.com/storage/v1/b", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := createBucket(t, `{"name":"soft-delete-bucket","softDeletePolicy":{"retentionDurationSeconds":"604800"}}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	var bucket bucketResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bucket); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.SoftDeletePolicy == nil {
+		t.Fatal("unexpected <nil> soft delete policy")
+	}
+	if bucket.SoftDeletePolicy.RetentionDurationSeconds != 604800 || bucket.SoftDeletePolicy.EffectiveTime == "" {
+		t.Errorf("wrong soft delete policy: %+v", bucket.SoftDeletePolicy)
+	}
+
+	resp = createBucket(t, `{"name":"other-bucket","softDeletePolicy":{"retentionDurationSeconds":"31536000"}}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status for a retention duration that is too long\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	if err := server.SetBucketSoftDeletePolicy("soft-delete-bucket", 0); err != nil {
+		t.Fatal(err)
+	}
+	b, err := server.backend.GetBucket("soft-delete-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.SoftDeletePolicy != nil {
+		t.Errorf("unexpected soft delete policy after disabling it: %+v", b.SoftDeletePolicy)
+	}
+}
+
+func TestSoftDeletedObjects(t *testing.T) {
+	const bucketName = "soft-delete-bucket"
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName, SoftDeleteRetention: time.Hour})
+	server.CreateObject(Object{
+		ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "deleted.txt", Generation: 1111},
+		Content:     []byte("deleted content"),
+	})
+	server.CreateObject(Object{
+		ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "overwritten.txt", Generation: 2222},
+		Content:     []byte("old content"),
+	})
+	server.CreateObject(Object{
+		ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "overwritten.txt", Generation: 3333},
+		Content:     []byte("new content"),
+	})
+	if err := server.Client().Bucket(bucketName).Object("deleted.txt").Delete(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	client := server.HTTPClient()
+	baseURL := "https://storage.googleapis.com/storage/v1/b/" + bucketName + "/o"
+
+	resp, err := client.Get(baseURL + "?softDeleted=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Items []objectResponse `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 2 {
+		t.Fatalf("wrong number of soft-deleted objects\nwant 2\ngot  %d", len(list.Items))
+	}
+	for i, expected := range []struct {
+		name       string
+		generation int64
+	}{{"deleted.txt", 1111}, {"overwritten.txt", 2222}} {
+		item := list.Items[i]
+		if item.Name != expected.name || item.Generation != expected.generation {
+			t.Errorf("wrong soft-deleted object\nwant %s#%d\ngot  %s#%d", expected.name, expected.generation, item.Name, item.Generation)
+		}
+		if item.SoftDeleteTime == "" || item.HardDeleteTime == "" {
+			t.Errorf("soft-deleted object %s without soft and hard delete times", item.Name)
+		}
+	}
+
+	resp, err = client.Get(baseURL + "?softDeleted=true&versions=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status combining versions and softDeleted\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp, err = client.Get(baseURL + "/deleted.txt?softDeleted=true&generation=1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status getting a soft-deleted object\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = client.Post(baseURL+"/deleted.txt/restore?generation=1111", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status restoring an object\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	var restored objectResponse
+	if err := json.NewDecoder(resp.Body).Decode(&restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Generation == 1111 || restored.SoftDeleteTime != "" {
+		t.Errorf("wrong restored object: %+v", restored)
+	}
+	obj, err := server.GetObject(bucketName, "deleted.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "deleted content" {
+		t.Errorf("wrong content of the restored object\nwant %q\ngot  %q", "deleted content", obj.Content)
+	}
+
+	resp, err = client.Post(baseURL+"/deleted.txt/restore?generation=1111", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status restoring an object twice\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+	objs, _, err := server.ListObjectsWithOptions(bucketName, ListOptions{SoftDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Errorf("wrong number of soft-deleted objects after restoring one\nwant 1\ngot  %d", len(objs))
+	}
+}
+
+func TestSoftDeletedComposeDestination(t *testing.T) {
+	const bucketName = "soft-delete-bucket"
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName, SoftDeleteRetention: time.Hour})
+	server.CreateObject(Object{
+		ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "composed.txt", Generation: 1111},
+		Content:     []byte("old content"),
+	})
+	server.CreateObject(Object{
+		ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "source.txt"},
+		Content:     []byte("new content"),
+	})
+	bucket := server.Client().Bucket(bucketName)
+	if _, err := bucket.Object("composed.txt").ComposerFrom(bucket.Object("source.txt")).Run(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := server.GetSoftDeletedObject(bucketName, "composed.txt", 1111)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != "old content" {
+		t.Errorf("wrong content of the soft-deleted object\nwant %q\ngot  %q", "old content", obj.Content)
+	}
+}
+
+func TestSoftDeletedObjectsHardDelete(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "soft-delete-bucket", SoftDeleteRetention: 50 * time.Millisecond})
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "other-bucket"})
+	for _, bucketName := range []string{"soft-delete-bucket", "other-bucket"} {
+		server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "object.txt", Generation: 1111}})
+		if err := server.Client().Bucket(bucketName).Object("object.txt").Delete(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := server.GetSoftDeletedObject("other-bucket", "object.txt", 1111); err == nil {
+		t.Error("object soft-deleted from a bucket without a soft delete policy")
+	}
+	if _, err := server.GetSoftDeletedObject("soft-delete-bucket", "object.txt", 1111); err != nil {
+		t.Fatalf("object wasn't soft-deleted: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := server.RestoreObject("soft-delete-bucket", "object.txt", 1111); err == nil {
+		t.Error("unexpected <nil> error restoring an object past its hard delete time")
+	}
+	objs, _, err := server.ListObjectsWithOptions("soft-delete-bucket", ListOptions{SoftDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 0 {
+		t.Errorf("unexpected soft-deleted objects past their hard delete time: %+v", objs)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+)
+
+// maxInMemoryContentSize is the size above which the content of uploads is
+// spooled to a temporary file instead of being kept in memory.
+const maxInMemoryContentSize = 32 << 20
+
+// spooledContent holds the content of an upload while it's verified, in
+// memory for small uploads and in a temporary file for large ones, so the
+// memory used by an upload is bounded. The checksums are calculated as the
+// content is written.
+type spooledContent struct {
+	buf    bytes.Buffer
+	file   *os.File
+	size   int64
+	crc32c hash.Hash32
+	md5    hash.Hash
+}
+
+func newSpooledContent() *spooledContent {
+	return &spooledContent{crc32c: checksum.NewCrc32c(), md5: md5.New()}
+}
+
+// spoolContent copies the content of the reader into a spooledContent. The
+// caller must close it.
+func spoolContent(r io.Reader) (*spooledContent, error) {
+	spooled := newSpooledContent()
+	if _, err := io.Copy(spooled, r); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+func (c *spooledContent) Write(p []byte) (int, error) {
+	if c.file == nil && c.size+int64(len(p)) > maxInMemoryContentSize {
+		file, err := os.CreateTemp("", "fake-gcs-upload-*")
+		if err != nil {
+			return 0, err
+		}
+		c.file = file
+		if _, err := c.buf.WriteTo(file); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if c.file != nil {
+		n, err = c.file.Write(p)
+	} else {
+		n, err = c.buf.Write(p)
+	}
+	c.crc32c.Write(p[:n])
+	c.md5.Write(p[:n])
+	c.size += int64(n)
+	return n, err
+}
+
+// checksums returns the CRC32C checksum and MD5 hash of the content.
+func (c *spooledContent) checksums() (string, string) {
+	return checksum.EncodedChecksum(c.crc32c.Sum(nil)), checksum.EncodedHash(c.md5.Sum(nil))
+}
+
+// reader returns a reader of the whole content. Reading it doesn't move the
+// offset of the temporary file, so more content can be written afterwards,
+// as resumable uploads do when storing the object fails.
+func (c *spooledContent) reader() io.Reader {
+	if c.file == nil {
+		return bytes.NewReader(c.buf.Bytes())
+	}
+	return io.NewSectionReader(c.file, 0, c.size)
+}
+
+// Close removes the temporary file, if any.
+func (c *spooledContent) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	c.file.Close()
+	return os.Remove(c.file.Name())
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+)
+
+func TestSpooledContent(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		expectedFile bool
+	}{
+		{"small content", 1024, false},
+		{"content at the limit", maxInMemoryContentSize, false},
+		{"large content", maxInMemoryContentSize + 1, true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("a"), test.size)
+			spooled, err := spoolContent(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spooled.size != int64(test.size) {
+				t.Errorf("wrong size\nwant %d\ngot  %d", test.size, spooled.size)
+			}
+			if hasFile := spooled.file != nil; hasFile != test.expectedFile {
+				t.Errorf("wrong spooling to a file\nwant %t\ngot  %t", test.expectedFile, hasFile)
+			}
+			crc32c, md5Hash := spooled.checksums()
+			if expected := checksum.EncodedCrc32cChecksum(content); crc32c != expected {
+				t.Errorf("wrong crc32c\nwant %q\ngot  %q", expected, crc32c)
+			}
+			if expected := checksum.EncodedMd5Hash(content); md5Hash != expected {
+				t.Errorf("wrong md5\nwant %q\ngot  %q", expected, md5Hash)
+			}
+			data, err := io.ReadAll(spooled.reader())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("wrong content read back, got %d bytes", len(data))
+			}
+			if err := spooled.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if test.expectedFile {
+				if _, err := os.Stat(spooled.file.Name()); !os.IsNotExist(err) {
+					t.Errorf("temporary file not removed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BucketStats are the counts of the objects and upload sessions of a
+// bucket.
+type BucketStats struct {
+	Name string `json:"name"`
+
+	// Objects and Bytes count the live versions of the objects.
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+
+	// NoncurrentVersions and NoncurrentBytes count the noncurrent versions
+	// of the objects, kept by buckets with versioning enabled.
+	NoncurrentVersions int   `json:"noncurrentVersions"`
+	NoncurrentBytes    int64 `json:"noncurrentBytes"`
+
+	// SoftDeletedObjects counts the soft-deleted objects that can still be
+	// restored.
+	SoftDeletedObjects int `json:"softDeletedObjects"`
+
+	// UploadSessions counts the resumable uploads and the XML API multipart
+	// uploads in progress, excluding expired ones.
+	UploadSessions int `json:"uploadSessions"`
+}
+
+// Stats are the counts of the objects and upload sessions of all buckets,
+// sorted by name, along with their totals.
+type Stats struct {
+	Buckets            []BucketStats `json:"buckets"`
+	Objects            int           `json:"objects"`
+	Bytes              int64         `json:"bytes"`
+	NoncurrentVersions int           `json:"noncurrentVersions"`
+	NoncurrentBytes    int64         `json:"noncurrentBytes"`
+	SoftDeletedObjects int           `json:"softDeletedObjects"`
+	UploadSessions     int           `json:"uploadSessions"`
+}
+
+// Stats returns the counts of the objects and upload sessions of all
+// buckets, so tests can assert on the state of the server without listing
+// the objects themselves. The counts are computed from the attributes of the
+// objects, without reading their content.
+func (s *Server) Stats() (Stats, error) {
+	buckets, err := s.backend.ListBuckets()
+	if err != nil {
+		return Stats{}, err
+	}
+	sessions := s.uploadSessionsByBucket()
+	stats := Stats{Buckets: make([]BucketStats, 0, len(buckets))}
+	for _, bucket := range buckets {
+		bucketStats, err := s.bucketStats(bucket.Name, sessions)
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.Buckets = append(stats.Buckets, bucketStats)
+		stats.Objects += bucketStats.Objects
+		stats.Bytes += bucketStats.Bytes
+		stats.NoncurrentVersions += bucketStats.NoncurrentVersions
+		stats.NoncurrentBytes += bucketStats.NoncurrentBytes
+		stats.SoftDeletedObjects += bucketStats.SoftDeletedObjects
+		stats.UploadSessions += bucketStats.UploadSessions
+	}
+	sort.Slice(stats.Buckets, func(i, j int) bool {
+		return stats.Buckets[i].Name < stats.Buckets[j].Name
+	})
+	return stats, nil
+}
+
+// BucketStats returns the counts of the objects and upload sessions of the
+// bucket.
+func (s *Server) BucketStats(bucketName string) (BucketStats, error) {
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return BucketStats{}, err
+	}
+	return s.bucketStats(bucketName, s.uploadSessionsByBucket())
+}
+
+func (s *Server) bucketStats(bucketName string, sessions map[string]int) (BucketStats, error) {
+	stats := BucketStats{
+		Name:               bucketName,
+		SoftDeletedObjects: len(s.softDeleted.list(bucketName)),
+		UploadSessions:     sessions[bucketName],
+	}
+	liveObjs, err := s.backend.ListObjects(bucketName, "", false)
+	if err != nil {
+		return stats, err
+	}
+	live := make(map[string]int64, len(liveObjs))
+	for _, obj := range liveObjs {
+		live[obj.Name] = obj.Generation
+		stats.Objects++
+		stats.Bytes += obj.Size
+	}
+	allObjs, err := s.backend.ListObjects(bucketName, "", true)
+	if err != nil {
+		return stats, err
+	}
+	for _, obj := range allObjs {
+		if generation, ok := live[obj.Name]; ok && generation == obj.Generation {
+			continue
+		}
+		stats.NoncurrentVersions++
+		stats.NoncurrentBytes += obj.Size
+	}
+	return stats, nil
+}
+
+// uploadSessionsByBucket returns the number of upload sessions in progress
+// in each bucket. Completed resumable uploads are kept until they expire, to
+// answer status queries, but aren't in progress.
+func (s *Server) uploadSessionsByBucket() map[string]int {
+	expiry := s.uploadSessionExpiry()
+	sessions := make(map[string]int)
+	s.uploads.Range(func(_, value interface{}) bool {
+		session := value.(uploadSession)
+		if !session.done && time.Since(session.createdAt) <= expiry {
+			sessions[session.obj.BucketName]++
+		}
+		return true
+	})
+	s.multipartUploads.Range(func(_, value interface{}) bool {
+		upload := value.(*multipartUpload)
+		upload.mtx.Lock()
+		if !upload.done && time.Since(upload.initiated) <= expiry {
+			sessions[upload.bucketName]++
+		}
+		upload.mtx.Unlock()
+		return true
+	})
+	return sessions
+}
+
+func (s *Server) getStats(r *http.Request) jsonResponse {
+	stats, err := s.Stats()
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	return jsonResponse{data: stats}
+}
+
+func (s *Server) getBucketStats(r *http.Request) jsonResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	stats, err := s.bucketStats(bucketName, s.uploadSessionsByBucket())
+	if err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	return jsonResponse{data: stats}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerStats(t *testing.T) {
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{ObjectAttrs: ObjectAttrs{BucketName: "other-bucket", Name: "file.txt"}, Content: []byte("other")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket", VersioningEnabled: true})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte("first")})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt"}, Content: []byte("second!")})
+	server.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "other.txt"}, Content: []byte("12")})
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "empty-bucket"})
+
+	resp, err := server.HTTPClient().Post("https://storage.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=upload.txt", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code initiating the upload\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	someBucket := BucketStats{Name: "some-bucket", Objects: 2, Bytes: 9, NoncurrentVersions: 1, NoncurrentBytes: 5, UploadSessions: 1}
+	expected := Stats{
+		Buckets: []BucketStats{
+			{Name: "empty-bucket"},
+			{Name: "other-bucket", Objects: 1, Bytes: 5},
+			someBucket,
+		},
+		Objects:            3,
+		Bytes:              14,
+		NoncurrentVersions: 1,
+		NoncurrentBytes:    5,
+		UploadSessions:     1,
+	}
+	stats, err := server.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("wrong stats\nwant %+v\ngot  %+v", expected, stats)
+	}
+
+	resp, err = server.HTTPClient().Get("https://storage.googleapis.com/_internal/stats/some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var bucketStats BucketStats
+	if err := json.NewDecoder(resp.Body).Decode(&bucketStats); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bucketStats, someBucket) {
+		t.Errorf("wrong bucket stats\nwant %+v\ngot  %+v", someBucket, bucketStats)
+	}
+
+	resp, err = server.HTTPClient().Get("https://storage.googleapis.com/_internal/stats/missing-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status code for a missing bucket\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestServerStatsCompletedUpload(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+
+	resp, err := server.HTTPClient().Post("https://storage.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=upload.txt", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	req, err := http.NewRequest(http.MethodPut, resp.Header.Get("Location"), strings.NewReader("some content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code completing the upload\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	stats, err := server.BucketStats("some-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BucketStats{Name: "some-bucket", Objects: 1, Bytes: 12}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("wrong bucket stats\nwant %+v\ngot  %+v", expected, stats)
+	}
+}
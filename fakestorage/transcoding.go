@@ -0,0 +1,65 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decompressiveTranscoding returns the decompressed content of gzip encoded
+// objects, reporting whether it should be served instead of the stored
+// bytes. As in Cloud Storage, objects are served as stored to clients that
+// accept gzip, or when the request has "Cache-Control: no-transform". Objects
+// whose content isn't valid gzip are also served as stored.
+func decompressiveTranscoding(obj Object, r *http.Request) ([]byte, bool) {
+	if obj.ContentEncoding != "gzip" || acceptsGzip(r) || hasDirective(r.Header.Get("Cache-Control"), "no-transform") {
+		return nil, false
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(obj.Content))
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of the request
+// includes gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.TrimSpace(encoding)
+			if i := strings.Index(encoding, ";"); i >= 0 {
+				if strings.ReplaceAll(encoding[i+1:], " ", "") == "q=0" {
+					continue
+				}
+				encoding = strings.TrimSpace(encoding[:i])
+			}
+			if strings.EqualFold(encoding, "gzip") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasDirective reports whether the given Cache-Control header value includes
+// the directive.
+func hasDirective(cacheControl, directive string) bool {
+	for _, value := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(value), directive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func gzipContent(t *testing.T, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDownloadObjectDecompressiveTranscoding(t *testing.T) {
+	const content = "some content that is stored compressed"
+	compressed := gzipContent(t, content)
+	server, err := NewServerWithOptions(Options{
+		NoListener: true,
+		InitialObjects: []Object{
+			{
+				ObjectAttrs: ObjectAttrs{
+					BucketName:      "some-bucket",
+					Name:            "compressed.txt",
+					ContentType:     "text/plain",
+					ContentEncoding: "gzip",
+				},
+				Content: compressed,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name                    string
+		headers                 map[string]string
+		expectedStatus          int
+		expectedBody            []byte
+		expectedContentEncoding string
+		expectedWarning         string
+	}{
+		{
+			"decompressed by default",
+			nil,
+			http.StatusOK,
+			[]byte(content),
+			"",
+			"",
+		},
+		{
+			"range ignored when decompressing",
+			map[string]string{"Range": "bytes=0-3"},
+			http.StatusOK,
+			[]byte(content),
+			"",
+			"",
+		},
+		{
+			"accepts gzip",
+			map[string]string{"Accept-Encoding": "deflate, gzip"},
+			http.StatusOK,
+			compressed,
+			"gzip",
+			"",
+		},
+		{
+			"gzip not acceptable",
+			map[string]string{"Accept-Encoding": "gzip;q=0"},
+			http.StatusOK,
+			[]byte(content),
+			"",
+			"",
+		},
+		{
+			"range of the stored content",
+			map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-3"},
+			http.StatusPartialContent,
+			compressed[:4],
+			"gzip",
+			"",
+		},
+		{
+			"no transform",
+			map[string]string{"Cache-Control": "no-transform"},
+			http.StatusOK,
+			compressed,
+			"gzip",
+			"214 UploadServer gzipped",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/some-bucket/compressed.txt", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, test.expectedBody) {
+				t.Errorf("wrong body\nwant %q\ngot  %q", test.expectedBody, data)
+			}
+			headers := map[string]string{
+				"Content-Encoding":               test.expectedContentEncoding,
+				"Warning":                        test.expectedWarning,
+				"X-Goog-Stored-Content-Encoding": "gzip",
+				"X-Goog-Stored-Content-Length":   strconv.Itoa(len(compressed)),
+			}
+			for name, expected := range headers {
+				if value := resp.Header.Get(name); value != expected {
+					t.Errorf("wrong %s header\nwant %q\ngot  %q", name, expected, value)
+				}
+			}
+		})
+	}
+
+	obj := server.Client().Bucket("some-bucket").Object("compressed.txt")
+	for _, readCompressed := range []bool{false, true} {
+		expected := []byte(content)
+		if readCompressed {
+			expected = compressed
+		}
+		reader, err := obj.ReadCompressed(readCompressed).NewReader(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("wrong content reading with ReadCompressed(%t)\nwant %q\ngot  %q", readCompressed, expected, data)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package fakestorage
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,6 +15,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/fsouza/fake-gcs-server/internal/checksum"
@@ -29,10 +32,42 @@ const (
 )
 
 type multipartMetadata struct {
-	ContentType     string            `json:"contentType"`
-	ContentEncoding string            `json:"contentEncoding"`
-	Name            string            `json:"name"`
-	Metadata        map[string]string `json:"metadata"`
+	ContentType        string            `json:"contentType"`
+	ContentEncoding    string            `json:"contentEncoding"`
+	CacheControl       string            `json:"cacheControl"`
+	ContentDisposition string            `json:"contentDisposition"`
+	ContentLanguage    string            `json:"contentLanguage"`
+	Name               string            `json:"name"`
+	Metadata           map[string]string `json:"metadata"`
+	StorageClass       string            `json:"storageClass"`
+	KMSKeyName         string            `json:"kmsKeyName"`
+	CustomTime         time.Time         `json:"customTime"`
+	Crc32c             string            `json:"crc32c"`
+	Md5Hash            string            `json:"md5Hash"`
+}
+
+// defaultUploadSessionExpiry is the lifetime of resumable upload sessions in
+// Cloud Storage.
+const defaultUploadSessionExpiry = 7 * 24 * time.Hour
+
+// uploadSession is the state of a resumable upload: the attributes of the
+// object being uploaded, the content received so far, the checksums sent when
+// the upload started, and whether it has been committed already or
+// interrupted by a FaultUploadInterruption rule.
+type uploadSession struct {
+	obj Object
+	// content is spooled to a temporary file once it's large, so uploads
+	// don't need to fit in memory. It's shared by the copies of the session,
+	// and the requests writing to it are serialized by mtx.
+	content     *spooledContent
+	mtx         *sync.Mutex
+	checksums   uploadChecksums
+	createdAt   time.Time
+	done        bool
+	interrupted bool
+	// conds are the preconditions of the request that started the upload,
+	// enforced again when the object is stored.
+	conds objectPreconditions
 }
 
 type contentRange struct {
@@ -47,7 +82,7 @@ func (s *Server) insertObject(r *http.Request) jsonResponse {
 	bucketName := mux.Vars(r)["bucketName"]
 
 	if _, err := s.backend.GetBucket(bucketName); err != nil {
-		return jsonResponse{status: http.StatusNotFound}
+		return jsonResponse{status: http.StatusNotFound, xmlErrorCode: "NoSuchBucket"}
 	}
 	uploadType := r.URL.Query().Get("uploadType")
 	if uploadType == "" && r.Header.Get("X-Goog-Upload-Protocol") == uploadTypeResumable {
@@ -71,37 +106,39 @@ func (s *Server) insertObject(r *http.Request) jsonResponse {
 				return s.signedUpload(bucketName, r)
 			}
 		}
+		if isV2SignedURL(r) {
+			if errResp := s.verifyV2SignedURL(r); errResp != nil {
+				return *errResp
+			}
+			switch r.Method {
+			case http.MethodPost:
+				return s.resumableUpload(bucketName, r)
+			case http.MethodPut:
+				return s.signedUpload(bucketName, r)
+			}
+		}
 		return jsonResponse{errorMessage: "invalid uploadType", status: http.StatusBadRequest}
 	}
 }
 
 func (s *Server) insertFormObject(r *http.Request) xmlResponse {
 	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return xmlResponse{status: http.StatusNotFound, errorCode: "NoSuchBucket", errorMessage: fmt.Sprintf("No such bucket: %s", bucketName)}
+	}
 
 	if err := r.ParseMultipartForm(32 << 20); nil != err {
 		return xmlResponse{errorMessage: "invalid form", status: http.StatusBadRequest}
 	}
 
 	// Load metadata
-	var name string
-	if keys, ok := r.MultipartForm.Value["key"]; ok {
-		name = keys[0]
-	}
+	name := formValue(r, "key")
 	if name == "" {
 		return xmlResponse{errorMessage: "missing key", status: http.StatusBadRequest}
 	}
-	var predefinedACL string
-	if acls, ok := r.MultipartForm.Value["acl"]; ok {
-		predefinedACL = acls[0]
-	}
-	var contentEncoding string
-	if contentEncodings, ok := r.MultipartForm.Value["Content-Encoding"]; ok {
-		contentEncoding = contentEncodings[0]
-	}
-	var contentType string
-	if contentTypes, ok := r.MultipartForm.Value["Content-Type"]; ok {
-		contentType = contentTypes[0]
-	}
+	predefinedACL := formValue(r, "acl")
+	contentEncoding := formValue(r, "Content-Encoding")
+	contentType := formValue(r, "Content-Type")
 	metaData := make(map[string]string)
 	for key := range r.MultipartForm.Value {
 		lowerKey := strings.ToLower(key)
@@ -126,83 +163,36 @@ func (s *Server) insertFormObject(r *http.Request) xmlResponse {
 	if err != nil {
 		return xmlResponse{errorMessage: err.Error()}
 	}
+	if s.options.VerifyPostPolicies {
+		if resp := s.verifyPostPolicy(r, bucketName, len(data)); resp != nil {
+			return *resp
+		}
+	}
 	md5Hash := checksum.EncodedMd5Hash(data)
 	obj := Object{
 		ObjectAttrs: ObjectAttrs{
-			BucketName:      bucketName,
-			Name:            name,
-			ContentType:     contentType,
-			ContentEncoding: contentEncoding,
-			Crc32c:          checksum.EncodedCrc32cChecksum(data),
-			Md5Hash:         md5Hash,
-			Etag:            fmt.Sprintf("%q", md5Hash),
-			ACL:             getObjectACL(predefinedACL),
-			Metadata:        metaData,
+			BucketName:         bucketName,
+			Name:               name,
+			ContentType:        contentType,
+			ContentEncoding:    contentEncoding,
+			CacheControl:       formValue(r, "Cache-Control"),
+			ContentDisposition: formValue(r, "Content-Disposition"),
+			ContentLanguage:    formValue(r, "Content-Language"),
+			Crc32c:             checksum.EncodedCrc32cChecksum(data),
+			Md5Hash:            md5Hash,
+			Etag:               fmt.Sprintf("%q", md5Hash),
+			ACL:                s.newObjectACL(bucketName, predefinedACL),
+			Metadata:           metaData,
+			StorageClass:       r.Header.Get("X-Goog-Storage-Class"),
 		},
 		Content: data,
 	}
-	_, err = s.createObject(obj)
+	obj, err = s.createObject(obj)
 	if err != nil {
-		return xmlResponse{errorMessage: err.Error()}
+		resp := errToJsonResponse(err)
+		return xmlResponse{status: resp.status, errorMessage: resp.errorMessage}
 	}
-	return xmlResponse{status: http.StatusNoContent}
-}
-
-func (s *Server) checkUploadPreconditions(r *http.Request, bucketName string, objectName string) *jsonResponse {
-	ifGenerationMatch := r.URL.Query().Get("ifGenerationMatch")
-
-	if ifGenerationMatch != "" {
-		gen, err := strconv.ParseInt(ifGenerationMatch, 10, 64)
-		if err != nil {
-			return &jsonResponse{
-				status:       http.StatusBadRequest,
-				errorMessage: err.Error(),
-			}
-		}
-		if gen == 0 {
-			_, err := s.backend.GetObject(bucketName, objectName)
-			if err == nil {
-				return &jsonResponse{
-					status:       http.StatusPreconditionFailed,
-					errorMessage: "Precondition failed",
-				}
-			}
-		} else if _, err := s.backend.GetObjectWithGeneration(bucketName, objectName, gen); err != nil {
-			return &jsonResponse{
-				status:       http.StatusPreconditionFailed,
-				errorMessage: "Precondition failed",
-			}
-		}
-		return nil
-	}
-
-	ifGenerationNotMatch := r.URL.Query().Get("ifGenerationNotMatch")
-
-	if ifGenerationNotMatch != "" {
-		gen, err := strconv.ParseInt(ifGenerationNotMatch, 10, 64)
-		if err != nil {
-			return &jsonResponse{
-				status:       http.StatusBadRequest,
-				errorMessage: err.Error(),
-			}
-		}
-		_, err = s.backend.GetObjectWithGeneration(bucketName, objectName, gen)
-		if gen == 0 {
-			if err != nil {
-				return &jsonResponse{
-					status:       http.StatusPreconditionFailed,
-					errorMessage: "Precondition failed",
-				}
-			}
-		} else if err == nil {
-			return &jsonResponse{
-				status:       http.StatusPreconditionFailed,
-				errorMessage: "Precondition failed",
-			}
-		}
-	}
-
-	return nil
+	return s.postObjectSuccessResponse(r, obj)
 }
 
 func (s *Server) simpleUpload(bucketName string, r *http.Request) jsonResponse {
@@ -216,25 +206,41 @@ func (s *Server) simpleUpload(bucketName string, r *http.Request) jsonResponse {
 			errorMessage: "name is required for simple uploads",
 		}
 	}
-	data, err := io.ReadAll(r.Body)
+	conds, resp := s.checkObjectPreconditions(r, bucketName, name)
+	if resp != nil {
+		return *resp
+	}
+	keySHA256, kmsKeyName, errResp := s.objectEncryption(r, bucketName, r.URL.Query().Get("kmsKeyName"))
+	if errResp != nil {
+		return *errResp
+	}
+	spooled, err := spoolContent(r.Body)
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
-	md5Hash := checksum.EncodedMd5Hash(data)
+	defer spooled.Close()
+	crc32c, md5Hash := spooled.checksums()
+	if err := mediaChecksums(r.Header).verifyCalculated(crc32c, md5Hash); err != nil {
+		return errToJsonResponse(err)
+	}
 	obj := Object{
 		ObjectAttrs: ObjectAttrs{
-			BucketName:      bucketName,
-			Name:            name,
-			ContentType:     r.Header.Get(contentTypeHeader),
-			ContentEncoding: contentEncoding,
-			Crc32c:          checksum.EncodedCrc32cChecksum(data),
-			Md5Hash:         md5Hash,
-			Etag:            fmt.Sprintf("%q", md5Hash),
-			ACL:             getObjectACL(predefinedACL),
+			BucketName:        bucketName,
+			Name:              name,
+			Size:              spooled.size,
+			ContentType:       r.Header.Get(contentTypeHeader),
+			ContentEncoding:   contentEncoding,
+			Crc32c:            crc32c,
+			Md5Hash:           md5Hash,
+			Etag:              fmt.Sprintf("%q", md5Hash),
+			ACL:               s.newObjectACL(bucketName, predefinedACL),
+			CustomerKeySHA256: keySHA256,
+			KMSKeyName:        kmsKeyName,
 		},
-		Content: data,
 	}
-	obj, err = s.createObject(obj)
+	// the content is streamed to the backend, so large uploads don't need to
+	// fit in memory.
+	obj, err = s.createObjectIf(obj, spooled.reader(), conds)
 	if err != nil {
 		return errToJsonResponse(err)
 	}
@@ -246,12 +252,28 @@ func (s *Server) signedUpload(bucketName string, r *http.Request) jsonResponse {
 	name := mux.Vars(r)["objectName"]
 	predefinedACL := r.URL.Query().Get("predefinedAcl")
 	contentEncoding := r.URL.Query().Get("contentEncoding")
+	conds, resp := s.checkObjectPreconditions(r, bucketName, name)
+	if resp != nil {
+		return *resp
+	}
+	keySHA256, kmsKeyName, errResp := s.objectEncryption(r, bucketName, r.Header.Get("X-Goog-Encryption-Kms-Key-Name"))
+	if errResp != nil {
+		return *errResp
+	}
 
 	// Load data from HTTP Headers
 	if contentEncoding == "" {
 		contentEncoding = r.Header.Get("Content-Encoding")
 	}
 
+	var customTime time.Time
+	if value := r.Header.Get("X-Goog-Custom-Time"); value != "" {
+		var err error
+		if customTime, err = time.Parse(time.RFC3339, value); err != nil {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: "Invalid x-goog-custom-time header: " + value}
+		}
+	}
+
 	metaData := make(map[string]string)
 	for key := range r.Header {
 		lowerKey := strings.ToLower(key)
@@ -260,30 +282,54 @@ func (s *Server) signedUpload(bucketName string, r *http.Request) jsonResponse {
 		}
 	}
 
-	data, err := io.ReadAll(r.Body)
+	spooled, err := spoolContent(r.Body)
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
-	md5Hash := checksum.EncodedMd5Hash(data)
+	defer spooled.Close()
+	crc32c, md5Hash := spooled.checksums()
+	if err := mediaChecksums(r.Header).verifyCalculated(crc32c, md5Hash); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorReason: "BadDigest", errorMessage: err.Error()}
+	}
 	obj := Object{
 		ObjectAttrs: ObjectAttrs{
-			BucketName:      bucketName,
-			Name:            name,
-			ContentType:     r.Header.Get(contentTypeHeader),
-			ContentEncoding: contentEncoding,
-			Crc32c:          checksum.EncodedCrc32cChecksum(data),
-			Md5Hash:         md5Hash,
-			Etag:            fmt.Sprintf("%q", md5Hash),
-			ACL:             getObjectACL(predefinedACL),
-			Metadata:        metaData,
+			BucketName:         bucketName,
+			Name:               name,
+			Size:               spooled.size,
+			ContentType:        r.Header.Get(contentTypeHeader),
+			ContentEncoding:    contentEncoding,
+			CacheControl:       r.Header.Get("Cache-Control"),
+			ContentDisposition: r.Header.Get("Content-Disposition"),
+			ContentLanguage:    r.Header.Get("Content-Language"),
+			Crc32c:             crc32c,
+			Md5Hash:            md5Hash,
+			Etag:               fmt.Sprintf("%q", md5Hash),
+			ACL:                s.newObjectACL(bucketName, predefinedACL),
+			Metadata:           metaData,
+			CustomerKeySHA256:  keySHA256,
+			KMSKeyName:         kmsKeyName,
+			CustomTime:         customTime,
 		},
-		Content: data,
 	}
-	obj, err = s.createObject(obj)
+	obj, err = s.createObjectIf(obj, spooled.reader(), conds)
 	if err != nil {
 		return errToJsonResponse(err)
 	}
-	return jsonResponse{data: obj}
+	header := make(http.Header)
+	setGenerationHeaders(header, obj.ObjectAttrs)
+	return jsonResponse{header: header, data: obj}
+}
+
+// newObjectACL returns the ACL of an object uploaded to the bucket with the
+// given predefined ACL. Objects uploaded without one get the default object
+// ACL of the bucket, when it has one.
+func (s *Server) newObjectACL(bucketName, predefinedACL string) []storage.ACLRule {
+	if predefinedACL == "" {
+		if acl := s.defaultObjectACL(bucketName); acl != nil {
+			return acl
+		}
+	}
+	return getObjectACL(predefinedACL)
 }
 
 func getObjectACL(predefinedACL string) []storage.ACLRule {
@@ -306,35 +352,11 @@ func getObjectACL(predefinedACL string) []storage.ACLRule {
 
 func (s *Server) multipartUpload(bucketName string, r *http.Request) jsonResponse {
 	defer r.Body.Close()
-	_, params, err := mime.ParseMediaType(r.Header.Get(contentTypeHeader))
-	if err != nil {
-		return jsonResponse{
-			status:       http.StatusBadRequest,
-			errorMessage: "invalid Content-Type header",
-		}
-	}
-	var (
-		metadata *multipartMetadata
-		content  []byte
-	)
-	var contentType string
-	reader := multipart.NewReader(r.Body, params["boundary"])
-	part, err := reader.NextPart()
-	for ; err == nil; part, err = reader.NextPart() {
-		if metadata == nil {
-			metadata, err = loadMetadata(part)
-			contentType = metadata.ContentType
-		} else {
-			contentType = part.Header.Get(contentTypeHeader)
-			content, err = loadContent(part)
-		}
-		if err != nil {
-			break
-		}
-	}
-	if err != io.EOF {
-		return jsonResponse{errorMessage: err.Error()}
+	metadata, contentType, content, errResp := readMultipartUpload(r)
+	if errResp != nil {
+		return *errResp
 	}
+	defer content.Close()
 
 	objName := r.URL.Query().Get("name")
 	predefinedACL := r.URL.Query().Get("predefinedAcl")
@@ -342,26 +364,46 @@ func (s *Server) multipartUpload(bucketName string, r *http.Request) jsonRespons
 		objName = metadata.Name
 	}
 
-	if resp := s.checkUploadPreconditions(r, bucketName, objName); resp != nil {
+	conds, resp := s.checkObjectPreconditions(r, bucketName, objName)
+	if resp != nil {
 		return *resp
 	}
+	kmsKeyName := r.URL.Query().Get("kmsKeyName")
+	if kmsKeyName == "" {
+		kmsKeyName = metadata.KMSKeyName
+	}
+	keySHA256, kmsKeyName, errResp := s.objectEncryption(r, bucketName, kmsKeyName)
+	if errResp != nil {
+		return *errResp
+	}
 
-	md5Hash := checksum.EncodedMd5Hash(content)
+	crc32c, md5Hash := content.checksums()
+	checksums := uploadChecksums{crc32c: metadata.Crc32c, md5Hash: metadata.Md5Hash}
+	if err := checksums.verifyCalculated(crc32c, md5Hash); err != nil {
+		return errToJsonResponse(err)
+	}
 	obj := Object{
 		ObjectAttrs: ObjectAttrs{
-			BucketName:      bucketName,
-			Name:            objName,
-			ContentType:     contentType,
-			ContentEncoding: metadata.ContentEncoding,
-			Crc32c:          checksum.EncodedCrc32cChecksum(content),
-			Md5Hash:         md5Hash,
-			Etag:            fmt.Sprintf("%q", md5Hash),
-			ACL:             getObjectACL(predefinedACL),
-			Metadata:        metadata.Metadata,
+			BucketName:         bucketName,
+			Name:               objName,
+			Size:               content.size,
+			ContentType:        contentType,
+			ContentEncoding:    metadata.ContentEncoding,
+			CacheControl:       metadata.CacheControl,
+			ContentDisposition: metadata.ContentDisposition,
+			ContentLanguage:    metadata.ContentLanguage,
+			Crc32c:             crc32c,
+			Md5Hash:            md5Hash,
+			Etag:               fmt.Sprintf("%q", md5Hash),
+			ACL:                s.newObjectACL(bucketName, predefinedACL),
+			Metadata:           metadata.Metadata,
+			StorageClass:       metadata.StorageClass,
+			CustomerKeySHA256:  keySHA256,
+			KMSKeyName:         kmsKeyName,
+			CustomTime:         metadata.CustomTime,
 		},
-		Content: content,
 	}
-	obj, err = s.createObject(obj)
+	obj, err := s.createObjectIf(obj, content.reader(), conds)
 	if err != nil {
 		return errToJsonResponse(err)
 	}
@@ -383,24 +425,52 @@ func (s *Server) resumableUpload(bucketName string, r *http.Request) jsonRespons
 	if objName == "" {
 		objName = metadata.Name
 	}
+	conds, resp := s.checkObjectPreconditions(r, bucketName, objName)
+	if resp != nil {
+		return *resp
+	}
+	kmsKeyName := r.URL.Query().Get("kmsKeyName")
+	if kmsKeyName == "" {
+		kmsKeyName = metadata.KMSKeyName
+	}
+	keySHA256, kmsKeyName, errResp := s.objectEncryption(r, bucketName, kmsKeyName)
+	if errResp != nil {
+		return *errResp
+	}
 	obj := Object{
 		ObjectAttrs: ObjectAttrs{
-			BucketName:      bucketName,
-			Name:            objName,
-			ContentEncoding: contentEncoding,
-			ACL:             getObjectACL(predefinedACL),
-			Metadata:        metadata.Metadata,
+			BucketName:         bucketName,
+			Name:               objName,
+			ContentType:        metadata.ContentType,
+			ContentEncoding:    contentEncoding,
+			CacheControl:       metadata.CacheControl,
+			ContentDisposition: metadata.ContentDisposition,
+			ContentLanguage:    metadata.ContentLanguage,
+			ACL:                s.newObjectACL(bucketName, predefinedACL),
+			Metadata:           metadata.Metadata,
+			StorageClass:       metadata.StorageClass,
+			CustomerKeySHA256:  keySHA256,
+			KMSKeyName:         kmsKeyName,
+			CustomTime:         metadata.CustomTime,
 		},
 	}
 	uploadID, err := generateUploadID()
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
-	s.uploads.Store(uploadID, obj)
+	s.removeExpiredUploads()
+	s.uploads.Store(uploadID, uploadSession{
+		obj:       obj,
+		content:   newSpooledContent(),
+		mtx:       new(sync.Mutex),
+		checksums: uploadChecksums{crc32c: metadata.Crc32c, md5Hash: metadata.Md5Hash},
+		conds:     conds,
+		createdAt: time.Now(),
+	})
 	header := make(http.Header)
-	header.Set("Location", s.URL()+"/upload/resumable/"+uploadID)
+	header.Set("Location", s.baseURL(r)+"/upload/resumable/"+uploadID)
 	if r.Header.Get("X-Goog-Upload-Command") == "start" {
-		header.Set("X-Goog-Upload-URL", s.URL()+"/upload/resumable/"+uploadID)
+		header.Set("X-Goog-Upload-URL", s.baseURL(r)+"/upload/resumable/"+uploadID)
 		header.Set("X-Goog-Upload-Status", "active")
 	}
 	return jsonResponse{
@@ -409,6 +479,64 @@ func (s *Server) resumableUpload(bucketName string, r *http.Request) jsonRespons
 	}
 }
 
+func (s *Server) uploadSessionExpiry() time.Duration {
+	if s.options.UploadSessionExpiry > 0 {
+		return s.options.UploadSessionExpiry
+	}
+	return defaultUploadSessionExpiry
+}
+
+func (s *Server) removeExpiredUploads() {
+	expiry := s.uploadSessionExpiry()
+	s.uploads.Range(func(key, value interface{}) bool {
+		if session := value.(uploadSession); time.Since(session.createdAt) > expiry {
+			s.discardUpload(key.(string), session)
+		}
+		return true
+	})
+}
+
+// discardUpload removes the upload session, along with the content received
+// so far.
+func (s *Server) discardUpload(uploadID string, session uploadSession) {
+	s.uploads.Delete(uploadID)
+	if session.content != nil {
+		session.content.Close()
+	}
+}
+
+// loadUploadSession returns the resumable upload session with the given ID, or
+// an error response if the session doesn't exist or has expired.
+func (s *Server) loadUploadSession(uploadID string) (uploadSession, *jsonResponse) {
+	rawSession, ok := s.uploads.Load(uploadID)
+	if !ok {
+		return uploadSession{}, &jsonResponse{status: http.StatusNotFound, errorMessage: "No such upload session."}
+	}
+	session := rawSession.(uploadSession)
+	if time.Since(session.createdAt) > s.uploadSessionExpiry() {
+		s.discardUpload(uploadID, session)
+		return uploadSession{}, &jsonResponse{status: http.StatusGone, errorMessage: "The upload session has expired."}
+	}
+	return session, nil
+}
+
+// lockUploadSession is like loadUploadSession, but waits for the other
+// requests of the session first. The returned function releases the lock.
+func (s *Server) lockUploadSession(uploadID string) (uploadSession, func(), *jsonResponse) {
+	session, errResp := s.loadUploadSession(uploadID)
+	if errResp != nil {
+		return uploadSession{}, nil, errResp
+	}
+	session.mtx.Lock()
+	// the session may have changed, or been removed, while waiting.
+	rawSession, ok := s.uploads.Load(uploadID)
+	if !ok {
+		session.mtx.Unlock()
+		return uploadSession{}, nil, &jsonResponse{status: http.StatusNotFound, errorMessage: "No such upload session."}
+	}
+	return rawSession.(uploadSession), session.mtx.Unlock, nil
+}
+
 // uploadFileContent accepts a chunk of a resumable upload
 //
 // A resumable upload is sent in one or more chunks. The request's
@@ -435,55 +563,119 @@ func (s *Server) resumableUpload(bucketName string, r *http.Request) jsonRespons
 // The server collects the content, analyzes the "Content-Range", and returns a
 // "308 Permanent Redirect" response if more chunks are expected, and a
 // "200 OK" response if the upload is complete (the Go client also accepts a
-// "201 Created" response). The "Range" header in the response should be set to
-// the size of the content received so far, such as:
+// "201 Created" response). The "Range" header in the response is set to the
+// content received so far (the header is omitted if nothing was received):
+//
+//	Range: bytes=0-1999
 //
-//	Range: bytes 0-2000
+// A chunk that starts before the end of the received content (the client
+// retrying a chunk it didn't get a response for) only has its new bytes
+// appended. A chunk that starts after it is rejected.
+//
+// An empty request with the "Content-Range" header set to "bytes */*" or
+// "bytes */<total>" queries the status of the upload: the server replies with
+// "308 Permanent Redirect" and the received range if the upload is still
+// incomplete, or with "200 OK" and the object once it's complete.
 //
 // The client (such as the Go client) can send a header "X-Guploader-No-308" if
 // it can't process a native "308 Permanent Redirect". The in-process response
 // then has a status of "200 OK", with a header "X-Http-Status-Code-Override"
 // set to "308".
+//
+// Sessions expire after Options.UploadSessionExpiry (one week by default),
+// and can be canceled with a DELETE request (see cancelUpload).
 func (s *Server) uploadFileContent(r *http.Request) jsonResponse {
+	defer r.Body.Close()
 	uploadID := mux.Vars(r)["uploadId"]
-	rawObj, ok := s.uploads.Load(uploadID)
-	if !ok {
-		return jsonResponse{status: http.StatusNotFound}
+	session, unlock, errResp := s.lockUploadSession(uploadID)
+	if errResp != nil {
+		return *errResp
 	}
-	obj := rawObj.(Object)
-	content, err := loadContent(r.Body)
-	if err != nil {
-		return jsonResponse{errorMessage: err.Error()}
+	defer unlock()
+	obj := session.obj
+	responseHeader := make(http.Header)
+	if r.Header.Get("X-Goog-Upload-Command") == "upload, finalize" {
+		responseHeader.Set("X-Goog-Upload-Status", "final")
+	}
+	if session.done {
+		// The upload was already committed, any further request (such as a
+		// status query) gets the resulting object.
+		return jsonResponse{data: obj, header: responseHeader}
+	}
+	if r.Header.Get("X-Goog-Upload-Command") == "query" {
+		responseHeader.Set("X-Goog-Upload-Status", "active")
+		responseHeader.Set("X-Goog-Upload-Size-Received", strconv.FormatInt(session.content.size, 10))
+		return jsonResponse{header: responseHeader}
 	}
 	commit := true
-	status := http.StatusOK
-	obj.Content = append(obj.Content, content...)
-	obj.Crc32c = checksum.EncodedCrc32cChecksum(obj.Content)
-	obj.Md5Hash = checksum.EncodedMd5Hash(obj.Content)
-	obj.Etag = fmt.Sprintf("%q", obj.Md5Hash)
-	obj.ContentType = r.Header.Get(contentTypeHeader)
-	responseHeader := make(http.Header)
+	var parsed contentRange
 	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
-		parsed, err := parseContentRange(contentRange)
+		var err error
+		parsed, err = parseContentRange(contentRange)
 		if err != nil {
 			return jsonResponse{errorMessage: err.Error(), status: http.StatusBadRequest}
 		}
 		if parsed.KnownRange {
 			// Middle of streaming request, or any part of chunked request
-			responseHeader.Set("Range", fmt.Sprintf("bytes=0-%d", parsed.End))
-			// Complete if the range covers the known total
-			commit = parsed.KnownTotal && (parsed.End+1 >= parsed.Total)
-		} else {
-			// End of a streaming request
-			responseHeader.Set("Range", fmt.Sprintf("bytes=0-%d", len(obj.Content)))
+			received := session.content.size
+			if int64(parsed.Start) > received {
+				return jsonResponse{
+					status:       http.StatusBadRequest,
+					errorMessage: fmt.Sprintf("Content-Range starts at %d, but only %d bytes were received.", parsed.Start, received),
+				}
+			}
+			// the bytes received already are skipped.
+			if overlap := received - int64(parsed.Start); overlap > 0 {
+				if _, err := io.CopyN(io.Discard, r.Body, overlap); err != nil && err != io.EOF {
+					return jsonResponse{errorMessage: err.Error()}
+				}
+			}
+		}
+	}
+	if rule, ok := s.faults.find(FaultUploadInterruption, r, obj.BucketName, obj.Name); ok && !session.interrupted {
+		if interrupted, err := s.receiveUntilInterrupted(session, r.Body, rule); err != nil {
+			return jsonResponse{errorMessage: err.Error()}
+		} else if interrupted {
+			return s.interruptUpload(uploadID, session, rule)
+		}
+	} else if _, err := io.Copy(session.content, r.Body); err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	received := session.content.size
+	if r.Header.Get("Content-Range") != "" {
+		switch {
+		case parsed.KnownTotal:
+			// Complete if the content covers the known total
+			commit = received >= int64(parsed.Total)
+		case parsed.KnownRange || parsed.Start < 0:
+			// Chunk of a streaming request, or status query
+			commit = false
+		}
+		if received > 0 {
+			responseHeader.Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
 		}
 	}
+	obj.Size = received
+	obj.Crc32c, obj.Md5Hash = session.content.checksums()
+	obj.Etag = fmt.Sprintf("%q", obj.Md5Hash)
+	if contentType := r.Header.Get(contentTypeHeader); contentType != "" {
+		obj.ContentType = contentType
+	}
+	status := http.StatusOK
 	if commit {
-		s.uploads.Delete(uploadID)
-		obj, err = s.createObject(obj)
+		if err := hashHeaderChecksums(r.Header).merge(session.checksums).verifyCalculated(obj.Crc32c, obj.Md5Hash); err != nil {
+			return errToJsonResponse(err)
+		}
+		var err error
+		obj, err = s.createObjectIf(obj, session.content.reader(), session.conds)
 		if err != nil {
 			return errToJsonResponse(err)
 		}
+		// only the attributes are kept to answer further requests, the
+		// content is in the backend.
+		session.content.Close()
+		session.obj, session.content, session.done = Object{ObjectAttrs: obj.ObjectAttrs}, nil, true
+		s.uploads.Store(uploadID, session)
 	} else {
 		if _, no308 := r.Header["X-Guploader-No-308"]; no308 {
 			// Go client
@@ -492,10 +684,8 @@ func (s *Server) uploadFileContent(r *http.Request) jsonResponse {
 			// Python client
 			status = http.StatusPermanentRedirect
 		}
-		s.uploads.Store(uploadID, obj)
-	}
-	if r.Header.Get("X-Goog-Upload-Command") == "upload, finalize" {
-		responseHeader.Set("X-Goog-Upload-Status", "final")
+		session.obj = obj
+		s.uploads.Store(uploadID, session)
 	}
 	return jsonResponse{
 		status: status,
@@ -504,12 +694,63 @@ func (s *Server) uploadFileContent(r *http.Request) jsonResponse {
 	}
 }
 
+// receiveUntilInterrupted appends the content of the request to the upload
+// until it reaches the bytes allowed by the rule, reporting whether the
+// request had more content, so the upload must be interrupted.
+func (s *Server) receiveUntilInterrupted(session uploadSession, body io.Reader, rule FaultRule) (bool, error) {
+	if allowed := rule.AfterBytes - session.content.size; allowed > 0 {
+		if _, err := io.CopyN(session.content, body, allowed); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	n, err := body.Read(make([]byte, 1))
+	if n > 0 {
+		return true, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return false, nil
+}
+
+// interruptUpload keeps the content of the upload received up to the bytes
+// allowed by the rule, and then fails the request as the rule says, either
+// with an error status or by dropping the connection.
+func (s *Server) interruptUpload(uploadID string, session uploadSession, rule FaultRule) jsonResponse {
+	session.interrupted = true
+	s.uploads.Store(uploadID, session)
+	if rule.Status == 0 {
+		panic(http.ErrAbortHandler)
+	}
+	return jsonResponse{status: rule.Status, errorMessage: "The upload was interrupted."}
+}
+
+// cancelUpload cancels a resumable upload, discarding the content received so
+// far. As in Cloud Storage, the response has the non-standard status 499.
+func (s *Server) cancelUpload(r *http.Request) jsonResponse {
+	uploadID := mux.Vars(r)["uploadId"]
+	session, unlock, errResp := s.lockUploadSession(uploadID)
+	if errResp != nil {
+		return *errResp
+	}
+	defer unlock()
+	if session.done {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: "The upload was already completed."}
+	}
+	s.discardUpload(uploadID, session)
+	return jsonResponse{status: 499}
+}
+
 // Parse a Content-Range header
 // Some possible valid header values:
 //
 //	bytes 0-1023/4096 (first 1024 bytes of a 4096-byte document)
 //	bytes 1024-2047/* (second 1024 bytes of a streaming document)
 //	bytes */4096      (The end of 4096 byte streaming document)
+//	bytes */*         (status query of a streaming document)
 //	bytes 0-*/*       (start and end of a streaming document as sent by nodeJS client lib)
 func parseContentRange(r string) (parsed contentRange, err error) {
 	invalidErr := fmt.Errorf("invalid Content-Range: %v", r)
@@ -555,10 +796,6 @@ func parseContentRange(r string) (parsed contentRange, err error) {
 	// Process total length
 	if parts[1] == "*" {
 		parsed.Total = -1
-
-		if parsed.Start < 0 {
-			return parsed, invalidErr
-		}
 	} else {
 		parsed.KnownTotal = true
 		parsed.Total, err = strconv.Atoi(parts[1])
@@ -570,6 +807,88 @@ func parseContentRange(r string) (parsed contentRange, err error) {
 	return parsed, nil
 }
 
+// readMultipartUpload reads the body of a multipart upload, which must have
+// exactly two parts, as in Cloud Storage: the JSON metadata of the object,
+// followed by its content. It returns the metadata, the content type of the
+// object and its content, spooled so it doesn't need to fit in memory. The
+// caller must close the content.
+func readMultipartUpload(r *http.Request) (*multipartMetadata, string, *spooledContent, *jsonResponse) {
+	var media *spooledContent
+	failed := func(resp jsonResponse) (*multipartMetadata, string, *spooledContent, *jsonResponse) {
+		if media != nil {
+			media.Close()
+		}
+		return nil, "", nil, &resp
+	}
+	invalid := func(message string) (*multipartMetadata, string, *spooledContent, *jsonResponse) {
+		return failed(jsonResponse{status: http.StatusBadRequest, errorReason: "invalid", errorMessage: message})
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get(contentTypeHeader))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return invalid("invalid Content-Type header")
+	}
+
+	var parts []*multipart.Part
+	var metadataContent []byte
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return invalid("Invalid multipart request: " + err.Error())
+		}
+		content, err := multipartPartReader(part)
+		if err == nil {
+			switch len(parts) {
+			case 0:
+				metadataContent, err = io.ReadAll(content)
+			case 1:
+				media, err = spoolContent(content)
+			default:
+				_, err = io.Copy(io.Discard, content)
+			}
+		}
+		part.Close()
+		if err != nil {
+			return invalid("Invalid multipart request: " + err.Error())
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) != 2 {
+		return invalid(fmt.Sprintf("Invalid multipart request with %d mime parts.", len(parts)))
+	}
+
+	metadataType, _, err := mime.ParseMediaType(parts[0].Header.Get(contentTypeHeader))
+	if err != nil || metadataType != "application/json" {
+		return invalid(fmt.Sprintf("Invalid metadata part with Content-Type %q, it must be the first part and have Content-Type application/json.", parts[0].Header.Get(contentTypeHeader)))
+	}
+	var metadata multipartMetadata
+	if err := json.Unmarshal(metadataContent, &metadata); err != nil {
+		return failed(jsonResponse{status: http.StatusBadRequest, errorReason: "parseError", errorMessage: "Parse Error"})
+	}
+	contentType := parts[1].Header.Get(contentTypeHeader)
+	if contentType == "" {
+		contentType = metadata.ContentType
+	}
+	return &metadata, contentType, media, nil
+}
+
+// multipartPartReader returns a reader of the content of a part of a
+// multipart upload, decoding it according to its Content-Transfer-Encoding.
+// The multipart reader already decodes quoted-printable parts.
+func multipartPartReader(part *multipart.Part) (io.Reader, error) {
+	switch encoding := strings.ToLower(part.Header.Get("Content-Transfer-Encoding")); encoding {
+	case "", "7bit", "8bit", "binary":
+		return part, nil
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, part), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Transfer-Encoding %q", encoding)
+	}
+}
+
 func loadMetadata(rc io.ReadCloser) (*multipartMetadata, error) {
 	defer rc.Close()
 	var m multipartMetadata
@@ -577,11 +896,6 @@ func loadMetadata(rc io.ReadCloser) (*multipartMetadata, error) {
 	return &m, err
 }
 
-func loadContent(rc io.ReadCloser) ([]byte, error) {
-	defer rc.Close()
-	return io.ReadAll(rc)
-}
-
 func generateUploadID() (string, error) {
 	var raw [16]byte
 	_, err := rand.Read(raw[:])
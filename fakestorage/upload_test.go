@@ -10,13 +10,16 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/fsouza/fake-gcs-server/internal/checksum"
@@ -163,6 +166,51 @@ func TestServerClientObjectWriterOverwrite(t *testing.T) {
 	})
 }
 
+func TestServerClientObjectWriterStorageClass(t *testing.T) {
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		const bucketName = "nearline-bucket"
+		client := server.Client()
+		err := client.Bucket(bucketName).Create(context.Background(), "whatever", &storage.BucketAttrs{StorageClass: "NEARLINE"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucketAttrs, err := client.Bucket(bucketName).Attrs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucketAttrs.StorageClass != "NEARLINE" {
+			t.Errorf("wrong bucket storage class\nwant %q\ngot  %q", "NEARLINE", bucketAttrs.StorageClass)
+		}
+
+		tests := []struct {
+			name                 string
+			storageClass         string
+			expectedStorageClass string
+		}{
+			{"inherited.txt", "", "NEARLINE"},
+			{"explicit.txt", "COLDLINE", "COLDLINE"},
+		}
+		for _, test := range tests {
+			w := client.Bucket(bucketName).Object(test.name).NewWriter(context.Background())
+			w.StorageClass = test.storageClass
+			w.Write([]byte("some content"))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if w.Attrs().StorageClass != test.expectedStorageClass {
+				t.Errorf("%s: wrong storage class in the upload response\nwant %q\ngot  %q", test.name, test.expectedStorageClass, w.Attrs().StorageClass)
+			}
+			attrs, err := client.Bucket(bucketName).Object(test.name).Attrs(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attrs.StorageClass != test.expectedStorageClass {
+				t.Errorf("%s: wrong storage class\nwant %q\ngot  %q", test.name, test.expectedStorageClass, attrs.StorageClass)
+			}
+		}
+	})
+}
+
 func TestServerClientObjectWriterWithDoesNotExistPrecondition(t *testing.T) {
 	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
 		const originalContent = "original content"
@@ -203,7 +251,7 @@ func TestServerClientObjectWriterWithDoesNotExistPrecondition(t *testing.T) {
 		if err == nil {
 			t.Fatal("expected overwriting existing object to fail, but received no error")
 		}
-		if err.Error() != "googleapi: Error 412: Precondition failed" {
+		if err.Error() != "googleapi: Error 412: Precondition failed, conditionNotMet" {
 			t.Errorf("expected HTTP 412 precondition failed error, but got %v", err)
 		}
 
@@ -325,7 +373,7 @@ func TestServerClientObjectOperationsWithIfGenerationNotMatchPrecondition(t *tes
 		if err == nil {
 			t.Fatal("expected overwriting existing object to fail, but received no error")
 		}
-		if err.Error() != "googleapi: Error 412: Precondition failed" {
+		if err.Error() != "googleapi: Error 412: Precondition failed, conditionNotMet" {
 			t.Errorf("expected HTTP 412 precondition failed error, but got %v", err)
 		}
 
@@ -390,6 +438,123 @@ func TestServerClientObjectWriterBucketNotFound(t *testing.T) {
 	})
 }
 
+func TestServerClientObjectWriterChecksumMismatch(t *testing.T) {
+	content := strings.Repeat("some nice content\n", googleapi.MinUploadChunkSize/8)
+	wrongContent := []byte("some other content")
+	tests := []struct {
+		name      string
+		chunkSize int
+		setup     func(w *storage.Writer)
+	}{
+		{
+			name: "multipart upload with wrong crc32c",
+			setup: func(w *storage.Writer) {
+				w.SendCRC32C = true
+				w.CRC32C = uint32Checksum(wrongContent)
+			},
+		},
+		{
+			name: "multipart upload with wrong md5",
+			setup: func(w *storage.Writer) {
+				w.MD5 = checksum.MD5Hash(wrongContent)
+			},
+		},
+		{
+			name:      "resumable upload with wrong crc32c",
+			chunkSize: googleapi.MinUploadChunkSize,
+			setup: func(w *storage.Writer) {
+				w.SendCRC32C = true
+				w.CRC32C = uint32Checksum(wrongContent)
+			},
+		},
+	}
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+		for _, test := range tests {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				w := server.Client().Bucket("some-bucket").Object("object.txt").NewWriter(context.Background())
+				w.ChunkSize = test.chunkSize
+				test.setup(w)
+				w.Write([]byte(content))
+				err := w.Close()
+				var apiErr *googleapi.Error
+				if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+					t.Fatalf("wrong error uploading with a checksum that doesn't match: %v", err)
+				}
+				if _, err := server.GetObject("some-bucket", "object.txt"); err == nil {
+					t.Error("unexpected <nil> error getting an object uploaded with a wrong checksum")
+				}
+			})
+		}
+
+		w := server.Client().Bucket("some-bucket").Object("object.txt").NewWriter(context.Background())
+		w.SendCRC32C = true
+		w.CRC32C = uint32Checksum([]byte(content))
+		w.MD5 = checksum.MD5Hash([]byte(content))
+		w.Write([]byte(content))
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error uploading with the right checksums: %v", err)
+		}
+	})
+}
+
+func TestServerSimpleUploadChecksumHeaders(t *testing.T) {
+	const content = "some nice content"
+	tests := []struct {
+		name           string
+		header         http.Header
+		expectedStatus int
+	}{
+		{
+			name:           "no checksums",
+			header:         http.Header{},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "matching x-goog-hash",
+			header: http.Header{"X-Goog-Hash": []string{
+				"crc32c=" + checksum.EncodedCrc32cChecksum([]byte(content)) + ",md5=" + checksum.EncodedMd5Hash([]byte(content)),
+			}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "mismatching x-goog-hash crc32c",
+			header:         http.Header{"X-Goog-Hash": []string{"crc32c=" + checksum.EncodedCrc32cChecksum([]byte("other"))}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "mismatching content-md5",
+			header:         http.Header{"Content-Md5": []string{checksum.EncodedMd5Hash([]byte("other"))}},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=media&name=object.txt", strings.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = test.header
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("wrong status code\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
 func TestServerClientSimpleUpload(t *testing.T) {
 	server := NewServer(nil)
 	defer server.Stop()
@@ -477,6 +642,49 @@ func TestServerClientSignedUpload(t *testing.T) {
 	checkChecksum(t, []byte(data), obj)
 }
 
+func TestServerClientSignedUploadAfterPublicHostChange(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "other-bucket"})
+	client := server.HTTPClient()
+
+	req, err := http.NewRequest(http.MethodPut, "https://storage.googleapis.com/_internal/config", strings.NewReader(`{"publicHost":"gcs.example.test"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	const data = "some nice content"
+	req, err = http.NewRequest(http.MethodPut, "https://gcs.example.test/other-bucket/some/nice/object.txt?X-Goog-Algorithm=GOOG4-RSA-SHA256", strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status code\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+
+	obj, err := server.GetObject("other-bucket", "some/nice/object.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Content) != data {
+		t.Errorf("wrong content\nwant %q\ngot  %q", data, obj.Content)
+	}
+}
+
 func TestServerClientSignedUploadBucketCNAME(t *testing.T) {
 	url := "https://mybucket.mydomain.com:4443/files/txt/text-02.txt?X-Goog-Algorithm=GOOG4-RSA-SHA256&X-Goog-Credential=fake-gcs&X-Goog-Expires=3600&X-Goog-SignedHeaders=host&X-Goog-Signature=fake-gc"
 	expectedName := "files/txt/text-02.txt"
@@ -634,6 +842,155 @@ func TestServerInvalidUploadType(t *testing.T) {
 	}
 }
 
+func TestServerMultipartUploadParsing(t *testing.T) {
+	const boundary = "foo'()+_,-./:=?bar"
+	part := func(headers, body string) string {
+		return "--" + boundary + "\r\n" + headers + "\r\n\r\n" + body + "\r\n"
+	}
+	const metadataHeaders = "Content-Type: application/json; charset=UTF-8"
+	const metadata = `{"name":"object.txt","metadata":{"key":"value"}}`
+	const end = "--" + boundary + "--\r\n"
+
+	tests := []struct {
+		name            string
+		contentType     string
+		body            string
+		expectedStatus  int
+		expectedReason  string
+		expectedContent string
+	}{
+		{
+			name:            "valid upload with a quoted boundary",
+			body:            part(metadataHeaders, metadata) + part("Content-Type: text/plain", "some content") + end,
+			expectedStatus:  http.StatusOK,
+			expectedContent: "some content",
+		},
+		{
+			name:            "base64 encoded content",
+			body:            part(metadataHeaders, metadata) + part("Content-Type: text/plain\r\nContent-Transfer-Encoding: base64", "c29tZSBj\r\nb250ZW50") + end,
+			expectedStatus:  http.StatusOK,
+			expectedContent: "some content",
+		},
+		{
+			name:            "base64 encoded metadata",
+			body:            part(metadataHeaders+"\r\nContent-Transfer-Encoding: base64", "eyJuYW1lIjoib2JqZWN0LnR4dCJ9") + part("Content-Type: text/plain", "some content") + end,
+			expectedStatus:  http.StatusOK,
+			expectedContent: "some content",
+		},
+		{
+			name:            "quoted-printable content",
+			body:            part(metadataHeaders, metadata) + part("Content-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable", "some=20con=\r\ntent") + end,
+			expectedStatus:  http.StatusOK,
+			expectedContent: "some content",
+		},
+		{
+			name:           "unsupported transfer encoding",
+			body:           part(metadataHeaders, metadata) + part("Content-Type: text/plain\r\nContent-Transfer-Encoding: x-uuencode", "some content") + end,
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "invalid",
+		},
+		{
+			name:           "missing media part",
+			body:           part(metadataHeaders, metadata) + end,
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "invalid",
+		},
+		{
+			name:           "extra part",
+			body:           part(metadataHeaders, metadata) + part("Content-Type: text/plain", "some content") + part("Content-Type: text/plain", "more content") + end,
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "invalid",
+		},
+		{
+			name:           "media before metadata",
+			body:           part("Content-Type: text/plain", "some content") + part(metadataHeaders, metadata) + end,
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "invalid",
+		},
+		{
+			name:           "metadata without content type",
+			body:           part("X-Whatever: value", metadata) + part("Content-Type: text/plain", "some content") + end,
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "invalid",
+		},
+		{
+			name:           "invalid metadata",
+			body:           part(metadataHeaders, `{"name":`) + part("Content-Type: text/plain", "some content") + end,
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "parseError",
+		},
+		{
+			name:           "truncated body",
+			body:           part(metadataHeaders, metadata) + "--" + boundary + "\r\nContent-Type: text/plain\r\n\r\nsome content",
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "invalid",
+		},
+		{
+			name:           "missing boundary",
+			contentType:    "multipart/related",
+			body:           part(metadataHeaders, metadata) + part("Content-Type: text/plain", "some content") + end,
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "invalid",
+		},
+		{
+			name:           "not a multipart body",
+			contentType:    "application/json",
+			body:           metadata,
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "invalid",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{NoListener: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+
+			req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=multipart", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			contentType := test.contentType
+			if contentType == "" {
+				contentType = `multipart/related; boundary="` + boundary + `"`
+			}
+			req.Header.Set("Content-Type", contentType)
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.expectedStatus {
+				t.Fatalf("wrong status returned\nwant %d\ngot  %d", test.expectedStatus, resp.StatusCode)
+			}
+			if test.expectedStatus != http.StatusOK {
+				var errResp errorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+					t.Fatal(err)
+				}
+				if len(errResp.Error.Errors) != 1 || errResp.Error.Errors[0].Reason != test.expectedReason {
+					t.Errorf("wrong errors returned\nwant reason %q\ngot  %+v", test.expectedReason, errResp.Error.Errors)
+				}
+				return
+			}
+			obj, err := server.GetObject("some-bucket", "object.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(obj.Content) != test.expectedContent {
+				t.Errorf("wrong content\nwant %q\ngot  %q", test.expectedContent, obj.Content)
+			}
+			if obj.ContentType != "text/plain" {
+				t.Errorf("wrong content type\nwant %q\ngot  %q", "text/plain", obj.ContentType)
+			}
+		})
+	}
+}
+
 func TestParseContentRange(t *testing.T) {
 	t.Parallel()
 	goodHeaderTests := []struct {
@@ -656,6 +1013,10 @@ func TestParseContentRange(t *testing.T) {
 			"bytes 0-1024/*", // A streaming request, unknown total
 			contentRange{KnownRange: true, Start: 0, End: 1024, Total: -1},
 		},
+		{
+			"bytes */*", // Status query of a streaming request
+			contentRange{Start: -1, End: -1, Total: -1},
+		},
 	}
 
 	for _, test := range goodHeaderTests {
@@ -679,7 +1040,6 @@ func TestParseContentRange(t *testing.T) {
 		"bytes start-20/100",  // Non-integer range start
 		"bytes 20-end/100",    // Non-integer range end
 		"bytes 100-200/total", // Non-integer size
-		"bytes */*",           // Unknown range or size
 	}
 	for _, test := range badHeaderTests {
 		test := test
@@ -693,6 +1053,276 @@ func TestParseContentRange(t *testing.T) {
 	}
 }
 
+func initiateResumableUpload(t *testing.T, server *Server, bucketName, objectName string) string {
+	t.Helper()
+	url := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s", server.URL(), bucketName, objectName)
+	resp, err := server.HTTPClient().Post(url, "application/json", strings.NewReader(`{"contentType":"text/plain"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status initiating the upload\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		t.Fatal("missing Location header with the upload URI")
+	}
+	return location
+}
+
+func putResumableChunk(t *testing.T, server *Server, uploadURI, contentRange, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, uploadURI, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := server.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestServerResumableUploadLocation(t *testing.T) {
+	tests := []struct {
+		name             string
+		externalURL      string
+		forwardedHeaders map[string]string
+		expectedPrefix   string
+	}{
+		{
+			"request host",
+			"",
+			nil,
+			"https://storage.googleapis.com/upload/resumable/",
+		},
+		{
+			"forwarded host and scheme",
+			"",
+			map[string]string{"X-Forwarded-Host": "localhost:8080", "X-Forwarded-Proto": "http"},
+			"http://localhost:8080/upload/resumable/",
+		},
+		{
+			"external URL override",
+			"https://gcs.example.com:4443/",
+			map[string]string{"X-Forwarded-Host": "localhost:8080"},
+			"https://gcs.example.com:4443/upload/resumable/",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(Options{NoListener: true, ExternalURL: test.externalURL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+			server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+
+			req, err := http.NewRequest(http.MethodPost, "https://storage.googleapis.com/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=file.txt", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range test.forwardedHeaders {
+				req.Header.Set(name, value)
+			}
+			resp, err := server.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if location := resp.Header.Get("Location"); !strings.HasPrefix(location, test.expectedPrefix) {
+				t.Errorf("wrong Location header\nwant prefix %q\ngot         %q", test.expectedPrefix, location)
+			}
+		})
+	}
+}
+
+func TestServerResumableUploadLocationListener(t *testing.T) {
+	server, err := NewServerWithOptions(Options{Scheme: "http", Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+
+	// simulate a client reaching the server through a different address,
+	// as with port forwarding.
+	url := strings.Replace(server.URL(), "127.0.0.1", "localhost", 1)
+	resp, err := http.Post(url+"/upload/storage/v1/b/some-bucket/o?uploadType=resumable&name=file.txt", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, url+"/upload/resumable/") {
+		t.Fatalf("wrong Location header\nwant prefix %q\ngot         %q", url+"/upload/resumable/", location)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, location, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("wrong status continuing the session\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestServerResumableUploadChunks(t *testing.T) {
+	const bucketName = "some-bucket"
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName})
+		uploadURI := initiateResumableUpload(t, server, bucketName, "chunked.txt")
+
+		tests := []struct {
+			name           string
+			contentRange   string
+			body           string
+			expectedStatus int
+			expectedRange  string
+		}{
+			{"status query before any chunk", "bytes */*", "", http.StatusPermanentRedirect, ""},
+			{"first chunk", "bytes 0-4/11", "hello", http.StatusPermanentRedirect, "bytes=0-4"},
+			{"status query with known total", "bytes */11", "", http.StatusPermanentRedirect, "bytes=0-4"},
+			{"chunk after a gap", "bytes 6-10/11", "world", http.StatusBadRequest, ""},
+			{"retried chunk", "bytes 3-6/11", "lo w", http.StatusPermanentRedirect, "bytes=0-6"},
+			{"last chunk", "bytes 7-10/11", "orld", http.StatusOK, "bytes=0-10"},
+			{"status query after completion", "bytes */*", "", http.StatusOK, ""},
+		}
+		for _, test := range tests {
+			resp := putResumableChunk(t, server, uploadURI, test.contentRange, test.body)
+			if resp.StatusCode != test.expectedStatus {
+				t.Errorf("%s: wrong status\nwant %d\ngot  %d", test.name, test.expectedStatus, resp.StatusCode)
+			}
+			if rangeHeader := resp.Header.Get("Range"); rangeHeader != test.expectedRange {
+				t.Errorf("%s: wrong Range header\nwant %q\ngot  %q", test.name, test.expectedRange, rangeHeader)
+			}
+		}
+
+		session, ok := server.uploads.Load(uploadURI[strings.LastIndex(uploadURI, "/")+1:])
+		if !ok {
+			t.Fatal("completed upload session not found")
+		}
+		if content := session.(uploadSession).obj.Content; content != nil {
+			t.Errorf("content of the completed upload kept in the session: %q", content)
+		}
+
+		obj, err := server.GetObject(bucketName, "chunked.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != "hello world" {
+			t.Errorf("wrong content\nwant %q\ngot  %q", "hello world", string(obj.Content))
+		}
+		if obj.ContentType != "text/plain" {
+			t.Errorf("wrong content type\nwant %q\ngot  %q", "text/plain", obj.ContentType)
+		}
+		checkChecksum(t, []byte("hello world"), obj)
+	})
+}
+
+func TestServerResumableUploadSpooled(t *testing.T) {
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+	uploadURI := initiateResumableUpload(t, server, "some-bucket", "large.bin")
+	uploadID := uploadURI[strings.LastIndex(uploadURI, "/")+1:]
+
+	first := bytes.Repeat([]byte("a"), maxInMemoryContentSize+1)
+	resp := putResumableChunk(t, server, uploadURI, fmt.Sprintf("bytes 0-%d/*", len(first)-1), string(first))
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		t.Fatalf("wrong status sending the first chunk\nwant %d\ngot  %d", http.StatusPermanentRedirect, resp.StatusCode)
+	}
+	session, _ := server.uploads.Load(uploadID)
+	spooled := session.(uploadSession).content
+	if spooled.file == nil {
+		t.Fatal("content of the upload wasn't spooled to a file")
+	}
+	resp = putResumableChunk(t, server, uploadURI, fmt.Sprintf("bytes %d-%d/%d", len(first), len(first)+2, len(first)+3), "end")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status sending the last chunk\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+	}
+	if _, err := os.Stat(spooled.file.Name()); !os.IsNotExist(err) {
+		t.Errorf("temporary file not removed: %v", err)
+	}
+
+	obj, err := server.GetObject("some-bucket", "large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChecksum(t, append(first, "end"...), obj)
+}
+
+func TestServerResumableUploadCancel(t *testing.T) {
+	const bucketName = "some-bucket"
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName})
+		uploadURI := initiateResumableUpload(t, server, bucketName, "canceled.txt")
+		putResumableChunk(t, server, uploadURI, "bytes 0-4/*", "hello")
+
+		req, err := http.NewRequest(http.MethodDelete, uploadURI, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.HTTPClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 499 {
+			t.Errorf("wrong status canceling the upload\nwant %d\ngot  %d", 499, resp.StatusCode)
+		}
+
+		resp = putResumableChunk(t, server, uploadURI, "bytes */*", "")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("wrong status querying canceled upload\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+		}
+		if _, err := server.GetObject(bucketName, "canceled.txt"); err == nil {
+			t.Error("unexpected <nil> error getting the object of a canceled upload")
+		}
+	})
+}
+
+func TestServerResumableUploadExpiry(t *testing.T) {
+	const bucketName = "some-bucket"
+	server, err := NewServerWithOptions(Options{
+		NoListener:          true,
+		UploadSessionExpiry: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName})
+	uploadURI := initiateResumableUpload(t, server, bucketName, "expired.txt")
+
+	resp := putResumableChunk(t, server, uploadURI, "bytes 0-4/*", "hello")
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		t.Errorf("wrong status before expiry\nwant %d\ngot  %d", http.StatusPermanentRedirect, resp.StatusCode)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	resp = putResumableChunk(t, server, uploadURI, "bytes 5-10/11", " world")
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("wrong status after expiry\nwant %d\ngot  %d", http.StatusGone, resp.StatusCode)
+	}
+	resp = putResumableChunk(t, server, uploadURI, "bytes */*", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status querying expired upload\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
 func resumableUploadTest(t *testing.T, server *Server, bucketName string, uploadRequestBody *strings.Reader) {
 	server.CreateBucketWithOpts(CreateBucketOpts{Name: bucketName})
 
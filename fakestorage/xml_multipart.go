@@ -0,0 +1,432 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxMultipartPartNumber = 10000
+	defaultMaxParts        = 1000
+	defaultMaxUploads      = 1000
+)
+
+// multipartUpload is an XML API multipart upload in progress. Parts are kept
+// in memory until the upload is completed, at which point they're assembled
+// into the object, or aborted. Uploads that are neither completed nor aborted
+// are discarded once they're older than the upload session expiry.
+type multipartUpload struct {
+	mtx         sync.Mutex
+	bucketName  string
+	objectName  string
+	contentType string
+	metadata    map[string]string
+	initiated   time.Time
+	parts       map[int]multipartPart
+
+	// done is set when the upload is completed or aborted, so parts
+	// uploaded concurrently are rejected instead of being kept around.
+	done bool
+}
+
+type multipartPart struct {
+	content      []byte
+	etag         string
+	lastModified time.Time
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type listPartsResult struct {
+	XMLName              xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string       `xml:"Bucket"`
+	Key                  string       `xml:"Key"`
+	UploadID             string       `xml:"UploadId"`
+	PartNumberMarker     int          `xml:"PartNumberMarker"`
+	NextPartNumberMarker int          `xml:"NextPartNumberMarker"`
+	MaxParts             int          `xml:"MaxParts"`
+	IsTruncated          bool         `xml:"IsTruncated"`
+	Parts                []listedPart `xml:"Part"`
+}
+
+type listedPart struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+type listMultipartUploadsResult struct {
+	XMLName            xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+	Bucket             string         `xml:"Bucket"`
+	KeyMarker          string         `xml:"KeyMarker"`
+	UploadIDMarker     string         `xml:"UploadIdMarker"`
+	NextKeyMarker      string         `xml:"NextKeyMarker"`
+	NextUploadIDMarker string         `xml:"NextUploadIdMarker"`
+	Prefix             string         `xml:"Prefix"`
+	MaxUploads         int            `xml:"MaxUploads"`
+	IsTruncated        bool           `xml:"IsTruncated"`
+	Uploads            []listedUpload `xml:"Upload"`
+}
+
+type listedUpload struct {
+	Key       string `xml:"Key"`
+	UploadID  string `xml:"UploadId"`
+	Initiated string `xml:"Initiated"`
+}
+
+func (s *Server) removeExpiredMultipartUploads() {
+	expiry := s.uploadSessionExpiry()
+	s.multipartUploads.Range(func(key, value interface{}) bool {
+		if time.Since(value.(*multipartUpload).initiated) > expiry {
+			s.discardMultipartUpload(key.(string))
+		}
+		return true
+	})
+}
+
+// discardMultipartUpload removes the upload and releases its parts.
+func (s *Server) discardMultipartUpload(uploadID string) {
+	rawUpload, ok := s.multipartUploads.LoadAndDelete(uploadID)
+	if !ok {
+		return
+	}
+	upload := rawUpload.(*multipartUpload)
+	upload.mtx.Lock()
+	upload.done = true
+	upload.parts = nil
+	upload.mtx.Unlock()
+}
+
+// loadMultipartUpload returns the multipart upload referenced by the uploadId
+// parameter of the request, making sure it targets the object in the URL.
+func (s *Server) loadMultipartUpload(r *http.Request) (string, *multipartUpload, *xmlResponse) {
+	vars := mux.Vars(r)
+	uploadID := r.URL.Query().Get("uploadId")
+	rawUpload, ok := s.multipartUploads.Load(uploadID)
+	if ok {
+		upload := rawUpload.(*multipartUpload)
+		if time.Since(upload.initiated) > s.uploadSessionExpiry() {
+			s.discardMultipartUpload(uploadID)
+		} else if upload.bucketName == vars["bucketName"] && upload.objectName == vars["objectName"] {
+			return uploadID, upload, nil
+		}
+	}
+	return "", nil, &xmlResponse{status: http.StatusNotFound, errorMessage: fmt.Sprintf("No such upload: %s", uploadID)}
+}
+
+func (s *Server) initiateMultipartUpload(r *http.Request) xmlResponse {
+	vars := mux.Vars(r)
+	bucketName := vars["bucketName"]
+	objectName := vars["objectName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return xmlResponse{status: http.StatusNotFound, errorCode: "NoSuchBucket", errorMessage: fmt.Sprintf("No such bucket: %s", bucketName)}
+	}
+	s.removeExpiredMultipartUploads()
+
+	metadata := make(map[string]string)
+	for key := range r.Header {
+		lowerKey := strings.ToLower(key)
+		if metadataKey := strings.TrimPrefix(lowerKey, "x-goog-meta-"); metadataKey != lowerKey {
+			metadata[metadataKey] = r.Header.Get(key)
+		}
+	}
+
+	uploadID, err := generateUploadID()
+	if err != nil {
+		return xmlResponse{errorMessage: err.Error()}
+	}
+	s.multipartUploads.Store(uploadID, &multipartUpload{
+		bucketName:  bucketName,
+		objectName:  objectName,
+		contentType: r.Header.Get(contentTypeHeader),
+		metadata:    metadata,
+		initiated:   time.Now(),
+		parts:       make(map[int]multipartPart),
+	})
+	return xmlResponse{
+		data: initiateMultipartUploadResult{
+			Bucket:   bucketName,
+			Key:      objectName,
+			UploadID: uploadID,
+		},
+	}
+}
+
+func (s *Server) uploadPart(r *http.Request) xmlResponse {
+	defer r.Body.Close()
+	_, upload, errResp := s.loadMultipartUpload(r)
+	if errResp != nil {
+		return *errResp
+	}
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxMultipartPartNumber {
+		return xmlResponse{
+			status:       http.StatusBadRequest,
+			errorMessage: fmt.Sprintf("Part number must be an integer between 1 and %d.", maxMultipartPartNumber),
+		}
+	}
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		return xmlResponse{errorMessage: err.Error()}
+	}
+	if err := mediaChecksums(r.Header).verify(content); err != nil {
+		return xmlResponse{status: http.StatusBadRequest, errorCode: "BadDigest", errorMessage: err.Error()}
+	}
+	hash := md5.Sum(content)
+	etag := fmt.Sprintf("%q", hex.EncodeToString(hash[:]))
+
+	upload.mtx.Lock()
+	defer upload.mtx.Unlock()
+	if upload.done {
+		return xmlResponse{status: http.StatusNotFound, errorMessage: fmt.Sprintf("No such upload: %s", r.URL.Query().Get("uploadId"))}
+	}
+	upload.parts[partNumber] = multipartPart{content: content, etag: etag, lastModified: time.Now()}
+
+	header := make(http.Header)
+	header.Set("ETag", etag)
+	return xmlResponse{header: header}
+}
+
+// completeMultipartUpload assembles the parts listed in the request into the
+// object. As in Cloud Storage, parts must be listed in ascending order, and
+// parts that were uploaded but not listed are discarded. Unlike Cloud
+// Storage, there's no minimum size for the parts.
+func (s *Server) completeMultipartUpload(r *http.Request) xmlResponse {
+	defer r.Body.Close()
+	uploadID, upload, errResp := s.loadMultipartUpload(r)
+	if errResp != nil {
+		return *errResp
+	}
+	var request completeMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		return xmlResponse{status: http.StatusBadRequest, errorMessage: "The XML you provided was not well-formed."}
+	}
+	if len(request.Parts) == 0 {
+		return xmlResponse{status: http.StatusBadRequest, errorMessage: "You must specify at least one part."}
+	}
+
+	upload.mtx.Lock()
+	defer upload.mtx.Unlock()
+	if upload.done {
+		return xmlResponse{status: http.StatusNotFound, errorMessage: fmt.Sprintf("No such upload: %s", uploadID)}
+	}
+	var content []byte
+	for i, requestedPart := range request.Parts {
+		if i > 0 && requestedPart.PartNumber <= request.Parts[i-1].PartNumber {
+			return xmlResponse{status: http.StatusBadRequest, errorMessage: "The list of parts was not in ascending order."}
+		}
+		part, ok := upload.parts[requestedPart.PartNumber]
+		if !ok || strings.Trim(requestedPart.ETag, `"`) != strings.Trim(part.etag, `"`) {
+			return xmlResponse{
+				status:       http.StatusBadRequest,
+				errorMessage: fmt.Sprintf("Part %d could not be found or its ETag doesn't match.", requestedPart.PartNumber),
+			}
+		}
+		content = append(content, part.content...)
+	}
+
+	md5Hash := checksum.EncodedMd5Hash(content)
+	obj, err := s.createObject(Object{
+		ObjectAttrs: ObjectAttrs{
+			BucketName:  upload.bucketName,
+			Name:        upload.objectName,
+			ContentType: upload.contentType,
+			Crc32c:      checksum.EncodedCrc32cChecksum(content),
+			Md5Hash:     md5Hash,
+			Etag:        fmt.Sprintf("%q", md5Hash),
+			Metadata:    upload.metadata,
+		},
+		Content: content,
+	})
+	if err != nil {
+		resp := errToJsonResponse(err)
+		return xmlResponse{status: resp.status, errorMessage: resp.errorMessage}
+	}
+	upload.done = true
+	upload.parts = nil
+	s.multipartUploads.Delete(uploadID)
+	header := make(http.Header)
+	setGenerationHeaders(header, obj.ObjectAttrs)
+	return xmlResponse{
+		header: header,
+		data: completeMultipartUploadResult{
+			Location: fmt.Sprintf("%s/%s/%s", s.baseURL(r), obj.BucketName, obj.Name),
+			Bucket:   obj.BucketName,
+			Key:      obj.Name,
+			ETag:     obj.Etag,
+		},
+	}
+}
+
+func (s *Server) abortMultipartUpload(r *http.Request) xmlResponse {
+	uploadID, _, errResp := s.loadMultipartUpload(r)
+	if errResp != nil {
+		return *errResp
+	}
+	s.discardMultipartUpload(uploadID)
+	return xmlResponse{status: http.StatusNoContent}
+}
+
+func (s *Server) listParts(r *http.Request) xmlResponse {
+	uploadID, upload, errResp := s.loadMultipartUpload(r)
+	if errResp != nil {
+		return *errResp
+	}
+	maxParts := defaultMaxParts
+	if value := r.URL.Query().Get("max-parts"); value != "" {
+		var err error
+		if maxParts, err = strconv.Atoi(value); err != nil || maxParts < 0 {
+			return xmlResponse{status: http.StatusBadRequest, errorMessage: "Invalid max-parts."}
+		}
+	}
+	var marker int
+	if value := r.URL.Query().Get("part-number-marker"); value != "" {
+		var err error
+		if marker, err = strconv.Atoi(value); err != nil {
+			return xmlResponse{status: http.StatusBadRequest, errorMessage: "Invalid part-number-marker."}
+		}
+	}
+
+	upload.mtx.Lock()
+	defer upload.mtx.Unlock()
+	if upload.done {
+		return xmlResponse{status: http.StatusNotFound, errorMessage: fmt.Sprintf("No such upload: %s", uploadID)}
+	}
+	partNumbers := make([]int, 0, len(upload.parts))
+	for partNumber := range upload.parts {
+		if partNumber > marker {
+			partNumbers = append(partNumbers, partNumber)
+		}
+	}
+	sort.Ints(partNumbers)
+
+	result := listPartsResult{
+		Bucket:           upload.bucketName,
+		Key:              upload.objectName,
+		UploadID:         uploadID,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	if len(partNumbers) > maxParts {
+		partNumbers = partNumbers[:maxParts]
+		result.IsTruncated = true
+	}
+	for _, partNumber := range partNumbers {
+		part := upload.parts[partNumber]
+		result.Parts = append(result.Parts, listedPart{
+			PartNumber:   partNumber,
+			LastModified: part.lastModified.UTC().Format(time.RFC3339Nano),
+			ETag:         part.etag,
+			Size:         len(part.content),
+		})
+		result.NextPartNumberMarker = partNumber
+	}
+	return xmlResponse{data: result}
+}
+
+// listMultipartUploads lists the multipart uploads in progress in the
+// bucket, sorted by object name and upload ID. Unlike Cloud Storage, the
+// delimiter parameter isn't supported.
+func (s *Server) listMultipartUploads(r *http.Request) xmlResponse {
+	bucketName := mux.Vars(r)["bucketName"]
+	if _, err := s.backend.GetBucket(bucketName); err != nil {
+		return xmlResponse{status: http.StatusNotFound, errorCode: "NoSuchBucket", errorMessage: fmt.Sprintf("No such bucket: %s", bucketName)}
+	}
+	query := r.URL.Query()
+	maxUploads := defaultMaxUploads
+	if value := query.Get("max-uploads"); value != "" {
+		var err error
+		if maxUploads, err = strconv.Atoi(value); err != nil || maxUploads < 0 {
+			return xmlResponse{status: http.StatusBadRequest, errorMessage: "Invalid max-uploads."}
+		}
+	}
+	prefix := query.Get("prefix")
+	keyMarker := query.Get("key-marker")
+	uploadIDMarker := query.Get("upload-id-marker")
+
+	s.removeExpiredMultipartUploads()
+	var uploads []listedUpload
+	s.multipartUploads.Range(func(key, value interface{}) bool {
+		uploadID := key.(string)
+		upload := value.(*multipartUpload)
+		if upload.bucketName != bucketName || !strings.HasPrefix(upload.objectName, prefix) {
+			return true
+		}
+		// without an upload ID marker, the uploads of the key marker itself
+		// are skipped too.
+		if upload.objectName < keyMarker || (upload.objectName == keyMarker && (uploadIDMarker == "" || uploadID <= uploadIDMarker)) {
+			return true
+		}
+		uploads = append(uploads, listedUpload{
+			Key:       upload.objectName,
+			UploadID:  uploadID,
+			Initiated: upload.initiated.UTC().Format(time.RFC3339Nano),
+		})
+		return true
+	})
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].UploadID < uploads[j].UploadID
+	})
+
+	result := listMultipartUploadsResult{
+		Bucket:         bucketName,
+		KeyMarker:      keyMarker,
+		UploadIDMarker: uploadIDMarker,
+		Prefix:         prefix,
+		MaxUploads:     maxUploads,
+	}
+	if len(uploads) > maxUploads {
+		uploads = uploads[:maxUploads]
+		result.IsTruncated = true
+	}
+	if len(uploads) > 0 {
+		last := uploads[len(uploads)-1]
+		result.NextKeyMarker = last.Key
+		result.NextUploadIDMarker = last.UploadID
+	}
+	result.Uploads = uploads
+	return xmlResponse{data: result}
+}
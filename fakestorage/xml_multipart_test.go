@@ -0,0 +1,249 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doXMLMultipartRequest(t *testing.T, client *http.Client, method, url, body string, result interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Goog-Meta-Tool", "distcp")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if result != nil && resp.StatusCode == http.StatusOK {
+		if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		io.Copy(io.Discard, resp.Body)
+	}
+	return resp
+}
+
+func TestXMLMultipartUpload(t *testing.T) {
+	const objectURL = "https://storage.googleapis.com/some-bucket/multipart/object.txt"
+	runServersTest(t, runServersOptions{}, func(t *testing.T, server *Server) {
+		server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+		client := server.HTTPClient()
+
+		var initiated initiateMultipartUploadResult
+		resp := doXMLMultipartRequest(t, client, http.MethodPost, objectURL+"?uploads", "", &initiated)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status initiating upload\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+		}
+		if initiated.UploadID == "" || initiated.Bucket != "some-bucket" || initiated.Key != "multipart/object.txt" {
+			t.Fatalf("unexpected initiate result: %+v", initiated)
+		}
+
+		parts := []string{"first part, ", "second part, ", "ignored part, ", "third part"}
+		etags := make([]string, len(parts))
+		for i, part := range parts {
+			url := fmt.Sprintf("%s?partNumber=%d&uploadId=%s", objectURL, i+1, initiated.UploadID)
+			resp := doXMLMultipartRequest(t, client, http.MethodPut, url, part, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("wrong status uploading part %d\nwant %d\ngot  %d", i+1, http.StatusOK, resp.StatusCode)
+			}
+			etags[i] = resp.Header.Get("ETag")
+		}
+
+		var listed listPartsResult
+		resp = doXMLMultipartRequest(t, client, http.MethodGet, objectURL+"?max-parts=3&uploadId="+initiated.UploadID, "", &listed)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status listing parts\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+		}
+		if len(listed.Parts) != 3 || !listed.IsTruncated || listed.NextPartNumberMarker != 3 {
+			t.Errorf("unexpected list parts result: %+v", listed)
+		}
+		if len(listed.Parts) > 1 && (listed.Parts[1].ETag != etags[1] || listed.Parts[1].Size != len(parts[1])) {
+			t.Errorf("wrong listed part\nwant etag %s size %d\ngot  %+v", etags[1], len(parts[1]), listed.Parts[1])
+		}
+
+		outOfOrder := fmt.Sprintf(
+			"<CompleteMultipartUpload><Part><PartNumber>2</PartNumber><ETag>%s</ETag></Part><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>",
+			etags[1], etags[0],
+		)
+		resp = doXMLMultipartRequest(t, client, http.MethodPost, objectURL+"?uploadId="+initiated.UploadID, outOfOrder, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("wrong status completing with parts out of order\nwant %d\ngot  %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		complete := fmt.Sprintf(
+			"<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part><Part><PartNumber>2</PartNumber><ETag>%s</ETag></Part><Part><PartNumber>4</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>",
+			etags[0], etags[1], etags[3],
+		)
+		var completed completeMultipartUploadResult
+		resp = doXMLMultipartRequest(t, client, http.MethodPost, objectURL+"?uploadId="+initiated.UploadID, complete, &completed)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("wrong status completing upload\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+		}
+
+		const expectedContent = "first part, second part, third part"
+		obj, err := server.GetObject("some-bucket", "multipart/object.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(obj.Content) != expectedContent {
+			t.Errorf("wrong content\nwant %q\ngot  %q", expectedContent, string(obj.Content))
+		}
+		if obj.ContentType != "text/plain" {
+			t.Errorf("wrong content type\nwant %q\ngot  %q", "text/plain", obj.ContentType)
+		}
+		if obj.Metadata["tool"] != "distcp" {
+			t.Errorf("wrong metadata\nwant %q\ngot  %q", "distcp", obj.Metadata["tool"])
+		}
+		if completed.ETag != obj.Etag {
+			t.Errorf("wrong etag in the result\nwant %s\ngot  %s", obj.Etag, completed.ETag)
+		}
+		checkChecksum(t, []byte(expectedContent), obj)
+
+		resp = doXMLMultipartRequest(t, client, http.MethodGet, objectURL+"?uploadId="+initiated.UploadID, "", nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("wrong status listing parts of completed upload\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
+
+func TestXMLMultipartUploadAbort(t *testing.T) {
+	const objectURL = "https://storage.googleapis.com/some-bucket/aborted.txt"
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+	client := server.HTTPClient()
+
+	var initiated initiateMultipartUploadResult
+	doXMLMultipartRequest(t, client, http.MethodPost, objectURL+"?uploads", "", &initiated)
+	doXMLMultipartRequest(t, client, http.MethodPut, objectURL+"?partNumber=1&uploadId="+initiated.UploadID, "content", nil)
+
+	resp := doXMLMultipartRequest(t, client, http.MethodDelete, objectURL+"?uploadId="+initiated.UploadID, "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("wrong status aborting upload\nwant %d\ngot  %d", http.StatusNoContent, resp.StatusCode)
+	}
+	resp = doXMLMultipartRequest(t, client, http.MethodPut, objectURL+"?partNumber=2&uploadId="+initiated.UploadID, "content", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status uploading part to aborted upload\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if _, err := server.GetObject("some-bucket", "aborted.txt"); err == nil {
+		t.Error("unexpected <nil> error getting the object of an aborted upload")
+	}
+
+	resp = doXMLMultipartRequest(t, client, http.MethodPost, "https://storage.googleapis.com/missing-bucket/object.txt?uploads", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status initiating upload in missing bucket\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestXMLListMultipartUploads(t *testing.T) {
+	const bucketURL = "https://storage.googleapis.com/some-bucket"
+	server, err := NewServerWithOptions(Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+	client := server.HTTPClient()
+
+	uploadIDs := make(map[string]string)
+	for _, name := range []string{"logs/b.txt", "logs/a.txt", "data/c.txt"} {
+		var initiated initiateMultipartUploadResult
+		doXMLMultipartRequest(t, client, http.MethodPost, bucketURL+"/"+name+"?uploads", "", &initiated)
+		uploadIDs[name] = initiated.UploadID
+	}
+
+	tests := []struct {
+		name              string
+		query             string
+		expectedKeys      []string
+		expectedTruncated bool
+	}{
+		{"all uploads", "", []string{"data/c.txt", "logs/a.txt", "logs/b.txt"}, false},
+		{"prefix", "&prefix=logs/", []string{"logs/a.txt", "logs/b.txt"}, false},
+		{"max uploads", "&max-uploads=2", []string{"data/c.txt", "logs/a.txt"}, true},
+		{"key marker", "&key-marker=logs/a.txt&upload-id-marker=" + uploadIDs["logs/a.txt"], []string{"logs/b.txt"}, false},
+		{"key marker without upload id marker", "&key-marker=logs/a.txt", []string{"logs/b.txt"}, false},
+		{"upload id marker before the upload", "&key-marker=logs/a.txt&upload-id-marker=0", []string{"logs/a.txt", "logs/b.txt"}, false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var listed listMultipartUploadsResult
+			resp := doXMLMultipartRequest(t, client, http.MethodGet, bucketURL+"?uploads"+test.query, "", &listed)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("wrong status\nwant %d\ngot  %d", http.StatusOK, resp.StatusCode)
+			}
+			var keys []string
+			for _, upload := range listed.Uploads {
+				keys = append(keys, upload.Key)
+				if upload.UploadID != uploadIDs[upload.Key] {
+					t.Errorf("wrong upload id for %s\nwant %s\ngot  %s", upload.Key, uploadIDs[upload.Key], upload.UploadID)
+				}
+			}
+			if strings.Join(keys, ",") != strings.Join(test.expectedKeys, ",") {
+				t.Errorf("wrong uploads listed\nwant %v\ngot  %v", test.expectedKeys, keys)
+			}
+			if listed.IsTruncated != test.expectedTruncated {
+				t.Errorf("wrong is truncated\nwant %t\ngot  %t", test.expectedTruncated, listed.IsTruncated)
+			}
+		})
+	}
+
+	doXMLMultipartRequest(t, client, http.MethodDelete, bucketURL+"/logs/a.txt?uploadId="+uploadIDs["logs/a.txt"], "", nil)
+	var listed listMultipartUploadsResult
+	doXMLMultipartRequest(t, client, http.MethodGet, bucketURL+"?uploads&prefix=logs/", "", &listed)
+	if len(listed.Uploads) != 1 || listed.Uploads[0].Key != "logs/b.txt" {
+		t.Errorf("unexpected uploads after abort: %+v", listed.Uploads)
+	}
+
+	resp := doXMLMultipartRequest(t, client, http.MethodGet, "https://storage.googleapis.com/missing-bucket?uploads", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status listing uploads in missing bucket\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestXMLMultipartUploadExpiry(t *testing.T) {
+	const objectURL = "https://storage.googleapis.com/some-bucket/expired.txt"
+	server, err := NewServerWithOptions(Options{
+		NoListener:          true,
+		UploadSessionExpiry: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.CreateBucketWithOpts(CreateBucketOpts{Name: "some-bucket"})
+	client := server.HTTPClient()
+
+	var initiated initiateMultipartUploadResult
+	doXMLMultipartRequest(t, client, http.MethodPost, objectURL+"?uploads", "", &initiated)
+	doXMLMultipartRequest(t, client, http.MethodPut, objectURL+"?partNumber=1&uploadId="+initiated.UploadID, "content", nil)
+
+	time.Sleep(100 * time.Millisecond)
+	var listed listMultipartUploadsResult
+	doXMLMultipartRequest(t, client, http.MethodGet, "https://storage.googleapis.com/some-bucket?uploads", "", &listed)
+	if len(listed.Uploads) != 0 {
+		t.Errorf("unexpected expired uploads listed: %+v", listed.Uploads)
+	}
+	resp := doXMLMultipartRequest(t, client, http.MethodGet, objectURL+"?uploadId="+initiated.UploadID, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status listing parts of expired upload\nwant %d\ngot  %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
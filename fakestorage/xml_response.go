@@ -10,6 +10,9 @@ type xmlResponse struct {
 	header       http.Header
 	data         interface{}
 	errorMessage string
+	// errorCode identifies errors that can't be identified by the status
+	// alone, such as "InvalidPolicyDocument".
+	errorCode string
 }
 
 type xmlHandler = func(r *http.Request) xmlResponse
@@ -25,18 +28,105 @@ func xmlToHTTPHandler(h xmlHandler) http.HandlerFunc {
 		}
 
 		status := resp.getStatus()
-		var data interface{}
 		if status > 399 {
-			data = newErrorResponse(status, resp.getErrorMessage(status), nil)
-		} else {
-			data = resp.data
+			writeXMLErrorWithCode(w, status, resp.errorCode, resp.errorMessage)
+			return
 		}
 
 		w.WriteHeader(status)
-		xml.NewEncoder(w).Encode(data)
+		xml.NewEncoder(w).Encode(resp.data)
 	}
 }
 
+// jsonToXMLAPIHandler serves handlers shared with the JSON API on XML API
+// routes: successful responses are unchanged, but errors are reported using
+// the XML error document.
+func jsonToXMLAPIHandler(h jsonHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := h(r)
+		if status := resp.getStatus(); status > 399 {
+			for name, values := range resp.header {
+				for _, value := range values {
+					w.Header().Add(name, value)
+				}
+			}
+			code := resp.xmlErrorCode
+			if code == "" {
+				code = resp.errorReason
+			}
+			writeXMLErrorWithCode(w, status, code, resp.errorMessage)
+			return
+		}
+		jsonToHTTPHandler(func(*http.Request) jsonResponse { return resp })(w, r)
+	}
+}
+
+type xmlErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+	Details string   `xml:"Details,omitempty"`
+}
+
+type xmlError struct {
+	code    string
+	message string
+}
+
+var xmlErrors = map[int]xmlError{
+	http.StatusBadRequest:                   {"InvalidArgument", "Invalid argument."},
+	http.StatusForbidden:                    {"AccessDenied", "Access denied."},
+	http.StatusNotFound:                     {"NoSuchKey", "The specified key does not exist."},
+	http.StatusConflict:                     {"Conflict", "The request conflicts with the current state of the resource."},
+	http.StatusPreconditionFailed:           {"PreconditionFailed", "At least one of the pre-conditions you specified did not hold."},
+	http.StatusRequestedRangeNotSatisfiable: {"InvalidRange", "The requested range cannot be satisfied."},
+}
+
+// xmlErrorsByCode are the errors that can't be identified by the status
+// alone. Handlers shared with the JSON API report them through the reason of
+// the response, and XML handlers through its error code.
+var xmlErrorsByCode = map[string]xmlError{
+	"BadDigest":             {"BadDigest", "The checksum you specified did not match what we received."},
+	"EntityTooLarge":        {"EntityTooLarge", "Your proposed upload is larger than the maximum object size specified in your Policy Document."},
+	"EntityTooSmall":        {"EntityTooSmall", "Your proposed upload is smaller than the minimum object size specified in your Policy Document."},
+	"ExpiredToken":          {"ExpiredToken", "The provided token has expired."},
+	"InvalidPolicyDocument": {"InvalidPolicyDocument", "The content of the form does not meet the conditions specified in the policy document."},
+	"NoSuchBucket":          {"NoSuchBucket", "The specified bucket does not exist."},
+	"UserProjectMissing":    {"UserProjectMissing", requesterPaysMessage},
+	"SignatureDoesNotMatch": {"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your Google secret key and signing method."},
+}
+
+func newXMLErrorResponse(status int, code string, details string) xmlErrorResponse {
+	e, ok := xmlErrorsByCode[code]
+	if !ok {
+		e, ok = xmlErrors[status]
+	}
+	if !ok {
+		e = xmlError{"InternalError", "We encountered an internal error. Please try again."}
+		if status < http.StatusInternalServerError {
+			e = xmlError{"InvalidRequest", http.StatusText(status) + "."}
+		}
+	}
+	if details == e.message {
+		details = ""
+	}
+	return xmlErrorResponse{Code: e.code, Message: e.message, Details: details}
+}
+
+func writeXMLError(w http.ResponseWriter, status int, details string) {
+	writeXMLErrorWithCode(w, status, "", details)
+}
+
+// writeXMLErrorWithCode writes the error identified by the given code, such as
+// "ExpiredToken", falling back to the error for the status when there's no
+// such code.
+func writeXMLErrorWithCode(w http.ResponseWriter, status int, code string, details string) {
+	w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(newXMLErrorResponse(status, code, details))
+}
+
 func (r *xmlResponse) getStatus() int {
 	if r.status > 0 {
 		return r.status
@@ -6,12 +6,20 @@ package backend
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
 )
 
 func tempDir() string {
@@ -27,14 +35,38 @@ func makeStorageBackends(t *testing.T) (map[string]Storage, func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	storageFS, err := NewStorageFS(nil, tempDir)
+	storageFS, err := NewStorageFS(nil, filepath.Join(tempDir, "fs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageBolt, err := NewStorageBolt(nil, filepath.Join(tempDir, "bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageBoltDedup, err := NewStorageBoltWithOptions(nil, filepath.Join(tempDir, "bolt-dedup"), BoltOptions{DeduplicateContent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Server := httptest.NewServer(&fakeS3{t: t, objects: map[string][]byte{}})
+	storageS3, err := NewStorageS3(nil, S3Config{
+		Endpoint:        s3Server.URL,
+		Bucket:          "some-s3-bucket",
+		AccessKeyID:     "access-key",
+		SecretAccessKey: "secret-key",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 	return map[string]Storage{
 			"memory":     NewStorageMemory(nil),
 			"filesystem": storageFS,
+			"bolt":       storageBolt,
+			"bolt-dedup": storageBoltDedup,
+			"s3":         storageS3,
 		}, func() {
+			s3Server.Close()
+			storageBolt.(io.Closer).Close()
+			storageBoltDedup.(io.Closer).Close()
 			err := os.RemoveAll(tempDir)
 			if err != nil {
 				t.Fatal(err)
@@ -53,6 +85,16 @@ func testForStorageBackends(t *testing.T, test func(t *testing.T, storage Storag
 	}
 }
 
+// supportsVersioning reports whether the backend keeps the noncurrent
+// versions of objects, which the fs and s3 backends don't.
+func supportsVersioning(storage Storage) bool {
+	switch storage.(type) {
+	case *storageFS, *storageS3:
+		return false
+	}
+	return true
+}
+
 func noError(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -68,35 +110,20 @@ func shouldError(t *testing.T, err error) {
 }
 
 func uploadAndCompare(t *testing.T, storage Storage, obj Object) int64 {
-	isFSStorage := reflect.TypeOf(storage) == reflect.TypeOf(&storageFS{})
 	_, err := storage.CreateObject(obj)
-	if isFSStorage && obj.Generation != 0 {
-		t.Log("FS should not support objects generation")
-		shouldError(t, err)
-		obj.Generation = 0
-		_, err = storage.CreateObject(obj)
-	}
 	noError(t, err)
 	activeObj, err := storage.GetObject(obj.BucketName, obj.Name)
 	noError(t, err)
-	if isFSStorage && activeObj.Generation != 0 {
-		t.Errorf("FS should leave generation empty, as it does not persist it. Value: %d", activeObj.Generation)
-	}
-	if !isFSStorage && activeObj.Generation == 0 {
+	if activeObj.Generation == 0 {
 		t.Errorf("generation is empty, but we expect a unique int")
 	}
 	if err := compareObjects(activeObj, obj); err != nil {
 		t.Errorf("object retrieved differs from the created one. Descr: %v", err)
 	}
 	objFromGeneration, err := storage.GetObjectWithGeneration(obj.BucketName, obj.Name, activeObj.Generation)
-	if isFSStorage {
-		t.Log("FS should not implement fetch with generation")
-		shouldError(t, err)
-	} else {
-		noError(t, err)
-		if err := compareObjects(objFromGeneration, obj); err != nil {
-			t.Errorf("object retrieved differs from the created one. Descr: %v", err)
-		}
+	noError(t, err)
+	if err := compareObjects(objFromGeneration, obj); err != nil {
+		t.Errorf("object retrieved differs from the created one. Descr: %v", err)
 	}
 	return activeObj.Generation
 }
@@ -117,9 +144,9 @@ func TestObjectCRUD(t *testing.T) {
 			// Delete in non-existent case
 			err = storage.DeleteObject(bucketName, objectName)
 			shouldError(t, err)
-			err = storage.CreateBucket(bucketName, versioningEnabled)
-			if reflect.TypeOf(storage) == reflect.TypeOf(&storageFS{}) && versioningEnabled {
-				t.Log("FS storage type should not implement versioning")
+			err = storage.CreateBucket(bucketName, BucketAttrs{VersioningEnabled: versioningEnabled})
+			if !supportsVersioning(storage) && versioningEnabled {
+				t.Log("the storage type should not implement versioning")
 				shouldError(t, err)
 				return
 			}
@@ -201,9 +228,9 @@ func TestObjectQueryErrors(t *testing.T) {
 		versioningEnabled := versioningEnabled
 		testForStorageBackends(t, func(t *testing.T, storage Storage) {
 			const bucketName = "random-bucket"
-			err := storage.CreateBucket(bucketName, versioningEnabled)
-			if reflect.TypeOf(storage) == reflect.TypeOf(&storageFS{}) && versioningEnabled {
-				t.Log("FS storage type should not implement versioning")
+			err := storage.CreateBucket(bucketName, BucketAttrs{VersioningEnabled: versioningEnabled})
+			if !supportsVersioning(storage) && versioningEnabled {
+				t.Log("the storage type should not implement versioning")
 				shouldError(t, err)
 				return
 			}
@@ -232,8 +259,10 @@ func TestBucketCreateGetListDelete(t *testing.T) {
 			t.Fatalf("more than zero buckets found: %d, and expecting zero when starting the test", len(buckets))
 		}
 		bucketsToTest := []Bucket{
-			{"prod-bucket", false, time.Time{}},
-			{"prod-bucket-with-versioning", true, time.Time{}},
+			{Name: "prod-bucket"},
+			{Name: "prod-bucket-with-versioning", VersioningEnabled: true},
+			{Name: "prod-bucket-with-storage-class", DefaultStorageClass: "NEARLINE"},
+			{Name: "prod-bucket-with-project", ProjectID: "my-project"},
 		}
 		for _, bucket := range bucketsToTest {
 			_, err := storage.GetBucket(bucket.Name)
@@ -244,11 +273,11 @@ func TestBucketCreateGetListDelete(t *testing.T) {
 			// Use a large +/- 5 second window to allow for an imperfectly synchronized
 			// clock generating the filesystem timestamp and to reduce test flakes.
 			timeBeforeCreation := time.Now().Add(-5 * time.Second)
-			err = storage.CreateBucket(bucket.Name, bucket.VersioningEnabled)
+			err = storage.CreateBucket(bucket.Name, BucketAttrs{VersioningEnabled: bucket.VersioningEnabled, DefaultStorageClass: bucket.DefaultStorageClass, ProjectID: bucket.ProjectID})
 			timeAfterCreation := time.Now().Add(5 * time.Second)
-			if reflect.TypeOf(storage) == reflect.TypeOf(&storageFS{}) && bucket.VersioningEnabled {
+			if !supportsVersioning(storage) && bucket.VersioningEnabled {
 				if err == nil {
-					t.Fatal("fs storage should not accept creating buckets with versioning, but it's not failing")
+					t.Fatal("the storage should not accept creating buckets with versioning, but it's not failing")
 				}
 				continue
 			}
@@ -284,24 +313,316 @@ func TestBucketCreateGetListDelete(t *testing.T) {
 func isBucketEquivalentTo(a, b Bucket, earliest, latest time.Time) bool {
 	return a.Name == b.Name &&
 		a.VersioningEnabled == b.VersioningEnabled &&
+		a.DefaultStorageClass == b.DefaultStorageClass &&
+		a.ProjectID == b.ProjectID &&
 		a.TimeCreated.After(earliest) && a.TimeCreated.Before(latest)
 }
 
 func TestBucketDuplication(t *testing.T) {
 	const bucketName = "prod-bucket"
 	testForStorageBackends(t, func(t *testing.T, storage Storage) {
-		err := storage.CreateBucket(bucketName, false)
+		err := storage.CreateBucket(bucketName, BucketAttrs{})
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		err = storage.CreateBucket(bucketName, true)
+		err = storage.CreateBucket(bucketName, BucketAttrs{VersioningEnabled: true})
 		if err == nil {
 			t.Fatal("we were expecting a bucket duplication error")
 		}
 	})
 }
 
+func TestBucketUpdate(t *testing.T) {
+	const bucketName = "prod-bucket"
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		err := storage.UpdateBucket(bucketName, BucketAttrs{})
+		if err != BucketNotFound {
+			t.Errorf("wrong error updating a bucket that doesn't exist\nwant %v\ngot  %v", BucketNotFound, err)
+		}
+		err = storage.CreateBucket(bucketName, BucketAttrs{ProjectID: "my-project"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs := BucketAttrs{
+			ProjectID: "my-project",
+			CORS: []CORS{
+				{Origin: []string{"https://example.com"}, Method: []string{"GET", "PUT"}, ResponseHeader: []string{"Content-Type"}, MaxAgeSeconds: 3600},
+			},
+			RetentionPolicy: &RetentionPolicy{
+				RetentionPeriod: time.Hour,
+				EffectiveTime:   time.Date(2022, time.March, 1, 10, 0, 0, 0, time.UTC),
+			},
+			SoftDeletePolicy: &SoftDeletePolicy{
+				RetentionDuration: 7 * 24 * time.Hour,
+				EffectiveTime:     time.Date(2022, time.March, 1, 10, 0, 0, 0, time.UTC),
+			},
+			Labels:         map[string]string{"env": "prod"},
+			RequesterPays:  true,
+			Metageneration: 2,
+		}
+		err = storage.UpdateBucket(bucketName, attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket, err := storage.GetBucket(bucketName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(bucket.Attrs(), attrs) {
+			t.Errorf("wrong bucket attributes after update\nwant %+v\ngot  %+v", attrs, bucket.Attrs())
+		}
+		err = storage.CreateBucket(bucketName, attrs)
+		if err != nil {
+			t.Errorf("unexpected error creating a bucket with the same properties: %v", err)
+		}
+	})
+}
+
+func TestObjectGenerationOperations(t *testing.T) {
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		const bucketName = "some-bucket"
+		versioning := supportsVersioning(storage)
+		err := storage.CreateBucket(bucketName, BucketAttrs{VersioningEnabled: versioning})
+		noError(t, err)
+		obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "object.txt"}, Content: []byte("content")}
+		first, err := storage.CreateObject(obj)
+		noError(t, err)
+		live := first
+		if versioning {
+			live, err = storage.CreateObject(obj)
+			noError(t, err)
+		}
+
+		err = storage.SetObjectStorageClass(bucketName, "object.txt", live.Generation, "COLDLINE")
+		noError(t, err)
+		got, err := storage.GetObject(bucketName, "object.txt")
+		noError(t, err)
+		if got.StorageClass != "COLDLINE" {
+			t.Errorf("wrong storage class\nwant %q\ngot  %q", "COLDLINE", got.StorageClass)
+		}
+		err = storage.SetObjectStorageClass(bucketName, "object.txt", live.Generation+1, "ARCHIVE")
+		shouldError(t, err)
+		attrs := got.ObjectAttrs
+		attrs.CustomTime = "2022-05-01T10:00:00Z"
+		attrs.Metadata = map[string]string{"key": "value"}
+		attrs.Metageneration = 2
+		err = storage.UpdateObjectAttrs(bucketName, "object.txt", live.Generation, attrs)
+		noError(t, err)
+		got, err = storage.GetObject(bucketName, "object.txt")
+		noError(t, err)
+		if !reflect.DeepEqual(got.ObjectAttrs, attrs) {
+			t.Errorf("wrong attributes after update\nwant %+v\ngot  %+v", attrs, got.ObjectAttrs)
+		}
+		if string(got.Content) != "content" {
+			t.Errorf("wrong content after updating the attributes: %q", got.Content)
+		}
+		err = storage.UpdateObjectAttrs(bucketName, "object.txt", live.Generation+1, attrs)
+		shouldError(t, err)
+		err = storage.DeleteObjectGeneration(bucketName, "object.txt", live.Generation+1)
+		shouldError(t, err)
+
+		if versioning {
+			err = storage.DeleteObjectGeneration(bucketName, "object.txt", first.Generation)
+			noError(t, err)
+			objs, err := storage.ListObjects(bucketName, "", true)
+			noError(t, err)
+			if len(objs) != 1 || objs[0].Generation != live.Generation {
+				t.Errorf("wrong objects after deleting the noncurrent version: %+v", objs)
+			}
+		}
+		err = storage.DeleteObjectGeneration(bucketName, "object.txt", live.Generation)
+		noError(t, err)
+		_, err = storage.GetObject(bucketName, "object.txt")
+		shouldError(t, err)
+	})
+}
+
+func TestObjectDefaultStorageClass(t *testing.T) {
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		err := storage.CreateBucket("nearline-bucket", BucketAttrs{DefaultStorageClass: "NEARLINE"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			obj                  Object
+			expectedStorageClass string
+		}{
+			{
+				Object{ObjectAttrs: ObjectAttrs{BucketName: "nearline-bucket", Name: "inherited"}},
+				"NEARLINE",
+			},
+			{
+				Object{ObjectAttrs: ObjectAttrs{BucketName: "nearline-bucket", Name: "explicit", StorageClass: "COLDLINE"}},
+				"COLDLINE",
+			},
+			{
+				Object{ObjectAttrs: ObjectAttrs{BucketName: "implicit-bucket", Name: "default"}},
+				DefaultStorageClass,
+			},
+		}
+		for _, test := range tests {
+			_, err := storage.CreateObject(test.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj, err := storage.GetObject(test.obj.BucketName, test.obj.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.StorageClass != test.expectedStorageClass {
+				t.Errorf("wrong storage class for %s\nwant %q\ngot  %q", obj.ID(), test.expectedStorageClass, obj.StorageClass)
+			}
+		}
+	})
+}
+
+func TestObjectStream(t *testing.T) {
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		const bucketName = "stream-bucket"
+		content := bytes.Repeat([]byte("0123456789"), 1000)
+		attrs, err := storage.CreateObjectStream(ObjectAttrs{BucketName: bucketName, Name: "object.bin"}, bytes.NewReader(content))
+		noError(t, err)
+		if attrs.Size != int64(len(content)) {
+			t.Errorf("wrong size\nwant %d\ngot  %d", len(content), attrs.Size)
+		}
+		if expected := checksum.EncodedCrc32cChecksum(content); attrs.Crc32c != expected {
+			t.Errorf("wrong crc32c\nwant %q\ngot  %q", expected, attrs.Crc32c)
+		}
+		if expected := checksum.EncodedMd5Hash(content); attrs.Md5Hash != expected {
+			t.Errorf("wrong md5\nwant %q\ngot  %q", expected, attrs.Md5Hash)
+		}
+
+		obj, err := storage.GetObjectStream(bucketName, "object.bin", 0)
+		noError(t, err)
+		defer obj.Content.Close()
+		if obj.Size != int64(len(content)) {
+			t.Errorf("wrong size of the retrieved object\nwant %d\ngot  %d", len(content), obj.Size)
+		}
+		_, err = obj.Content.Seek(9990, io.SeekStart)
+		noError(t, err)
+		tail, err := io.ReadAll(obj.Content)
+		noError(t, err)
+		if string(tail) != "0123456789" {
+			t.Errorf("wrong content after seeking\nwant %q\ngot  %q", "0123456789", tail)
+		}
+
+		objs, err := storage.ListObjects(bucketName, "", false)
+		noError(t, err)
+		if len(objs) != 1 || objs[0].Size != int64(len(content)) {
+			t.Errorf("wrong objects listed: %+v", objs)
+		}
+
+		_, err = storage.GetObjectStream(bucketName, "object.bin", attrs.Generation+1)
+		shouldError(t, err)
+		_, err = storage.GetObjectStream(bucketName, "missing.bin", 0)
+		shouldError(t, err)
+	})
+}
+
+func TestObjectConditions(t *testing.T) {
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		const bucketName = "conditions-bucket"
+		noError(t, storage.CreateBucket(bucketName, BucketAttrs{}))
+		int64Ptr := func(v int64) *int64 { return &v }
+		create := func(conds Conditions) (ObjectAttrs, error) {
+			return storage.CreateObjectIf(ObjectAttrs{BucketName: bucketName, Name: "object.txt"}, strings.NewReader("content"), conds)
+		}
+
+		attrs, err := create(Conditions{GenerationMatch: int64Ptr(0)})
+		noError(t, err)
+		_, err = create(Conditions{GenerationMatch: int64Ptr(0)})
+		if !errors.Is(err, PreconditionFailed) {
+			t.Errorf("wrong error creating an object that already exists\nwant %v\ngot  %v", PreconditionFailed, err)
+		}
+		_, err = create(Conditions{MetagenerationMatch: int64Ptr(attrs.Metageneration + 1)})
+		if !errors.Is(err, PreconditionFailed) {
+			t.Errorf("wrong error creating an object with the wrong metageneration\nwant %v\ngot  %v", PreconditionFailed, err)
+		}
+		var conditionErr *ConditionError
+		if !errors.As(err, &conditionErr) || conditionErr.Condition != "MetagenerationMatch" {
+			t.Errorf("wrong failed condition\nwant MetagenerationMatch\ngot  %v", err)
+		}
+		attrs, err = create(Conditions{GenerationMatch: int64Ptr(attrs.Generation), MetagenerationMatch: int64Ptr(attrs.Metageneration)})
+		noError(t, err)
+
+		update := attrs
+		update.ContentType = "text/plain"
+		update.Metageneration++
+		metageneration := attrs.Metageneration
+		noError(t, storage.UpdateObjectAttrsIf(bucketName, "object.txt", attrs.Generation, update, Conditions{MetagenerationMatch: &metageneration}))
+		// the metageneration changed with the first update.
+		err = storage.UpdateObjectAttrsIf(bucketName, "object.txt", attrs.Generation, update, Conditions{MetagenerationMatch: &metageneration})
+		if !errors.Is(err, PreconditionFailed) {
+			t.Errorf("wrong error updating an object with the wrong metageneration\nwant %v\ngot  %v", PreconditionFailed, err)
+		}
+		obj, err := storage.GetObject(bucketName, "object.txt")
+		noError(t, err)
+		if obj.ContentType != "text/plain" || obj.Metageneration != metageneration+1 {
+			t.Errorf("wrong object after the updates: %+v", obj.ObjectAttrs)
+		}
+	})
+}
+
+func TestObjectGenerationsIncrease(t *testing.T) {
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		noError(t, storage.CreateBucket("some-bucket", BucketAttrs{}))
+		// a generation ahead of the clock, as if the object had been
+		// written within the same microsecond.
+		previous := time.Now().Add(time.Hour).UnixNano() / 1000
+		_, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "object.txt", Generation: previous}, Content: []byte("content")})
+		noError(t, err)
+		for i := 0; i < 20; i++ {
+			obj, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "object.txt"}, Content: []byte("content " + strconv.Itoa(i))})
+			noError(t, err)
+			if obj.Generation <= previous {
+				t.Fatalf("generation didn't increase on overwrite %d\nwant more than %d\ngot  %d", i, previous, obj.Generation)
+			}
+			previous = obj.Generation
+		}
+	})
+}
+
+func TestComposeObjectConditions(t *testing.T) {
+	testForStorageBackends(t, func(t *testing.T, storage Storage) {
+		const bucketName = "compose-bucket"
+		noError(t, storage.CreateBucket(bucketName, BucketAttrs{}))
+		int64Ptr := func(v int64) *int64 { return &v }
+		_, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "source.txt"}, Content: []byte("content")})
+		noError(t, err)
+		compose := func(conds Conditions) (Object, error) {
+			return storage.ComposeObject(bucketName, []string{"source.txt", "source.txt"}, ObjectAttrs{Name: "composed.txt", ContentType: "text/plain"}, conds)
+		}
+
+		composed, err := compose(Conditions{GenerationMatch: int64Ptr(0)})
+		noError(t, err)
+		_, err = compose(Conditions{GenerationMatch: int64Ptr(0)})
+		if !errors.Is(err, PreconditionFailed) {
+			t.Errorf("wrong error composing an object that already exists\nwant %v\ngot  %v", PreconditionFailed, err)
+		}
+		attrs := composed.ObjectAttrs
+		attrs.CacheControl = "no-cache"
+		attrs.CustomerKeySHA256 = "some-key-sha256"
+		attrs.Created = "2020-01-01T00:00:00Z"
+		noError(t, storage.UpdateObjectAttrs(bucketName, "composed.txt", composed.Generation, attrs))
+		recomposed, err := compose(Conditions{GenerationMatch: int64Ptr(composed.Generation)})
+		noError(t, err)
+		if recomposed.Generation <= composed.Generation {
+			t.Errorf("generation didn't increase\nwant more than %d\ngot  %d", composed.Generation, recomposed.Generation)
+		}
+		if recomposed.CacheControl != "" || recomposed.CustomerKeySHA256 != "" {
+			t.Errorf("attributes inherited from the replaced version: %+v", recomposed.ObjectAttrs)
+		}
+		if _, err := time.Parse(timestampFormat, recomposed.Created); err != nil || recomposed.Created == attrs.Created {
+			t.Errorf("wrong creation time of the composed object %q: %v", recomposed.Created, err)
+		}
+		_, err = compose(Conditions{GenerationMatch: int64Ptr(composed.Generation)})
+		if !errors.Is(err, PreconditionFailed) {
+			t.Errorf("wrong error composing over a generation that was replaced\nwant %v\ngot  %v", PreconditionFailed, err)
+		}
+	})
+}
+
 func compareObjects(o1, o2 Object) error {
 	if o1.BucketName != o2.BucketName {
 		return fmt.Errorf("bucket name differs:\nmain %q\narg  %q", o1.BucketName, o2.BucketName)
@@ -0,0 +1,713 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	boltBucketsKey = []byte("buckets")
+	boltObjectsKey = []byte("objects")
+	boltContentKey = []byte("content")
+)
+
+// storageBolt is an implementation of the backend storage that keeps the
+// metadata of buckets and objects, including all their generations, in a
+// Bolt database, and the content of the objects in regular files.
+//
+// The layout is the following:
+//
+// - rootDir
+//
+//	|- metadata.db
+//	|- blobs
+//	| \- bucket1
+//	|   |- object1#1650000000000000
+//	|   \- object1#1650000000000001
+//	\- content
+//	  \- 9f
+//	    \- 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//
+// Bucket and object names are url path escaped, like in the fs backend.
+//
+// In the database, the "buckets" bucket maps the name of each bucket to its
+// attributes, and the "objects" bucket has a nested bucket for each bucket,
+// mapping the object name followed by a zero byte and the generation to the
+// attributes of that generation of the object.
+//
+// With content deduplication, the content of the objects is stored in the
+// content folder instead, in a file named after its SHA-256 hash, and shared
+// by all generations of all objects with the same content. The "content"
+// bucket maps each hash to the number of generations referencing it, and
+// the file is removed when the last one is deleted.
+type storageBolt struct {
+	rootDir string
+	db      *bbolt.DB
+	dedup   bool
+}
+
+// BoltOptions are the options of the Bolt storage backend.
+type BoltOptions struct {
+	// DeduplicateContent stores the content of objects with the same
+	// content, in any bucket, only once. Objects stored without it are
+	// still read from their own files.
+	DeduplicateContent bool
+}
+
+// boltObject is the record of a generation of an object in the database.
+type boltObject struct {
+	Attrs ObjectAttrs
+	Size  int64
+	// Live is false for the noncurrent generations of objects in buckets
+	// with versioning enabled.
+	Live bool
+	// ContentHash is the hash of the content of generations stored with
+	// content deduplication.
+	ContentHash string `json:",omitempty"`
+}
+
+// NewStorageBolt creates an instance of the backend storage that keeps the
+// metadata in a Bolt database in rootDir. The state survives restarts, and
+// the objects in the database are never rescanned from the disk.
+func NewStorageBolt(objects []Object, rootDir string) (Storage, error) {
+	return NewStorageBoltWithOptions(objects, rootDir, BoltOptions{})
+}
+
+// NewStorageBoltWithOptions creates an instance of the Bolt storage backend
+// with the given options.
+func NewStorageBoltWithOptions(objects []Object, rootDir string, options BoltOptions) (Storage, error) {
+	if err := os.MkdirAll(filepath.Join(rootDir, "blobs"), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(filepath.Join(rootDir, "metadata.db"), 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the metadata database in %q: %w", rootDir, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, key := range [][]byte{boltBucketsKey, boltObjectsKey, boltContentKey} {
+			if _, err := tx.CreateBucketIfNotExists(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &storageBolt{rootDir: rootDir, db: db, dedup: options.DeduplicateContent}
+	for _, o := range objects {
+		if _, err := s.CreateObject(o); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Close closes the database, releasing its lock so another instance can
+// open it.
+func (s *storageBolt) Close() error {
+	return s.db.Close()
+}
+
+func boltObjectKey(objectName string, generation int64) []byte {
+	key := make([]byte, len(objectName)+9)
+	copy(key, objectName)
+	binary.BigEndian.PutUint64(key[len(objectName)+1:], uint64(generation))
+	return key
+}
+
+func (s *storageBolt) blobPath(bucketName, objectName string, generation int64) string {
+	return filepath.Join(s.rootDir, "blobs", url.PathEscape(bucketName), url.PathEscape(objectName)+"#"+strconv.FormatInt(generation, 10))
+}
+
+func (s *storageBolt) contentPath(hash string) string {
+	return filepath.Join(s.rootDir, "content", hash[:2], hash)
+}
+
+// recordPath returns the path of the file with the content of the given
+// generation of the object.
+func (s *storageBolt) recordPath(record boltObject) string {
+	if record.ContentHash != "" {
+		return s.contentPath(record.ContentHash)
+	}
+	return s.blobPath(record.Attrs.BucketName, record.Attrs.Name, record.Attrs.Generation)
+}
+
+// storeContent moves the file with the content of a new generation to its
+// final path, returning the content hash to be set in its record when
+// content deduplication is enabled. With deduplication, the file is only
+// moved if no other generation has the same content.
+func (s *storageBolt) storeContent(tx *bbolt.Tx, tmpPath string, attrs ObjectAttrs, hash []byte) (string, error) {
+	if !s.dedup {
+		path := s.blobPath(attrs.BucketName, attrs.Name, attrs.Generation)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return "", err
+		}
+		return "", os.Rename(tmpPath, path)
+	}
+	contentHash := hex.EncodeToString(hash)
+	refs := tx.Bucket(boltContentKey)
+	var count uint64
+	if value := refs.Get([]byte(contentHash)); value != nil {
+		count = binary.BigEndian.Uint64(value)
+	}
+	if count == 0 {
+		path := s.contentPath(contentHash)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return "", err
+		}
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, count+1)
+	return contentHash, refs.Put([]byte(contentHash), value)
+}
+
+// releaseContent drops the reference of a deleted generation to its
+// content, returning whether the file with the content must be removed with
+// removeContent once the transaction is committed.
+func (s *storageBolt) releaseContent(tx *bbolt.Tx, record boltObject) (bool, error) {
+	if record.ContentHash == "" {
+		return true, nil
+	}
+	refs := tx.Bucket(boltContentKey)
+	key := []byte(record.ContentHash)
+	var count uint64
+	if value := refs.Get(key); value != nil {
+		count = binary.BigEndian.Uint64(value)
+	}
+	if count > 1 {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, count-1)
+		return false, refs.Put(key, value)
+	}
+	return true, refs.Delete(key)
+}
+
+// removeContent removes the files with the content released by a committed
+// transaction. Deduplicated content is only removed if no other generation
+// stored the same content since then.
+func (s *storageBolt) removeContent(records []boltObject) error {
+	var hashes []string
+	for _, record := range records {
+		if record.ContentHash != "" {
+			hashes = append(hashes, record.ContentHash)
+			continue
+		}
+		if err := os.Remove(s.recordPath(record)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		refs := tx.Bucket(boltContentKey)
+		for _, hash := range hashes {
+			if refs.Get([]byte(hash)) != nil {
+				continue
+			}
+			if err := os.Remove(s.contentPath(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getBoltBucket(tx *bbolt.Tx, name string) (Bucket, error) {
+	encoded := tx.Bucket(boltBucketsKey).Get([]byte(name))
+	if encoded == nil {
+		return Bucket{}, fmt.Errorf("no bucket named %s", name)
+	}
+	var bucket Bucket
+	err := json.Unmarshal(encoded, &bucket)
+	return bucket, err
+}
+
+func putBoltBucket(tx *bbolt.Tx, bucket Bucket) error {
+	encoded, err := json.Marshal(bucket)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Bucket(boltObjectsKey).CreateBucketIfNotExists([]byte(bucket.Name)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltBucketsKey).Put([]byte(bucket.Name), encoded)
+}
+
+// boltObjects returns the objects of the given bucket in the database, or
+// nil if the bucket doesn't exist.
+func boltObjects(tx *bbolt.Tx, bucketName string) *bbolt.Bucket {
+	return tx.Bucket(boltObjectsKey).Bucket([]byte(bucketName))
+}
+
+func decodeBoltObject(bucketName string, key, value []byte) (boltObject, error) {
+	var record boltObject
+	if err := json.Unmarshal(value, &record); err != nil {
+		return boltObject{}, err
+	}
+	record.Attrs.BucketName = bucketName
+	record.Attrs.Name = string(key[:len(key)-9])
+	record.Attrs.Size = record.Size
+	return record, nil
+}
+
+func putBoltObject(objects *bbolt.Bucket, record boltObject) error {
+	record.Size = record.Attrs.Size
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return objects.Put(boltObjectKey(record.Attrs.Name, record.Attrs.Generation), encoded)
+}
+
+// findBoltObject looks for the given generation of the object, or its live
+// version when generation is zero.
+func findBoltObject(tx *bbolt.Tx, bucketName, objectName string, generation int64) (boltObject, error) {
+	objects := boltObjects(tx, bucketName)
+	if objects == nil {
+		return boltObject{}, fmt.Errorf("no bucket named %s", bucketName)
+	}
+	if generation != 0 {
+		key := boltObjectKey(objectName, generation)
+		value := objects.Get(key)
+		if value == nil {
+			return boltObject{}, errors.New("object not found")
+		}
+		return decodeBoltObject(bucketName, key, value)
+	}
+	prefix := boltObjectKey(objectName, 0)[:len(objectName)+1]
+	c := objects.Cursor()
+	for key, value := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = c.Next() {
+		record, err := decodeBoltObject(bucketName, key, value)
+		if err != nil {
+			return boltObject{}, err
+		}
+		if record.Live {
+			return record, nil
+		}
+	}
+	return boltObject{}, errors.New("object not found")
+}
+
+// CreateBucket creates a bucket in the database.
+func (s *storageBolt) CreateBucket(name string, bucketAttrs BucketAttrs) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if bucket, err := getBoltBucket(tx, name); err == nil {
+			if !reflect.DeepEqual(bucket.Attrs(), bucketAttrs) {
+				return fmt.Errorf("a bucket named %s already exists, but with different properties", name)
+			}
+			return nil
+		}
+		bucket := Bucket{Name: name, TimeCreated: time.Now()}
+		bucket.setAttrs(bucketAttrs)
+		return putBoltBucket(tx, bucket)
+	})
+}
+
+// ListBuckets lists the buckets in the database.
+func (s *storageBolt) ListBuckets() ([]Bucket, error) {
+	buckets := []Bucket{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucketsKey).ForEach(func(_, value []byte) error {
+			var bucket Bucket
+			if err := json.Unmarshal(value, &bucket); err != nil {
+				return err
+			}
+			buckets = append(buckets, bucket)
+			return nil
+		})
+	})
+	return buckets, err
+}
+
+// GetBucket retrieves the bucket from the database.
+func (s *storageBolt) GetBucket(name string) (Bucket, error) {
+	var bucket Bucket
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		bucket, err = getBoltBucket(tx, name)
+		return err
+	})
+	return bucket, err
+}
+
+// UpdateBucket replaces the attributes of the bucket.
+func (s *storageBolt) UpdateBucket(name string, attrs BucketAttrs) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := getBoltBucket(tx, name)
+		if err != nil {
+			return BucketNotFound
+		}
+		bucket.setAttrs(attrs)
+		return putBoltBucket(tx, bucket)
+	})
+}
+
+// DeleteBucket removes the bucket, which must have no live objects, along
+// with the noncurrent versions of its objects.
+func (s *storageBolt) DeleteBucket(name string) error {
+	objs, err := s.ListObjects(name, "", false)
+	if err != nil {
+		return BucketNotFound
+	}
+	if len(objs) > 0 {
+		return BucketNotEmpty
+	}
+	var released []boltObject
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		if objects := boltObjects(tx, name); objects != nil {
+			// the files of the objects stored without deduplication are
+			// removed along with the folder of the bucket.
+			err := objects.ForEach(func(key, value []byte) error {
+				record, err := decodeBoltObject(name, key, value)
+				if err != nil || record.ContentHash == "" {
+					return err
+				}
+				remove, err := s.releaseContent(tx, record)
+				if remove {
+					released = append(released, record)
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(boltObjectsKey).DeleteBucket([]byte(name)); err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+			return err
+		}
+		return tx.Bucket(boltBucketsKey).Delete([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.removeContent(released); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.rootDir, "blobs", url.PathEscape(name)))
+}
+
+// CreateObject stores the object, with its content in a file on disk.
+func (s *storageBolt) CreateObject(obj Object) (Object, error) {
+	attrs, err := s.createObject(obj.ObjectAttrs, bytes.NewReader(obj.Content), false, Conditions{})
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{ObjectAttrs: attrs, Content: obj.Content}, nil
+}
+
+// CreateObjectStream stores the object, copying the content from the given
+// reader to a file on disk.
+func (s *storageBolt) CreateObjectStream(attrs ObjectAttrs, content io.Reader) (ObjectAttrs, error) {
+	return s.createObject(attrs, content, true, Conditions{})
+}
+
+// CreateObjectIf is like CreateObjectStream, checking the conditions against
+// the live version of the object in the same transaction that stores the new
+// generation.
+func (s *storageBolt) CreateObjectIf(attrs ObjectAttrs, content io.Reader, conds Conditions) (ObjectAttrs, error) {
+	return s.createObject(attrs, content, true, conds)
+}
+
+func (s *storageBolt) createObject(attrs ObjectAttrs, content io.Reader, fillChecksums bool, conds Conditions) (ObjectAttrs, error) {
+	tmpFile, err := os.CreateTemp(filepath.Join(s.rootDir, "blobs"), ".object-*")
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+	crc32cHash := checksum.NewCrc32c()
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	attrs.Size, err = io.Copy(io.MultiWriter(tmpFile, crc32cHash, md5Hash, sha256Hash), content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	if fillChecksums && attrs.Crc32c == "" {
+		attrs.Crc32c = checksum.EncodedChecksum(crc32cHash.Sum(nil))
+	}
+	if fillChecksums && attrs.Md5Hash == "" {
+		attrs.Md5Hash = checksum.EncodedHash(md5Hash.Sum(nil))
+	}
+
+	var released []boltObject
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := getBoltBucket(tx, attrs.BucketName)
+		if err != nil {
+			bucket = Bucket{Name: attrs.BucketName, TimeCreated: time.Now()}
+			if err := putBoltBucket(tx, bucket); err != nil {
+				return err
+			}
+		}
+		objects := boltObjects(tx, attrs.BucketName)
+		current, err := findBoltObject(tx, attrs.BucketName, attrs.Name, 0)
+		hasCurrent := err == nil
+		if !conds.IsZero() {
+			var currentAttrs *ObjectAttrs
+			if hasCurrent {
+				currentAttrs = &current.Attrs
+			}
+			if err := conds.check(currentAttrs); err != nil {
+				return err
+			}
+		}
+		if attrs.Generation == 0 {
+			attrs.Generation = time.Now().UnixNano() / 1000
+			if latest, ok := latestBoltGeneration(objects, attrs.Name); ok && latest >= attrs.Generation {
+				attrs.Generation = latest + 1
+			}
+		}
+		if attrs.Metageneration == 0 {
+			attrs.Metageneration = 1
+		}
+		if attrs.StorageClass == "" {
+			attrs.StorageClass = bucket.Attrs().objectStorageClass()
+		}
+		if hasCurrent && current.Attrs.Generation != attrs.Generation {
+			if bucket.VersioningEnabled {
+				current.Live = false
+				current.Attrs.Deleted = time.Now().Format(timestampFormat)
+				if err := putBoltObject(objects, current); err != nil {
+					return err
+				}
+			} else {
+				if err := objects.Delete(boltObjectKey(current.Attrs.Name, current.Attrs.Generation)); err != nil {
+					return err
+				}
+				remove, err := s.releaseContent(tx, current)
+				if err != nil {
+					return err
+				}
+				if remove {
+					released = append(released, current)
+				}
+			}
+		}
+		contentHash, err := s.storeContent(tx, tmpFile.Name(), attrs, sha256Hash.Sum(nil))
+		if err != nil {
+			return err
+		}
+		return putBoltObject(objects, boltObject{Attrs: attrs, Live: true, ContentHash: contentHash})
+	})
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	s.removeContent(released)
+	return attrs, nil
+}
+
+// latestBoltGeneration returns the latest generation of the object, live or
+// noncurrent.
+func latestBoltGeneration(objects *bbolt.Bucket, objectName string) (int64, bool) {
+	prefix := boltObjectKey(objectName, 0)[:len(objectName)+1]
+	var latest int64
+	found := false
+	c := objects.Cursor()
+	for key, _ := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = c.Next() {
+		latest = int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+		found = true
+	}
+	return latest, found
+}
+
+// ListObjects lists the objects in a given bucket with a given prefix,
+// including the noncurrent versions when versions is true.
+func (s *storageBolt) ListObjects(bucketName string, prefix string, versions bool) ([]ObjectAttrs, error) {
+	objAttrs := []ObjectAttrs{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		objects := boltObjects(tx, bucketName)
+		if objects == nil {
+			return fmt.Errorf("no bucket named %s", bucketName)
+		}
+		c := objects.Cursor()
+		for key, value := c.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, value = c.Next() {
+			record, err := decodeBoltObject(bucketName, key, value)
+			if err != nil {
+				return err
+			}
+			if record.Live || versions {
+				objAttrs = append(objAttrs, record.Attrs)
+			}
+		}
+		return nil
+	})
+	return objAttrs, err
+}
+
+// GetObject retrieves the live version of the object.
+func (s *storageBolt) GetObject(bucketName, objectName string) (Object, error) {
+	return s.GetObjectWithGeneration(bucketName, objectName, 0)
+}
+
+// GetObjectWithGeneration retrieves a specific version of the object.
+func (s *storageBolt) GetObjectWithGeneration(bucketName, objectName string, generation int64) (Object, error) {
+	obj, err := s.GetObjectStream(bucketName, objectName, generation)
+	if err != nil {
+		return Object{}, err
+	}
+	defer obj.Content.Close()
+	content, err := io.ReadAll(obj.Content)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{ObjectAttrs: obj.ObjectAttrs, Content: content}, nil
+}
+
+// GetObjectStream retrieves the given generation of the object, or the live
+// version when generation is zero, with its content read from the disk on
+// demand.
+func (s *storageBolt) GetObjectStream(bucketName, objectName string, generation int64) (StreamingObject, error) {
+	var obj StreamingObject
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		record, err := findBoltObject(tx, bucketName, objectName, generation)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(s.recordPath(record))
+		if err != nil {
+			return err
+		}
+		obj = StreamingObject{ObjectAttrs: record.Attrs, Content: file}
+		return nil
+	})
+	return obj, err
+}
+
+// DeleteObject deletes the live version of the object, which is kept as a
+// noncurrent version in buckets with versioning enabled.
+func (s *storageBolt) DeleteObject(bucketName, objectName string) error {
+	return s.DeleteObjectGeneration(bucketName, objectName, 0)
+}
+
+// DeleteObjectGeneration deletes the given generation of the object.
+// Deleting the live version behaves as DeleteObject, while noncurrent
+// versions are removed permanently.
+func (s *storageBolt) DeleteObjectGeneration(bucketName, objectName string, generation int64) error {
+	var released []boltObject
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		record, err := findBoltObject(tx, bucketName, objectName, generation)
+		if err != nil {
+			return err
+		}
+		bucket, err := getBoltBucket(tx, bucketName)
+		if err != nil {
+			return err
+		}
+		objects := boltObjects(tx, bucketName)
+		if record.Live && bucket.VersioningEnabled {
+			record.Live = false
+			record.Attrs.Deleted = time.Now().Format(timestampFormat)
+			return putBoltObject(objects, record)
+		}
+		if err := objects.Delete(boltObjectKey(objectName, record.Attrs.Generation)); err != nil {
+			return err
+		}
+		remove, err := s.releaseContent(tx, record)
+		if remove {
+			released = append(released, record)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.removeContent(released)
+}
+
+// SetObjectStorageClass changes the storage class of the given generation of
+// the object, which can be a noncurrent version.
+func (s *storageBolt) SetObjectStorageClass(bucketName, objectName string, generation int64, storageClass string) error {
+	return s.updateObject(bucketName, objectName, generation, func(attrs *ObjectAttrs) error {
+		attrs.StorageClass = storageClass
+		return nil
+	})
+}
+
+// UpdateObjectAttrs replaces the attributes of the object, which must have
+// the given generation, without rewriting its content or creating a new
+// generation.
+func (s *storageBolt) UpdateObjectAttrs(bucketName, objectName string, generation int64, attrs ObjectAttrs) error {
+	return s.UpdateObjectAttrsIf(bucketName, objectName, generation, attrs, Conditions{})
+}
+
+// UpdateObjectAttrsIf replaces the attributes of the object if the given
+// generation meets the conditions.
+func (s *storageBolt) UpdateObjectAttrsIf(bucketName, objectName string, generation int64, attrs ObjectAttrs, conds Conditions) error {
+	return s.updateObject(bucketName, objectName, generation, func(current *ObjectAttrs) error {
+		if err := conds.check(current); err != nil {
+			return err
+		}
+		attrs.BucketName = bucketName
+		attrs.Name = objectName
+		attrs.Generation = generation
+		attrs.Size = current.Size
+		*current = attrs
+		return nil
+	})
+}
+
+func (s *storageBolt) updateObject(bucketName, objectName string, generation int64, update func(*ObjectAttrs) error) error {
+	if generation == 0 {
+		return errors.New("object not found")
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		record, err := findBoltObject(tx, bucketName, objectName, generation)
+		if err != nil {
+			return err
+		}
+		if err := update(&record.Attrs); err != nil {
+			return err
+		}
+		return putBoltObject(boltObjects(tx, bucketName), record)
+	})
+}
+
+// ComposeObject concatenates the source objects into the destination object,
+// streaming their content from the disk.
+func (s *storageBolt) ComposeObject(bucketName string, objectNames []string, dest ObjectAttrs, conds Conditions) (Object, error) {
+	var sources []io.Reader
+	var componentCount int
+	for _, n := range objectNames {
+		obj, err := s.GetObjectStream(bucketName, n, 0)
+		if err != nil {
+			return Object{}, err
+		}
+		defer obj.Content.Close()
+		sources = append(sources, obj.Content)
+		componentCount += obj.componentCount()
+	}
+
+	result, err := s.CreateObjectIf(composedAttrs(bucketName, dest, componentCount), io.MultiReader(sources...), conds)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{ObjectAttrs: result}, nil
+}
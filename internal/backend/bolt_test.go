@@ -0,0 +1,65 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageBoltDeduplicateContent(t *testing.T) {
+	rootDir := t.TempDir()
+	storage, err := NewStorageBoltWithOptions(nil, rootDir, BoltOptions{DeduplicateContent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.(io.Closer).Close()
+	noError(t, storage.CreateBucket("some-bucket", BucketAttrs{}))
+	noError(t, storage.CreateBucket("versioned-bucket", BucketAttrs{VersioningEnabled: true}))
+	countFiles := func() int {
+		t.Helper()
+		files, err := filepath.Glob(filepath.Join(rootDir, "content", "*", "*"))
+		noError(t, err)
+		return len(files)
+	}
+
+	objs := []ObjectAttrs{
+		{BucketName: "some-bucket", Name: "fixture-1.bin"},
+		{BucketName: "some-bucket", Name: "fixture-2.bin"},
+		{BucketName: "versioned-bucket", Name: "fixture.bin"},
+		{BucketName: "versioned-bucket", Name: "fixture.bin"},
+	}
+	for _, attrs := range objs {
+		_, err := storage.CreateObject(Object{ObjectAttrs: attrs, Content: []byte("some large fixture")})
+		noError(t, err)
+	}
+	if n := countFiles(); n != 1 {
+		t.Errorf("wrong number of content files\nwant 1\ngot  %d", n)
+	}
+	obj, err := storage.GetObject("some-bucket", "fixture-2.bin")
+	noError(t, err)
+	if string(obj.Content) != "some large fixture" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "some large fixture", obj.Content)
+	}
+
+	// replacing an object releases its previous content.
+	_, err = storage.CreateObject(Object{ObjectAttrs: objs[0], Content: []byte("other content")})
+	noError(t, err)
+	if n := countFiles(); n != 2 {
+		t.Errorf("wrong number of content files\nwant 2\ngot  %d", n)
+	}
+	noError(t, storage.DeleteObject("some-bucket", "fixture-1.bin"))
+	noError(t, storage.DeleteObject("some-bucket", "fixture-2.bin"))
+	if n := countFiles(); n != 1 {
+		t.Errorf("wrong number of content files\nwant 1\ngot  %d", n)
+	}
+	// deleting the bucket releases the content of the noncurrent versions.
+	noError(t, storage.DeleteObject("versioned-bucket", "fixture.bin"))
+	noError(t, storage.DeleteBucket("versioned-bucket"))
+	if n := countFiles(); n != 0 {
+		t.Errorf("wrong number of content files\nwant 0\ngot  %d", n)
+	}
+}
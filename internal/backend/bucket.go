@@ -4,11 +4,191 @@
 
 package backend
 
-import "time"
+import (
+	"time"
+
+	"cloud.google.com/go/storage"
+)
 
 // Bucket represents the bucket that is stored within the fake server.
 type Bucket struct {
-	Name              string
-	VersioningEnabled bool
-	TimeCreated       time.Time
+	Name                string
+	VersioningEnabled   bool
+	TimeCreated         time.Time
+	DefaultStorageClass string
+	// ProjectID is the project that owns the bucket. Buckets created
+	// without a project are visible to all projects.
+	ProjectID string
+	CORS      []CORS
+	Lifecycle []LifecycleRule
+	// RetentionPolicy is nil for buckets without a retention policy.
+	RetentionPolicy *RetentionPolicy
+	// SoftDeletePolicy is nil for buckets without soft delete.
+	SoftDeletePolicy *SoftDeletePolicy
+	Labels           map[string]string
+	// DefaultObjectACL is the ACL of objects created in the bucket without
+	// one.
+	DefaultObjectACL []storage.ACLRule
+	// DefaultKMSKeyName is the Cloud KMS key of objects created in the
+	// bucket without an encryption key.
+	DefaultKMSKeyName string
+	// UniformBucketLevelAccess is nil for buckets where access to objects is
+	// also granted through ACLs.
+	UniformBucketLevelAccess *UniformBucketLevelAccess
+	// PublicAccessPrevention is "enforced" for buckets that can't be made
+	// public, and empty for buckets that inherit the setting of the project.
+	PublicAccessPrevention string
+	// Autoclass is nil for buckets that never had Autoclass enabled.
+	Autoclass *Autoclass
+	// RequesterPays makes the requesters pay for accessing the bucket's
+	// objects, so requests must name the project billed for them.
+	RequesterPays bool
+	// Metageneration is the version of the bucket's metadata, incremented
+	// by every change through the API. Zero means the metadata was never
+	// changed.
+	Metageneration int64
+}
+
+// Autoclass is the Autoclass configuration of a bucket, which transitions
+// objects to colder storage classes as they go unused.
+type Autoclass struct {
+	Enabled    bool
+	ToggleTime time.Time
+	// TerminalStorageClass is the coldest storage class objects transition
+	// to, either NEARLINE or ARCHIVE.
+	TerminalStorageClass           string
+	TerminalStorageClassUpdateTime time.Time
+}
+
+// UniformBucketLevelAccess is the uniform bucket-level access configuration
+// of a bucket that has it enabled.
+type UniformBucketLevelAccess struct {
+	// LockedTime is the deadline for disabling uniform bucket-level access.
+	LockedTime time.Time
+}
+
+// CORS is a Cross-Origin Resource Sharing rule of a bucket.
+type CORS struct {
+	Origin         []string
+	Method         []string
+	ResponseHeader []string
+	MaxAgeSeconds  int
+}
+
+// LifecycleRule is an object lifecycle management rule of a bucket: the
+// action is applied to the objects that meet all of the conditions.
+type LifecycleRule struct {
+	Action    LifecycleAction
+	Condition LifecycleCondition
+}
+
+// LifecycleAction is the action of a lifecycle rule, either "Delete" or
+// "SetStorageClass".
+type LifecycleAction struct {
+	Type         string
+	StorageClass string
+}
+
+// LifecycleCondition are the conditions of a lifecycle rule. Dates are in
+// the YYYY-MM-DD format, and zero values mean the condition isn't set,
+// except for Age, which is only unset when nil.
+type LifecycleCondition struct {
+	Age                     *int64
+	CreatedBefore           string
+	CustomTimeBefore        string
+	DaysSinceCustomTime     int64
+	DaysSinceNoncurrentTime int64
+	IsLive                  *bool
+	MatchesPrefix           []string
+	MatchesSuffix           []string
+	MatchesStorageClass     []string
+	NoncurrentTimeBefore    string
+	NumNewerVersions        int64
+}
+
+// RetentionPolicy is the minimum time objects must be kept in a bucket
+// before they can be deleted or overwritten. Locked policies can't be
+// removed or shortened.
+type RetentionPolicy struct {
+	RetentionPeriod time.Duration
+	EffectiveTime   time.Time
+	IsLocked        bool
+}
+
+// SoftDeletePolicy is how long deleted objects are kept in a bucket, and can
+// be restored, before they're permanently deleted.
+type SoftDeletePolicy struct {
+	RetentionDuration time.Duration
+	EffectiveTime     time.Time
+}
+
+// DefaultStorageClass is the storage class of buckets created without one.
+const DefaultStorageClass = "STANDARD"
+
+// BucketAttrs represents the bucket properties that can be set on creation
+// and updated with UpdateBucket.
+type BucketAttrs struct {
+	VersioningEnabled        bool
+	DefaultStorageClass      string
+	ProjectID                string
+	CORS                     []CORS                    `json:",omitempty"`
+	Lifecycle                []LifecycleRule           `json:",omitempty"`
+	RetentionPolicy          *RetentionPolicy          `json:",omitempty"`
+	SoftDeletePolicy         *SoftDeletePolicy         `json:",omitempty"`
+	Labels                   map[string]string         `json:",omitempty"`
+	DefaultObjectACL         []storage.ACLRule         `json:",omitempty"`
+	DefaultKMSKeyName        string                    `json:",omitempty"`
+	UniformBucketLevelAccess *UniformBucketLevelAccess `json:",omitempty"`
+	PublicAccessPrevention   string                    `json:",omitempty"`
+	Autoclass                *Autoclass                `json:",omitempty"`
+	RequesterPays            bool                      `json:",omitempty"`
+	Metageneration           int64                     `json:",omitempty"`
+}
+
+// Attrs returns the properties of the bucket that can be updated.
+func (b Bucket) Attrs() BucketAttrs {
+	return BucketAttrs{
+		VersioningEnabled:        b.VersioningEnabled,
+		DefaultStorageClass:      b.DefaultStorageClass,
+		ProjectID:                b.ProjectID,
+		CORS:                     b.CORS,
+		Lifecycle:                b.Lifecycle,
+		RetentionPolicy:          b.RetentionPolicy,
+		SoftDeletePolicy:         b.SoftDeletePolicy,
+		Labels:                   b.Labels,
+		DefaultObjectACL:         b.DefaultObjectACL,
+		DefaultKMSKeyName:        b.DefaultKMSKeyName,
+		UniformBucketLevelAccess: b.UniformBucketLevelAccess,
+		PublicAccessPrevention:   b.PublicAccessPrevention,
+		Autoclass:                b.Autoclass,
+		RequesterPays:            b.RequesterPays,
+		Metageneration:           b.Metageneration,
+	}
+}
+
+func (b *Bucket) setAttrs(attrs BucketAttrs) {
+	b.VersioningEnabled = attrs.VersioningEnabled
+	b.DefaultStorageClass = attrs.DefaultStorageClass
+	b.ProjectID = attrs.ProjectID
+	b.CORS = attrs.CORS
+	b.Lifecycle = attrs.Lifecycle
+	b.RetentionPolicy = attrs.RetentionPolicy
+	b.SoftDeletePolicy = attrs.SoftDeletePolicy
+	b.Labels = attrs.Labels
+	b.DefaultObjectACL = attrs.DefaultObjectACL
+	b.DefaultKMSKeyName = attrs.DefaultKMSKeyName
+	b.UniformBucketLevelAccess = attrs.UniformBucketLevelAccess
+	b.PublicAccessPrevention = attrs.PublicAccessPrevention
+	b.Autoclass = attrs.Autoclass
+	b.RequesterPays = attrs.RequesterPays
+	b.Metageneration = attrs.Metageneration
+}
+
+// objectStorageClass returns the storage class inherited by objects created
+// in the bucket without one.
+func (b BucketAttrs) objectStorageClass() string {
+	if b.DefaultStorageClass != "" {
+		return b.DefaultStorageClass
+	}
+	return DefaultStorageClass
 }
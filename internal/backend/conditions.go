@@ -0,0 +1,72 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+// Conditions are the generation and metageneration preconditions of a
+// conditional write, checked by the backends atomically with the write, so
+// concurrent writers can't both meet them. Nil fields aren't checked. As in
+// Cloud Storage, a GenerationMatch of zero requires the object to not exist,
+// and a GenerationNotMatch of zero requires it to exist.
+type Conditions struct {
+	GenerationMatch        *int64
+	GenerationNotMatch     *int64
+	MetagenerationMatch    *int64
+	MetagenerationNotMatch *int64
+}
+
+// IsZero reports whether no condition is set.
+func (c Conditions) IsZero() bool {
+	return c == Conditions{}
+}
+
+// ConditionError is the error of a conditional write whose condition wasn't
+// met, naming the failed condition, such as "MetagenerationMatch", after the
+// field of Conditions. It matches PreconditionFailed.
+type ConditionError struct {
+	Condition string
+}
+
+func (e *ConditionError) Error() string {
+	return "precondition failed: " + e.Condition
+}
+
+func (e *ConditionError) Is(target error) bool {
+	return target == PreconditionFailed
+}
+
+// check verifies the conditions against the current version of the object,
+// which is nil if the object doesn't exist.
+func (c Conditions) check(current *ObjectAttrs) error {
+	var generation, metageneration int64
+	if current != nil {
+		generation = current.Generation
+		metageneration = current.Metageneration
+	}
+	if c.GenerationMatch != nil {
+		if *c.GenerationMatch == 0 {
+			if current != nil {
+				return &ConditionError{"GenerationMatch"}
+			}
+		} else if current == nil || generation != *c.GenerationMatch {
+			return &ConditionError{"GenerationMatch"}
+		}
+	}
+	if c.GenerationNotMatch != nil {
+		if *c.GenerationNotMatch == 0 {
+			if current == nil {
+				return &ConditionError{"GenerationNotMatch"}
+			}
+		} else if current != nil && generation == *c.GenerationNotMatch {
+			return &ConditionError{"GenerationNotMatch"}
+		}
+	}
+	if c.MetagenerationMatch != nil && (current == nil || metageneration != *c.MetagenerationMatch) {
+		return &ConditionError{"MetagenerationMatch"}
+	}
+	if c.MetagenerationNotMatch != nil && current != nil && metageneration == *c.MetagenerationNotMatch {
+		return &ConditionError{"MetagenerationNotMatch"}
+	}
+	return nil
+}
@@ -5,12 +5,16 @@
 package backend
 
 import (
+	"bytes"
+	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"syscall"
@@ -32,13 +36,68 @@ import (
 //	  \- object2
 //
 // Bucket and object names are url path escaped, so there's no special meaning of forward slashes.
+//
+// mtx guards the buckets. Operations on objects hold it for reading, along
+// with the lock of the object in objects, so they only wait for operations
+// on the same object, or for changes to the buckets.
 type storageFS struct {
 	rootDir string
 	mtx     sync.RWMutex
+	objects objectLocks
+	cipher  *contentCipher
+	sync    bool
+}
+
+// tempObjectPattern is the pattern of the names of the temporary files the
+// content of new objects is written to, in the root directory.
+const tempObjectPattern = ".object-*"
+
+// FSOptions are the options of the filesystem storage backend.
+type FSOptions struct {
+	// EncryptionKey is an AES-128, AES-192 or AES-256 key used to encrypt
+	// the content of the objects with AES-GCM. The attributes of the
+	// objects, stored in xattrs, aren't encrypted. A nil key disables
+	// encryption.
+	//
+	// The same key must always be used with the same root directory:
+	// objects written without encryption, or with a different key, can't be
+	// read.
+	EncryptionKey []byte
+
+	// Sync flushes new objects and attributes to the disk before the writes
+	// return, so they survive a crash of the machine, not only of the
+	// process, at the cost of slower writes. On Windows, only the content
+	// of the objects is flushed.
+	Sync bool
 }
 
 // NewStorageFS creates an instance of the filesystem-backed storage backend.
 func NewStorageFS(objects []Object, rootDir string) (Storage, error) {
+	return NewStorageFSWithOptions(objects, rootDir, FSOptions{})
+}
+
+// NewStorageFSWithEncryption creates an instance of the filesystem-backed
+// storage backend that encrypts the content of the objects with the given
+// key, as described in FSOptions.EncryptionKey.
+func NewStorageFSWithEncryption(objects []Object, rootDir string, key []byte) (Storage, error) {
+	return NewStorageFSWithOptions(objects, rootDir, FSOptions{EncryptionKey: key})
+}
+
+// NewStorageFSWithOptions creates an instance of the filesystem-backed
+// storage backend with the given options.
+//
+// New objects are written to temporary files, with their attributes, and
+// then renamed into place, so a process that's killed while writing them
+// never leaves truncated objects, or objects without attributes. Temporary
+// files left behind are removed when the backend is created.
+func NewStorageFSWithOptions(objects []Object, rootDir string, options FSOptions) (Storage, error) {
+	var contentCipher *contentCipher
+	if options.EncryptionKey != nil {
+		var err error
+		if contentCipher, err = newContentCipher(options.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
 	if !strings.HasSuffix(rootDir, "/") {
 		rootDir += "/"
 	}
@@ -46,6 +105,15 @@ func NewStorageFS(objects []Object, rootDir string) (Storage, error) {
 	if err != nil {
 		return nil, err
 	}
+	tempFiles, err := filepath.Glob(filepath.Join(rootDir, tempObjectPattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range tempFiles {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
 
 	// Check if rootDir supports xattr.
 	if xattr.XATTR_SUPPORTED {
@@ -57,7 +125,7 @@ func NewStorageFS(objects []Object, rootDir string) (Storage, error) {
 		}
 	}
 
-	s := &storageFS{rootDir: rootDir}
+	s := &storageFS{rootDir: rootDir, cipher: contentCipher, sync: options.Sync}
 	for _, o := range objects {
 		_, err := s.CreateObject(o)
 		if err != nil {
@@ -68,20 +136,84 @@ func NewStorageFS(objects []Object, rootDir string) (Storage, error) {
 }
 
 // CreateBucket creates a bucket in the fs backend. A bucket is a folder in the
-// root directory.
-func (s *storageFS) CreateBucket(name string, versioningEnabled bool) error {
-	if versioningEnabled {
+// root directory, and its attributes are stored in the folder's xattr.
+func (s *storageFS) CreateBucket(name string, bucketAttrs BucketAttrs) error {
+	if bucketAttrs.VersioningEnabled {
 		return errors.New("not implemented: fs storage type does not support versioning yet")
 	}
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	return s.createBucket(name)
+	path := filepath.Join(s.rootDir, url.PathEscape(name))
+	if _, err := os.Stat(path); err == nil {
+		currentAttrs, err := s.getBucketAttrs(name)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(currentAttrs, bucketAttrs) {
+			return fmt.Errorf("a bucket named %s already exists, but with different properties", name)
+		}
+		return nil
+	}
+	if err := s.createBucket(name); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(bucketAttrs)
+	if err != nil {
+		return err
+	}
+	return writeXattr(path, encoded)
+}
+
+// lockObject locks the object for writing, returning the function that
+// unlocks it.
+func (s *storageFS) lockObject(bucketName, objectName string) func() {
+	s.mtx.RLock()
+	l := s.objects.get(bucketName, objectName)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mtx.RUnlock()
+	}
+}
+
+// rlockObject locks the object for reading, returning the function that
+// unlocks it.
+func (s *storageFS) rlockObject(bucketName, objectName string) func() {
+	s.mtx.RLock()
+	l := s.objects.get(bucketName, objectName)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		s.mtx.RUnlock()
+	}
 }
 
 func (s *storageFS) createBucket(name string) error {
 	return os.MkdirAll(filepath.Join(s.rootDir, url.PathEscape(name)), 0o700)
 }
 
+// getBucketAttrs reads the attributes of the given bucket. Buckets created
+// implicitly by CreateObject have no attributes stored.
+func (s *storageFS) getBucketAttrs(name string) (BucketAttrs, error) {
+	var bucketAttrs BucketAttrs
+	encoded, err := readXattr(filepath.Join(s.rootDir, url.PathEscape(name)))
+	if err != nil {
+		if isMissingXattr(err) {
+			return bucketAttrs, nil
+		}
+		return bucketAttrs, err
+	}
+	err = json.Unmarshal(encoded, &bucketAttrs)
+	return bucketAttrs, err
+}
+
+// isMissingXattr reports whether the error was returned when reading the
+// attributes of a file that has none.
+func isMissingXattr(err error) bool {
+	var xerr *xattr.Error
+	return errors.Is(err, os.ErrNotExist) || (errors.As(err, &xerr) && xerr.Err == xattr.ENOATTR)
+}
+
 // ListBuckets returns a list of buckets from the list of directories in the
 // root directory.
 func (s *storageFS) ListBuckets() ([]Bucket, error) {
@@ -98,7 +230,11 @@ func (s *storageFS) ListBuckets() ([]Bucket, error) {
 			if err != nil {
 				return nil, fmt.Errorf("failed to unescape object name %s: %w", info.Name(), err)
 			}
-			buckets = append(buckets, Bucket{Name: unescaped})
+			bucket, err := s.getBucket(unescaped)
+			if err != nil {
+				return nil, err
+			}
+			buckets = append(buckets, bucket)
 		}
 	}
 	return buckets, nil
@@ -113,11 +249,55 @@ func timespecToTime(ts syscall.Timespec) time.Time {
 func (s *storageFS) GetBucket(name string) (Bucket, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
+	return s.getBucket(name)
+}
+
+func (s *storageFS) getBucket(name string) (Bucket, error) {
 	dirInfo, err := os.Stat(filepath.Join(s.rootDir, url.PathEscape(name)))
 	if err != nil {
 		return Bucket{}, err
 	}
-	return Bucket{Name: name, VersioningEnabled: false, TimeCreated: timespecToTime(createTimeFromFileInfo(dirInfo))}, err
+	bucketAttrs, err := s.getBucketAttrs(name)
+	if err != nil {
+		return Bucket{}, err
+	}
+	return Bucket{
+		Name:                     name,
+		VersioningEnabled:        false,
+		TimeCreated:              timespecToTime(createTimeFromFileInfo(dirInfo)),
+		DefaultStorageClass:      bucketAttrs.DefaultStorageClass,
+		ProjectID:                bucketAttrs.ProjectID,
+		CORS:                     bucketAttrs.CORS,
+		Lifecycle:                bucketAttrs.Lifecycle,
+		RetentionPolicy:          bucketAttrs.RetentionPolicy,
+		SoftDeletePolicy:         bucketAttrs.SoftDeletePolicy,
+		Labels:                   bucketAttrs.Labels,
+		DefaultObjectACL:         bucketAttrs.DefaultObjectACL,
+		DefaultKMSKeyName:        bucketAttrs.DefaultKMSKeyName,
+		UniformBucketLevelAccess: bucketAttrs.UniformBucketLevelAccess,
+		PublicAccessPrevention:   bucketAttrs.PublicAccessPrevention,
+		Autoclass:                bucketAttrs.Autoclass,
+		RequesterPays:            bucketAttrs.RequesterPays,
+		Metageneration:           bucketAttrs.Metageneration,
+	}, nil
+}
+
+// UpdateBucket replaces the attributes of the bucket.
+func (s *storageFS) UpdateBucket(name string, attrs BucketAttrs) error {
+	if attrs.VersioningEnabled {
+		return errors.New("not implemented: fs storage type does not support versioning yet")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	path := filepath.Join(s.rootDir, url.PathEscape(name))
+	if _, err := os.Stat(path); err != nil {
+		return BucketNotFound
+	}
+	encoded, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return writeXattr(path, encoded)
 }
 
 // DeleteBucket removes the bucket from the backend.
@@ -132,38 +312,168 @@ func (s *storageFS) DeleteBucket(name string) error {
 
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	return os.RemoveAll(filepath.Join(s.rootDir, url.PathEscape(name)))
+	path := filepath.Join(s.rootDir, url.PathEscape(name))
+	if err := removeXattrFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.RemoveAll(path)
 }
 
 // CreateObject stores an object as a regular file in the disk.
 func (s *storageFS) CreateObject(obj Object) (Object, error) {
-	if obj.Generation > 0 {
-		return Object{}, errors.New("not implemented: fs storage type does not support objects generation yet")
-	}
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	err := s.createBucket(obj.BucketName)
+	attrs, err := s.createObject(obj.ObjectAttrs, bytes.NewReader(obj.Content), false, Conditions{})
 	if err != nil {
 		return Object{}, err
 	}
+	return Object{ObjectAttrs: attrs, Content: obj.Content}, nil
+}
 
-	path := filepath.Join(s.rootDir, url.PathEscape(obj.BucketName), url.PathEscape(obj.Name))
+// CreateObjectStream stores an object as a regular file in the disk, copying
+// the content from the given reader. The content is written to a temporary
+// file in the root directory and then renamed, so readers never see a
+// partially written object and the content is never held in memory.
+func (s *storageFS) CreateObjectStream(attrs ObjectAttrs, content io.Reader) (ObjectAttrs, error) {
+	return s.createObject(attrs, content, true, Conditions{})
+}
 
-	if err = os.WriteFile(path, obj.Content, 0o600); err != nil {
-		return Object{}, err
+// CreateObjectIf is like CreateObjectStream, checking the conditions against
+// the stored object right before the new content replaces it.
+func (s *storageFS) CreateObjectIf(attrs ObjectAttrs, content io.Reader, conds Conditions) (ObjectAttrs, error) {
+	return s.createObject(attrs, content, true, conds)
+}
+
+func (s *storageFS) createObject(attrs ObjectAttrs, content io.Reader, fillChecksums bool, conds Conditions) (ObjectAttrs, error) {
+	tmpFile, err := os.CreateTemp(s.rootDir, tempObjectPattern)
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer removeXattrFile(tmpFile.Name())
+	defer tmpFile.Close()
+	crc32cHash := checksum.NewCrc32c()
+	md5Hash := md5.New()
+	attrs.Size, err = s.writeContent(tmpFile, io.TeeReader(content, io.MultiWriter(crc32cHash, md5Hash)))
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	if fillChecksums && attrs.Crc32c == "" {
+		attrs.Crc32c = checksum.EncodedChecksum(crc32cHash.Sum(nil))
+	}
+	if fillChecksums && attrs.Md5Hash == "" {
+		attrs.Md5Hash = checksum.EncodedHash(md5Hash.Sum(nil))
 	}
 
-	// TODO: Handle if metadata is not present more gracefully?
-	encoded, err := json.Marshal(obj.ObjectAttrs)
+	defer s.lockObject(attrs.BucketName, attrs.Name)()
+	err = s.createBucket(attrs.BucketName)
 	if err != nil {
-		return Object{}, err
+		return ObjectAttrs{}, err
+	}
+	if attrs.StorageClass == "" {
+		bucketAttrs, err := s.getBucketAttrs(attrs.BucketName)
+		if err != nil {
+			return ObjectAttrs{}, err
+		}
+		attrs.StorageClass = bucketAttrs.objectStorageClass()
+	}
+	if attrs.Metageneration == 0 {
+		attrs.Metageneration = 1
 	}
 
-	if err = writeXattr(path, encoded); err != nil {
-		return Object{}, err
+	var current *ObjectAttrs
+	if currentAttrs, err := s.getObjectAttrs(attrs.BucketName, attrs.Name); err == nil {
+		current = &currentAttrs
+	}
+	if err := conds.check(current); err != nil {
+		return ObjectAttrs{}, err
+	}
+	if attrs.Generation == 0 {
+		var latest int64
+		if current != nil {
+			latest = current.Generation
+		}
+		attrs.Generation = nextGeneration(latest)
 	}
 
-	return obj, nil
+	// the attributes are stored in the temporary file, so they're renamed
+	// into place with the content.
+	encoded, err := json.Marshal(attrs)
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	if err = writeXattr(tmpFile.Name(), encoded); err != nil {
+		return ObjectAttrs{}, err
+	}
+	if s.sync {
+		if err = tmpFile.Sync(); err != nil {
+			return ObjectAttrs{}, err
+		}
+	}
+	if err = tmpFile.Close(); err != nil {
+		return ObjectAttrs{}, err
+	}
+
+	path := s.objectPath(attrs.BucketName, attrs.Name)
+	if err = renameWithXattr(tmpFile.Name(), path); err != nil {
+		return ObjectAttrs{}, err
+	}
+	if s.sync {
+		if err = syncDir(filepath.Dir(path)); err != nil {
+			return ObjectAttrs{}, err
+		}
+	}
+	return attrs, nil
+}
+
+// writeObjectAttrs replaces the attributes of a stored object.
+func (s *storageFS) writeObjectAttrs(attrs ObjectAttrs) error {
+	encoded, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	path := s.objectPath(attrs.BucketName, attrs.Name)
+	if err := writeXattr(path, encoded); err != nil {
+		return err
+	}
+	if s.sync {
+		return syncXattr(path)
+	}
+	return nil
+}
+
+// writeContent copies the content to the file, encrypting it if encryption
+// is enabled, and returns the size of the content.
+func (s *storageFS) writeContent(file *os.File, content io.Reader) (int64, error) {
+	if s.cipher == nil {
+		return io.Copy(file, content)
+	}
+	w, err := s.cipher.newWriter(file)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, content)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// openContent opens the file with the content of the object, decrypting it
+// if encryption is enabled.
+func (s *storageFS) openContent(path string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(path)
+	if err != nil || s.cipher == nil {
+		return file, err
+	}
+	r, err := s.cipher.newReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return r, nil
+}
+
+func (s *storageFS) objectPath(bucketName, objectName string) string {
+	return filepath.Join(s.rootDir, url.PathEscape(bucketName), url.PathEscape(objectName))
 }
 
 // ListObjects lists the objects in a given bucket with a given prefix and
@@ -188,57 +498,113 @@ func (s *storageFS) ListObjects(bucketName string, prefix string, versions bool)
 		if prefix != "" && !strings.HasPrefix(unescaped, prefix) {
 			continue
 		}
-		object, err := s.getObject(bucketName, unescaped)
+		l := s.objects.get(bucketName, unescaped)
+		l.RLock()
+		attrs, err := s.getObjectAttrs(bucketName, unescaped)
+		l.RUnlock()
+		// files without attributes, such as files copied by other tools,
+		// aren't objects until the backend is refreshed.
+		if isMissingXattr(err) {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
-		object.Size = int64(len(object.Content))
-		objects = append(objects, object.ObjectAttrs)
+		objects = append(objects, attrs)
 	}
 	return objects, nil
 }
 
 // GetObject get an object by bucket and name.
 func (s *storageFS) GetObject(bucketName, objectName string) (Object, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
+	defer s.rlockObject(bucketName, objectName)()
 	return s.getObject(bucketName, objectName)
 }
 
-// GetObjectWithGeneration retrieves an specific version of the object. Not
-// implemented for this backend.
+// GetObjectWithGeneration retrieves the object, which must have the given
+// generation when it's not zero. The fs backend doesn't keep old generations
+// of objects.
 func (s *storageFS) GetObjectWithGeneration(bucketName, objectName string, generation int64) (Object, error) {
-	return Object{}, errors.New("not implemented: fs storage type does not support versioning yet")
+	defer s.rlockObject(bucketName, objectName)()
+	obj, err := s.getObject(bucketName, objectName)
+	if err != nil {
+		return Object{}, err
+	}
+	if generation != 0 && obj.Generation != generation {
+		return Object{}, errors.New("object not found")
+	}
+	return obj, nil
+}
+
+// GetObjectStream retrieves the object, which must have the given generation
+// when it's not zero, with its content read from the disk on demand.
+func (s *storageFS) GetObjectStream(bucketName, objectName string, generation int64) (StreamingObject, error) {
+	defer s.rlockObject(bucketName, objectName)()
+	attrs, err := s.getObjectAttrs(bucketName, objectName)
+	if err != nil {
+		return StreamingObject{}, err
+	}
+	if generation != 0 && attrs.Generation != generation {
+		return StreamingObject{}, errors.New("object not found")
+	}
+	content, err := s.openContent(s.objectPath(bucketName, objectName))
+	if err != nil {
+		return StreamingObject{}, err
+	}
+	return StreamingObject{ObjectAttrs: attrs, Content: content}, nil
 }
 
 func (s *storageFS) getObject(bucketName, objectName string) (Object, error) {
-	path := filepath.Join(s.rootDir, url.PathEscape(bucketName), url.PathEscape(objectName))
+	attrs, err := s.getObjectAttrs(bucketName, objectName)
+	if err != nil {
+		return Object{}, err
+	}
+	file, err := s.openContent(s.objectPath(bucketName, objectName))
+	if err != nil {
+		return Object{}, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return Object{}, err
+	}
+	attrs.Size = int64(len(content))
+	return Object{ObjectAttrs: attrs, Content: content}, nil
+}
+
+// getObjectAttrs reads the attributes of the object, without its content.
+func (s *storageFS) getObjectAttrs(bucketName, objectName string) (ObjectAttrs, error) {
+	path := s.objectPath(bucketName, objectName)
 
 	encoded, err := readXattr(path)
 	if err != nil {
-		return Object{}, err
+		return ObjectAttrs{}, err
 	}
 
-	var obj Object
-	if err = json.Unmarshal(encoded, &obj.ObjectAttrs); err != nil {
-		return Object{}, err
+	var attrs ObjectAttrs
+	if err = json.Unmarshal(encoded, &attrs); err != nil {
+		return ObjectAttrs{}, err
 	}
 
-	obj.Content, err = os.ReadFile(path)
+	info, err := os.Stat(path)
 	if err != nil {
-		return Object{}, err
+		return ObjectAttrs{}, err
 	}
 
-	obj.Name = filepath.ToSlash(objectName)
-	obj.BucketName = bucketName
-	obj.Size = int64(len(obj.Content))
-	return obj, nil
+	attrs.Name = filepath.ToSlash(objectName)
+	attrs.BucketName = bucketName
+	attrs.Size = info.Size()
+	if s.cipher != nil {
+		if attrs.Size, err = s.cipher.plaintextSize(info.Size()); err != nil {
+			return ObjectAttrs{}, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return attrs, nil
 }
 
 // DeleteObject deletes an object by bucket and name.
 func (s *storageFS) DeleteObject(bucketName, objectName string) error {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+	defer s.lockObject(bucketName, objectName)()
 	if objectName == "" {
 		return errors.New("can't delete object with empty name")
 	}
@@ -249,68 +615,81 @@ func (s *storageFS) DeleteObject(bucketName, objectName string) error {
 	return os.Remove(path)
 }
 
-// PatchObject patches the given object metadata.
-func (s *storageFS) PatchObject(bucketName, objectName string, metadata map[string]string) (Object, error) {
-	obj, err := s.GetObject(bucketName, objectName)
+// DeleteObjectGeneration deletes the object if it has the given generation.
+// The fs backend doesn't keep old generations of objects.
+func (s *storageFS) DeleteObjectGeneration(bucketName, objectName string, generation int64) error {
+	unlock := s.rlockObject(bucketName, objectName)
+	obj, err := s.getObjectAttrs(bucketName, objectName)
+	unlock()
 	if err != nil {
-		return Object{}, err
+		return err
 	}
-	if obj.Metadata == nil {
-		obj.Metadata = map[string]string{}
+	if obj.Generation != generation {
+		return errors.New("object not found")
 	}
-	for k, v := range metadata {
-		obj.Metadata[k] = v
+	return s.DeleteObject(bucketName, objectName)
+}
+
+// SetObjectStorageClass changes the storage class of the object, which must
+// have the given generation, without rewriting its content.
+func (s *storageFS) SetObjectStorageClass(bucketName, objectName string, generation int64, storageClass string) error {
+	defer s.lockObject(bucketName, objectName)()
+	obj, err := s.getObjectAttrs(bucketName, objectName)
+	if err != nil {
+		return err
 	}
-	s.CreateObject(obj) // recreate object
-	return obj, nil
+	if obj.Generation != generation {
+		return errors.New("object not found")
+	}
+	obj.StorageClass = storageClass
+	return s.writeObjectAttrs(obj)
+}
+
+// UpdateObjectAttrs replaces the attributes of the object, which must have
+// the given generation, without rewriting its content.
+func (s *storageFS) UpdateObjectAttrs(bucketName, objectName string, generation int64, attrs ObjectAttrs) error {
+	return s.UpdateObjectAttrsIf(bucketName, objectName, generation, attrs, Conditions{})
 }
 
-// UpdateObject replaces the given object metadata.
-func (s *storageFS) UpdateObject(bucketName, objectName string, metadata map[string]string) (Object, error) {
-	obj, err := s.GetObject(bucketName, objectName)
+// UpdateObjectAttrsIf replaces the attributes of the object if it meets the
+// conditions.
+func (s *storageFS) UpdateObjectAttrsIf(bucketName, objectName string, generation int64, attrs ObjectAttrs, conds Conditions) error {
+	defer s.lockObject(bucketName, objectName)()
+	obj, err := s.getObjectAttrs(bucketName, objectName)
 	if err != nil {
-		return Object{}, err
+		return err
 	}
-	obj.Metadata = map[string]string{}
-	for k, v := range metadata {
-		obj.Metadata[k] = v
+	if obj.Generation != generation {
+		return errors.New("object not found")
 	}
-	s.CreateObject(obj) // recreate object
-	return obj, nil
+	if err := conds.check(&obj); err != nil {
+		return err
+	}
+	attrs.BucketName = bucketName
+	attrs.Name = objectName
+	attrs.Generation = generation
+	attrs.Size = obj.Size
+	return s.writeObjectAttrs(attrs)
 }
 
-func (s *storageFS) ComposeObject(bucketName string, objectNames []string, destinationName string, metadata map[string]string, contentType string) (Object, error) {
-	var data []byte
+// ComposeObject concatenates the source objects into the destination object,
+// streaming their content from the disk.
+func (s *storageFS) ComposeObject(bucketName string, objectNames []string, dest ObjectAttrs, conds Conditions) (Object, error) {
+	var sources []io.Reader
+	var componentCount int
 	for _, n := range objectNames {
-		obj, err := s.GetObject(bucketName, n)
+		obj, err := s.GetObjectStream(bucketName, n, 0)
 		if err != nil {
 			return Object{}, err
 		}
-		data = append(data, obj.Content...)
+		defer obj.Content.Close()
+		sources = append(sources, obj.Content)
+		componentCount += obj.componentCount()
 	}
 
-	dest, err := s.GetObject(bucketName, destinationName)
+	result, err := s.CreateObjectIf(composedAttrs(bucketName, dest, componentCount), io.MultiReader(sources...), conds)
 	if err != nil {
-		oattrs := ObjectAttrs{
-			BucketName:  bucketName,
-			Name:        destinationName,
-			ContentType: contentType,
-			Created:     time.Now().String(),
-		}
-		dest = Object{
-			ObjectAttrs: oattrs,
-		}
-	}
-
-	dest.Content = data
-	dest.Crc32c = checksum.EncodedCrc32cChecksum(data)
-	dest.Md5Hash = checksum.EncodedMd5Hash(data)
-	dest.Metadata = metadata
-
-	result, err := s.CreateObject(dest)
-	if err != nil {
-		return result, err
+		return Object{}, err
 	}
-
-	return result, nil
+	return Object{ObjectAttrs: result}, nil
 }
@@ -0,0 +1,222 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted objects are stored as a header, with a magic string and a random
+// nonce prefix, followed by the content split into chunks sealed with
+// AES-GCM. Chunking keeps the content streamed when it's written and read,
+// and lets readers seek without decrypting the whole object. The nonce of
+// each chunk is the prefix followed by the index of the chunk and a flag set
+// on the last chunk, so truncated or reordered content fails to decrypt.
+const (
+	encryptionMagic       = "FGCSAES1"
+	encryptionNoncePrefix = 7
+	encryptionHeaderSize  = len(encryptionMagic) + encryptionNoncePrefix
+	encryptionChunkSize   = 64 * 1024
+)
+
+var errNotEncrypted = errors.New("object content is not encrypted")
+
+// contentCipher encrypts and decrypts the content of the objects stored by
+// the filesystem backend.
+type contentCipher struct {
+	aead cipher.AEAD
+}
+
+func newContentCipher(key []byte) (*contentCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &contentCipher{aead: aead}, nil
+}
+
+func (c *contentCipher) sealedChunkSize() int64 {
+	return int64(encryptionChunkSize + c.aead.Overhead())
+}
+
+func (c *contentCipher) nonce(prefix []byte, index int64, last bool) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefix:], uint32(index))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// plaintextSize returns the size of the content stored in an encrypted file
+// of the given size.
+func (c *contentCipher) plaintextSize(fileSize int64) (int64, error) {
+	sealedSize := fileSize - int64(encryptionHeaderSize)
+	if sealedSize < int64(c.aead.Overhead()) {
+		return 0, errNotEncrypted
+	}
+	chunks := (sealedSize + c.sealedChunkSize() - 1) / c.sealedChunkSize()
+	return sealedSize - chunks*int64(c.aead.Overhead()), nil
+}
+
+// encryptingWriter seals the content written to it, writing the chunks to
+// the underlying writer. Close must be called to write the last chunk.
+type encryptingWriter struct {
+	cipher *contentCipher
+	w      io.Writer
+	prefix []byte
+	index  int64
+	buf    []byte
+}
+
+func (c *contentCipher) newWriter(w io.Writer) (*encryptingWriter, error) {
+	prefix := make([]byte, encryptionNoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(encryptionMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{cipher: c, w: w, prefix: prefix, buf: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// a full chunk is only sealed once more content arrives, as the
+		// last chunk is sealed differently.
+		if len(w.buf) == encryptionChunkSize {
+			if err := w.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		free := encryptionChunkSize - len(w.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.buf = append(w.buf, p[:free]...)
+		p = p[free:]
+	}
+	return n, nil
+}
+
+func (w *encryptingWriter) seal(last bool) error {
+	sealed := w.cipher.aead.Seal(nil, w.cipher.nonce(w.prefix, w.index, last), w.buf, nil)
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close seals the last chunk, which is empty for empty objects. It doesn't
+// close the underlying writer.
+func (w *encryptingWriter) Close() error {
+	return w.seal(true)
+}
+
+// decryptingReader reads the content of an encrypted file, decrypting one
+// chunk at a time.
+type decryptingReader struct {
+	cipher *contentCipher
+	file   *os.File
+	prefix []byte
+	size   int64
+	offset int64
+	index  int64
+	chunk  []byte
+}
+
+func (c *contentCipher) newReader(file *os.File) (*decryptingReader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, err := c.plaintextSize(info.Size())
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errNotEncrypted
+	}
+	r := &decryptingReader{cipher: c, file: file, prefix: header[len(encryptionMagic):], size: size, index: -1}
+	if size == 0 {
+		// there's nothing to read from empty objects, but their only chunk
+		// is still authenticated.
+		if err := r.open(0); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := r.offset / encryptionChunkSize
+	if index != r.index {
+		if err := r.open(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk[r.offset%encryptionChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) open(index int64) error {
+	lastIndex := r.size / encryptionChunkSize
+	if r.size > 0 && r.size%encryptionChunkSize == 0 {
+		lastIndex--
+	}
+	sealed := make([]byte, r.cipher.sealedChunkSize())
+	n, err := r.file.ReadAt(sealed, int64(encryptionHeaderSize)+index*r.cipher.sealedChunkSize())
+	if err != nil && err != io.EOF {
+		return err
+	}
+	chunk, err := r.cipher.aead.Open(sealed[:0], r.cipher.nonce(r.prefix, index, index == lastIndex), sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt object content: %w", err)
+	}
+	r.index = index
+	r.chunk = chunk
+	return nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStorageFSEncryption(t *testing.T) {
+	rootDir, err := os.MkdirTemp(tempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	key := bytes.Repeat([]byte{1}, 32)
+	storage, err := NewStorageFSWithEncryption(nil, rootDir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noError(t, storage.CreateBucket("some-bucket", BucketAttrs{}))
+
+	contents := map[string][]byte{
+		"empty.txt": {},
+		"small.txt": []byte("some secret content"),
+		"chunk.txt": []byte(strings.Repeat("a", encryptionChunkSize)),
+		"large.txt": []byte(strings.Repeat("secret", encryptionChunkSize/2)),
+	}
+	for name, content := range contents {
+		_, err := storage.CreateObjectStream(ObjectAttrs{BucketName: "some-bucket", Name: name}, bytes.NewReader(content))
+		noError(t, err)
+	}
+	for name, content := range contents {
+		obj, err := storage.GetObject("some-bucket", name)
+		noError(t, err)
+		if !bytes.Equal(obj.Content, content) || obj.Size != int64(len(content)) {
+			t.Errorf("wrong content of %s\nwant %d bytes\ngot  %d bytes (size %d)", name, len(content), len(obj.Content), obj.Size)
+		}
+	}
+
+	stored, err := os.ReadFile(filepath.Join(rootDir, "some-bucket", "large.txt"))
+	noError(t, err)
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Error("content stored without encryption")
+	}
+
+	obj, err := storage.GetObjectStream("some-bucket", "large.txt", 0)
+	noError(t, err)
+	defer obj.Content.Close()
+	offset := int64(encryptionChunkSize + 3)
+	_, err = obj.Content.Seek(offset, io.SeekStart)
+	noError(t, err)
+	data, err := io.ReadAll(obj.Content)
+	noError(t, err)
+	if expected := contents["large.txt"][offset:]; !bytes.Equal(data, expected) {
+		t.Errorf("wrong content after seeking\nwant %d bytes\ngot  %d bytes", len(expected), len(data))
+	}
+
+	wrongKey, err := NewStorageFSWithEncryption(nil, rootDir, bytes.Repeat([]byte{2}, 32))
+	noError(t, err)
+	_, err = wrongKey.GetObject("some-bucket", "small.txt")
+	shouldError(t, err)
+	_, err = NewStorageFSWithEncryption(nil, rootDir, []byte("short"))
+	shouldError(t, err)
+}
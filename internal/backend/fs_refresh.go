@@ -0,0 +1,133 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Refresh imports the files copied into the bucket folders by other tools,
+// which have no attributes, as objects. Files in subfolders of a bucket
+// become objects named after their path relative to the bucket, with
+// forward slashes, and are moved to the root of the bucket folder, where
+// the backend keeps them.
+//
+// The content type of the objects is detected from the extension of the
+// files, or sniffed from their content when the extension is unknown. With
+// encryption enabled, the files are imported as plaintext and encrypted.
+// Files should be moved into the bucket folders once they're complete, as
+// they're imported with the content they have when they're found.
+func (s *storageFS) Refresh() (int, error) {
+	buckets, err := s.ListBuckets()
+	if err != nil {
+		return 0, err
+	}
+	var imported int
+	for _, bucket := range buckets {
+		n, err := s.refreshBucket(bucket.Name)
+		imported += n
+		if err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+func (s *storageFS) refreshBucket(bucketName string) (int, error) {
+	bucketDir := filepath.Join(s.rootDir, url.PathEscape(bucketName))
+	var imported int
+	var subdirs []string
+	err := filepath.Walk(bucketDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the file may have been removed since its folder was read.
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path != bucketDir {
+				subdirs = append(subdirs, path)
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || isXattrFile(path) {
+			return nil
+		}
+		var objectName string
+		if filepath.Dir(path) == bucketDir {
+			if objectName, err = url.PathUnescape(info.Name()); err != nil {
+				return fmt.Errorf("failed to unescape object name %s: %w", info.Name(), err)
+			}
+		} else {
+			relPath, _ := filepath.Rel(bucketDir, path)
+			objectName = filepath.ToSlash(relPath)
+		}
+		ok, err := s.importFile(bucketName, objectName, path, info)
+		if ok {
+			imported++
+		}
+		return err
+	})
+	if err != nil {
+		return imported, err
+	}
+	// subfolders are left empty once their files are imported, and removed
+	// from the deepest up. Folders that still have files are kept.
+	for i := len(subdirs) - 1; i >= 0; i-- {
+		os.Remove(subdirs[i])
+	}
+	return imported, nil
+}
+
+// importFile stores the file as an object unless it already is one,
+// returning whether it was imported.
+func (s *storageFS) importFile(bucketName, objectName, path string, info os.FileInfo) (bool, error) {
+	if _, err := readXattr(path); !isMissingXattr(err) {
+		return false, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(objectName))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	modTime := info.ModTime().Format(timestampFormat)
+	attrs := ObjectAttrs{
+		BucketName:  bucketName,
+		Name:        objectName,
+		ContentType: contentType,
+		Created:     modTime,
+		Updated:     modTime,
+	}
+	// the object must not exist, as an object written since the file was
+	// found replaced it.
+	var generation int64
+	_, err = s.createObject(attrs, bytes.NewReader(content), true, Conditions{GenerationMatch: &generation})
+	if errors.Is(err, PreconditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if objectPath := s.objectPath(bucketName, objectName); objectPath != path {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return true, err
+		}
+	}
+	return true, nil
+}
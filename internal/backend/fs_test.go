@@ -0,0 +1,48 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageFSRemovesTemporaryFiles(t *testing.T) {
+	rootDir, err := os.MkdirTemp(tempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	// a write interrupted by a killed process.
+	leftover := filepath.Join(rootDir, ".object-123456")
+	if err := os.WriteFile(leftover, []byte("truncated cont"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := NewStorageFSWithOptions(nil, rootDir, FSOptions{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("temporary file wasn't removed, stat returned %v", err)
+	}
+
+	created, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "file.txt", ContentType: "text/plain"}, Content: []byte("some content")})
+	noError(t, err)
+	noError(t, storage.UpdateObjectAttrs("some-bucket", "file.txt", created.Generation, ObjectAttrs{ContentType: "text/html"}))
+	obj, err := storage.GetObject("some-bucket", "file.txt")
+	noError(t, err)
+	if !bytes.Equal(obj.Content, []byte("some content")) || obj.ContentType != "text/html" {
+		t.Errorf("wrong object\nwant %q with type text/html\ngot  %q with type %s", "some content", obj.Content, obj.ContentType)
+	}
+
+	tempFiles, err := filepath.Glob(filepath.Join(rootDir, tempObjectPattern))
+	noError(t, err)
+	if len(tempFiles) > 0 {
+		t.Errorf("unexpected temporary files left after writing: %v", tempFiles)
+	}
+}
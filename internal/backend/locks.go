@@ -0,0 +1,30 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const objectLockShards = 64
+
+// objectLocks guards the objects of a backend with a fixed set of locks,
+// sharded by bucket and object name, so operations on different objects
+// rarely wait for each other. Objects that share a shard are serialized,
+// which is harmless: the locks are never held while waiting for another
+// shard.
+type objectLocks struct {
+	shards [objectLockShards]sync.RWMutex
+}
+
+// get returns the lock guarding the given object.
+func (l *objectLocks) get(bucketName, objectName string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucketName))
+	h.Write([]byte{0})
+	h.Write([]byte(objectName))
+	return &l.shards[h.Sum32()%objectLockShards]
+}
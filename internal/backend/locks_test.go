@@ -0,0 +1,119 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageFSObjectLocks(t *testing.T) {
+	rootDir, err := os.MkdirTemp(tempDir(), "fakegcstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	storage, err := NewStorageFS(nil, rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := storage.(*storageFS)
+	noError(t, fs.CreateBucket("some-bucket", BucketAttrs{}))
+
+	locked := fs.objects.get("some-bucket", "locked.txt")
+	if fs.objects.get("some-bucket", "other.txt") == locked {
+		t.Fatal("locked.txt and other.txt share the same lock")
+	}
+	create := func(name string) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := fs.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: name}, Content: []byte("something")})
+			done <- err
+		}()
+		return done
+	}
+
+	locked.Lock()
+	select {
+	case err := <-create("other.txt"):
+		noError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing other.txt waited for the lock of locked.txt")
+	}
+	done := create("locked.txt")
+	select {
+	case <-done:
+		t.Fatal("locked.txt was written while locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	locked.Unlock()
+	noError(t, <-done)
+}
+
+func TestStorageMemoryBucketLocks(t *testing.T) {
+	storage := NewStorageMemory(nil).(*storageMemory)
+	noError(t, storage.CreateBucket("locked-bucket", BucketAttrs{}))
+	noError(t, storage.CreateBucket("other-bucket", BucketAttrs{}))
+	create := func(bucketName string) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: "file.txt"}, Content: []byte("something")})
+			done <- err
+		}()
+		return done
+	}
+
+	locked := storage.buckets["locked-bucket"]
+	locked.mtx.Lock()
+	select {
+	case err := <-create("other-bucket"):
+		noError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing to other-bucket waited for the lock of locked-bucket")
+	}
+	done := create("locked-bucket")
+	select {
+	case <-done:
+		t.Fatal("locked-bucket was written while locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	locked.mtx.Unlock()
+	noError(t, <-done)
+}
+
+func TestStorageMemoryConcurrentEvictions(t *testing.T) {
+	storage := NewStorageMemoryWithLimits(nil, MemoryLimits{MaxObjects: 10, EvictOldest: true}).(*storageMemory)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		bucketName := "bucket-" + strconv.Itoa(i)
+		noError(t, storage.CreateBucket(bucketName, BucketAttrs{}))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := "file-" + strconv.Itoa(j) + ".txt"
+				if _, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: name}, Content: []byte("data")}); err != nil {
+					t.Error(err)
+				}
+				if j%3 == 0 {
+					storage.DeleteObject(bucketName, name)
+				}
+				storage.ListBuckets()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var objects int64
+	for _, bucket := range storage.buckets {
+		objects += int64(len(bucket.activeObjects) + len(bucket.archivedObjects))
+	}
+	if _, count := storage.usage.load(); count != objects || count > 10 {
+		t.Errorf("wrong number of objects\nwant %d, at most 10\ngot  %d", objects, count)
+	}
+}
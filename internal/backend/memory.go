@@ -5,10 +5,15 @@
 package backend
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsouza/fake-gcs-server/internal/checksum"
@@ -18,9 +23,52 @@ const timestampFormat = "2006-01-02T15:04:05.999999Z07:00"
 
 // storageMemory is an implementation of the backend storage that stores data
 // in memory.
+//
+// Each bucket has its own lock, so operations on different buckets don't
+// wait for each other, and the lock of the bucket map is only held to look
+// buckets up, never while waiting for the lock of a bucket. As the limits
+// are enforced across buckets, the writes checked against them are
+// serialized by limitsMtx, which is only taken when limits are set.
 type storageMemory struct {
-	buckets map[string]bucketInMemory
-	mtx     sync.RWMutex
+	buckets   map[string]*bucketInMemory
+	mtx       sync.RWMutex
+	limits    MemoryLimits
+	limitsMtx sync.Mutex
+	usage     *memoryUsage
+}
+
+// memoryUsage counts the objects stored by the memory backend, including
+// their noncurrent versions, and the size of their content. It's updated
+// atomically as objects are added and removed, with the lock of their bucket
+// held, so checking the limits doesn't need to go through all the objects.
+type memoryUsage struct {
+	bytes   int64
+	objects int64
+}
+
+func (u *memoryUsage) add(obj Object) {
+	atomic.AddInt64(&u.bytes, int64(len(obj.Content)))
+	atomic.AddInt64(&u.objects, 1)
+}
+
+func (u *memoryUsage) remove(obj Object) {
+	atomic.AddInt64(&u.bytes, -int64(len(obj.Content)))
+	atomic.AddInt64(&u.objects, -1)
+}
+
+func (u *memoryUsage) load() (int64, int64) {
+	return atomic.LoadInt64(&u.bytes), atomic.LoadInt64(&u.objects)
+}
+
+// MemoryLimits limits the objects stored in the memory backend, counting
+// all their versions. Zero values mean no limit.
+type MemoryLimits struct {
+	MaxBytes   int64
+	MaxObjects int
+	// EvictOldest makes room for objects that would exceed the limits by
+	// permanently deleting the oldest objects, noncurrent versions first,
+	// instead of failing with CapacityExceeded.
+	EvictOldest bool
 }
 
 type bucketInMemory struct {
@@ -29,32 +77,58 @@ type bucketInMemory struct {
 	// Object instances.
 	activeObjects   []Object
 	archivedObjects []Object
+	usage           *memoryUsage
+	mtx             sync.RWMutex
+	// deleted is set when the bucket is removed from the backend, for the
+	// operations that looked it up before.
+	deleted bool
 }
 
-func newBucketInMemory(name string, versioningEnabled bool) bucketInMemory {
-	return bucketInMemory{Bucket{name, versioningEnabled, time.Now()}, []Object{}, []Object{}}
+func newBucketInMemory(name string, bucketAttrs BucketAttrs, usage *memoryUsage) *bucketInMemory {
+	bucket := Bucket{Name: name, TimeCreated: time.Now()}
+	bucket.setAttrs(bucketAttrs)
+	return &bucketInMemory{Bucket: bucket, activeObjects: []Object{}, archivedObjects: []Object{}, usage: usage}
 }
 
 func (bm *bucketInMemory) addObject(obj Object) Object {
 	obj.Size = int64(len(obj.Content))
-	obj.Generation = getNewGenerationIfZero(obj.Generation)
+	if obj.Generation == 0 {
+		obj.Generation = bm.newGeneration(obj.Name)
+	}
+	if obj.Metageneration == 0 {
+		obj.Metageneration = 1
+	}
+	if obj.StorageClass == "" {
+		obj.StorageClass = BucketAttrs{DefaultStorageClass: bm.DefaultStorageClass}.objectStorageClass()
+	}
 	index := findObject(obj, bm.activeObjects, false)
 	if index >= 0 {
 		if bm.VersioningEnabled {
 			bm.activeObjects[index].Deleted = time.Now().Format(timestampFormat)
 			bm.cpToArchive(bm.activeObjects[index])
 		}
+		bm.usage.remove(bm.activeObjects[index])
 		bm.activeObjects[index] = obj
 	} else {
 		bm.activeObjects = append(bm.activeObjects, obj)
 	}
+	bm.usage.add(obj)
 
 	return obj
 }
 
-func getNewGenerationIfZero(generation int64) int64 {
-	if generation == 0 {
-		return time.Now().UnixNano() / 1000
+// newGeneration returns the generation of a new version of the object,
+// based on the current time, like in Cloud Storage, but always greater than
+// the generations of its previous versions, so it strictly increases even
+// when the object is overwritten within the same microsecond.
+func (bm *bucketInMemory) newGeneration(objectName string) int64 {
+	generation := time.Now().UnixNano() / 1000
+	for _, objs := range [][]Object{bm.activeObjects, bm.archivedObjects} {
+		for _, obj := range objs {
+			if obj.Name == objectName && obj.Generation >= generation {
+				generation = obj.Generation + 1
+			}
+		}
 	}
 	return generation
 }
@@ -74,6 +148,7 @@ func (bm *bucketInMemory) deleteObject(obj Object, matchGeneration bool) {
 
 func (bm *bucketInMemory) cpToArchive(obj Object) {
 	bm.archivedObjects = append(bm.archivedObjects, obj)
+	bm.usage.add(obj)
 }
 
 func (bm *bucketInMemory) mvToArchive(obj Object) {
@@ -87,6 +162,7 @@ func (bm *bucketInMemory) deleteFromObjectList(obj Object, active bool) {
 		objects = bm.archivedObjects
 	}
 	index := findObject(obj, objects, !active)
+	bm.usage.remove(objects[index])
 	objects[index] = objects[len(objects)-1]
 	if active {
 		bm.activeObjects = objects[:len(objects)-1]
@@ -111,97 +187,304 @@ func findObject(obj Object, objectList []Object, matchGeneration bool) int {
 
 // NewStorageMemory creates an instance of StorageMemory.
 func NewStorageMemory(objects []Object) Storage {
+	return NewStorageMemoryWithLimits(objects, MemoryLimits{})
+}
+
+// NewStorageMemoryWithLimits creates an instance of StorageMemory that
+// limits the objects it stores. The initial objects aren't limited.
+func NewStorageMemoryWithLimits(objects []Object, limits MemoryLimits) Storage {
 	s := &storageMemory{
-		buckets: make(map[string]bucketInMemory),
+		buckets: make(map[string]*bucketInMemory),
+		limits:  limits,
+		usage:   &memoryUsage{},
 	}
 	for _, o := range objects {
-		s.CreateBucket(o.BucketName, false)
-		bucket := s.buckets[o.BucketName]
-		bucket.addObject(o)
-		s.buckets[o.BucketName] = bucket
+		s.CreateBucket(o.BucketName, BucketAttrs{})
+		s.buckets[o.BucketName].addObject(o)
 	}
 	return s
 }
 
+// lockBucket looks the bucket up and locks it, for reading or for writing,
+// returning the function that unlocks it.
+func (s *storageMemory) lockBucket(name string, write bool) (*bucketInMemory, func(), error) {
+	for {
+		s.mtx.RLock()
+		bucket, found := s.buckets[name]
+		s.mtx.RUnlock()
+		if !found {
+			return nil, nil, fmt.Errorf("no bucket named %s", name)
+		}
+		unlock := bucket.mtx.RUnlock
+		if write {
+			bucket.mtx.Lock()
+			unlock = bucket.mtx.Unlock
+		} else {
+			bucket.mtx.RLock()
+		}
+		if !bucket.deleted {
+			return bucket, unlock, nil
+		}
+		// the bucket was deleted while waiting for its lock, and may have
+		// been created again.
+		unlock()
+	}
+}
+
+// lockOrCreateBucket locks the bucket for writing, creating it when it
+// doesn't exist.
+func (s *storageMemory) lockOrCreateBucket(name string) (*bucketInMemory, func()) {
+	for {
+		if bucket, unlock, err := s.lockBucket(name, true); err == nil {
+			return bucket, unlock
+		}
+		s.mtx.Lock()
+		if _, found := s.buckets[name]; !found {
+			s.buckets[name] = newBucketInMemory(name, BucketAttrs{}, s.usage)
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// bucketList returns the buckets of the backend, without locking them.
+func (s *storageMemory) bucketList() []*bucketInMemory {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	buckets := make([]*bucketInMemory, 0, len(s.buckets))
+	for _, bucket := range s.buckets {
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
 // CreateBucket creates a bucket.
-func (s *storageMemory) CreateBucket(name string, versioningEnabled bool) error {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	bucket, err := s.getBucketInMemory(name)
-	if err == nil {
-		if bucket.VersioningEnabled != versioningEnabled {
-			return fmt.Errorf("a bucket named %s already exists, but with different properties", name)
+func (s *storageMemory) CreateBucket(name string, bucketAttrs BucketAttrs) error {
+	for {
+		if bucket, unlock, err := s.lockBucket(name, false); err == nil {
+			defer unlock()
+			if !reflect.DeepEqual(bucket.Attrs(), bucketAttrs) {
+				return fmt.Errorf("a bucket named %s already exists, but with different properties", name)
+			}
+			return nil
+		}
+		s.mtx.Lock()
+		_, found := s.buckets[name]
+		if !found {
+			s.buckets[name] = newBucketInMemory(name, bucketAttrs, s.usage)
+		}
+		s.mtx.Unlock()
+		if !found {
+			return nil
 		}
-		return nil
 	}
-	s.buckets[name] = newBucketInMemory(name, versioningEnabled)
-	return nil
 }
 
 // ListBuckets lists buckets currently registered in the backend.
 func (s *storageMemory) ListBuckets() ([]Bucket, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
 	buckets := []Bucket{}
-	for _, bucketInMemory := range s.buckets {
-		buckets = append(buckets, Bucket{bucketInMemory.Name, bucketInMemory.VersioningEnabled, bucketInMemory.TimeCreated})
+	for _, bucket := range s.bucketList() {
+		bucket.mtx.RLock()
+		if !bucket.deleted {
+			buckets = append(buckets, bucket.Bucket)
+		}
+		bucket.mtx.RUnlock()
 	}
 	return buckets, nil
 }
 
 // GetBucket retrieves the bucket information from the backend.
 func (s *storageMemory) GetBucket(name string) (Bucket, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
-	bucketInMemory, err := s.getBucketInMemory(name)
-	return Bucket{bucketInMemory.Name, bucketInMemory.VersioningEnabled, bucketInMemory.TimeCreated}, err
+	bucket, unlock, err := s.lockBucket(name, false)
+	if err != nil {
+		return Bucket{}, err
+	}
+	defer unlock()
+	return bucket.Bucket, nil
 }
 
-func (s *storageMemory) getBucketInMemory(name string) (bucketInMemory, error) {
-	if bucketInMemory, found := s.buckets[name]; found {
-		return bucketInMemory, nil
+// UpdateBucket replaces the attributes of the bucket.
+func (s *storageMemory) UpdateBucket(name string, attrs BucketAttrs) error {
+	bucket, unlock, err := s.lockBucket(name, true)
+	if err != nil {
+		return BucketNotFound
 	}
-	return bucketInMemory{}, fmt.Errorf("no bucket named %s", name)
+	defer unlock()
+	bucket.setAttrs(attrs)
+	return nil
 }
 
 // DeleteBucket removes the bucket from the backend.
 func (s *storageMemory) DeleteBucket(name string) error {
-	objs, err := s.ListObjects(name, "", false)
+	bucket, unlock, err := s.lockBucket(name, true)
 	if err != nil {
 		return BucketNotFound
 	}
-	if len(objs) > 0 {
+	defer unlock()
+	if len(bucket.activeObjects) > 0 {
 		return BucketNotEmpty
 	}
-
+	// the noncurrent versions left in the bucket are deleted along with it.
+	for _, obj := range bucket.archivedObjects {
+		bucket.usage.remove(obj)
+	}
+	bucket.deleted = true
 	s.mtx.Lock()
-	defer s.mtx.Unlock()
 	delete(s.buckets, name)
+	s.mtx.Unlock()
 	return nil
 }
 
 // CreateObject stores an object in the backend.
 func (s *storageMemory) CreateObject(obj Object) (Object, error) {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	bucketInMemory, err := s.getBucketInMemory(obj.BucketName)
+	return s.createObject(obj, Conditions{})
+}
+
+func (s *storageMemory) limited() bool {
+	return s.limits.MaxBytes > 0 || s.limits.MaxObjects > 0
+}
+
+func (s *storageMemory) createObject(obj Object, conds Conditions) (Object, error) {
+	if s.limited() {
+		s.limitsMtx.Lock()
+		defer s.limitsMtx.Unlock()
+	}
+	bucket, unlock := s.lockOrCreateBucket(obj.BucketName)
+	defer unlock()
+	if !conds.IsZero() {
+		var current *ObjectAttrs
+		if index := findObject(obj, bucket.activeObjects, false); index >= 0 {
+			current = &bucket.activeObjects[index].ObjectAttrs
+		}
+		if err := conds.check(current); err != nil {
+			return Object{}, err
+		}
+	}
+	if err := s.makeRoom(bucket, obj); err != nil {
+		return Object{}, err
+	}
+	return bucket.addObject(obj), nil
+}
+
+// makeRoom checks that storing the object in the bucket, which must be
+// locked for writing, doesn't exceed the limits of the backend, evicting the
+// oldest objects when configured to do so. The live version of the object,
+// when replaced without versioning, doesn't count.
+//
+// The limits are checked against the running usage, and the objects are
+// only sorted when some of them must be evicted. The other buckets are
+// locked one at a time, as writes that could wait for the lock of this one
+// while holding theirs are serialized by limitsMtx.
+func (s *storageMemory) makeRoom(bucket *bucketInMemory, obj Object) error {
+	if !s.limited() {
+		return nil
+	}
+	size := int64(len(obj.Content))
+	if s.limits.MaxBytes > 0 && size > s.limits.MaxBytes {
+		return fmt.Errorf("%w: the object has %d bytes, the limit is %d", CapacityExceeded, size, s.limits.MaxBytes)
+	}
+	var replacedBytes, replacedObjects int64
+	if !bucket.VersioningEnabled {
+		if index := findObject(obj, bucket.activeObjects, false); index >= 0 {
+			replacedBytes = int64(len(bucket.activeObjects[index].Content))
+			replacedObjects = 1
+		}
+	}
+	exceeded := func() bool {
+		usedBytes, objectCount := s.usage.load()
+		return (s.limits.MaxBytes > 0 && usedBytes-replacedBytes+size > s.limits.MaxBytes) ||
+			(s.limits.MaxObjects > 0 && objectCount-replacedObjects+1 > int64(s.limits.MaxObjects))
+	}
+	if !exceeded() {
+		return nil
+	}
+	if !s.limits.EvictOldest {
+		return fmt.Errorf("%w: the limits are %d bytes and %d objects", CapacityExceeded, s.limits.MaxBytes, s.limits.MaxObjects)
+	}
+
+	type storedObject struct {
+		Object
+		bucket     *bucketInMemory
+		noncurrent bool
+	}
+	var stored []storedObject
+	for _, b := range s.bucketList() {
+		if b != bucket {
+			b.mtx.RLock()
+		}
+		if !b.deleted {
+			for _, o := range b.archivedObjects {
+				stored = append(stored, storedObject{o, b, true})
+			}
+			for _, o := range b.activeObjects {
+				if replacedObjects > 0 && o.IDNoGen() == obj.IDNoGen() {
+					continue
+				}
+				stored = append(stored, storedObject{o, b, false})
+			}
+		}
+		if b != bucket {
+			b.mtx.RUnlock()
+		}
+	}
+	sort.SliceStable(stored, func(i, j int) bool {
+		if stored[i].noncurrent != stored[j].noncurrent {
+			return stored[i].noncurrent
+		}
+		return stored[i].Generation < stored[j].Generation
+	})
+	for exceeded() && len(stored) > 0 {
+		evicted := stored[0]
+		stored = stored[1:]
+		if evicted.bucket != bucket {
+			evicted.bucket.mtx.Lock()
+		}
+		// the object may have been deleted since the objects were listed.
+		objects := evicted.bucket.activeObjects
+		if evicted.noncurrent {
+			objects = evicted.bucket.archivedObjects
+		}
+		if !evicted.bucket.deleted && findObject(evicted.Object, objects, true) >= 0 {
+			evicted.bucket.deleteFromObjectList(evicted.Object, !evicted.noncurrent)
+		}
+		if evicted.bucket != bucket {
+			evicted.bucket.mtx.Unlock()
+		}
+	}
+	return nil
+}
+
+// CreateObjectStream stores an object with the content read from the given
+// reader. The memory backend keeps the whole content in memory anyway.
+func (s *storageMemory) CreateObjectStream(attrs ObjectAttrs, content io.Reader) (ObjectAttrs, error) {
+	return s.CreateObjectIf(attrs, content, Conditions{})
+}
+
+// CreateObjectIf stores an object with the content read from the given
+// reader if the live version of the object meets the conditions.
+func (s *storageMemory) CreateObjectIf(attrs ObjectAttrs, content io.Reader, conds Conditions) (ObjectAttrs, error) {
+	data, err := io.ReadAll(content)
 	if err != nil {
-		bucketInMemory = newBucketInMemory(obj.BucketName, false)
+		return ObjectAttrs{}, err
+	}
+	attrs.Size = int64(len(data))
+	if attrs.Crc32c == "" {
+		attrs.Crc32c = checksum.EncodedCrc32cChecksum(data)
 	}
-	newObj := bucketInMemory.addObject(obj)
-	s.buckets[obj.BucketName] = bucketInMemory
-	return newObj, nil
+	if attrs.Md5Hash == "" {
+		attrs.Md5Hash = checksum.EncodedMd5Hash(data)
+	}
+	obj, err := s.createObject(Object{ObjectAttrs: attrs, Content: data}, conds)
+	return obj.ObjectAttrs, err
 }
 
 // ListObjects lists the objects in a given bucket with a given prefix and
 // delimeter.
 func (s *storageMemory) ListObjects(bucketName string, prefix string, versions bool) ([]ObjectAttrs, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
-	bucketInMemory, err := s.getBucketInMemory(bucketName)
+	bucketInMemory, unlock, err := s.lockBucket(bucketName, false)
 	if err != nil {
 		return []ObjectAttrs{}, err
 	}
+	defer unlock()
 	objAttrs := make([]ObjectAttrs, 0, len(bucketInMemory.activeObjects))
 	for _, obj := range bucketInMemory.activeObjects {
 		if prefix != "" && !strings.HasPrefix(obj.Name, prefix) {
@@ -229,105 +512,139 @@ func (s *storageMemory) GetObject(bucketName, objectName string) (Object, error)
 
 // GetObjectWithGeneration retrieves a specific version of the object.
 func (s *storageMemory) GetObjectWithGeneration(bucketName, objectName string, generation int64) (Object, error) {
-	s.mtx.RLock()
-	defer s.mtx.RUnlock()
-	bucketInMemory, err := s.getBucketInMemory(bucketName)
+	bucketInMemory, unlock, err := s.lockBucket(bucketName, false)
 	if err != nil {
 		return Object{}, err
 	}
+	defer unlock()
 	matchGeneration := false
 	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName}}
-	listToConsider := bucketInMemory.activeObjects
+	listsToConsider := [][]Object{bucketInMemory.activeObjects}
 	if generation != 0 {
 		matchGeneration = true
 		obj.Generation = generation
-		listToConsider = append(listToConsider, bucketInMemory.archivedObjects...)
+		listsToConsider = append(listsToConsider, bucketInMemory.archivedObjects)
 	}
-	index := findObject(obj, listToConsider, matchGeneration)
-	if index < 0 {
-		return obj, errors.New("object not found")
+	for _, objects := range listsToConsider {
+		if index := findObject(obj, objects, matchGeneration); index >= 0 {
+			return objects[index], nil
+		}
 	}
+	return obj, errors.New("object not found")
+}
 
-	return listToConsider[index], nil
+// GetObjectStream retrieves the given generation of the object, or the live
+// version when generation is zero.
+func (s *storageMemory) GetObjectStream(bucketName, objectName string, generation int64) (StreamingObject, error) {
+	obj, err := s.GetObjectWithGeneration(bucketName, objectName, generation)
+	if err != nil {
+		return StreamingObject{}, err
+	}
+	return StreamingObject{
+		ObjectAttrs: obj.ObjectAttrs,
+		Content:     nopSeekCloser{bytes.NewReader(obj.Content)},
+	}, nil
 }
 
 func (s *storageMemory) DeleteObject(bucketName, objectName string) error {
-	obj, err := s.GetObject(bucketName, objectName)
+	bucketInMemory, unlock, err := s.lockBucket(bucketName, true)
 	if err != nil {
 		return err
 	}
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	bucketInMemory, err := s.getBucketInMemory(bucketName)
+	defer unlock()
+	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName}}
+	index := findObject(obj, bucketInMemory.activeObjects, false)
+	if index < 0 {
+		return errors.New("object not found")
+	}
+	bucketInMemory.deleteObject(bucketInMemory.activeObjects[index], true)
+	return nil
+}
+
+// DeleteObjectGeneration deletes the given generation of the object. Deleting
+// the live version behaves as DeleteObject, while noncurrent versions are
+// removed permanently.
+func (s *storageMemory) DeleteObjectGeneration(bucketName, objectName string, generation int64) error {
+	bucketInMemory, unlock, err := s.lockBucket(bucketName, true)
 	if err != nil {
 		return err
 	}
-	bucketInMemory.deleteObject(obj, true)
-	s.buckets[bucketName] = bucketInMemory
+	defer unlock()
+	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName, Generation: generation}}
+	if index := findObject(obj, bucketInMemory.activeObjects, true); index >= 0 {
+		bucketInMemory.deleteObject(bucketInMemory.activeObjects[index], true)
+	} else if index := findObject(obj, bucketInMemory.archivedObjects, true); index >= 0 {
+		bucketInMemory.deleteFromObjectList(obj, false)
+	} else {
+		return errors.New("object not found")
+	}
 	return nil
 }
 
-// PatchObject updates an object metadata.
-func (s *storageMemory) PatchObject(bucketName, objectName string, metadata map[string]string) (Object, error) {
-	obj, err := s.GetObject(bucketName, objectName)
+// SetObjectStorageClass changes the storage class of the given generation of
+// the object, which can be a noncurrent version.
+func (s *storageMemory) SetObjectStorageClass(bucketName, objectName string, generation int64, storageClass string) error {
+	bucketInMemory, unlock, err := s.lockBucket(bucketName, true)
 	if err != nil {
-		return Object{}, err
-	}
-	if obj.Metadata == nil {
-		obj.Metadata = map[string]string{}
+		return err
 	}
-	for k, v := range metadata {
-		obj.Metadata[k] = v
+	defer unlock()
+	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName, Generation: generation}}
+	for _, objects := range [][]Object{bucketInMemory.activeObjects, bucketInMemory.archivedObjects} {
+		if index := findObject(obj, objects, true); index >= 0 {
+			objects[index].StorageClass = storageClass
+			return nil
+		}
 	}
-	s.CreateObject(obj) // recreate object
-	return obj, nil
+	return errors.New("object not found")
+}
+
+// UpdateObjectAttrs replaces the attributes of the object, which must have
+// the given generation, without rewriting its content or creating a new
+// generation.
+func (s *storageMemory) UpdateObjectAttrs(bucketName, objectName string, generation int64, attrs ObjectAttrs) error {
+	return s.UpdateObjectAttrsIf(bucketName, objectName, generation, attrs, Conditions{})
 }
 
-// UpdateObject replaces an object metadata.
-func (s *storageMemory) UpdateObject(bucketName, objectName string, metadata map[string]string) (Object, error) {
-	obj, err := s.GetObject(bucketName, objectName)
+// UpdateObjectAttrsIf replaces the attributes of the object if the given
+// generation meets the conditions.
+func (s *storageMemory) UpdateObjectAttrsIf(bucketName, objectName string, generation int64, attrs ObjectAttrs, conds Conditions) error {
+	bucketInMemory, unlock, err := s.lockBucket(bucketName, true)
 	if err != nil {
-		return Object{}, err
+		return err
 	}
-	obj.Metadata = map[string]string{}
-	for k, v := range metadata {
-		obj.Metadata[k] = v
+	defer unlock()
+	obj := Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: objectName, Generation: generation}}
+	for _, objects := range [][]Object{bucketInMemory.activeObjects, bucketInMemory.archivedObjects} {
+		if index := findObject(obj, objects, true); index >= 0 {
+			if err := conds.check(&objects[index].ObjectAttrs); err != nil {
+				return err
+			}
+			attrs.BucketName = bucketName
+			attrs.Name = objectName
+			attrs.Generation = generation
+			attrs.Size = objects[index].Size
+			objects[index].ObjectAttrs = attrs
+			return nil
+		}
 	}
-	s.CreateObject(obj) // recreate object
-	return obj, nil
+	return errors.New("object not found")
 }
 
-func (s *storageMemory) ComposeObject(bucketName string, objectNames []string, destinationName string, metadata map[string]string, contentType string) (Object, error) {
+func (s *storageMemory) ComposeObject(bucketName string, objectNames []string, dest ObjectAttrs, conds Conditions) (Object, error) {
 	var data []byte
+	var componentCount int
 	for _, n := range objectNames {
 		obj, err := s.GetObject(bucketName, n)
 		if err != nil {
 			return Object{}, err
 		}
 		data = append(data, obj.Content...)
+		componentCount += obj.componentCount()
 	}
 
-	dest, err := s.GetObject(bucketName, destinationName)
-	if err != nil {
-		dest = Object{
-			ObjectAttrs: ObjectAttrs{
-				BucketName:  bucketName,
-				Name:        destinationName,
-				ContentType: contentType,
-				Created:     time.Now().String(),
-			},
-		}
-	}
-
-	dest.Content = data
-	dest.Crc32c = checksum.EncodedCrc32cChecksum(data)
-	dest.Md5Hash = checksum.EncodedMd5Hash(data)
-	dest.Metadata = metadata
-
-	result, err := s.CreateObject(dest)
-	if err != nil {
-		return result, err
-	}
-
-	return result, nil
+	composed := Object{ObjectAttrs: composedAttrs(bucketName, dest, componentCount), Content: data}
+	composed.Crc32c = checksum.EncodedCrc32cChecksum(data)
+	composed.Md5Hash = checksum.EncodedMd5Hash(data)
+	return s.createObject(composed, conds)
 }
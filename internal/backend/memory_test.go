@@ -0,0 +1,97 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStorageMemoryLimits(t *testing.T) {
+	storage := NewStorageMemoryWithLimits(nil, MemoryLimits{MaxBytes: 10, MaxObjects: 2})
+	noError(t, storage.CreateBucket("some-bucket", BucketAttrs{}))
+	create := func(name, content string) error {
+		_, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: name}, Content: []byte(content)})
+		return err
+	}
+
+	noError(t, create("a.txt", "12345"))
+	noError(t, create("b.txt", "12345"))
+	// replacing an object only counts the new content.
+	noError(t, create("a.txt", "54321"))
+	for _, err := range []error{create("c.txt", "1"), create("a.txt", "12345678901")} {
+		if !errors.Is(err, CapacityExceeded) {
+			t.Errorf("wrong error\nwant %v\ngot  %v", CapacityExceeded, err)
+		}
+	}
+	noError(t, storage.DeleteObject("some-bucket", "b.txt"))
+	noError(t, create("c.txt", "1"))
+}
+
+func TestStorageMemoryEvictOldest(t *testing.T) {
+	storage := NewStorageMemoryWithLimits(nil, MemoryLimits{MaxObjects: 3, EvictOldest: true})
+	noError(t, storage.CreateBucket("versioned-bucket", BucketAttrs{VersioningEnabled: true}))
+	noError(t, storage.CreateBucket("some-bucket", BucketAttrs{}))
+	objs := []ObjectAttrs{
+		{BucketName: "some-bucket", Name: "old.txt", Generation: 1},
+		{BucketName: "versioned-bucket", Name: "file.txt", Generation: 2},
+		{BucketName: "versioned-bucket", Name: "file.txt", Generation: 3},
+		{BucketName: "some-bucket", Name: "new.txt", Generation: 4},
+		{BucketName: "some-bucket", Name: "newer.txt", Generation: 5},
+	}
+	for _, attrs := range objs {
+		_, err := storage.CreateObject(Object{ObjectAttrs: attrs, Content: []byte("data")})
+		noError(t, err)
+	}
+
+	// the noncurrent version of file.txt is evicted first, and then the
+	// oldest live object.
+	_, err := storage.GetObjectWithGeneration("versioned-bucket", "file.txt", 2)
+	shouldError(t, err)
+	_, err = storage.GetObject("some-bucket", "old.txt")
+	shouldError(t, err)
+	for _, attrs := range objs[2:] {
+		_, err := storage.GetObjectWithGeneration(attrs.BucketName, attrs.Name, attrs.Generation)
+		noError(t, err)
+	}
+}
+
+func TestStorageMemoryUsage(t *testing.T) {
+	storage := NewStorageMemoryWithLimits(nil, MemoryLimits{MaxObjects: 4, EvictOldest: true}).(*storageMemory)
+	noError(t, storage.CreateBucket("versioned-bucket", BucketAttrs{VersioningEnabled: true}))
+	noError(t, storage.CreateBucket("some-bucket", BucketAttrs{}))
+	create := func(bucketName, name, content string) {
+		_, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: bucketName, Name: name}, Content: []byte(content)})
+		noError(t, err)
+	}
+	create("versioned-bucket", "file.txt", "first")
+	create("versioned-bucket", "file.txt", "second")
+	create("some-bucket", "a.txt", "12345")
+	create("some-bucket", "a.txt", "123")
+	create("some-bucket", "b.txt", "1")
+	create("some-bucket", "c.txt", "12")
+	noError(t, storage.DeleteObject("versioned-bucket", "file.txt"))
+	noError(t, storage.DeleteObject("some-bucket", "b.txt"))
+
+	var want memoryUsage
+	for _, bucket := range storage.buckets {
+		for _, objs := range [][]Object{bucket.activeObjects, bucket.archivedObjects} {
+			for _, obj := range objs {
+				want.add(obj)
+			}
+		}
+	}
+	if *storage.usage != want {
+		t.Errorf("wrong usage\nwant %+v\ngot  %+v", want, *storage.usage)
+	}
+
+	// the noncurrent versions are deleted along with the bucket.
+	noError(t, storage.DeleteBucket("versioned-bucket"))
+	noError(t, storage.DeleteObject("some-bucket", "a.txt"))
+	noError(t, storage.DeleteObject("some-bucket", "c.txt"))
+	if *storage.usage != (memoryUsage{}) {
+		t.Errorf("wrong usage after deleting all the objects\nwant %+v\ngot  %+v", memoryUsage{}, *storage.usage)
+	}
+}
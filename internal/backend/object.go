@@ -6,6 +6,8 @@ package backend
 
 import (
 	"fmt"
+	"io"
+	"time"
 
 	"cloud.google.com/go/storage"
 )
@@ -17,15 +19,30 @@ type ObjectAttrs struct {
 	Size            int64  `json:"-"`
 	ContentType     string
 	ContentEncoding string
-	Crc32c          string
-	Md5Hash         string
-	Etag            string
-	ACL             []storage.ACLRule
-	Metadata        map[string]string
-	Created         string
-	Deleted         string
-	Updated         string
-	Generation      int64
+	CacheControl    string
+	// ContentDisposition and ContentLanguage are served as headers on
+	// downloads, along with CacheControl.
+	ContentDisposition string
+	ContentLanguage    string
+	Crc32c             string
+	Md5Hash            string
+	Etag               string
+	ACL                []storage.ACLRule
+	Metadata           map[string]string
+	Created            string
+	Deleted            string
+	Updated            string
+	Generation         int64
+	Metageneration     int64
+	StorageClass       string
+	ComponentCount     int
+	// CustomerKeySHA256 is the SHA256 of the customer-supplied encryption
+	// key of the object, if any.
+	CustomerKeySHA256 string
+	// KMSKeyName is the Cloud KMS key the object is encrypted with, if any.
+	KMSKeyName string
+	// CustomTime is the user-specified timestamp of the object, if any.
+	CustomTime string
 }
 
 // ID is used for comparing objects.
@@ -38,8 +55,64 @@ func (o *ObjectAttrs) IDNoGen() string {
 	return fmt.Sprintf("%s/%s", o.BucketName, o.Name)
 }
 
+// nextGeneration returns the generation of a new version of an object whose
+// latest version has the given generation, zero if there's none: the current
+// time in microseconds, like in Cloud Storage, but always greater than the
+// latest generation, so it strictly increases even when the object is
+// overwritten within the same microsecond.
+func nextGeneration(latest int64) int64 {
+	generation := time.Now().UnixNano() / 1000
+	if generation <= latest {
+		return latest + 1
+	}
+	return generation
+}
+
+// composedAttrs returns the attributes of a new object composed from sources
+// with the given number of components into the destination described by
+// dest: only its name, content type, metadata, ACL and encryption keys are
+// kept, as nothing is inherited from the version being replaced.
+func composedAttrs(bucketName string, dest ObjectAttrs, componentCount int) ObjectAttrs {
+	now := time.Now().Format(timestampFormat)
+	return ObjectAttrs{
+		BucketName:        bucketName,
+		Name:              dest.Name,
+		ContentType:       dest.ContentType,
+		Metadata:          dest.Metadata,
+		ACL:               dest.ACL,
+		CustomerKeySHA256: dest.CustomerKeySHA256,
+		KMSKeyName:        dest.KMSKeyName,
+		Created:           now,
+		Updated:           now,
+		ComponentCount:    componentCount,
+	}
+}
+
+// componentCount returns the number of components the object contributes to
+// a composite object it's part of.
+func (o *ObjectAttrs) componentCount() int {
+	if o.ComponentCount > 0 {
+		return o.ComponentCount
+	}
+	return 1
+}
+
 // Object represents the object that is stored within the fake server.
 type Object struct {
 	ObjectAttrs
 	Content []byte
 }
+
+// StreamingObject is an object with its content read from the backend on
+// demand, so large objects don't need to be loaded into memory. Callers must
+// close the content.
+type StreamingObject struct {
+	ObjectAttrs
+	Content io.ReadSeekCloser
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
@@ -0,0 +1,405 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+	"google.golang.org/api/iterator"
+)
+
+// ProxyConfig configures the proxy backend.
+type ProxyConfig struct {
+	// Client is the client used to read from Cloud Storage.
+	Client *storage.Client
+	// Buckets are the buckets whose reads are forwarded to Cloud Storage.
+	Buckets []string
+}
+
+// storageProxy is an implementation of the backend storage that forwards
+// the reads of buckets and objects missing from another backend to Cloud
+// Storage, keeping a copy of them in that backend. Writes are never
+// forwarded, so they only change the local copies.
+//
+// Objects deleted locally are remembered in the local backend, so they
+// aren't read from Cloud Storage again, even after a restart. The listings
+// of Cloud Storage are recorded the first time each prefix is listed.
+type storageProxy struct {
+	Storage
+	client  *storage.Client
+	buckets map[string]bool
+
+	mtx     sync.Mutex
+	deleted map[string]bool
+	listed  map[string][]ObjectAttrs
+}
+
+// proxyDeletedBucket is the local bucket where the proxy records the objects
+// deleted locally, as empty objects named <bucket>/<object>. Its name isn't
+// valid in Cloud Storage, so it can't clash with the buckets of the server,
+// and it's hidden from the listings of buckets.
+const proxyDeletedBucket = "_fake-gcs-proxy-deleted"
+
+// refreshableStorageProxy is the proxy backend of a local backend that can
+// be refreshed.
+type refreshableStorageProxy struct {
+	*storageProxy
+}
+
+// NewStorageProxy creates an instance of the proxy backend, with the copies
+// of the buckets and objects read from Cloud Storage stored in local. With a
+// persistent local backend, the copies are read again in later runs without
+// reaching Cloud Storage. The proxy can be refreshed when local can.
+func NewStorageProxy(local Storage, config ProxyConfig) (Storage, error) {
+	buckets := make(map[string]bool, len(config.Buckets))
+	for _, name := range config.Buckets {
+		buckets[name] = true
+	}
+	s := &storageProxy{
+		Storage: local,
+		client:  config.Client,
+		buckets: buckets,
+		deleted: make(map[string]bool),
+		listed:  make(map[string][]ObjectAttrs),
+	}
+	if _, err := local.GetBucket(proxyDeletedBucket); err == nil {
+		deleted, err := local.ListObjects(proxyDeletedBucket, "", false)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range deleted {
+			s.deleted[obj.Name] = true
+		}
+	}
+	if _, ok := local.(Refresher); ok {
+		return refreshableStorageProxy{s}, nil
+	}
+	return s, nil
+}
+
+// Refresh imports the files added to the local backend by other tools.
+func (s refreshableStorageProxy) Refresh() (int, error) {
+	return s.Storage.(Refresher).Refresh()
+}
+
+// Close closes the local backend, if it can be closed.
+func (s *storageProxy) Close() error {
+	if closer, ok := s.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *storageProxy) isDeleted(bucketName, objectName string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.deleted[bucketName+"/"+objectName]
+}
+
+// setDeleted records whether the object of a proxied bucket was deleted
+// locally, in memory and in the local backend.
+func (s *storageProxy) setDeleted(bucketName, objectName string, deleted bool) error {
+	if !s.buckets[bucketName] {
+		return nil
+	}
+	key := bucketName + "/" + objectName
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.deleted[key] == deleted {
+		return nil
+	}
+	if !deleted {
+		if err := s.Storage.DeleteObject(proxyDeletedBucket, key); err != nil {
+			return err
+		}
+		delete(s.deleted, key)
+		return nil
+	}
+	if _, err := s.Storage.GetBucket(proxyDeletedBucket); err != nil {
+		if err := s.Storage.CreateBucket(proxyDeletedBucket, BucketAttrs{}); err != nil {
+			return err
+		}
+	}
+	if _, err := s.Storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: proxyDeletedBucket, Name: key}}); err != nil {
+		return err
+	}
+	s.deleted[key] = true
+	return nil
+}
+
+// ListBuckets lists the local buckets, without the bucket where the deleted
+// objects are recorded.
+func (s *storageProxy) ListBuckets() ([]Bucket, error) {
+	buckets, err := s.Storage.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	visible := buckets[:0]
+	for _, bucket := range buckets {
+		if bucket.Name != proxyDeletedBucket {
+			visible = append(visible, bucket)
+		}
+	}
+	return visible, nil
+}
+
+// GetBucket retrieves the bucket, copying it from Cloud Storage if it's
+// missing.
+func (s *storageProxy) GetBucket(name string) (Bucket, error) {
+	bucket, err := s.Storage.GetBucket(name)
+	if err == nil || !s.buckets[name] {
+		return bucket, err
+	}
+	if err := s.fetchBucket(name); err != nil {
+		return Bucket{}, err
+	}
+	return s.Storage.GetBucket(name)
+}
+
+func (s *storageProxy) fetchBucket(name string) error {
+	attrs, err := s.client.Bucket(name).Attrs(context.Background())
+	if err != nil {
+		return err
+	}
+	return s.Storage.CreateBucket(name, BucketAttrs{
+		DefaultStorageClass: attrs.StorageClass,
+		Labels:              attrs.Labels,
+	})
+}
+
+// ListObjects lists the local objects along with the objects in Cloud
+// Storage that weren't copied yet.
+func (s *storageProxy) ListObjects(bucketName string, prefix string, versions bool) ([]ObjectAttrs, error) {
+	if !s.buckets[bucketName] {
+		return s.Storage.ListObjects(bucketName, prefix, versions)
+	}
+	if _, err := s.GetBucket(bucketName); err != nil {
+		return nil, err
+	}
+	objects, err := s.Storage.ListObjects(bucketName, prefix, versions)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := s.listRemote(bucketName, prefix)
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		local[obj.Name] = true
+	}
+	for _, obj := range remote {
+		if !local[obj.Name] && !s.isDeleted(bucketName, obj.Name) {
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+func (s *storageProxy) listRemote(bucketName, prefix string) ([]ObjectAttrs, error) {
+	key := bucketName + "\x00" + prefix
+	s.mtx.Lock()
+	objects, ok := s.listed[key]
+	s.mtx.Unlock()
+	if ok {
+		return objects, nil
+	}
+	it := s.client.Bucket(bucketName).Objects(context.Background(), &storage.Query{Prefix: prefix})
+	objects = []ObjectAttrs{}
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, fromRemoteObjectAttrs(attrs))
+	}
+	s.mtx.Lock()
+	s.listed[key] = objects
+	s.mtx.Unlock()
+	return objects, nil
+}
+
+// fromRemoteObjectAttrs converts the attributes of an object in Cloud
+// Storage. The generations aren't kept, as they're assigned by the local
+// backend.
+func fromRemoteObjectAttrs(attrs *storage.ObjectAttrs) ObjectAttrs {
+	obj := ObjectAttrs{
+		BucketName:         attrs.Bucket,
+		Name:               attrs.Name,
+		Size:               attrs.Size,
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentLanguage:    attrs.ContentLanguage,
+		ACL:                attrs.ACL,
+		Metadata:           attrs.Metadata,
+		StorageClass:       attrs.StorageClass,
+		Created:            attrs.Created.Format(timestampFormat),
+		Updated:            attrs.Updated.Format(timestampFormat),
+	}
+	if attrs.CRC32C != 0 {
+		crc32c := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc32c, attrs.CRC32C)
+		obj.Crc32c = checksum.EncodedChecksum(crc32c)
+	}
+	if len(attrs.MD5) > 0 {
+		obj.Md5Hash = checksum.EncodedHash(attrs.MD5)
+	}
+	if !attrs.CustomTime.IsZero() {
+		obj.CustomTime = attrs.CustomTime.Format(timestampFormat)
+	}
+	return obj
+}
+
+// fetchObject copies the live version of the object from Cloud Storage,
+// reporting whether it was copied.
+func (s *storageProxy) fetchObject(bucketName, objectName string) bool {
+	if !s.buckets[bucketName] || s.isDeleted(bucketName, objectName) {
+		return false
+	}
+	if _, err := s.GetBucket(bucketName); err != nil {
+		return false
+	}
+	ctx := context.Background()
+	obj := s.client.Bucket(bucketName).Object(objectName)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return false
+	}
+	// the content is copied as stored, without decompressive transcoding.
+	reader, err := obj.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	// the checksums are calculated from the content copied.
+	local := fromRemoteObjectAttrs(attrs)
+	local.Crc32c = ""
+	local.Md5Hash = ""
+	_, err = s.Storage.CreateObjectStream(local, reader)
+	return err == nil
+}
+
+// GetObject retrieves the live version of the object, copying it from Cloud
+// Storage if it's missing.
+func (s *storageProxy) GetObject(bucketName, objectName string) (Object, error) {
+	obj, err := s.Storage.GetObject(bucketName, objectName)
+	if err != nil && s.fetchObject(bucketName, objectName) {
+		return s.Storage.GetObject(bucketName, objectName)
+	}
+	return obj, err
+}
+
+// GetObjectWithGeneration retrieves a specific version of the object. Only
+// the live versions of objects are copied from Cloud Storage.
+func (s *storageProxy) GetObjectWithGeneration(bucketName, objectName string, generation int64) (Object, error) {
+	obj, err := s.Storage.GetObjectWithGeneration(bucketName, objectName, generation)
+	if err != nil && s.fetchObject(bucketName, objectName) {
+		return s.Storage.GetObjectWithGeneration(bucketName, objectName, generation)
+	}
+	return obj, err
+}
+
+// GetObjectStream retrieves a version of the object without reading its
+// content, copying the live version from Cloud Storage if it's missing.
+func (s *storageProxy) GetObjectStream(bucketName, objectName string, generation int64) (StreamingObject, error) {
+	obj, err := s.Storage.GetObjectStream(bucketName, objectName, generation)
+	if err != nil && s.fetchObject(bucketName, objectName) {
+		return s.Storage.GetObjectStream(bucketName, objectName, generation)
+	}
+	return obj, err
+}
+
+// CreateObject stores the object locally.
+func (s *storageProxy) CreateObject(obj Object) (Object, error) {
+	if err := s.setDeleted(obj.BucketName, obj.Name, false); err != nil {
+		return Object{}, err
+	}
+	return s.Storage.CreateObject(obj)
+}
+
+// CreateObjectStream stores the object locally.
+func (s *storageProxy) CreateObjectStream(attrs ObjectAttrs, content io.Reader) (ObjectAttrs, error) {
+	if err := s.setDeleted(attrs.BucketName, attrs.Name, false); err != nil {
+		return ObjectAttrs{}, err
+	}
+	return s.Storage.CreateObjectStream(attrs, content)
+}
+
+// CreateObjectIf stores the object locally if it meets the conditions. When
+// conditions are set, the object is copied from Cloud Storage first, so
+// they're checked against the remote object when there's no local copy.
+func (s *storageProxy) CreateObjectIf(attrs ObjectAttrs, content io.Reader, conds Conditions) (ObjectAttrs, error) {
+	if !conds.IsZero() {
+		if obj, err := s.GetObjectStream(attrs.BucketName, attrs.Name, 0); err == nil {
+			obj.Content.Close()
+		}
+	}
+	newAttrs, err := s.Storage.CreateObjectIf(attrs, content, conds)
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	return newAttrs, s.setDeleted(attrs.BucketName, attrs.Name, false)
+}
+
+// DeleteObject deletes the local copy of the object, which won't be read
+// from Cloud Storage again.
+func (s *storageProxy) DeleteObject(bucketName, objectName string) error {
+	err := s.Storage.DeleteObject(bucketName, objectName)
+	if err != nil && !s.existsRemote(bucketName, objectName) {
+		return err
+	}
+	return s.setDeleted(bucketName, objectName, true)
+}
+
+// existsRemote reports whether the object exists in Cloud Storage and wasn't
+// deleted locally.
+func (s *storageProxy) existsRemote(bucketName, objectName string) bool {
+	if !s.buckets[bucketName] || s.isDeleted(bucketName, objectName) {
+		return false
+	}
+	_, err := s.client.Bucket(bucketName).Object(objectName).Attrs(context.Background())
+	return err == nil
+}
+
+// DeleteObjectGeneration deletes the given generation of the local copy of
+// the object.
+func (s *storageProxy) DeleteObjectGeneration(bucketName, objectName string, generation int64) error {
+	if err := s.Storage.DeleteObjectGeneration(bucketName, objectName, generation); err != nil {
+		return err
+	}
+	obj, err := s.Storage.GetObjectStream(bucketName, objectName, 0)
+	if err != nil {
+		return s.setDeleted(bucketName, objectName, true)
+	}
+	obj.Content.Close()
+	return nil
+}
+
+// ComposeObject composes the objects locally, copying the missing source
+// objects from Cloud Storage first.
+func (s *storageProxy) ComposeObject(bucketName string, objectNames []string, dest ObjectAttrs, conds Conditions) (Object, error) {
+	for _, name := range objectNames {
+		obj, err := s.GetObjectStream(bucketName, name, 0)
+		if err != nil {
+			return Object{}, err
+		}
+		obj.Content.Close()
+	}
+	if err := s.setDeleted(bucketName, dest.Name, false); err != nil {
+		return Object{}, err
+	}
+	return s.Storage.ComposeObject(bucketName, objectNames, dest, conds)
+}
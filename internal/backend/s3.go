@@ -0,0 +1,488 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/fake-gcs-server/internal/checksum"
+)
+
+// storageS3 is an implementation of the backend storage that stores data in
+// a bucket of an S3-compatible store, such as MinIO.
+//
+// The layout of the keys in the S3 bucket is the following:
+//
+//	buckets/<bucket>                attributes of the bucket
+//	objects/<bucket>/<object>#<gen> content of a generation of the object
+//	metadata/<bucket>/<object>      attributes of the object
+//
+// Like the fs backend, it keeps only the live version of each object, so it
+// doesn't support versioning. The content of a new generation is stored
+// before its attributes, which point readers to it, and the content of the
+// previous generation is removed afterwards, so readers never see the
+// attributes of a generation along with the content of another one.
+//
+// The S3 API has no conditional writes, so the conditions of CreateObjectIf
+// and UpdateObjectAttrsIf are checked while holding a lock that serializes
+// the writes of each object. They're only atomic when no other server shares
+// the same S3 bucket.
+type storageS3 struct {
+	client  *s3Client
+	objects objectLocks
+}
+
+// s3Object is the record of the attributes of an object in the store.
+type s3Object struct {
+	Attrs ObjectAttrs
+	Size  int64
+}
+
+// NewStorageS3 creates an instance of the backend storage that stores data
+// in the given S3-compatible store. The S3 bucket must already exist.
+func NewStorageS3(objects []Object, config S3Config) (Storage, error) {
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &storageS3{client: client}
+	for _, o := range objects {
+		if _, err := s.CreateObject(o); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func s3BucketKey(name string) string {
+	return "buckets/" + name
+}
+
+func s3ObjectKey(bucketName, objectName string, generation int64) string {
+	return "objects/" + bucketName + "/" + objectName + "#" + strconv.FormatInt(generation, 10)
+}
+
+func s3MetadataKey(bucketName, objectName string) string {
+	return "metadata/" + bucketName + "/" + objectName
+}
+
+func (s *storageS3) getJSON(key string, value interface{}) error {
+	body, err := s.client.get(key, 0)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(value)
+}
+
+func (s *storageS3) putJSON(key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.client.put(key, bytes.NewReader(encoded), int64(len(encoded)), "application/json")
+}
+
+// CreateBucket creates a bucket in the store.
+func (s *storageS3) CreateBucket(name string, bucketAttrs BucketAttrs) error {
+	if bucketAttrs.VersioningEnabled {
+		return errors.New("not implemented: s3 storage type does not support versioning yet")
+	}
+	bucket, err := s.GetBucket(name)
+	if err == nil {
+		if !reflect.DeepEqual(bucket.Attrs(), bucketAttrs) {
+			return fmt.Errorf("a bucket named %s already exists, but with different properties", name)
+		}
+		return nil
+	}
+	bucket = Bucket{Name: name, TimeCreated: time.Now()}
+	bucket.setAttrs(bucketAttrs)
+	return s.putJSON(s3BucketKey(name), bucket)
+}
+
+// ListBuckets lists the buckets in the store.
+func (s *storageS3) ListBuckets() ([]Bucket, error) {
+	keys, err := s.client.list(s3BucketKey(""))
+	if err != nil {
+		return nil, err
+	}
+	buckets := []Bucket{}
+	for _, key := range keys {
+		bucket, err := s.GetBucket(strings.TrimPrefix(key, s3BucketKey("")))
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// GetBucket retrieves the bucket from the store.
+func (s *storageS3) GetBucket(name string) (Bucket, error) {
+	var bucket Bucket
+	if err := s.getJSON(s3BucketKey(name), &bucket); err != nil {
+		if isS3NotFound(err) {
+			return Bucket{}, fmt.Errorf("no bucket named %s", name)
+		}
+		return Bucket{}, err
+	}
+	return bucket, nil
+}
+
+// UpdateBucket replaces the attributes of the bucket.
+func (s *storageS3) UpdateBucket(name string, attrs BucketAttrs) error {
+	if attrs.VersioningEnabled {
+		return errors.New("not implemented: s3 storage type does not support versioning yet")
+	}
+	bucket, err := s.GetBucket(name)
+	if err != nil {
+		return BucketNotFound
+	}
+	bucket.setAttrs(attrs)
+	return s.putJSON(s3BucketKey(name), bucket)
+}
+
+// DeleteBucket removes the bucket from the store.
+func (s *storageS3) DeleteBucket(name string) error {
+	objs, err := s.ListObjects(name, "", false)
+	if err != nil {
+		return BucketNotFound
+	}
+	if len(objs) > 0 {
+		return BucketNotEmpty
+	}
+	return s.client.delete(s3BucketKey(name))
+}
+
+// CreateObject stores the object in the store.
+func (s *storageS3) CreateObject(obj Object) (Object, error) {
+	attrs, err := s.createObject(obj.ObjectAttrs, bytes.NewReader(obj.Content), false, Conditions{})
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{ObjectAttrs: attrs, Content: obj.Content}, nil
+}
+
+// CreateObjectStream stores the object in the store, with the content read
+// from the given reader. The content is spooled to a temporary file first,
+// as the S3 API requires the size of the content upfront.
+func (s *storageS3) CreateObjectStream(attrs ObjectAttrs, content io.Reader) (ObjectAttrs, error) {
+	return s.createObject(attrs, content, true, Conditions{})
+}
+
+// CreateObjectIf is like CreateObjectStream, checking the conditions against
+// the stored object before it's replaced.
+func (s *storageS3) CreateObjectIf(attrs ObjectAttrs, content io.Reader, conds Conditions) (ObjectAttrs, error) {
+	return s.createObject(attrs, content, true, conds)
+}
+
+func (s *storageS3) createObject(attrs ObjectAttrs, content io.Reader, fillChecksums bool, conds Conditions) (ObjectAttrs, error) {
+	bucket, err := s.GetBucket(attrs.BucketName)
+	if err != nil {
+		bucket = Bucket{Name: attrs.BucketName, TimeCreated: time.Now()}
+		if err := s.putJSON(s3BucketKey(attrs.BucketName), bucket); err != nil {
+			return ObjectAttrs{}, err
+		}
+	}
+
+	tmpFile, err := os.CreateTemp("", "fake-gcs-s3-*")
+	if err != nil {
+		return ObjectAttrs{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	crc32cHash := checksum.NewCrc32c()
+	md5Hash := md5.New()
+	if attrs.Size, err = io.Copy(io.MultiWriter(tmpFile, crc32cHash, md5Hash), content); err != nil {
+		return ObjectAttrs{}, err
+	}
+	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+		return ObjectAttrs{}, err
+	}
+	if fillChecksums && attrs.Crc32c == "" {
+		attrs.Crc32c = checksum.EncodedChecksum(crc32cHash.Sum(nil))
+	}
+	if fillChecksums && attrs.Md5Hash == "" {
+		attrs.Md5Hash = checksum.EncodedHash(md5Hash.Sum(nil))
+	}
+	if attrs.Metageneration == 0 {
+		attrs.Metageneration = 1
+	}
+	if attrs.StorageClass == "" {
+		attrs.StorageClass = bucket.Attrs().objectStorageClass()
+	}
+
+	l := s.objects.get(attrs.BucketName, attrs.Name)
+	l.Lock()
+	defer l.Unlock()
+	var current *ObjectAttrs
+	if currentAttrs, err := s.getObjectAttrs(attrs.BucketName, attrs.Name); err == nil {
+		current = &currentAttrs
+	}
+	if err := conds.check(current); err != nil {
+		return ObjectAttrs{}, err
+	}
+	if attrs.Generation == 0 {
+		var latest int64
+		if current != nil {
+			latest = current.Generation
+		}
+		attrs.Generation = nextGeneration(latest)
+	}
+	contentKey := s3ObjectKey(attrs.BucketName, attrs.Name, attrs.Generation)
+	if err = s.client.put(contentKey, tmpFile, attrs.Size, "application/octet-stream"); err != nil {
+		return ObjectAttrs{}, err
+	}
+	if err = s.putJSON(s3MetadataKey(attrs.BucketName, attrs.Name), s3Object{Attrs: attrs, Size: attrs.Size}); err != nil {
+		s.client.delete(contentKey)
+		return ObjectAttrs{}, err
+	}
+	if current != nil && current.Generation != attrs.Generation {
+		if err := s.client.delete(s3ObjectKey(attrs.BucketName, attrs.Name, current.Generation)); err != nil {
+			return ObjectAttrs{}, err
+		}
+	}
+	return attrs, nil
+}
+
+func (s *storageS3) getObjectAttrs(bucketName, objectName string) (ObjectAttrs, error) {
+	var record s3Object
+	if err := s.getJSON(s3MetadataKey(bucketName, objectName), &record); err != nil {
+		if isS3NotFound(err) {
+			return ObjectAttrs{}, errors.New("object not found")
+		}
+		return ObjectAttrs{}, err
+	}
+	attrs := record.Attrs
+	attrs.BucketName = bucketName
+	attrs.Name = objectName
+	attrs.Size = record.Size
+	return attrs, nil
+}
+
+// ListObjects lists the objects in a given bucket with a given prefix.
+func (s *storageS3) ListObjects(bucketName string, prefix string, versions bool) ([]ObjectAttrs, error) {
+	if _, err := s.GetBucket(bucketName); err != nil {
+		return nil, err
+	}
+	keys, err := s.client.list(s3MetadataKey(bucketName, prefix))
+	if err != nil {
+		return nil, err
+	}
+	objects := []ObjectAttrs{}
+	for _, key := range keys {
+		attrs, err := s.getObjectAttrs(bucketName, strings.TrimPrefix(key, s3MetadataKey(bucketName, "")))
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, attrs)
+	}
+	return objects, nil
+}
+
+// GetObject retrieves the object from the store.
+func (s *storageS3) GetObject(bucketName, objectName string) (Object, error) {
+	return s.GetObjectWithGeneration(bucketName, objectName, 0)
+}
+
+// GetObjectWithGeneration retrieves the object, which must have the given
+// generation when it's not zero.
+func (s *storageS3) GetObjectWithGeneration(bucketName, objectName string, generation int64) (Object, error) {
+	obj, err := s.GetObjectStream(bucketName, objectName, generation)
+	if err != nil {
+		return Object{}, err
+	}
+	defer obj.Content.Close()
+	content, err := io.ReadAll(obj.Content)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{ObjectAttrs: obj.ObjectAttrs, Content: content}, nil
+}
+
+// GetObjectStream retrieves the object, which must have the given generation
+// when it's not zero. The content is downloaded from the store as it's read.
+func (s *storageS3) GetObjectStream(bucketName, objectName string, generation int64) (StreamingObject, error) {
+	attrs, err := s.getObjectAttrs(bucketName, objectName)
+	if err != nil {
+		return StreamingObject{}, err
+	}
+	if generation != 0 && attrs.Generation != generation {
+		return StreamingObject{}, errors.New("object not found")
+	}
+	return StreamingObject{
+		ObjectAttrs: attrs,
+		Content:     &s3ObjectReader{client: s.client, key: s3ObjectKey(bucketName, objectName, attrs.Generation), size: attrs.Size},
+	}, nil
+}
+
+// DeleteObject deletes the object from the store.
+func (s *storageS3) DeleteObject(bucketName, objectName string) error {
+	if objectName == "" {
+		return errors.New("can't delete object with empty name")
+	}
+	l := s.objects.get(bucketName, objectName)
+	l.Lock()
+	defer l.Unlock()
+	attrs, err := s.getObjectAttrs(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	return s.deleteObject(attrs)
+}
+
+// deleteObject removes the metadata and the content of the object. Callers
+// must hold the lock of the object.
+func (s *storageS3) deleteObject(attrs ObjectAttrs) error {
+	if err := s.client.delete(s3MetadataKey(attrs.BucketName, attrs.Name)); err != nil {
+		return err
+	}
+	return s.client.delete(s3ObjectKey(attrs.BucketName, attrs.Name, attrs.Generation))
+}
+
+// DeleteObjectGeneration deletes the object if it has the given generation.
+func (s *storageS3) DeleteObjectGeneration(bucketName, objectName string, generation int64) error {
+	l := s.objects.get(bucketName, objectName)
+	l.Lock()
+	defer l.Unlock()
+	attrs, err := s.getObjectAttrs(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	if attrs.Generation != generation {
+		return errors.New("object not found")
+	}
+	return s.deleteObject(attrs)
+}
+
+// SetObjectStorageClass changes the storage class of the object, which must
+// have the given generation, without rewriting its content.
+func (s *storageS3) SetObjectStorageClass(bucketName, objectName string, generation int64, storageClass string) error {
+	l := s.objects.get(bucketName, objectName)
+	l.Lock()
+	defer l.Unlock()
+	attrs, err := s.getObjectAttrs(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	if attrs.Generation != generation {
+		return errors.New("object not found")
+	}
+	attrs.StorageClass = storageClass
+	return s.putJSON(s3MetadataKey(bucketName, objectName), s3Object{Attrs: attrs, Size: attrs.Size})
+}
+
+// UpdateObjectAttrs replaces the attributes of the object, which must have
+// the given generation, without rewriting its content.
+func (s *storageS3) UpdateObjectAttrs(bucketName, objectName string, generation int64, attrs ObjectAttrs) error {
+	return s.UpdateObjectAttrsIf(bucketName, objectName, generation, attrs, Conditions{})
+}
+
+// UpdateObjectAttrsIf replaces the attributes of the object if it meets the
+// conditions.
+func (s *storageS3) UpdateObjectAttrsIf(bucketName, objectName string, generation int64, attrs ObjectAttrs, conds Conditions) error {
+	l := s.objects.get(bucketName, objectName)
+	l.Lock()
+	defer l.Unlock()
+	current, err := s.getObjectAttrs(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	if current.Generation != generation {
+		return errors.New("object not found")
+	}
+	if err := conds.check(&current); err != nil {
+		return err
+	}
+	attrs.BucketName = bucketName
+	attrs.Name = objectName
+	attrs.Generation = generation
+	attrs.Size = current.Size
+	return s.putJSON(s3MetadataKey(bucketName, objectName), s3Object{Attrs: attrs, Size: attrs.Size})
+}
+
+// ComposeObject concatenates the source objects into the destination object,
+// streaming their content from the store.
+func (s *storageS3) ComposeObject(bucketName string, objectNames []string, dest ObjectAttrs, conds Conditions) (Object, error) {
+	var sources []io.Reader
+	var componentCount int
+	for _, n := range objectNames {
+		obj, err := s.GetObjectStream(bucketName, n, 0)
+		if err != nil {
+			return Object{}, err
+		}
+		defer obj.Content.Close()
+		sources = append(sources, obj.Content)
+		componentCount += obj.componentCount()
+	}
+
+	result, err := s.CreateObjectIf(composedAttrs(bucketName, dest, componentCount), io.MultiReader(sources...), conds)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{ObjectAttrs: result}, nil
+}
+
+// s3ObjectReader reads the content of an object from the store, sending a
+// new ranged request after seeking.
+type s3ObjectReader struct {
+	client *s3Client
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.client.get(r.key, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *s3ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal S3 server, keeping the objects of a single bucket in
+// memory and verifying the signature of the requests.
+type fakeS3 struct {
+	t       *testing.T
+	mtx     sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.verifySignature(r)
+	key := strings.TrimPrefix(r.URL.Path, "/some-s3-bucket/")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"))
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			data = data[start:]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list lists the keys with the prefix, two at a time to exercise the
+// pagination.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) && key > r.URL.Query().Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var result s3ListResult
+	if len(keys) > 2 {
+		keys = keys[:2]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, struct{ Key string }{key})
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: result})
+}
+
+func (f *fakeS3) verifySignature(r *http.Request) {
+	date, err := time.Parse(s3DateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		f.t.Errorf("invalid x-amz-date header: %v", err)
+		return
+	}
+	req := r.Clone(r.Context())
+	req.URL.Host = r.Host
+	req.Header.Del("Authorization")
+	expected := signV4(req, r.Header.Get("X-Amz-Content-Sha256"), date, "us-east-1", "s3", "access-key", "secret-key")
+	if got := r.Header.Get("Authorization"); got != expected {
+		f.t.Errorf("wrong signature of %s %s\nwant %q\ngot  %q", r.Method, r.URL, expected, got)
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	// the get-vanilla case of the AWS Signature Version 4 test suite.
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Amz-Date", "20150830T123600Z")
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	got := signV4(req, emptyPayloadHash, now, "us-east-1", "service", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got != expected {
+		t.Errorf("wrong authorization header\nwant %q\ngot  %q", expected, got)
+	}
+}
+
+func TestStorageS3(t *testing.T) {
+	fake := &fakeS3{t: t, objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	storage, err := NewStorageS3(nil, S3Config{
+		Endpoint:        server.URL,
+		Bucket:          "some-s3-bucket",
+		AccessKeyID:     "access-key",
+		SecretAccessKey: "secret-key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noError(t, storage.CreateBucket("some-bucket", BucketAttrs{DefaultStorageClass: "NEARLINE"}))
+	shouldError(t, storage.CreateBucket("versioned-bucket", BucketAttrs{VersioningEnabled: true}))
+	buckets, err := storage.ListBuckets()
+	noError(t, err)
+	if len(buckets) != 1 || buckets[0].Name != "some-bucket" {
+		t.Errorf("wrong buckets listed: %+v", buckets)
+	}
+
+	names := []string{"dir/file 1.txt", "dir/file+2.txt", "dir/file(3).txt", "other.txt"}
+	for _, name := range names {
+		_, err := storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: name}, Content: []byte("content of " + name)})
+		noError(t, err)
+	}
+	objs, err := storage.ListObjects("some-bucket", "dir/", false)
+	noError(t, err)
+	if len(objs) != 3 {
+		t.Errorf("wrong number of objects listed\nwant 3\ngot  %d", len(objs))
+	}
+
+	obj, err := storage.GetObject("some-bucket", "dir/file+2.txt")
+	noError(t, err)
+	if string(obj.Content) != "content of dir/file+2.txt" {
+		t.Errorf("wrong content\nwant %q\ngot  %q", "content of dir/file+2.txt", obj.Content)
+	}
+	if obj.StorageClass != "NEARLINE" {
+		t.Errorf("wrong storage class\nwant %q\ngot  %q", "NEARLINE", obj.StorageClass)
+	}
+
+	streamingObj, err := storage.GetObjectStream("some-bucket", "other.txt", obj.Generation+1)
+	shouldError(t, err)
+	streamingObj, err = storage.GetObjectStream("some-bucket", "other.txt", 0)
+	noError(t, err)
+	_, err = streamingObj.Content.Seek(11, io.SeekStart)
+	noError(t, err)
+	tail, err := io.ReadAll(streamingObj.Content)
+	noError(t, err)
+	streamingObj.Content.Close()
+	if string(tail) != "other.txt" {
+		t.Errorf("wrong content after seeking\nwant %q\ngot  %q", "other.txt", tail)
+	}
+
+	composed, err := storage.ComposeObject("some-bucket", []string{"dir/file 1.txt", "other.txt"}, ObjectAttrs{Name: "composed.txt", ContentType: "text/plain"}, Conditions{})
+	noError(t, err)
+	if expected := int64(len("content of dir/file 1.txt") + len("content of other.txt")); composed.Size != expected {
+		t.Errorf("wrong size of the composed object\nwant %d\ngot  %d", expected, composed.Size)
+	}
+
+	noError(t, storage.UpdateObjectAttrs("some-bucket", "other.txt", streamingObj.Generation, ObjectAttrs{ContentType: "text/csv"}))
+	obj, err = storage.GetObject("some-bucket", "other.txt")
+	noError(t, err)
+	if obj.ContentType != "text/csv" || !bytes.Equal(obj.Content, []byte("content of other.txt")) {
+		t.Errorf("wrong object after updating its attributes: %+v", obj)
+	}
+
+	// overwriting the object stores the new generation under its own key and
+	// removes the content of the previous one.
+	_, err = storage.CreateObject(Object{ObjectAttrs: ObjectAttrs{BucketName: "some-bucket", Name: "other.txt", Generation: obj.Generation + 1}, Content: []byte("new content")})
+	noError(t, err)
+	obj, err = storage.GetObject("some-bucket", "other.txt")
+	noError(t, err)
+	if string(obj.Content) != "new content" {
+		t.Errorf("wrong content after overwriting\nwant %q\ngot  %q", "new content", obj.Content)
+	}
+	if _, ok := fake.objects[s3ObjectKey("some-bucket", "other.txt", streamingObj.Generation)]; ok {
+		t.Error("the content of the previous generation wasn't removed")
+	}
+
+	shouldError(t, storage.DeleteBucket("some-bucket"))
+	for _, name := range append(names, "composed.txt") {
+		noError(t, storage.DeleteObject("some-bucket", name))
+	}
+	shouldError(t, storage.DeleteObject("some-bucket", "other.txt"))
+	noError(t, storage.DeleteBucket("some-bucket"))
+	if len(fake.objects) != 0 {
+		t.Errorf("keys left in the S3 bucket: %d", len(fake.objects))
+	}
+}
@@ -5,21 +5,53 @@
 // Package backend proides the backends used by fake-gcs-server.
 package backend
 
+import (
+	"io"
+)
+
 // Storage is the generic interface for implementing the backend storage of the
 // server.
 type Storage interface {
-	CreateBucket(name string, versioningEnabled bool) error
+	CreateBucket(name string, bucketAttrs BucketAttrs) error
 	ListBuckets() ([]Bucket, error)
 	GetBucket(name string) (Bucket, error)
 	DeleteBucket(name string) error
+	UpdateBucket(name string, attrs BucketAttrs) error
 	CreateObject(obj Object) (Object, error)
+	// CreateObjectStream stores an object with the content read from the
+	// given reader, filling in its size and, when not set, its checksums.
+	CreateObjectStream(attrs ObjectAttrs, content io.Reader) (ObjectAttrs, error)
+	// CreateObjectIf is like CreateObjectStream, but only stores the object
+	// if its live version meets the given conditions, failing with a
+	// ConditionError, which matches PreconditionFailed, otherwise.
+	CreateObjectIf(attrs ObjectAttrs, content io.Reader, conds Conditions) (ObjectAttrs, error)
 	ListObjects(bucketName string, prefix string, versions bool) ([]ObjectAttrs, error)
 	GetObject(bucketName, objectName string) (Object, error)
 	GetObjectWithGeneration(bucketName, objectName string, generation int64) (Object, error)
+	// GetObjectStream retrieves the given generation of the object, or the
+	// live version when generation is zero, without reading its content.
+	GetObjectStream(bucketName, objectName string, generation int64) (StreamingObject, error)
 	DeleteObject(bucketName, objectName string) error
-	PatchObject(bucketName, objectName string, metadata map[string]string) (Object, error)
-	UpdateObject(bucketName, objectName string, metadata map[string]string) (Object, error)
-	ComposeObject(bucketName string, objectNames []string, destinationName string, metadata map[string]string, contentType string) (Object, error)
+	DeleteObjectGeneration(bucketName, objectName string, generation int64) error
+	SetObjectStorageClass(bucketName, objectName string, generation int64, storageClass string) error
+	UpdateObjectAttrs(bucketName, objectName string, generation int64, attrs ObjectAttrs) error
+	// UpdateObjectAttrsIf is like UpdateObjectAttrs, but only updates the
+	// object if the updated version meets the given conditions, failing
+	// with a ConditionError otherwise.
+	UpdateObjectAttrsIf(bucketName, objectName string, generation int64, attrs ObjectAttrs, conds Conditions) error
+	// ComposeObject concatenates the source objects into a new version of
+	// the dest object if its live version meets the given conditions,
+	// failing with a ConditionError otherwise. See composedAttrs for the
+	// attributes taken from dest.
+	ComposeObject(bucketName string, objectNames []string, dest ObjectAttrs, conds Conditions) (Object, error)
+}
+
+// Refresher is implemented by the backends whose storage can be changed by
+// other tools while the server runs, such as the filesystem backend.
+type Refresher interface {
+	// Refresh imports the files added to the storage by other tools as
+	// objects, returning the number of objects imported.
+	Refresh() (int, error)
 }
 
 type Error string
@@ -27,6 +59,8 @@ type Error string
 func (e Error) Error() string { return string(e) }
 
 const (
-	BucketNotFound = Error("bucket not found")
-	BucketNotEmpty = Error("bucket must be empty prior to deletion")
+	BucketNotFound     = Error("bucket not found")
+	BucketNotEmpty     = Error("bucket must be empty prior to deletion")
+	CapacityExceeded   = Error("storage capacity exceeded")
+	PreconditionFailed = Error("precondition failed")
 )
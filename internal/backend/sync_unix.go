@@ -0,0 +1,29 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package backend
+
+import "os"
+
+// syncPath flushes the file or directory to the disk.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir flushes the entries of the directory, such as renamed files, to
+// the disk.
+func syncDir(path string) error {
+	return syncPath(path)
+}
@@ -0,0 +1,11 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+// syncDir does nothing, as directories can't be flushed on Windows, where
+// renames are journaled by the filesystem.
+func syncDir(path string) error {
+	return nil
+}
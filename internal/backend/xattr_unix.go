@@ -8,6 +8,8 @@
 package backend
 
 import (
+	"os"
+
 	"github.com/pkg/xattr"
 )
 
@@ -28,3 +30,13 @@ func isXattrFile(path string) bool {
 func removeXattrFile(path string) error {
 	return nil
 }
+
+// renameWithXattr renames the file, along with its attributes.
+func renameWithXattr(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+// syncXattr flushes the attributes of the file to the disk.
+func syncXattr(path string) error {
+	return syncPath(path)
+}
@@ -9,13 +9,28 @@ package backend
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 )
 
 const xattrKey = ".metadata"
 
+// writeXattr writes the attributes to a temporary file, renamed into place,
+// so they're never left truncated.
 func writeXattr(path string, encoded []byte) error {
-	return os.WriteFile(path+xattrKey, encoded, 0o600)
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".tmp-*"+xattrKey)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(encoded)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path+xattrKey)
 }
 
 func readXattr(path string) ([]byte, error) {
@@ -29,3 +44,18 @@ func isXattrFile(path string) bool {
 func removeXattrFile(path string) error {
 	return os.Remove(path + xattrKey)
 }
+
+// renameWithXattr renames the file along with the file of its attributes,
+// which is renamed first: a process killed in between leaves attributes
+// without content behind, which are ignored, instead of content without
+// attributes.
+func renameWithXattr(oldPath, newPath string) error {
+	if err := os.Rename(oldPath+xattrKey, newPath+xattrKey); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func syncXattr(path string) error {
+	return nil
+}
@@ -7,6 +7,7 @@ package checksum
 import (
 	"crypto/md5"
 	"encoding/base64"
+	"hash"
 	"hash/crc32"
 )
 
@@ -39,3 +40,9 @@ func EncodedHash(hash []byte) string {
 func EncodedMd5Hash(content []byte) string {
 	return EncodedHash(MD5Hash(content))
 }
+
+// NewCrc32c returns a hash computing the CRC32C checksum, for content that
+// isn't loaded into memory at once.
+func NewCrc32c() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
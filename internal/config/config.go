@@ -7,10 +7,15 @@
 package config
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"math"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fsouza/fake-gcs-server/fakestorage"
 	"github.com/fsouza/fake-gcs-server/internal/notification"
@@ -20,33 +25,61 @@ import (
 const (
 	filesystemBackend   = "filesystem"
 	memoryBackend       = "memory"
+	boltBackend         = "bolt"
+	s3Backend           = "s3"
 	eventFinalize       = "finalize"
 	eventDelete         = "delete"
 	eventMetadataUpdate = "metadataUpdate"
 	eventArchive        = "archive"
+
+	defaultChaosProbability = 0.05
+
+	encryptionKeyEnv = "FAKE_GCS_ENCRYPTION_KEY"
 )
 
 type Config struct {
 	Seed                string
+	RestoreFile         string
+	SnapshotFile        string
 	publicHost          string
 	externalURL         string
+	basePath            string
 	allowedCORSHeaders  []string
 	scheme              string
 	host                string
 	port                uint
 	backend             string
 	fsRoot              string
+	encryptionKey       []byte
+	fsSync              bool
+	dedupContent        bool
+	s3                  fakestorage.S3Options
+	memoryLimits        fakestorage.MemoryLimits
+	proxyBuckets        []string
+	seedCacheControl    string
+	seedManifest        string
 	event               EventConfig
 	bucketLocation      string
 	certificateLocation string
 	privateKeyLocation  string
+	strictContentType   bool
+	verifyPostPolicies  bool
+	enforceObjectACL    bool
+	lifecycleInterval   time.Duration
+	objectTTL           time.Duration
+	operationLatencies  map[string]fakestorage.OperationLatency
+	bandwidthLimits     fakestorage.BandwidthLimits
+	faultRules          []fakestorage.FaultRule
+	listingDelay        time.Duration
+	chaos               fakestorage.ChaosOptions
 }
 
 type EventConfig struct {
-	pubsubProjectID string
-	pubsubTopic     string
-	prefix          string
-	list            []string
+	pubsubProjectID    string
+	pubsubTopic        string
+	pubsubEmulatorHost string
+	prefix             string
+	list               []string
 }
 
 // Load parses the given arguments list and return a config object (and/or an
@@ -55,53 +88,244 @@ func Load(args []string) (Config, error) {
 	var cfg Config
 	var allowedCORSHeaders string
 	var eventList string
+	var latencies string
+	var faultErrors string
+	var chaos bool
+	var proxyBuckets string
+	var encryptionKeyFile string
 
 	fs := flag.NewFlagSet("fake-gcs-server", flag.ContinueOnError)
-	fs.StringVar(&cfg.backend, "backend", filesystemBackend, "storage backend (memory or filesystem)")
-	fs.StringVar(&cfg.fsRoot, "filesystem-root", "/storage", "filesystem root (required for the filesystem backend). folder will be created if it doesn't exist")
+	fs.StringVar(&cfg.backend, "backend", filesystemBackend, "storage backend (memory, filesystem, bolt or s3)")
+	fs.StringVar(&cfg.s3.Endpoint, "s3-endpoint", "", "URL of the S3-compatible store (required for the s3 backend), such as http://localhost:9000. the credentials are read from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	fs.StringVar(&cfg.s3.Bucket, "s3-bucket", "", "S3 bucket that holds the buckets and objects (required for the s3 backend)")
+	fs.StringVar(&cfg.s3.Region, "s3-region", "us-east-1", "region of the S3 bucket")
+	fs.Int64Var(&cfg.memoryLimits.MaxBytes, "memory-max-bytes", 0, "maximum size of the content stored by the memory backend, counting all versions of the objects. unlimited by default")
+	fs.IntVar(&cfg.memoryLimits.MaxObjects, "memory-max-objects", 0, "maximum number of objects stored by the memory backend, counting all versions of the objects. unlimited by default")
+	fs.BoolVar(&cfg.memoryLimits.EvictOldest, "memory-evict-oldest", false, "permanently delete the oldest objects, noncurrent versions first, instead of rejecting uploads that exceed the memory backend limits")
+	fs.StringVar(&proxyBuckets, "proxy-buckets", "", "comma separated list of buckets whose missing objects are read from Cloud Storage with the application default credentials and copied to the backend. writes are kept local")
+	fs.StringVar(&cfg.fsRoot, "filesystem-root", "/storage", "filesystem root (required for the filesystem and bolt backends). folder will be created if it doesn't exist")
+	fs.StringVar(&encryptionKeyFile, "filesystem-encryption-key-file", "", "file with a base64-encoded AES key (16, 24 or 32 bytes) used to encrypt the content of the objects stored by the filesystem backend. the key can also be set in $"+encryptionKeyEnv)
+	fs.BoolVar(&cfg.fsSync, "filesystem-sync", false, "flush new objects to the disk before the writes return, so they survive a crash of the machine, with the filesystem backend")
+	fs.BoolVar(&cfg.dedupContent, "deduplicate-content", false, "store the content of identical objects only once, with the bolt backend")
 	fs.StringVar(&cfg.publicHost, "public-host", "storage.googleapis.com", "Optional URL for public host")
-	fs.StringVar(&cfg.externalURL, "external-url", "", "optional external URL, returned in the Location header for uploads. Defaults to the address where the server is running")
+	fs.StringVar(&cfg.externalURL, "external-url", "", "optional external URL, returned in the Location header for uploads. Defaults to the address the request was sent to")
+	fs.StringVar(&cfg.basePath, "base-path", "", "optional path prefix for running the server behind a reverse proxy, included in the URLs generated by the server")
 	fs.StringVar(&cfg.scheme, "scheme", "https", "using http or https")
 	fs.StringVar(&cfg.host, "host", "0.0.0.0", "host to bind to")
 	fs.StringVar(&cfg.Seed, "data", "", "where to load data from (provided that the directory exists)")
+	fs.StringVar(&cfg.Seed, "seed-dir", "", "directory with a folder for each bucket to create, with a file for each object (same as -data)")
+	fs.StringVar(&cfg.seedCacheControl, "seed-cache-control", "", "Cache-Control of the objects loaded from the seed directory")
+	fs.StringVar(&cfg.seedManifest, "seed-manifest", "", "JSON or YAML manifest describing the buckets and objects to create on startup")
+	fs.StringVar(&cfg.RestoreFile, "restore", "", "snapshot tarball whose buckets and objects replace the ones of the server on startup")
+	fs.StringVar(&cfg.SnapshotFile, "snapshot", "", "where to write a snapshot tarball of all buckets and objects when the server is stopped")
 	fs.StringVar(&allowedCORSHeaders, "cors-headers", "", "comma separated list of headers to add to the CORS allowlist")
 	fs.UintVar(&cfg.port, "port", 4443, "port to bind to")
 	fs.StringVar(&cfg.event.pubsubProjectID, "event.pubsub-project-id", "", "project ID containing the pubsub topic")
 	fs.StringVar(&cfg.event.pubsubTopic, "event.pubsub-topic", "", "pubsub topic name to publish events on")
+	fs.StringVar(&cfg.event.pubsubEmulatorHost, "event.pubsub-emulator-host", "", "address of the pubsub emulator that bucket notification configurations publish to (defaults to $PUBSUB_EMULATOR_HOST)")
 	fs.StringVar(&cfg.event.prefix, "event.object-prefix", "", "if not empty, only objects having this prefix will generate trigger events")
 	fs.StringVar(&eventList, "event.list", eventFinalize, "comma separated list of events to publish on cloud function URl. Options are: finalize, delete, and metadataUpdate")
 	fs.StringVar(&cfg.bucketLocation, "location", "US-CENTRAL1", "location for buckets")
 	fs.StringVar(&cfg.certificateLocation, "cert-location", "", "location for server certificate")
 	fs.StringVar(&cfg.privateKeyLocation, "private-key-location", "", "location for private key")
+	fs.BoolVar(&cfg.strictContentType, "strict-content-type", false, "reject JSON API metadata requests whose body isn't sent as application/json, as Cloud Storage does")
+	fs.DurationVar(&cfg.lifecycleInterval, "lifecycle-interval", 0, "how often bucket lifecycle rules are applied in the background. disabled by default")
+	fs.DurationVar(&cfg.objectTTL, "object-ttl", 0, "delete objects, including all their versions, once they're older than the given duration, regardless of lifecycle rules. disabled by default")
+	fs.BoolVar(&cfg.verifyPostPolicies, "verify-post-policies", false, "reject form POST uploads whose policy document has expired or whose fields don't meet its conditions")
+	fs.BoolVar(&cfg.enforceObjectACL, "enforce-object-acl", false, "reject downloads without credentials of objects whose ACL doesn't grant access to allUsers")
+	fs.StringVar(&latencies, "latency", "", "comma separated list of latencies added to the requests of each class of operations (upload, download, list and metadata), fixed or as a random range, such as upload=100ms,download=50ms-200ms")
+	fs.Int64Var(&cfg.bandwidthLimits.Upload, "upload-bandwidth", 0, "maximum rate of the content of uploads, in bytes per second. unlimited by default")
+	fs.Int64Var(&cfg.bandwidthLimits.Download, "download-bandwidth", 0, "maximum rate of the content of downloads, in bytes per second. unlimited by default")
+	fs.DurationVar(&cfg.listingDelay, "list-consistency-delay", 0, "how long created, overwritten or deleted objects take to be listed as such, simulating eventually consistent listings. disabled by default")
+	fs.BoolVar(&chaos, "chaos", false, "disrupt a share of the requests at random with latency, 5xx errors, dropped connections and truncated bodies, to test retry logic")
+	fs.Float64Var(&cfg.chaos.Probability, "chaos-probability", defaultChaosProbability, "chance of each request being disrupted in chaos mode, between 0 and 1")
+	fs.DurationVar(&cfg.chaos.MaxLatency, "chaos-max-latency", time.Second, "maximum latency added to requests in chaos mode")
+	fs.Int64Var(&cfg.chaos.Seed, "chaos-seed", 0, "seed of the disruptions in chaos mode, for reproducing them. random by default")
+	fs.StringVar(&faultErrors, "fault-errors", "", "comma separated list of errors returned for a percentage of the requests to each API method, as method=status:percentage, such as storage.objects.get=503:10,storage.objects.insert=429:5")
 
 	err := fs.Parse(args)
 	if err != nil {
 		return cfg, err
 	}
 
+	if cfg.backend == s3Backend {
+		cfg.s3.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		cfg.s3.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	} else {
+		cfg.s3 = fakestorage.S3Options{}
+	}
+	if cfg.backend == filesystemBackend {
+		if cfg.encryptionKey, err = loadEncryptionKey(encryptionKeyFile); err != nil {
+			return cfg, err
+		}
+	}
+	if proxyBuckets != "" {
+		cfg.proxyBuckets = strings.Split(proxyBuckets, ",")
+	}
 	if allowedCORSHeaders != "" {
 		cfg.allowedCORSHeaders = strings.Split(allowedCORSHeaders, ",")
 	}
 	if eventList != "" {
 		cfg.event.list = strings.Split(eventList, ",")
 	}
+	if latencies != "" {
+		if cfg.operationLatencies, err = parseOperationLatencies(latencies); err != nil {
+			return cfg, err
+		}
+	}
+	if !chaos {
+		cfg.chaos = fakestorage.ChaosOptions{}
+	}
+	if faultErrors != "" {
+		if cfg.faultRules, err = parseFaultErrors(faultErrors); err != nil {
+			return cfg, err
+		}
+	}
 
 	return cfg, cfg.validate()
 }
 
+// loadEncryptionKey reads the base64-encoded key used to encrypt the
+// filesystem backend from the given file or, when it's empty, from the
+// environment. It returns nil if neither is set.
+func loadEncryptionKey(file string) ([]byte, error) {
+	encoded := os.Getenv(encryptionKeyEnv)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the encryption key: %w", err)
+		}
+		encoded = string(data)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key, must be base64-encoded: %w", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid encryption key with %d bytes, must have 16, 24 or 32 bytes", len(key))
+	}
+}
+
+// parseOperationLatencies parses the value of the latency flag, such as
+// upload=100ms,download=50ms-200ms.
+func parseOperationLatencies(value string) (map[string]fakestorage.OperationLatency, error) {
+	latencies := make(map[string]fakestorage.OperationLatency)
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid latency %q, must be in the format operation=duration", item)
+		}
+		switch parts[0] {
+		case fakestorage.OperationUpload, fakestorage.OperationDownload, fakestorage.OperationList, fakestorage.OperationMetadata:
+		default:
+			return nil, fmt.Errorf("invalid latency operation %q, must be one of upload, download, list or metadata", parts[0])
+		}
+		var latency fakestorage.OperationLatency
+		durations := strings.SplitN(parts[1], "-", 2)
+		var err error
+		if latency.Min, err = time.ParseDuration(durations[0]); err != nil {
+			return nil, fmt.Errorf("invalid latency %q: %w", item, err)
+		}
+		if len(durations) == 2 {
+			if latency.Max, err = time.ParseDuration(durations[1]); err != nil {
+				return nil, fmt.Errorf("invalid latency %q: %w", item, err)
+			}
+			if latency.Max < latency.Min {
+				return nil, fmt.Errorf("invalid latency %q: the maximum is lower than the minimum", item)
+			}
+		}
+		latencies[parts[0]] = latency
+	}
+	return latencies, nil
+}
+
+// parseFaultErrors parses the value of the fault-errors flag, such as
+// "storage.objects.get=503:10", into error fault rules.
+func parseFaultErrors(value string) ([]fakestorage.FaultRule, error) {
+	var rules []fakestorage.FaultRule
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid fault error %q, must be in the format method=status:percentage", item)
+		}
+		values := strings.SplitN(parts[1], ":", 2)
+		if len(values) != 2 {
+			return nil, fmt.Errorf("invalid fault error %q, must be in the format method=status:percentage", item)
+		}
+		status, err := strconv.Atoi(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault error status %q: %w", item, err)
+		}
+		percentage, err := strconv.ParseFloat(values[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault error percentage %q: %w", item, err)
+		}
+		if status != http.StatusTooManyRequests && (status < 500 || status > 599) {
+			return nil, fmt.Errorf("invalid fault error %q: the status must be 429 or 5xx", item)
+		}
+		if percentage <= 0 || percentage > 100 {
+			return nil, fmt.Errorf("invalid fault error %q: the percentage must be greater than 0 and up to 100", item)
+		}
+		rules = append(rules, fakestorage.FaultRule{
+			Type:       fakestorage.FaultError,
+			APIMethod:  parts[0],
+			Status:     status,
+			Percentage: percentage,
+		})
+	}
+	return rules, nil
+}
+
 func (c *Config) validate() error {
-	if c.backend != memoryBackend && c.backend != filesystemBackend {
-		return fmt.Errorf(`invalid backend %q, must be either "memory" or "filesystem"`, c.backend)
+	switch c.backend {
+	case memoryBackend, filesystemBackend, boltBackend:
+	case s3Backend:
+		if c.s3.Endpoint == "" || c.s3.Bucket == "" {
+			return fmt.Errorf("backend %q requires the s3-endpoint and the s3-bucket to be defined", c.backend)
+		}
+	default:
+		return fmt.Errorf(`invalid backend %q, must be either "memory", "filesystem", "bolt" or "s3"`, c.backend)
 	}
-	if c.backend == filesystemBackend && c.fsRoot == "" {
+	if (c.backend == filesystemBackend || c.backend == boltBackend) && c.fsRoot == "" {
 		return fmt.Errorf("backend %q requires the filesystem-root to be defined", c.backend)
 	}
+	if c.fsSync && c.backend != filesystemBackend {
+		return fmt.Errorf("syncing writes is only supported by the %q backend", filesystemBackend)
+	}
+	if c.dedupContent && c.backend != boltBackend {
+		return fmt.Errorf("content deduplication is only supported by the %q backend", boltBackend)
+	}
 	if c.scheme != "http" && c.scheme != "https" {
 		return fmt.Errorf(`invalid scheme %s, must be either "http"" or "https"`, c.scheme)
 	}
 	if c.port > math.MaxUint16 {
 		return fmt.Errorf("port %d is too high, maximum value is %d", c.port, math.MaxUint16)
 	}
+	if c.chaos.Probability < 0 || c.chaos.Probability > 1 {
+		return fmt.Errorf("invalid chaos probability %v, must be between 0 and 1", c.chaos.Probability)
+	}
+	if c.chaos.MaxLatency < 0 {
+		return fmt.Errorf("invalid chaos max latency %s, must not be negative", c.chaos.MaxLatency)
+	}
+	if c.listingDelay < 0 {
+		return fmt.Errorf("invalid list consistency delay %s, must not be negative", c.listingDelay)
+	}
+	if c.objectTTL < 0 {
+		return fmt.Errorf("invalid object TTL %s, must not be negative", c.objectTTL)
+	}
+	if c.memoryLimits.MaxBytes < 0 || c.memoryLimits.MaxObjects < 0 {
+		return fmt.Errorf("invalid memory backend limits, must not be negative")
+	}
+	if c.bandwidthLimits.Upload < 0 || c.bandwidthLimits.Download < 0 {
+		return fmt.Errorf("invalid bandwidth limit, must not be negative")
+	}
 
 	return c.event.validate()
 }
@@ -135,13 +359,14 @@ func (c *EventConfig) validate() error {
 
 func (c *Config) ToFakeGcsOptions() fakestorage.Options {
 	storageRoot := c.fsRoot
-	if c.backend == memoryBackend {
+	if c.backend == memoryBackend || c.backend == s3Backend {
 		storageRoot = ""
 	}
 	eventOptions := notification.EventManagerOptions{
-		ProjectID:    c.event.pubsubProjectID,
-		TopicName:    c.event.pubsubTopic,
-		ObjectPrefix: c.event.prefix,
+		ProjectID:          c.event.pubsubProjectID,
+		TopicName:          c.event.pubsubTopic,
+		PubsubEmulatorHost: c.event.pubsubEmulatorHost,
+		ObjectPrefix:       c.event.prefix,
 	}
 	if c.event.pubsubProjectID != "" && c.event.pubsubTopic != "" {
 		for _, event := range c.event.list {
@@ -159,17 +384,38 @@ func (c *Config) ToFakeGcsOptions() fakestorage.Options {
 	}
 
 	return fakestorage.Options{
-		StorageRoot:         storageRoot,
-		Scheme:              c.scheme,
-		Host:                c.host,
-		Port:                uint16(c.port),
-		PublicHost:          c.publicHost,
-		ExternalURL:         c.externalURL,
-		AllowedCORSHeaders:  c.allowedCORSHeaders,
-		Writer:              logrus.New().Writer(),
-		EventOptions:        eventOptions,
-		BucketsLocation:     c.bucketLocation,
-		CertificateLocation: c.certificateLocation,
-		PrivateKeyLocation:  c.privateKeyLocation,
+		StorageRoot:             storageRoot,
+		BoltBackend:             c.backend == boltBackend,
+		DeduplicateContent:      c.dedupContent,
+		StorageEncryptionKey:    c.encryptionKey,
+		StorageSync:             c.fsSync,
+		S3:                      c.s3,
+		MemoryLimits:            c.memoryLimits,
+		Proxy:                   fakestorage.ProxyOptions{Buckets: c.proxyBuckets},
+		SeedDir:                 c.Seed,
+		SeedCacheControl:        c.seedCacheControl,
+		SeedManifest:            c.seedManifest,
+		Scheme:                  c.scheme,
+		Host:                    c.host,
+		Port:                    uint16(c.port),
+		PublicHost:              c.publicHost,
+		ExternalURL:             c.externalURL,
+		BasePath:                c.basePath,
+		AllowedCORSHeaders:      c.allowedCORSHeaders,
+		Writer:                  logrus.New().Writer(),
+		EventOptions:            eventOptions,
+		BucketsLocation:         c.bucketLocation,
+		CertificateLocation:     c.certificateLocation,
+		PrivateKeyLocation:      c.privateKeyLocation,
+		StrictContentType:       c.strictContentType,
+		VerifyPostPolicies:      c.verifyPostPolicies,
+		EnforceObjectACL:        c.enforceObjectACL,
+		LifecycleInterval:       c.lifecycleInterval,
+		ObjectTTL:               c.objectTTL,
+		OperationLatencies:      c.operationLatencies,
+		BandwidthLimits:         c.bandwidthLimits,
+		FaultRules:              c.faultRules,
+		ListingConsistencyDelay: c.listingDelay,
+		Chaos:                   c.chaos,
 	}
 }
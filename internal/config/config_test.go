@@ -5,7 +5,12 @@
 package config
 
 import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/fsouza/fake-gcs-server/fakestorage"
 	"github.com/fsouza/fake-gcs-server/internal/notification"
@@ -28,34 +33,82 @@ func TestLoadConfig(t *testing.T) {
 				"-filesystem-root", "/tmp/something",
 				"-public-host", "127.0.0.1.nip.io:8443",
 				"-external-url", "https://myhost.example.com:8443",
+				"-base-path", "/gcs",
 				"-cors-headers", "X-Goog-Meta-Uploader",
 				"-host", "127.0.0.1",
 				"-port", "443",
 				"-data", "/var/gcs",
+				"-seed-cache-control", "public, max-age=60",
+				"-seed-manifest", "/var/gcs/manifest.yaml",
+				"-restore", "/var/gcs/restore.tar",
+				"-snapshot", "/var/gcs/snapshot.tar",
 				"-scheme", "http",
 				"-event.pubsub-project-id", "test-project",
 				"-event.pubsub-topic", "gcs-events",
+				"-event.pubsub-emulator-host", "localhost:8085",
 				"-event.object-prefix", "uploads/",
 				"-event.list", "finalize,delete,metadataUpdate,archive",
 				"-location", "US-EAST1",
+				"-strict-content-type",
+				"-verify-post-policies",
+				"-enforce-object-acl",
+				"-lifecycle-interval", "1h",
+				"-object-ttl", "24h",
+				"-latency", "upload=100ms,download=50ms-200ms",
+				"-upload-bandwidth", "1048576",
+				"-download-bandwidth", "2097152",
+				"-list-consistency-delay", "2s",
+				"-chaos",
+				"-chaos-probability", "0.1",
+				"-chaos-max-latency", "500ms",
+				"-chaos-seed", "42",
+				"-fault-errors", "storage.objects.get=503:10,storage.objects.insert=429:2.5",
+				"-proxy-buckets", "prod-fixtures,other-fixtures",
+				"-memory-max-bytes", "104857600",
+				"-memory-max-objects", "1000",
+				"-memory-evict-oldest",
 			},
 			expectedConfig: Config{
 				Seed:               "/var/gcs",
+				RestoreFile:        "/var/gcs/restore.tar",
+				SnapshotFile:       "/var/gcs/snapshot.tar",
+				seedCacheControl:   "public, max-age=60",
+				seedManifest:       "/var/gcs/manifest.yaml",
 				backend:            "memory",
 				fsRoot:             "/tmp/something",
+				proxyBuckets:       []string{"prod-fixtures", "other-fixtures"},
+				memoryLimits:       fakestorage.MemoryLimits{MaxBytes: 104857600, MaxObjects: 1000, EvictOldest: true},
 				publicHost:         "127.0.0.1.nip.io:8443",
 				externalURL:        "https://myhost.example.com:8443",
+				basePath:           "/gcs",
 				allowedCORSHeaders: []string{"X-Goog-Meta-Uploader"},
 				host:               "127.0.0.1",
 				port:               443,
 				scheme:             "http",
 				event: EventConfig{
-					pubsubProjectID: "test-project",
-					pubsubTopic:     "gcs-events",
-					prefix:          "uploads/",
-					list:            []string{"finalize", "delete", "metadataUpdate", "archive"},
+					pubsubProjectID:    "test-project",
+					pubsubTopic:        "gcs-events",
+					pubsubEmulatorHost: "localhost:8085",
+					prefix:             "uploads/",
+					list:               []string{"finalize", "delete", "metadataUpdate", "archive"},
+				},
+				bucketLocation:     "US-EAST1",
+				strictContentType:  true,
+				verifyPostPolicies: true,
+				enforceObjectACL:   true,
+				lifecycleInterval:  time.Hour,
+				objectTTL:          24 * time.Hour,
+				operationLatencies: map[string]fakestorage.OperationLatency{
+					"upload":   {Min: 100 * time.Millisecond},
+					"download": {Min: 50 * time.Millisecond, Max: 200 * time.Millisecond},
+				},
+				bandwidthLimits: fakestorage.BandwidthLimits{Upload: 1048576, Download: 2097152},
+				listingDelay:    2 * time.Second,
+				chaos:           fakestorage.ChaosOptions{Probability: 0.1, MaxLatency: 500 * time.Millisecond, Seed: 42},
+				faultRules: []fakestorage.FaultRule{
+					{Type: fakestorage.FaultError, APIMethod: "storage.objects.get", Status: 503, Percentage: 10},
+					{Type: fakestorage.FaultError, APIMethod: "storage.objects.insert", Status: 429, Percentage: 2.5},
 				},
-				bucketLocation: "US-EAST1",
 			},
 		},
 		{
@@ -76,6 +129,23 @@ func TestLoadConfig(t *testing.T) {
 				bucketLocation: "US-CENTRAL1",
 			},
 		},
+		{
+			name: "both seed directory flags",
+			args: []string{"-data", "/var/gcs", "-seed-dir", "/var/seed"},
+			expectedConfig: Config{
+				Seed:       "/var/seed",
+				backend:    "filesystem",
+				fsRoot:     "/storage",
+				publicHost: "storage.googleapis.com",
+				host:       "0.0.0.0",
+				port:       4443,
+				scheme:     "https",
+				event: EventConfig{
+					list: []string{"finalize"},
+				},
+				bucketLocation: "US-CENTRAL1",
+			},
+		},
 		{
 			name:      "invalid port value type",
 			args:      []string{"-port", "not-a-number"},
@@ -96,6 +166,26 @@ func TestLoadConfig(t *testing.T) {
 			args:      []string{"-backend", "filesystem", "-filesystem-root", ""},
 			expectErr: true,
 		},
+		{
+			name:      "bolt backend with no root",
+			args:      []string{"-backend", "bolt", "-filesystem-root", ""},
+			expectErr: true,
+		},
+		{
+			name:      "syncing writes without the filesystem backend",
+			args:      []string{"-backend", "bolt", "-filesystem-sync"},
+			expectErr: true,
+		},
+		{
+			name:      "content deduplication without the bolt backend",
+			args:      []string{"-backend", "memory", "-deduplicate-content"},
+			expectErr: true,
+		},
+		{
+			name:      "s3 backend with no bucket",
+			args:      []string{"-backend", "s3", "-s3-endpoint", "http://localhost:9000"},
+			expectErr: true,
+		},
 		{
 			name:      "missing event pubsub project ID",
 			args:      []string{"-event.pubsub-topic", "gcs-events"},
@@ -106,6 +196,56 @@ func TestLoadConfig(t *testing.T) {
 			args:      []string{"-event.pubsub-project-id", "test-project"},
 			expectErr: true,
 		},
+		{
+			name:      "invalid latency operation",
+			args:      []string{"-latency", "delete=1s"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid latency duration",
+			args:      []string{"-latency", "upload=fast"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid latency range",
+			args:      []string{"-latency", "list=2s-1s"},
+			expectErr: true,
+		},
+		{
+			name:      "negative bandwidth limit",
+			args:      []string{"-download-bandwidth", "-1"},
+			expectErr: true,
+		},
+		{
+			name:      "negative object TTL",
+			args:      []string{"-object-ttl", "-1h"},
+			expectErr: true,
+		},
+		{
+			name:      "negative memory limit",
+			args:      []string{"-backend", "memory", "-memory-max-objects", "-1"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid chaos probability",
+			args:      []string{"-chaos", "-chaos-probability", "1.5"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid fault error format",
+			args:      []string{"-fault-errors", "storage.objects.get=503"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid fault error status",
+			args:      []string{"-fault-errors", "storage.objects.get=404:10"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid fault error percentage",
+			args:      []string{"-fault-errors", "storage.objects.get=503:150"},
+			expectErr: true,
+		},
 		{
 			name:      "invalid events",
 			args:      []string{"-event.list", "invalid,stuff", "-event.pubsub-topic", "gcs-events", "-event.pubsub-project-id", "test-project"},
@@ -146,10 +286,11 @@ func TestToFakeGcsOptions(t *testing.T) {
 				host:        "0.0.0.0",
 				port:        443,
 				event: EventConfig{
-					pubsubProjectID: "test-project",
-					pubsubTopic:     "gcs-events",
-					prefix:          "uploads/",
-					list:            []string{"finalize", "delete"},
+					pubsubProjectID:    "test-project",
+					pubsubTopic:        "gcs-events",
+					pubsubEmulatorHost: "localhost:8085",
+					prefix:             "uploads/",
+					list:               []string{"finalize", "delete"},
 				},
 				bucketLocation: "US-EAST1",
 			},
@@ -160,9 +301,10 @@ func TestToFakeGcsOptions(t *testing.T) {
 				Host:        "0.0.0.0",
 				Port:        443,
 				EventOptions: notification.EventManagerOptions{
-					ProjectID:    "test-project",
-					TopicName:    "gcs-events",
-					ObjectPrefix: "uploads/",
+					ProjectID:          "test-project",
+					TopicName:          "gcs-events",
+					PubsubEmulatorHost: "localhost:8085",
+					ObjectPrefix:       "uploads/",
 					NotifyOn: notification.EventNotificationOptions{
 						Finalize:       true,
 						Delete:         true,
@@ -172,6 +314,117 @@ func TestToFakeGcsOptions(t *testing.T) {
 				BucketsLocation: "US-EAST1",
 			},
 		},
+		{
+			"bolt",
+			Config{
+				backend:    "bolt",
+				fsRoot:     "/tmp/something",
+				publicHost: "127.0.0.1.nip.io:8443",
+				host:       "0.0.0.0",
+				port:       443,
+			},
+			fakestorage.Options{
+				StorageRoot: "/tmp/something",
+				BoltBackend: true,
+				PublicHost:  "127.0.0.1.nip.io:8443",
+				Host:        "0.0.0.0",
+				Port:        443,
+			},
+		},
+		{
+			"filesystem with synced writes",
+			Config{
+				backend: "filesystem",
+				fsRoot:  "/tmp/something",
+				fsSync:  true,
+				host:    "0.0.0.0",
+				port:    443,
+			},
+			fakestorage.Options{
+				StorageRoot: "/tmp/something",
+				StorageSync: true,
+				Host:        "0.0.0.0",
+				Port:        443,
+			},
+		},
+		{
+			"bolt with content deduplication",
+			Config{
+				backend:      "bolt",
+				fsRoot:       "/tmp/something",
+				dedupContent: true,
+				host:         "0.0.0.0",
+				port:         443,
+			},
+			fakestorage.Options{
+				StorageRoot:        "/tmp/something",
+				BoltBackend:        true,
+				DeduplicateContent: true,
+				Host:               "0.0.0.0",
+				Port:               443,
+			},
+		},
+		{
+			"proxy",
+			Config{
+				backend:      "bolt",
+				fsRoot:       "/tmp/something",
+				proxyBuckets: []string{"prod-fixtures"},
+				host:         "0.0.0.0",
+				port:         443,
+			},
+			fakestorage.Options{
+				StorageRoot: "/tmp/something",
+				BoltBackend: true,
+				Proxy:       fakestorage.ProxyOptions{Buckets: []string{"prod-fixtures"}},
+				Host:        "0.0.0.0",
+				Port:        443,
+			},
+		},
+		{
+			"seed directory",
+			Config{
+				Seed:             "/var/gcs",
+				seedCacheControl: "no-cache",
+				backend:          "memory",
+				host:             "0.0.0.0",
+				port:             443,
+			},
+			fakestorage.Options{
+				SeedDir:          "/var/gcs",
+				SeedCacheControl: "no-cache",
+				Host:             "0.0.0.0",
+				Port:             443,
+			},
+		},
+		{
+			"s3",
+			Config{
+				backend: "s3",
+				fsRoot:  "/tmp/something",
+				s3: fakestorage.S3Options{
+					Endpoint:        "http://localhost:9000",
+					Bucket:          "fake-gcs",
+					Region:          "us-east-1",
+					AccessKeyID:     "access-key",
+					SecretAccessKey: "secret-key",
+				},
+				host: "0.0.0.0",
+				port: 443,
+			},
+			fakestorage.Options{
+				StorageRoot: "",
+				S3: fakestorage.S3Options{
+					Endpoint:        "http://localhost:9000",
+					Bucket:          "fake-gcs",
+					Region:          "us-east-1",
+					AccessKeyID:     "access-key",
+					SecretAccessKey: "secret-key",
+				},
+				Host: "0.0.0.0",
+				Port: 443,
+			},
+		},
 		{
 			"memory",
 			Config{
@@ -204,3 +457,39 @@ func TestToFakeGcsOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadEncryptionKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load([]string{"-filesystem-encryption-key-file", keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := cfg.ToFakeGcsOptions(); !bytes.Equal(opts.StorageEncryptionKey, key) {
+		t.Errorf("wrong encryption key\nwant %q\ngot  %q", key, opts.StorageEncryptionKey)
+	}
+
+	t.Setenv(encryptionKeyEnv, base64.StdEncoding.EncodeToString(key[:16]))
+	cfg, err = Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cfg.encryptionKey, key[:16]) {
+		t.Errorf("wrong encryption key from the environment\nwant %q\ngot  %q", key[:16], cfg.encryptionKey)
+	}
+	cfg, err = Load([]string{"-backend", "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.encryptionKey != nil {
+		t.Errorf("unexpected encryption key for the memory backend: %q", cfg.encryptionKey)
+	}
+
+	t.Setenv(encryptionKeyEnv, base64.StdEncoding.EncodeToString([]byte("short")))
+	if _, err := Load(nil); err == nil {
+		t.Error("unexpected <nil> error loading an invalid encryption key")
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package notification
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// PayloadFormatJSON publishes the object resource as the payload of the
+	// messages.
+	PayloadFormatJSON = "JSON_API_V1"
+	// PayloadFormatNone publishes messages without a payload.
+	PayloadFormatNone = "NONE"
+)
+
+// Config is a notification configuration of a bucket: the events of the
+// objects in the bucket that match it are published to its topic.
+type Config struct {
+	ID               string
+	BucketName       string
+	TopicProjectID   string
+	TopicName        string
+	EventTypes       []EventType
+	CustomAttributes map[string]string
+	PayloadFormat    string
+	ObjectNamePrefix string
+}
+
+func (c Config) matches(o *backend.Object, eventType EventType) bool {
+	if o.BucketName != c.BucketName || !strings.HasPrefix(o.Name, c.ObjectNamePrefix) {
+		return false
+	}
+	if len(c.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range c.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidEventType reports whether t is one of the event types of Cloud Storage
+// notifications.
+func ValidEventType(t EventType) bool {
+	switch t {
+	case EventFinalize, EventDelete, EventMetadata, EventArchive:
+		return true
+	}
+	return false
+}
+
+// ConfigEventManager keeps the notification configurations of the buckets
+// and publishes the events that match them. Events are only published when
+// a Pub/Sub emulator is configured, either through the emulator host given
+// to NewConfigEventManager or the PUBSUB_EMULATOR_HOST environment variable.
+type ConfigEventManager struct {
+	mtx     sync.Mutex
+	configs []Config
+	lastID  int
+
+	// publishSynchronously is a flag that if true, events will be published
+	// synchronously and not in a goroutine. It is used during tests to prevent
+	// race conditions.
+	publishSynchronously bool
+	// writer is where logs are written to.
+	writer io.Writer
+	// newPublisher creates the publisher of a topic, nil when events
+	// aren't published.
+	newPublisher func(projectID, topicName string) (eventPublisher, error)
+	publishers   map[string]eventPublisher
+	// payload returns the payload of the events.
+	payload PayloadFunc
+}
+
+// NewConfigEventManager returns a manager that publishes the events of
+// bucket notification configurations through the Pub/Sub emulator at
+// emulatorHost.
+func NewConfigEventManager(emulatorHost string, payload PayloadFunc, w io.Writer) *ConfigEventManager {
+	m := &ConfigEventManager{writer: w, payload: payload}
+	if emulatorHost == "" {
+		emulatorHost = os.Getenv("PUBSUB_EMULATOR_HOST")
+	}
+	if emulatorHost != "" {
+		m.newPublisher = func(projectID, topicName string) (eventPublisher, error) {
+			client, err := newPubsubClient(context.Background(), projectID, emulatorHost)
+			if err != nil {
+				return nil, err
+			}
+			return client.Topic(topicName), nil
+		}
+	}
+	return m
+}
+
+// newPubsubClient returns a client for the given project. When emulatorHost
+// is set, the client connects to the Pub/Sub emulator at that address.
+func newPubsubClient(ctx context.Context, projectID, emulatorHost string) (*pubsub.Client, error) {
+	if emulatorHost == "" {
+		return pubsub.NewClient(ctx, projectID)
+	}
+	return pubsub.NewClient(ctx, projectID,
+		option.WithEndpoint(emulatorHost),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+}
+
+// AddConfig stores the configuration, assigning it an ID.
+func (m *ConfigEventManager) AddConfig(config Config) Config {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.lastID++
+	config.ID = strconv.Itoa(m.lastID)
+	m.configs = append(m.configs, config)
+	return config
+}
+
+// ListConfigs returns the configurations of the bucket.
+func (m *ConfigEventManager) ListConfigs(bucketName string) []Config {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var configs []Config
+	for _, config := range m.configs {
+		if config.BucketName == bucketName {
+			configs = append(configs, config)
+		}
+	}
+	return configs
+}
+
+// GetConfig returns the configuration of the bucket with the given ID.
+func (m *ConfigEventManager) GetConfig(bucketName, id string) (Config, bool) {
+	for _, config := range m.ListConfigs(bucketName) {
+		if config.ID == id {
+			return config, true
+		}
+	}
+	return Config{}, false
+}
+
+// DeleteConfig removes the configuration of the bucket with the given ID,
+// returning false if there's no such configuration.
+func (m *ConfigEventManager) DeleteConfig(bucketName, id string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for i, config := range m.configs {
+		if config.BucketName == bucketName && config.ID == id {
+			m.configs = append(m.configs[:i:i], m.configs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteBucketConfigs removes all the configurations of the bucket.
+func (m *ConfigEventManager) DeleteBucketConfigs(bucketName string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	configs := m.configs[:0]
+	for _, config := range m.configs {
+		if config.BucketName != bucketName {
+			configs = append(configs, config)
+		}
+	}
+	m.configs = configs
+}
+
+// Trigger publishes the event to the topics of the configurations that match
+// it.
+func (m *ConfigEventManager) Trigger(o *backend.Object, eventType EventType, extraEventAttr map[string]string) {
+	if m.newPublisher == nil {
+		return
+	}
+	eventTime := time.Now().Format(time.RFC3339)
+	for _, config := range m.ListConfigs(o.BucketName) {
+		if !config.matches(o, eventType) {
+			continue
+		}
+		config := config
+		publishFunc := func() {
+			err := m.publish(config, o, eventType, eventTime, extraEventAttr)
+			if m.writer != nil {
+				if err != nil {
+					fmt.Fprintf(m.writer, "error publishing event: %v", err)
+				} else {
+					fmt.Fprintf(m.writer, "sent event %s for object %s to topic %s\n", string(eventType), o.ID(), config.TopicName)
+				}
+			}
+		}
+		if m.publishSynchronously {
+			publishFunc()
+		} else {
+			go publishFunc()
+		}
+	}
+}
+
+func (m *ConfigEventManager) publisher(config Config) (eventPublisher, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key := config.TopicProjectID + "/" + config.TopicName
+	if publisher, ok := m.publishers[key]; ok {
+		return publisher, nil
+	}
+	publisher, err := m.newPublisher(config.TopicProjectID, config.TopicName)
+	if err != nil {
+		return nil, err
+	}
+	if m.publishers == nil {
+		m.publishers = make(map[string]eventPublisher)
+	}
+	m.publishers[key] = publisher
+	return publisher, nil
+}
+
+func (m *ConfigEventManager) publish(config Config, o *backend.Object, eventType EventType, eventTime string, extraEventAttr map[string]string) error {
+	attrs := map[string]string{
+		"notificationConfig": fmt.Sprintf("projects/_/buckets/%s/notificationConfigs/%s", config.BucketName, config.ID),
+	}
+	for k, v := range config.CustomAttributes {
+		attrs[k] = v
+	}
+	for k, v := range extraEventAttr {
+		attrs[k] = v
+	}
+	data, attributes, err := generateEvent(o, m.payload, eventType, eventTime, attrs)
+	if err != nil {
+		return err
+	}
+	if config.PayloadFormat == PayloadFormatNone {
+		data = nil
+		attributes["payloadFormat"] = PayloadFormatNone
+	}
+	publisher, err := m.publisher(config)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if r := publisher.Publish(ctx, &pubsub.Message{
+		Data:       data,
+		Attributes: attributes,
+	}); r != nil {
+		_, err = r.Get(ctx)
+		return err
+	}
+	return nil
+}
+
+// EventManagers triggers the events on every one of the managers.
+type EventManagers []EventManager
+
+func (m EventManagers) Trigger(o *backend.Object, eventType EventType, extraEventAttr map[string]string) {
+	for _, manager := range m {
+		manager.Trigger(o, eventType, extraEventAttr)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package notification
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/internal/backend"
+)
+
+func TestConfigEventManager_Trigger(t *testing.T) {
+	publishers := map[string]*mockPublisher{}
+	eventManager := ConfigEventManager{
+		publishSynchronously: true,
+		payload:              testPayload,
+		newPublisher: func(projectID, topicName string) (eventPublisher, error) {
+			publisher := &mockPublisher{}
+			publishers[projectID+"/"+topicName] = publisher
+			return publisher, nil
+		},
+	}
+	eventManager.AddConfig(Config{
+		BucketName:       "some-bucket",
+		TopicProjectID:   "my-project",
+		TopicName:        "uploads",
+		EventTypes:       []EventType{EventFinalize},
+		CustomAttributes: map[string]string{"team": "storage"},
+		PayloadFormat:    PayloadFormatJSON,
+		ObjectNamePrefix: "files/",
+	})
+	noPayload := eventManager.AddConfig(Config{
+		BucketName:     "some-bucket",
+		TopicProjectID: "my-project",
+		TopicName:      "everything",
+		PayloadFormat:  PayloadFormatNone,
+	})
+
+	obj := backend.Object{ObjectAttrs: backend.ObjectAttrs{BucketName: "some-bucket", Name: "files/text-01.txt"}, Content: []byte("something")}
+	eventManager.Trigger(&obj, EventFinalize, nil)
+
+	msg := publishers["my-project/uploads"].lastMessage
+	if msg == nil {
+		t.Fatal("no message published to the uploads topic")
+	}
+	expectedAttrs := map[string]string{
+		"notificationConfig": "projects/_/buckets/some-bucket/notificationConfigs/1",
+		"team":               "storage",
+		"eventType":          string(EventFinalize),
+		"bucketId":           "some-bucket",
+		"objectId":           "files/text-01.txt",
+		"payloadFormat":      PayloadFormatJSON,
+	}
+	for k, v := range expectedAttrs {
+		if msg.Attributes[k] != v {
+			t.Errorf("wrong %s attribute\nwant %q\ngot  %q", k, v, msg.Attributes[k])
+		}
+	}
+	var event testEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != obj.Name {
+		t.Errorf("wrong object name in the payload\nwant %q\ngot  %q", obj.Name, event.Name)
+	}
+
+	msg = publishers["my-project/everything"].lastMessage
+	if msg == nil {
+		t.Fatal("no message published to the everything topic")
+	}
+	if msg.Data != nil {
+		t.Errorf("unexpected payload with the %s payload format: %s", PayloadFormatNone, msg.Data)
+	}
+	if msg.Attributes["payloadFormat"] != PayloadFormatNone {
+		t.Errorf("wrong payloadFormat attribute\nwant %q\ngot  %q", PayloadFormatNone, msg.Attributes["payloadFormat"])
+	}
+
+	// the first configuration filters the event type and the object name
+	// prefix.
+	publishers["my-project/uploads"].lastMessage = nil
+	eventManager.Trigger(&obj, EventDelete, nil)
+	other := backend.Object{ObjectAttrs: backend.ObjectAttrs{BucketName: "some-bucket", Name: "other.txt"}}
+	eventManager.Trigger(&other, EventFinalize, nil)
+	if msg := publishers["my-project/uploads"].lastMessage; msg != nil {
+		t.Errorf("unexpected message published to the uploads topic: %v", msg.Attributes)
+	}
+
+	if !eventManager.DeleteConfig("some-bucket", noPayload.ID) {
+		t.Fatal("failed to delete the configuration")
+	}
+	publishers["my-project/everything"].lastMessage = nil
+	eventManager.Trigger(&obj, EventDelete, nil)
+	if msg := publishers["my-project/everything"].lastMessage; msg != nil {
+		t.Errorf("unexpected message published after deleting the configuration: %v", msg.Attributes)
+	}
+}
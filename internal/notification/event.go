@@ -49,12 +49,20 @@ type EventManagerOptions struct {
 	ObjectPrefix string
 	// NotifyOn determines what events to trigger.
 	NotifyOn EventNotificationOptions
+	// PubsubEmulatorHost, if not empty, is the address of the Pub/Sub
+	// emulator events are published to.
+	PubsubEmulatorHost string
 }
 
 type EventManager interface {
 	Trigger(o *backend.Object, eventType EventType, extraEventAttr map[string]string)
 }
 
+// PayloadFunc returns the resource of the object sent as the JSON payload of
+// its events, which is the object resource returned by the JSON API:
+// https://cloud.google.com/storage/docs/json_api/v1/objects#resource-representations.
+type PayloadFunc func(o *backend.Object) interface{}
+
 // PubsubEventManager checks if an event should be published.
 type PubsubEventManager struct {
 	// publishSynchronously is a flag that if true, events will be published
@@ -70,17 +78,20 @@ type PubsubEventManager struct {
 	objectPrefix string
 	//  publisher is used to publish events on.
 	publisher eventPublisher
+	// payload returns the payload of the events.
+	payload PayloadFunc
 }
 
-func NewPubsubEventManager(options EventManagerOptions, w io.Writer) (*PubsubEventManager, error) {
+func NewPubsubEventManager(options EventManagerOptions, payload PayloadFunc, w io.Writer) (*PubsubEventManager, error) {
 	manager := &PubsubEventManager{
 		writer:       w,
 		notifyOn:     options.NotifyOn,
 		objectPrefix: options.ObjectPrefix,
+		payload:      payload,
 	}
 	if options.ProjectID != "" && options.TopicName != "" {
 		ctx := context.Background()
-		client, err := pubsub.NewClient(ctx, options.ProjectID)
+		client, err := newPubsubClient(ctx, options.ProjectID, options.PubsubEmulatorHost)
 		if err != nil {
 			return nil, fmt.Errorf("error creating pubsub client: %v", err)
 		}
@@ -141,7 +152,7 @@ func (m *PubsubEventManager) Trigger(o *backend.Object, eventType EventType, ext
 
 func (m *PubsubEventManager) publish(o *backend.Object, eventType EventType, eventTime string, extraEventAttr map[string]string) error {
 	ctx := context.Background()
-	data, attributes, err := generateEvent(o, eventType, eventTime, extraEventAttr)
+	data, attributes, err := generateEvent(o, m.payload, eventType, eventTime, extraEventAttr)
 	if err != nil {
 		return err
 	}
@@ -155,43 +166,7 @@ func (m *PubsubEventManager) publish(o *backend.Object, eventType EventType, eve
 	return nil
 }
 
-// gcsEvent is the payload of a GCS event.  The description of the full object
-// can be found here:
-// https://cloud.google.com/storage/docs/json_api/v1/objects#resource-representations.
-type gcsEvent struct {
-	Kind            string            `json:"kind"`
-	ID              string            `json:"id"`
-	Name            string            `json:"name"`
-	Bucket          string            `json:"bucket"`
-	Generation      int64             `json:"generation,omitempty"`
-	ContentType     string            `json:"contentType"`
-	ContentEncoding string            `json:"contentEncoding,omitempty"`
-	Created         string            `json:"timeCreated,omitempty"`
-	Updated         string            `json:"updated,omitempty"`
-	StorageClass    string            `json:"storageClass"`
-	Size            string            `json:"size"`
-	MD5Hash         string            `json:"md5Hash,omitempty"`
-	CRC32c          string            `json:"crc32c,omitempty"`
-	MetaData        map[string]string `json:"metadata,omitempty"`
-}
-
-func generateEvent(o *backend.Object, eventType EventType, eventTime string, extraEventAttr map[string]string) ([]byte, map[string]string, error) {
-	payload := gcsEvent{
-		Kind:            "storage#object",
-		ID:              o.ID(),
-		Name:            o.Name,
-		Bucket:          o.BucketName,
-		Generation:      o.Generation,
-		ContentType:     o.ContentType,
-		ContentEncoding: o.ContentEncoding,
-		Created:         o.Created,
-		Updated:         o.Updated,
-		StorageClass:    "STANDARD",
-		Size:            strconv.Itoa(len(o.Content)),
-		MD5Hash:         o.Md5Hash,
-		CRC32c:          o.Crc32c,
-		MetaData:        o.Metadata,
-	}
+func generateEvent(o *backend.Object, payload PayloadFunc, eventType EventType, eventTime string, extraEventAttr map[string]string) ([]byte, map[string]string, error) {
 	attributes := map[string]string{
 		"bucketId":         o.BucketName,
 		"eventTime":        eventTime,
@@ -206,7 +181,7 @@ func generateEvent(o *backend.Object, eventType EventType, eventTime string, ext
 		}
 		attributes[k] = v
 	}
-	data, err := json.Marshal(&payload)
+	data, err := json.Marshal(payload(o))
 	if err != nil {
 		return nil, nil, err
 	}
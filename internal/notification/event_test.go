@@ -24,6 +24,19 @@ func (m *mockPublisher) Publish(ctx context.Context, msg *pubsub.Message) *pubsu
 	return nil
 }
 
+// testEvent is the payload built by testPayload, with the fields of the
+// object resource checked by the tests.
+type testEvent struct {
+	Name     string            `json:"name"`
+	Bucket   string            `json:"bucket"`
+	Size     string            `json:"size"`
+	MetaData map[string]string `json:"metadata,omitempty"`
+}
+
+func testPayload(o *backend.Object) interface{} {
+	return testEvent{Name: o.Name, Bucket: o.BucketName, Size: strconv.Itoa(len(o.Content)), MetaData: o.Metadata}
+}
+
 func TestPubsubEventManager_Trigger(t *testing.T) {
 	newMetadata := map[string]string{
 		"1-key": "1.1-value",
@@ -99,6 +112,7 @@ func TestPubsubEventManager_Trigger(t *testing.T) {
 			eventManager := PubsubEventManager{
 				notifyOn:     test.notifyOn,
 				objectPrefix: test.prefix,
+				payload:      testPayload,
 			}
 			publisher := &mockPublisher{}
 			eventManager.publisher = publisher
@@ -125,7 +139,7 @@ func TestPubsubEventManager_Trigger(t *testing.T) {
 					if test.eventType != receivedMessage.Attributes["eventType"] {
 						t.Errorf("wrong event type\nwant %q\ngot %q", test.eventType, receivedMessage.Attributes["eventType"])
 					}
-					var receivedEvent gcsEvent
+					var receivedEvent testEvent
 					if err := json.Unmarshal(receivedMessage.Data, &receivedEvent); err != nil {
 						t.Errorf("invalid event payload: %v", err)
 					}
@@ -6,21 +6,25 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"log"
-	"mime"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
 
 	"github.com/fsouza/fake-gcs-server/fakestorage"
-	"github.com/fsouza/fake-gcs-server/internal/checksum"
 	"github.com/fsouza/fake-gcs-server/internal/config"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:], os.Stdout); err != nil && err != flag.ErrHelp {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	cfg, err := config.Load(os.Args[1:])
 	if err == flag.ErrHelp {
 		return
@@ -30,78 +34,54 @@ func main() {
 	}
 	logger := logrus.New()
 
-	var emptyBuckets []string
-	opts := cfg.ToFakeGcsOptions()
-	if cfg.Seed != "" {
-		opts.InitialObjects, emptyBuckets = generateObjectsFromFiles(logger, cfg.Seed)
-	}
-
-	server, err := fakestorage.NewServerWithOptions(opts)
+	server, err := fakestorage.NewServerWithOptions(cfg.ToFakeGcsOptions())
 	if err != nil {
 		logger.WithError(err).Fatal("couldn't start the server")
 	}
 	logger.Infof("server started at %s", server.URL())
-	for _, bucketName := range emptyBuckets {
-		server.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: bucketName})
+	if cfg.RestoreFile != "" {
+		if err := restoreSnapshot(server, cfg.RestoreFile); err != nil {
+			logger.WithError(err).Fatalf("couldn't restore the snapshot %q", cfg.RestoreFile)
+		}
+		logger.Infof("restored the snapshot %q", cfg.RestoreFile)
 	}
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	<-ch
-}
-
-func generateObjectsFromFiles(logger *logrus.Logger, folder string) ([]fakestorage.Object, []string) {
-	var objects []fakestorage.Object
-	var emptyBuckets []string
-	if files, err := os.ReadDir(folder); err == nil {
-		for _, f := range files {
-			if !f.IsDir() {
-				continue
-			}
-			bucketName := f.Name()
-			localBucketPath := filepath.Join(folder, bucketName)
 
-			bucketObjects, err := objectsFromBucket(localBucketPath, bucketName)
-			if err != nil {
-				logger.WithError(err).Warnf("couldn't read files from %q, skipping (make sure it's a directory)", localBucketPath)
-				continue
-			}
-
-			if len(bucketObjects) < 1 {
-				emptyBuckets = append(emptyBuckets, bucketName)
-			}
-			objects = append(objects, bucketObjects...)
+	if cfg.SnapshotFile != "" {
+		if err := writeSnapshot(server, cfg.SnapshotFile); err != nil {
+			logger.WithError(err).Fatalf("couldn't write the snapshot %q", cfg.SnapshotFile)
 		}
+		logger.Infof("wrote the snapshot %q", cfg.SnapshotFile)
 	}
-	if len(objects) == 0 && len(emptyBuckets) == 0 {
-		logger.Infof("couldn't load any objects or buckets from %q, starting empty", folder)
+	server.Stop()
+}
+
+func restoreSnapshot(server *fakestorage.Server, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
-	return objects, emptyBuckets
+	defer f.Close()
+	return server.Restore(f)
 }
 
-func objectsFromBucket(localBucketPath, bucketName string) ([]fakestorage.Object, error) {
-	var objects []fakestorage.Object
-	err := filepath.Walk(localBucketPath, func(path string, info os.FileInfo, _ error) error {
-		if info.Mode().IsRegular() {
-			// Rel() should never return error since path always descend from localBucketPath
-			relPath, _ := filepath.Rel(localBucketPath, path)
-			objectKey := filepath.ToSlash(relPath)
-			fileContent, err := os.ReadFile(path)
-			if err != nil {
-				return fmt.Errorf("could not read file %q: %w", path, err)
-			}
-			objects = append(objects, fakestorage.Object{
-				ObjectAttrs: fakestorage.ObjectAttrs{
-					BucketName:  bucketName,
-					Name:        objectKey,
-					ContentType: mime.TypeByExtension(filepath.Ext(path)),
-					Crc32c:      checksum.EncodedCrc32cChecksum(fileContent),
-					Md5Hash:     checksum.EncodedMd5Hash(fileContent),
-				},
-				Content: fileContent,
-			})
-		}
-		return nil
-	})
-	return objects, err
+// writeSnapshot writes the snapshot to a temporary file that replaces the
+// given one when complete, so a failure doesn't leave a partial snapshot.
+func writeSnapshot(server *fakestorage.Server, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := server.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
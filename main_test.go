@@ -12,13 +12,18 @@ import (
 	"testing"
 
 	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/fsouza/fake-gcs-server/internal/config"
 	"github.com/google/go-cmp/cmp"
-	"github.com/google/go-cmp/cmp/cmpopts"
-	"github.com/sirupsen/logrus"
 )
 
 const testContentType = "text/plain; charset=utf-8"
 
+type seededObject struct {
+	bucketName string
+	name       string
+	content    string
+}
+
 func TestMain(m *testing.M) {
 	mime.AddExtensionType(".txt", testContentType)
 	const emptyBucketDir = "testdata/basic/empty-bucket"
@@ -34,58 +39,31 @@ func TestMain(m *testing.M) {
 	status = m.Run()
 }
 
-func TestGenerateObjectsFromFiles(t *testing.T) {
+func TestSeedDirFlag(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
-		name                 string
-		folder               string
-		expectedObjects      []fakestorage.Object
-		expectedEmptyBuckets []string
+		name            string
+		folder          string
+		expectedObjects []seededObject
+		expectedBuckets []string
 	}{
 		{
 			name:   "should load from sample folder",
 			folder: "testdata/basic",
-			expectedObjects: []fakestorage.Object{
-				{
-					ObjectAttrs: fakestorage.ObjectAttrs{
-						BucketName:  "sample-bucket",
-						Name:        "some_file.txt",
-						ContentType: testContentType,
-					},
-					Content: []byte("Some amazing content to be loaded"),
-				},
+			expectedObjects: []seededObject{
+				{bucketName: "sample-bucket", name: "some_file.txt", content: "Some amazing content to be loaded"},
 			},
-			expectedEmptyBuckets: []string{"empty-bucket"},
+			expectedBuckets: []string{"empty-bucket", "sample-bucket"},
 		},
 		{
 			name:   "should support multiple levels",
 			folder: "testdata/multi-level",
-			expectedObjects: []fakestorage.Object{
-				{
-					ObjectAttrs: fakestorage.ObjectAttrs{
-						BucketName:  "some-bucket",
-						Name:        "a/b/c/d/e/f/object1.txt",
-						ContentType: testContentType,
-					},
-					Content: []byte("this is object 1\n"),
-				},
-				{
-					ObjectAttrs: fakestorage.ObjectAttrs{
-						BucketName:  "some-bucket",
-						Name:        "a/b/c/d/e/f/object2.txt",
-						ContentType: testContentType,
-					},
-					Content: []byte("this is object 2\n"),
-				},
-				{
-					ObjectAttrs: fakestorage.ObjectAttrs{
-						BucketName:  "some-bucket",
-						Name:        "root-object.txt",
-						ContentType: testContentType,
-					},
-					Content: []byte("r00t\n"),
-				},
+			expectedObjects: []seededObject{
+				{bucketName: "some-bucket", name: "a/b/c/d/e/f/object1.txt", content: "this is object 1\n"},
+				{bucketName: "some-bucket", name: "a/b/c/d/e/f/object2.txt", content: "this is object 2\n"},
+				{bucketName: "some-bucket", name: "root-object.txt", content: "r00t\n"},
 			},
+			expectedBuckets: []string{"some-bucket"},
 		},
 		{
 			name:   "should skip inexistent folder",
@@ -98,40 +76,13 @@ func TestGenerateObjectsFromFiles(t *testing.T) {
 		{
 			name:   "should skip invalid directories and files",
 			folder: "testdata/chaos",
-			expectedObjects: []fakestorage.Object{
-				{
-					ObjectAttrs: fakestorage.ObjectAttrs{
-						BucketName:  "bucket1",
-						Name:        "object1.txt",
-						ContentType: testContentType,
-					},
-					Content: []byte("object 1\n"),
-				},
-				{
-					ObjectAttrs: fakestorage.ObjectAttrs{
-						BucketName:  "bucket1",
-						Name:        "object2.txt",
-						ContentType: testContentType,
-					},
-					Content: []byte("object 2\n"),
-				},
-				{
-					ObjectAttrs: fakestorage.ObjectAttrs{
-						BucketName:  "bucket2",
-						Name:        "object1.txt",
-						ContentType: testContentType,
-					},
-					Content: []byte("object 1\n"),
-				},
-				{
-					ObjectAttrs: fakestorage.ObjectAttrs{
-						BucketName:  "bucket2",
-						Name:        "object2.txt",
-						ContentType: testContentType,
-					},
-					Content: []byte("object 2\n"),
-				},
+			expectedObjects: []seededObject{
+				{bucketName: "bucket1", name: "object1.txt", content: "object 1\n"},
+				{bucketName: "bucket1", name: "object2.txt", content: "object 2\n"},
+				{bucketName: "bucket2", name: "object1.txt", content: "object 1\n"},
+				{bucketName: "bucket2", name: "object2.txt", content: "object 2\n"},
 			},
+			expectedBuckets: []string{"bucket1", "bucket2"},
 		},
 	}
 
@@ -139,18 +90,46 @@ func TestGenerateObjectsFromFiles(t *testing.T) {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
-			logger := discardLogger()
+			cfg, err := config.Load([]string{"-backend", "memory", "-data", test.folder})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := cfg.ToFakeGcsOptions()
+			opts.NoListener = true
+			server, err := fakestorage.NewServerWithOptions(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
 
-			objects, emptyBuckets := generateObjectsFromFiles(logger, test.folder)
-			cmpOpts := []cmp.Option{
-				cmpopts.IgnoreFields(fakestorage.Object{}, "Crc32c", "Md5Hash"),
-				cmpopts.IgnoreUnexported(fakestorage.Object{}),
+			stats, err := server.Stats()
+			if err != nil {
+				t.Fatal(err)
 			}
-			if diff := cmp.Diff(objects, test.expectedObjects, cmpOpts...); diff != "" {
-				t.Errorf("wrong list of objects returned\nwant %#v\ngot  %#v\ndiff: %s", test.expectedObjects, objects, diff)
+			var buckets []string
+			var objects []seededObject
+			for _, bucket := range stats.Buckets {
+				buckets = append(buckets, bucket.Name)
+				attrs, _, err := server.ListObjects(bucket.Name, "", "", false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, attr := range attrs {
+					obj, err := server.GetObject(attr.BucketName, attr.Name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if obj.ContentType != testContentType {
+						t.Errorf("wrong content type of %s\nwant %q\ngot  %q", obj.Name, testContentType, obj.ContentType)
+					}
+					objects = append(objects, seededObject{bucketName: obj.BucketName, name: obj.Name, content: string(obj.Content)})
+				}
 			}
-			if diff := cmp.Diff(emptyBuckets, test.expectedEmptyBuckets); diff != "" {
-				t.Errorf("wrong list of empty buckets returned\nwant %#v\ngot  %#v", test.expectedEmptyBuckets, emptyBuckets)
+			if diff := cmp.Diff(objects, test.expectedObjects, cmp.AllowUnexported(seededObject{})); diff != "" {
+				t.Errorf("wrong list of objects seeded\nwant %#v\ngot  %#v\ndiff: %s", test.expectedObjects, objects, diff)
+			}
+			if diff := cmp.Diff(buckets, test.expectedBuckets); diff != "" {
+				t.Errorf("wrong list of buckets created\nwant %#v\ngot  %#v", test.expectedBuckets, buckets)
 			}
 		})
 	}
@@ -176,10 +155,3 @@ func ensureEmptyDir(dirname string) error {
 	}
 	return nil
 }
-
-func discardLogger() *logrus.Logger {
-	logger := logrus.New()
-	logger.Out = io.Discard
-	logger.Level = logrus.PanicLevel
-	return logger
-}